@@ -0,0 +1,47 @@
+package epub
+
+import (
+	"path"
+	"strings"
+)
+
+// AltTextIssue is an <img> element of a section that doesn't have an alt
+// attribute, as reported by AuditAltText.
+type AltTextIssue struct {
+	File string // The internal path of the section, e.g. xhtml/section0001.xhtml
+	Line int    // The line of the <img> tag in the section file, starting at 1
+	Tag  string // The <img> tag
+}
+
+// AuditAltText returns the <img> elements of the sections that don't have an
+// alt attribute, in the order of the sections, so that the text alternatives
+// required by accessibility guidelines can be added before the EPUB is
+// published. Decorative images should have an empty alt attribute (alt="")
+// rather than none.
+func (e *Epub) AuditAltText() []AltTextIssue {
+	e.Lock()
+	defer e.Unlock()
+
+	issues := []AltTextIssue{}
+	altRegex := attributeRegex("alt")
+	e.forEachSection(func(s *epubSection) {
+		body := s.xhtml.xml.Body.XML
+		bodyLine := 0
+		for _, loc := range imgTagRegex.FindAllStringIndex(body, -1) {
+			tag := body[loc[0]:loc[1]]
+			if altRegex.MatchString(tag) {
+				continue
+			}
+			// The body is written as is, so lines are counted from its start
+			if bodyLine == 0 {
+				bodyLine = s.xhtml.bodyLine()
+			}
+			issues = append(issues, AltTextIssue{
+				File: path.Join(xhtmlFolderName, s.filename),
+				Line: bodyLine + strings.Count(body[:loc[0]], "\n"),
+				Tag:  tag,
+			})
+		}
+	})
+	return issues
+}
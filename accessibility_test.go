@@ -0,0 +1,57 @@
+package epub
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+)
+
+func TestAuditAltText(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	testImagePath, err := e.AddImage(testImageFromFileSource, "")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	// The default cover page has alt text
+	e.SetCover(testImagePath, "")
+	testSectionPath, err := e.AddSection(`<h1>Section 1</h1>
+<p><img src="`+testImagePath+`" alt="Gopher"/></p>
+<p><img src="`+testImagePath+`"/></p>
+<p><img src="`+testImagePath+`" alt=""/></p>`, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	testSubSectionPath, err := e.AddSubSection(testSectionPath, `<img
+  src="`+testImagePath+`" />`, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+
+	issues := e.AuditAltText()
+	if len(issues) != 2 {
+		t.Fatalf("Got %d issues, expected 2: %+v", len(issues), issues)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	for i, sectionPath := range []string{testSectionPath, testSubSectionPath} {
+		wantFile := filepath.ToSlash(filepath.Join(xhtmlFolderName, filepath.Base(sectionPath)))
+		if issues[i].File != wantFile {
+			t.Errorf("Got issue in %s, expected %s", issues[i].File, wantFile)
+		}
+		contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, wantFile))
+		if err != nil {
+			t.Fatalf("Unexpected error reading section file: %s", err)
+		}
+		lines := strings.Split(string(contents), "\n")
+		if issues[i].Line < 1 || issues[i].Line > len(lines) || !strings.Contains(lines[issues[i].Line-1], "<img") {
+			t.Errorf("Line %d of %s doesn't contain the <img> tag: %s", issues[i].Line, wantFile, contents)
+		}
+		if !strings.HasPrefix(issues[i].Tag, "<img") || strings.Contains(issues[i].Tag, "alt=") {
+			t.Errorf("Got tag %q, expected an <img> tag without alt text", issues[i].Tag)
+		}
+	}
+}
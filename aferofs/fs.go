@@ -0,0 +1,55 @@
+// Package aferofs implements the Storage interface for afero filesystems, so
+// that any afero.Fs (e.g. afero.NewMemMapFs or a layered filesystem) can be
+// used to build EPUBs:
+//
+//	e := epub.NewEpub("My title", epub.WithCustomStorage(aferofs.New(afero.NewMemMapFs())))
+package aferofs
+
+import (
+	"io/fs"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+	"github.com/spf13/afero"
+)
+
+// AferoFS is a storage backed by an afero filesystem.
+type AferoFS struct {
+	fs   afero.Fs
+	iofs afero.IOFS
+}
+
+// New returns a storage backed by the afero filesystem.
+func New(fs afero.Fs) *AferoFS {
+	return &AferoFS{
+		fs:   fs,
+		iofs: afero.NewIOFS(fs),
+	}
+}
+
+func (a *AferoFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return afero.WriteFile(a.fs, name, data, perm)
+}
+
+func (a *AferoFS) Mkdir(name string, perm fs.FileMode) error {
+	return a.fs.Mkdir(name, perm)
+}
+
+func (a *AferoFS) RemoveAll(name string) error {
+	return a.fs.RemoveAll(name)
+}
+
+func (a *AferoFS) Create(name string) (storage.File, error) {
+	return a.fs.Create(name)
+}
+
+func (a *AferoFS) Stat(name string) (fs.FileInfo, error) {
+	return a.iofs.Stat(name)
+}
+
+func (a *AferoFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return a.iofs.ReadDir(name)
+}
+
+func (a *AferoFS) Open(name string) (fs.File, error) {
+	return a.iofs.Open(name)
+}
@@ -0,0 +1,49 @@
+package aferofs_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"github.com/bmaupin/go-epub"
+	"github.com/bmaupin/go-epub/aferofs"
+	"github.com/spf13/afero"
+)
+
+func TestAferoFS(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	e := epub.NewEpub("My title", epub.WithCustomStorage(aferofs.New(fs)))
+	if _, err := e.AddImage("../testdata/gophercolor16x16.png", ""); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	if _, err := e.AddSection("<h1>Section 1</h1>", "Section 1", "", ""); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	names := make(map[string]bool)
+	for _, f := range r.File {
+		names[f.Name] = true
+	}
+	for _, name := range []string{"mimetype", "META-INF/container.xml", "EPUB/package.opf", "EPUB/images/gophercolor16x16.png", "EPUB/xhtml/section0001.xhtml"} {
+		if !names[name] {
+			t.Errorf("%s not found in the EPUB", name)
+		}
+	}
+
+	// The files of the build are removed once the EPUB is written
+	entries, err := afero.ReadDir(fs, ".")
+	if err != nil {
+		t.Fatalf("Unexpected error reading the storage: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Got %d files left in the storage, expected none", len(entries))
+	}
+}
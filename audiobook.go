@@ -0,0 +1,102 @@
+package epub
+
+import (
+	"fmt"
+	"html"
+	"path"
+	"time"
+)
+
+// Body of the XHTML page of an audio track, shown by reading systems that can't
+// play the audio from the spine
+const audioTrackBodyFormat = `<h1>%[1]s</h1>
+<audio controls="controls" src="%[2]s">
+  <a href="%[2]s">%[1]s</a>
+</audio>`
+
+// AddAudioTrack adds a track of an audiobook and returns the internal filename
+// of its page, like AddSection. Audiobooks follow the EPUB 3 audio profile: the
+// audio is part of the spine, in the order the tracks are added, and the page,
+// which plays the audio, is its fallback for reading systems that only support
+// XHTML in the spine. The title is used for the page and the table of
+// contents; if no title is provided, the track will not be added to the table
+// of contents.
+//
+// The duration of the track is added to the metadata (media:duration) if it's
+// not zero, along with the duration of the whole audiobook if all the tracks
+// have one.
+//
+// The source is retrieved like the source of AddAudio, and the same errors are
+// returned. If the audio is skipped when the EPUB is written (see
+// SetMediaFailurePolicy), the page takes its place in the spine.
+func (e *Epub) AddAudioTrack(source string, title string, duration time.Duration) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	audioPath, err := addMedia(e.grabber(), source, "", audioFileFormat, AudioFolderName, e.audios)
+	if err != nil {
+		return "", err
+	}
+	body := fmt.Sprintf(audioTrackBodyFormat, html.EscapeString(title), html.EscapeString(audioPath))
+	filename, err := e.addSection("", body, title, "", "")
+	if err != nil {
+		delete(e.audios, path.Base(audioPath))
+		return "", err
+	}
+	s := e.findSection(filename)
+	s.audio = path.Base(audioPath)
+	s.audioDuration = duration
+	return filename, nil
+}
+
+// addSectionToSpine adds a section to the spine. The audio of an audio track
+// (see AddAudioTrack) is added instead, with the section as fallback, unless
+// the audio isn't part of the manifest.
+func (e *Epub) addSectionToSpine(s *epubSection) {
+	id := s.filename
+	if s.audio != "" {
+		audioID := SanitizeXMLID(s.audio)
+		if e.pkg.setFallback(audioID, s.filename) {
+			id = audioID
+			if s.audioDuration > 0 {
+				e.pkg.setDuration("#"+audioID, clockValue(s.audioDuration))
+			}
+		}
+	}
+	e.pkg.addToSpine(id, !s.nonLinear, s.spineProperties)
+}
+
+// setTotalDuration sets the duration of the EPUB to the total duration of its
+// audio tracks and media overlays, if there are some and the tracks all have a
+// duration. The class of the element being read aloud is set as well if there
+// are media overlays. Nothing is set in Kindle compatibility mode, which leaves
+// the audio out.
+func (e *Epub) setTotalDuration() {
+	if e.kindle {
+		return
+	}
+	var total time.Duration
+	timed, unknown, overlays := false, false, false
+	e.forEachSection(func(s *epubSection) {
+		if s.audio != "" {
+			timed = true
+			total += s.audioDuration
+			unknown = unknown || s.audioDuration <= 0
+		}
+		if s.mediaOverlay != nil {
+			timed, overlays = true, true
+			total += s.mediaOverlay.duration
+		}
+	})
+	if timed && !unknown {
+		e.pkg.setDuration("", clockValue(total))
+	}
+	if overlays {
+		e.pkg.setActiveClass(mediaOverlayActiveClass)
+	}
+}
+
+// clockValue returns the duration as a SMIL clock value, e.g. 1:02:03.500
+func clockValue(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	return fmt.Sprintf("%d:%02d:%02d.%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Milliseconds()%1000)
+}
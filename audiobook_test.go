@@ -0,0 +1,79 @@
+package epub
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddAudioTrack(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	first, err := e.AddAudioTrack(testAudioFromFileSource, "Chapter <1>", 90*time.Second+500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddAudioTrack(testAudioFromFileSource, "Chapter 2", time.Hour+2*time.Minute+3*time.Second); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddAudioTrack("testdata/missing.mp3", "Missing", 0); err == nil {
+		t.Error("Expected an error for a missing audio file")
+	}
+
+	opf, err := e.DumpOPF()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`<item id="sample_audio.wav" href="audios/sample_audio.wav" media-type="audio/wav" fallback="` + first + `"></item>`,
+		`<itemref idref="sample_audio.wav"></itemref>`,
+		`<itemref idref="audio0002.wav"></itemref>`,
+		`<meta refines="#sample_audio.wav" property="media:duration">0:01:30.500</meta>`,
+		`<meta refines="#audio0002.wav" property="media:duration">1:02:03.000</meta>`,
+		`<meta property="media:duration">1:03:33.500</meta>`,
+	} {
+		if !strings.Contains(opf, expected) {
+			t.Errorf("Package file doesn't contain %s:\n%s", expected, opf)
+		}
+	}
+	if strings.Contains(opf, `<itemref idref="`+first+`"`) {
+		t.Errorf("Track page in the spine:\n%s", opf)
+	}
+
+	nav, err := e.DumpNav()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(nav, `<a href="xhtml/`+first+`">Chapter &lt;1&gt;</a>`) {
+		t.Errorf("Track not in the table of contents:\n%s", nav)
+	}
+
+	// The total duration is left out if a track has none
+	if _, err := e.AddAudioTrack(testAudioFromFileSource, "Chapter 3", 0); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if opf, err := e.DumpOPF(); err != nil || strings.Contains(opf, `<meta property="media:duration">`) {
+		t.Errorf("Unexpected total duration or error %v:\n%s", err, opf)
+	}
+
+	findings, err := e.Validate()
+	if err != nil {
+		t.Fatalf("Unexpected error validating EPUB: %s", err)
+	}
+	for _, finding := range findings {
+		t.Errorf("Unexpected finding: %s", finding)
+	}
+}
+
+func TestClockValue(t *testing.T) {
+	testCases := map[time.Duration]string{
+		0:                            "0:00:00.000",
+		1500 * time.Microsecond:      "0:00:00.002",
+		59*time.Minute + time.Second: "0:59:01.000",
+		27 * time.Hour:               "27:00:00.000",
+	}
+	for d, expected := range testCases {
+		if got := clockValue(d); got != expected {
+			t.Errorf("clockValue(%s) = %s, expected %s", d, got, expected)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package epub
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	bibliographyType = "bibliography"
+	// <li> element of a reference, the backlinks go after the citation
+	bibliographyEntryFormat = `  <li id="%s" epub:type="biblioentry">%s%s</li>
+`
+	// Backlink to a citation of a reference from a bibliography
+	bibliographyBacklinkFormat = ` <a href="%s" epub:type="backlink">&#8617;</a>`
+	// Citation of a reference returned by Cite, labeled by the number of the
+	// reference
+	citationFormat   = `<a id="%s" href="%s" epub:type="biblioref">[%d]</a>`
+	citationIDFormat = "cite%04d"
+)
+
+// anchorTagRegexp matches the opening tags of the <a> elements of sections
+var anchorTagRegexp = regexp.MustCompile(`(?is)<a\b[^>]*>`)
+
+// InvalidReferenceError is thrown by AddBibliographySection if a reference has
+// an ID that isn't a valid XML ID or is the same as the ID of another
+// reference.
+type InvalidReferenceError struct {
+	Index int   // Index of the reference
+	Err   error // Underlying error
+}
+
+func (e *InvalidReferenceError) Error() string {
+	return fmt.Sprintf("Invalid reference %d: %s", e.Index, e.Err)
+}
+
+func (e *InvalidReferenceError) Unwrap() error {
+	return e.Err
+}
+
+// ReferenceDoesNotExistError is thrown by Cite if the bibliography doesn't
+// have a reference with the given ID.
+type ReferenceDoesNotExistError struct {
+	Filename string // Internal filename of the bibliography
+	ID       string // ID that caused the error
+}
+
+func (e *ReferenceDoesNotExistError) Error() string {
+	return fmt.Sprintf("Reference %s does not exist in bibliography %s", e.ID, e.Filename)
+}
+
+// Reference is a reference of a bibliography (see AddBibliographySection).
+type Reference struct {
+	// ID of the reference, which is used to cite it (see Cite), e.g. knuth1984
+	ID string
+	// Citation of the reference, which must be valid XHTML, e.g.
+	// Knuth, D. E. (1984). <i>Literate Programming</i>. The content will not
+	// be validated.
+	Citation string
+}
+
+// AddBibliographySection adds a bibliography section with the references to
+// the EPUB and returns a relative path to the section, like AddSection. The
+// body of the section is marked as a bibliography (epub:type="bibliography")
+// and lists the references in order, each one being followed by links back to
+// the places it's cited from (see Cite). The backlinks are added when the EPUB
+// is written.
+//
+// The same errors as AddSection are returned. If a reference has an ID that
+// isn't a valid XML ID (see SanitizeXMLID) or the same ID as another reference,
+// InvalidReferenceError will be returned.
+func (e *Epub) AddBibliographySection(references []Reference, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	ids := make(map[string]bool)
+	for i, reference := range references {
+		if reference.ID == "" || SanitizeXMLID(reference.ID) != reference.ID {
+			return "", &InvalidReferenceError{Index: i, Err: fmt.Errorf("invalid ID %q", reference.ID)}
+		}
+		if ids[reference.ID] {
+			return "", &InvalidReferenceError{Index: i, Err: errors.New("ID " + reference.ID + " already used")}
+		}
+		ids[reference.ID] = true
+	}
+
+	filename, err := e.addSection("", "", sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	s := e.findSection(filename)
+	s.xhtml.setEpubType(bibliographyType)
+	s.references = append([]Reference{}, references...)
+	s.xhtml.setBody(e.bibliographyBody(s))
+	return filename, nil
+}
+
+// Cite returns a citation of the reference with the ID, which can be used in
+// the body of a section (see AddSection). The citation is a link to the
+// reference in the bibliography with the internal filename, labeled with the
+// number of the reference, e.g. [1]. It has a unique ID, so that the
+// bibliography links back to it.
+//
+// If no bibliography with the internal filename exists (see
+// AddBibliographySection), SectionDoesNotExistError will be returned. If the
+// bibliography doesn't have a reference with the ID,
+// ReferenceDoesNotExistError will be returned.
+func (e *Epub) Cite(bibliographyFilename string, id string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	s := e.findSection(bibliographyFilename)
+	if s == nil || s.references == nil {
+		return "", &SectionDoesNotExistError{Filename: bibliographyFilename}
+	}
+	for i, reference := range s.references {
+		if reference.ID == id {
+			e.citations++
+			citationID := fmt.Sprintf(citationIDFormat, e.citations)
+			return fmt.Sprintf(citationFormat, citationID, html.EscapeString(s.filename+"#"+id), i+1), nil
+		}
+	}
+	return "", &ReferenceDoesNotExistError{Filename: bibliographyFilename, ID: id}
+}
+
+// backlinks returns, by fragment, the targets of the links back to the links
+// with an ID that point to the section with the filename, e.g.
+// section0001.xhtml#cite0001 for knuth1984 if section0001.xhtml cites the
+// reference with that ID
+func (e *Epub) backlinks(internalFilename string) map[string][]string {
+	targetPath := path.Join(xhtmlFolderName, internalFilename)
+	backlinks := make(map[string][]string)
+	e.forEachSection(func(s *epubSection) {
+		sectionPath := path.Join(xhtmlFolderName, s.filename)
+		for _, tag := range anchorTagRegexp.FindAllString(s.xhtml.xml.Body.XML, -1) {
+			id := getAttribute(tag, "id")
+			link := html.UnescapeString(getAttribute(tag, "href"))
+			if id == "" || resolveLink(sectionPath, link) != targetPath {
+				continue
+			}
+			_, fragment := splitFragment(link)
+			// Sections are all in the same folder
+			backlinks[fragment] = append(backlinks[fragment], s.filename+"#"+html.UnescapeString(id))
+		}
+	})
+	return backlinks
+}
+
+// prepareBibliographies adds the backlinks to the citations of the references
+// to the bibliographies, since the sections citing them may have been added
+// after them
+func (e *Epub) prepareBibliographies() {
+	e.forEachSection(func(s *epubSection) {
+		if s.references != nil {
+			s.xhtml.setBody(e.bibliographyBody(s))
+		}
+	})
+}
+
+// bibliographyBody returns the body of a bibliography, with backlinks to the
+// citations of its references found in the sections. Citations are links to
+// the references that have an ID.
+func (e *Epub) bibliographyBody(bibliography *epubSection) string {
+	backlinks := e.backlinks(bibliography.filename)
+	var body strings.Builder
+	body.WriteString("<ol>\n")
+	for _, reference := range bibliography.references {
+		var links strings.Builder
+		for _, backlink := range backlinks[reference.ID] {
+			fmt.Fprintf(&links, bibliographyBacklinkFormat, html.EscapeString(backlink))
+		}
+		fmt.Fprintf(&body, bibliographyEntryFormat, html.EscapeString(reference.ID), reference.Citation, links.String())
+	}
+	body.WriteString("</ol>")
+	return body.String()
+}
@@ -0,0 +1,89 @@
+package epub
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAddBibliographySection(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	bibliography, err := e.AddBibliographySection([]Reference{
+		{ID: "knuth1984", Citation: "Knuth, D. E. (1984). <i>Literate Programming</i>."},
+		{ID: "dijkstra1968", Citation: "Dijkstra, E. W. (1968). Go To Statement Considered Harmful."},
+	}, "References", "references.xhtml", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	first, err := e.Cite(bibliography, "dijkstra1968")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := `<a id="cite0001" href="references.xhtml#dijkstra1968" epub:type="biblioref">[2]</a>`
+	if first != expected {
+		t.Errorf("Got citation %s, expected %s", first, expected)
+	}
+	second, err := e.Cite(bibliography, "dijkstra1968")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection("<p>As shown "+first+" and "+second+".</p>", testSectionTitle, "section0001.xhtml", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	r := newTestReader(t, e)
+	content, err := r.ReadFile("EPUB/xhtml/references.xhtml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`epub:type="bibliography">`,
+		`<li id="knuth1984" epub:type="biblioentry">Knuth, D. E. (1984). <i>Literate Programming</i>.</li>`,
+		`<li id="dijkstra1968" epub:type="biblioentry">Dijkstra, E. W. (1968). Go To Statement Considered Harmful. ` +
+			`<a href="section0001.xhtml#cite0001" epub:type="backlink">&#8617;</a> ` +
+			`<a href="section0001.xhtml#cite0002" epub:type="backlink">&#8617;</a></li>`,
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("Bibliography doesn't contain %s:\n%s", expected, content)
+		}
+	}
+
+	findings, err := e.Validate()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("Unexpected findings: %+v", findings)
+	}
+}
+
+func TestAddBibliographySectionErrors(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	var referenceErr *InvalidReferenceError
+	if _, err := e.AddBibliographySection([]Reference{{ID: "a"}, {ID: "1 b"}}, "", "", ""); !errors.As(err, &referenceErr) || referenceErr.Index != 1 {
+		t.Errorf("Expected InvalidReferenceError for reference 1, got %v", err)
+	}
+	if _, err := e.AddBibliographySection([]Reference{{ID: "a"}, {ID: "a"}}, "", "", ""); !errors.As(err, &referenceErr) || referenceErr.Index != 1 {
+		t.Errorf("Expected InvalidReferenceError for reference 1, got %v", err)
+	}
+
+	bibliography, err := e.AddBibliographySection([]Reference{{ID: "a"}}, "", "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var referenceDoesNotExistErr *ReferenceDoesNotExistError
+	if _, err := e.Cite(bibliography, "b"); !errors.As(err, &referenceDoesNotExistErr) {
+		t.Errorf("Expected ReferenceDoesNotExistError, got %v", err)
+	}
+	section, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var sectionErr *SectionDoesNotExistError
+	for _, filename := range []string{section, "missing.xhtml"} {
+		if _, err := e.Cite(filename, "a"); !errors.As(err, &sectionErr) {
+			t.Errorf("Expected SectionDoesNotExistError for %s, got %v", filename, err)
+		}
+	}
+}
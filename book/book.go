@@ -0,0 +1,491 @@
+// Package book builds EPUBs from a book description in JSON or YAML, which
+// lists the metadata, the assets and the chapters of the book, e.g.
+//
+//	title: My book
+//	author: Jane Doe
+//	language: en
+//	cover: images/cover.jpg
+//	css: [style.css]
+//	assets:
+//	  - fonts
+//	  - images
+//	chapters:
+//	  - title: Introduction
+//	    file: introduction.md
+//	  - title: Chapter 1
+//	    file: chapter1.html
+//	    sections:
+//	      - title: Section 1.1
+//	        file: chapter1-1.md
+//
+// The chapters are HTML files, whose body is used, or Markdown files, which are
+// converted to XHTML. The assets are files or folders, whose files are added as
+// fonts, images, audio, video or CSS depending on their extension, or else as
+// raw files at the same path. The links between the chapters, the assets and the
+// CSS files are rewritten to the paths of the files in the EPUB.
+//
+// The paths are relative to the folder of the description and use slashes:
+//
+//	e, err := book.BuildFile("my-book/book.yaml")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	err = e.Write("My book.epub")
+package book
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bmaupin/go-epub"
+	"github.com/bmaupin/go-epub/internal/markdown"
+	"gopkg.in/yaml.v3"
+)
+
+// Book is the description of a book.
+type Book struct {
+	// Metadata of the EPUB, see the setters of epub.Epub
+	Title       string `json:"title" yaml:"title"`
+	Author      string `json:"author,omitempty" yaml:"author,omitempty"`
+	Language    string `json:"language,omitempty" yaml:"language,omitempty"`
+	Identifier  string `json:"identifier,omitempty" yaml:"identifier,omitempty"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	// Page progression direction, ltr or rtl
+	Direction string `json:"direction,omitempty" yaml:"direction,omitempty"`
+	// Path to the cover image
+	Cover string `json:"cover,omitempty" yaml:"cover,omitempty"`
+	// Paths to the CSS files linked by all the chapters, in order
+	CSS []string `json:"css,omitempty" yaml:"css,omitempty"`
+	// Paths to the other files or folders of files to add
+	Assets []string `json:"assets,omitempty" yaml:"assets,omitempty"`
+	// Chapters in reading order
+	Chapters []Chapter `json:"chapters" yaml:"chapters"`
+}
+
+// Chapter is a chapter of a book.
+type Chapter struct {
+	// Title used for the table of contents; if no title is provided, the
+	// chapter will not be added to the table of contents
+	Title string `json:"title,omitempty" yaml:"title,omitempty"`
+	// Path to the HTML or Markdown file of the chapter
+	File string `json:"file" yaml:"file"`
+	// Internal filename of the chapter in the EPUB; if no filename is
+	// provided, the name of the file with the .xhtml extension is used
+	Filename string `json:"filename,omitempty" yaml:"filename,omitempty"`
+	// Sections of the chapter, which can't have sections themselves
+	Sections []Chapter `json:"sections,omitempty" yaml:"sections,omitempty"`
+}
+
+// Extensions of the assets added as fonts, images, audio and video
+var (
+	fontExtensions  = []string{".otf", ".ttf", ".woff", ".woff2"}
+	imageExtensions = []string{".avif", ".gif", ".jpeg", ".jpg", ".png", ".svg", ".webp"}
+	audioExtensions = []string{".m4a", ".mp3", ".oga", ".ogg", ".opus", ".wav"}
+	videoExtensions = []string{".m4v", ".mp4", ".ogv", ".webm"}
+)
+
+// Extensions of the chapters converted from Markdown
+var markdownExtensions = []string{".markdown", ".md"}
+
+var (
+	// Attributes of the chapters that link to other files
+	linkAttributeRegex = regexp.MustCompile(`(\s(?:href|src|poster|xlink:href)\s*=\s*)("[^"]*"|'[^']*')`)
+	// Links of the CSS files
+	cssLinkRegex   = regexp.MustCompile(`(url\(\s*)("[^"]*"|'[^']*'|[^)"'\s]*)|(@import\s+)("[^"]*"|'[^']*')`)
+	bodyRegex      = regexp.MustCompile(`(?is)<body[^>]*>(.*)</body\s*>`)
+	schemeRegex    = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*:`)
+	errNoChapters  = errors.New("book: no chapters")
+	errNoTitle     = errors.New("book: no title")
+	errNestedLevel = errors.New("book: sections can't have sections")
+)
+
+// Load reads the book description at the path, in JSON if its extension is
+// .json or in YAML if its extension is .yaml or .yml.
+func Load(descriptionPath string) (*Book, error) {
+	data, err := os.ReadFile(descriptionPath)
+	if err != nil {
+		return nil, fmt.Errorf("book: %w", err)
+	}
+	switch ext := strings.ToLower(filepath.Ext(descriptionPath)); ext {
+	case ".json":
+		return ParseJSON(data)
+	case ".yaml", ".yml":
+		return ParseYAML(data)
+	default:
+		return nil, fmt.Errorf("book: unsupported description format %q", ext)
+	}
+}
+
+// ParseJSON parses a book description in JSON. Unknown fields are errors, to
+// catch typos.
+func ParseJSON(data []byte) (*Book, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	b := &Book{}
+	if err := decoder.Decode(b); err != nil {
+		return nil, fmt.Errorf("book: invalid description: %w", err)
+	}
+	return b, nil
+}
+
+// ParseYAML parses a book description in YAML, as ParseJSON does. Unknown
+// fields are errors as well.
+func ParseYAML(data []byte) (*Book, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	b := &Book{}
+	if err := decoder.Decode(b); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("book: invalid description: empty YAML")
+		}
+		return nil, fmt.Errorf("book: invalid YAML: %w", err)
+	}
+	return b, nil
+}
+
+// BuildFile loads the book description at the path and builds the EPUB, see
+// Build.
+func BuildFile(descriptionPath string, options ...epub.EpubOption) (*epub.Epub, error) {
+	b, err := Load(descriptionPath)
+	if err != nil {
+		return nil, err
+	}
+	return b.Build(filepath.Dir(descriptionPath), options...)
+}
+
+// Build builds the EPUB of the book, whose paths are relative to the folder dir.
+// The options are passed to epub.NewEpub. The EPUB isn't written, so it can be
+// changed before it is.
+func (b *Book) Build(dir string, options ...epub.EpubOption) (*epub.Epub, error) {
+	if b.Title == "" {
+		return nil, errNoTitle
+	}
+	if len(b.Chapters) == 0 {
+		return nil, errNoChapters
+	}
+	e := epub.NewEpub(b.Title, options...)
+	if b.Author != "" {
+		e.SetAuthor(b.Author)
+	}
+	if b.Language != "" {
+		e.SetLang(b.Language)
+	}
+	if b.Identifier != "" {
+		e.SetIdentifier(b.Identifier)
+	}
+	if b.Description != "" {
+		e.SetDescription(b.Description)
+	}
+	if b.Direction != "" {
+		e.SetPpd(b.Direction)
+	}
+
+	bb := &builder{
+		book:     b,
+		dir:      dir,
+		epub:     e,
+		files:    map[string]string{},
+		chapters: map[string]string{},
+	}
+	if err := bb.addAssets(); err != nil {
+		return nil, err
+	}
+	if err := bb.setCover(); err != nil {
+		return nil, err
+	}
+	if err := bb.addChapters(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// builder holds the state of a build
+type builder struct {
+	book *Book
+	dir  string
+	epub *epub.Epub
+	// Internal paths of the files added to the EPUB, by path in the book
+	// folder, e.g. ../images/cover.jpg for images/cover.jpg
+	files map[string]string
+	// Internal filenames of the chapters, by path in the book folder
+	chapters map[string]string
+	// Internal paths of the CSS files linked by the chapters
+	css []string
+}
+
+// addAssets adds the files of the assets, then the CSS files whose links to the
+// assets can then be rewritten
+func (bb *builder) addAssets() error {
+	var cssFiles []string
+	isCSS := map[string]bool{}
+	for _, asset := range bb.book.Assets {
+		assetFiles, err := bb.listFiles(asset)
+		if err != nil {
+			return err
+		}
+		for _, file := range assetFiles {
+			if _, ok := bb.files[file]; ok || isCSS[file] {
+				continue
+			}
+			if strings.ToLower(path.Ext(file)) == ".css" {
+				cssFiles = append(cssFiles, file)
+				isCSS[file] = true
+				continue
+			}
+			if err := bb.addAsset(file); err != nil {
+				return err
+			}
+		}
+	}
+	for _, file := range bb.book.CSS {
+		file = path.Clean(file)
+		if !isCSS[file] {
+			cssFiles = append(cssFiles, file)
+			isCSS[file] = true
+		}
+	}
+
+	for _, file := range cssFiles {
+		data, err := os.ReadFile(bb.localPath(file))
+		if err != nil {
+			return fmt.Errorf("book: unable to read CSS file: %w", err)
+		}
+		css := cssLinkRegex.ReplaceAllStringFunc(string(data), func(match string) string {
+			groups := cssLinkRegex.FindStringSubmatch(match)
+			prefix, link := groups[1], groups[2]
+			if prefix == "" {
+				prefix, link = groups[3], groups[4]
+			}
+			quote := ""
+			if link != "" && (link[0] == '"' || link[0] == '\'') {
+				quote, link = link[:1], link[1:len(link)-1]
+			}
+			return prefix + quote + bb.rewriteLink(file, link) + quote
+		})
+		internalPath, err := bb.epub.AddCSSFromString(css, path.Base(file))
+		if err != nil {
+			return fmt.Errorf("book: unable to add CSS file %s: %w", file, err)
+		}
+		bb.files[file] = internalPath
+	}
+	for _, file := range bb.book.CSS {
+		bb.css = append(bb.css, bb.files[path.Clean(file)])
+	}
+	return nil
+}
+
+// addAsset adds the file of an asset to the EPUB, depending on its extension
+func (bb *builder) addAsset(file string) error {
+	source := bb.localPath(file)
+	ext := strings.ToLower(path.Ext(file))
+	var internalPath string
+	var err error
+	switch {
+	case contains(fontExtensions, ext):
+		internalPath, err = bb.epub.AddFont(source, "")
+	case contains(imageExtensions, ext):
+		internalPath, err = bb.epub.AddImage(source, "")
+	case contains(audioExtensions, ext):
+		internalPath, err = bb.epub.AddAudio(source, "")
+	case contains(videoExtensions, ext):
+		internalPath, err = bb.epub.AddVideo(source, "")
+	default:
+		internalPath, err = bb.epub.AddRawFile(source, file, "")
+	}
+	if err != nil {
+		return fmt.Errorf("book: unable to add asset %s: %w", file, err)
+	}
+	bb.files[file] = internalPath
+	return nil
+}
+
+// setCover sets the cover image, which is added unless it's one of the assets
+func (bb *builder) setCover() error {
+	if bb.book.Cover == "" {
+		return nil
+	}
+	cover := path.Clean(bb.book.Cover)
+	if internalPath, ok := bb.files[cover]; ok {
+		bb.epub.SetCover(internalPath, "")
+		return nil
+	}
+	if err := bb.epub.SetCoverFromSource(bb.localPath(cover)); err != nil {
+		return fmt.Errorf("book: unable to set cover: %w", err)
+	}
+	return nil
+}
+
+// addChapters adds the chapters and their sections, once their internal
+// filenames are known so that the links between them can be rewritten
+func (bb *builder) addChapters() error {
+	for _, chapter := range bb.book.Chapters {
+		if err := bb.registerChapter(chapter); err != nil {
+			return err
+		}
+		for _, section := range chapter.Sections {
+			if len(section.Sections) > 0 {
+				return errNestedLevel
+			}
+			if err := bb.registerChapter(section); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, chapter := range bb.book.Chapters {
+		parentFilename, err := bb.addChapter(chapter, "")
+		if err != nil {
+			return err
+		}
+		for _, section := range chapter.Sections {
+			if _, err := bb.addChapter(section, parentFilename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// registerChapter records the internal filename of the chapter
+func (bb *builder) registerChapter(chapter Chapter) error {
+	if chapter.File == "" {
+		return fmt.Errorf("book: chapter %q has no file", chapter.Title)
+	}
+	file := path.Clean(chapter.File)
+	if _, ok := bb.chapters[file]; ok {
+		return fmt.Errorf("book: chapter %s is listed more than once", file)
+	}
+	filename := chapter.Filename
+	if filename == "" {
+		filename = strings.TrimSuffix(path.Base(file), path.Ext(file)) + ".xhtml"
+	}
+	bb.chapters[file] = filename
+	return nil
+}
+
+// addChapter adds the chapter to the EPUB, as a section of the parent if it
+// isn't empty
+func (bb *builder) addChapter(chapter Chapter, parentFilename string) (string, error) {
+	file := path.Clean(chapter.File)
+	data, err := os.ReadFile(bb.localPath(file))
+	if err != nil {
+		return "", fmt.Errorf("book: unable to read chapter: %w", err)
+	}
+	body := string(data)
+	if contains(markdownExtensions, strings.ToLower(path.Ext(file))) {
+		body = markdown.ToXHTML(body)
+	} else if match := bodyRegex.FindStringSubmatch(body); match != nil {
+		body = match[1]
+	}
+	body = linkAttributeRegex.ReplaceAllStringFunc(body, func(match string) string {
+		groups := linkAttributeRegex.FindStringSubmatch(match)
+		value := groups[2]
+		return groups[1] + value[:1] + bb.rewriteLink(file, value[1:len(value)-1]) + value[:1]
+	})
+
+	filename, err := bb.epub.AddSectionWithOptions(body, epub.SectionOptions{
+		Title:    chapter.Title,
+		Filename: bb.chapters[file],
+		CSS:      bb.css,
+		Parent:   parentFilename,
+	})
+	if err != nil {
+		return "", fmt.Errorf("book: unable to add chapter %s: %w", file, err)
+	}
+	return filename, nil
+}
+
+// rewriteLink returns the link of the file at fromFile to another file of the
+// book as a link to the file in the EPUB. The links to files that aren't part of
+// the book are kept as is.
+func (bb *builder) rewriteLink(fromFile string, link string) string {
+	if link == "" || strings.HasPrefix(link, "#") || strings.HasPrefix(link, "/") || schemeRegex.MatchString(link) {
+		return link
+	}
+	linkPath, fragment, _ := strings.Cut(link, "#")
+	if unescaped, err := url.PathUnescape(linkPath); err == nil {
+		linkPath = unescaped
+	}
+	target := path.Join(path.Dir(fromFile), linkPath)
+	if fragment != "" {
+		fragment = "#" + fragment
+	}
+	if filename, ok := bb.chapters[target]; ok {
+		// Both chapters are in the same folder of the EPUB, unlike the CSS
+		// files, which are in a sibling folder
+		if path.Ext(fromFile) == ".css" {
+			return "../xhtml/" + filename + fragment
+		}
+		return filename + fragment
+	}
+	if internalPath, ok := bb.files[target]; ok {
+		return internalPath + fragment
+	}
+	return link
+}
+
+// listFiles returns the paths of the files of the asset, which is a file or a
+// folder whose files are listed recursively in alphabetical order. Hidden files
+// and folders are skipped.
+func (bb *builder) listFiles(asset string) ([]string, error) {
+	asset = path.Clean(asset)
+	info, err := os.Stat(bb.localPath(asset))
+	if err != nil {
+		return nil, fmt.Errorf("book: unable to add asset: %w", err)
+	}
+	if !info.IsDir() {
+		return []string{asset}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(bb.localPath(asset), func(localPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && localPath != bb.localPath(asset) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(bb.dir, localPath)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("book: unable to list asset %s: %w", asset, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// localPath returns the path on disk of the file of the book
+func (bb *builder) localPath(file string) string {
+	return filepath.Join(bb.dir, filepath.FromSlash(file))
+}
+
+// contains returns whether the slice contains the string
+func contains(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
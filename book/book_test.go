@@ -0,0 +1,231 @@
+package book
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testDescription = `# The description of the test book
+title: Test book
+author: "Jane Doe"
+language: en
+cover: images/cover.png
+css: [style.css]
+assets:
+  - images
+  - fonts/font.ttf
+  - data/notes.txt
+chapters:
+  - title: Introduction
+    file: introduction.md
+  - title: Chapter 1
+    file: chapters/chapter1.html
+    filename: one.xhtml
+    sections:
+      - title: Section 1.1
+        file: chapters/section1-1.md
+`
+
+func TestBuildFile(t *testing.T) {
+	dir := t.TempDir()
+	png, err := os.ReadFile("../testdata/gophercolor16x16.png")
+	if err != nil {
+		t.Fatalf("Error reading image: %s", err)
+	}
+	font, err := os.ReadFile("../testdata/redacted-script-regular.ttf")
+	if err != nil {
+		t.Fatalf("Error reading font: %s", err)
+	}
+	files := map[string]string{
+		"book.yaml":               testDescription,
+		"style.css":               `@font-face { font-family: "Script"; src: url(fonts/font.ttf); } body { background: url("images/cover.png"); }`,
+		"images/cover.png":        string(png),
+		"images/.hidden.png":      string(png),
+		"fonts/font.ttf":          string(font),
+		"data/notes.txt":          "Notes",
+		"introduction.md":         "# Introduction\n\nSee [chapter 1](chapters/chapter1.html#start) and [the notes](data/notes.txt).\n",
+		"chapters/chapter1.html":  `<html><head><title>Ignored</title></head><body><h1 id="start">Chapter 1</h1><img src="../images/cover.png" alt="Cover"/><a href="section1-1.md">Next</a><a href="https://example.com/">Remote</a></body></html>`,
+		"chapters/section1-1.md":  "## Section 1.1\n\nBack to [the introduction](../introduction.md).\n",
+		"chapters/unlisted.xhtml": "<p>Unlisted</p>",
+	}
+	for name, content := range files {
+		localPath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(localPath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e, err := BuildFile(filepath.Join(dir, "book.yaml"))
+	if err != nil {
+		t.Fatalf("Unexpected error building EPUB: %s", err)
+	}
+	if e.Title() != "Test book" || e.Author() != "Jane Doe" || e.Lang() != "en" {
+		t.Errorf("Unexpected metadata: %q, %q, %q", e.Title(), e.Author(), e.Lang())
+	}
+
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	contents := map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[f.Name] = string(content)
+	}
+
+	for _, name := range []string{"EPUB/images/cover.png", "EPUB/fonts/font.ttf", "EPUB/data/notes.txt", "EPUB/css/style.css"} {
+		if _, ok := contents[name]; !ok {
+			t.Errorf("Missing file %s", name)
+		}
+	}
+	for _, name := range []string{"EPUB/images/.hidden.png", "EPUB/xhtml/unlisted.xhtml"} {
+		if _, ok := contents[name]; ok {
+			t.Errorf("Unexpected file %s", name)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		expected []string
+	}{
+		{"EPUB/css/style.css", []string{"url(../fonts/font.ttf)", `url("../images/cover.png")`}},
+		{"EPUB/xhtml/introduction.xhtml", []string{
+			`<h1>Introduction</h1>`,
+			`href="one.xhtml#start"`,
+			`href="../data/notes.txt"`,
+			`href="../css/style.css"`,
+		}},
+		{"EPUB/xhtml/one.xhtml", []string{
+			`<h1 id="start">Chapter 1</h1>`,
+			`src="../images/cover.png"`,
+			`href="section1-1.xhtml"`,
+			`href="https://example.com/"`,
+		}},
+		{"EPUB/xhtml/section1-1.xhtml", []string{`href="introduction.xhtml"`}},
+		{"EPUB/nav.xhtml", []string{"Introduction", "Chapter 1", "Section 1.1"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			content, ok := contents[tc.name]
+			if !ok {
+				t.Fatalf("Missing file %s", tc.name)
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(content, expected) {
+					t.Errorf("%s doesn't contain %s:\n%s", tc.name, expected, content)
+				}
+			}
+		})
+	}
+	if strings.Contains(contents["EPUB/xhtml/one.xhtml"], "Ignored") {
+		t.Error("The head of the HTML chapter is part of the section")
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		book     Book
+		expected string
+	}{
+		{"no title", Book{Chapters: []Chapter{{File: "a.md"}}}, "no title"},
+		{"no chapters", Book{Title: "Title"}, "no chapters"},
+		{"no file", Book{Title: "Title", Chapters: []Chapter{{Title: "A"}}}, `chapter "A" has no file`},
+		{"missing file", Book{Title: "Title", Chapters: []Chapter{{File: "a.md"}}}, "unable to read chapter"},
+		{"duplicate chapter", Book{Title: "Title", Chapters: []Chapter{{File: "a.md"}, {File: "./a.md"}}}, "listed more than once"},
+		{"nested sections", Book{Title: "Title", Chapters: []Chapter{{File: "a.md", Sections: []Chapter{{File: "b.md", Sections: []Chapter{{File: "c.md"}}}}}}}, "sections can't have sections"},
+		{"missing asset", Book{Title: "Title", Assets: []string{"images"}, Chapters: []Chapter{{File: "a.md"}}}, "unable to add asset"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.book.Build(t.TempDir())
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("Expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	b, err := ParseJSON([]byte(`{"title": "Title", "chapters": [{"title": "A", "file": "a.md", "sections": [{"file": "b.html"}]}]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := &Book{Title: "Title", Chapters: []Chapter{{Title: "A", File: "a.md", Sections: []Chapter{{File: "b.html"}}}}}
+	if !reflect.DeepEqual(b, expected) {
+		t.Errorf("Got %+v, expected %+v", b, expected)
+	}
+
+	if _, err := ParseJSON([]byte(`{"title": "Title", "chapter": []}`)); err == nil {
+		t.Error("Expected an error for an unknown field")
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	b, err := ParseYAML([]byte(testDescription))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := &Book{
+		Title:    "Test book",
+		Author:   "Jane Doe",
+		Language: "en",
+		Cover:    "images/cover.png",
+		CSS:      []string{"style.css"},
+		Assets:   []string{"images", "fonts/font.ttf", "data/notes.txt"},
+		Chapters: []Chapter{
+			{Title: "Introduction", File: "introduction.md"},
+			{Title: "Chapter 1", File: "chapters/chapter1.html", Filename: "one.xhtml", Sections: []Chapter{
+				{Title: "Section 1.1", File: "chapters/section1-1.md"},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(b, expected) {
+		t.Errorf("Got %+v, expected %+v", b, expected)
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		yaml     string
+		expected string
+	}{
+		{"empty", "# Nothing\n", "empty YAML"},
+		{"not a mapping", "- a", "cannot unmarshal"},
+		{"unknown field", "title: x\ntitel: y", "field titel not found"},
+		{"tab", "a:\n\t- b", "line 2"},
+		{"nested mapping value", "title: a: b", "mapping values are not allowed"},
+		{"empty key", ":", "did not find expected key"},
+		{"empty nested key", "title: x\nchapters:\n  - :\n", "did not find expected key"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseYAML([]byte(tc.yaml))
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("Expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
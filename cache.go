@@ -0,0 +1,118 @@
+package epub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// CachedMedia is media retrieved from a URL and stored in a MediaCache, along
+// with the validators used to check whether it changed since it was retrieved.
+type CachedMedia struct {
+	Data         []byte // The content of the media
+	ETag         string // The ETag header of the response, if any
+	LastModified string // The Last-Modified header of the response, if any
+	// The Content-Type header of the response, if any, whose charset is used
+	// to transcode CSS files to UTF-8 when the cached media is used
+	ContentType string
+}
+
+// MediaCache stores the media retrieved from URLs so that it doesn't need to be
+// downloaded again when the same EPUB is written several times, e.g. by tools
+// that regularly update an EPUB with the new chapters of a serial.
+//
+// See SetMediaCache.
+type MediaCache interface {
+	// Get returns the media cached for the URL, or nil if there's none.
+	Get(url string) (*CachedMedia, error)
+	// Set stores the media retrieved from the URL.
+	Set(url string, media *CachedMedia) error
+}
+
+// dirMediaCache is a MediaCache that stores media in a directory of the local
+// filesystem. Each URL is stored as two files named after the hash of the URL:
+// one with the content of the media and one with its validators.
+type dirMediaCache struct {
+	dir string
+}
+
+// dirMediaCacheMeta is the content of the file with the validators of media
+// stored by dirMediaCache
+type dirMediaCacheMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	ContentType  string `json:"contentType,omitempty"`
+}
+
+// NewDirMediaCache returns a MediaCache that stores media in the directory of
+// the local filesystem, which is created if needed. The directory can be shared
+// by several EPUBs.
+func NewDirMediaCache(dir string) MediaCache {
+	return &dirMediaCache{dir: dir}
+}
+
+// paths returns the paths of the files of the media cached for the URL
+func (c *dirMediaCache) paths(url string) (dataPath string, metaPath string) {
+	hash := sha256.Sum256([]byte(url))
+	name := hex.EncodeToString(hash[:])
+	return filepath.Join(c.dir, name), filepath.Join(c.dir, name+".json")
+}
+
+func (c *dirMediaCache) Get(url string) (*CachedMedia, error) {
+	dataPath, metaPath := c.paths(url)
+	metaJSON, err := os.ReadFile(metaPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta dirMediaCacheMeta
+	if err := json.Unmarshal(metaJSON, &meta); err != nil {
+		return nil, err
+	}
+	// Protects against hash collisions
+	if meta.URL != url {
+		return nil, nil
+	}
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedMedia{
+		Data:         data,
+		ETag:         meta.ETag,
+		LastModified: meta.LastModified,
+		ContentType:  meta.ContentType,
+	}, nil
+}
+
+func (c *dirMediaCache) Set(url string, media *CachedMedia) error {
+	if err := os.MkdirAll(c.dir, dirPermissions); err != nil {
+		return err
+	}
+	metaJSON, err := json.Marshal(dirMediaCacheMeta{
+		URL:          url,
+		ETag:         media.ETag,
+		LastModified: media.LastModified,
+		ContentType:  media.ContentType,
+	})
+	if err != nil {
+		return err
+	}
+	dataPath, metaPath := c.paths(url)
+	// The validators are written last so that an interrupted write doesn't
+	// leave validators matching the wrong content
+	if err := os.Remove(metaPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.WriteFile(dataPath, media.Data, filePermissions); err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, metaJSON, filePermissions)
+}
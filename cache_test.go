@@ -0,0 +1,101 @@
+package epub
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+)
+
+func TestDirMediaCache(t *testing.T) {
+	cache := NewDirMediaCache(filepath.Join(t.TempDir(), "cache"))
+	testURL := "https://example.com/image.png"
+
+	media, err := cache.Get(testURL)
+	if err != nil || media != nil {
+		t.Fatalf("Get() on empty cache = %v, %v, want nil, nil", media, err)
+	}
+
+	want := &CachedMedia{Data: []byte("image"), ETag: `"1234"`}
+	if err := cache.Set(testURL, want); err != nil {
+		t.Fatalf("Unexpected error setting media: %s", err)
+	}
+	media, err = cache.Get(testURL)
+	if err != nil {
+		t.Fatalf("Unexpected error getting media: %s", err)
+	}
+	if media == nil || !bytes.Equal(media.Data, want.Data) || media.ETag != want.ETag || media.LastModified != "" {
+		t.Errorf("Get() = %+v, want %+v", media, want)
+	}
+}
+
+func TestSetMediaCache(t *testing.T) {
+	testImage, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading image: %s", err)
+	}
+	testETag := `"gopher"`
+	downloads := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", testETag)
+		if r.Header.Get("If-None-Match") == testETag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == http.MethodGet {
+			downloads++
+		}
+		w.Write(testImage)
+	}))
+	defer ts.Close()
+
+	cache := NewDirMediaCache(t.TempDir())
+	for i := 0; i < 2; i++ {
+		e := NewEpub(testEpubTitle)
+		e.SetMediaCache(cache)
+		testImagePath, err := e.AddImage(ts.URL+"/image.png", "")
+		if err != nil {
+			t.Fatalf("Error adding image: %s", err)
+		}
+
+		tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+		contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testImagePath))
+		if err != nil {
+			t.Errorf("Unexpected error reading image file from EPUB: %s", err)
+		}
+		if !bytes.Equal(contents, testImage) {
+			t.Errorf("Image file contents don't match")
+		}
+		cleanup(testEpubFilename, tempDir)
+	}
+	if downloads != 1 {
+		t.Errorf("Image downloaded %d times, expected 1", downloads)
+	}
+
+	// Media isn't cached without validators
+	downloads = 0
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			downloads++
+		}
+		w.Write(testImage)
+	})
+	for i := 0; i < 2; i++ {
+		e := NewEpub(testEpubTitle)
+		e.SetMediaCache(cache)
+		if _, err := e.AddImage(ts.URL+"/uncached.png", ""); err != nil {
+			t.Fatalf("Error adding image: %s", err)
+		}
+		if _, err := e.WriteTo(io.Discard); err != nil {
+			t.Fatalf("Unexpected error writing EPUB: %s", err)
+		}
+	}
+	if downloads != 2 {
+		t.Errorf("Image downloaded %d times, expected 2", downloads)
+	}
+}
@@ -0,0 +1,132 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+	"github.com/vincent-petithory/dataurl"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+const (
+	// Encoding of legacy CSS without a declared encoding that isn't valid
+	// UTF-8, as assumed by browsers
+	defaultLegacyCharset = "windows-1252"
+	utf8Charset          = "utf-8"
+)
+
+var (
+	// @charset rule at the start of a CSS file, e.g. @charset "windows-1252";
+	cssCharsetRegexp = regexp.MustCompile(`^@charset\s*"([^"]*)"\s*;[ \t]*\r?\n?`)
+	utf8BOM          = []byte{0xEF, 0xBB, 0xBF}
+	utf16BEBOM       = []byte{0xFE, 0xFF}
+	utf16LEBOM       = []byte{0xFF, 0xFE}
+)
+
+// utf8CSS returns the CSS transcoded to UTF-8, the encoding required by EPUB
+// readers. The encoding of the CSS is determined like browsers do: from its
+// byte order mark, its @charset rule or the charset of its media type (e.g.
+// from the Content-Type header of the response it was retrieved from), in that
+// order. CSS without any of them is kept as is if it's valid UTF-8, and decoded
+// as windows-1252 otherwise, which is the most common encoding of legacy CSS.
+// The @charset rule of transcoded CSS is removed, since it no longer matches.
+func utf8CSS(css []byte, charset string) []byte {
+	content := css
+	label := ""
+	switch {
+	case bytes.HasPrefix(content, utf8BOM):
+		return css
+	case bytes.HasPrefix(content, utf16BEBOM):
+		content, label = content[len(utf16BEBOM):], "utf-16be"
+	case bytes.HasPrefix(content, utf16LEBOM):
+		content, label = content[len(utf16LEBOM):], "utf-16le"
+	default:
+		if m := cssCharsetRegexp.FindSubmatch(content); m != nil {
+			label = string(m[1])
+			// CSS whose @charset rule could be read isn't UTF-16
+			if strings.HasPrefix(strings.ToLower(label), "utf-16") {
+				label = utf8Charset
+			}
+		}
+	}
+	if label == "" {
+		label = charset
+	}
+
+	encoding, err := htmlindex.Get(label)
+	if err != nil {
+		// The encoding is unknown or missing
+		if utf8.Valid(content) {
+			return css
+		}
+		encoding, _ = htmlindex.Get(defaultLegacyCharset)
+	}
+	if name, _ := htmlindex.Name(encoding); name == utf8Charset {
+		return css
+	}
+	decoded, err := encoding.NewDecoder().Bytes(content)
+	if err != nil {
+		return css
+	}
+	return cssCharsetRegexp.ReplaceAll(decoded, nil)
+}
+
+// utf8CSSFile transcodes the CSS file at the path of the storage to UTF-8,
+// given the charset of its media type (see utf8CSS)
+func utf8CSSFile(filesystem storage.Storage, cssFilePath string, charset string) error {
+	css, err := storage.ReadFile(filesystem, cssFilePath)
+	if err != nil {
+		return err
+	}
+	transcoded := utf8CSS(css, charset)
+	if bytes.Equal(transcoded, css) {
+		return nil
+	}
+	return filesystem.WriteFile(cssFilePath, transcoded, filePermissions)
+}
+
+// mediaCharset returns the charset of the media type of mediaSource, i.e. the
+// charset parameter of a data URL or of the Content-Type header of the response
+// to a URL, an empty string if it's unknown
+func (g grabber) mediaCharset(mediaSource string) string {
+	switch detectMediaType(mediaSource) {
+	case "URL":
+		if g.charsets != nil {
+			if charset, ok := g.charsets.Load(mediaSource); ok {
+				return charset.(string)
+			}
+		}
+	case "DataURL":
+		if data, err := dataurl.DecodeString(mediaSource); err == nil {
+			return data.Params["charset"]
+		}
+	}
+	return ""
+}
+
+// readCSS returns the content of the CSS file at cssSource, transcoded to UTF-8
+// (see utf8CSS)
+func (g grabber) readCSS(ctx context.Context, cssSource string) ([]byte, error) {
+	css, err := g.readMedia(ctx, cssSource)
+	if err != nil {
+		return nil, err
+	}
+	return utf8CSS(css, g.mediaCharset(cssSource)), nil
+}
+
+// storeMediaCharset keeps the charset of the Content-Type header of the
+// response to a request for remote media, or of the cached response if the
+// media didn't change (see mediaCharset)
+func (g grabber) storeMediaCharset(mediaSource string, contentType string) {
+	if g.charsets == nil {
+		return
+	}
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		g.charsets.Store(mediaSource, params["charset"])
+	}
+}
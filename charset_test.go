@@ -0,0 +1,109 @@
+package epub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestUTF8CSS(t *testing.T) {
+	gbk, err := simplifiedchinese.GBK.NewEncoder().String(`p::before { content: "中文" }`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, test := range []struct {
+		css      string
+		charset  string
+		expected string
+	}{
+		// Valid UTF-8 is kept as is
+		{`p::before { content: "é" }`, "", `p::before { content: "é" }`},
+		{"@charset \"UTF-8\";\np::before { content: \"é\" }", "windows-1252", "@charset \"UTF-8\";\np::before { content: \"é\" }"},
+		{"\xEF\xBB\xBFp::before { content: \"é\" }", "gbk", "\xEF\xBB\xBFp::before { content: \"é\" }"},
+		// Legacy CSS without a declared encoding
+		{"p::before { content: \"\xE9\" }", "", `p::before { content: "é" }`},
+		{"p::before { content: \"\xE9\" }", "unknown", `p::before { content: "é" }`},
+		// The @charset rule takes precedence over the media type
+		{"@charset \"GBK\";\n" + gbk, "windows-1252", `p::before { content: "中文" }`},
+		{gbk, "gbk", `p::before { content: "中文" }`},
+		{"\xFF\xFEp\x00{\x00}\x00", "", "p{}"},
+	} {
+		if css := string(utf8CSS([]byte(test.css), test.charset)); css != test.expected {
+			t.Errorf("Got %q transcoding %q (charset %q), expected %q", css, test.css, test.charset, test.expected)
+		}
+	}
+}
+
+func TestRemoteCSSCharset(t *testing.T) {
+	gbk, err := simplifiedchinese.GBK.NewEncoder().String(`p::before { content: "中文" }`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css; charset=GBK")
+		w.Write([]byte(gbk))
+	}))
+	defer server.Close()
+
+	e := NewEpub(testEpubTitle)
+	cssPath, err := e.AddCSS(server.URL+"/style.css", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "", cssPath); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, directWrite := range []bool{false, true} {
+		e.SetDirectWrite(directWrite)
+		r := newTestReader(t, e)
+		css, err := r.ReadFile("EPUB/css/style.css")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if expected := `p::before { content: "中文" }`; string(css) != expected {
+			t.Errorf("Got CSS %q writing directly: %t, expected %q", css, directWrite, expected)
+		}
+	}
+}
+
+// The charset is kept with the cached CSS, for the responses telling that it
+// didn't change
+func TestCachedCSSCharset(t *testing.T) {
+	gbk, err := simplifiedchinese.GBK.NewEncoder().String(`p::before { content: "中文" }`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/css; charset=GBK")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(gbk))
+	}))
+	defer server.Close()
+
+	cache := NewDirMediaCache(t.TempDir())
+	for i := 0; i < 2; i++ {
+		e := NewEpub(testEpubTitle)
+		e.SetMediaCache(cache)
+		cssPath, err := e.AddCSS(server.URL+"/style.css", "")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if _, err := e.AddSection(testSectionBody, testSectionTitle, "", cssPath); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		r := newTestReader(t, e)
+		css, err := r.ReadFile("EPUB/css/style.css")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if expected := `p::before { content: "中文" }`; string(css) != expected {
+			t.Errorf("Got CSS %q writing %d times, expected %q", css, i+1, expected)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package epub
+
+import (
+	"maps"
+	"slices"
+)
+
+// Clone returns a deep copy of the EPUB, e.g. to build variants of a book (a
+// sample and the full book, or the metadata of each retailer) from a base with
+// the shared front matter, styles and fonts. Changes to either EPUB don't
+// affect the other one.
+//
+// The copy keeps the sources of the media, which are retrieved by each EPUB
+// when it's written, and the settings, including the warnings, the logger, the
+// HTTP client, the media cache and the storage. The media retrieved when it was
+// added and the files compressed by incremental writes are shared, since they
+// never change. The copy has the same identifier, which should be changed if
+// it's a different book (see SetIdentifier).
+func (e *Epub) Clone() *Epub {
+	e.Lock()
+	defer e.Unlock()
+
+	c := &Epub{
+		Client:             e.Client,
+		author:             e.author,
+		css:                maps.Clone(e.css),
+		fonts:              maps.Clone(e.fonts),
+		identifier:         e.identifier,
+		images:             maps.Clone(e.images),
+		videos:             maps.Clone(e.videos),
+		audios:             maps.Clone(e.audios),
+		remoteMedia:        maps.Clone(e.remoteMedia),
+		rawFiles:           maps.Clone(e.rawFiles),
+		metaInfFiles:       maps.Clone(e.metaInfFiles),
+		mediaTypes:         maps.Clone(e.mediaTypes),
+		lang:               e.lang,
+		desc:               e.desc,
+		ppd:                e.ppd,
+		dictionaryLang:     e.dictionaryLang,
+		citations:          e.citations,
+		noterefs:           e.noterefs,
+		figures:            e.figures,
+		figureLabel:        e.figureLabel,
+		tableLabel:         e.tableLabel,
+		dropOrphanedMedia:  e.dropOrphanedMedia,
+		userAgent:          e.userAgent,
+		from:               e.from,
+		header:             e.header.Clone(),
+		cookies:            slices.Clone(e.cookies),
+		noNcx:              e.noNcx,
+		navInSpine:         e.navInSpine,
+		validateImages:     e.validateImages,
+		convertImages:      e.convertImages,
+		subsetFonts:        e.subsetFonts,
+		streamMedia:        e.streamMedia,
+		directWrite:        e.directWrite,
+		incremental:        e.incremental,
+		incrementalFiles:   maps.Clone(e.incrementalFiles),
+		incrementalMedia:   maps.Clone(e.incrementalMedia),
+		progressFunc:       e.progressFunc,
+		mediaFailurePolicy: e.mediaFailurePolicy,
+		embedFailurePolicy: e.embedFailurePolicy,
+		filenamePolicy:     e.filenamePolicy,
+		compressionMethods: maps.Clone(e.compressionMethods),
+		coverTemplate:      e.coverTemplate,
+		coverCSS:           e.coverCSS,
+		writeTimeout:       e.writeTimeout,
+		fetchTimeout:       e.fetchTimeout,
+		mediaCache:         e.mediaCache,
+		fetchMode:          e.fetchMode,
+		maxMediaSize:       e.maxMediaSize,
+		maxTotalMediaSize:  e.maxTotalMediaSize,
+		fetchedMedia:       maps.Clone(e.fetchedMedia),
+		mediaCharsets:      e.mediaCharsets,
+		sourceFS:           e.sourceFS,
+		filesystem:         e.filesystem,
+		pkg:                e.pkg.clone(),
+		sectionFilenames:   maps.Clone(e.sectionFilenames),
+		nextSectionIndex:   e.nextSectionIndex,
+		title:              e.title,
+		toc:                e.toc.clone(),
+		warnings:           slices.Clone(e.warnings),
+		strict:             e.strict,
+		kindle:             e.kindle,
+		themeCSSFilename:   e.themeCSSFilename,
+		sanitizePolicy:     e.sanitizePolicy,
+		rights:             e.rights,
+		signer:             e.signer,
+		signerCertificate:  e.signerCertificate,
+		logger:             e.logger,
+		initErr:            e.initErr,
+	}
+	cover := *e.cover
+	c.cover = &cover
+	c.sections = cloneSections(e.sections)
+	if e.ocfMetadata != nil {
+		c.ocfMetadata = &OCFMetadata{Identifier: e.ocfMetadata.Identifier, Meta: slices.Clone(e.ocfMetadata.Meta)}
+	}
+	return c
+}
+
+// cloneSections returns a deep copy of the sections and their subsections
+func cloneSections(sections []epubSection) []epubSection {
+	if sections == nil {
+		return nil
+	}
+	clones := make([]epubSection, len(sections))
+	for i, s := range sections {
+		clones[i] = s
+		clones[i].xhtml = s.xhtml.clone()
+		if s.children != nil {
+			children := cloneSections(*s.children)
+			clones[i].children = &children
+		}
+	}
+	return clones
+}
+
+// clone returns a deep copy of the XHTML document
+func (x *xhtml) clone() *xhtml {
+	root := *x.xml
+	root.Head.Links = slices.Clone(x.xml.Head.Links)
+	return &xhtml{xml: &root}
+}
+
+// clone returns a deep copy of the package file
+func (p *pkg) clone() *pkg {
+	root := *p.xml
+	root.Metadata.Meta = slices.Clone(p.xml.Metadata.Meta)
+	if p.xml.Metadata.Creator != nil {
+		creator := *p.xml.Metadata.Creator
+		root.Metadata.Creator = &creator
+	}
+	root.ManifestItems = slices.Clone(p.xml.ManifestItems)
+	root.Spine.Items = slices.Clone(p.xml.Spine.Items)
+	return &pkg{
+		xml:          &root,
+		authorMeta:   cloneMeta(p.authorMeta),
+		coverMeta:    cloneMeta(p.coverMeta),
+		modifiedMeta: cloneMeta(p.modifiedMeta),
+	}
+}
+
+// cloneMeta returns a copy of the meta element, or nil if it's nil
+func cloneMeta(m *pkgMeta) *pkgMeta {
+	if m == nil {
+		return nil
+	}
+	meta := *m
+	return &meta
+}
+
+// clone returns a deep copy of the table of contents
+func (t *toc) clone() *toc {
+	c := *t
+	navXML := *t.navXML
+	navXML.Links = cloneNavItems(t.navXML.Links)
+	c.navXML = &navXML
+	ncxXML := *t.ncxXML
+	ncxXML.Meta = slices.Clone(t.ncxXML.Meta)
+	ncxXML.NavMap = cloneNavPoints(t.ncxXML.NavMap)
+	c.ncxXML = &ncxXML
+	return &c
+}
+
+// cloneNavItems returns a deep copy of the items of the nav document
+func cloneNavItems(items []tocNavItem) []tocNavItem {
+	if items == nil {
+		return nil
+	}
+	clones := make([]tocNavItem, len(items))
+	for i, item := range items {
+		clones[i] = item
+		if item.Children != nil {
+			children := cloneNavItems(*item.Children)
+			clones[i].Children = &children
+		}
+	}
+	return clones
+}
+
+// cloneNavPoints returns a deep copy of the navigation points of the NCX
+// document
+func cloneNavPoints(points []tocNcxNavPoint) []tocNcxNavPoint {
+	if points == nil {
+		return nil
+	}
+	clones := make([]tocNcxNavPoint, len(points))
+	for i, point := range points {
+		clones[i] = point
+		if point.Children != nil {
+			children := cloneNavPoints(*point.Children)
+			clones[i].Children = &children
+		}
+	}
+	return clones
+}
@@ -0,0 +1,134 @@
+package epub
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	e.SetAuthor("Jane Doe")
+	e.SetDescription("Description")
+	cssPath, err := e.AddCSSFromString("p { margin: 0; }", "style.css")
+	if err != nil {
+		t.Fatalf("Unexpected error adding CSS: %s", err)
+	}
+	imagePath, err := e.AddImage(testImageFromFileSource, "")
+	if err != nil {
+		t.Fatalf("Unexpected error adding image: %s", err)
+	}
+	e.SetCover(imagePath, "")
+	parent, err := e.AddSectionWithOptions(testSectionBody, SectionOptions{Title: testSectionTitle, CSS: []string{cssPath}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding section: %s", err)
+	}
+	if _, err := e.AddSubSection(parent, testSectionBody, "Subsection", "", ""); err != nil {
+		t.Fatalf("Unexpected error adding subsection: %s", err)
+	}
+	original := writeEpubToBuffer(t, e)
+
+	c := e.Clone()
+	c.SetTitle("Sample")
+	c.SetAuthor("John Doe")
+	if _, err := c.AddSection("<p>Only in the sample</p>", "Sample", "sample.xhtml", ""); err != nil {
+		t.Fatalf("Unexpected error adding section to the clone: %s", err)
+	}
+	if _, err := c.AddSubSection(parent, "<p>Sample subsection</p>", "Sample subsection", "", ""); err != nil {
+		t.Fatalf("Unexpected error adding subsection to the clone: %s", err)
+	}
+	if err := c.SetSectionTocTitle(parent, "Short"); err != nil {
+		t.Fatalf("Unexpected error setting the TOC title of the clone: %s", err)
+	}
+	if _, err := c.AddCSSFromString("h1 { margin: 0; }", "sample.css"); err != nil {
+		t.Fatalf("Unexpected error adding CSS to the clone: %s", err)
+	}
+	c.findSection(parent).xhtml.setCSS()
+
+	if e.Title() != testEpubTitle || e.Author() != "Jane Doe" {
+		t.Errorf("The metadata of the original changed: %q, %q", e.Title(), e.Author())
+	}
+	if c.Title() != "Sample" || c.Author() != "John Doe" || c.Description() != "Description" {
+		t.Errorf("Unexpected metadata of the clone: %q, %q, %q", c.Title(), c.Author(), c.Description())
+	}
+	if _, ok := e.css["sample.css"]; ok {
+		t.Error("The CSS added to the clone was added to the original")
+	}
+	if e.findSection("sample.xhtml") != nil {
+		t.Error("The section added to the clone was added to the original")
+	}
+	if got := writeEpubToBuffer(t, e); !bytes.Equal(withoutModified(got.Bytes()), withoutModified(original.Bytes())) {
+		r := newTestReader(t, e)
+		nav, _ := r.ReadFile("EPUB/nav.xhtml")
+		t.Errorf("The original changed once the clone was changed, nav:\n%s", nav)
+	}
+
+	r := newTestReader(t, c)
+	nav, err := r.ReadFile("EPUB/nav.xhtml")
+	if err != nil {
+		t.Fatalf("Unexpected error reading the nav of the clone: %s", err)
+	}
+	for _, expected := range []string{"Short", "Subsection", "Sample subsection", "Sample"} {
+		if !strings.Contains(string(nav), expected) {
+			t.Errorf("The nav of the clone doesn't contain %q:\n%s", expected, nav)
+		}
+	}
+	if _, err := r.ReadFile("EPUB/images/" + e.cover.imageFilename); err != nil {
+		t.Errorf("Unexpected error reading the cover of the clone: %s", err)
+	}
+}
+
+func TestCloneFields(t *testing.T) {
+	e := NewEpub(testEpubTitle, WithLogger(nil))
+	e.SetUserAgent("agent")
+	e.SetFrom("from@example.com")
+	e.SetHeader("X-Test", "test")
+	e.SetDropOrphanedMedia(true)
+	e.SetStrict(true)
+	e.SetFilenamePolicy(FilenameTransliterate)
+	e.SetFetchTimeout(1)
+	e.SetWriteTimeout(1)
+	e.SetMediaSizeLimits(1<<20, 1<<30)
+	e.addWarning(WarningRenamed, "name", "warning")
+
+	c := e.Clone()
+	original := reflect.ValueOf(e).Elem()
+	clone := reflect.ValueOf(c).Elem()
+	for i := 0; i < original.NumField(); i++ {
+		name := original.Type().Field(i).Name
+		switch name {
+		case "Mutex", "progress":
+			continue
+		}
+		if original.Field(i).IsZero() != clone.Field(i).IsZero() {
+			t.Errorf("Field %s isn't copied", name)
+		}
+	}
+	if !reflect.DeepEqual(c.Warnings(), e.Warnings()) {
+		t.Errorf("Got warnings %v, expected %v", c.Warnings(), e.Warnings())
+	}
+}
+
+// withoutModified returns the EPUB without the modified date of its package
+// file, which differs between writes
+func withoutModified(epub []byte) []byte {
+	r, err := NewReader(bytes.NewReader(epub), int64(len(epub)))
+	if err != nil {
+		return epub
+	}
+	var b bytes.Buffer
+	for _, name := range []string{"EPUB/package.opf", "EPUB/nav.xhtml", "EPUB/toc.ncx"} {
+		data, _ := r.ReadFile(name)
+		for _, line := range strings.Split(string(data), "\n") {
+			if !strings.Contains(line, "dcterms:modified") {
+				b.WriteString(line)
+			}
+		}
+	}
+	for _, s := range r.Spine {
+		data, _ := r.SectionContent(s)
+		b.Write(data)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,301 @@
+// Command go-epub builds, validates and inspects EPUB files with the go-epub
+// library.
+//
+// Usage:
+//
+//	go-epub build [flags] <description or folder>
+//	go-epub validate <file.epub>...
+//	go-epub stats <file.epub>
+//
+// The build command builds an EPUB from a book description in JSON or YAML (see
+// the book package), or from a folder. A folder with a book.yaml, book.yml or
+// book.json file is built from this description, otherwise it's built by
+// epub.FromDir: its HTML and Markdown files become the sections in alphabetical
+// order, titled by their first heading, and the files of its assets folder are
+// added as well. The flags override the metadata:
+//
+//	go-epub build -o "My book.epub" -author "Jane Doe" -embed-images -validate my-book
+//
+// The validate command prints the problems found by epub.ValidateFile and exits
+// with status 1 if there are errors. The stats command prints the word counts
+// and reading times of the sections.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bmaupin/go-epub"
+	"github.com/bmaupin/go-epub/book"
+)
+
+// Names of the book descriptions looked for in the folders to build
+var descriptionFilenames = []string{"book.yaml", "book.yml", "book.json"}
+
+const usage = `Usage:
+  go-epub build [flags] <description or folder>
+  go-epub validate <file.epub>...
+  go-epub stats <file.epub>
+
+Run go-epub <command> -h for the flags of a command.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command with the arguments and returns the exit status
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "build":
+		err = runBuild(args[1:], stdout, stderr)
+	case "validate":
+		err = runValidate(args[1:], stdout, stderr)
+	case "stats":
+		err = runStats(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "go-epub: unknown command %q\n%s", args[0], usage)
+		return 2
+	}
+
+	var status exitStatus
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.As(err, &status):
+		return int(status)
+	default:
+		fmt.Fprintf(stderr, "go-epub: %s\n", err)
+		return 1
+	}
+}
+
+// exitStatus is returned by the commands to exit with a status without printing
+// an error, e.g. when the problems were already printed
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(s))
+}
+
+// runBuild runs the build command
+func runBuild(args []string, stdout io.Writer, stderr io.Writer) error {
+	flags := flag.NewFlagSet("go-epub build", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, "Usage: go-epub build [flags] <description or folder>\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "path of the EPUB to write (default: the name of the folder with the .epub extension)")
+	title := flags.String("title", "", "title of the EPUB")
+	author := flags.String("author", "", "author of the EPUB")
+	lang := flags.String("lang", "", "language of the EPUB, e.g. en")
+	identifier := flags.String("identifier", "", "unique identifier of the EPUB, e.g. urn:isbn:9780000000000")
+	description := flags.String("description", "", "description of the EPUB")
+	cover := flags.String("cover", "", "path to the cover image, relative to the current folder")
+	embedImages := flags.Bool("embed-images", false, "download the remote images of the chapters and CSS into the EPUB")
+	validate := flags.Bool("validate", false, "validate the EPUB once written and exit with status 1 if there are errors")
+	stats := flags.Bool("stats", false, "print the word counts and reading times of the chapters")
+	verbose := flags.Bool("v", false, "log the retrieval of the media and the steps of the write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitStatus(2)
+	}
+	input := flags.Arg(0)
+
+	var options []epub.EpubOption
+	if *verbose {
+		options = append(options, epub.WithLogger(slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	}
+	e, dir, err := buildEpub(input, *cover == "", options)
+	if err != nil {
+		return err
+	}
+	for _, override := range []struct {
+		value string
+		set   func(string)
+	}{
+		{*title, e.SetTitle},
+		{*author, e.SetAuthor},
+		{*lang, e.SetLang},
+		{*identifier, e.SetIdentifier},
+		{*description, e.SetDescription},
+	} {
+		if override.value != "" {
+			override.set(override.value)
+		}
+	}
+	if *cover != "" {
+		if err := e.SetCoverFromSource(*cover); err != nil {
+			return err
+		}
+	}
+	if *embedImages {
+		for _, failure := range e.EmbedImages() {
+			fmt.Fprintf(stderr, "go-epub: unable to embed %s in %s: %s\n", failure.Source, failure.File, failure.Err)
+		}
+	}
+
+	if *output == "" {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		*output = filepath.Base(absDir) + ".epub"
+	}
+	if err := e.Write(*output); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Wrote %s\n", *output)
+
+	if *stats {
+		printStats(stdout, e.Stats())
+	}
+	if *validate {
+		return validateFile(*output, stdout)
+	}
+	return nil
+}
+
+// buildEpub builds the EPUB from the book description at the path, or from the
+// folder at the path, and returns the folder of the book. The cover of the
+// description is left out unless withCover is true.
+func buildEpub(input string, withCover bool, options []epub.EpubOption) (*epub.Epub, string, error) {
+	info, err := os.Stat(input)
+	if err != nil {
+		return nil, "", err
+	}
+	descriptionPath, dir := input, filepath.Dir(input)
+	if info.IsDir() {
+		descriptionPath, dir = "", input
+		for _, filename := range descriptionFilenames {
+			if _, err := os.Stat(filepath.Join(input, filename)); err == nil {
+				descriptionPath = filepath.Join(input, filename)
+				break
+			}
+		}
+	}
+	if descriptionPath == "" {
+		e, err := epub.FromDir(dir, epub.WithEpubOptions(options...))
+		return e, dir, err
+	}
+
+	b, err := book.Load(descriptionPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if !withCover {
+		b.Cover = ""
+	}
+	e, err := b.Build(dir, options...)
+	return e, dir, err
+}
+
+// runValidate runs the validate command
+func runValidate(args []string, stdout io.Writer, stderr io.Writer) error {
+	flags := flag.NewFlagSet("go-epub validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, "Usage: go-epub validate <file.epub>...\n")
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitStatus(2)
+	}
+	var status error
+	for _, file := range flags.Args() {
+		if err := validateFile(file, stdout); err != nil {
+			if !errors.As(err, new(exitStatus)) {
+				return err
+			}
+			status = err
+		}
+	}
+	return status
+}
+
+// validateFile prints the problems of the EPUB at the path and returns
+// exitStatus(1) if there are errors
+func validateFile(file string, stdout io.Writer) error {
+	findings, err := epub.ValidateFile(file)
+	if err != nil {
+		return err
+	}
+	errorCount := 0
+	for _, finding := range findings {
+		fmt.Fprintf(stdout, "%s: %s\n", file, finding)
+		if finding.Severity == epub.SeverityError {
+			errorCount++
+		}
+	}
+	fmt.Fprintf(stdout, "%s: %d errors, %d warnings\n", file, errorCount, len(findings)-errorCount)
+	if errorCount > 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// runStats runs the stats command
+func runStats(args []string, stdout io.Writer, stderr io.Writer) error {
+	flags := flag.NewFlagSet("go-epub stats", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, "Usage: go-epub stats <file.epub>\n")
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitStatus(2)
+	}
+	r, err := epub.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	e, err := epub.Upgrade(&r.Reader)
+	if err != nil {
+		return err
+	}
+	printStats(stdout, e.Stats())
+	return nil
+}
+
+// printStats prints the statistics as a table
+func printStats(w io.Writer, stats epub.Stats) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Section\tWords\tCharacters\tReading time")
+	for _, section := range stats.Sections {
+		title := section.Title
+		if title == "" {
+			title = section.Filename
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", title, section.Words, section.Characters, section.ReadingTime.Round(time.Minute))
+	}
+	fmt.Fprintf(tw, "Total\t%d\t%d\t%s\n", stats.Words, stats.Characters, stats.ReadingTime.Round(time.Minute))
+	tw.Flush()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		localPath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(localPath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuildFolder(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"02-end.html":      "<html><body><h1>The &amp; <em>end</em></h1><p>Bye</p></body></html>",
+		"01-start.md":      "# Start\n\nHello [world](02-end.html).\n",
+		"assets/style.css": "p { margin: 0; }",
+		"notes/notes.txt":  "Ignored",
+		"old.epub":         "Previous build",
+		".hidden/file.txt": "Hidden",
+	})
+	output := filepath.Join(t.TempDir(), "out.epub")
+
+	var stdout, stderr bytes.Buffer
+	status := run([]string{"build", "-o", output, "-author", "Jane Doe", "-validate", "-stats", dir}, &stdout, &stderr)
+	if status != 0 {
+		t.Fatalf("Unexpected status %d: %s%s", status, stdout.String(), stderr.String())
+	}
+	for _, expected := range []string{"Wrote " + output, "Start", "The & end", "0 errors"} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Errorf("Output doesn't contain %q:\n%s", expected, stdout.String())
+		}
+	}
+
+	stdout.Reset()
+	if status := run([]string{"stats", output}, &stdout, &stderr); status != 0 {
+		t.Fatalf("Unexpected status %d: %s", status, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "Total") {
+		t.Errorf("Unexpected stats:\n%s", stdout.String())
+	}
+}
+
+func TestBuildDescription(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"book.json":  `{"title": "From JSON", "chapters": [{"title": "One", "file": "one.md"}]}`,
+		"one.md":     "Hello\n",
+		"ignored.md": "Not a chapter\n",
+	})
+	e, _, err := buildEpub(dir, true, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error building folder: %s", err)
+	}
+	if e.Title() != "From JSON" || len(e.Stats().Sections) != 1 {
+		t.Errorf("Unexpected EPUB %q with %d sections", e.Title(), len(e.Stats().Sections))
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	invalid := filepath.Join(t.TempDir(), "invalid.epub")
+	if err := os.WriteFile(invalid, []byte("Not an EPUB"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name   string
+		args   []string
+		status int
+	}{
+		{"no command", nil, 2},
+		{"unknown command", []string{"unknown"}, 2},
+		{"help", []string{"build", "-h"}, 0},
+		{"no input", []string{"build"}, 2},
+		{"missing input", []string{"build", filepath.Join(t.TempDir(), "missing")}, 1},
+		{"invalid EPUB", []string{"validate", invalid}, 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if status := run(tc.args, &stdout, &stderr); status != tc.status {
+				t.Errorf("Got status %d, expected %d: %s", status, tc.status, stderr.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package epub
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// Run with -race to detect unsynchronized accesses
+func TestConcurrentUse(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	source := NewEpub(testEpubTitle)
+	if _, err := source.AddSection(testSectionBody, testSectionTitle, "merged.xhtml", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				e.SetTitle(fmt.Sprintf("Title %d", j))
+				e.SetAuthor(fmt.Sprintf("Author %d", i))
+				_ = e.Title()
+				_ = e.Author()
+				_ = e.Identifier()
+				_ = e.Lang()
+				_ = e.Description()
+				_ = e.Ppd()
+				_ = e.Warnings()
+				_ = e.Stats()
+				if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+					t.Error(err)
+				}
+				if _, err := e.WriteTo(io.Discard); err != nil {
+					t.Error(err)
+				}
+				_ = e.Clone()
+			}
+		}(i)
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := Merge(e, source); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// Merging in both directions at the same time mustn't deadlock
+		if err := Merge(source, e); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	if got := len(e.Stats().Sections); got != 41 {
+		t.Errorf("Got %d sections, expected 41", got)
+	}
+}
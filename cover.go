@@ -0,0 +1,107 @@
+package epub
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+
+	"github.com/vincent-petithory/dataurl"
+)
+
+// SVGCoverTemplate is a cover template (see SetCoverTemplate) that wraps the
+// cover image in an SVG element, so that the image is scaled to fit the screen
+// while keeping its aspect ratio. Some readers (e.g. Kindle and Kobo) display
+// such covers better than the default <img> element.
+const SVGCoverTemplate = `<div style="height: 100vh; margin: 0; padding: 0; text-align: center;">
+  <svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.1" width="100%" height="100%" preserveAspectRatio="xMidYMid meet">
+    <image width="100%" height="100%" xlink:href="{{.ImagePath}}" />
+  </svg>
+</div>`
+
+// CoverTemplateData is the data used to execute a cover template (see
+// SetCoverTemplate).
+type CoverTemplateData struct {
+	ImagePath string // Relative path to the cover image, e.g. ../images/cover.png
+	Title     string // Title of the EPUB
+}
+
+// SetCoverTemplate sets the template used to generate the body of the cover
+// page, instead of the default <img> element. The template uses the syntax of
+// the html/template package and is executed with a CoverTemplateData, e.g.:
+//
+//	<img src="{{.ImagePath}}" alt="{{.Title}}" />
+//
+// See SVGCoverTemplate for a template that scales the cover image better on
+// some readers. The template can be set before or after the cover; the package
+// still takes care of adding the cover page to the manifest and the spine. An
+// empty template restores the default cover page body.
+//
+// An error will be returned if the template can't be parsed or executed.
+func (e *Epub) SetCoverTemplate(tmpl string) error {
+	e.Lock()
+	defer e.Unlock()
+
+	var coverTemplate *template.Template
+	if tmpl != "" {
+		var err error
+		coverTemplate, err = template.New("cover").Parse(tmpl)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Update the cover page if there's already one
+	if cover := e.findSection(e.cover.xhtmlFilename); cover != nil {
+		coverBody, err := executeCoverTemplate(coverTemplate, "../"+ImageFolderName+"/"+e.cover.imageFilename, e.title)
+		if err != nil {
+			return err
+		}
+		cover.xhtml.setBody(coverBody)
+	}
+	e.coverTemplate = coverTemplate
+	return nil
+}
+
+// SetDefaultCoverCSS sets the content of the stylesheet used by the cover page
+// when no CSS is passed to SetCover, instead of the default stylesheet, e.g. to
+// apply a house style to the covers of all the EPUBs of an organization. The CSS
+// can be set before or after the cover. An empty CSS restores the default
+// stylesheet.
+func (e *Epub) SetDefaultCoverCSS(css string) {
+	e.Lock()
+	defer e.Unlock()
+	e.coverCSS = css
+
+	// Update the cover stylesheet if the cover already uses the default one
+	if e.cover.cssTempFile != "" {
+		source := dataurl.New([]byte(e.defaultCoverCSS()), mediaTypeCSS, "charset", "utf-8").String()
+		e.css[e.cover.cssFilename] = source
+		e.cover.cssTempFile = source
+	}
+}
+
+// defaultCoverCSS returns the content of the stylesheet used by the cover page
+// when no CSS is passed to SetCover
+func (e *Epub) defaultCoverCSS() string {
+	if e.coverCSS == "" {
+		return defaultCoverCSSContent
+	}
+	return e.coverCSS
+}
+
+// executeCoverTemplate returns the body of the cover page, using the default
+// body if coverTemplate is nil
+func executeCoverTemplate(coverTemplate *template.Template, imagePath string, title string) (string, error) {
+	if coverTemplate == nil {
+		return fmt.Sprintf(defaultCoverBody, imagePath), nil
+	}
+	var b strings.Builder
+	err := coverTemplate.Execute(&b, CoverTemplateData{
+		ImagePath: imagePath,
+		Title:     title,
+	})
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,276 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CSSIssueType is the kind of problem a CSSIssue is about.
+type CSSIssueType int
+
+const (
+	// CSSParseError is the type of the issues about CSS that can't be parsed,
+	// e.g. an unclosed block, which can make reading systems ignore the rest
+	// of the file
+	CSSParseError CSSIssueType = iota
+	// CSSMissingFile is the type of the issues about links to files that
+	// aren't part of the EPUB, e.g. a font that wasn't added
+	CSSMissingFile
+	// CSSUnsupportedProperty is the type of the issues about declarations
+	// known to break the rendering on Kindle or Kobo readers, e.g. position:
+	// fixed
+	CSSUnsupportedProperty
+)
+
+// CSSIssue is a problem of a CSS file, as reported by LintCSS.
+type CSSIssue struct {
+	Type    CSSIssueType
+	File    string // The internal path of the CSS file, e.g. css/style.css
+	Line    int    // The line of the problem in the CSS file, starting at 1
+	Message string
+}
+
+// String returns the issue as a single line, e.g.
+// css/style.css:3: position: fixed isn't supported by Kindle and Kobo readers
+func (i CSSIssue) String() string {
+	return fmt.Sprintf("%s:%d: %s", i.File, i.Line, i.Message)
+}
+
+// cssDeclarationRule flags the declarations of a property known to break the
+// rendering on e-readers
+type cssDeclarationRule struct {
+	property string
+	// Reports whether the value, in lowercase, is a problem given the selector
+	// of the rule, nil if any value is
+	matches func(selector string, value string) bool
+	message string
+}
+
+// cssDeclarationRules are the declarations reported as CSSUnsupportedProperty
+var cssDeclarationRules = []cssDeclarationRule{
+	{
+		property: "position",
+		matches:  func(_ string, value string) bool { return value == "fixed" },
+		message:  "position: fixed isn't supported by Kindle and Kobo readers",
+	},
+	{
+		property: "position",
+		matches:  func(_ string, value string) bool { return value == "absolute" },
+		message:  "absolutely positioned content may overlap other content or disappear on Kindle and Kobo readers",
+	},
+	{
+		property: "overflow",
+		matches:  func(selector string, value string) bool { return value == "hidden" && cssSelectsRoot(selector) },
+		message:  "overflow: hidden on the body hides the content that doesn't fit in the first page on Kindle and Kobo readers",
+	},
+	{
+		property: "height",
+		matches: func(selector string, value string) bool {
+			return strings.HasSuffix(value, "vh") || (value == "100%" && cssSelectsRoot(selector))
+		},
+		message: "a height relative to the screen can render blank pages on Kindle and Kobo readers",
+	},
+	{
+		property: "display",
+		matches:  func(selector string, value string) bool { return value == "none" && cssSelectsRoot(selector) },
+		message:  "display: none on the body hides the whole section",
+	},
+	{
+		property: "column-count",
+		message:  "multi-column layouts break the pagination of Kindle readers",
+	},
+	{
+		property: "columns",
+		message:  "multi-column layouts break the pagination of Kindle readers",
+	},
+	{
+		property: "font-size",
+		matches: func(_ string, value string) bool {
+			return strings.Trim(value, "0.") == "" || value == "0px" || value == "0em"
+		},
+		message: "font-size: 0 makes the text invisible",
+	},
+}
+
+// cssSelectsRoot returns whether a selector of the selector list selects the
+// html or body element itself
+func cssSelectsRoot(selector string) bool {
+	for _, s := range strings.Split(strings.ToLower(selector), ",") {
+		if s = strings.TrimSpace(s); s == "html" || s == "body" || s == "html body" || s == "html > body" {
+			return true
+		}
+	}
+	return false
+}
+
+// LintCSS returns the problems found in the CSS files of the EPUB, in the
+// order of their paths, since broken CSS is a common cause of sections that
+// render blank:
+//   - CSS that can't be parsed, e.g. unclosed blocks, comments or strings
+//   - links to files that aren't part of the EPUB, e.g. fonts that weren't
+//     added
+//   - declarations known to break the rendering on Kindle or Kobo readers
+//
+// The CSS files are retrieved from their source. Nothing is changed; the
+// problems are left for the caller to fix or to report.
+func (e *Epub) LintCSS() ([]CSSIssue, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	files := make(map[string]bool)
+	for mediaFolderName, mediaMap := range e.mediaFolders() {
+		for filename := range mediaMap {
+			files[path.Join(mediaFolderName, filename)] = true
+		}
+	}
+	for rawPath := range e.rawFiles {
+		files[rawPath] = true
+	}
+
+	issues := []CSSIssue{}
+	g := e.grabber()
+	for _, cssFilename := range sortedMediaFilenames(CSSFolderName, e.css, nil) {
+		css, err := g.readCSS(context.Background(), e.css[cssFilename])
+		if err != nil {
+			return nil, err
+		}
+		cssIssues, _ := lintCSS(path.Join(CSSFolderName, cssFilename), string(css), files)
+		issues = append(issues, cssIssues...)
+	}
+	return issues, nil
+}
+
+// cssBlock is a block of CSS being parsed by lintCSS
+type cssBlock struct {
+	prelude string // The selector or the at-rule of the block
+	line    int    // The line the block starts at
+}
+
+// cssSpan is the range of bytes [start, end) of a declaration in a CSS file
+type cssSpan struct {
+	start int
+	end   int
+}
+
+// lintCSS returns the problems of the CSS file at the path relative to the
+// content folder, given the files of the EPUB by path, along with the spans of
+// the declarations reported as CSSUnsupportedProperty
+func lintCSS(cssPath string, css string, files map[string]bool) ([]CSSIssue, []cssSpan) {
+	var issues []CSSIssue
+	var unsupported []cssSpan
+	add := func(issueType CSSIssueType, line int, format string, a ...interface{}) {
+		issues = append(issues, CSSIssue{Type: issueType, File: cssPath, Line: line, Message: fmt.Sprintf(format, a...)})
+	}
+
+	var blocks []cssBlock
+	var buf strings.Builder
+	line, bufLine, bufStart := 1, 1, 0
+	// declaration checks the declaration or the statement in buf, which ends
+	// at the byte end
+	declaration := func(end int) {
+		text := strings.TrimSpace(buf.String())
+		buf.Reset()
+		if text == "" || len(blocks) == 0 || strings.HasPrefix(text, "@") {
+			return
+		}
+		property, value, ok := strings.Cut(text, ":")
+		if !ok {
+			add(CSSParseError, bufLine, "invalid declaration %q", text)
+			return
+		}
+		property = strings.ToLower(strings.TrimSpace(property))
+		value = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important")))
+		selector := blocks[len(blocks)-1].prelude
+		for _, rule := range cssDeclarationRules {
+			if rule.property == property && (rule.matches == nil || rule.matches(selector, value)) {
+				add(CSSUnsupportedProperty, bufLine, "%s", rule.message)
+				if len(unsupported) == 0 || unsupported[len(unsupported)-1].start != bufStart {
+					unsupported = append(unsupported, cssSpan{start: bufStart, end: end})
+				}
+			}
+		}
+	}
+
+	for i := 0; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case c == '/' && strings.HasPrefix(css[i:], "/*"):
+			end := strings.Index(css[i+2:], "*/")
+			if end == -1 {
+				add(CSSParseError, line, "unclosed comment")
+				return issues, unsupported
+			}
+			line += strings.Count(css[i:i+2+end], "\n")
+			i += end + 3
+			continue
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(css) && css[end] != c && css[end] != '\n' {
+				if css[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(css) || css[end] != c {
+				add(CSSParseError, line, "unclosed string")
+				end--
+			}
+			if end >= len(css) {
+				end = len(css) - 1
+			}
+			if buf.Len() == 0 {
+				bufLine, bufStart = line, i
+			}
+			buf.WriteString(css[i : end+1])
+			// Escaped line breaks
+			line += strings.Count(css[i:end+1], "\n")
+			i = end
+			continue
+		case c == '{':
+			blocks = append(blocks, cssBlock{prelude: strings.TrimSpace(buf.String()), line: line})
+			buf.Reset()
+		case c == '}':
+			if len(blocks) == 0 {
+				add(CSSParseError, line, "unexpected }")
+				buf.Reset()
+				break
+			}
+			declaration(i)
+			blocks = blocks[:len(blocks)-1]
+		case c == ';':
+			declaration(i + 1)
+		default:
+			if buf.Len() == 0 && c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+				bufLine, bufStart = line, i
+			}
+			if buf.Len() > 0 || (c != ' ' && c != '\t' && c != '\n' && c != '\r') {
+				buf.WriteByte(c)
+			}
+		}
+		if c == '\n' {
+			line++
+		}
+	}
+	for _, block := range blocks {
+		add(CSSParseError, block.line, "unclosed block %q", block.prelude)
+	}
+
+	for _, m := range cssLinkRegex.FindAllStringSubmatchIndex(css, -1) {
+		var link string
+		for g := 1; g <= 2; g++ {
+			if m[2*g] != -1 {
+				link += css[m[2*g]:m[2*g+1]]
+			}
+		}
+		linkPath, _ := splitFragment(link)
+		if linkPath == "" || isRemoteLink(linkPath) {
+			continue
+		}
+		if resolved := resolveLink(cssPath, link); !files[resolved] {
+			add(CSSMissingFile, strings.Count(css[:m[0]], "\n")+1, "link %q to a file that isn't part of the EPUB", link)
+		}
+	}
+	return issues, unsupported
+}
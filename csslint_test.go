@@ -0,0 +1,95 @@
+package epub
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vincent-petithory/dataurl"
+)
+
+func TestLintCSS(t *testing.T) {
+	testCases := []struct {
+		name     string
+		css      string
+		expected []CSSIssue
+	}{
+		{
+			name: "valid",
+			css: "@font-face { font-family: \"Redacted\"; src: url('../fonts/redacted-script-regular.ttf'); }\n" +
+				"/* position: fixed; { */\n" +
+				"body { margin: 0; background: url(\"data:image/png;base64,AAAA\"); }\n" +
+				"p::before { content: \"}\"; }\n",
+		},
+		{
+			name: "parse errors",
+			css:  "p { margin 0; }\n}\ndiv { color: red;\n",
+			expected: []CSSIssue{
+				{Type: CSSParseError, Line: 1, Message: `invalid declaration "margin 0"`},
+				{Type: CSSParseError, Line: 2, Message: "unexpected }"},
+				{Type: CSSParseError, Line: 3, Message: `unclosed block "div"`},
+			},
+		},
+		{
+			name: "unclosed comment",
+			css:  "p { color: red; }\n/* p { position: fixed; }\n",
+			expected: []CSSIssue{
+				{Type: CSSParseError, Line: 2, Message: "unclosed comment"},
+			},
+		},
+		{
+			name: "unclosed string",
+			css:  "p::before {\n  content: \"a;\n}\n",
+			expected: []CSSIssue{
+				{Type: CSSParseError, Line: 2, Message: "unclosed string"},
+			},
+		},
+		{
+			name: "missing files",
+			css:  "@import \"other.css\";\nbody { background: url(../images/missing.png#x); }\n",
+			expected: []CSSIssue{
+				{Type: CSSMissingFile, Line: 1, Message: `link "other.css" to a file that isn't part of the EPUB`},
+				{Type: CSSMissingFile, Line: 2, Message: `link "../images/missing.png#x" to a file that isn't part of the EPUB`},
+			},
+		},
+		{
+			name: "unsupported properties",
+			css: "html, body { height: 100%; overflow: HIDDEN !important; }\n" +
+				"p { height: 100%; overflow: hidden; }\n" +
+				"@media screen {\n  .header { position: fixed; columns: 2; }\n}\n",
+			expected: []CSSIssue{
+				{Type: CSSUnsupportedProperty, Line: 1, Message: cssDeclarationRules[3].message},
+				{Type: CSSUnsupportedProperty, Line: 1, Message: cssDeclarationRules[2].message},
+				{Type: CSSUnsupportedProperty, Line: 4, Message: cssDeclarationRules[0].message},
+				{Type: CSSUnsupportedProperty, Line: 4, Message: cssDeclarationRules[6].message},
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			e := NewEpub(testEpubTitle)
+			if _, err := e.AddFont("testdata/redacted-script-regular.ttf", ""); err != nil {
+				t.Fatal(err)
+			}
+			cssPath, err := e.AddCSS(dataurl.New([]byte(testCase.css), mediaTypeCSS).String(), "style.css")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cssPath != "../css/style.css" {
+				t.Fatalf("Unexpected CSS path: %s", cssPath)
+			}
+
+			issues, err := e.LintCSS()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []CSSIssue{}
+			for _, issue := range testCase.expected {
+				issue.File = "css/style.css"
+				expected = append(expected, issue)
+			}
+			if !reflect.DeepEqual(issues, expected) {
+				t.Errorf("Unexpected issues\nGot: %#v\nExpected: %#v", issues, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package epub
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"path"
+	"strings"
+)
+
+const (
+	dictionaryEntryIDFormat = "entry%04d"
+	// <article> element of a dictionary entry, the definition goes after the
+	// headword
+	dictionaryEntryFormat = `<article id="%s" epub:type="dictentry">
+  <dfn>%s</dfn>
+  %s
+</article>
+`
+	dictionaryType            = "dictionary"
+	mediaTypeSearchKeyMap     = "application/vnd.epub.search-key-map+xml"
+	pkgSourceLanguageProperty = "source-language"
+	pkgTargetLanguageProperty = "target-language"
+	searchKeyMapFilename      = "search-key-map.xml"
+	searchKeyMapID            = "search-key-map"
+	searchKeyMapProperties    = "dictionary search-key-map"
+)
+
+// InvalidDictionaryEntryError is thrown by AddDictionarySection if an entry
+// has no headword or the same ID as another entry.
+type InvalidDictionaryEntryError struct {
+	Index int   // Index of the entry
+	Err   error // Underlying error
+}
+
+func (e *InvalidDictionaryEntryError) Error() string {
+	return fmt.Sprintf("Invalid dictionary entry %d: %s", e.Index, e.Err)
+}
+
+func (e *InvalidDictionaryEntryError) Unwrap() error {
+	return e.Err
+}
+
+// DictionaryEntry is an entry of a dictionary section (see
+// AddDictionarySection).
+type DictionaryEntry struct {
+	// ID of the entry in the section, which can be used for links; if no ID
+	// is provided, one will be generated, e.g. entry0001
+	ID string
+	// Word or phrase defined by the entry
+	Headword string
+	// Other forms of the headword which lead to the entry when they're looked
+	// up, e.g. plurals or conjugated forms
+	Forms []string
+	// Definition of the headword, which must be valid XHTML that will go after
+	// the headword in the entry. The content will not be validated.
+	Definition string
+}
+
+// The search key map document of a dictionary, which reading systems use to
+// look up words
+// Ex: <search-key-map xmlns="http://www.idpf.org/2007/ops" xml:lang="en">
+//
+//	  <search-key-group href="xhtml/section0001.xhtml#entry0001">
+//	    <match value="cat">
+//	      <value value="cats"></value>
+//	    </match>
+//	  </search-key-group>
+//	</search-key-map>
+type searchKeyMapRoot struct {
+	XMLName xml.Name         `xml:"http://www.idpf.org/2007/ops search-key-map"`
+	XMLLang string           `xml:"xml:lang,attr,omitempty"`
+	Groups  []searchKeyGroup `xml:"search-key-group"`
+}
+
+type searchKeyGroup struct {
+	Href  string         `xml:"href,attr"`
+	Match searchKeyMatch `xml:"match"`
+}
+
+type searchKeyMatch struct {
+	Value  string           `xml:"value,attr"`
+	Values []searchKeyValue `xml:"value"`
+}
+
+type searchKeyValue struct {
+	Value string `xml:"value,attr"`
+}
+
+// SetDictionaryLanguages sets the language of the headwords and the language of
+// the definitions of the dictionary sections (see AddDictionarySection), e.g.
+// en and fr for an English-French dictionary. Both languages are the same for a
+// monolingual dictionary. They're added to the metadata as source-language and
+// target-language; empty languages are left out. If no source language is set,
+// the language of the EPUB is used for the search key map.
+func (e *Epub) SetDictionaryLanguages(source string, target string) {
+	e.Lock()
+	defer e.Unlock()
+	e.dictionaryLang = source
+	e.pkg.setDictionaryLanguages(source, target)
+}
+
+// AddDictionarySection adds a section of dictionary entries to the EPUB and
+// returns a relative path to the section, like AddSection. The EPUB follows the
+// EPUB Dictionaries and Glossaries specification, so that reading systems that
+// support it (e.g. Kobo and Apple Books) can use it as a dictionary: the body
+// of the section is marked as a dictionary (epub:type="dictionary") with one
+// <article> per entry, and the headwords and their forms are added to the
+// search key map of the EPUB, which is written along with the dc:type
+// dictionary metadata when the EPUB is written.
+//
+// The same errors as AddSection are returned. If an entry has no headword or
+// has the same ID as another entry, InvalidDictionaryEntryError will be
+// returned.
+func (e *Epub) AddDictionarySection(entries []DictionaryEntry, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	entries = append([]DictionaryEntry{}, entries...)
+	ids := make(map[string]bool)
+	for i, entry := range entries {
+		if strings.TrimSpace(entry.Headword) == "" {
+			return "", &InvalidDictionaryEntryError{Index: i, Err: errors.New("no headword")}
+		}
+		if ids[entry.ID] {
+			return "", &InvalidDictionaryEntryError{Index: i, Err: fmt.Errorf("ID %s already used", entry.ID)}
+		}
+		if entry.ID != "" {
+			ids[entry.ID] = true
+		}
+	}
+
+	var body strings.Builder
+	for i := range entries {
+		// Generated IDs skip the ones that were provided
+		for n := i + 1; entries[i].ID == ""; n++ {
+			if id := fmt.Sprintf(dictionaryEntryIDFormat, n); !ids[id] {
+				entries[i].ID = id
+				ids[id] = true
+			}
+		}
+		entries[i].Forms = append([]string{}, entries[i].Forms...)
+		fmt.Fprintf(&body, dictionaryEntryFormat, html.EscapeString(entries[i].ID), html.EscapeString(entries[i].Headword), entries[i].Definition)
+	}
+
+	filename, err := e.addSection("", body.String(), sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	s := e.findSection(filename)
+	s.xhtml.setEpubType(dictionaryType)
+	s.dictionary = entries
+	return filename, nil
+}
+
+// writeSearchKeyMap writes the search key map of the dictionary sections, if
+// there are some, and adds it to the package file, which marks the EPUB as a
+// dictionary
+func (e *Epub) writeSearchKeyMap(w epubFileWriter) error {
+	root := searchKeyMapRoot{XMLLang: e.dictionaryLang}
+	if root.XMLLang == "" {
+		root.XMLLang = e.lang
+	}
+	e.forEachSection(func(s *epubSection) {
+		for _, entry := range s.dictionary {
+			group := searchKeyGroup{
+				Href:  path.Join(xhtmlFolderName, s.filename) + "#" + entry.ID,
+				Match: searchKeyMatch{Value: entry.Headword},
+			}
+			for _, form := range entry.Forms {
+				group.Match.Values = append(group.Match.Values, searchKeyValue{Value: form})
+			}
+			root.Groups = append(root.Groups, group)
+		}
+	})
+	if root.Groups == nil {
+		e.pkg.setType("")
+		return nil
+	}
+
+	output, err := xml.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling XML for search key map: %w", err)
+	}
+	// Add the xml header to the output
+	content := append([]byte(xml.Header), output...)
+	// It's generally nice to have files end with a newline
+	content = append(content, "\n"...)
+
+	if err := w(path.Join(contentFolderName, searchKeyMapFilename), mediaTypeSearchKeyMap, content); err != nil {
+		return fmt.Errorf("error writing search key map: %w", err)
+	}
+	e.pkg.addToManifest(searchKeyMapID, searchKeyMapFilename, mediaTypeSearchKeyMap, searchKeyMapProperties)
+	e.pkg.setType(dictionaryType)
+	return nil
+}
@@ -0,0 +1,119 @@
+package epub
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAddDictionarySection(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	e.SetDictionaryLanguages("en", "fr")
+	filename, err := e.AddDictionarySection([]DictionaryEntry{
+		{Headword: "cat", Forms: []string{"cats"}, Definition: "<p>chat</p>"},
+		{ID: "entry0001", Headword: "R&D", Definition: "<p>R&amp;D</p>"},
+	}, "A-Z", "dictionary.xhtml", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	r := newTestReader(t, e)
+	section, err := r.ReadFile("EPUB/xhtml/" + filename)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`epub:type="dictionary">`,
+		`<article id="entry0002" epub:type="dictentry">`,
+		`<dfn>cat</dfn>`,
+		`<p>chat</p>`,
+		`<article id="entry0001" epub:type="dictentry">`,
+		`<dfn>R&amp;D</dfn>`,
+	} {
+		if !strings.Contains(string(section), expected) {
+			t.Errorf("Section doesn't contain %s:\n%s", expected, section)
+		}
+	}
+
+	skm, err := r.ReadFile("EPUB/search-key-map.xml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`<search-key-map xmlns="http://www.idpf.org/2007/ops" xml:lang="en">`,
+		`<search-key-group href="xhtml/dictionary.xhtml#entry0002">`,
+		`<match value="cat">`,
+		`<value value="cats"></value>`,
+		`<search-key-group href="xhtml/dictionary.xhtml#entry0001">`,
+		`<match value="R&amp;D"></match>`,
+	} {
+		if !strings.Contains(string(skm), expected) {
+			t.Errorf("Search key map doesn't contain %s:\n%s", expected, skm)
+		}
+	}
+
+	opf, err := r.ReadFile("EPUB/package.opf")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`<dc:type>dictionary</dc:type>`,
+		`<meta property="source-language">en</meta>`,
+		`<meta property="target-language">fr</meta>`,
+		`<item id="search-key-map" href="search-key-map.xml" media-type="application/vnd.epub.search-key-map+xml" properties="dictionary search-key-map"></item>`,
+	} {
+		if !strings.Contains(string(opf), expected) {
+			t.Errorf("Package file doesn't contain %s:\n%s", expected, opf)
+		}
+	}
+	if strings.Contains(string(opf), `<itemref idref="search-key-map"`) {
+		t.Errorf("Search key map in the spine:\n%s", opf)
+	}
+
+	findings, err := e.Validate()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("Unexpected findings: %+v", findings)
+	}
+}
+
+func TestAddDictionarySectionErrors(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	var entryErr *InvalidDictionaryEntryError
+	if _, err := e.AddDictionarySection([]DictionaryEntry{{Headword: "cat"}, {Headword: " "}}, "", "", ""); !errors.As(err, &entryErr) || entryErr.Index != 1 {
+		t.Errorf("Expected InvalidDictionaryEntryError for entry 1, got %v", err)
+	}
+	if _, err := e.AddDictionarySection([]DictionaryEntry{{ID: "a", Headword: "cat"}, {ID: "a", Headword: "dog"}}, "", "", ""); !errors.As(err, &entryErr) || entryErr.Index != 1 {
+		t.Errorf("Expected InvalidDictionaryEntryError for entry 1, got %v", err)
+	}
+	if _, err := e.AddDictionarySection([]DictionaryEntry{{Headword: "cat"}}, "", "dictionary.xhtml", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var filenameErr *FilenameAlreadyUsedError
+	if _, err := e.AddDictionarySection([]DictionaryEntry{{Headword: "cat"}}, "", "dictionary.xhtml", ""); !errors.As(err, &filenameErr) {
+		t.Errorf("Expected FilenameAlreadyUsedError, got %v", err)
+	}
+}
+
+func TestNoDictionary(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e.SetDictionaryLanguages("en", "")
+	e.SetDictionaryLanguages("", "")
+	opf, err := e.DumpOPF()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, unexpected := range []string{"dc:type", "search-key-map", "-language"} {
+		if strings.Contains(opf, unexpected) {
+			t.Errorf("Package file contains %s:\n%s", unexpected, opf)
+		}
+	}
+}
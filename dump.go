@@ -0,0 +1,70 @@
+package epub
+
+import (
+	"context"
+	"io"
+	"path"
+)
+
+// DumpOPF returns the package file (package.opf) that would be written, e.g. to
+// inspect the metadata, the manifest or the spine in tests or while
+// troubleshooting without writing and unzipping the EPUB.
+//
+// The manifest depends on the media, so the media is retrieved as when the EPUB
+// is written and the same errors may be returned, but nothing is written and
+// the function set by SetProgressFunc isn't called. The modification date is
+// the current time.
+func (e *Epub) DumpOPF() (string, error) {
+	return e.dump(pkgFilename)
+}
+
+// DumpNav returns the EPUB v3 table of contents (nav.xhtml) that would be
+// written. See DumpOPF.
+func (e *Epub) DumpNav() (string, error) {
+	return e.dump(tocNavFilename)
+}
+
+// DumpNCX returns the EPUB v2 table of contents (toc.ncx) that would be
+// written, or an empty string if it's left out (see SetNcx). See DumpOPF.
+func (e *Epub) DumpNCX() (string, error) {
+	return e.dump(tocNcxFilename)
+}
+
+// dump builds the EPUB without writing it and returns the content of the
+// generated file with the filename in the content folder
+func (e *Epub) dump(filename string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	ctx := context.Background()
+	fetchCtx, g, orphans, done, err := e.prepareWrite(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	e.progress = newWriteProgressTracker(nil, e.logger)
+
+	sink := dumpSink{name: path.Join(contentFolderName, filename)}
+	if err := e.writeDirectFiles(ctx, fetchCtx, g, &sink, orphans); err != nil {
+		return "", err
+	}
+	return string(sink.content), nil
+}
+
+// dumpSink discards the files of an EPUB except the one with the given path
+// (see DumpOPF)
+type dumpSink struct {
+	name    string
+	content []byte
+}
+
+func (s *dumpSink) create(name string, mediaType string) (io.WriteCloser, error) {
+	return nopWriteCloser{io.Discard}, nil
+}
+
+func (s *dumpSink) write(name string, mediaType string, content []byte) error {
+	if name == s.name {
+		s.content = content
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package epub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddImage(testImageFromFileSource, "image.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "section.xhtml", ""); err != nil {
+		t.Fatal(err)
+	}
+	progressCalled := false
+	e.SetProgressFunc(func(WriteProgress) {
+		progressCalled = true
+	})
+
+	testCases := []struct {
+		name     string
+		dump     func() (string, error)
+		contains []string
+	}{
+		{"OPF", e.DumpOPF, []string{testEpubTitle, `href="images/image.png"`, `media-type="image/png"`, `<itemref idref="section.xhtml">`}},
+		{"Nav", e.DumpNav, []string{`<a href="xhtml/section.xhtml">` + testSectionTitle + `</a>`}},
+		{"NCX", e.DumpNCX, []string{`<content src="xhtml/section.xhtml">`}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dump, err := tc.dump()
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			for _, expected := range tc.contains {
+				if !strings.Contains(dump, expected) {
+					t.Errorf("Dump doesn't contain %s:\n%s", expected, dump)
+				}
+			}
+		})
+	}
+	if progressCalled {
+		t.Error("The progress func was called by a dump")
+	}
+
+	// The dump is the same as the written file
+	dump, err := e.DumpNav()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestReader(t, e)
+	written, err := r.ReadFile("EPUB/nav.xhtml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump != string(written) {
+		t.Errorf("Dump differs from the written file:\n%s\n%s", dump, written)
+	}
+
+	e.SetNcx(false)
+	if dump, err := e.DumpNCX(); err != nil || dump != "" {
+		t.Errorf("Got NCX %q and error %v, expected none", dump, err)
+	}
+}
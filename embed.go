@@ -0,0 +1,458 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/vincent-petithory/dataurl"
+)
+
+var (
+	// cssURLRegex matches the url() references of CSS. The URL is in the first
+	// group that matched: double quotes, single quotes, double or single quotes
+	// escaped as XHTML character references, or no quotes.
+	cssURLRegex = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|&quot;(.*?)&quot;|&#39;(.*?)&#39;|([^"'()\s]*))\s*\)`)
+	// fontFaceRegex matches the @font-face rules of CSS
+	fontFaceRegex = regexp.MustCompile(`@font-face\s*{[^}]*}`)
+	// styleElementRegex matches the <style> elements of XHTML, the CSS being in
+	// the second group
+	styleElementRegex = regexp.MustCompile(`(?s)(<style[^>]*>)(.*?)(</style>)`)
+	// styleAttributeRegex matches the style attributes of XHTML elements, the CSS
+	// being in the second group if the value is in double quotes or in the third
+	// group if it's in single quotes
+	styleAttributeRegex = regexp.MustCompile(`(\sstyle\s*=\s*)(?:"([^"]*)"|'([^']*)')`)
+	// pictureElementRegex matches the <picture> elements of XHTML
+	pictureElementRegex = regexp.MustCompile(`(?s)<picture[^>]*>.*?</picture>`)
+	// imgTagRegex matches the <img> tags of XHTML
+	imgTagRegex = regexp.MustCompile(`<img[^>]*>`)
+	// sourceTagRegex matches the <source> tags of XHTML
+	sourceTagRegex = regexp.MustCompile(`<source[^>]*>`)
+	// audioVideoElementRegex matches the <audio> and <video> elements of XHTML,
+	// the name of the element being in the first group
+	audioVideoElementRegex = regexp.MustCompile(`(?s)<(audio|video)\b[^>]*?(?:/>|>.*?</(?:audio|video)>)`)
+	// audioVideoTagRegex matches the tags of XHTML that reference audio and
+	// video files
+	audioVideoTagRegex = regexp.MustCompile(`<(?:audio|video|source)\b[^>]*>`)
+)
+
+// fontExtensions are the extensions of the font files referenced from CSS
+var fontExtensions = map[string]bool{
+	".eot":   true,
+	".otf":   true,
+	".sfnt":  true,
+	".ttf":   true,
+	".woff":  true,
+	".woff2": true,
+}
+
+// EmbedFailurePolicy defines how EmbedImages handles images that can't be
+// retrieved.
+type EmbedFailurePolicy int
+
+const (
+	// EmbedFailureKeep leaves the references to the images as is (default)
+	EmbedFailureKeep EmbedFailurePolicy = iota
+	// EmbedFailureStrip removes the <img> tags of the images and replaces their
+	// url() references from CSS with none
+	EmbedFailureStrip
+	// EmbedFailurePlaceholder replaces the images with a blank placeholder
+	// image
+	EmbedFailurePlaceholder
+)
+
+// EmbedFailure is media that EmbedImages couldn't embed in the EPUB.
+type EmbedFailure struct {
+	Source string // The source of the media, as referenced by the file
+	File   string // The internal path of the section or CSS file referencing the media
+	Err    error  // The error that was thrown
+}
+
+// mediaEmbedder embeds the media referenced by the sections and CSS files of an
+// EPUB (see EmbedImages and EmbedAudioVideo)
+type mediaEmbedder struct {
+	e      *Epub
+	g      grabber
+	policy EmbedFailurePolicy
+	// The internal path of the file whose references are being embedded
+	file     string
+	failures []EmbedFailure
+}
+
+// EmbedImages download <img> tags in EPUB and modify body to show images
+// file inside of EPUB:
+// ../ImageFolderName/internalFilename
+//
+// The image source should either be a URL, a path to a local file, or an embedded data URL; in any
+// case, the image file will be retrieved and stored in the EPUB.
+//
+// Responsive images are reduced to a single image: the candidate with the
+// highest resolution of the srcset attribute of <img> tags becomes their src
+// attribute, and <picture> elements are replaced by their <img> tag, using the
+// candidates of their first <source> tag if the <img> tag has none.
+//
+// Remote images and fonts referenced with url() from CSS are embedded as well,
+// e.g. background images and @font-face sources. This applies to the style
+// attributes and <style> elements of the sections as well as to the CSS files
+// of the EPUB; CSS files referencing remote media are stored with the
+// references replaced. References relative to a CSS file retrieved from a URL
+// are resolved against its URL.
+//
+// The media that couldn't be embedded is returned. Images that can't be
+// retrieved are handled according to the embed failure policy (see
+// SetEmbedFailurePolicy); references to other media are left as is.
+
+// Just call EmbedImages() after section added
+func (e *Epub) EmbedImages() []EmbedFailure {
+	e.Lock()
+	defer e.Unlock()
+	m := &mediaEmbedder{
+		e:      e,
+		g:      e.grabber(),
+		policy: e.embedFailurePolicy,
+	}
+
+	imageTagRegex := regexp.MustCompile(`<img.*?src="(.*?)".*?>`)
+	e.forEachSection(func(section *epubSection) {
+		m.file = path.Join(xhtmlFolderName, section.filename)
+		body := selectImageCandidates(section.xhtml.xml.Body.XML)
+		for _, match := range imageTagRegex.FindAllStringSubmatch(body, -1) {
+			imageURL := match[1]
+			if !strings.HasPrefix(imageURL, "data:image/") && !m.isEmbedded(imageURL) {
+				filePath, err := addMedia(m.g, imageURL, "", imageFileFormat, ImageFolderName, e.images)
+				if err != nil {
+					switch m.fail(imageURL, err) {
+					case EmbedFailureStrip:
+						body = strings.ReplaceAll(body, match[0], "")
+					case EmbedFailurePlaceholder:
+						if placeholderPath, err := m.placeholder(); err == nil {
+							body = strings.ReplaceAll(body, match[0], replaceSrcAttribute(match[0], placeholderPath))
+						}
+					}
+					continue
+				}
+				body = strings.ReplaceAll(body, match[0], replaceSrcAttribute(match[0], filePath))
+			}
+		}
+		section.xhtml.xml.Body.XML = m.embedXHTMLCSSMedia(body)
+	})
+
+	for cssFilename, cssSource := range e.css {
+		m.file = path.Join(CSSFolderName, cssFilename)
+		css, err := m.g.readCSS(context.Background(), cssSource)
+		if err != nil {
+			m.failures = append(m.failures, EmbedFailure{Source: cssSource, File: m.file, Err: err})
+			continue
+		}
+		var base *url.URL
+		if detectMediaType(cssSource) == "URL" {
+			base, _ = url.Parse(cssSource)
+		}
+		embedded := m.embedCSSMedia(string(css), base, `"`)
+		if embedded != string(css) {
+			e.css[cssFilename] = dataurl.New([]byte(embedded), mediaTypeCSS, "charset", "utf-8").String()
+		}
+	}
+	return m.failures
+}
+
+// EmbedAudioVideo downloads the audio and video files referenced by the <audio>
+// and <video> elements of the sections, as well as by their <source> elements,
+// and replaces the references with the paths of the files inside the EPUB:
+// ../AudioFolderName/internalFilename or ../VideoFolderName/internalFilename
+//
+// The sources of <source> elements are stored as audio or video files
+// depending on the element they belong to. The poster images of <video>
+// elements are stored as images. Media added with AddRemoteAudio or
+// AddRemoteVideo is left as is, as well as data URLs.
+//
+// The media that couldn't be embedded is returned and the references to it are
+// left as is.
+func (e *Epub) EmbedAudioVideo() []EmbedFailure {
+	e.Lock()
+	defer e.Unlock()
+	m := &mediaEmbedder{
+		e: e,
+		g: e.grabber(),
+	}
+
+	e.forEachSection(func(section *epubSection) {
+		m.file = path.Join(xhtmlFolderName, section.filename)
+		section.xhtml.xml.Body.XML = audioVideoElementRegex.ReplaceAllStringFunc(section.xhtml.xml.Body.XML, func(element string) string {
+			mediaFileFormat, mediaFolderName, mediaMap := videoFileFormat, VideoFolderName, e.videos
+			if audioVideoElementRegex.FindStringSubmatch(element)[1] == "audio" {
+				mediaFileFormat, mediaFolderName, mediaMap = audioFileFormat, AudioFolderName, e.audios
+			}
+			return audioVideoTagRegex.ReplaceAllStringFunc(element, func(tag string) string {
+				tag = m.embedAttribute(tag, "src", mediaFileFormat, mediaFolderName, mediaMap)
+				if strings.HasPrefix(tag, "<video") {
+					tag = m.embedAttribute(tag, "poster", imageFileFormat, ImageFolderName, e.images)
+				}
+				return tag
+			})
+		})
+	})
+	return m.failures
+}
+
+// embedAttribute adds the media referenced by the attribute of the XHTML tag to
+// the EPUB and replaces the reference with its internal path
+func (m *mediaEmbedder) embedAttribute(tag string, name string, mediaFileFormat string, mediaFolderName string, mediaMap map[string]string) string {
+	source := html.UnescapeString(getAttribute(tag, name))
+	if source == "" || strings.HasPrefix(source, "data:") || m.isEmbedded(source) {
+		return tag
+	}
+	if _, ok := m.e.remoteMedia[source]; ok {
+		return tag
+	}
+	filePath, err := addMedia(m.g, source, "", mediaFileFormat, mediaFolderName, mediaMap)
+	if err != nil {
+		m.fail(source, err)
+		return tag
+	}
+	return setAttribute(tag, name, filePath)
+}
+
+// isEmbedded reports whether the link of the current file references media
+// that is already part of the EPUB, e.g. the image of the cover
+func (m *mediaEmbedder) isEmbedded(link string) bool {
+	p := resolveLink(m.file, link)
+	if p == "" {
+		return false
+	}
+	_, ok := m.e.mediaFolders()[path.Dir(p)][path.Base(p)]
+	return ok
+}
+
+// fail records the failure to embed the media and returns the policy to apply
+func (m *mediaEmbedder) fail(source string, err error) EmbedFailurePolicy {
+	m.failures = append(m.failures, EmbedFailure{
+		Source: source,
+		File:   m.file,
+		Err:    err,
+	})
+	return m.policy
+}
+
+// placeholder returns the path of the placeholder image, adding it to the EPUB
+// if needed
+func (m *mediaEmbedder) placeholder() (string, error) {
+	source := dataurl.New(placeholderImage(), mediaTypePng).String()
+	if filename := findMediaSource(m.e.images, source); filename != "" {
+		return path.Join("..", ImageFolderName, filename), nil
+	}
+	filename := unusedMediaFilename(m.e.images, imageFileFormat, ".png")
+	return addMedia(m.g, source, filename, imageFileFormat, ImageFolderName, m.e.images)
+}
+
+func replaceSrcAttribute(imgTag string, filePath string) string {
+	re := regexp.MustCompile(`src="([^"]*)"`)
+	return re.ReplaceAllString(imgTag, fmt.Sprintf(`src="%s"`, filePath))
+}
+
+// selectImageCandidates replaces the responsive images of the XHTML body with
+// a single image (see EmbedImages)
+func selectImageCandidates(body string) string {
+	body = pictureElementRegex.ReplaceAllStringFunc(body, func(picture string) string {
+		img := imgTagRegex.FindString(picture)
+		if img == "" {
+			return picture
+		}
+		if getAttribute(img, "srcset") == "" && getAttribute(img, "src") == "" {
+			source := sourceTagRegex.FindString(picture)
+			if source == "" {
+				return picture
+			}
+			img = setAttribute(img, "srcset", getAttribute(source, "srcset"))
+		}
+		return img
+	})
+	return imgTagRegex.ReplaceAllStringFunc(body, func(img string) string {
+		candidate := bestSrcsetCandidate(getAttribute(img, "srcset"))
+		if candidate == "" {
+			return img
+		}
+		img = setAttribute(img, "src", candidate)
+		img = removeAttribute(img, "srcset")
+		return removeAttribute(img, "sizes")
+	})
+}
+
+// bestSrcsetCandidate returns the URL of the candidate of a srcset attribute
+// with the highest resolution: the largest width if the candidates have width
+// descriptors (e.g. 640w), the largest pixel density otherwise (e.g. 2x).
+func bestSrcsetCandidate(srcset string) string {
+	var best string
+	var bestWidth, bestDensity float64
+	for rest := srcset; ; {
+		// The URL ends at the first whitespace, the descriptors at the next comma
+		rest = strings.TrimLeft(rest, " \t\n\r\f,")
+		if rest == "" {
+			break
+		}
+		candidateURL := rest
+		descriptors := ""
+		if i := strings.IndexAny(rest, " \t\n\r\f"); i != -1 {
+			candidateURL, rest = rest[:i], rest[i:]
+		} else {
+			rest = ""
+		}
+		if strings.HasSuffix(candidateURL, ",") {
+			// A URL followed by a comma has no descriptors
+			candidateURL = strings.TrimRight(candidateURL, ",")
+		} else if j := strings.Index(rest, ","); j != -1 {
+			descriptors, rest = rest[:j], rest[j+1:]
+		} else {
+			descriptors, rest = rest, ""
+		}
+
+		width, density := 0.0, 1.0
+		for _, descriptor := range strings.Fields(descriptors) {
+			value, err := strconv.ParseFloat(descriptor[:len(descriptor)-1], 64)
+			if err != nil {
+				continue
+			}
+			switch descriptor[len(descriptor)-1] {
+			case 'w':
+				width = value
+			case 'x':
+				density = value
+			}
+		}
+		if best == "" || width > bestWidth || (width == bestWidth && density > bestDensity) {
+			best, bestWidth, bestDensity = candidateURL, width, density
+		}
+	}
+	return best
+}
+
+// attributeRegex returns a regular expression matching the attribute of an
+// XHTML tag, the value being in the first group if it's in double quotes or in
+// the second group if it's in single quotes
+func attributeRegex(name string) *regexp.Regexp {
+	return regexp.MustCompile(`\s` + regexp.QuoteMeta(name) + `\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+}
+
+// getAttribute returns the value of the attribute of the XHTML tag, or an empty
+// string if the tag doesn't have the attribute
+func getAttribute(tag string, name string) string {
+	m := attributeRegex(name).FindStringSubmatch(tag)
+	if m == nil {
+		return ""
+	}
+	return m[1] + m[2]
+}
+
+// setAttribute sets the value of the attribute of the XHTML tag, adding the
+// attribute if needed. The value must already be escaped.
+func setAttribute(tag string, name string, value string) string {
+	attr := fmt.Sprintf(` %s="%s"`, name, value)
+	re := attributeRegex(name)
+	if re.MatchString(tag) {
+		return re.ReplaceAllLiteralString(tag, attr)
+	}
+	i := strings.IndexAny(tag, " \t\n\r/>")
+	if i == -1 {
+		return tag
+	}
+	return tag[:i] + attr + tag[i:]
+}
+
+// removeAttribute removes the attribute from the XHTML tag
+func removeAttribute(tag string, name string) string {
+	return attributeRegex(name).ReplaceAllLiteralString(tag, "")
+}
+
+// embedXHTMLCSSMedia embeds the remote media referenced from the style
+// attributes and <style> elements of the XHTML body (see embedCSSMedia)
+func (m *mediaEmbedder) embedXHTMLCSSMedia(body string) string {
+	body = styleElementRegex.ReplaceAllStringFunc(body, func(element string) string {
+		sm := styleElementRegex.FindStringSubmatch(element)
+		return sm[1] + m.embedCSSMedia(sm[2], nil, `"`) + sm[3]
+	})
+	return styleAttributeRegex.ReplaceAllStringFunc(body, func(attr string) string {
+		sm := styleAttributeRegex.FindStringSubmatch(attr)
+		// The internal paths are quoted with the quotes that don't delimit the
+		// attribute value
+		if strings.HasPrefix(attr[len(sm[1]):], `"`) {
+			return sm[1] + `"` + m.embedCSSMedia(sm[2], nil, `'`) + `"`
+		}
+		return sm[1] + `'` + m.embedCSSMedia(sm[3], nil, `"`) + `'`
+	})
+}
+
+// embedCSSMedia adds the remote images and fonts referenced with url() from the
+// CSS to the EPUB and replaces the references with their internal paths,
+// quoted with quote. References relative to base, the URL of the CSS, are
+// resolved against it if it isn't nil. References to fonts are those in
+// @font-face rules or with the extension of a font file.
+func (m *mediaEmbedder) embedCSSMedia(css string, base *url.URL, quote string) string {
+	css = fontFaceRegex.ReplaceAllStringFunc(css, func(rule string) string {
+		return m.embedCSSURLs(rule, base, quote, true)
+	})
+	return m.embedCSSURLs(css, base, quote, false)
+}
+
+// embedCSSURLs embeds the media referenced by the url() references of the CSS,
+// as fonts if font is true or if their extension is the one of a font file and
+// as images otherwise
+func (m *mediaEmbedder) embedCSSURLs(css string, base *url.URL, quote string, font bool) string {
+	return cssURLRegex.ReplaceAllStringFunc(css, func(ref string) string {
+		sm := cssURLRegex.FindStringSubmatch(ref)
+		var link string
+		for _, group := range sm[1:] {
+			if group != "" {
+				link = group
+				break
+			}
+		}
+		source := resolveCSSURL(link, base)
+		if detectMediaType(source) != "URL" {
+			return ref
+		}
+
+		if u, _ := url.Parse(source); font || (u != nil && fontExtensions[strings.ToLower(path.Ext(u.Path))]) {
+			filePath, err := addMedia(m.g, source, "", fontFileFormat, FontFolderName, m.e.fonts)
+			if err != nil {
+				// The failure policy only applies to images
+				m.fail(source, err)
+				return ref
+			}
+			return "url(" + quote + filePath + quote + ")"
+		}
+
+		filePath, err := addMedia(m.g, source, "", imageFileFormat, ImageFolderName, m.e.images)
+		if err != nil {
+			switch m.fail(source, err) {
+			case EmbedFailureStrip:
+				return "none"
+			case EmbedFailurePlaceholder:
+				if filePath, err = m.placeholder(); err != nil {
+					return ref
+				}
+			default:
+				return ref
+			}
+		}
+		return "url(" + quote + filePath + quote + ")"
+	})
+}
+
+// resolveCSSURL returns the URL of a url() reference of CSS, resolved against
+// base, the URL of the CSS, if it isn't nil
+func resolveCSSURL(link string, base *url.URL) string {
+	link = strings.TrimSpace(link)
+	if base == nil || strings.HasPrefix(link, "data:") {
+		return link
+	}
+	u, err := base.Parse(link)
+	if err != nil {
+		return link
+	}
+	return u.String()
+}
@@ -0,0 +1,265 @@
+package epub
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+)
+
+func TestEmbedImagesCSS(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("./testdata/")))
+	mux.HandleFunc("/css/remote.css", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		io.WriteString(w, `@font-face { font-family: "Redacted"; src: url(../redacted-script-regular.ttf); }
+body { background-image: url("../gophercolor16x16.png"); }`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	e := NewEpub(testEpubTitle)
+	testCSSPath, err := e.AddCSS(server.URL+"/css/remote.css", "")
+	if err != nil {
+		t.Fatalf("Error adding CSS: %s", err)
+	}
+	testSectionPath, err := e.AddSection(fmt.Sprintf(`<style>p { background: url('%[1]s/gophercolor16x16.png'); }</style>
+<p style="background-image: url(&quot;%[1]s/gophercolor16x16.png&quot;)">Paragraph</p>
+<p style='background-image: url("%[1]s/fileNotExist.png")'>Paragraph</p>`, server.URL), testSectionTitle, "", testCSSPath)
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	e.EmbedImages()
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Fatalf("Unexpected error reading section file: %s", err)
+	}
+	for _, want := range []string{
+		`<style>p { background: url("../images/gophercolor16x16.png"); }</style>`,
+		`<p style="background-image: url('../images/gophercolor16x16.png')">`,
+		// Media that can't be retrieved is left as is
+		fmt.Sprintf(`<p style='background-image: url("%s/fileNotExist.png")'>`, server.URL),
+	} {
+		if !strings.Contains(string(contents), want) {
+			t.Errorf("Section file doesn't contain %q: %s", want, contents)
+		}
+	}
+
+	contents, err = storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testCSSPath))
+	if err != nil {
+		t.Fatalf("Unexpected error reading CSS file: %s", err)
+	}
+	for _, want := range []string{
+		`src: url("../fonts/redacted-script-regular.ttf");`,
+		`background-image: url("../images/gophercolor16x16.png");`,
+	} {
+		if !strings.Contains(string(contents), want) {
+			t.Errorf("CSS file doesn't contain %q: %s", want, contents)
+		}
+	}
+
+	pkgContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading package file: %s", err)
+	}
+	for _, want := range []string{
+		`href="fonts/redacted-script-regular.ttf"`,
+		`href="images/gophercolor16x16.png"`,
+	} {
+		if strings.Count(string(pkgContents), want) != 1 {
+			t.Errorf("Package file doesn't contain %q once: %s", want, pkgContents)
+		}
+	}
+}
+
+func TestBestSrcsetCandidate(t *testing.T) {
+	tests := []struct {
+		srcset string
+		want   string
+	}{
+		{"", ""},
+		{"image.png", "image.png"},
+		{"small.png 1x, large.png 2x", "large.png"},
+		{"large.png 2x, small.png", "large.png"},
+		{"small.png 320w, large.png 1280w, medium.png 640w", "large.png"},
+		{"  a.png  1.5x ,\n b.png 3x  ", "b.png"},
+		{"first.png, second.png 2x", "second.png"},
+		{"data:image/png;base64,AAAA 2x, b.png 1x", "data:image/png;base64,AAAA"},
+	}
+	for _, tt := range tests {
+		if got := bestSrcsetCandidate(tt.srcset); got != tt.want {
+			t.Errorf("bestSrcsetCandidate(%q) = %q, want %q", tt.srcset, got, tt.want)
+		}
+	}
+}
+
+func TestSelectImageCandidates(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{
+			`<img src="a.png" alt="A"/>`,
+			`<img src="a.png" alt="A"/>`,
+		},
+		{
+			`<img src="a.png" srcset="a.png 1x, a2.png 2x" sizes="50vw" alt="A"/>`,
+			`<img src="a2.png" alt="A"/>`,
+		},
+		{
+			`<img srcset='b.png 100w, b2.png 200w'/>`,
+			`<img src="b2.png"/>`,
+		},
+		{
+			`<picture><source srcset="c.webp" type="image/webp"/><img src="c.jpg" alt="C"/></picture>`,
+			`<img src="c.jpg" alt="C"/>`,
+		},
+		{
+			"<picture>\n<source srcset=\"d.jpg 1x, d2.jpg 2x\"/>\n<img alt=\"D\"/>\n</picture>",
+			`<img src="d2.jpg" alt="D"/>`,
+		},
+	}
+	for _, tt := range tests {
+		if got := selectImageCandidates(tt.body); got != tt.want {
+			t.Errorf("selectImageCandidates(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestEmbedImagesResponsive(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("./testdata/")))
+	defer server.Close()
+
+	e := NewEpub(testEpubTitle)
+	testSectionPath, err := e.AddSection(fmt.Sprintf(`<picture>
+<source srcset="%[1]s/fileNotExist.webp" type="image/webp"/>
+<img srcset="%[1]s/fileNotExist.png 1x, %[1]s/gophercolor16x16.png 2x" alt="Gopher"/>
+</picture>`, server.URL), testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	e.EmbedImages()
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Fatalf("Unexpected error reading section file: %s", err)
+	}
+	want := `<img src="../images/gophercolor16x16.png" alt="Gopher"/>`
+	if !strings.Contains(string(contents), want) || strings.Contains(string(contents), "<picture") {
+		t.Errorf("Section file doesn't contain %q: %s", want, contents)
+	}
+}
+
+func TestEmbedImagesFailurePolicy(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("./testdata/")))
+	defer server.Close()
+	missingURL := server.URL + "/fileNotExist.png"
+
+	tests := []struct {
+		name     string
+		policy   EmbedFailurePolicy
+		wantBody string
+	}{
+		{
+			"Keep",
+			EmbedFailureKeep,
+			fmt.Sprintf(`<img src="%[1]s" alt="Missing"/><p style="background: url('%[1]s')">Paragraph</p>`, missingURL),
+		},
+		{
+			"Strip",
+			EmbedFailureStrip,
+			`<p style="background: none">Paragraph</p>`,
+		},
+		{
+			"Placeholder",
+			EmbedFailurePlaceholder,
+			`<img src="../images/image0002.png" alt="Missing"/><p style="background: url('../images/image0002.png')">Paragraph</p>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEpub(testEpubTitle)
+			e.SetEmbedFailurePolicy(tt.policy)
+			testImagePath, err := e.AddImage(testImageFromFileSource, "")
+			if err != nil {
+				t.Fatalf("Error adding image: %s", err)
+			}
+			// The cover references an image that is already part of the EPUB
+			e.SetCover(testImagePath, "")
+			testSectionPath, err := e.AddSection(fmt.Sprintf(`<img src="%[1]s" alt="Missing"/><p style="background: url('%[1]s')">Paragraph</p>`, missingURL), testSectionTitle, "", "")
+			if err != nil {
+				t.Fatalf("Error adding section: %s", err)
+			}
+
+			failures := e.EmbedImages()
+			if len(failures) != 2 {
+				t.Fatalf("Got %d failures, expected 2: %+v", len(failures), failures)
+			}
+			for _, failure := range failures {
+				wantFile := path.Join(xhtmlFolderName, filepath.Base(testSectionPath))
+				if failure.Source != missingURL || failure.File != wantFile || failure.Err == nil {
+					t.Errorf("Got failure %+v, expected failure of %s in %s", failure, missingURL, wantFile)
+				}
+			}
+			if got := strings.TrimSpace(e.sections[len(e.sections)-1].xhtml.xml.Body.XML); got != tt.wantBody {
+				t.Errorf("Got body %q, expected %q", got, tt.wantBody)
+			}
+			if _, err := e.WriteTo(io.Discard); err != nil {
+				t.Errorf("Unexpected error writing EPUB: %s", err)
+			}
+		})
+	}
+}
+
+func TestEmbedAudioVideo(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("./testdata/")))
+	defer server.Close()
+
+	e := NewEpub(testEpubTitle)
+	testRemoteVideoURL, err := e.AddRemoteVideo(server.URL+"/sample_640x360.mp4?remote", "video/mp4")
+	if err != nil {
+		t.Fatalf("Error adding remote video: %s", err)
+	}
+	testSectionPath, err := e.AddSection(fmt.Sprintf(`<video src="%[1]s/sample_640x360.mp4" poster="%[1]s/gophercolor16x16.png" controls="controls"></video>
+<audio controls="controls"><source src="%[1]s/sample_audio.wav" type="audio/wav"/><source src="%[1]s/fileNotExist.mp3"/></audio>
+<video src="%[2]s"/>`, server.URL, testRemoteVideoURL), testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+
+	failures := e.EmbedAudioVideo()
+	if len(failures) != 1 || failures[0].Source != server.URL+"/fileNotExist.mp3" {
+		t.Errorf("Got failures %+v, expected a failure for fileNotExist.mp3", failures)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Fatalf("Unexpected error reading section file: %s", err)
+	}
+	for _, want := range []string{
+		`<video src="../videos/sample_640x360.mp4" poster="../images/gophercolor16x16.png" controls="controls"></video>`,
+		`<source src="../audios/sample_audio.wav" type="audio/wav"/>`,
+		fmt.Sprintf(`<source src="%s/fileNotExist.mp3"/>`, server.URL),
+		fmt.Sprintf(`<video src="%s"/>`, testRemoteVideoURL),
+	} {
+		if !strings.Contains(string(contents), want) {
+			t.Errorf("Section file doesn't contain %q: %s", want, contents)
+		}
+	}
+}
@@ -21,29 +21,47 @@ Basic usage:
 	if err != nil {
 		// handle error
 	}
+
+An Epub is safe for concurrent use by multiple goroutines: its methods, and
+Merge, lock the EPUB, so that e.g. sections can be added while another
+goroutine reads the metadata. Calls are serialized, so a write blocks the other
+calls until it's done. The functions called by the EPUB while it's locked, such
+as the function set by SetProgressFunc, must not call its methods. The
+embedded http.Client must not be changed while the EPUB is used by other
+goroutines.
+
+A Reader is safe for concurrent use once it's created, but a SectionIterator
+isn't.
 */
 package epub
 
 import (
+	"archive/zip"
+	"crypto"
+	"crypto/x509"
 	"fmt"
+	"html/template"
 	"io/fs"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
+	"net/url"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/bmaupin/go-epub/internal/storage"
 	// TODO: Eventually this should include the major version (e.g. github.com/gofrs/uuid/v3) but that would break
 	// compatibility with Go < 1.9 (https://github.com/golang/go/wiki/Modules#semantic-import-versioning)
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/gofrs/uuid"
 	"github.com/vincent-petithory/dataurl"
 )
 
-// FilenameAlreadyUsedError is thrown by AddCSS, AddFont, AddImage, or AddSection
-// if the same filename is used more than once.
+// FilenameAlreadyUsedError is thrown by AddCSS, AddFont, AddImage, AddVideo,
+// AddAudio, AddRawFile, AddMetaInfFile or AddSection if the same filename is
+// used more than once.
 type FilenameAlreadyUsedError struct {
 	Filename string // Filename that caused the error
 }
@@ -52,8 +70,8 @@ func (e *FilenameAlreadyUsedError) Error() string {
 	return fmt.Sprintf("Filename already used: %s", e.Filename)
 }
 
-// FileRetrievalError is thrown by AddCSS, AddFont, AddImage, or Write if there was a
-// problem retrieving the source file that was provided.
+// FileRetrievalError is thrown by AddCSS, AddFont, AddImage, AddVideo, AddAudio,
+// or Write if there was a problem retrieving the source file that was provided.
 type FileRetrievalError struct {
 	Source string // The source of the file whose retrieval failed
 	Err    error  // The underlying error that was thrown
@@ -63,6 +81,54 @@ func (e *FileRetrievalError) Error() string {
 	return fmt.Sprintf("Error retrieving %q from source: %+v", e.Source, e.Err)
 }
 
+func (e *FileRetrievalError) Unwrap() error {
+	return e.Err
+}
+
+// UnexpectedMediaTypeError is the underlying error of the FileRetrievalError
+// thrown by Write if the content retrieved for a file doesn't match the type of
+// file it was added as, e.g. an HTML error page retrieved for an image.
+type UnexpectedMediaTypeError struct {
+	MediaType string // The media type of the retrieved content
+	Expected  string // The kind of media that was expected
+}
+
+func (e *UnexpectedMediaTypeError) Error() string {
+	return fmt.Sprintf("Unexpected media type %s, expected %s", e.MediaType, e.Expected)
+}
+
+// InvalidCompressionMethodError is thrown by SetCompressionMethod if the
+// compression method isn't allowed by the EPUB spec.
+type InvalidCompressionMethodError struct {
+	Method uint16 // The compression method that caused the error
+}
+
+func (e *InvalidCompressionMethodError) Error() string {
+	return fmt.Sprintf("Compression method %d is not allowed, use zip.Store or zip.Deflate", e.Method)
+}
+
+// InvalidInternalPathError is thrown by AddRawFile if the internal path isn't a
+// valid path inside the content folder of the EPUB or is in a folder used by
+// the other files of the EPUB, and by AddMetaInfFile if the filename isn't a
+// valid path inside the META-INF folder.
+type InvalidInternalPathError struct {
+	Path string // The internal path that caused the error
+}
+
+func (e *InvalidInternalPathError) Error() string {
+	return fmt.Sprintf("Invalid internal path: %s", e.Path)
+}
+
+// InvalidRemoteMediaError is thrown by AddRemoteVideo and AddRemoteAudio if the
+// source isn't an http or https URL.
+type InvalidRemoteMediaError struct {
+	Source string // The source that caused the error
+}
+
+func (e *InvalidRemoteMediaError) Error() string {
+	return fmt.Sprintf("Remote media source %s is not an http or https URL", e.Source)
+}
+
 // ParentDoesNotExistError is thrown by AddSubSection if the parent with the
 // previously defined internal filename does not exist.
 type ParentDoesNotExistError struct {
@@ -73,6 +139,42 @@ func (e *ParentDoesNotExistError) Error() string {
 	return fmt.Sprintf("Parent with the internal filename %s does not exist", e.Filename)
 }
 
+// SectionDoesNotExistError is thrown by RenameSection, SetSectionLinear,
+// SetSectionTocTitle, SetSectionSpineProperties or SectionAssets if no section
+// with the given internal filename exists.
+type SectionDoesNotExistError struct {
+	Filename string // Filename that caused the error
+}
+
+func (e *SectionDoesNotExistError) Error() string {
+	return fmt.Sprintf("Section with the internal filename %s does not exist", e.Filename)
+}
+
+// MediaDoesNotExistError is thrown by SetMediaType if no media file with the
+// given internal path exists.
+type MediaDoesNotExistError struct {
+	Path string // Path that caused the error
+}
+
+func (e *MediaDoesNotExistError) Error() string {
+	return fmt.Sprintf("Media with the internal path %s does not exist", e.Path)
+}
+
+// MediaTooLargeError is returned, wrapped in a FileRetrievalError, if media
+// exceeds the size limits set by SetMediaSizeLimits.
+type MediaTooLargeError struct {
+	Source string // The source of the media
+	Limit  int64  // The limit that has been exceeded, in bytes
+	Total  bool   // Whether the limit is the one on the total size of the media
+}
+
+func (e *MediaTooLargeError) Error() string {
+	if e.Total {
+		return fmt.Sprintf("Media %q exceeds the limit of %d bytes on the total size of the media of the EPUB", e.Source, e.Limit)
+	}
+	return fmt.Sprintf("Media %q exceeds the limit of %d bytes", e.Source, e.Limit)
+}
+
 // Folder names used for resources inside the EPUB
 const (
 	CSSFolderName   = "css"
@@ -83,6 +185,7 @@ const (
 )
 
 const (
+	audioFileFormat        = "audio%04d%s"
 	cssFileFormat          = "css%04d%s"
 	defaultCoverBody       = `<img src="%s" alt="Cover Image" />`
 	defaultCoverCSSContent = `body {
@@ -108,7 +211,6 @@ img {
 	videoFileFormat           = "video%04d%s"
 	sectionFileFormat         = "section%04d.xhtml"
 	urnUUIDPrefix             = "urn:uuid:"
-	audioFileFormat           = "audio%04d%s"
 )
 
 // Epub implements an EPUB file.
@@ -128,22 +230,157 @@ type Epub struct {
 	videos map[string]string
 	// The key is the audio filename, the value is the audio source
 	audios map[string]string
+	// The key is the URL of remote audio or video referenced by the sections,
+	// the value is its media type
+	remoteMedia map[string]string
+	// The key is the path of a file added by AddRawFile relative to the content
+	// folder
+	rawFiles map[string]epubRawFile
+	// The key is the path of a file relative to the META-INF folder, the value
+	// is the file source
+	metaInfFiles map[string]string
+	// The key is the path of a media file relative to the content folder (e.g.
+	// fonts/font0001.otf), the value is the media type set by SetMediaType
+	mediaTypes map[string]string
 	// Language
 	lang string
 	// Description
 	desc string
 	// Page progression direction
 	ppd string
+	// Source language of the dictionary sections (see SetDictionaryLanguages)
+	dictionaryLang string
+	// Number of citations returned by Cite, used for their IDs
+	citations int
+	// Number of links returned by AddNote, used for their IDs
+	noterefs int
+	// Number of figures added by AddFigure, used for their IDs
+	figures int
+	// Labels of the numbered figures and tables (see SetFigureNumbering)
+	figureLabel string
+	tableLabel  string
+	// Whether media not referenced by any section is left out by Write
+	dropOrphanedMedia bool
+	// User-Agent and From headers of the requests made to retrieve media
+	userAgent string
+	from      string
+	// Other headers and cookies of the requests made to retrieve media
+	header  http.Header
+	cookies []*http.Cookie
+	// Whether the EPUB 2 table of contents (toc.ncx) is left out
+	noNcx bool
+	// Whether the nav document is part of the spine
+	navInSpine bool
+	// Whether images are retrieved and validated as they're added
+	validateImages bool
+	// Whether WebP and AVIF images are converted to JPEG or PNG
+	convertImages bool
+	// Whether TrueType fonts are subset to the characters used by the sections
+	subsetFonts bool
+	// Whether audio and video are streamed from their source into the EPUB
+	streamMedia bool
+	// Whether Write builds the zip archive without storing the files first
+	directWrite bool
+	// Whether Write reuses the media and the compressed files of the previous
+	// write
+	incremental bool
+	// The files compressed by the previous incremental write, by name
+	incrementalFiles map[string]incrementalFile
+	// The sources of the media kept in fetchedMedia by incremental writes
+	incrementalMedia map[string]bool
+	// Function reporting the progress of Write, nil if progress isn't reported
+	progressFunc func(WriteProgress)
+	// Progress of the current write, nil if there's no write in progress or
+	// progress isn't reported
+	progress *writeProgressTracker
+	// The paths of the media renamed by the current write, relative to the
+	// content folder, by original path. The media left out of the EPUB has an
+	// empty path. Nil if there's no write in progress.
+	renamedMedia map[string]string
+	// How media that can't be retrieved during Write is handled
+	mediaFailurePolicy MediaFailurePolicy
+	// How images that can't be retrieved by EmbedImages are handled
+	embedFailurePolicy EmbedFailurePolicy
+	// How the internal filenames of the media and the sections are sanitized
+	filenamePolicy FilenamePolicy
+	// The key is a file extension (e.g. .jpg) or a media type (e.g.
+	// image/jpeg), the value is the zip compression method of the files
+	compressionMethods map[string]uint16
+	// Template of the cover page body, nil for the default body
+	coverTemplate *template.Template
+	// Content of the cover stylesheet used when SetCover isn't passed any CSS,
+	// empty for the default stylesheet
+	coverCSS string
+	// Maximum duration of Write, 0 means no limit
+	writeTimeout time.Duration
+	// Maximum duration of each retrieval of media, 0 means no limit
+	fetchTimeout time.Duration
+	// Cache of the media retrieved from URLs, nil if media isn't cached
+	mediaCache MediaCache
+	// When media is retrieved
+	fetchMode FetchMode
+	// Maximum size of each media and of all the media of the EPUB, 0 means no
+	// limit
+	maxMediaSize      int64
+	maxTotalMediaSize int64
+	// The content of the media retrieved when it was added, by source
+	fetchedMedia map[string][]byte
+	// The charset of the media retrieved from URLs, by source
+	mediaCharsets *sync.Map
+	// File system the local media sources are read from, nil for the OS file
+	// system (see SetSourceFS)
+	sourceFS fs.FS
+	// Storage used to build the EPUB when it's written (see WithStorage)
+	filesystem storage.Storage
 	// The package file (package.opf)
 	pkg      *pkg
 	sections []epubSection
-	title    string
+	// The filenames of the sections and subsections
+	sectionFilenames map[string]bool
+	// The index of the next section filename to try when generating one
+	nextSectionIndex int
+	title            string
 	// Table of contents
 	toc *toc
+	// Non-fatal problems found while building and writing the EPUB (see
+	// Warnings)
+	warnings []Warning
+	// Whether Write fails if the EPUB would be invalid
+	strict bool
+	// Whether the EPUB is written for Kindle (see SetKindleCompatibility)
+	kindle bool
+	// Filename of the stylesheet of the theme, empty if no theme is applied
+	// (see SetTheme)
+	themeCSSFilename string
+	// Policy the bodies of the sections are sanitized with, nil if they
+	// aren't (see SetSanitizePolicy)
+	sanitizePolicy *SanitizePolicy
+	// Watermark of the EPUB being written by WriteWatermarked, nil otherwise
+	watermark *Watermark
+	// Content of the META-INF/metadata.xml and rights.xml files, nil if they're
+	// left out (see SetOCFMetadata and SetRights)
+	ocfMetadata *OCFMetadata
+	rights      []byte
+	// Signer of the EPUB and its certificate, nil if the EPUB isn't signed
+	// (see SetSigner)
+	signer            crypto.Signer
+	signerCertificate *x509.Certificate
+	// Logger of the retrieval of the media and of the writes, nil if nothing
+	// is logged (see SetLogger)
+	logger *slog.Logger
+	// Error creating the EPUB, returned by the writes
+	initErr error
+}
+
+// epubRawFile is a file added by AddRawFile
+type epubRawFile struct {
+	source    string
+	mediaType string
 }
 
 type epubCover struct {
-	cssFilename   string
+	cssFilename string
+	// The source of the default cover CSS if it's used, a data URL
 	cssTempFile   string
 	imageFilename string
 	xhtmlFilename string
@@ -153,10 +390,49 @@ type epubSection struct {
 	filename string
 	xhtml    *xhtml
 	children *[]epubSection
+	// Whether the section is marked as linear="no" in the spine
+	nonLinear bool
+	// Properties of the spine itemref, e.g. page-spread-left
+	spineProperties string
+	// Whether the file is left out of the spine and the table of contents
+	auxiliary bool
+	// Label of the section in the table of contents if it's different from
+	// the title
+	tocTitle string
+	// Filename of the audio of an audio track (see AddAudioTrack), which is
+	// part of the spine instead of the section, and its duration if known
+	audio         string
+	audioDuration time.Duration
+	// Media overlay of the section (see AddMediaOverlay), nil if it has none
+	mediaOverlay *mediaOverlay
+	// Entries of a dictionary section (see AddDictionarySection)
+	dictionary []DictionaryEntry
+	// References of a bibliography (see AddBibliographySection), nil if the
+	// section isn't a bibliography
+	references []Reference
+	// Content of the notes of a notes section (see AddNotesSection), nil if
+	// the section isn't a notes section
+	notes []string
+}
+
+// tocLabel returns the label of the section in the table of contents, an empty
+// string if the section isn't part of it
+func (s *epubSection) tocLabel() string {
+	if s.tocTitle != "" {
+		return s.tocTitle
+	}
+	return s.xhtml.Title()
 }
 
+// EpubOption is an option of NewEpub.
+type EpubOption func(*Epub)
+
 // NewEpub returns a new Epub.
-func NewEpub(title string) *Epub {
+//
+// If the templates of the package and TOC files can't be parsed, which would be
+// a bug of this package, the EPUB can't be written: the error is logged (see
+// WithLogger) and returned when the EPUB is written.
+func NewEpub(title string, options ...EpubOption) *Epub {
 	e := &Epub{}
 	e.cover = &epubCover{
 		cssFilename:   "",
@@ -165,18 +441,43 @@ func NewEpub(title string) *Epub {
 		xhtmlFilename: "",
 	}
 	e.Client = http.DefaultClient
+	e.filesystem = filesystem
+	e.initErr = filesystemErr
 	e.css = make(map[string]string)
 	e.fonts = make(map[string]string)
 	e.images = make(map[string]string)
 	e.videos = make(map[string]string)
 	e.audios = make(map[string]string)
-	e.pkg = newPackage()
-	e.toc = newToc()
+	e.remoteMedia = make(map[string]string)
+	e.rawFiles = make(map[string]epubRawFile)
+	e.metaInfFiles = make(map[string]string)
+	e.fetchedMedia = make(map[string][]byte)
+	e.mediaCharsets = &sync.Map{}
+	e.sectionFilenames = make(map[string]bool)
+	e.nextSectionIndex = 1
+	e.mediaTypes = make(map[string]string)
+	e.header = make(http.Header)
+	e.compressionMethods = make(map[string]uint16)
+	var err error
+	if e.pkg, err = newPackage(); err != nil {
+		e.initErr = err
+		e.pkg = &pkg{xml: &pkgRoot{}}
+	}
+	if e.toc, err = newToc(); err != nil {
+		e.initErr = err
+		e.toc = &toc{navXML: &tocNavBody{}, ncxXML: &tocNcxRoot{}}
+	}
 	// Set minimal required attributes
 	e.SetIdentifier(urnUUIDPrefix + uuid.Must(uuid.NewV4()).String())
 	e.SetLang(defaultEpubLang)
 	e.SetTitle(title)
 
+	for _, option := range options {
+		option(e)
+	}
+	if e.initErr != nil && e.logger != nil {
+		e.logger.Error("unable to create EPUB", "error", e.initErr)
+	}
 	return e
 }
 
@@ -187,6 +488,11 @@ func NewEpub(title string) *Epub {
 // The CSS source should either be a URL, a path to a local file, or an embedded data URL; in any
 // case, the CSS file will be retrieved and stored in the EPUB.
 //
+// CSS in another encoding than UTF-8, e.g. windows-1252, is transcoded to UTF-8
+// when the EPUB is written. The encoding is detected from the byte order mark
+// or the @charset rule of the CSS, or else from the charset of the
+// Content-Type header of the response to the URL or of the data URL.
+//
 // The internal filename will be used when storing the CSS file in the EPUB
 // and must be unique among all CSS files. If the same filename is used more
 // than once, FilenameAlreadyUsedError will be returned. The internal filename is
@@ -198,7 +504,30 @@ func (e *Epub) AddCSS(source string, internalFilename string) (string, error) {
 }
 
 func (e *Epub) addCSS(source string, internalFilename string) (string, error) {
-	return addMedia(e.Client, source, internalFilename, cssFileFormat, CSSFolderName, e.css)
+	return addMedia(e.grabber(), source, internalFilename, cssFileFormat, CSSFolderName, e.css)
+}
+
+// AddCSSFromString adds a CSS file with the given content to the EPUB and
+// returns a relative path to the CSS file that can be used in EPUB sections in
+// the format:
+// ../CSSFolderName/internalFilename
+//
+// The internal filename will be used when storing the CSS file in the EPUB
+// and must be unique among all CSS files. If the same filename is used more
+// than once, FilenameAlreadyUsedError will be returned. The internal filename is
+// optional; if no filename is provided, one will be generated.
+func (e *Epub) AddCSSFromString(content string, internalFilename string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	return e.addCSSFromString(content, internalFilename)
+}
+
+func (e *Epub) addCSSFromString(content string, internalFilename string) (string, error) {
+	if internalFilename == "" {
+		internalFilename = unusedMediaFilename(e.css, cssFileFormat, ".css")
+	}
+	source := dataurl.New([]byte(content), mediaTypeCSS, "charset", "utf-8").String()
+	return e.addCSS(source, internalFilename)
 }
 
 // AddFont adds a font file to the EPUB and returns a relative path to the font
@@ -215,7 +544,30 @@ func (e *Epub) addCSS(source string, internalFilename string) (string, error) {
 func (e *Epub) AddFont(source string, internalFilename string) (string, error) {
 	e.Lock()
 	defer e.Unlock()
-	return addMedia(e.Client, source, internalFilename, fontFileFormat, FontFolderName, e.fonts)
+	return addMedia(e.grabber(), source, internalFilename, fontFileFormat, FontFolderName, e.fonts)
+}
+
+// AddFontBytes adds a font file with the given content to the EPUB, e.g. a font
+// embedded in the program with go:embed, and returns a relative path to the font
+// file that can be used in EPUB sections in the format:
+// ../FontFolderName/internalFilename
+//
+// The internal filename will be used when storing the font file in the EPUB
+// and must be unique among all font files. If the same filename is used more
+// than once, FilenameAlreadyUsedError will be returned. The internal filename is
+// optional; if no filename is provided, one will be generated using the
+// extension matching the font format.
+func (e *Epub) AddFontBytes(data []byte, internalFilename string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	mime := mimetype.Detect(data)
+	if internalFilename == "" {
+		internalFilename = unusedMediaFilename(e.fonts, fontFileFormat, mime.Extension())
+	}
+	// The data URL package rejects font/* media types, the actual media type is
+	// detected from the content when the EPUB is written
+	source := dataurl.New(data, "application/octet-stream").String()
+	return addMedia(e.grabber(), source, internalFilename, fontFileFormat, FontFolderName, e.fonts)
 }
 
 // AddImage adds an image to the EPUB and returns a relative path to the image
@@ -228,14 +580,25 @@ func (e *Epub) AddFont(source string, internalFilename string) (string, error) {
 // The internal filename will be used when storing the image file in the EPUB
 // and must be unique among all image files. If the same filename is used more
 // than once, FilenameAlreadyUsedError will be returned. The internal filename is
-// optional; if no filename is provided, one will be generated.
+// optional; if no filename is provided, one will be generated. If no filename is
+// provided and an image was already added from the same URL, the path to that
+// image is returned and the URL is only downloaded once.
 func (e *Epub) AddImage(source string, imageFilename string) (string, error) {
 	e.Lock()
 	defer e.Unlock()
-	return addMedia(e.Client, source, imageFilename, imageFileFormat, ImageFolderName, e.images)
+	return e.addImage(source, imageFilename)
+}
+
+func (e *Epub) addImage(source string, imageFilename string) (string, error) {
+	if e.validateImages {
+		if err := e.grabber().validateImage(source); err != nil {
+			return "", err
+		}
+	}
+	return addMedia(e.grabber(), source, imageFilename, imageFileFormat, ImageFolderName, e.images)
 }
 
-// AddVideo adds an video to the EPUB and returns a relative path to the video
+// AddVideo adds a video to the EPUB and returns a relative path to the video
 // file that can be used in EPUB sections in the format:
 // ../VideoFolderName/internalFilename
 //
@@ -249,10 +612,10 @@ func (e *Epub) AddImage(source string, imageFilename string) (string, error) {
 func (e *Epub) AddVideo(source string, videoFilename string) (string, error) {
 	e.Lock()
 	defer e.Unlock()
-	return addMedia(e.Client, source, videoFilename, videoFileFormat, VideoFolderName, e.videos)
+	return addMedia(e.grabber(), source, videoFilename, videoFileFormat, VideoFolderName, e.videos)
 }
 
-// AddAudio adds an audio to the EPUB and returns a relative path to the audio
+// AddAudio adds an audio file to the EPUB and returns a relative path to the audio
 // file that can be used in EPUB sections in the format:
 // ../AudioFolderName/internalFilename
 //
@@ -266,7 +629,135 @@ func (e *Epub) AddVideo(source string, videoFilename string) (string, error) {
 func (e *Epub) AddAudio(source string, audioFilename string) (string, error) {
 	e.Lock()
 	defer e.Unlock()
-	return addMedia(e.Client, source, audioFilename, audioFileFormat, AudioFolderName, e.audios)
+	return addMedia(e.grabber(), source, audioFilename, audioFileFormat, AudioFolderName, e.audios)
+}
+
+// AddRemoteVideo adds a video that is referenced by URL instead of being stored
+// in the EPUB and returns the URL, which can be used in EPUB sections. The
+// video is listed in the manifest with the media type, which must be an audio
+// or video media type (e.g. video/mp4), and the remote-resources property is
+// set on the sections that reference it.
+//
+// The source must be an http or https URL, otherwise InvalidRemoteMediaError
+// will be returned. If the media type isn't an audio or video media type,
+// UnexpectedMediaTypeError will be returned. If the video can't be retrieved,
+// FileRetrievalError will be returned.
+func (e *Epub) AddRemoteVideo(source string, mediaType string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	return e.addRemoteMedia(source, mediaType)
+}
+
+// AddRemoteAudio adds an audio file that is referenced by URL instead of being
+// stored in the EPUB and returns the URL, which can be used in EPUB sections.
+// The audio file is listed in the manifest with the media type, which must be
+// an audio or video media type (e.g. audio/mpeg), and the remote-resources
+// property is set on the sections that reference it.
+//
+// The errors are the same as those of AddRemoteVideo.
+func (e *Epub) AddRemoteAudio(source string, mediaType string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	return e.addRemoteMedia(source, mediaType)
+}
+
+func (e *Epub) addRemoteMedia(source string, mediaType string) (string, error) {
+	if detectMediaType(source) != "URL" {
+		return "", &InvalidRemoteMediaError{Source: source}
+	}
+	baseType, _, _ := strings.Cut(mediaType, ";")
+	baseType = strings.TrimSpace(baseType)
+	if !strings.HasPrefix(baseType, "audio/") && !strings.HasPrefix(baseType, "video/") && baseType != "application/ogg" {
+		return "", &UnexpectedMediaTypeError{
+			MediaType: mediaType,
+			Expected:  "audio or video",
+		}
+	}
+	// Remote media is never retrieved, only checked
+	if _, ok := e.remoteMedia[source]; !ok && e.fetchMode != FetchLazy {
+		if err := e.grabber().checkMedia(source); err != nil {
+			return "", err
+		}
+	}
+	e.remoteMedia[source] = mediaType
+	return source, nil
+}
+
+// AddRawFile adds a file at an arbitrary path inside the content folder of the
+// EPUB, e.g. JSON data used by scripted content, WebVTT captions or
+// supplementary XML, and returns a relative path to the file that can be used
+// in EPUB sections in the format:
+// ../internalPath
+//
+// The source should either be a URL, a path to a local file, or an embedded
+// data URL; in any case, the file will be retrieved and stored in the EPUB. The
+// file is listed in the manifest with the media type, which is detected from
+// its content if it's empty.
+//
+// The internal path is relative to the content folder, e.g. data/chapters.json.
+// It can't be in the folders used by the other files of the EPUB (CSSFolderName,
+// FontFolderName, ImageFolderName, VideoFolderName, AudioFolderName and the
+// folder of the sections), otherwise InvalidInternalPathError will be returned.
+// If the same internal path is used more than once, FilenameAlreadyUsedError
+// will be returned.
+func (e *Epub) AddRawFile(source string, internalPath string, mediaType string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	rawPath := path.Clean(internalPath)
+	if !fs.ValidPath(rawPath) || rawPath == "." {
+		return "", &InvalidInternalPathError{Path: internalPath}
+	}
+	folderName, _, _ := strings.Cut(rawPath, "/")
+	if _, ok := e.mediaFolders()[folderName]; ok || folderName == xhtmlFolderName {
+		return "", &InvalidInternalPathError{Path: internalPath}
+	}
+	if _, ok := e.rawFiles[rawPath]; ok || rawPath == pkgFilename || rawPath == tocNavFilename || rawPath == tocNcxFilename {
+		return "", &FilenameAlreadyUsedError{Filename: internalPath}
+	}
+	if err := e.grabber().retrieveAddedMedia(source); err != nil {
+		return "", &FileRetrievalError{
+			Source: source,
+			Err:    err,
+		}
+	}
+	e.rawFiles[rawPath] = epubRawFile{
+		source:    source,
+		mediaType: mediaType,
+	}
+	return path.Join("..", rawPath), nil
+}
+
+// AddMetaInfFile adds a file to the META-INF folder of the EPUB, e.g. vendor
+// specific display options (com.apple.ibooks.display-options.xml) or rights
+// information (rights.xml). Such files aren't part of the manifest.
+//
+// The source should either be a URL, a path to a local file, or an embedded
+// data URL; in any case, the file will be retrieved and stored in the EPUB.
+//
+// The filename is the path of the file relative to the META-INF folder. If it
+// isn't a valid path, InvalidInternalPathError will be returned. If the same
+// filename is used more than once, or the filename is the one of the container
+// file (container.xml), which is always generated, or of a file set by
+// SetOCFMetadata or SetRights, FilenameAlreadyUsedError will be returned.
+func (e *Epub) AddMetaInfFile(source string, filename string) error {
+	e.Lock()
+	defer e.Unlock()
+	metaInfPath := path.Clean(filename)
+	if !fs.ValidPath(metaInfPath) || metaInfPath == "." {
+		return &InvalidInternalPathError{Path: filename}
+	}
+	if _, ok := e.metaInfFiles[metaInfPath]; ok || metaInfPath == containerFilename ||
+		(metaInfPath == ocfMetadataFilename && e.ocfMetadata != nil) || (metaInfPath == rightsFilename && e.rights != nil) {
+		return &FilenameAlreadyUsedError{Filename: filename}
+	}
+	if err := e.grabber().retrieveAddedMedia(source); err != nil {
+		return &FileRetrievalError{
+			Source: source,
+			Err:    err,
+		}
+	}
+	e.metaInfFiles[metaInfPath] = source
+	return nil
 }
 
 // AddSection adds a new section (chapter, etc) to the EPUB and returns a
@@ -288,17 +779,49 @@ func (e *Epub) AddAudio(source string, audioFilename string) (string, error) {
 //
 // The internal path to an already-added CSS file (as returned by AddCSS) to be
 // used for the section is optional.
+//
+// See AddSectionWithOptions for more options, such as several CSS files or the
+// language of the section.
 func (e *Epub) AddSection(body string, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
 	e.Lock()
 	defer e.Unlock()
 	return e.addSection("", body, sectionTitle, internalFilename, internalCSSPath)
 }
 
+// AddAuxiliaryXHTML adds an XHTML file that is part of the EPUB but not of the
+// reading order, e.g. footnote popups or image description pages, and returns a
+// relative path to the file that can be used from a section (for links). The
+// file is added to the manifest but not to the spine or the table of contents.
+//
+// The body must be valid XHTML that will go between the <body> tags of the
+// XHTML file. The content will not be validated. The title is used as the title
+// of the XHTML file.
+//
+// The internal filename will be used when storing the file in the EPUB and must
+// be unique among all section files, including auxiliary ones. If the same
+// filename is used more than once, FilenameAlreadyUsedError will be returned.
+// The internal filename is optional; if no filename is provided, one will be
+// generated.
+//
+// The internal path to an already-added CSS file (as returned by AddCSS) to be
+// used for the file is optional.
+func (e *Epub) AddAuxiliaryXHTML(body string, title string, internalFilename string, internalCSSPath string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	internalFilename, err := e.addSection("", body, title, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	e.sections[len(e.sections)-1].auxiliary = true
+	return internalFilename, nil
+}
+
 // AddSubSection adds a nested section (chapter, etc) to an existing section.
 // The method returns a relative path to the section that can be used from another
 // section (for links).
 //
-// The parent filename must be a valid filename from another section already added.
+// The parent filename must be a valid filename from another section already added,
+// other than an auxiliary file added with AddAuxiliaryXHTML.
 //
 // The body must be valid XHTML that will go between the <body> tags of the
 // section XHTML file. The content will not be validated.
@@ -321,57 +844,92 @@ func (e *Epub) AddSubSection(parentFilename string, body string, sectionTitle st
 	return e.addSection(parentFilename, body, sectionTitle, internalFilename, internalCSSPath)
 }
 
-func (e *Epub) addSection(parentFilename string, body string, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
-	parentIndex := -1
+// SectionOptions are the options of a section added with AddSectionWithOptions.
+// All of them are optional.
+type SectionOptions struct {
+	// Title used for the table of contents; if no title is provided, the
+	// section will not be added to the table of contents
+	Title string
+	// Shorter label used in the table of contents instead of the title, e.g.
+	// "Ch. 12", while the title is still used as the title of the page
+	TocTitle string
+	// Internal filename used when storing the section file in the EPUB; if no
+	// filename is provided, one will be generated
+	Filename string
+	// Internal paths to already-added CSS files (as returned by AddCSS), linked
+	// in order
+	CSS []string
+	// Language of the section, if it's different from the language of the EPUB
+	Lang string
+	// The epub:type of the section body, e.g. chapter or appendix
+	EpubType string
+	// Internal filename of the parent section, in order to add a subsection
+	Parent string
+	// Whether the section is left out of the linear reading order (see
+	// SetSectionLinear)
+	NonLinear bool
+	// Properties of the spine item of the section (see
+	// SetSectionSpineProperties)
+	SpineProperties string
+}
+
+// AddSectionWithOptions adds a new section (chapter, etc) to the EPUB, or a
+// subsection if a parent is provided, and returns a relative path to the section
+// that can be used from another section (for links).
+//
+// The body must be valid XHTML that will go between the <body> tags of the
+// section XHTML file. The content will not be validated.
+//
+// The same errors as AddSection and AddSubSection are returned.
+func (e *Epub) AddSectionWithOptions(body string, opts SectionOptions) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	internalFilename, err := e.addSection(opts.Parent, body, opts.Title, opts.Filename, "")
+	if err != nil {
+		return "", err
+	}
+
+	section := e.findSection(internalFilename)
+	section.xhtml.setCSS(opts.CSS...)
+	section.xhtml.setLang(opts.Lang)
+	section.xhtml.setEpubType(opts.EpubType)
+	section.tocTitle = opts.TocTitle
+	section.nonLinear = opts.NonLinear
+	section.spineProperties = strings.Join(strings.Fields(opts.SpineProperties), " ")
+
+	return internalFilename, nil
+}
 
+func (e *Epub) addSection(parentFilename string, body string, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
 	// Generate a filename if one isn't provided
 	if internalFilename == "" {
-		index := 1
-		for internalFilename == "" {
-			internalFilename = fmt.Sprintf(sectionFileFormat, index)
-			for item, section := range e.sections {
-				if section.filename == parentFilename {
-					parentIndex = item
-				}
-				if section.filename == internalFilename {
-					internalFilename, index = "", index+1
-					if parentFilename == "" || parentIndex != -1 {
-						break
-					}
-				}
-				// Check for nested sections with the same filename to avoid duplicate entries
-				if section.children != nil {
-					for _, subsection := range *section.children {
-						if subsection.filename == internalFilename {
-							internalFilename, index = "", index+1
-						}
-					}
-				}
-			}
-		}
-	} else {
-		for item, section := range e.sections {
-			if section.filename == parentFilename {
-				parentIndex = item
-			}
-			if section.filename == internalFilename {
-				return "", &FilenameAlreadyUsedError{Filename: internalFilename}
-			}
-			if section.children != nil {
-				for _, subsection := range *section.children {
-					if subsection.filename == internalFilename {
-						return "", &FilenameAlreadyUsedError{Filename: internalFilename}
-					}
-				}
+		internalFilename = e.unusedSectionFilename()
+	} else if internalFilename = e.sanitizedSectionFilename(internalFilename); e.sectionFilenames[internalFilename] {
+		return "", &FilenameAlreadyUsedError{Filename: internalFilename}
+	}
+
+	// Subsections are usually added right after their parent, so the parent
+	// is looked for from the end
+	parentIndex := -1
+	if parentFilename != "" {
+		for i := len(e.sections) - 1; i >= 0; i-- {
+			if e.sections[i].filename == parentFilename {
+				parentIndex = i
+				break
 			}
 		}
 	}
 
-	if parentFilename != "" && parentIndex == -1 {
+	// Auxiliary files can't have subsections since they aren't part of the
+	// reading order
+	if parentFilename != "" && (parentIndex == -1 || e.sections[parentIndex].auxiliary) {
 		return "", &ParentDoesNotExistError{Filename: parentFilename}
 	}
 
-	x := newXhtml(body)
+	x, err := newXhtml(body)
+	if err != nil {
+		return "", err
+	}
 	x.setTitle(sectionTitle)
 	x.setXmlnsEpub(xmlnsEpub)
 
@@ -394,32 +952,227 @@ func (e *Epub) addSection(parentFilename string, body string, sectionTitle strin
 	} else {
 		e.sections = append(e.sections, s)
 	}
+	e.sectionFilenames[internalFilename] = true
 
 	return internalFilename, nil
 }
 
+// RenameSection changes the internal filename of an existing section and
+// returns the new relative path to the section.
+//
+// Links to the section from other sections (including links with a fragment,
+// e.g. section0001.xhtml#note1) are rewritten to use the new filename. The
+// table of contents follows the new filename as well.
+//
+// The new internal filename must be unique among all section files. If it's
+// already used, FilenameAlreadyUsedError will be returned. If no new filename is
+// provided, one will be generated. If no section with
+// the current internal filename exists, SectionDoesNotExistError will be
+// returned.
+func (e *Epub) RenameSection(internalFilename string, newInternalFilename string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	return e.renameSection(internalFilename, newInternalFilename)
+}
+
+func (e *Epub) renameSection(internalFilename string, newInternalFilename string) (string, error) {
+	section := e.findSection(internalFilename)
+	if section == nil {
+		return "", &SectionDoesNotExistError{Filename: internalFilename}
+	}
+	if newInternalFilename == internalFilename {
+		return newInternalFilename, nil
+	}
+	// Generate a filename if one isn't provided
+	if newInternalFilename == "" {
+		newInternalFilename = e.unusedSectionFilename()
+	} else {
+		newInternalFilename = e.sanitizedSectionFilename(newInternalFilename)
+	}
+	if e.sectionFilenames[newInternalFilename] {
+		return "", &FilenameAlreadyUsedError{Filename: newInternalFilename}
+	}
+
+	section.filename = newInternalFilename
+	e.removeSectionFilename(internalFilename)
+	e.sectionFilenames[newInternalFilename] = true
+	if e.cover.xhtmlFilename == internalFilename {
+		e.cover.xhtmlFilename = newInternalFilename
+	}
+
+	oldPath := path.Join(xhtmlFolderName, internalFilename)
+	e.forEachSection(func(s *epubSection) {
+		fromPath := path.Join(xhtmlFolderName, s.filename)
+		rename := func(link string) string {
+			if resolveLink(fromPath, link) != oldPath {
+				return link
+			}
+			linkPath, fragment := splitFragment(link)
+			link = strings.TrimSuffix(linkPath, internalFilename) + newInternalFilename
+			if fragment != "" {
+				link += "#" + fragment
+			}
+			return link
+		}
+		s.xhtml.xml.Body.XML = rewriteLinks(s.xhtml.xml.Body.XML, rename)
+		// The links of the SMIL documents of media overlays are relative to
+		// their section as well
+		if s.mediaOverlay != nil && s.mediaOverlay.clips == nil {
+			overlay := *s.mediaOverlay
+			overlay.smil = rewriteLinks(overlay.smil, rename)
+			s.mediaOverlay = &overlay
+		}
+	})
+
+	return newInternalFilename, nil
+}
+
+// SetSectionLinear sets whether a section is part of the linear reading order.
+// Non-linear sections (e.g. answer keys or notes) are still part of the spine
+// and can be reached from links, but reading systems may skip them when paging
+// through the book. Sections are linear by default.
+//
+// If no section with the internal filename exists, SectionDoesNotExistError will
+// be returned.
+func (e *Epub) SetSectionLinear(internalFilename string, linear bool) error {
+	e.Lock()
+	defer e.Unlock()
+	section := e.findSection(internalFilename)
+	if section == nil {
+		return &SectionDoesNotExistError{Filename: internalFilename}
+	}
+	section.nonLinear = !linear
+	return nil
+}
+
+// SetSectionTocTitle sets the label of a section in the table of contents, e.g.
+// "Ch. 12", when it should be different from the title of the section, which is
+// still used as the title of the page. An empty string restores the title as
+// the label.
+//
+// If no section with the internal filename exists, SectionDoesNotExistError will
+// be returned.
+func (e *Epub) SetSectionTocTitle(internalFilename string, tocTitle string) error {
+	e.Lock()
+	defer e.Unlock()
+	section := e.findSection(internalFilename)
+	if section == nil {
+		return &SectionDoesNotExistError{Filename: internalFilename}
+	}
+	section.tocTitle = tocTitle
+	return nil
+}
+
+// SetSectionSpineProperties sets the properties of the spine item of a section,
+// as a space-separated list, e.g. "page-spread-left" or
+// "rendition:layout-pre-paginated page-spread-right". They are used to control
+// how the section is rendered, for instance to mix fixed-layout and reflowable
+// sections in the same book. An empty string removes the properties.
+//
+// If no section with the internal filename exists, SectionDoesNotExistError will
+// be returned.
+func (e *Epub) SetSectionSpineProperties(internalFilename string, properties string) error {
+	e.Lock()
+	defer e.Unlock()
+	section := e.findSection(internalFilename)
+	if section == nil {
+		return &SectionDoesNotExistError{Filename: internalFilename}
+	}
+	section.spineProperties = strings.Join(strings.Fields(properties), " ")
+	return nil
+}
+
+// unusedSectionFilename returns the first generated section filename that isn't
+// used by any section or subsection
+func (e *Epub) unusedSectionFilename() string {
+	for ; ; e.nextSectionIndex++ {
+		filename := fmt.Sprintf(sectionFileFormat, e.nextSectionIndex)
+		if !e.sectionFilenames[filename] {
+			return filename
+		}
+	}
+}
+
+// sanitizedSectionFilename returns the internal filename of a section sanitized
+// according to the filename policy. If the sanitized filename is used by
+// another section, it's made unique.
+func (e *Epub) sanitizedSectionFilename(internalFilename string) string {
+	sanitized := SanitizeFilename(internalFilename, e.filenamePolicy)
+	if sanitized == internalFilename {
+		return internalFilename
+	}
+	sanitized = uniqueFilename(sanitized, func(filename string) bool {
+		return e.sectionFilenames[filename]
+	})
+	e.addWarning(WarningRenamed, path.Join(contentFolderName, xhtmlFolderName, sanitized), "filename %s sanitized", internalFilename)
+	return sanitized
+}
+
+// removeSectionFilename marks the filename of a section that has been renamed
+// or removed as unused. Since it might be a generated filename, the next
+// generated filename is looked for from the start again.
+func (e *Epub) removeSectionFilename(filename string) {
+	delete(e.sectionFilenames, filename)
+	e.nextSectionIndex = 1
+}
+
+// findSection returns the section or subsection with the given internal
+// filename, or nil if there's none
+func (e *Epub) findSection(internalFilename string) *epubSection {
+	var found *epubSection
+	e.forEachSection(func(s *epubSection) {
+		if found == nil && s.filename == internalFilename {
+			found = s
+		}
+	})
+	return found
+}
+
+// forEachSection calls fn for each section and subsection in reading order
+func (e *Epub) forEachSection(fn func(s *epubSection)) {
+	for i := range e.sections {
+		fn(&e.sections[i])
+		if e.sections[i].children != nil {
+			children := *e.sections[i].children
+			for j := range children {
+				fn(&children[j])
+			}
+		}
+	}
+}
+
 // Author returns the author of the EPUB.
 func (e *Epub) Author() string {
+	e.Lock()
+	defer e.Unlock()
 	return e.author
 }
 
 // Identifier returns the unique identifier of the EPUB.
 func (e *Epub) Identifier() string {
+	e.Lock()
+	defer e.Unlock()
 	return e.identifier
 }
 
 // Lang returns the language of the EPUB.
 func (e *Epub) Lang() string {
+	e.Lock()
+	defer e.Unlock()
 	return e.lang
 }
 
 // Description returns the description of the EPUB.
 func (e *Epub) Description() string {
+	e.Lock()
+	defer e.Unlock()
 	return e.desc
 }
 
 // Ppd returns the page progression direction of the EPUB.
 func (e *Epub) Ppd() string {
+	e.Lock()
+	defer e.Unlock()
 	return e.ppd
 }
 
@@ -435,79 +1188,112 @@ func (e *Epub) SetAuthor(author string) {
 // optional CSS.
 //
 // The internal path to an already-added image file (as returned by AddImage) is
-// required.
+// required. The image can be a raster image (e.g. JPEG or PNG) or an SVG file.
 //
 // The internal path to an already-added CSS file (as returned by AddCSS) to be
 // used for the cover is optional. If the CSS path isn't provided, default CSS
-// will be used.
+// will be used (see SetDefaultCoverCSS).
 func (e *Epub) SetCover(internalImagePath string, internalCSSPath string) {
 	e.Lock()
 	defer e.Unlock()
+	if err := e.setCover(internalImagePath, internalCSSPath); err != nil {
+		panic(err)
+	}
+}
+
+// SetCoverFromSource sets the cover page for the EPUB using the image at the
+// source, which is added to the EPUB, and the default cover CSS. The source
+// should either be a URL, a path to a local file, or an embedded data URL, as
+// for AddImage.
+//
+// Unlike SetCover, errors are returned instead of causing a panic; if the image
+// can't be retrieved, FileRetrievalError will be returned.
+func (e *Epub) SetCoverFromSource(source string) error {
+	e.Lock()
+	defer e.Unlock()
+
+	ext := strings.ToLower(filepath.Ext(source))
+	switch detectMediaType(source) {
+	case "DataURL":
+		ext = ""
+		if d, err := dataurl.DecodeString(source); err == nil {
+			ext = mimetype.Lookup(d.MediaType.ContentType()).Extension()
+		}
+	case "URL":
+		// The query and the fragment aren't part of the extension
+		ext = ""
+		if u, err := url.Parse(source); err == nil {
+			ext = strings.ToLower(path.Ext(u.Path))
+		}
+	}
+	imageFilename := fmt.Sprintf(defaultCoverImgFormat, ext)
+	if _, ok := e.images[imageFilename]; ok {
+		imageFilename = unusedMediaFilename(e.images, imageFileFormat, ext)
+	}
+	imagePath, err := addMedia(e.grabber(), source, imageFilename, imageFileFormat, ImageFolderName, e.images)
+	if err != nil {
+		return err
+	}
+	return e.setCover(imagePath, "")
+}
+
+func (e *Epub) setCover(internalImagePath string, internalCSSPath string) error {
 	// If a cover already exists
 	if e.cover.xhtmlFilename != "" {
 		// Remove the xhtml file
 		for i, section := range e.sections {
 			if section.filename == e.cover.xhtmlFilename {
 				e.sections = append(e.sections[:i], e.sections[i+1:]...)
+				e.removeSectionFilename(section.filename)
 				break
 			}
 		}
 
 		// Remove the image
 		delete(e.images, e.cover.imageFilename)
+		delete(e.mediaTypes, path.Join(ImageFolderName, e.cover.imageFilename))
 
 		// Remove the CSS
 		delete(e.css, e.cover.cssFilename)
-
-		if e.cover.cssTempFile != "" {
-			os.Remove(e.cover.cssTempFile)
-		}
+		delete(e.mediaTypes, path.Join(CSSFolderName, e.cover.cssFilename))
+		e.cover.cssTempFile = ""
 	}
 
 	e.cover.imageFilename = filepath.Base(internalImagePath)
-	e.pkg.setCover(e.cover.imageFilename)
+	// The manifest ID of the cover image, which Kindle looks for
+	e.pkg.setCover(SanitizeXMLID(e.cover.imageFilename))
 
 	// Use default cover stylesheet if one isn't provided
 	if internalCSSPath == "" {
-		// Encode the default CSS
-		e.cover.cssTempFile = dataurl.EncodeBytes([]byte(defaultCoverCSSContent))
 		var err error
-		internalCSSPath, err = e.addCSS(e.cover.cssTempFile, defaultCoverCSSFilename)
+		internalCSSPath, err = e.addCSSFromString(e.defaultCoverCSS(), defaultCoverCSSFilename)
 		// If that doesn't work, generate a filename
 		if _, ok := err.(*FilenameAlreadyUsedError); ok {
-			coverCSSFilename := fmt.Sprintf(
-				cssFileFormat,
-				len(e.css)+1,
-				".css",
-			)
-
-			internalCSSPath, err = e.addCSS(e.cover.cssTempFile, coverCSSFilename)
-			if _, ok := err.(*FilenameAlreadyUsedError); ok {
-				// This shouldn't cause an error
-				panic(fmt.Sprintf("Error adding default cover CSS file: %s", err))
-			}
+			internalCSSPath, err = e.addCSSFromString(e.defaultCoverCSS(), "")
 		}
 		if err != nil {
-			if _, ok := err.(*FilenameAlreadyUsedError); !ok {
-				panic(fmt.Sprintf("DEBUG %+v", err))
-			}
+			return fmt.Errorf("error adding default cover CSS file: %w", err)
 		}
+		e.cover.cssTempFile = e.css[filepath.Base(internalCSSPath)]
 	}
 	e.cover.cssFilename = filepath.Base(internalCSSPath)
 
-	coverBody := fmt.Sprintf(defaultCoverBody, internalImagePath)
+	coverBody, err := executeCoverTemplate(e.coverTemplate, internalImagePath, e.title)
+	if err != nil {
+		return fmt.Errorf("error generating cover XHTML file: %w", err)
+	}
 	// Title won't be used since the cover won't be added to the TOC
 	// First try to use the default cover filename
 	coverPath, err := e.addSection("", coverBody, "", defaultCoverXhtmlFilename, internalCSSPath)
 	// If that doesn't work, generate a filename
 	if _, ok := err.(*FilenameAlreadyUsedError); ok {
 		coverPath, err = e.addSection("", coverBody, "", "", internalCSSPath)
-		if _, ok := err.(*FilenameAlreadyUsedError); ok {
-			// This shouldn't cause an error since we're not specifying a filename
-			panic(fmt.Sprintf("Error adding default cover XHTML file: %s", err))
-		}
+	}
+	if err != nil {
+		return fmt.Errorf("error adding cover XHTML file: %w", err)
 	}
 	e.cover.xhtmlFilename = filepath.Base(coverPath)
+	return nil
 }
 
 // SetIdentifier sets the unique identifier of the EPUB, such as a UUID, DOI,
@@ -537,6 +1323,37 @@ func (e *Epub) SetDescription(desc string) {
 	e.pkg.setDescription(desc)
 }
 
+// SetNcx sets whether the EPUB 2 table of contents (toc.ncx) is generated. It's
+// generated by default for compatibility with readers that only support EPUB 2;
+// it can be left out when only EPUB 3 readers are targeted.
+func (e *Epub) SetNcx(include bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.noNcx = !include
+}
+
+// SetNcxMaxDepth limits the depth of the EPUB 2 table of contents (toc.ncx),
+// e.g. a depth of 1 only keeps the sections and leaves out the subsections. Some
+// older readers have trouble with deeply nested tables of contents. The EPUB 3
+// table of contents isn't affected. A depth of 0, the default, means no limit.
+func (e *Epub) SetNcxMaxDepth(depth int) {
+	e.Lock()
+	defer e.Unlock()
+	e.toc.setNcxMaxDepth(depth)
+}
+
+// SetNavInSpine sets whether the table of contents (the EPUB 3 nav document) is
+// added to the spine, right after the cover if there's one, so that it shows up
+// as a page of the book. Some readers only show tables of contents that are
+// part of the book. A landmark pointing to the table of contents is added to the
+// nav document as well. By default, the nav document isn't part of the spine.
+func (e *Epub) SetNavInSpine(include bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.navInSpine = include
+	e.toc.setTocLandmark(include)
+}
+
 // SetPpd sets the page progression direction of the EPUB.
 func (e *Epub) SetPpd(direction string) {
 	e.Lock()
@@ -545,6 +1362,263 @@ func (e *Epub) SetPpd(direction string) {
 	e.pkg.setPpd(direction)
 }
 
+// SetConvertImages sets whether Write converts images in formats that older
+// readers can't display (WebP and AVIF) to PNG if they have transparency or
+// JPEG otherwise. The converted images are renamed with the extension of their
+// new format, e.g. image.webp becomes image.jpg, and the links to them from the
+// sections and the CSS files are updated as they're written.
+//
+// WebP images are always converted. AVIF images are only converted if an AVIF
+// decoder is registered with the image package (see image.RegisterFormat),
+// which is usually done by importing the package of the decoder; otherwise, or
+// if an image can't be decoded, it's written as is. By default, images aren't
+// converted.
+func (e *Epub) SetConvertImages(convert bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.convertImages = convert
+}
+
+// SetValidateImages sets whether AddImage retrieves images as they're added to
+// make sure that they're in one of the image formats supported by EPUB readers
+// (GIF, JPEG, PNG, SVG or WebP), which catches content that isn't an image
+// (e.g. an HTML error page saved as a .jpg file) before it breaks the EPUB.
+// Images in the formats that can be decoded by the image package are decoded
+// as well. Invalid images result in a FileRetrievalError, wrapping an
+// UnexpectedMediaTypeError if the format isn't supported. By default, images
+// aren't validated.
+func (e *Epub) SetValidateImages(validate bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.validateImages = validate
+}
+
+// SetSubsetFonts sets whether Write subsets the fonts of the EPUB to the
+// characters used by its sections, which can greatly reduce the size of EPUBs
+// with large fonts (e.g. CJK fonts). The outlines of the glyphs of the
+// characters that aren't found in the body or the title of any section, nor in
+// the title of the EPUB or the text added to the sections when they're written
+// (the watermark and the labels of SetFigureNumbering), are removed from the
+// fonts. Characters that are only
+// used by CSS (e.g. with the content property) are therefore not kept.
+//
+// Only TrueType fonts are subset; other fonts (e.g. OpenType fonts with CFF
+// outlines or WOFF fonts) are written as is. By default, fonts aren't subset.
+func (e *Epub) SetSubsetFonts(subset bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.subsetFonts = subset
+}
+
+// SetDropOrphanedMedia sets whether Write leaves out media files that aren't
+// referenced by any section (see OrphanedMedia). By default, all media files are
+// written.
+func (e *Epub) SetDropOrphanedMedia(drop bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.dropOrphanedMedia = drop
+}
+
+// SetStreamMedia sets whether Write streams audio and video files from their
+// source straight into the EPUB instead of storing them before adding them to
+// the EPUB, which halves the I/O and the memory used by large audio or video
+// books when the storage is in memory (see Use).
+//
+// Streamed media is retrieved again each time it's used, even if it's added
+// several times from the same URL. Media that can't be retrieved is handled
+// according to the media failure policy (see SetMediaFailurePolicy), but an
+// error that happens once the media is being added to the EPUB always makes
+// Write fail. By default, media isn't streamed.
+func (e *Epub) SetStreamMedia(stream bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.streamMedia = stream
+}
+
+// SetDirectWrite sets whether Write builds the EPUB straight into the zip
+// archive instead of storing all its files (see Use) and then adding them to the
+// archive, which avoids writing each file twice. Media is then held in memory one
+// file at a time while it's added to the archive, except for the audio and video
+// files that are streamed (see SetStreamMedia). By default, the files are stored
+// first.
+func (e *Epub) SetDirectWrite(direct bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.directWrite = direct
+}
+
+// SetFilenamePolicy sets how the internal filenames of the media and the
+// sections are sanitized, e.g. the filenames of media retrieved from URLs which
+// may contain characters that break links (such as % or #), characters that
+// look alike but differ, or be too long for some reading systems. The policy
+// applies to the filenames derived from the sources as well as to the ones
+// provided when adding media or sections, and to the new filenames of
+// RenameSection. If a sanitized filename is already used, a number is added to
+// it, e.g. image-2.png, and a WarningRenamed warning is reported (see
+// Warnings). Already added files aren't renamed.
+//
+// By default (FilenameKeep), filenames are used as they are. See
+// SanitizeFilename for the result of each policy.
+func (e *Epub) SetFilenamePolicy(policy FilenamePolicy) {
+	e.Lock()
+	defer e.Unlock()
+	e.filenamePolicy = policy
+}
+
+// SetMediaFailurePolicy sets how Write handles media that can't be retrieved.
+// By default, Write fails with a FileRetrievalError.
+func (e *Epub) SetMediaFailurePolicy(policy MediaFailurePolicy) {
+	e.Lock()
+	defer e.Unlock()
+	e.mediaFailurePolicy = policy
+}
+
+// SetCompressionMethod sets the zip compression method of the files of the EPUB
+// with an extension (e.g. ".jpg") or a media type (e.g. "image/jpeg"), which
+// must be zip.Store or zip.Deflate, the only methods allowed by the EPUB spec.
+// Storing files that are already compressed (e.g. JPEG images, MP4 videos or
+// WOFF2 fonts) uncompressed makes writing faster and the EPUB sometimes
+// smaller. The media type takes precedence over the extension if both match
+// a file.
+//
+// By default, all files are compressed with zip.Deflate, except for the
+// mimetype file which is always stored uncompressed. If the method isn't
+// allowed, InvalidCompressionMethodError will be returned.
+func (e *Epub) SetCompressionMethod(extensionOrMediaType string, method uint16) error {
+	e.Lock()
+	defer e.Unlock()
+	if method != zip.Store && method != zip.Deflate {
+		return &InvalidCompressionMethodError{Method: method}
+	}
+	if strings.HasPrefix(extensionOrMediaType, ".") {
+		extensionOrMediaType = strings.ToLower(extensionOrMediaType)
+	}
+	e.compressionMethods[extensionOrMediaType] = method
+	return nil
+}
+
+// SetEmbedFailurePolicy sets how EmbedImages handles images that can't be
+// retrieved. By default, the references to the images are left as is.
+func (e *Epub) SetEmbedFailurePolicy(policy EmbedFailurePolicy) {
+	e.Lock()
+	defer e.Unlock()
+	e.embedFailurePolicy = policy
+}
+
+// SetWriteTimeout bounds the total time spent by Write. Remote media that
+// hasn't been retrieved once the timeout is reached is handled according to the
+// media failure policy (see SetMediaFailurePolicy). A timeout of 0, the
+// default, means no timeout.
+func (e *Epub) SetWriteTimeout(timeout time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+	e.writeTimeout = timeout
+}
+
+// SetFetchTimeout bounds the time spent retrieving each media file, whether
+// it's checked when it's added (e.g. by AddImage) or retrieved by Write, so that
+// a stalled URL doesn't hang the EPUB. Media that can't be retrieved in time
+// results in a FileRetrievalError wrapping context.DeadlineExceeded, which Write
+// handles according to the media failure policy (see SetMediaFailurePolicy). A
+// timeout of 0, the default, means no timeout.
+//
+// See SetWriteTimeout to bound the total time spent by Write.
+func (e *Epub) SetFetchTimeout(timeout time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+	e.fetchTimeout = timeout
+}
+
+// SetMediaCache sets the cache of the media retrieved from URLs by Write (see
+// NewDirMediaCache). Media found in the cache is revalidated with a conditional
+// request using its ETag or Last-Modified header and only downloaded again if
+// it changed. Only responses with one of these headers are cached. Errors
+// accessing the cache are ignored and the media is downloaded instead. By
+// default, media isn't cached; a nil cache disables caching.
+func (e *Epub) SetMediaCache(cache MediaCache) {
+	e.Lock()
+	defer e.Unlock()
+	e.mediaCache = cache
+}
+
+// SetFetchMode sets when the media added to the EPUB (e.g. by AddImage) is
+// retrieved. By default, media is checked when it's added and retrieved when
+// the EPUB is written (FetchOnWrite), so media that disappears in between makes
+// Write fail unless a media failure policy is set (see SetMediaFailurePolicy).
+// With FetchEager, media is retrieved when it's added and kept in memory, which
+// avoids such surprises at the cost of memory. With FetchLazy, media isn't
+// checked at all when it's added.
+//
+// The fetch mode only applies to the media added after it's set.
+func (e *Epub) SetFetchMode(mode FetchMode) {
+	e.Lock()
+	defer e.Unlock()
+	e.fetchMode = mode
+}
+
+// SetMediaSizeLimits sets the maximum size in bytes of each media file and of
+// all the media files of the EPUB, so that EPUBs generated from untrusted
+// sources can't be blown up by huge media. A limit of 0, the default, means no
+// limit.
+//
+// The size of each media file is checked when it's added (e.g. by AddImage) if
+// it's known, and enforced while it's retrieved. The total size is enforced
+// while Write retrieves the media. Media that exceeds a limit results in a
+// FileRetrievalError wrapping a MediaTooLargeError, which Write handles
+// according to the media failure policy (see SetMediaFailurePolicy).
+func (e *Epub) SetMediaSizeLimits(maxSize int64, maxTotalSize int64) {
+	e.Lock()
+	defer e.Unlock()
+	e.maxMediaSize = maxSize
+	e.maxTotalMediaSize = maxTotalSize
+}
+
+// SetUserAgent sets the User-Agent header of the HTTP requests made to retrieve
+// media from URLs, so that services archiving web content can identify
+// themselves. By default, the User-Agent of the HTTP client is used.
+func (e *Epub) SetUserAgent(userAgent string) {
+	e.Lock()
+	defer e.Unlock()
+	e.userAgent = userAgent
+}
+
+// SetFrom sets the From header of the HTTP requests made to retrieve media from
+// URLs, typically the email address of the person or organization responsible
+// for the requests. By default, no From header is sent.
+func (e *Epub) SetFrom(from string) {
+	e.Lock()
+	defer e.Unlock()
+	e.from = from
+}
+
+// SetHeader sets a header of the HTTP requests made to retrieve media from URLs,
+// both when media is checked as it's added (e.g. by AddImage) and when it's
+// retrieved by Write. This is useful for hosts that require a Referer header or
+// authentication (e.g. an Authorization header). Setting a header to an empty
+// value removes it.
+//
+// The User-Agent and From headers set by SetUserAgent and SetFrom take
+// precedence over the headers set by SetHeader.
+func (e *Epub) SetHeader(key string, value string) {
+	e.Lock()
+	defer e.Unlock()
+	if value == "" {
+		e.header.Del(key)
+		return
+	}
+	e.header.Set(key, value)
+}
+
+// AddCookie adds a cookie to the HTTP requests made to retrieve media from URLs,
+// e.g. an authentication cookie. The cookie is sent to every URL regardless of
+// its domain and path; set the Client of the EPUB to an http.Client with a
+// cookie jar to only send cookies to the hosts they belong to.
+func (e *Epub) AddCookie(cookie *http.Cookie) {
+	e.Lock()
+	defer e.Unlock()
+	e.cookies = append(e.cookies, cookie)
+}
+
 // SetTitle sets the title of the EPUB.
 func (e *Epub) SetTitle(title string) {
 	e.Lock()
@@ -556,75 +1630,73 @@ func (e *Epub) SetTitle(title string) {
 
 // Title returns the title of the EPUB.
 func (e *Epub) Title() string {
+	e.Lock()
+	defer e.Unlock()
 	return e.title
 }
 
-// EmbedImages download <img> tags in EPUB and modify body to show images
-// file inside of EPUB:
-// ../ImageFolderName/internalFilename
-//
-// The image source should either be a URL, a path to a local file, or an embedded data URL; in any
-// case, the image file will be retrieved and stored in the EPUB.
-//
-// The internal filename will be used when storing the image file in the EPUB
-// and must be unique among all image files. If the same filename is used more
-// than once, FilenameAlreadyUsedError will be returned. The internal filename is
-// optional; if no filename is provided, one will be generated.
-// if go-epub can't download image it keep it untoch and not return any error just log that
-
-// Just call EmbedImages() after section added
-func (e *Epub) EmbedImages() {
-	imageTagRegex := regexp.MustCompile(`<img.*?src="(.*?)".*?>`)
-	for i, section := range e.sections {
-		imageTagMatches := imageTagRegex.FindAllStringSubmatch(section.xhtml.xml.Body.XML, -1)
-
-		// Check if imageTagMatches is empty
-		if len(imageTagMatches) == 0 {
-			continue // Skip to the next section
-		}
-		images := make(map[string]string)
-
-		for _, match := range imageTagMatches {
-			imageURL := match[1]
-			if !strings.HasPrefix(imageURL, "data:image/") {
-				images[imageURL] = match[0]
-				filePath, err := e.AddImage(string(imageURL), "")
-				if err != nil {
-					log.Printf("can't add image to the epub: %s", err)
-					continue
-				}
-				e.sections[i].xhtml.xml.Body.XML = strings.ReplaceAll(section.xhtml.xml.Body.XML, match[0], replaceSrcAttribute(match[0], filePath))
-			}
-		}
+// mediaFolders returns the media files of the EPUB by the name of the folder
+// they're stored in
+func (e *Epub) mediaFolders() map[string]map[string]string {
+	return map[string]map[string]string{
+		CSSFolderName:   e.css,
+		FontFolderName:  e.fonts,
+		ImageFolderName: e.images,
+		VideoFolderName: e.videos,
+		AudioFolderName: e.audios,
 	}
 }
 
-func replaceSrcAttribute(imgTag string, filePath string) string {
-	re := regexp.MustCompile(`src="([^"]*)"`)
-	return re.ReplaceAllString(imgTag, fmt.Sprintf(`src="%s"`, filePath))
-}
-
 // Add a media file to the EPUB and return the path relative to the EPUB section
 // files
-func addMedia(client *http.Client, source string, internalFilename string, mediaFileFormat string, mediaFolderName string, mediaMap map[string]string) (string, error) {
-	err := grabber{client}.checkMedia(source)
+func addMedia(g grabber, source string, internalFilename string, mediaFileFormat string, mediaFolderName string, mediaMap map[string]string) (string, error) {
+	// Media already added from the same URL is reused rather than being
+	// downloaded again
+	if internalFilename == "" && detectMediaType(source) == "URL" {
+		if existingFilename := findMediaSource(mediaMap, source); existingFilename != "" {
+			return path.Join(
+				"..",
+				mediaFolderName,
+				existingFilename,
+			), nil
+		}
+	}
+
+	err := g.retrieveAddedMedia(source)
 	if err != nil {
 		return "", &FileRetrievalError{
 			Source: source,
 			Err:    err,
 		}
 	}
-	if internalFilename == "" {
+	if internalFilename != "" {
+		// The filename provided is sanitized as well, but it's made unique only
+		// if the sanitization makes it collide with another filename
+		if sanitized := SanitizeFilename(internalFilename, g.filenamePolicy); sanitized != internalFilename {
+			sanitized = uniqueFilename(sanitized, func(filename string) bool {
+				_, ok := mediaMap[filename]
+				return ok
+			})
+			if g.warn != nil {
+				g.warn(WarningRenamed, path.Join(contentFolderName, mediaFolderName, sanitized), "filename %s sanitized", internalFilename)
+			}
+			internalFilename = sanitized
+		}
+	} else {
 		// If a filename isn't provided, use the filename from the source
-		internalFilename = filepath.Base(source)
+		internalFilename = sourceFilename(source, g.filenamePolicy)
 		_, ok := mediaMap[internalFilename]
-		// if filename is too long, invalid or already used, try to generate a unique filename
-		if len(internalFilename) > 255 || !fs.ValidPath(internalFilename) || ok {
-			internalFilename = fmt.Sprintf(
+		// if filename is invalid or already used, try to generate a unique filename
+		if internalFilename == "" || ok {
+			generatedFilename := fmt.Sprintf(
 				mediaFileFormat,
 				len(mediaMap)+1,
 				strings.ToLower(filepath.Ext(source)),
 			)
+			if ok && g.warn != nil {
+				g.warn(WarningRenamed, path.Join(contentFolderName, mediaFolderName, generatedFilename), "filename %s already used", internalFilename)
+			}
+			internalFilename = generatedFilename
 		}
 	}
 
@@ -640,3 +1712,57 @@ func addMedia(client *http.Client, source string, internalFilename string, media
 		internalFilename,
 	), nil
 }
+
+// SetMediaType sets the media type of a media file (CSS, font, image, video or
+// audio) in the manifest, e.g. font/otf or application/javascript, instead of
+// the media type detected from its content. This is useful when the detection
+// gets it wrong, e.g. for a font served as application/octet-stream. The content
+// of the media file isn't checked against the media type. An empty media type
+// restores the detection.
+//
+// The internal path is the path returned when the media file was added, e.g.
+// ../FontFolderName/internalFilename. If no media file with this path exists,
+// MediaDoesNotExistError will be returned.
+func (e *Epub) SetMediaType(internalPath string, mediaType string) error {
+	e.Lock()
+	defer e.Unlock()
+	mediaPath := strings.TrimPrefix(path.Clean(internalPath), "../")
+	mediaFolderName, mediaFilename := path.Split(mediaPath)
+	mediaMap, ok := e.mediaFolders()[strings.TrimSuffix(mediaFolderName, "/")]
+	if !ok {
+		return &MediaDoesNotExistError{Path: internalPath}
+	}
+	if _, ok := mediaMap[mediaFilename]; !ok {
+		return &MediaDoesNotExistError{Path: internalPath}
+	}
+	if mediaType == "" {
+		delete(e.mediaTypes, mediaPath)
+	} else {
+		e.mediaTypes[mediaPath] = mediaType
+	}
+	return nil
+}
+
+// unusedMediaFilename generates a filename from mediaFileFormat and the
+// extension that isn't used yet in mediaMap
+func unusedMediaFilename(mediaMap map[string]string, mediaFileFormat string, ext string) string {
+	for index := len(mediaMap) + 1; ; index++ {
+		filename := fmt.Sprintf(mediaFileFormat, index, ext)
+		if _, ok := mediaMap[filename]; !ok {
+			return filename
+		}
+	}
+}
+
+// findMediaSource returns the filename of the media added from source, or an
+// empty string if there isn't any. If the source was added several times, the
+// first filename in lexical order is returned.
+func findMediaSource(mediaMap map[string]string, source string) string {
+	found := ""
+	for filename, mediaSource := range mediaMap {
+		if mediaSource == source && (found == "" || filename < found) {
+			found = filename
+		}
+	}
+	return found
+}
@@ -3,22 +3,29 @@ package epub
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/base64"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/bmaupin/go-epub/epubcheck"
 	"github.com/bmaupin/go-epub/internal/storage"
 	"github.com/gofrs/uuid"
+	"github.com/vincent-petithory/dataurl"
 )
 
 const (
@@ -33,6 +40,7 @@ const (
 </container>`
 	testCoverCSSFilename     = "cover.css"
 	testCoverCSSSource       = "testdata/cover.css"
+	testCoverSVGSource       = "testdata/cover.svg"
 	testCoverContentTemplate = `<?xml version="1.0" encoding="UTF-8"?>
 <!DOCTYPE html>
 <html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
@@ -47,8 +55,6 @@ const (
 	testCSSLinkTemplate       = `<link rel="stylesheet" type="text/css" href="%s"></link>`
 	testDirPerm               = 0775
 	testEpubAuthor            = "Hingle McCringleberry"
-	testEpubcheckJarfile      = "epubcheck.jar"
-	testEpubcheckPrefix       = "epubcheck"
 	testEpubFilename          = "My EPUB.epub"
 	testEpubIdentifier        = "urn:uuid:51b7c9ea-b2a2-49c6-9d8c-522790786d15"
 	testEpubLang              = "fr"
@@ -61,6 +67,7 @@ const (
 	testIdentifierTemplate    = `<dc:identifier id="pub-id">%s</dc:identifier>`
 	testImageFromFileFilename = "testfromfile.png"
 	testImageFromFileSource   = "testdata/gophercolor16x16.png"
+	testImageWebpSource       = "testdata/gopher.webp"
 	testNumberFilenameStart   = "01filenametest.png"
 	testSpaceInFilename       = "filename with space.png"
 	testVideoFromFileFilename = "testfromfile.mp4"
@@ -233,6 +240,46 @@ func TestAddCSS(t *testing.T) {
 	cleanup(testEpubFilename, tempDir)
 }
 
+func TestAddCSSFromString(t *testing.T) {
+	testCSSContent := "body { font-family: serif; }\n"
+	e := NewEpub(testEpubTitle)
+	testCSS1Path, err := e.AddCSSFromString(testCSSContent, "style.css")
+	if err != nil {
+		t.Errorf("Error adding CSS: %s", err)
+	}
+	testCSS2Path, err := e.AddCSSFromString(testCSSContent, "")
+	if err != nil {
+		t.Errorf("Error adding CSS: %s", err)
+	}
+	if _, err := e.AddCSSFromString(testCSSContent, "style.css"); err == nil {
+		t.Errorf("Expected FilenameAlreadyUsedError for a duplicate filename")
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	for _, testCSSPath := range []string{testCSS1Path, testCSS2Path} {
+		if filepath.Ext(testCSSPath) != ".css" {
+			t.Errorf("CSS path %s doesn't have a .css extension", testCSSPath)
+		}
+		contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testCSSPath))
+		if err != nil {
+			t.Errorf("Unexpected error reading CSS file: %s", err)
+		}
+		if string(contents) != testCSSContent {
+			t.Errorf("CSS file contents don't match\nGot: %s\nExpected: %s", contents, testCSSContent)
+		}
+	}
+
+	pkgContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading package file: %s", err)
+	}
+	if !strings.Contains(string(pkgContents), `href="css/style.css" media-type="text/css"`) {
+		t.Errorf("CSS file doesn't have the text/css media type: %s", pkgContents)
+	}
+}
+
 func TestAddFont(t *testing.T) {
 	e := NewEpub(testEpubTitle)
 	testFontFromFilePath, err := e.AddFont(testFontFromFileSource, "")
@@ -259,6 +306,178 @@ func TestAddFont(t *testing.T) {
 	cleanup(testEpubFilename, tempDir)
 }
 
+func TestAddFontBytes(t *testing.T) {
+	testFontContents, err := os.ReadFile(testFontFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading testdata font file: %s", err)
+	}
+	e := NewEpub(testEpubTitle)
+	testFont1Path, err := e.AddFontBytes(testFontContents, "")
+	if err != nil {
+		t.Errorf("Error adding font: %s", err)
+	}
+	if testFont1Path != "../fonts/font0001.ttf" {
+		t.Errorf("Got font path %s, expected ../fonts/font0001.ttf", testFont1Path)
+	}
+	testFont2Path, err := e.AddFontBytes(testFontContents, "embedded.ttf")
+	if err != nil {
+		t.Errorf("Error adding font: %s", err)
+	}
+	if _, err := e.AddFontBytes(testFontContents, "embedded.ttf"); err == nil {
+		t.Errorf("Expected FilenameAlreadyUsedError for a duplicate filename")
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	for _, testFontPath := range []string{testFont1Path, testFont2Path} {
+		contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testFontPath))
+		if err != nil {
+			t.Errorf("Unexpected error reading font file from EPUB: %s", err)
+		}
+		if !bytes.Equal(contents, testFontContents) {
+			t.Errorf("Font file contents don't match")
+		}
+	}
+}
+
+func TestSetMediaType(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	testFontPath, _ := e.AddFont(testFontFromFileSource, "")
+	testCSSPath, _ := e.AddCSS(testCoverCSSSource, "")
+	if err := e.SetMediaType(testFontPath, "application/font-sfnt"); err != nil {
+		t.Errorf("Unexpected error setting media type: %s", err)
+	}
+	if err := e.SetMediaType(testCSSPath, "text/plain"); err != nil {
+		t.Errorf("Unexpected error setting media type: %s", err)
+	}
+	// Restores the detected media type
+	if err := e.SetMediaType(testCSSPath, ""); err != nil {
+		t.Errorf("Unexpected error setting media type: %s", err)
+	}
+	for _, missingPath := range []string{"../fonts/missing.ttf", "../other/file.txt"} {
+		err := e.SetMediaType(missingPath, "font/ttf")
+		if _, ok := err.(*MediaDoesNotExistError); !ok {
+			t.Errorf("Expected MediaDoesNotExistError for %s, got %v", missingPath, err)
+		}
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	pkgContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading package file: %s", err)
+	}
+	for _, testItem := range []string{
+		`href="fonts/redacted-script-regular.ttf" media-type="application/font-sfnt"`,
+		`href="css/cover.css" media-type="text/css"`,
+	} {
+		if !strings.Contains(string(pkgContents), testItem) {
+			t.Errorf("Package file doesn't contain %q: %s", testItem, pkgContents)
+		}
+	}
+}
+
+func TestSetValidateImages(t *testing.T) {
+	testImage, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Error reading image: %s", err)
+	}
+	truncatedImage := "data:image/png;base64," + base64.StdEncoding.EncodeToString(testImage[:20])
+	errorPage := "data:text/html;base64," + base64.StdEncoding.EncodeToString([]byte("<html><body>Not found</body></html>"))
+
+	tests := []struct {
+		name             string
+		source           string
+		wantErr          bool
+		wantMediaTypeErr bool
+	}{
+		{"PNG", testImageFromFileSource, false, false},
+		{"WebP", testImageWebpSource, false, false},
+		{"HTML", errorPage, true, true},
+		{"Truncated", truncatedImage, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEpub(testEpubTitle)
+			if _, err := e.AddImage(tt.source, ""); err != nil {
+				t.Errorf("Unexpected error adding image without validation: %s", err)
+			}
+
+			e = NewEpub(testEpubTitle)
+			e.SetValidateImages(true)
+			_, err := e.AddImage(tt.source, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+			if _, ok := err.(*FileRetrievalError); !ok {
+				t.Errorf("Expected error FileRetrievalError not returned. Returned instead: %+v", err)
+			}
+			var mediaTypeErr *UnexpectedMediaTypeError
+			if errors.As(err, &mediaTypeErr) != tt.wantMediaTypeErr {
+				t.Errorf("Got error %+v, expected UnexpectedMediaTypeError: %v", err, tt.wantMediaTypeErr)
+			}
+		})
+	}
+}
+
+func TestSetConvertImages(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	testImagePath, err := e.AddImage(testImageWebpSource, "")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	section, err := e.AddSection(`<img src="`+testImagePath+`" alt="" />`, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	e.SetConvertImages(true)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	pkgContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading package file: %s", err)
+	}
+	if strings.Contains(string(pkgContents), mediaTypeWebp) {
+		t.Errorf("Package file still contains a WebP image: %s", pkgContents)
+	}
+
+	// The converted image is renamed with the extension of its format
+	m := regexp.MustCompile(`href="images/(gopher\.(?:png|jpg))"`).FindSubmatch(pkgContents)
+	if m == nil {
+		t.Fatalf("Converted image not found in the package file: %s", pkgContents)
+	}
+	convertedPath := "../images/" + string(m[1])
+	sectionContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, section))
+	if err != nil {
+		t.Fatalf("Unexpected error reading section: %s", err)
+	}
+	if !strings.Contains(string(sectionContents), `src="`+convertedPath+`"`) {
+		t.Errorf("Section doesn't link to the converted image %s: %s", convertedPath, sectionContents)
+	}
+	for _, w := range e.Warnings() {
+		if w.Type == WarningExtensionMismatch {
+			t.Errorf("Unexpected warning: %s", w)
+		}
+	}
+
+	// The image path is relative to the XHTML folder
+	f, err := filesystem.Open(filepath.Join(tempDir, contentFolderName, xhtmlFolderName, convertedPath))
+	if err != nil {
+		t.Fatalf("Unexpected error opening image: %s", err)
+	}
+	defer f.Close()
+	if _, format, err := image.Decode(f); err != nil || (format != "png" && format != "jpeg") {
+		t.Errorf("Image wasn't converted to PNG or JPEG: format %q, error %v", format, err)
+	}
+}
+
 func TestAddImage(t *testing.T) {
 	fs := http.FileServer(http.Dir("./testdata/"))
 
@@ -429,6 +648,159 @@ func TestAddAudio(t *testing.T) {
 	cleanup(testEpubFilename, tempDir)
 }
 
+func TestAddRemoteMedia(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("./testdata/")))
+	defer server.Close()
+
+	e := NewEpub(testEpubTitle)
+	testVideoURL, err := e.AddRemoteVideo(server.URL+"/sample_640x360.mp4", "video/mp4")
+	if err != nil {
+		t.Fatalf("Error adding remote video: %s", err)
+	}
+	testAudioURL, err := e.AddRemoteAudio(server.URL+"/sample_audio.wav", "audio/wav")
+	if err != nil {
+		t.Fatalf("Error adding remote audio: %s", err)
+	}
+	testRemoteSectionPath, err := e.AddSection(fmt.Sprintf(`<video src="%s" />`, testVideoURL), "Remote", "", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	testLocalSectionPath, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+
+	if _, err := e.AddRemoteVideo(testVideoFromFileSource, "video/mp4"); err == nil {
+		t.Error("Expected error InvalidRemoteMediaError not returned")
+	} else if _, ok := err.(*InvalidRemoteMediaError); !ok {
+		t.Errorf("Expected error InvalidRemoteMediaError not returned. Returned instead: %+v", err)
+	}
+	if _, err := e.AddRemoteAudio(testAudioURL, "text/html"); err == nil {
+		t.Error("Expected error UnexpectedMediaTypeError not returned")
+	} else if _, ok := err.(*UnexpectedMediaTypeError); !ok {
+		t.Errorf("Expected error UnexpectedMediaTypeError not returned. Returned instead: %+v", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	pkgContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading package file: %s", err)
+	}
+	for _, testItem := range []string{
+		fmt.Sprintf(`href="%s" media-type="video/mp4"`, testVideoURL),
+		fmt.Sprintf(`href="%s" media-type="audio/wav"`, testAudioURL),
+		fmt.Sprintf(`href="%s" media-type="application/xhtml+xml" properties="remote-resources"`, filepath.Join(xhtmlFolderName, filepath.Base(testRemoteSectionPath))),
+		fmt.Sprintf(`href="%s" media-type="application/xhtml+xml"></item>`, filepath.Join(xhtmlFolderName, filepath.Base(testLocalSectionPath))),
+	} {
+		if !strings.Contains(string(pkgContents), testItem) {
+			t.Errorf("Package file doesn't contain %q: %s", testItem, pkgContents)
+		}
+	}
+
+	// Remote media isn't stored in the EPUB
+	if strings.Contains(string(pkgContents), `href="`+VideoFolderName+`/`) {
+		t.Errorf("Package file contains a stored video: %s", pkgContents)
+	}
+}
+
+func TestAddRawFile(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	testDataPath, err := e.AddRawFile("data:application/json,%7B%22chapters%22%3A2%7D", "data/chapters.json", "")
+	if err != nil {
+		t.Fatalf("Error adding raw file: %s", err)
+	}
+	if testDataPath != "../data/chapters.json" {
+		t.Errorf("Got path %s, expected ../data/chapters.json", testDataPath)
+	}
+	testCaptionsPath, err := e.AddRawFile("data:,WEBVTT", "captions.vtt", "text/vtt")
+	if err != nil {
+		t.Fatalf("Error adding raw file: %s", err)
+	}
+
+	for _, tt := range []struct {
+		internalPath string
+		wantErr      error
+	}{
+		{"data/chapters.json", &FilenameAlreadyUsedError{}},
+		{pkgFilename, &FilenameAlreadyUsedError{}},
+		{"../outside.json", &InvalidInternalPathError{}},
+		{"/absolute.json", &InvalidInternalPathError{}},
+		{ImageFolderName + "/image.json", &InvalidInternalPathError{}},
+		{xhtmlFolderName + "/section.json", &InvalidInternalPathError{}},
+	} {
+		_, err := e.AddRawFile("data:,{}", tt.internalPath, "application/json")
+		if fmt.Sprintf("%T", err) != fmt.Sprintf("%T", tt.wantErr) {
+			t.Errorf("AddRawFile(%q) returned error %v, expected %T", tt.internalPath, err, tt.wantErr)
+		}
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	// The path is relative to the XHTML folder
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testDataPath))
+	if err != nil {
+		t.Fatalf("Unexpected error reading raw file: %s", err)
+	}
+	if string(contents) != `{"chapters":2}` {
+		t.Errorf("Got raw file contents %q, expected %q", contents, `{"chapters":2}`)
+	}
+	if _, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testCaptionsPath)); err != nil {
+		t.Errorf("Unexpected error reading raw file: %s", err)
+	}
+
+	pkgContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading package file: %s", err)
+	}
+	for _, testItem := range []string{
+		`href="captions.vtt" media-type="text/vtt"`,
+		`href="data/chapters.json" media-type="application/json"`,
+	} {
+		if !strings.Contains(string(pkgContents), testItem) {
+			t.Errorf("Package file doesn't contain %q: %s", testItem, pkgContents)
+		}
+	}
+}
+
+func TestAddMetaInfFile(t *testing.T) {
+	testDisplayOptions := `<?xml version="1.0" encoding="UTF-8"?><display_options><platform name="*"><option name="specified-fonts">true</option></platform></display_options>`
+	e := NewEpub(testEpubTitle)
+	if err := e.AddMetaInfFile("data:application/xml,"+url.PathEscape(testDisplayOptions), "com.apple.ibooks.display-options.xml"); err != nil {
+		t.Fatalf("Error adding META-INF file: %s", err)
+	}
+
+	for _, tt := range []struct {
+		filename string
+		wantErr  error
+	}{
+		{"com.apple.ibooks.display-options.xml", &FilenameAlreadyUsedError{}},
+		{containerFilename, &FilenameAlreadyUsedError{}},
+		{"../outside.xml", &InvalidInternalPathError{}},
+	} {
+		err := e.AddMetaInfFile("data:,test", tt.filename)
+		if fmt.Sprintf("%T", err) != fmt.Sprintf("%T", tt.wantErr) {
+			t.Errorf("AddMetaInfFile(%q) returned error %v, expected %T", tt.filename, err, tt.wantErr)
+		}
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, metaInfFolderName, "com.apple.ibooks.display-options.xml"))
+	if err != nil {
+		t.Fatalf("Unexpected error reading META-INF file: %s", err)
+	}
+	if string(contents) != testDisplayOptions {
+		t.Errorf("Got META-INF file contents %q, expected %q", contents, testDisplayOptions)
+	}
+	if _, err := storage.ReadFile(filesystem, filepath.Join(tempDir, metaInfFolderName, containerFilename)); err != nil {
+		t.Errorf("Unexpected error reading container file: %s", err)
+	}
+}
+
 func TestAddSection(t *testing.T) {
 	e := NewEpub(testEpubTitle)
 	testSection1Path, err := e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
@@ -521,6 +893,197 @@ func TestAddSubSection(t *testing.T) {
 	cleanup(testEpubFilename, tempDir)
 }
 
+func TestAddSectionGeneratedFilenames(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	addSection := func(parent string, filename string) string {
+		t.Helper()
+		var sectionPath string
+		var err error
+		if parent == "" {
+			sectionPath, err = e.AddSection(testSectionBody, testSectionTitle, filename, "")
+		} else {
+			sectionPath, err = e.AddSubSection(parent, testSectionBody, testSectionTitle, filename, "")
+		}
+		if err != nil {
+			t.Fatalf("Error adding section: %s", err)
+		}
+		return sectionPath
+	}
+
+	addSection("", "section0002.xhtml")
+	if got := addSection("", ""); got != "section0001.xhtml" {
+		t.Errorf("Got generated filename %s, expected section0001.xhtml", got)
+	}
+	// Filenames used by sections and subsections are skipped
+	if got := addSection("section0001.xhtml", ""); got != "section0003.xhtml" {
+		t.Errorf("Got generated filename %s, expected section0003.xhtml", got)
+	}
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "section0003.xhtml", ""); err == nil {
+		t.Error("Expected error adding a section with the filename of a subsection")
+	}
+	// The filenames of renamed sections can be generated again
+	if _, err := e.RenameSection("section0001.xhtml", "intro.xhtml"); err != nil {
+		t.Fatalf("Error renaming section: %s", err)
+	}
+	if got := addSection("", ""); got != "section0001.xhtml" {
+		t.Errorf("Got generated filename %s, expected section0001.xhtml", got)
+	}
+	if got := addSection("", ""); got != "section0004.xhtml" {
+		t.Errorf("Got generated filename %s, expected section0004.xhtml", got)
+	}
+}
+
+func TestAddSectionWithOptions(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	testCSS1Path, _ := e.AddCSS(testCoverCSSSource, testCoverCSSFilename)
+	testCSS2Path, _ := e.AddCSS(testFontCSSSource, testFontCSSFilename)
+	testSectionPath, err := e.AddSectionWithOptions(testSectionBody, SectionOptions{
+		Title:           testSectionTitle,
+		Filename:        testSectionFilename,
+		CSS:             []string{testCSS1Path, testCSS2Path},
+		Lang:            "fr",
+		EpubType:        "chapter",
+		SpineProperties: "page-spread-right",
+	})
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	testSubSectionPath, err := e.AddSectionWithOptions(testSectionBody, SectionOptions{
+		Title:     "Answers",
+		Parent:    testSectionPath,
+		NonLinear: true,
+	})
+	if err != nil {
+		t.Fatalf("Error adding subsection: %s", err)
+	}
+	if _, err := e.AddSectionWithOptions(testSectionBody, SectionOptions{Parent: "missing.xhtml"}); err == nil {
+		t.Errorf("Expected ParentDoesNotExistError for a missing parent")
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Fatalf("Unexpected error reading section file: %s", err)
+	}
+	for _, s := range []string{
+		`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="fr" xml:lang="fr">`,
+		fmt.Sprintf(testCSSLinkTemplate, testCSS1Path) + "\n    " + fmt.Sprintf(testCSSLinkTemplate, testCSS2Path),
+		`<body dir="auto" epub:type="chapter">`,
+	} {
+		if !strings.Contains(string(contents), s) {
+			t.Errorf("Section file doesn't contain %q:\n%s", s, contents)
+		}
+	}
+
+	pkgContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading package file: %s", err)
+	}
+	for _, s := range []string{
+		fmt.Sprintf(`<itemref idref="%s" properties="page-spread-right"></itemref>`, testSectionPath),
+		fmt.Sprintf(`<itemref idref="%s" linear="no"></itemref>`, testSubSectionPath),
+	} {
+		if !strings.Contains(string(pkgContents), s) {
+			t.Errorf("Package file doesn't contain %q:\n%s", s, pkgContents)
+		}
+	}
+}
+
+func TestSectionTocTitle(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	testSectionPath, _ := e.AddSectionWithOptions(testSectionBody, SectionOptions{
+		Title:    "Chapter 12: The Long Way Home",
+		TocTitle: "Ch. 12",
+	})
+	e.AddSection(testSectionBody, "Chapter 13: Arrival", "chapter13.xhtml", "")
+	if err := e.SetSectionTocTitle("chapter13.xhtml", "Ch. 13"); err != nil {
+		t.Fatalf("Unexpected error setting TOC title: %s", err)
+	}
+	if err := e.SetSectionTocTitle("missing.xhtml", "Ch. 14"); err == nil {
+		t.Errorf("Expected SectionDoesNotExistError for a missing section")
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	sectionContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Fatalf("Unexpected error reading section file: %s", err)
+	}
+	if !strings.Contains(string(sectionContents), `<title dir="auto">Chapter 12: The Long Way Home</title>`) {
+		t.Errorf("Section page title doesn't match: %s", sectionContents)
+	}
+	for _, tocFilename := range []string{tocNavFilename, tocNcxFilename} {
+		tocContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, tocFilename))
+		if err != nil {
+			t.Fatalf("Unexpected error reading TOC file: %s", err)
+		}
+		for _, label := range []string{"Ch. 12", "Ch. 13"} {
+			if !strings.Contains(string(tocContents), ">"+label+"<") {
+				t.Errorf("%s doesn't contain the TOC title %q: %s", tocFilename, label, tocContents)
+			}
+		}
+		if strings.Contains(string(tocContents), "Chapter 12") {
+			t.Errorf("%s contains the page title instead of the TOC title: %s", tocFilename, tocContents)
+		}
+	}
+}
+
+func TestRenameSection(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	testSection1Path, err := e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+	testSection2Body := fmt.Sprintf(`<a href="%s">Link</a> <a href="%s#note1">Note</a> <a href="../xhtml/%s">Other</a>`, testSection1Path, testSection1Path, testSection1Path)
+	testSection2Path, err := e.AddSubSection(testSection1Path, testSection2Body, testSectionTitle, "", "")
+	if err != nil {
+		t.Errorf("Error adding subsection: %s", err)
+	}
+
+	_, err = e.RenameSection(testSection1Path, testSection2Path)
+	if _, ok := err.(*FilenameAlreadyUsedError); !ok {
+		t.Errorf("Expected error FilenameAlreadyUsedError not returned. Returned instead: %+v", err)
+	}
+	_, err = e.RenameSection("doesnotexist.xhtml", "new.xhtml")
+	if _, ok := err.(*SectionDoesNotExistError); !ok {
+		t.Errorf("Expected error SectionDoesNotExistError not returned. Returned instead: %+v", err)
+	}
+
+	testRenamedPath, err := e.RenameSection(testSection1Path, "renamed.xhtml")
+	if err != nil {
+		t.Errorf("Error renaming section: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSection2Path))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	testRenamedBody := `<a href="renamed.xhtml">Link</a> <a href="renamed.xhtml#note1">Note</a> <a href="../xhtml/renamed.xhtml">Other</a>`
+	if !strings.Contains(string(contents), testRenamedBody) {
+		t.Errorf(
+			"Links to renamed section don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testRenamedBody)
+	}
+
+	contents, err = storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading nav file: %s", err)
+	}
+	if !strings.Contains(string(contents), filepath.ToSlash(filepath.Join(xhtmlFolderName, testRenamedPath))) {
+		t.Errorf("TOC doesn't link to renamed section: %s", contents)
+	}
+
+	cleanup(testEpubFilename, tempDir)
+}
+
 func TestEpubAuthor(t *testing.T) {
 	e := NewEpub(testEpubTitle)
 	e.SetAuthor(testEpubAuthor)
@@ -775,6 +1338,404 @@ func TestSetCover(t *testing.T) {
 	cleanup(testEpubFilename, tempDir)
 }
 
+func TestSetCoverFromSource(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if err := e.SetCoverFromSource("testdata/missing.png"); err == nil {
+		t.Errorf("Expected FileRetrievalError for a missing image")
+	} else if _, ok := err.(*FileRetrievalError); !ok {
+		t.Errorf("Expected FileRetrievalError, got %T: %s", err, err)
+	}
+	if err := e.SetCoverFromSource(testImageFromFileSource); err != nil {
+		t.Fatalf("Unexpected error setting cover: %s", err)
+	}
+	// Replacing the cover with a data URL image
+	if err := e.SetCoverFromSource("data:image/png;base64," + base64.StdEncoding.EncodeToString(mustReadFile(t, testImageFromFileSource))); err != nil {
+		t.Fatalf("Unexpected error setting cover: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	coverContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, defaultCoverXhtmlFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading cover file: %s", err)
+	}
+	if !strings.Contains(string(coverContents), `<img src="../images/image0002.png" alt="Cover Image" />`) {
+		t.Errorf("Cover page doesn't reference the cover image: %s", coverContents)
+	}
+	pkgContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading package file: %s", err)
+	}
+	if !strings.Contains(string(pkgContents), `<item id="image0002.png" href="images/image0002.png" media-type="image/png" properties="cover-image"></item>`) {
+		t.Errorf("Cover image isn't in the manifest: %s", pkgContents)
+	}
+	if strings.Contains(string(pkgContents), `href="images/cover.png"`) {
+		t.Errorf("Previous cover image is still in the manifest: %s", pkgContents)
+	}
+	if strings.Count(string(pkgContents), `<meta name="cover"`) != 1 {
+		t.Errorf("Expected a single cover meta element: %s", pkgContents)
+	}
+}
+
+// The query of a cover URL isn't part of the filename of the image
+func TestSetCoverFromSourceURL(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("./testdata/")))
+	defer server.Close()
+
+	e := NewEpub(testEpubTitle)
+	if err := e.SetCoverFromSource(server.URL + "/gophercolor16x16.png?w=600#cover"); err != nil {
+		t.Fatalf("Unexpected error setting cover: %s", err)
+	}
+	r := newTestReader(t, e)
+	if _, err := r.ReadFile("EPUB/images/cover.png"); err != nil {
+		t.Errorf("Unexpected error reading the cover image: %s", err)
+	}
+}
+
+func TestSVGCover(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if err := e.SetCoverFromSource(testCoverSVGSource); err != nil {
+		t.Fatalf("Unexpected error setting cover: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	pkgContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading package file: %s", err)
+	}
+	if !strings.Contains(string(pkgContents), `<item id="cover.svg" href="images/cover.svg" media-type="image/svg+xml" properties="cover-image"></item>`) {
+		t.Errorf("SVG cover image isn't in the manifest: %s", pkgContents)
+	}
+	coverContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, defaultCoverXhtmlFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading cover file: %s", err)
+	}
+	if !strings.Contains(string(coverContents), `<img src="../images/cover.svg" alt="Cover Image" />`) {
+		t.Errorf("Cover page doesn't reference the SVG cover image: %s", coverContents)
+	}
+}
+
+func TestSetCoverTemplate(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if err := e.SetCoverTemplate("{{.Missing"); err == nil {
+		t.Errorf("Expected an error for an invalid template")
+	}
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	// Setting the template after the cover updates the cover page
+	if err := e.SetCoverTemplate(SVGCoverTemplate); err != nil {
+		t.Fatalf("Unexpected error setting cover template: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	coverContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, defaultCoverXhtmlFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading cover file: %s", err)
+	}
+	if !strings.Contains(string(coverContents), `<image width="100%" height="100%" xlink:href="`+testImagePath+`" />`) {
+		t.Errorf("Cover page doesn't use the template: %s", coverContents)
+	}
+	pkgContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading package file: %s", err)
+	}
+	if !strings.Contains(string(pkgContents), `<item id="cover.xhtml" href="xhtml/cover.xhtml" media-type="application/xhtml+xml" properties="svg"></item>`) {
+		t.Errorf("Cover page isn't declared as containing SVG: %s", pkgContents)
+	}
+
+	// Setting the template before the cover
+	e = NewEpub(testEpubTitle)
+	if err := e.SetCoverTemplate(`<img src="{{.ImagePath}}" alt="{{.Title}}" />`); err != nil {
+		t.Fatalf("Unexpected error setting cover template: %s", err)
+	}
+	testImagePath, _ = e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	body := e.findSection(defaultCoverXhtmlFilename).xhtml.xml.Body.XML
+	if !strings.Contains(body, `<img src="`+testImagePath+`" alt="`+testEpubTitle+`" />`) {
+		t.Errorf("Cover page doesn't use the template: %s", body)
+	}
+}
+
+func TestSetDefaultCoverCSS(t *testing.T) {
+	testCoverCSS := "body { background-color: #000000; }\n"
+	testOtherCoverCSS := "img { width: 100%; }\n"
+
+	// Setting the CSS before the cover
+	e := NewEpub(testEpubTitle)
+	e.SetDefaultCoverCSS(testCoverCSS)
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	coverCSSContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, CSSFolderName, defaultCoverCSSFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading cover CSS file: %s", err)
+	}
+	if string(coverCSSContents) != testCoverCSS {
+		t.Errorf("Got cover CSS %q, expected %q", coverCSSContents, testCoverCSS)
+	}
+	cleanup(testEpubFilename, tempDir)
+
+	// Setting the CSS after the cover updates the cover stylesheet
+	e = NewEpub(testEpubTitle)
+	testImagePath, _ = e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	e.SetDefaultCoverCSS(testOtherCoverCSS)
+
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+	coverCSSContents, err = storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, CSSFolderName, defaultCoverCSSFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading cover CSS file: %s", err)
+	}
+	if string(coverCSSContents) != testOtherCoverCSS {
+		t.Errorf("Got cover CSS %q, expected %q", coverCSSContents, testOtherCoverCSS)
+	}
+
+	// An empty CSS restores the default stylesheet
+	e.SetDefaultCoverCSS("")
+	d, err := dataurl.DecodeString(e.css[defaultCoverCSSFilename])
+	if err != nil {
+		t.Fatalf("Unexpected error decoding cover CSS: %s", err)
+	}
+	if string(d.Data) != defaultCoverCSSContent {
+		t.Errorf("Got cover CSS %q, expected the default cover CSS", d.Data)
+	}
+}
+
+func mustReadFile(t testing.TB, name string) []byte {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Unexpected error reading %s: %s", name, err)
+	}
+	return data
+}
+
+func TestNavInSpine(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	e.SetNavInSpine(true)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	testSpine := `<itemref idref="cover.xhtml"></itemref>
+    <itemref idref="nav"></itemref>
+    <itemref idref="section0001.xhtml"></itemref>`
+	if !strings.Contains(string(contents), testSpine) {
+		t.Errorf(
+			"Spine doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testSpine)
+	}
+
+	contents, err = storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading nav file: %s", err)
+	}
+	testLandmark := `<a epub:type="toc" href="nav.xhtml">Table of Contents</a>`
+	if !strings.Contains(string(contents), testLandmark) {
+		t.Errorf(
+			"Nav landmarks don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testLandmark)
+	}
+
+	cleanup(testEpubFilename, tempDir)
+}
+
+func TestNoNcx(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	e.SetNcx(false)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if strings.Contains(string(contents), tocNcxFilename) || strings.Contains(string(contents), `toc="ncx"`) {
+		t.Errorf("Package file still references the NCX: %s", contents)
+	}
+	if _, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, tocNcxFilename)); err == nil {
+		t.Errorf("NCX file was written to the EPUB")
+	}
+
+	cleanup(testEpubFilename, tempDir)
+}
+
+func TestSetSectionLinear(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	e.AddSection(testSectionBody, "Answers", "answers.xhtml", "")
+	if err := e.SetSectionLinear("answers.xhtml", false); err != nil {
+		t.Fatalf("Unexpected error setting section linear: %s", err)
+	}
+	err := e.SetSectionLinear("missing.xhtml", false)
+	if _, ok := err.(*SectionDoesNotExistError); !ok {
+		t.Errorf("Expected SectionDoesNotExistError, got %v", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if !strings.Contains(string(contents), `<itemref idref="answers.xhtml" linear="no"></itemref>`) {
+		t.Errorf("Non-linear section isn't marked as such in the spine: %s", contents)
+	}
+	if !strings.Contains(string(contents), fmt.Sprintf(`<itemref idref="%s"></itemref>`, testSectionFilename)) {
+		t.Errorf("Linear section isn't in the spine: %s", contents)
+	}
+
+	cleanup(testEpubFilename, tempDir)
+}
+
+func TestSetSectionSpineProperties(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	if err := e.SetSectionSpineProperties(testSectionFilename, " page-spread-left  rendition:layout-pre-paginated "); err != nil {
+		t.Fatalf("Unexpected error setting spine properties: %s", err)
+	}
+	err := e.SetSectionSpineProperties("missing.xhtml", "page-spread-left")
+	if _, ok := err.(*SectionDoesNotExistError); !ok {
+		t.Errorf("Expected SectionDoesNotExistError, got %v", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	testItemref := fmt.Sprintf(`<itemref idref="%s" properties="page-spread-left rendition:layout-pre-paginated"></itemref>`, testSectionFilename)
+	if !strings.Contains(string(contents), testItemref) {
+		t.Errorf("Spine item properties don't match\nGot: %s\nExpected to contain: %s", contents, testItemref)
+	}
+
+	cleanup(testEpubFilename, tempDir)
+}
+
+func TestAddAuxiliaryXHTML(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	auxiliaryPath, err := e.AddAuxiliaryXHTML(testSectionBody, "Note", "note.xhtml", "")
+	if err != nil {
+		t.Fatalf("Unexpected error adding auxiliary XHTML: %s", err)
+	}
+	if _, err := e.AddAuxiliaryXHTML(testSectionBody, "Note", "note.xhtml", ""); err == nil {
+		t.Errorf("Expected FilenameAlreadyUsedError for a duplicate filename")
+	}
+	if _, err := e.AddSubSection(auxiliaryPath, testSectionBody, "Subsection", "", ""); err == nil {
+		t.Errorf("Expected ParentDoesNotExistError for a subsection of an auxiliary file")
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	if _, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, auxiliaryPath)); err != nil {
+		t.Errorf("Auxiliary XHTML file wasn't written: %s", err)
+	}
+	pkgContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading package file: %s", err)
+	}
+	if !strings.Contains(string(pkgContents), `<item id="note.xhtml" href="xhtml/note.xhtml" media-type="application/xhtml+xml"></item>`) {
+		t.Errorf("Auxiliary XHTML file isn't in the manifest: %s", pkgContents)
+	}
+	if strings.Contains(string(pkgContents), `<itemref idref="note.xhtml"`) {
+		t.Errorf("Auxiliary XHTML file is in the spine: %s", pkgContents)
+	}
+	for _, tocFilename := range []string{tocNavFilename, tocNcxFilename} {
+		tocContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, tocFilename))
+		if err != nil {
+			t.Fatalf("Unexpected error reading TOC file: %s", err)
+		}
+		if strings.Contains(string(tocContents), "note.xhtml") {
+			t.Errorf("Auxiliary XHTML file is in %s: %s", tocFilename, tocContents)
+		}
+	}
+}
+
+func TestNcxDepth(t *testing.T) {
+	newTestEpub := func() *Epub {
+		e := NewEpub(testEpubTitle)
+		parentPath, _ := e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+		e.AddSubSection(parentPath, testSectionBody, "Subsection", "subsection.xhtml", "")
+		return e
+	}
+
+	readNcx := func(t *testing.T, e *Epub) (*tocNcxRoot, string) {
+		tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+		defer cleanup(testEpubFilename, tempDir)
+		contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, tocNcxFilename))
+		if err != nil {
+			t.Fatalf("Unexpected error reading NCX file: %s", err)
+		}
+		navContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+		if err != nil {
+			t.Fatalf("Unexpected error reading nav file: %s", err)
+		}
+		ncx := &tocNcxRoot{}
+		if err := xml.Unmarshal(contents, ncx); err != nil {
+			t.Fatalf("Unexpected error parsing NCX file: %s", err)
+		}
+		return ncx, string(navContents)
+	}
+	ncxMeta := func(ncx *tocNcxRoot, name string) string {
+		for _, meta := range ncx.Meta {
+			if meta.Name == name {
+				return meta.Content
+			}
+		}
+		return ""
+	}
+
+	e := newTestEpub()
+	ncx, _ := readNcx(t, e)
+	if got := ncxMeta(ncx, "dtb:uid"); got != e.Identifier() {
+		t.Errorf("dtb:uid = %q, expected %q", got, e.Identifier())
+	}
+	if got := ncxMeta(ncx, "dtb:depth"); got != "2" {
+		t.Errorf("dtb:depth = %q, expected 2", got)
+	}
+	if got := ncxMeta(ncx, "dtb:totalPageCount"); got != "0" {
+		t.Errorf("dtb:totalPageCount = %q, expected 0", got)
+	}
+	if len(ncx.NavMap) != 1 || ncx.NavMap[0].Children == nil || len(*ncx.NavMap[0].Children) != 1 {
+		t.Fatalf("Subsection isn't nested under its section in the NCX: %+v", ncx.NavMap)
+	}
+
+	e = newTestEpub()
+	e.SetNcxMaxDepth(1)
+	ncx, nav := readNcx(t, e)
+	if got := ncxMeta(ncx, "dtb:depth"); got != "1" {
+		t.Errorf("dtb:depth = %q, expected 1", got)
+	}
+	if len(ncx.NavMap) != 1 || ncx.NavMap[0].Children != nil {
+		t.Errorf("Subsection wasn't left out of the NCX: %+v", ncx.NavMap)
+	}
+	if !strings.Contains(nav, "subsection.xhtml") {
+		t.Errorf("Subsection was left out of the nav document: %s", nav)
+	}
+}
+
 func TestManifestItems(t *testing.T) {
 	fs := http.FileServer(http.Dir("./testdata/"))
 
@@ -794,7 +1755,7 @@ func TestManifestItems(t *testing.T) {
 	e := NewEpub(testEpubTitle)
 	e.AddImage(testImageFromFileSource, testImageFromFileFilename)
 	e.AddImage(testImageFromFileSource, "")
-	// In particular, we want to test these next two, which will be modified by fixXMLId()
+	// In particular, we want to test these next two, which will be modified by SanitizeXMLID()
 	e.AddImage(testImageFromFileSource, testNumberFilenameStart)
 	e.AddImage(testImageFromFileSource, testSpaceInFilename)
 	e.AddImage(testImageFromURLSource, "")
@@ -1113,40 +2074,16 @@ func unzipFile(sourceFilePath string, destDirPath string) error {
 
 // This function requires EPUBCheck to work; see README.md for more information
 func validateEpub(t testing.TB, epubFilename string) ([]byte, error) {
-	cwd, err := os.Getwd()
-	if err != nil {
-		t.Error("Error getting working directory")
-	}
-
-	items, err := ioutil.ReadDir(cwd)
-	if err != nil {
-		t.Error("Error getting contents of working directory")
-	}
-
-	pathToEpubcheck := ""
-	for _, i := range items {
-		if i.Name() == testEpubcheckJarfile {
-			pathToEpubcheck = i.Name()
-			break
-
-		} else if strings.HasPrefix(i.Name(), testEpubcheckPrefix) {
-			if i.Mode().IsDir() {
-				pathToEpubcheck = filepath.Join(i.Name(), testEpubcheckJarfile)
-				if _, err := os.Stat(pathToEpubcheck); err == nil {
-					break
-				} else {
-					pathToEpubcheck = ""
-				}
-			}
-		}
-	}
-
-	if pathToEpubcheck == "" {
+	pathToEpubcheck, err := epubcheck.FindJar(".")
+	if errors.Is(err, epubcheck.ErrNotFound) {
 		if testing.Verbose() {
 			fmt.Println("Epubcheck tool not installed, skipping EPUB validation.")
 		}
 		return nil, nil
 	}
+	if err != nil {
+		t.Error("Error getting contents of working directory")
+	}
 
 	cmd := exec.Command("java", "-jar", pathToEpubcheck, epubFilename)
 	return cmd.CombinedOutput()
@@ -0,0 +1,180 @@
+// Package epubcheck runs EPUBCheck (https://github.com/w3c/epubcheck), the
+// official EPUB validator, and parses its results, e.g. to validate the EPUBs
+// built by tests:
+//
+//	result, err := epubcheck.Run("My EPUB.epub")
+//	if errors.Is(err, epubcheck.ErrNotFound) {
+//		t.Skip("EPUBCheck not installed")
+//	}
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	if !result.Valid() {
+//		t.Errorf("Invalid EPUB: %v", result.Messages)
+//	}
+//
+// EPUBCheck requires Java.
+package epubcheck
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// JarFilename is the filename of the EPUBCheck jar file
+	JarFilename = "epubcheck.jar"
+	// Prefix of the directories EPUBCheck is extracted to, e.g. epubcheck-5.1.0
+	dirPrefix = "epubcheck"
+	// JarEnv is the environment variable Run reads the path of the EPUBCheck
+	// jar file from, if it's set
+	JarEnv = "EPUBCHECK_JAR"
+)
+
+// ErrNotFound is returned by FindJar and Run if the EPUBCheck jar file can't
+// be found.
+var ErrNotFound = errors.New("epubcheck: " + JarFilename + " not found")
+
+// Severities of the messages of EPUBCheck
+const (
+	SeverityFatal   = "FATAL"
+	SeverityError   = "ERROR"
+	SeverityWarning = "WARNING"
+	SeverityUsage   = "USAGE"
+	SeverityInfo    = "INFO"
+)
+
+// Result is the result of EPUBCheck for an EPUB, as reported by its JSON
+// output.
+type Result struct {
+	Checker  Checker   `json:"checker"`
+	Messages []Message `json:"messages"`
+}
+
+// Checker is the summary of a run of EPUBCheck.
+type Checker struct {
+	Path           string `json:"path"`           // The path of the EPUB checked
+	CheckerVersion string `json:"checkerVersion"` // The version of EPUBCheck, e.g. 5.1.0
+	NFatal         int    `json:"nFatal"`         // The number of fatal errors
+	NError         int    `json:"nError"`         // The number of errors
+	NWarning       int    `json:"nWarning"`       // The number of warnings
+	NUsage         int    `json:"nUsage"`         // The number of usage messages
+}
+
+// Message is a problem found by EPUBCheck.
+type Message struct {
+	ID         string     `json:"ID"`       // The ID of the check, e.g. RSC-005
+	Severity   string     `json:"severity"` // The severity, e.g. ERROR
+	Message    string     `json:"message"`
+	Suggestion string     `json:"suggestion"` // How to fix the problem, if any
+	Locations  []Location `json:"locations"`
+}
+
+// Location is the location of a problem found by EPUBCheck.
+type Location struct {
+	Path   string `json:"path"` // The path of the file inside the EPUB
+	Line   int    `json:"line"` // The line, starting at 1, or -1 if unknown
+	Column int    `json:"column"`
+}
+
+// String returns the message as EPUBCheck prints it, e.g.
+// ERROR(RSC-005): EPUB/package.opf(12,3): Error while parsing file
+func (m Message) String() string {
+	location := ""
+	if len(m.Locations) > 0 {
+		l := m.Locations[0]
+		location = l.Path
+		if l.Line > 0 {
+			location += fmt.Sprintf("(%d,%d)", l.Line, l.Column)
+		}
+		location += ": "
+	}
+	return fmt.Sprintf("%s(%s): %s%s", m.Severity, m.ID, location, m.Message)
+}
+
+// Valid returns whether EPUBCheck found no fatal error and no error.
+func (r *Result) Valid() bool {
+	return r.Checker.NFatal == 0 && r.Checker.NError == 0
+}
+
+// FindJar returns the path of the EPUBCheck jar file in the directory, or in
+// a subdirectory of the directory EPUBCheck was extracted to, e.g.
+// epubcheck-5.1.0/epubcheck.jar. ErrNotFound is returned if there's none.
+func FindJar(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.Name() == JarFilename && !entry.IsDir() {
+			return filepath.Join(dir, entry.Name()), nil
+		}
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), dirPrefix) {
+			jarPath := filepath.Join(dir, entry.Name(), JarFilename)
+			if _, err := os.Stat(jarPath); err == nil {
+				return jarPath, nil
+			}
+		}
+	}
+	return "", ErrNotFound
+}
+
+// Run runs EPUBCheck on the EPUB file at the path and returns its result. The
+// EPUBCheck jar file is the one set by the EPUBCHECK_JAR environment variable,
+// or else the one found by FindJar in the current directory.
+//
+// An error is only returned if EPUBCheck can't be run or its output can't be
+// parsed; see Result.Valid to know whether the EPUB is valid.
+func Run(path string) (*Result, error) {
+	jarPath := os.Getenv(JarEnv)
+	if jarPath == "" {
+		var err error
+		if jarPath, err = FindJar("."); err != nil {
+			return nil, err
+		}
+	}
+	return RunJar(jarPath, path)
+}
+
+// RunJar runs the EPUBCheck jar file at jarPath on the EPUB file at the path
+// and returns its result, see Run.
+func RunJar(jarPath string, path string) (*Result, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("java", "-jar", jarPath, path, "--json", "-")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// EPUBCheck exits with an error status if the EPUB is invalid, which is
+	// reported by the result
+	runErr := cmd.Run()
+	var exitErr *exec.ExitError
+	if runErr != nil && !errors.As(runErr, &exitErr) {
+		return nil, fmt.Errorf("epubcheck: unable to run EPUBCheck: %w", runErr)
+	}
+	result, err := parseResult(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("epubcheck: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return result, nil
+}
+
+// parseResult parses the JSON output of EPUBCheck, which may be preceded by
+// other messages
+func parseResult(output []byte) (*Result, error) {
+	start := bytes.IndexByte(output, '{')
+	if start == -1 {
+		return nil, errors.New("no result in the output of EPUBCheck")
+	}
+	var result Result
+	if err := json.Unmarshal(output[start:], &result); err != nil {
+		return nil, fmt.Errorf("unable to parse the output of EPUBCheck: %w", err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,96 @@
+package epubcheck
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindJar(t *testing.T) {
+	testCases := []struct {
+		name     string
+		files    []string
+		expected string
+	}{
+		{"jar", []string{JarFilename}, JarFilename},
+		{"extracted", []string{"epubcheck-5.1.0/" + JarFilename, "epubcheck-5.1.0/lib/other.jar"}, "epubcheck-5.1.0/" + JarFilename},
+		{"jar first", []string{"epubcheck-5.1.0/" + JarFilename, JarFilename}, JarFilename},
+		{"missing", []string{"epubcheck-5.1.0/README.txt", "other.jar"}, ""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, file := range testCase.files {
+				name := filepath.Join(dir, filepath.FromSlash(file))
+				if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(name, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			jarPath, err := FindJar(dir)
+			if testCase.expected == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("Got path %q and error %v, expected ErrNotFound", jarPath, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if expected := filepath.Join(dir, filepath.FromSlash(testCase.expected)); jarPath != expected {
+				t.Errorf("Got path %q, expected %q", jarPath, expected)
+			}
+		})
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	output := []byte(`Validating using EPUB version 3.3 rules.
+{
+  "customMessageFileName" : null,
+  "checker" : {
+    "path" : "My EPUB.epub",
+    "filename" : "My EPUB.epub",
+    "checkerVersion" : "5.1.0",
+    "nFatal" : 0,
+    "nError" : 1,
+    "nWarning" : 0,
+    "nUsage" : 0
+  },
+  "messages" : [ {
+    "ID" : "RSC-005",
+    "severity" : "ERROR",
+    "message" : "Error while parsing file: element \"foo\" not allowed here",
+    "additionalLocations" : 0,
+    "locations" : [ {
+      "path" : "EPUB/xhtml/section0001.xhtml",
+      "line" : 12,
+      "column" : 7,
+      "context" : null
+    } ],
+    "suggestion" : null
+  } ]
+}`)
+	result, err := parseResult(output)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result.Valid() {
+		t.Error("Expected the result to be invalid")
+	}
+	if result.Checker.CheckerVersion != "5.1.0" || len(result.Messages) != 1 {
+		t.Fatalf("Got result %+v, expected version 5.1.0 and one message", result)
+	}
+	expected := `ERROR(RSC-005): EPUB/xhtml/section0001.xhtml(12,7): Error while parsing file: element "foo" not allowed here`
+	if got := result.Messages[0].String(); got != expected {
+		t.Errorf("Got message %q, expected %q", got, expected)
+	}
+
+	if _, err := parseResult([]byte("java: command not found")); err == nil {
+		t.Error("Expected an error for output without a result")
+	}
+}
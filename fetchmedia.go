@@ -2,23 +2,135 @@ package epub
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"image"
+	// Registers the GIF format with the image package for validateImage
+	_ "image/gif"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/bmaupin/go-epub/internal/storage"
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/vincent-petithory/dataurl"
 )
 
+// FetchMode defines when the media added to an EPUB is retrieved.
+type FetchMode int
+
+const (
+	// FetchOnWrite checks that media exists when it's added (e.g. by AddImage)
+	// and retrieves it when the EPUB is written (default)
+	FetchOnWrite FetchMode = iota
+	// FetchEager retrieves media when it's added and keeps it in memory until
+	// the EPUB is written, so that media that disappears in between is still
+	// written
+	FetchEager
+	// FetchLazy doesn't check media when it's added, which saves a request for
+	// each remote media. Media that can't be retrieved is only reported when
+	// the EPUB is written.
+	FetchLazy
+)
+
+// supportedImageMediaTypes are the media types of the images supported by EPUB
+// readers, i.e. the image core media types of the EPUB spec
+var supportedImageMediaTypes = map[string]bool{
+	"image/gif":   true,
+	mediaTypeJpeg: true,
+	mediaTypePng:  true,
+	mediaTypeSvg:  true,
+	mediaTypeWebp: true,
+}
+
 // grabber is a top level structure that allows a custom http client.
 // if onlyChecl is true, the methods will not perform actual grab to spare memory and bandwidth
 type grabber struct {
 	*http.Client
+	// Headers and cookies added to every HTTP request
+	header  http.Header
+	cookies []*http.Cookie
+	// Remote media fetches shared by the grabber, nil if fetches aren't
+	// coalesced
+	fetches *fetchGroup
+	// Maximum duration of each retrieval of media, 0 means no limit
+	timeout time.Duration
+	// Cache of the media retrieved from URLs, nil if media isn't cached
+	cache MediaCache
+	// When media is retrieved
+	mode FetchMode
+	// The content of the media retrieved when it was added, by source
+	fetched map[string][]byte
+	// The charset of the Content-Type header of the responses to the requests
+	// for remote media, by source
+	charsets *sync.Map
+	// Maximum size of each media and of all the media retrieved, 0 means no
+	// limit
+	maxSize      int64
+	maxTotalSize int64
+	// Size of all the media retrieved by the grabber, nil if the total size
+	// isn't limited
+	totalSize *atomic.Int64
+	// Storage where the media is retrieved to when the EPUB is written
+	filesystem storage.Storage
+	// Function the warnings about the media added are reported to, nil if
+	// they're ignored
+	warn func(warningType WarningType, name string, format string, a ...interface{})
+	// Logger of the retrieval of the media, nil if nothing is logged
+	logger *slog.Logger
+	// How the filenames of the media added are sanitized
+	filenamePolicy FilenamePolicy
+	// File system the local media sources are read from, nil for the OS file
+	// system
+	sourceFS fs.FS
+}
+
+// grabber returns the grabber used to retrieve the media of the EPUB
+func (e *Epub) grabber() grabber {
+	header := e.header.Clone()
+	if e.userAgent != "" {
+		header.Set("User-Agent", e.userAgent)
+	}
+	if e.from != "" {
+		header.Set("From", e.from)
+	}
+	return grabber{
+		Client:  e.Client,
+		header:  header,
+		cookies: e.cookies,
+		timeout: e.fetchTimeout,
+		cache:   e.mediaCache,
+		mode:    e.fetchMode,
+		fetched: e.fetchedMedia,
+		maxSize: e.maxMediaSize,
+		// Media is stored in the storage of the EPUB
+		filesystem: e.filesystem,
+		warn:       e.addWarning,
+		logger:     e.logger,
+
+		filenamePolicy: e.filenamePolicy,
+		sourceFS:       e.sourceFS,
+
+		// Charsets are kept for the media retrieved when it was added
+		charsets: e.mediaCharsets,
+	}
+}
+
+// withTimeout returns a copy of ctx bounded by the timeout of the grabber
+func (g grabber) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if g.timeout > 0 {
+		return context.WithTimeout(ctx, g.timeout)
+	}
+	return context.WithCancel(ctx)
 }
 
 func detectMediaType(mediaSource string) string {
@@ -35,7 +147,7 @@ func detectMediaType(mediaSource string) string {
 
 func (g grabber) checkMedia(mediaSource string) error {
 	var fetchErrors []error // Declare fetchErrors variable
-	var f func(string, bool) (io.ReadCloser, error)
+	var f func(context.Context, string, bool) (io.ReadCloser, error)
 	switch detectMediaType(mediaSource) {
 	case "URL":
 		f = g.httpHandler
@@ -44,7 +156,9 @@ func (g grabber) checkMedia(mediaSource string) error {
 	default:
 		f = g.localHandler
 	}
-	source, err := f(mediaSource, true)
+	ctx, cancel := g.withTimeout(context.Background())
+	defer cancel()
+	source, err := f(ctx, mediaSource, true)
 	if err != nil {
 		fetchErrors = append(fetchErrors, err) // Capture the error
 	}
@@ -57,38 +171,90 @@ func (g grabber) checkMedia(mediaSource string) error {
 	return &FileRetrievalError{Source: mediaSource, Err: fetchError(fetchErrors)}
 }
 
+// retrieveAddedMedia checks or retrieves media as it's added to the EPUB,
+// depending on the fetch mode
+func (g grabber) retrieveAddedMedia(mediaSource string) error {
+	switch g.mode {
+	case FetchLazy:
+		return nil
+	case FetchEager:
+		// Data URLs are already in memory
+		if _, ok := g.fetched[mediaSource]; ok || detectMediaType(mediaSource) == "DataURL" {
+			return nil
+		}
+		data, err := g.readMedia(context.Background(), mediaSource)
+		if err != nil {
+			return err
+		}
+		g.fetched[mediaSource] = data
+		return nil
+	default:
+		return g.checkMedia(mediaSource)
+	}
+}
+
+// validateImage retrieves the image at mediaSource and makes sure that it's an
+// image in one of the formats supported by EPUB readers. Images in the formats
+// registered with the image package are decoded as well, which catches
+// truncated and corrupt images.
+func (g grabber) validateImage(mediaSource string) error {
+	data, err := g.readMedia(context.Background(), mediaSource)
+	if err != nil {
+		return err
+	}
+	mediaType := detectedMediaType(mimetype.Detect(data), mediaSource, "")
+	if err := checkMediaType(mediaSource, mediaType, ImageFolderName); err != nil {
+		return err
+	}
+	if !supportedImageMediaTypes[mediaType] {
+		return &FileRetrievalError{
+			Source: mediaSource,
+			Err: &UnexpectedMediaTypeError{
+				MediaType: mediaType,
+				Expected:  "a GIF, JPEG, PNG, SVG or WebP image",
+			},
+		}
+	}
+	if mediaType != mediaTypeSvg {
+		if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+			return &FileRetrievalError{Source: mediaSource, Err: err}
+		}
+	}
+	// The image isn't retrieved again if it's retrieved when it's added
+	if g.mode == FetchEager && detectMediaType(mediaSource) != "DataURL" {
+		g.fetched[mediaSource] = data
+	}
+	return nil
+}
+
 // fetchMedia from mediaSource into mediaFolderPath as mediaFilename returning its type.
 // the mediaSource can be a URL, a local path or an inline dataurl (as specified in RFC 2397)
-func (g grabber) fetchMedia(mediaSource, mediaFolderPath, mediaFilename string) (mediaType string, err error) {
+// ctx bounds the time spent retrieving remote media
+func (g grabber) fetchMedia(ctx context.Context, mediaSource, mediaFolderPath, mediaFilename string) (mediaType string, err error) {
+	if g.fetches != nil && detectMediaType(mediaSource) == "URL" {
+		return g.fetches.fetch(ctx, g, mediaSource, filepath.Join(mediaFolderPath, mediaFilename))
+	}
+	return g.fetchMediaOnce(ctx, mediaSource, mediaFolderPath, mediaFilename)
+}
+
+// fetchMediaOnce retrieves mediaSource without going through the fetch group
+func (g grabber) fetchMediaOnce(ctx context.Context, mediaSource, mediaFolderPath, mediaFilename string) (mediaType string, err error) {
+	ctx, cancel := g.withTimeout(ctx)
+	defer cancel()
 
 	mediaFilePath := filepath.Join(
 		mediaFolderPath,
 		mediaFilename,
 	)
 	// failfast, create the output file handler at the begining, if we cannot write the file, bail out
-	w, err := filesystem.Create(mediaFilePath)
+	w, err := g.filesystem.Create(mediaFilePath)
 	if err != nil {
 		return "", fmt.Errorf("unable to create file %s: %s", mediaFilePath, err)
 	}
 	defer w.Close()
-	var source io.ReadCloser
-	fetchErrors := make([]error, 0)
-	for _, f := range []func(string, bool) (io.ReadCloser, error){
-		g.localHandler,
-		g.httpHandler,
-		g.dataURLHandler,
-	} {
-		var err error
-		source, err = f(mediaSource, false)
-		if err != nil {
-			fetchErrors = append(fetchErrors, err)
-			continue
-		}
-		break
-	}
-	if source == nil {
-		return "", &FileRetrievalError{Source: mediaSource, Err: fetchError(fetchErrors)}
-
+	source, err := g.openMedia(ctx, mediaSource)
+	if err != nil {
+		return "", err
 	}
 	defer source.Close()
 
@@ -100,54 +266,237 @@ func (g grabber) fetchMedia(mediaSource, mediaFolderPath, mediaFilename string)
 	}
 
 	// Detect the mediaType
-	r, err := filesystem.Open(mediaFilePath)
+	r, err := g.filesystem.Open(mediaFilePath)
 	if err != nil {
-		return "", err
+		return "", &StorageError{Path: mediaFilePath, Err: err}
 	}
 	defer r.Close()
 	mime, err := mimetype.DetectReader(r)
 	if err != nil {
-		panic(err)
+		return "", &StorageError{Path: mediaFilePath, Err: err}
 	}
+	return detectedMediaType(mime, mediaSource, mediaFilename), nil
+}
 
+// detectedMediaType returns the media type of media detected as mime, fixing
+// the detection of the types that can't be told apart from their content
+func detectedMediaType(mime *mimetype.MIME, mediaSource string, mediaFilename string) string {
 	// Is it CSS?
 	mtype := mime.String()
 	if mime.Is("text/plain") {
-		if filepath.Ext(mediaSource) == ".css" || filepath.Ext(mediaFilename) == ".css" {
+		if filepath.Ext(mediaSource) == ".css" || filepath.Ext(mediaFilename) == ".css" || strings.HasPrefix(mediaSource, "data:"+mediaTypeCSS) {
 			mtype = "text/css"
 		}
 	}
-	return mtype, nil
+	// Is it SVG? The root element of SVG files with a long prolog (e.g.
+	// comments) isn't found by the detection
+	if mime.Is("text/xml") {
+		if filepath.Ext(mediaSource) == ".svg" || filepath.Ext(mediaFilename) == ".svg" || strings.HasPrefix(mediaSource, "data:"+mediaTypeSvg) {
+			mtype = mediaTypeSvg
+		}
+	}
+	return mtype
 }
 
-func (g grabber) httpHandler(mediaSource string, onlyCheck bool) (io.ReadCloser, error) {
-	var resp *http.Response
-	var err error
+// fetchMediaData retrieves mediaSource and returns its content and type. The
+// mediaFilename is the name of the file the media is stored as, which helps
+// detecting the type of some media.
+func (g grabber) fetchMediaData(ctx context.Context, mediaSource, mediaFilename string) ([]byte, string, error) {
+	data, err := g.readMedia(ctx, mediaSource)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, detectedMediaType(mimetype.Detect(data), mediaSource, mediaFilename), nil
+}
+
+// mediaSize returns the size of mediaSource if it's known without retrieving it,
+// i.e. unless it's a URL that was neither retrieved when it was added nor cached
+func (g grabber) mediaSize(mediaSource string) (int64, bool) {
+	if data, ok := g.fetched[mediaSource]; ok {
+		return int64(len(data)), true
+	}
+	switch detectMediaType(mediaSource) {
+	case "URL":
+		if g.cache != nil {
+			if cached, err := g.cache.Get(mediaSource); err == nil && cached != nil {
+				return int64(len(cached.Data)), true
+			}
+		}
+		return 0, false
+	case "DataURL":
+		data, err := dataurl.DecodeString(mediaSource)
+		if err != nil {
+			return 0, false
+		}
+		return int64(len(data.Data)), true
+	}
+	info, err := g.statLocal(mediaSource)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// openMedia opens mediaSource for reading, whether it's a URL, a local path or
+// an inline dataurl
+func (g grabber) openMedia(ctx context.Context, mediaSource string) (io.ReadCloser, error) {
+	// Media retrieved when it was added isn't retrieved again
+	if data, ok := g.fetched[mediaSource]; ok {
+		g.debug("using media retrieved when it was added", "source", loggedSource(mediaSource))
+		return g.limitSize(mediaSource, contextReadCloser{ctx: ctx, ReadCloser: ioutil.NopCloser(bytes.NewReader(data))}), nil
+	}
+	fetchErrors := make([]error, 0)
+	for _, f := range []func(context.Context, string, bool) (io.ReadCloser, error){
+		g.localHandler,
+		g.httpHandler,
+		g.dataURLHandler,
+	} {
+		source, err := f(ctx, mediaSource, false)
+		if err != nil {
+			fetchErrors = append(fetchErrors, err)
+			continue
+		}
+		g.debug("retrieving media", "source", loggedSource(mediaSource))
+		return g.limitSize(mediaSource, source), nil
+	}
+	g.debug("unable to retrieve media", "source", loggedSource(mediaSource), "error", fetchError(fetchErrors))
+	return nil, &FileRetrievalError{Source: mediaSource, Err: fetchError(fetchErrors)}
+}
+
+// readMedia returns the content of mediaSource
+func (g grabber) readMedia(ctx context.Context, mediaSource string) ([]byte, error) {
+	ctx, cancel := g.withTimeout(ctx)
+	defer cancel()
+	source, err := g.openMedia(ctx, mediaSource)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return nil, &FileRetrievalError{Source: mediaSource, Err: err}
+	}
+	return data, nil
+}
+
+func (g grabber) httpHandler(ctx context.Context, mediaSource string, onlyCheck bool) (io.ReadCloser, error) {
+	method := http.MethodGet
 	if onlyCheck {
-		resp, err = g.Head(mediaSource)
-	} else {
-		resp, err = g.Get(mediaSource)
+		method = http.MethodHead
 	}
+	req, err := http.NewRequestWithContext(ctx, method, mediaSource, nil)
 	if err != nil {
 		return nil, err
 	}
+	for key, values := range g.header {
+		req.Header[key] = values
+	}
+	for _, cookie := range g.cookies {
+		req.AddCookie(cookie)
+	}
+	// Cached media is only downloaded again if it changed. The cache is only
+	// an optimization, so errors accessing it are ignored.
+	var cached *CachedMedia
+	if g.cache != nil && !onlyCheck {
+		cached, _ = g.cache.Get(mediaSource)
+		if cached != nil {
+			if cached.ETag != "" {
+				req.Header.Set("If-None-Match", cached.ETag)
+			}
+			if cached.LastModified != "" {
+				req.Header.Set("If-Modified-Since", cached.LastModified)
+			}
+		}
+	}
+	g.debug("requesting remote media", "method", method, "url", mediaSource)
+	resp, err := g.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	g.debug("received remote media", "url", mediaSource, "status", resp.StatusCode)
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		g.debug("using cached media", "url", mediaSource)
+		resp.Body.Close()
+		g.storeMediaCharset(mediaSource, cached.ContentType)
+		return ioutil.NopCloser(bytes.NewReader(cached.Data)), nil
+	}
 	if resp.StatusCode > 400 {
+		resp.Body.Close()
 		return nil, errors.New("cannot get file, bad return code")
 	}
+	// Media that is known to be too large isn't downloaded at all
+	if g.maxSize > 0 && resp.ContentLength > g.maxSize {
+		resp.Body.Close()
+		return nil, &MediaTooLargeError{Source: mediaSource, Limit: g.maxSize}
+	}
+	if !onlyCheck {
+		g.storeMediaCharset(mediaSource, resp.Header.Get("Content-Type"))
+	}
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if g.cache != nil && !onlyCheck && (etag != "" || lastModified != "") {
+		defer resp.Body.Close()
+		body := io.Reader(resp.Body)
+		if g.maxSize > 0 {
+			body = io.LimitReader(resp.Body, g.maxSize+1)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		if g.maxSize > 0 && int64(len(data)) > g.maxSize {
+			return nil, &MediaTooLargeError{Source: mediaSource, Limit: g.maxSize}
+		}
+		_ = g.cache.Set(mediaSource, &CachedMedia{
+			Data:         data,
+			ETag:         etag,
+			LastModified: lastModified,
+			ContentType:  resp.Header.Get("Content-Type"),
+		})
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
 	return resp.Body, nil
 }
 
-func (g grabber) localHandler(mediaSource string, onlyCheck bool) (io.ReadCloser, error) {
+func (g grabber) localHandler(ctx context.Context, mediaSource string, onlyCheck bool) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if onlyCheck {
-		if _, err := os.Stat(mediaSource); os.IsNotExist(err) {
+		info, err := g.statLocal(mediaSource)
+		if errors.Is(err, fs.ErrNotExist) {
 			return nil, err
 		}
+		if err == nil && g.maxSize > 0 && info.Size() > g.maxSize {
+			return nil, &MediaTooLargeError{Source: mediaSource, Limit: g.maxSize}
+		}
 		return nil, nil
 	}
-	return os.Open(mediaSource)
+	var f io.ReadCloser
+	var err error
+	if g.sourceFS != nil {
+		f, err = g.sourceFS.Open(sourceFSPath(mediaSource))
+	} else {
+		f, err = os.Open(mediaSource)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return contextReadCloser{ctx: ctx, ReadCloser: f}, nil
+}
+
+// statLocal returns the information of the file of a local media source
+func (g grabber) statLocal(mediaSource string) (fs.FileInfo, error) {
+	if g.sourceFS != nil {
+		return fs.Stat(g.sourceFS, sourceFSPath(mediaSource))
+	}
+	return os.Stat(mediaSource)
 }
 
-func (g grabber) dataURLHandler(mediaSource string, onlyCheck bool) (io.ReadCloser, error) {
+func (g grabber) dataURLHandler(ctx context.Context, mediaSource string, onlyCheck bool) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if onlyCheck {
 		_, err := dataurl.DecodeString(mediaSource)
 		return nil, err
@@ -156,7 +505,128 @@ func (g grabber) dataURLHandler(mediaSource string, onlyCheck bool) (io.ReadClos
 	if err != nil {
 		return nil, err
 	}
-	return ioutil.NopCloser(bytes.NewReader(data.Data)), nil
+	return contextReadCloser{ctx: ctx, ReadCloser: ioutil.NopCloser(bytes.NewReader(data.Data))}, nil
+}
+
+// contextReadCloser is an io.ReadCloser that stops reading once its context is
+// done
+type contextReadCloser struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r contextReadCloser) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// limitSize returns a reader of the media read by r that fails with
+// MediaTooLargeError once the media exceeds the size limits of the grabber
+func (g grabber) limitSize(mediaSource string, r io.ReadCloser) io.ReadCloser {
+	if g.maxSize <= 0 && (g.maxTotalSize <= 0 || g.totalSize == nil) {
+		return r
+	}
+	return &sizeLimitedReadCloser{ReadCloser: r, g: g, source: mediaSource}
+}
+
+// sizeLimitedReadCloser is an io.ReadCloser that enforces the size limits of a
+// grabber
+type sizeLimitedReadCloser struct {
+	io.ReadCloser
+	g      grabber
+	source string
+	size   int64
+}
+
+func (r *sizeLimitedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.size += int64(n)
+	if r.g.maxSize > 0 && r.size > r.g.maxSize {
+		return n, &MediaTooLargeError{Source: r.source, Limit: r.g.maxSize}
+	}
+	if r.g.maxTotalSize > 0 && r.g.totalSize != nil && r.g.totalSize.Add(int64(n)) > r.g.maxTotalSize {
+		return n, &MediaTooLargeError{Source: r.source, Limit: r.g.maxTotalSize, Total: true}
+	}
+	return n, err
+}
+
+// fetchGroup coalesces the retrieval of remote media so that each URL is only
+// downloaded once, even when several fetches of the same URL are in flight at
+// the same time. The media is downloaded to the file of the first fetch, and
+// its content is kept for the others, since the file of the first fetch may be
+// changed afterwards, e.g. converted or replaced by a placeholder.
+type fetchGroup struct {
+	sync.Mutex
+	calls map[string]*fetchCall
+}
+
+// fetchCall is a fetch of a URL that is either in flight or done
+type fetchCall struct {
+	done      chan struct{}
+	data      []byte
+	mediaType string
+	err       error
+}
+
+// fetch retrieves the media at mediaURL into mediaFilePath and returns its
+// type, reusing the result of a previous or in-flight fetch of the same URL
+func (fg *fetchGroup) fetch(ctx context.Context, g grabber, mediaURL string, mediaFilePath string) (string, error) {
+	fg.Lock()
+	if fg.calls == nil {
+		fg.calls = make(map[string]*fetchCall)
+	}
+	if c, ok := fg.calls[mediaURL]; ok {
+		fg.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return "", &FileRetrievalError{Source: mediaURL, Err: ctx.Err()}
+		}
+		if c.err != nil {
+			return "", c.err
+		}
+		if err := g.filesystem.WriteFile(mediaFilePath, c.data, filePermissions); err != nil {
+			return "", &FileRetrievalError{Source: mediaURL, Err: err}
+		}
+		return c.mediaType, nil
+	}
+	c := &fetchCall{
+		done: make(chan struct{}),
+	}
+	fg.calls[mediaURL] = c
+	fg.Unlock()
+
+	c.mediaType, c.err = g.fetchMediaOnce(ctx, mediaURL, filepath.Dir(mediaFilePath), filepath.Base(mediaFilePath))
+	if c.err == nil {
+		// The media is read before the file can be changed by the caller
+		data, err := storage.ReadFile(g.filesystem, mediaFilePath)
+		if err != nil {
+			c.err = &FileRetrievalError{Source: mediaURL, Err: err}
+		}
+		c.data = data
+	}
+	close(c.done)
+	return c.mediaType, c.err
+}
+
+// copyStorageFile copies the file at srcPath to dstPath in the filesystem
+func copyStorageFile(filesystem storage.Storage, srcPath string, dstPath string) error {
+	r, err := filesystem.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := filesystem.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	_, err = io.Copy(w, r)
+	return err
 }
 
 type fetchError []error
@@ -168,3 +638,9 @@ func (f fetchError) Error() string {
 	}
 	return message
 }
+
+// Unwrap allows errors.Is and errors.As to find the errors of the handlers,
+// e.g. context.DeadlineExceeded if the retrieval timed out
+func (f fetchError) Unwrap() []error {
+	return f
+}
@@ -1,6 +1,10 @@
 package epub
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -9,7 +13,11 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/bmaupin/go-epub/internal/storage"
 )
 
 var golangFavicon = strings.Replace(`AAABAAEAEBAAAAEAIABoBAAAFgAAACgAAAAQAAAAIAAAAAEAIAAAAAAAAAAAAAAAAAAAAAAAAAAA
@@ -77,7 +85,7 @@ func testFetchMedia(t *testing.T) {
 			"URL request with test filename",
 			args{
 				mediaSource:     ts.URL + "/image.png",
-				mediaFolderPath: "/",
+				mediaFolderPath: ".",
 				mediaFilename:   "test",
 			},
 			"image/png",
@@ -87,7 +95,7 @@ func testFetchMedia(t *testing.T) {
 			"local file with test filename",
 			args{
 				mediaSource:     filepath.Join("testdata", filename),
-				mediaFolderPath: "/",
+				mediaFolderPath: ".",
 				mediaFilename:   "test",
 			},
 			"image/png",
@@ -97,7 +105,7 @@ func testFetchMedia(t *testing.T) {
 			"dataurl media with test filename",
 			args{
 				mediaSource:     `data:image/vnd.microsoft.icon;name=golang%20favicon;base64,` + golangFavicon,
-				mediaFolderPath: "/",
+				mediaFolderPath: ".",
 				mediaFilename:   "test",
 			},
 			"image/x-icon",
@@ -107,7 +115,7 @@ func testFetchMedia(t *testing.T) {
 			"bad request",
 			args{
 				mediaSource:     "badRequest",
-				mediaFolderPath: "/",
+				mediaFolderPath: ".",
 				mediaFilename:   "test",
 			},
 			"",
@@ -117,7 +125,7 @@ func testFetchMedia(t *testing.T) {
 			"empty filename",
 			args{
 				mediaSource:     "badRequest",
-				mediaFolderPath: "/",
+				mediaFolderPath: ".",
 				mediaFilename:   "",
 			},
 			"",
@@ -137,7 +145,7 @@ func testFetchMedia(t *testing.T) {
 			"CSS",
 			args{
 				mediaSource:     ts.URL + "/test.css",
-				mediaFolderPath: "/",
+				mediaFolderPath: ".",
 				mediaFilename:   "test.css",
 			},
 			"text/css",
@@ -147,7 +155,7 @@ func testFetchMedia(t *testing.T) {
 			"bad request",
 			args{
 				mediaSource:     ts.URL + "/nonexistent",
-				mediaFolderPath: "/",
+				mediaFolderPath: ".",
 				mediaFilename:   "test.css",
 			},
 			"",
@@ -156,8 +164,8 @@ func testFetchMedia(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			g := &grabber{http.DefaultClient}
-			gotMediaType, err := g.fetchMedia(tt.args.mediaSource, tt.args.mediaFolderPath, tt.args.mediaFilename)
+			g := &grabber{Client: http.DefaultClient, filesystem: filesystem}
+			gotMediaType, err := g.fetchMedia(context.Background(), tt.args.mediaSource, tt.args.mediaFolderPath, tt.args.mediaFilename)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("fetchMedia() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -175,3 +183,418 @@ func testFetchMedia(t *testing.T) {
 		})
 	}
 }
+
+func TestUserAgentAndFrom(t *testing.T) {
+	testUserAgent := "go-epub-test/1.0"
+	testFrom := "archive@example.com"
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.UserAgent() != testUserAgent {
+			t.Errorf("%s request User-Agent = %q, want %q", r.Method, r.UserAgent(), testUserAgent)
+		}
+		if r.Header.Get("From") != testFrom {
+			t.Errorf("%s request From = %q, want %q", r.Method, r.Header.Get("From"), testFrom)
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", "gophercolor16x16.png"))
+	}))
+	defer ts.Close()
+
+	e := NewEpub(testEpubTitle)
+	e.SetUserAgent(testUserAgent)
+	e.SetFrom(testFrom)
+	if _, err := e.AddImage(ts.URL+"/image.png", ""); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	if _, err := e.WriteTo(io.Discard); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	// One request to check the image and one to retrieve it
+	if requests != 2 {
+		t.Errorf("Got %d requests, expected 2", requests)
+	}
+}
+
+func TestHeaderAndCookie(t *testing.T) {
+	testReferer := "https://example.com/story"
+	testCookie := &http.Cookie{Name: "session", Value: "1234"}
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Referer() != testReferer {
+			t.Errorf("%s request Referer = %q, want %q", r.Method, r.Referer(), testReferer)
+		}
+		if r.Header.Get("X-Removed") != "" {
+			t.Errorf("%s request has removed header X-Removed", r.Method)
+		}
+		if cookie, err := r.Cookie(testCookie.Name); err != nil || cookie.Value != testCookie.Value {
+			t.Errorf("%s request cookie = %v, want %v", r.Method, cookie, testCookie)
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", "gophercolor16x16.png"))
+	}))
+	defer ts.Close()
+
+	e := NewEpub(testEpubTitle)
+	e.SetHeader("Referer", testReferer)
+	e.SetHeader("X-Removed", "value")
+	e.SetHeader("X-Removed", "")
+	e.AddCookie(testCookie)
+	if _, err := e.AddImage(ts.URL+"/image.png", ""); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	if _, err := e.WriteTo(io.Discard); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	// One request to check the image and one to retrieve it
+	if requests != 2 {
+		t.Errorf("Got %d requests, expected 2", requests)
+	}
+}
+
+func TestDuplicateURLFetchedOnce(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method]++
+		mu.Unlock()
+		http.ServeFile(w, r, filepath.Join("testdata", "gophercolor16x16.png"))
+	}))
+	defer ts.Close()
+	imageURL := ts.URL + "/image.png"
+
+	e := NewEpub(testEpubTitle)
+	imagePath, err := e.AddImage(imageURL, "")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	samePath, err := e.AddImage(imageURL, "")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	if samePath != imagePath {
+		t.Errorf("Adding the same URL twice returned %q and %q, expected the same path", imagePath, samePath)
+	}
+	if _, err := e.AddImage(imageURL, "copy.png"); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	// The image is checked when it's added under each filename but only
+	// retrieved once
+	if requests[http.MethodHead] != 2 {
+		t.Errorf("Got %d HEAD requests, expected 2", requests[http.MethodHead])
+	}
+	if requests[http.MethodGet] != 1 {
+		t.Errorf("Got %d GET requests, expected 1", requests[http.MethodGet])
+	}
+
+	testImageContents, err := os.ReadFile(filepath.Join("testdata", "gophercolor16x16.png"))
+	if err != nil {
+		t.Fatalf("Unexpected error reading testdata file: %s", err)
+	}
+	for _, imageFilename := range []string{"image.png", "copy.png"} {
+		contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, ImageFolderName, imageFilename))
+		if err != nil {
+			t.Fatalf("Unexpected error reading image file from EPUB: %s", err)
+		}
+		if !bytes.Equal(contents, testImageContents) {
+			t.Errorf("Image file %s contents don't match", imageFilename)
+		}
+	}
+}
+
+// Each use of media retrieved once gets the content that was retrieved, not
+// the one of the first use once it's been processed
+func TestDuplicateURLProcessedPerFile(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, testImageWebpSource)
+	}))
+	defer ts.Close()
+	imageURL := ts.URL + "/image.webp"
+
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddImage(imageURL, "converted.webp"); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	rawPath, err := e.AddImage(imageURL, "raw.webp")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	// Images whose media type is set aren't converted
+	if err := e.SetMediaType(rawPath, mediaTypeWebp); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e.SetConvertImages(true)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	testImageContents, err := os.ReadFile(testImageWebpSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading testdata file: %s", err)
+	}
+	contents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, ImageFolderName, "raw.webp"))
+	if err != nil {
+		t.Fatalf("Unexpected error reading image file from EPUB: %s", err)
+	}
+	if !bytes.Equal(contents, testImageContents) {
+		t.Error("Image file raw.webp contents don't match")
+	}
+	entries, err := fs.ReadDir(filesystem, filepath.Join(tempDir, contentFolderName, ImageFolderName))
+	if err != nil {
+		t.Fatalf("Unexpected error reading images: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Got %d images in the EPUB, expected the raw and the converted image", len(entries))
+	}
+}
+
+func TestFetchGroupCoalescesInFlightFetches(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		<-release
+		http.ServeFile(w, r, filepath.Join("testdata", "gophercolor16x16.png"))
+	}))
+	defer ts.Close()
+
+	g := grabber{Client: http.DefaultClient, fetches: &fetchGroup{}, filesystem: filesystem}
+
+	const fetches = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, fetches)
+	for i := 0; i < fetches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := g.fetchMedia(context.Background(), ts.URL+"/image.png", ".", fmt.Sprintf("fetchgroup%d.png", i))
+			errs <- err
+		}(i)
+	}
+	// Let the fetches reach the server or the fetch group before answering
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Unexpected error fetching media: %s", err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Got %d requests, expected 1", requests)
+	}
+	for i := 0; i < fetches; i++ {
+		fetchedFilePath := filepath.Join(".", fmt.Sprintf("fetchgroup%d.png", i))
+		if _, err := storage.ReadFile(filesystem, fetchedFilePath); err != nil {
+			t.Errorf("Fetched file is missing: %s", err)
+		}
+		filesystem.RemoveAll(fetchedFilePath)
+	}
+}
+
+func TestHandlersHonorCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	g := NewEpub(testEpubTitle).grabber()
+	for name, tt := range map[string]struct {
+		handler func(context.Context, string, bool) (io.ReadCloser, error)
+		source  string
+	}{
+		"local":   {g.localHandler, testImageFromFileSource},
+		"dataurl": {g.dataURLHandler, "data:image/vnd.microsoft.icon;name=golang%20favicon;base64," + golangFavicon},
+	} {
+		if _, err := tt.handler(ctx, tt.source, false); err != context.Canceled {
+			t.Errorf("%s handler: expected error context.Canceled, got %v", name, err)
+		}
+	}
+
+	// Reading stops once the context is done
+	ctx, cancel = context.WithCancel(context.Background())
+	source, err := g.localHandler(ctx, testImageFromFileSource, false)
+	if err != nil {
+		t.Fatalf("Unexpected error opening %s: %s", testImageFromFileSource, err)
+	}
+	defer source.Close()
+	cancel()
+	if _, err := io.ReadAll(source); err != context.Canceled {
+		t.Errorf("Expected error context.Canceled reading %s, got %v", testImageFromFileSource, err)
+	}
+}
+
+func TestSetFetchMode(t *testing.T) {
+	testImage, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Error reading image: %s", err)
+	}
+
+	tests := []struct {
+		name          string
+		mode          FetchMode
+		wantWriteErr  bool
+		wantRetrieved bool
+	}{
+		{"OnWrite", FetchOnWrite, true, false},
+		{"Eager", FetchEager, false, true},
+		{"Lazy", FetchLazy, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The image disappears between the time it's added and the time the
+			// EPUB is written
+			imagePath := filepath.Join(t.TempDir(), "image.png")
+			if err := os.WriteFile(imagePath, testImage, 0644); err != nil {
+				t.Fatalf("Error writing image: %s", err)
+			}
+
+			e := NewEpub(testEpubTitle)
+			e.SetFetchMode(tt.mode)
+			imageInternalPath, err := e.AddImage(imagePath, "")
+			if err != nil {
+				t.Fatalf("Error adding image: %s", err)
+			}
+			if _, ok := e.fetchedMedia[imagePath]; ok != tt.wantRetrieved {
+				t.Errorf("Image retrieved when added: %v, expected %v", ok, tt.wantRetrieved)
+			}
+			if err := os.Remove(imagePath); err != nil {
+				t.Fatalf("Error removing image: %s", err)
+			}
+
+			var b bytes.Buffer
+			_, err = e.WriteTo(&b)
+			if (err != nil) != tt.wantWriteErr {
+				t.Fatalf("WriteTo() error = %v, wantWriteErr %v", err, tt.wantWriteErr)
+			}
+			if err != nil {
+				return
+			}
+			r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+			if err != nil {
+				t.Fatalf("Unexpected error reading EPUB: %s", err)
+			}
+			rc, err := r.Open(contentFolderName + "/" + strings.TrimPrefix(imageInternalPath, "../"))
+			if err != nil {
+				t.Fatalf("Unexpected error opening image: %s", err)
+			}
+			defer rc.Close()
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("Unexpected error reading image: %s", err)
+			}
+			if !bytes.Equal(got, testImage) {
+				t.Error("Image retrieved when added doesn't match its source")
+			}
+		})
+	}
+
+	t.Run("Missing", func(t *testing.T) {
+		for _, mode := range []FetchMode{FetchOnWrite, FetchEager} {
+			e := NewEpub(testEpubTitle)
+			e.SetFetchMode(mode)
+			if _, err := e.AddImage("testdata/missing.png", ""); err == nil {
+				t.Errorf("Expected error adding missing image with fetch mode %d", mode)
+			}
+		}
+		e := NewEpub(testEpubTitle)
+		e.SetFetchMode(FetchLazy)
+		if _, err := e.AddImage("testdata/missing.png", ""); err != nil {
+			t.Errorf("Unexpected error adding missing image with lazy fetch mode: %s", err)
+		}
+	})
+}
+
+func TestSetMediaSizeLimits(t *testing.T) {
+	testImage, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Error reading image: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, testImageFromFileSource)
+	})
+	mux.HandleFunc("/chunked.png", func(w http.ResponseWriter, r *http.Request) {
+		// The size of the image is only known once it's downloaded
+		w.Header().Set("Content-Type", "image/png")
+		if r.Method == http.MethodGet {
+			w.Write(testImage[:10])
+			w.(http.Flusher).Flush()
+			w.Write(testImage[10:])
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tooLarge := func(t *testing.T, err error, wantTotal bool) {
+		t.Helper()
+		var sizeErr *MediaTooLargeError
+		if !errors.As(err, &sizeErr) {
+			t.Fatalf("Expected error MediaTooLargeError not returned. Returned instead: %+v", err)
+		}
+		if sizeErr.Total != wantTotal {
+			t.Errorf("Got MediaTooLargeError with Total %v, expected %v", sizeErr.Total, wantTotal)
+		}
+	}
+
+	t.Run("Add", func(t *testing.T) {
+		for _, source := range []string{testImageFromFileSource, server.URL + "/image.png"} {
+			e := NewEpub(testEpubTitle)
+			e.SetMediaSizeLimits(int64(len(testImage))-1, 0)
+			_, err := e.AddImage(source, "")
+			tooLarge(t, err, false)
+		}
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		e := NewEpub(testEpubTitle)
+		e.SetMediaSizeLimits(int64(len(testImage))-1, 0)
+		if _, err := e.AddImage(server.URL+"/chunked.png", ""); err != nil {
+			t.Fatalf("Error adding image: %s", err)
+		}
+		_, err := e.WriteTo(io.Discard)
+		tooLarge(t, err, false)
+	})
+
+	t.Run("Total", func(t *testing.T) {
+		for _, policy := range []MediaFailurePolicy{MediaFailureError, MediaFailureSkip} {
+			e := NewEpub(testEpubTitle)
+			e.SetMediaSizeLimits(0, int64(len(testImage))*3/2)
+			e.SetMediaFailurePolicy(policy)
+			for _, filename := range []string{"image1.png", "image2.png"} {
+				if _, err := e.AddImage(testImageFromFileSource, filename); err != nil {
+					t.Fatalf("Error adding image: %s", err)
+				}
+			}
+			var b bytes.Buffer
+			_, err := e.WriteTo(&b)
+			if policy == MediaFailureError {
+				tooLarge(t, err, true)
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error writing EPUB: %s", err)
+			}
+			r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+			if err != nil {
+				t.Fatalf("Unexpected error reading EPUB: %s", err)
+			}
+			images := 0
+			for _, f := range r.File {
+				if strings.HasPrefix(f.Name, contentFolderName+"/"+ImageFolderName+"/") {
+					images++
+				}
+			}
+			if images != 1 {
+				t.Errorf("Got %d images in the EPUB, expected 1", images)
+			}
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package epub
+
+import (
+	"fmt"
+	"html"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Label inserted at the start of the caption of a numbered figure or table,
+	// e.g. "Figure 3. "
+	figureLabelFormat = "%s %d. "
+	// Link replacing a cross-reference, labeled by the number of the figure or
+	// table
+	figureRefFormat = `<a href="%s">%d</a>`
+	// Figure added to the end of a section by AddFigure
+	figureFormat = `<figure id="%s"><img src="%s" alt="%s" />%s</figure>
+`
+	figureCaptionFormat = "<figcaption>%s</figcaption>"
+	figureIDFormat      = "figure%04d"
+)
+
+var (
+	// Opening and closing tags of the figures, tables and their captions
+	figureTagRegexp = regexp.MustCompile(`<(/?)(figure|table|figcaption|caption)(?:\s[^>]*)?>`)
+	// Cross-reference to a figure or table, e.g. {ref:architecture}
+	figureRefRegexp = regexp.MustCompile(`\{ref:([^{}\s]+)\}`)
+)
+
+// figureNumber is the number of a figure or table and the filename of the
+// section it's in
+type figureNumber struct {
+	filename string
+	number   int
+}
+
+// figureNumbering is the numbering of the figures and tables of the EPUB
+// being written
+type figureNumbering struct {
+	labels map[string]string // The key is the element, figure or table
+	// The number of figures and tables before each section, the key is the
+	// filename of the section
+	start map[string][2]int
+	// The key is the ID of a figure or table
+	ids map[string]figureNumber
+}
+
+// SetFigureNumbering numbers the figures and tables of the sections when the
+// EPUB is written, across sections in reading order, and resolves their
+// cross-references. The label of a figure is added to the start of its
+// caption, e.g. "Figure 3. ", and likewise for tables. An empty label leaves
+// the figures or tables unnumbered; both labels are empty by default.
+//
+// Only figures with a <figcaption> element and tables with a <caption> element
+// are numbered. A cross-reference is a placeholder in the body of a section
+// with the ID of a figure or table, e.g. "see Figure {ref:architecture}", that
+// is replaced by a link to the figure labeled with its number. Placeholders
+// that don't match a numbered figure or table are left as is and a warning is
+// added (see Warnings).
+//
+// The sections themselves aren't changed.
+func (e *Epub) SetFigureNumbering(figureLabel string, tableLabel string) {
+	e.Lock()
+	defer e.Unlock()
+	e.figureLabel = figureLabel
+	e.tableLabel = tableLabel
+}
+
+// AddFigure adds a figure with an image to the end of the body of the section
+// with the internal filename and returns the ID of the figure, which can be
+// used in links and cross-references (see SetFigureNumbering). The figure is a
+// <figure> element with the image and a <figcaption> element with the caption.
+//
+// The image is either a relative path to an image returned by AddImage, or a
+// source added to the EPUB as with AddImage, with a generated filename. The
+// caption must be valid XHTML. It will not be validated. An empty caption
+// leaves out the <figcaption> element. The alternative text of the image is
+// plain text.
+//
+// If no section with the internal filename exists, SectionDoesNotExistError
+// will be returned. The same errors as AddImage are returned.
+func (e *Epub) AddFigure(sectionFilename string, imagePath string, caption string, alt string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	s := e.findSection(sectionFilename)
+	if s == nil {
+		return "", &SectionDoesNotExistError{Filename: sectionFilename}
+	}
+	if !e.hasImage(imagePath) {
+		var err error
+		imagePath, err = e.addImage(imagePath, "")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	e.figures++
+	id := fmt.Sprintf(figureIDFormat, e.figures)
+	figcaption := ""
+	if caption != "" {
+		figcaption = fmt.Sprintf(figureCaptionFormat, caption)
+	}
+	s.xhtml.xml.Body.XML += fmt.Sprintf(figureFormat, id, html.EscapeString(imagePath), html.EscapeString(alt), figcaption)
+	return id, nil
+}
+
+// hasImage returns whether the path is the relative path to an image of the
+// EPUB, as returned by AddImage
+func (e *Epub) hasImage(imagePath string) bool {
+	dir, filename := path.Split(imagePath)
+	_, ok := e.images[filename]
+	return ok && dir == "../"+ImageFolderName+"/"
+}
+
+// newFigureNumbering numbers the figures and tables of the sections
+func (e *Epub) newFigureNumbering() *figureNumbering {
+	n := &figureNumbering{
+		labels: map[string]string{"figure": e.figureLabel, "table": e.tableLabel},
+		start:  make(map[string][2]int),
+		ids:    make(map[string]figureNumber),
+	}
+	var counts [2]int
+	e.forEachSection(func(s *epubSection) {
+		n.start[s.filename] = counts
+		_, counts = n.number(s.xhtml.xml.Body.XML, s.filename, counts)
+	})
+	return n
+}
+
+// number numbers the figures and tables of the content of a section, given
+// the number of figures and tables before it, and returns the content with the
+// labels added to the captions and the number of figures and tables after it
+func (n *figureNumbering) number(content string, filename string, counts [2]int) (string, [2]int) {
+	// The figures and tables the tags are in, innermost last
+	var open []string
+	var ids []string
+	var numbered strings.Builder
+	last := 0
+	for _, m := range figureTagRegexp.FindAllStringSubmatchIndex(content, -1) {
+		closing := content[m[2]:m[3]] == "/"
+		element := content[m[4]:m[5]]
+		switch {
+		case (element == "figure" || element == "table") && closing:
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+				ids = ids[:len(ids)-1]
+			}
+		case element == "figure" || element == "table":
+			open = append(open, element)
+			ids = append(ids, html.UnescapeString(getAttribute(content[m[0]:m[1]], "id")))
+		case closing || len(open) == 0:
+		case element == "figcaption" && open[len(open)-1] == "figure",
+			element == "caption" && open[len(open)-1] == "table":
+			label := n.labels[open[len(open)-1]]
+			if label == "" {
+				continue
+			}
+			i := 0
+			if open[len(open)-1] == "table" {
+				i = 1
+			}
+			counts[i]++
+			if id := ids[len(ids)-1]; id != "" {
+				n.ids[id] = figureNumber{filename: filename, number: counts[i]}
+			}
+			numbered.WriteString(content[last:m[1]])
+			numbered.WriteString(html.EscapeString(fmt.Sprintf(figureLabelFormat, label, counts[i])))
+			last = m[1]
+		}
+	}
+	numbered.WriteString(content[last:])
+	return numbered.String(), counts
+}
+
+// figureNumberingFileWriter returns an epubFileWriter that numbers the figures
+// and tables of the sections and resolves their cross-references
+func (e *Epub) figureNumberingFileWriter(w epubFileWriter) epubFileWriter {
+	n := e.newFigureNumbering()
+	return func(name string, mediaType string, content []byte) error {
+		dir, filename := path.Split(name)
+		counts, ok := n.start[filename]
+		if mediaType != mediaTypeXhtml || dir != path.Join(contentFolderName, xhtmlFolderName)+"/" || !ok {
+			return w(name, mediaType, content)
+		}
+		numbered, _ := n.number(string(content), filename, counts)
+		numbered = figureRefRegexp.ReplaceAllStringFunc(numbered, func(ref string) string {
+			id := html.UnescapeString(figureRefRegexp.FindStringSubmatch(ref)[1])
+			target, ok := n.ids[id]
+			if !ok {
+				e.addWarning(WarningUnresolvedReference, name, "no numbered figure or table with ID %s", id)
+				return ref
+			}
+			return fmt.Sprintf(figureRefFormat, html.EscapeString(target.filename+"#"+id), target.number)
+		})
+		return w(name, mediaType, []byte(numbered))
+	}
+}
@@ -0,0 +1,137 @@
+package epub
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSetFigureNumbering(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	first, err := e.AddSection(`<p>See Figure {ref:diagram}, Figure {ref:chart} and Table {ref:results}.</p>
+<figure id="diagram"><figcaption>Diagram</figcaption></figure>
+<figure><p>Figure without a caption</p></figure>`, testSectionTitle, "first.xhtml", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection(`<table id="results"><caption class="caption">Results</caption><tr><td>1</td></tr></table>
+<figure id="chart"><figcaption>Chart</figcaption></figure>
+<p>See {ref:missing}.</p>`, testSectionTitle, "second.xhtml", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e.SetFigureNumbering("Figure", "Table")
+
+	r := newTestReader(t, e)
+	content, err := r.ReadFile("EPUB/xhtml/first.xhtml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`<p>See Figure <a href="first.xhtml#diagram">1</a>, Figure <a href="second.xhtml#chart">2</a> and Table <a href="second.xhtml#results">1</a>.</p>`,
+		`<figure id="diagram"><figcaption>Figure 1. Diagram</figcaption></figure>`,
+		`<figure><p>Figure without a caption</p></figure>`,
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("First section doesn't contain %s:\n%s", expected, content)
+		}
+	}
+	content, err = r.ReadFile("EPUB/xhtml/second.xhtml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`<caption class="caption">Table 1. Results</caption>`,
+		`<figcaption>Figure 2. Chart</figcaption>`,
+		`<p>See {ref:missing}.</p>`,
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("Second section doesn't contain %s:\n%s", expected, content)
+		}
+	}
+
+	warnings := e.Warnings()
+	if len(warnings) != 1 || warnings[0].Type != WarningUnresolvedReference || warnings[0].Path != "EPUB/xhtml/second.xhtml" {
+		t.Errorf("Unexpected warnings: %+v", warnings)
+	}
+
+	// The sections themselves aren't changed
+	e.SetFigureNumbering("", "Table")
+	r = newTestReader(t, e)
+	content, err = r.ReadFile("EPUB/xhtml/" + first)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`<p>See Figure {ref:diagram}, Figure {ref:chart} and Table <a href="second.xhtml#results">1</a>.</p>`,
+		`<figcaption>Diagram</figcaption>`,
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("First section doesn't contain %s:\n%s", expected, content)
+		}
+	}
+}
+
+func TestAddFigure(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	section, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	imagePath, err := e.AddImage(testImageFromFileSource, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	first, err := e.AddFigure(section, imagePath, "The <em>Go</em> gopher", "Gopher & friends")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The image is added from the source
+	second, err := e.AddFigure(section, testImageFromFileSource, "", "Gopher")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection("<p>See Figure {ref:"+first+"}.</p>", testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e.SetFigureNumbering("Figure", "")
+
+	r := newTestReader(t, e)
+	content, err := r.ReadFile("EPUB/xhtml/" + section)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`<figure id="` + first + `"><img src="` + imagePath + `" alt="Gopher &amp; friends" /><figcaption>Figure 1. The <em>Go</em> gopher</figcaption></figure>`,
+		`<figure id="` + second + `"><img src="../images/image0002.png" alt="Gopher" /></figure>`,
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("Section doesn't contain %s:\n%s", expected, content)
+		}
+	}
+	if _, err := r.ReadFile("EPUB/images/image0002.png"); err != nil {
+		t.Errorf("Image of the figure not added: %s", err)
+	}
+
+	findings, err := e.Validate()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("Unexpected findings: %+v", findings)
+	}
+}
+
+func TestAddFigureErrors(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	var sectionErr *SectionDoesNotExistError
+	if _, err := e.AddFigure("missing.xhtml", testImageFromFileSource, "", ""); !errors.As(err, &sectionErr) {
+		t.Errorf("Expected SectionDoesNotExistError, got %v", err)
+	}
+	section, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddFigure(section, "testdata/missing.png", "", ""); err == nil {
+		t.Error("Expected an error for a missing image")
+	}
+}
@@ -0,0 +1,219 @@
+package epub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// FilenamePolicy defines how the internal filenames of the media and the
+// sections are sanitized (see SetFilenamePolicy).
+type FilenamePolicy int
+
+const (
+	// FilenameKeep keeps the internal filenames as they are (default). The
+	// filenames of the sources are only replaced by generated ones when they
+	// can't be used at all (see SafeInternalFilename).
+	FilenameKeep FilenamePolicy = iota
+	// FilenameTransliterate replaces the letters with diacritics and the
+	// compatibility characters (e.g. fullwidth letters) with their ASCII
+	// equivalent, e.g. "Café № 1.png" becomes "Cafe_No_1.png", and the other
+	// characters that aren't letters, digits, dots, hyphens or underscores
+	// with underscores
+	FilenameTransliterate
+	// FilenameStrip removes the characters that aren't ASCII letters, digits,
+	// dots, hyphens or underscores, e.g. "Café № 1.png" becomes "Caf1.png"
+	FilenameStrip
+	// FilenameHash replaces the filename with a hash of it, keeping the
+	// extension, e.g. "Café № 1.png" becomes "8c53d4903da92b15.png"
+	FilenameHash
+)
+
+const (
+	// Maximum length of an internal filename
+	maxFilenameLength = 255
+	// Maximum length of the filenames sanitized by a filename policy, since
+	// some reading systems fail to open files with long paths
+	maxSanitizedFilenameLength = 64
+	// Maximum length of the extensions kept by a filename policy
+	maxSanitizedExtensionLength = 8
+	// Number of hexadecimal digits of the hashes used by FilenameHash
+	filenameHashLength = 16
+)
+
+// SanitizeXMLID takes a string and returns an XML id compatible string. This is
+// how the IDs of the manifest items are derived from internal filenames.
+// https://www.w3.org/TR/REC-xml-names/#NT-NCName
+// This means it must not contain a colon (:) or whitespace and it must not
+// start with a digit, punctuation or diacritics. An empty string is returned as
+// is.
+func SanitizeXMLID(id string) string {
+	fixedId := []rune{}
+	for i := 0; len(id) > 0; i++ {
+		r, size := utf8.DecodeRuneInString(id)
+		if i == 0 {
+			// The new id should be prefixed with 'id' if an invalid
+			// starting character is found
+			// this is not 100% accurate, but a better check than no check
+			if unicode.IsNumber(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+				fixedId = append(fixedId, []rune("id")...)
+			}
+		}
+		if !unicode.IsSpace(r) && r != ':' {
+			fixedId = append(fixedId, r)
+		}
+		id = id[size:]
+	}
+	return string(fixedId)
+}
+
+// SafeInternalFilename returns the internal filename that AddCSS, AddFont,
+// AddImage, AddVideo or AddAudio use for a file added from source without an
+// internal filename, which is the filename of the source. An empty string is
+// returned if the filename of the source can't be used (e.g. because it's too
+// long, invalid or the source is a data URL), in which case a filename will be
+// generated instead.
+//
+// The returned filename may still be replaced by a generated one if it's already
+// used by another file of the same type.
+//
+// The filename of the source is used as is; see SanitizeFilename to make it
+// safe to use in URLs.
+func SafeInternalFilename(source string) string {
+	if detectMediaType(source) == "DataURL" {
+		return ""
+	}
+	filename := filepath.Base(source)
+	if len(filename) > maxFilenameLength || !fs.ValidPath(filename) {
+		return ""
+	}
+	return filename
+}
+
+// SanitizeFilename returns the filename sanitized according to the policy, as
+// done by AddSection and by the methods adding media when a filename policy is
+// set (see SetFilenamePolicy). Sanitized filenames are at most 64 bytes long,
+// extension included, and only contain ASCII letters, digits, dots, hyphens and
+// underscores. Filenames that would end up empty are hashed instead. An empty
+// filename is returned as is.
+func SanitizeFilename(filename string, policy FilenamePolicy) string {
+	if filename == "" || policy == FilenameKeep {
+		return filename
+	}
+
+	ext := path.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	ext = strings.ToLower(ext)
+	if !isSanitizedExtension(ext) {
+		// Not an extension, e.g. "v1.2 (final)"
+		base, ext = filename, ""
+	}
+
+	switch policy {
+	case FilenameTransliterate:
+		base = transliterateFilename(base)
+	case FilenameStrip:
+		base = strings.Map(func(r rune) rune {
+			if isSafeFilenameRune(r) {
+				return r
+			}
+			return -1
+		}, base)
+	}
+	// Hidden files and trailing separators are avoided
+	base = strings.Trim(base, "._-")
+
+	if policy == FilenameHash || base == "" {
+		hash := sha256.Sum256([]byte(filename))
+		base = hex.EncodeToString(hash[:])[:filenameHashLength]
+	}
+	if len(base)+len(ext) > maxSanitizedFilenameLength {
+		base = strings.TrimRight(base[:maxSanitizedFilenameLength-len(ext)], "._-")
+	}
+	return base + ext
+}
+
+// transliterateFilename replaces the characters of the filename that aren't
+// safe with their ASCII equivalent when there's one, or else with underscores
+func transliterateFilename(filename string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(filename) {
+		switch {
+		case isSafeFilenameRune(r):
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+			// Diacritics separated from their letter by the decomposition
+		case !strings.HasSuffix(b.String(), "_"):
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// isSanitizedExtension returns whether the extension, including its dot, can
+// be kept as is by a filename policy
+func isSanitizedExtension(ext string) bool {
+	if len(ext) > maxSanitizedExtensionLength {
+		return false
+	}
+	for _, r := range strings.TrimPrefix(ext, ".") {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// isSafeFilenameRune returns whether the character can be used as is in the
+// filenames sanitized by a filename policy
+func isSafeFilenameRune(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_'
+}
+
+// sourceFilename returns the filename of the source sanitized according to the
+// policy, or an empty string if the source has no filename (e.g. a data URL)
+func sourceFilename(source string, policy FilenamePolicy) string {
+	if policy == FilenameKeep {
+		return SafeInternalFilename(source)
+	}
+	switch detectMediaType(source) {
+	case "DataURL":
+		return ""
+	case "URL":
+		// The query and the fragment aren't part of the filename
+		u, err := url.Parse(source)
+		if err != nil {
+			return ""
+		}
+		source = u.Path
+	}
+	filename := filepath.Base(filepath.FromSlash(source))
+	if filename == "." || filename == string(filepath.Separator) {
+		return ""
+	}
+	return SanitizeFilename(filename, policy)
+}
+
+// uniqueFilename returns the filename, or if it's already used, the filename
+// with the first number that makes it unique, e.g. image-2.png
+func uniqueFilename(filename string, used func(filename string) bool) string {
+	if !used(filename) {
+		return filename
+	}
+	ext := path.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for i := 2; ; i++ {
+		if candidate := fmt.Sprintf("%s-%d%s", base, i, ext); !used(candidate) {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package epub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeXMLID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"image.png", "image.png"},
+		{"01filenametest.png", "id01filenametest.png"},
+		{"filename with space.png", "filenamewithspace.png"},
+		{"name:with:colons", "namewithcolons"},
+		{"_underscore", "id_underscore"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := SanitizeXMLID(tt.id); got != tt.want {
+			t.Errorf("SanitizeXMLID(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestSafeInternalFilename(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"testdata/gophercolor16x16.png", "gophercolor16x16.png"},
+		{"https://example.com/images/cover.jpg", "cover.jpg"},
+		{"data:text/plain;base64,SGVsbG8=", ""},
+		{"/", ""},
+		{string(make([]byte, 256)), ""},
+	}
+	for _, tt := range tests {
+		if got := SafeInternalFilename(tt.source); got != tt.want {
+			t.Errorf("SafeInternalFilename(%q) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	long := strings.Repeat("a", 100) + ".png"
+	tests := []struct {
+		filename string
+		policy   FilenamePolicy
+		want     string
+	}{
+		{"Café № 1.png", FilenameKeep, "Café № 1.png"},
+		{"Café № 1.png", FilenameTransliterate, "Cafe_No_1.png"},
+		{"Café № 1.png", FilenameStrip, "Caf1.png"},
+		{"Café № 1.png", FilenameHash, "8c53d4903da92b15.png"},
+		{"ｆｕｌｌｗｉｄｔｈ.PNG", FilenameTransliterate, "fullwidth.png"},
+		{"100%#1?.jpg", FilenameTransliterate, "100_1.jpg"},
+		{"chapter 1 (final)", FilenameTransliterate, "chapter_1_final"},
+		{".hidden.css", FilenameStrip, "hidden.css"},
+		{"日本語.xhtml", FilenameTransliterate, "d021cbf7d33d2291.xhtml"},
+		{long, FilenameStrip, strings.Repeat("a", 60) + ".png"},
+		{"", FilenameHash, ""},
+	}
+	for _, tt := range tests {
+		if got := SanitizeFilename(tt.filename, tt.policy); got != tt.want {
+			t.Errorf("SanitizeFilename(%q, %d) = %q, want %q", tt.filename, tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestSetFilenamePolicy(t *testing.T) {
+	image, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Error reading test image: %s", err)
+	}
+	tempDir := t.TempDir()
+	imagePath := filepath.Join(tempDir, "gopher #1.png")
+	if err := os.WriteFile(imagePath, image, 0644); err != nil {
+		t.Fatalf("Error writing test image: %s", err)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(tempDir)))
+	defer server.Close()
+
+	e := NewEpub(testEpubTitle)
+	e.SetFilenamePolicy(FilenameTransliterate)
+
+	testCases := []struct {
+		source           string
+		internalFilename string
+		expectedPath     string
+	}{
+		{server.URL + "/gopher%20%231.png?size=16", "", "../images/gopher_1.png"},
+		{testImageFromFileSource, "gopher 1.png", "../images/gopher_1-2.png"},
+		{testImageFromFileSource, "Gopher é.png", "../images/Gopher_e.png"},
+		{imagePath, "", "../images/image0004.png"},
+	}
+	for _, testCase := range testCases {
+		internalPath, err := e.AddImage(testCase.source, testCase.internalFilename)
+		if err != nil {
+			t.Fatalf("Error adding image %s: %s", testCase.source, err)
+		}
+		if internalPath != testCase.expectedPath {
+			t.Errorf("Got image path %s, expected %s", internalPath, testCase.expectedPath)
+		}
+	}
+
+	// A filename that's the same once sanitized is still reported as used
+	if _, err := e.AddImage(testImageFromFileSource, "Gopher_e.png"); err == nil {
+		t.Error("Expected FilenameAlreadyUsedError adding an image with a used filename")
+	}
+
+	sectionPath, err := e.AddSection(testSectionBody, testSectionTitle, "Chapter 1.xhtml", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	if sectionPath != "Chapter_1.xhtml" {
+		t.Errorf("Got section filename %s, expected Chapter_1.xhtml", sectionPath)
+	}
+	renamedPath, err := e.RenameSection(sectionPath, "Chapitre 1.xhtml")
+	if err != nil {
+		t.Fatalf("Error renaming section: %s", err)
+	}
+	if renamedPath != "Chapitre_1.xhtml" {
+		t.Errorf("Got renamed section filename %s, expected Chapitre_1.xhtml", renamedPath)
+	}
+
+	var renamed []string
+	for _, warning := range e.Warnings() {
+		if warning.Type == WarningRenamed {
+			renamed = append(renamed, warning.Path)
+		}
+	}
+	expected := []string{
+		"EPUB/images/gopher_1-2.png",
+		"EPUB/images/Gopher_e.png",
+		"EPUB/images/image0004.png",
+		"EPUB/xhtml/Chapter_1.xhtml",
+		"EPUB/xhtml/Chapitre_1.xhtml",
+	}
+	if !reflect.DeepEqual(renamed, expected) {
+		t.Errorf("Got renamed files %v, expected %v", renamed, expected)
+	}
+}
@@ -0,0 +1,418 @@
+package epub
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+)
+
+// errFontNotSubsettable is returned by subsetFont for fonts it can't subset,
+// e.g. fonts with CFF outlines, WOFF fonts or font collections
+var errFontNotSubsettable = errors.New("font can't be subset")
+
+const (
+	// Flags of the components of composite glyphs
+	glyfArg1And2AreWords   = 0x0001
+	glyfWeHaveAScale       = 0x0008
+	glyfMoreComponents     = 0x0020
+	glyfWeHaveAnXAndYScale = 0x0040
+	glyfWeHaveATwoByTwo    = 0x0080
+	// Offset of checkSumAdjustment in the head table
+	headCheckSumAdjustmentOffset = 8
+	// Offset of indexToLocFormat in the head table
+	headIndexToLocFormatOffset = 50
+	// Value the font checksum is adjusted to
+	sfntCheckSumMagic = 0xB1B0AFBA
+)
+
+// sfntTable is a table of a TrueType font
+type sfntTable struct {
+	tag  string
+	data []byte
+}
+
+// usedRunes returns the characters that can be displayed by the sections of
+// the EPUB: the characters of their bodies (including the body of the cover
+// page, generated from its template) and titles, the characters of the EPUB
+// title, which is used by the cover, and the characters of the text added to
+// the sections when they're written: the watermark and the labels of the
+// figures and tables
+func (e *Epub) usedRunes() map[rune]bool {
+	runes := make(map[rune]bool)
+	addRunes := func(s string) {
+		for _, r := range s {
+			runes[r] = true
+		}
+	}
+	addRunes(e.title)
+	e.forEachSection(func(s *epubSection) {
+		body := s.xhtml.xml.Body.XML
+		addRunes(body)
+		// Characters can be written as character references
+		addRunes(html.UnescapeString(body))
+		addRunes(s.xhtml.Title())
+	})
+	if e.watermark != nil {
+		addRunes(e.watermark.Text)
+	}
+	// The labels are followed by any number
+	if e.figureLabel != "" {
+		addRunes(fmt.Sprintf(figureLabelFormat, e.figureLabel, 1234567890))
+	}
+	if e.tableLabel != "" {
+		addRunes(fmt.Sprintf(figureLabelFormat, e.tableLabel, 1234567890))
+	}
+	return runes
+}
+
+// subsetFontFile subsets the TrueType font at fontFilePath (see subsetFont)
+func subsetFontFile(filesystem storage.Storage, fontFilePath string, runes map[rune]bool) error {
+	font, err := storage.ReadFile(filesystem, fontFilePath)
+	if err != nil {
+		return err
+	}
+	subset, err := subsetFont(font, runes)
+	if err != nil {
+		return err
+	}
+	return filesystem.WriteFile(fontFilePath, subset, filePermissions)
+}
+
+// subsetFont returns a copy of the TrueType font where the outlines of the
+// glyphs that are only mapped to characters that aren't in runes are removed.
+//
+// Glyph indexes are kept as is so that the other tables of the font (metrics,
+// kerning, substitutions, etc.) stay valid. Glyphs that aren't mapped to any
+// character (e.g. ligatures and alternates), as well as the components of the
+// glyphs that are kept, are always kept.
+func subsetFont(font []byte, runes map[rune]bool) ([]byte, error) {
+	tables, err := parseSfntTables(font)
+	if err != nil {
+		return nil, err
+	}
+	tableData := make(map[string][]byte)
+	for _, t := range tables {
+		tableData[t.tag] = t.data
+	}
+	head, maxp, loca, glyf, cmap := tableData["head"], tableData["maxp"], tableData["loca"], tableData["glyf"], tableData["cmap"]
+	if len(head) < headIndexToLocFormatOffset+2 || len(maxp) < 6 || loca == nil || glyf == nil || cmap == nil {
+		return nil, errFontNotSubsettable
+	}
+
+	numGlyphs := int(binary.BigEndian.Uint16(maxp[4:]))
+	offsets, err := parseLoca(loca, numGlyphs, binary.BigEndian.Uint16(head[headIndexToLocFormatOffset:]) == 1, len(glyf))
+	if err != nil {
+		return nil, err
+	}
+	glyphs := make([][]byte, numGlyphs)
+	for i := range glyphs {
+		glyphs[i] = glyf[offsets[i]:offsets[i+1]]
+	}
+
+	// Glyphs mapped to characters are only kept if the characters are used
+	mapped, used, err := parseCmap(cmap, runes)
+	if err != nil {
+		return nil, err
+	}
+	keep := make([]bool, numGlyphs)
+	var toVisit []int
+	for i := range keep {
+		if i == 0 || !mapped[i] || used[i] {
+			toVisit = append(toVisit, i)
+		}
+	}
+	for len(toVisit) > 0 {
+		i := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+		if i >= numGlyphs || keep[i] {
+			continue
+		}
+		keep[i] = true
+		toVisit = append(toVisit, glyphComponents(glyphs[i])...)
+	}
+
+	// Rebuild the glyf table without the outlines of the removed glyphs and the
+	// loca table with long offsets
+	var newGlyf []byte
+	newLoca := make([]byte, 4*(numGlyphs+1))
+	for i, glyph := range glyphs {
+		binary.BigEndian.PutUint32(newLoca[4*i:], uint32(len(newGlyf)))
+		if keep[i] {
+			newGlyf = append(newGlyf, glyph...)
+			for len(newGlyf)%4 != 0 {
+				newGlyf = append(newGlyf, 0)
+			}
+		}
+	}
+	binary.BigEndian.PutUint32(newLoca[4*numGlyphs:], uint32(len(newGlyf)))
+
+	newHead := append([]byte{}, head...)
+	binary.BigEndian.PutUint32(newHead[headCheckSumAdjustmentOffset:], 0)
+	binary.BigEndian.PutUint16(newHead[headIndexToLocFormatOffset:], 1)
+
+	newTables := make([]sfntTable, 0, len(tables))
+	for _, t := range tables {
+		switch t.tag {
+		case "glyf":
+			t.data = newGlyf
+		case "loca":
+			t.data = newLoca
+		case "head":
+			t.data = newHead
+		case "DSIG":
+			// The digital signature isn't valid anymore
+			continue
+		}
+		newTables = append(newTables, t)
+	}
+	return writeSfntTables(font[:4], newTables), nil
+}
+
+// parseSfntTables returns the tables of the TrueType font
+func parseSfntTables(font []byte) ([]sfntTable, error) {
+	if len(font) < 12 || (binary.BigEndian.Uint32(font) != 0x00010000 && string(font[:4]) != "true") {
+		return nil, errFontNotSubsettable
+	}
+	numTables := int(binary.BigEndian.Uint16(font[4:]))
+	if len(font) < 12+16*numTables {
+		return nil, errFontNotSubsettable
+	}
+	tables := make([]sfntTable, numTables)
+	for i := range tables {
+		record := font[12+16*i:]
+		offset := int64(binary.BigEndian.Uint32(record[8:]))
+		length := int64(binary.BigEndian.Uint32(record[12:]))
+		if offset+length > int64(len(font)) {
+			return nil, errFontNotSubsettable
+		}
+		tables[i] = sfntTable{
+			tag:  string(record[:4]),
+			data: font[offset : offset+length],
+		}
+	}
+	return tables, nil
+}
+
+// writeSfntTables returns a TrueType font made of the tables
+func writeSfntTables(sfntVersion []byte, tables []sfntTable) []byte {
+	sort.Slice(tables, func(i, j int) bool { return tables[i].tag < tables[j].tag })
+
+	numTables := len(tables)
+	entrySelector := 0
+	for 1<<(entrySelector+1) <= numTables {
+		entrySelector++
+	}
+	searchRange := 16 << entrySelector
+
+	font := make([]byte, 12+16*numTables)
+	copy(font, sfntVersion)
+	binary.BigEndian.PutUint16(font[4:], uint16(numTables))
+	binary.BigEndian.PutUint16(font[6:], uint16(searchRange))
+	binary.BigEndian.PutUint16(font[8:], uint16(entrySelector))
+	binary.BigEndian.PutUint16(font[10:], uint16(16*numTables-searchRange))
+
+	headOffset := -1
+	for i, t := range tables {
+		record := font[12+16*i:]
+		copy(record, t.tag)
+		binary.BigEndian.PutUint32(record[4:], sfntChecksum(t.data))
+		binary.BigEndian.PutUint32(record[8:], uint32(len(font)))
+		binary.BigEndian.PutUint32(record[12:], uint32(len(t.data)))
+		if t.tag == "head" {
+			headOffset = len(font)
+		}
+		font = append(font, t.data...)
+		for len(font)%4 != 0 {
+			font = append(font, 0)
+		}
+	}
+
+	if headOffset != -1 {
+		binary.BigEndian.PutUint32(font[headOffset+headCheckSumAdjustmentOffset:], sfntCheckSumMagic-sfntChecksum(font))
+	}
+	return font
+}
+
+// sfntChecksum returns the checksum of TrueType font data
+func sfntChecksum(data []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(data); i += 4 {
+		var word [4]byte
+		copy(word[:], data[i:])
+		sum += binary.BigEndian.Uint32(word[:])
+	}
+	return sum
+}
+
+// parseLoca returns the offsets of the glyphs in the glyf table
+func parseLoca(loca []byte, numGlyphs int, long bool, glyfLength int) ([]int, error) {
+	size := 2
+	if long {
+		size = 4
+	}
+	if len(loca) < size*(numGlyphs+1) {
+		return nil, errFontNotSubsettable
+	}
+	offsets := make([]int, numGlyphs+1)
+	for i := range offsets {
+		if long {
+			offsets[i] = int(binary.BigEndian.Uint32(loca[4*i:]))
+		} else {
+			offsets[i] = 2 * int(binary.BigEndian.Uint16(loca[2*i:]))
+		}
+		if offsets[i] > glyfLength || (i > 0 && offsets[i] < offsets[i-1]) {
+			return nil, errFontNotSubsettable
+		}
+	}
+	return offsets, nil
+}
+
+// glyphComponents returns the indexes of the glyphs a composite glyph is made
+// of, or nothing for a simple glyph
+func glyphComponents(glyph []byte) []int {
+	if len(glyph) < 10 || int16(binary.BigEndian.Uint16(glyph)) >= 0 {
+		return nil
+	}
+	var components []int
+	for p := 10; p+4 <= len(glyph); {
+		flags := binary.BigEndian.Uint16(glyph[p:])
+		components = append(components, int(binary.BigEndian.Uint16(glyph[p+2:])))
+		p += 4
+		if flags&glyfArg1And2AreWords != 0 {
+			p += 4
+		} else {
+			p += 2
+		}
+		switch {
+		case flags&glyfWeHaveAScale != 0:
+			p += 2
+		case flags&glyfWeHaveAnXAndYScale != 0:
+			p += 4
+		case flags&glyfWeHaveATwoByTwo != 0:
+			p += 8
+		}
+		if flags&glyfMoreComponents == 0 {
+			break
+		}
+	}
+	return components
+}
+
+// parseCmap returns the glyphs that are mapped to characters by the Unicode
+// subtables of the cmap table and, among them, the glyphs mapped to the runes
+func parseCmap(cmap []byte, runes map[rune]bool) (mapped map[int]bool, used map[int]bool, err error) {
+	if len(cmap) < 4 {
+		return nil, nil, errFontNotSubsettable
+	}
+	mapped = make(map[int]bool)
+	used = make(map[int]bool)
+	addMapping := func(r rune, glyph int) {
+		if glyph == 0 {
+			return
+		}
+		mapped[glyph] = true
+		if runes[r] {
+			used[glyph] = true
+		}
+	}
+
+	numSubtables := int(binary.BigEndian.Uint16(cmap[2:]))
+	found := false
+	for i := 0; i < numSubtables && 4+8*i+8 <= len(cmap); i++ {
+		record := cmap[4+8*i:]
+		platformID := binary.BigEndian.Uint16(record)
+		encodingID := binary.BigEndian.Uint16(record[2:])
+		// Only Unicode subtables are used
+		if platformID != 0 && !(platformID == 3 && (encodingID == 1 || encodingID == 10)) {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint32(record[4:]))
+		if offset+2 > len(cmap) {
+			return nil, nil, errFontNotSubsettable
+		}
+		subtable := cmap[offset:]
+		switch binary.BigEndian.Uint16(subtable) {
+		case 4:
+			err = parseCmapFormat4(subtable, addMapping)
+		case 12:
+			err = parseCmapFormat12(subtable, addMapping)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		found = true
+	}
+	if !found {
+		return nil, nil, errFontNotSubsettable
+	}
+	return mapped, used, nil
+}
+
+// parseCmapFormat4 calls addMapping for each character mapped by the format 4
+// cmap subtable
+func parseCmapFormat4(subtable []byte, addMapping func(rune, int)) error {
+	if len(subtable) < 14 {
+		return errFontNotSubsettable
+	}
+	segCount := int(binary.BigEndian.Uint16(subtable[6:]) / 2)
+	endCodes := 14
+	startCodes := endCodes + 2*segCount + 2
+	idDeltas := startCodes + 2*segCount
+	idRangeOffsets := idDeltas + 2*segCount
+	if len(subtable) < idRangeOffsets+2*segCount {
+		return errFontNotSubsettable
+	}
+	for i := 0; i < segCount; i++ {
+		endCode := int(binary.BigEndian.Uint16(subtable[endCodes+2*i:]))
+		startCode := int(binary.BigEndian.Uint16(subtable[startCodes+2*i:]))
+		idDelta := int(binary.BigEndian.Uint16(subtable[idDeltas+2*i:]))
+		idRangeOffset := int(binary.BigEndian.Uint16(subtable[idRangeOffsets+2*i:]))
+		for c := startCode; c <= endCode && c != 0xFFFF; c++ {
+			glyph := 0
+			if idRangeOffset == 0 {
+				glyph = (c + idDelta) & 0xFFFF
+			} else {
+				p := idRangeOffsets + 2*i + idRangeOffset + 2*(c-startCode)
+				if p+2 > len(subtable) {
+					return errFontNotSubsettable
+				}
+				if glyph = int(binary.BigEndian.Uint16(subtable[p:])); glyph != 0 {
+					glyph = (glyph + idDelta) & 0xFFFF
+				}
+			}
+			addMapping(rune(c), glyph)
+		}
+	}
+	return nil
+}
+
+// parseCmapFormat12 calls addMapping for each character mapped by the format
+// 12 cmap subtable
+func parseCmapFormat12(subtable []byte, addMapping func(rune, int)) error {
+	if len(subtable) < 16 {
+		return errFontNotSubsettable
+	}
+	numGroups := int(binary.BigEndian.Uint32(subtable[12:]))
+	if numGroups < 0 || len(subtable) < 16+12*numGroups {
+		return errFontNotSubsettable
+	}
+	for i := 0; i < numGroups; i++ {
+		group := subtable[16+12*i:]
+		startChar := binary.BigEndian.Uint32(group)
+		endChar := binary.BigEndian.Uint32(group[4:])
+		startGlyph := binary.BigEndian.Uint32(group[8:])
+		if endChar < startChar || endChar > 0x10FFFF {
+			return errFontNotSubsettable
+		}
+		for c := startChar; c <= endChar; c++ {
+			addMapping(rune(c), int(startGlyph+c-startChar))
+		}
+	}
+	return nil
+}
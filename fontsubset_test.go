@@ -0,0 +1,118 @@
+package epub
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+func TestSubsetFont(t *testing.T) {
+	font, err := os.ReadFile(testFontFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading font: %s", err)
+	}
+
+	subset, err := subsetFont(font, map[rune]bool{'a': true})
+	if err != nil {
+		t.Fatalf("Unexpected error subsetting font: %s", err)
+	}
+	if len(subset) >= len(font) {
+		t.Errorf("Subset font isn't smaller than the font: got %d bytes, font has %d bytes", len(subset), len(font))
+	}
+
+	f, err := sfnt.Parse(subset)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing subset font: %s", err)
+	}
+	var b sfnt.Buffer
+	if f.NumGlyphs() != mustParseFont(t, font).NumGlyphs() {
+		t.Errorf("Subset font has %d glyphs, expected as many glyphs as the font", f.NumGlyphs())
+	}
+	for _, tt := range []struct {
+		r            rune
+		wantOutlines bool
+	}{
+		{'a', true},
+		{'b', false},
+	} {
+		i, err := f.GlyphIndex(&b, tt.r)
+		if err != nil || i == 0 {
+			t.Fatalf("Glyph of %q not found in subset font: %v", tt.r, err)
+		}
+		segments, err := f.LoadGlyph(&b, i, fixed.I(12), nil)
+		if err != nil {
+			t.Fatalf("Unexpected error loading glyph of %q: %s", tt.r, err)
+		}
+		if got := len(segments) > 0; got != tt.wantOutlines {
+			t.Errorf("Glyph of %q has outlines: got %t, expected %t", tt.r, got, tt.wantOutlines)
+		}
+	}
+
+	// Fonts that aren't TrueType fonts are left alone
+	if _, err := subsetFont([]byte("wOFF not a TrueType font"), nil); err != errFontNotSubsettable {
+		t.Errorf("Expected errFontNotSubsettable, got %v", err)
+	}
+}
+
+func TestSetSubsetFonts(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	testFontPath, err := e.AddFont(testFontFromFileSource, "")
+	if err != nil {
+		t.Fatalf("Error adding font: %s", err)
+	}
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	e.SetSubsetFonts(true)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	subset, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testFontPath))
+	if err != nil {
+		t.Fatalf("Unexpected error reading font: %s", err)
+	}
+	fontInfo, err := os.Stat(testFontFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading font: %s", err)
+	}
+	if int64(len(subset)) >= fontInfo.Size() {
+		t.Errorf("Font wasn't subset: got %d bytes, font has %d bytes", len(subset), fontInfo.Size())
+	}
+	if _, err := sfnt.Parse(subset); err != nil {
+		t.Errorf("Unexpected error parsing subset font: %s", err)
+	}
+}
+
+// The text added to the sections when they're written is kept
+func TestUsedRunes(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddSection("<p>a</p>", "", "", ""); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	e.SetFigureNumbering("Fig", "Tab")
+	e.watermark = &Watermark{Text: "Jé"}
+
+	runes := e.usedRunes()
+	for _, r := range "aFigTabJé.0123456789" {
+		if !runes[r] {
+			t.Errorf("%q isn't used", r)
+		}
+	}
+	if runes['z'] {
+		t.Errorf("%q is used", 'z')
+	}
+}
+
+func mustParseFont(t *testing.T, font []byte) *sfnt.Font {
+	t.Helper()
+	f, err := sfnt.Parse(font)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing font: %s", err)
+	}
+	return f
+}
@@ -0,0 +1,307 @@
+package epub
+
+import (
+	"fmt"
+	"html"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bmaupin/go-epub/internal/markdown"
+)
+
+// Name of the folder of the assets used by FromDir by default
+const defaultAssetsFolderName = "assets"
+
+var (
+	// dirHeadingRegexp matches the headings of the sections built by FromDir,
+	// the first group being their content
+	dirHeadingRegexp = regexp.MustCompile(`(?is)<h[1-6]\b[^>]*>(.*?)</h[1-6]\s*>`)
+	// dirOrderPrefixRegexp matches the prefixes used to order the files of the
+	// sections built by FromDir, e.g. 01- or 2_
+	dirOrderPrefixRegexp = regexp.MustCompile(`^\d+[-_. ]*`)
+)
+
+// Extensions of the files used by FromDir, by kind
+var (
+	dirHTMLExtensions     = []string{".htm", ".html", ".xhtml"}
+	dirMarkdownExtensions = []string{".markdown", ".md"}
+	dirImageExtensions    = []string{".avif", ".gif", ".jpeg", ".jpg", ".png", ".svg", ".webp"}
+	dirAudioExtensions    = []string{".m4a", ".mp3", ".oga", ".ogg", ".opus", ".wav"}
+	dirVideoExtensions    = []string{".m4v", ".mp4", ".ogv", ".webm"}
+)
+
+// DirOption is an option of FromDir.
+type DirOption func(*dirOptions)
+
+// dirOptions are the options of FromDir
+type dirOptions struct {
+	assetsFolderName string
+	epubOptions      []EpubOption
+}
+
+// WithAssetsFolder returns an option of FromDir that sets the name of the
+// folder of the assets (assets by default).
+func WithAssetsFolder(name string) DirOption {
+	return func(o *dirOptions) {
+		o.assetsFolderName = name
+	}
+}
+
+// WithEpubOptions returns an option of FromDir that sets the options passed to
+// NewEpub, e.g. WithLogger.
+func WithEpubOptions(options ...EpubOption) DirOption {
+	return func(o *dirOptions) {
+		o.epubOptions = append(o.epubOptions, options...)
+	}
+}
+
+// FromDir creates an EPUB from the HTML and Markdown files of the folder at
+// dirPath, titled by the name of the folder:
+//   - The files are sections, in the alphabetical order of their paths, so
+//     they can be ordered with prefixes such as 01- or 02-. The files of a
+//     subfolder are subsections of its first file, in the same order.
+//   - Sections are titled in the table of contents by their first heading, or
+//     else by the title of their HTML head, or else by their filename without
+//     extension and order prefix.
+//   - HTML files are XHTML whose body is used. Markdown files (.md and
+//     .markdown) are converted to XHTML.
+//   - The files of the assets folder (see WithAssetsFolder) are added as fonts,
+//     images, videos, audio or CSS depending on their extension, or else as raw
+//     files at their path in the folder. All the sections link to the CSS
+//     files, in alphabetical order. An image named cover at the top of the
+//     assets folder, e.g. assets/cover.jpg, becomes the cover.
+//   - The links between the files are updated to their paths in the EPUB.
+//
+// Hidden files and folders, whose names start with a dot, and the other files
+// outside of the assets folder are left out. The EPUB isn't written, so the
+// metadata can be set before it is, e.g. with SetTitle and SetAuthor. If a file
+// can't be read, FileRetrievalError will be returned.
+func FromDir(dirPath string, options ...DirOption) (*Epub, error) {
+	o := dirOptions{assetsFolderName: defaultAssetsFolderName}
+	for _, option := range options {
+		option(&o)
+	}
+
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		return nil, &FileRetrievalError{Source: dirPath, Err: err}
+	}
+	var sectionFiles, assetFiles []string
+	err = filepath.WalkDir(dirPath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dirPath, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		ext := strings.ToLower(path.Ext(rel))
+		switch folderName, _, _ := strings.Cut(rel, "/"); {
+		case folderName == o.assetsFolderName && rel != folderName:
+			assetFiles = append(assetFiles, rel)
+		case slices.Contains(dirHTMLExtensions, ext) || slices.Contains(dirMarkdownExtensions, ext):
+			sectionFiles = append(sectionFiles, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &FileRetrievalError{Source: dirPath, Err: err}
+	}
+	sort.Strings(sectionFiles)
+	sort.Strings(assetFiles)
+
+	e := NewEpub(filepath.Base(absPath), o.epubOptions...)
+	// The new paths of the files relative to the content folder, by path
+	// relative to the folder
+	renamed := make(map[string]string)
+	if err := addDirAssets(e, dirPath, assetFiles, o.assetsFolderName, renamed); err != nil {
+		return nil, err
+	}
+	var cssPaths []string
+	for _, file := range assetFiles {
+		if strings.HasPrefix(renamed[file], CSSFolderName+"/") {
+			cssPaths = append(cssPaths, path.Join("..", renamed[file]))
+		}
+	}
+
+	sectionFilenames := make(map[string]bool)
+	if e.cover.xhtmlFilename != "" {
+		sectionFilenames[e.cover.xhtmlFilename] = true
+	}
+	for i, file := range sectionFiles {
+		filename := SafeInternalFilename(strings.TrimSuffix(file, path.Ext(file)) + ".xhtml")
+		if filename == "" || sectionFilenames[filename] {
+			for index := i + 1; filename == "" || sectionFilenames[filename]; index++ {
+				filename = fmt.Sprintf(sectionFileFormat, index)
+			}
+		}
+		sectionFilenames[filename] = true
+		renamed[file] = path.Join(xhtmlFolderName, filename)
+	}
+
+	// The first file of each subfolder, which is the parent of the others
+	parents := make(map[string]string)
+	for _, file := range sectionFiles {
+		data, err := os.ReadFile(filepath.Join(dirPath, filepath.FromSlash(file)))
+		if err != nil {
+			return nil, &FileRetrievalError{Source: file, Err: err}
+		}
+		title, body := dirSectionContent(file, string(data))
+		opts := SectionOptions{
+			Title:    title,
+			Filename: path.Base(renamed[file]),
+			CSS:      cssPaths,
+		}
+		if folderName, _, ok := strings.Cut(file, "/"); ok {
+			if parent, ok := parents[folderName]; ok {
+				opts.Parent = parent
+			} else {
+				parents[folderName] = opts.Filename
+			}
+		}
+		body = rewriteLinks(body, func(link string) string {
+			return upgradedLink(link, file, renamed[file], renamed)
+		})
+		if _, err := e.AddSectionWithOptions(body, opts); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// addDirAssets adds the files of the assets folder of FromDir to e and records
+// their paths in renamed
+func addDirAssets(e *Epub, dirPath string, assetFiles []string, assetsFolderName string, renamed map[string]string) error {
+	var cssFiles []string
+	cover := ""
+	for _, file := range assetFiles {
+		source := filepath.Join(dirPath, filepath.FromSlash(file))
+		ext := strings.ToLower(path.Ext(file))
+		var mediaFolderName string
+		switch {
+		case ext == ".css":
+			cssFiles = append(cssFiles, file)
+			continue
+		case fontExtensions[ext]:
+			mediaFolderName = FontFolderName
+		case slices.Contains(dirImageExtensions, ext):
+			mediaFolderName = ImageFolderName
+			if path.Dir(file) == assetsFolderName && strings.TrimSuffix(path.Base(file), path.Ext(file)) == "cover" {
+				cover = file
+			}
+		case slices.Contains(dirAudioExtensions, ext):
+			mediaFolderName = AudioFolderName
+		case slices.Contains(dirVideoExtensions, ext):
+			mediaFolderName = VideoFolderName
+		}
+
+		var internalPath string
+		var err error
+		if mediaFolderName == "" {
+			// The raw files keep their path, unless it's in a folder used by
+			// the other files of the EPUB
+			rawPath := file
+			folderName, _, _ := strings.Cut(rawPath, "/")
+			if _, ok := e.mediaFolders()[folderName]; ok || folderName == xhtmlFolderName {
+				rawPath = path.Join(upgradedRawFolderName, rawPath)
+			}
+			internalPath, err = e.AddRawFile(source, rawPath, "")
+		} else {
+			// Files of subfolders may have the same name
+			filename := path.Base(file)
+			if _, ok := e.mediaFolders()[mediaFolderName][filename]; ok {
+				filename = ""
+			}
+			add := map[string]func(string, string) (string, error){
+				FontFolderName:  e.AddFont,
+				ImageFolderName: e.AddImage,
+				VideoFolderName: e.AddVideo,
+				AudioFolderName: e.AddAudio,
+			}[mediaFolderName]
+			internalPath, err = add(source, filename)
+		}
+		if err != nil {
+			return err
+		}
+		renamed[file] = strings.TrimPrefix(internalPath, "../")
+	}
+
+	// The CSS files are added once the paths of the files they link to are
+	// known
+	for _, file := range cssFiles {
+		data, err := os.ReadFile(filepath.Join(dirPath, filepath.FromSlash(file)))
+		if err != nil {
+			return &FileRetrievalError{Source: file, Err: err}
+		}
+		filename := path.Base(file)
+		// The links are relative to the CSS folder whatever the filename
+		renamed[file] = path.Join(CSSFolderName, filename)
+		if _, ok := e.css[filename]; ok {
+			filename = ""
+		}
+		internalPath, err := e.AddCSSFromString(upgradedCSS(string(data), file, renamed), filename)
+		if err != nil {
+			return err
+		}
+		renamed[file] = strings.TrimPrefix(internalPath, "../")
+	}
+
+	if cover != "" {
+		return e.setCover(path.Join("..", renamed[cover]), "")
+	}
+	return nil
+}
+
+// dirSectionContent returns the title and the body of a section of FromDir,
+// given the content of its file
+func dirSectionContent(file string, content string) (string, string) {
+	title := ""
+	body := content
+	if slices.Contains(dirMarkdownExtensions, strings.ToLower(path.Ext(file))) {
+		body = markdown.ToXHTML(content)
+	} else if m := xhtmlBodyRegexp.FindStringSubmatchIndex(content); m != nil {
+		if t := xhtmlTitleRegexp.FindStringSubmatch(content[:m[0]]); t != nil {
+			title = t[1]
+		}
+		body = content[m[2]:m[3]]
+	}
+	if m := dirHeadingRegexp.FindStringSubmatch(body); m != nil {
+		title = m[1]
+	}
+	title = strings.Join(strings.Fields(html.UnescapeString(htmlTagRegexp.ReplaceAllString(title, ""))), " ")
+	if title == "" {
+		// The filename without extension and order prefix, e.g. Introduction
+		// for 01-introduction.md
+		name := strings.TrimSuffix(path.Base(file), path.Ext(file))
+		name = strings.Join(strings.FieldsFunc(dirOrderPrefixRegexp.ReplaceAllString(name, ""), func(r rune) bool {
+			return r == '-' || r == '_' || unicode.IsSpace(r)
+		}), " ")
+		if name == "" {
+			name = strings.TrimSuffix(path.Base(file), path.Ext(file))
+		}
+		first, size := utf8.DecodeRuneInString(name)
+		title = string(unicode.ToUpper(first)) + name[size:]
+	}
+	return title, body
+}
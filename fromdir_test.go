@@ -0,0 +1,151 @@
+package epub
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFromDir(t *testing.T) {
+	image, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Error reading image: %s", err)
+	}
+	dir := filepath.Join(t.TempDir(), "My book")
+	files := map[string]string{
+		"01-introduction.md":        "# Welcome & *hello*\n\nSee [the part](02-part/01-start.html#top) and ![the cover](assets/cover.png).\n",
+		"02-part/01-start.html":     `<html><head><title>Ignored title</title></head><body><p id="top">No heading</p><a href="../01-introduction.md">Back</a></body></html>`,
+		"02-part/02-details.xhtml":  `<html><head><title>Details</title></head><body><p>Text</p></body></html>`,
+		"02-part/more/03-nested.md": "Nested\n",
+		"03_the-end.md":             "The end, see [notes](assets/data/notes.txt).\n",
+		"assets/cover.png":          string(image),
+		"assets/images/cover.png":   string(image),
+		"assets/style.css":          `body { background: url(images/cover.png); }`,
+		"assets/data/notes.txt":     "Notes",
+		"assets/images/notes.txt":   "Notes",
+		"notes.txt":                 "Ignored",
+		".hidden/hidden.md":         "Hidden",
+	}
+	for name, content := range files {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e, err := FromDir(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if e.Title() != "My book" {
+		t.Errorf("Got title %q, expected %q", e.Title(), "My book")
+	}
+
+	type expectedSection struct {
+		filename string
+		title    string
+		parent   string
+		contains []string
+	}
+	expected := []expectedSection{
+		{"cover.xhtml", "", "", nil},
+		{"01-introduction.xhtml", "Welcome & hello", "", []string{`href="01-start.xhtml#top"`, `src="../images/cover.png"`}},
+		{"01-start.xhtml", "Ignored title", "", []string{`href="01-introduction.xhtml"`}},
+		{"02-details.xhtml", "Details", "01-start.xhtml", nil},
+		{"03-nested.xhtml", "Nested", "01-start.xhtml", nil},
+		{"03_the-end.xhtml", "The end", "", []string{`href="../assets/data/notes.txt"`}},
+	}
+	var sections []epubSection
+	parents := make(map[string]string)
+	for _, s := range e.sections {
+		sections = append(sections, s)
+		if s.children != nil {
+			for _, child := range *s.children {
+				sections = append(sections, child)
+				parents[child.filename] = s.filename
+			}
+		}
+	}
+	if len(sections) != len(expected) {
+		t.Fatalf("Got %d sections, expected %d", len(sections), len(expected))
+	}
+	for i, s := range sections {
+		if s.filename != expected[i].filename {
+			t.Errorf("Section %d: got filename %s, expected %s", i, s.filename, expected[i].filename)
+		}
+		if i > 0 && s.xhtml.Title() != expected[i].title {
+			t.Errorf("Section %s: got title %q, expected %q", s.filename, s.xhtml.Title(), expected[i].title)
+		}
+		if parent := parents[s.filename]; parent != expected[i].parent {
+			t.Errorf("Section %s: got parent %q, expected %q", s.filename, parent, expected[i].parent)
+		}
+		for _, c := range expected[i].contains {
+			if !strings.Contains(s.xhtml.xml.Body.XML, c) {
+				t.Errorf("Section %s doesn't contain %s:\n%s", s.filename, c, s.xhtml.xml.Body.XML)
+			}
+		}
+		if i > 0 && (len(s.xhtml.xml.Head.Links) != 1 || s.xhtml.xml.Head.Links[0].Href != "../css/style.css") {
+			t.Errorf("Section %s doesn't link to the CSS", s.filename)
+		}
+	}
+
+	if len(e.images) != 2 {
+		t.Errorf("Got images %v, expected 2", e.images)
+	}
+	for _, rawPath := range []string{"assets/data/notes.txt", "assets/images/notes.txt"} {
+		if _, ok := e.rawFiles[rawPath]; !ok {
+			t.Errorf("Missing raw file %s in %v", rawPath, e.rawFiles)
+		}
+	}
+	if e.cover.imageFilename != "cover.png" {
+		t.Errorf("Got cover %q, expected cover.png", e.cover.imageFilename)
+	}
+
+	findings, err := e.Validate()
+	if err != nil {
+		t.Fatalf("Unexpected error validating EPUB: %s", err)
+	}
+	for _, finding := range findings {
+		t.Errorf("Unexpected finding: %s", finding)
+	}
+}
+
+func TestFromDirOptions(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"chapter.md":    "# Chapter\n",
+		"media/a.css":   "p { margin: 0; }",
+		"assets/b.html": "<p>Not a section</p>",
+	} {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e, err := FromDir(dir, WithAssetsFolder("media"), WithEpubOptions(WithLogger(nil)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := e.css["a.css"]; !ok {
+		t.Errorf("Expected a.css to be added, got %v", e.css)
+	}
+	var filenames []string
+	e.forEachSection(func(s *epubSection) {
+		filenames = append(filenames, s.filename)
+	})
+	if strings.Join(filenames, ",") != "b.xhtml,chapter.xhtml" {
+		t.Errorf("Got sections %v", filenames)
+	}
+
+	if _, err := FromDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected an error for a missing folder")
+	}
+}
@@ -1,9 +1,12 @@
 package epub
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/bmaupin/go-epub/internal/storage"
+	"github.com/bmaupin/go-epub/internal/storage/encrypted"
+	"github.com/bmaupin/go-epub/internal/storage/hybrid"
 	"github.com/bmaupin/go-epub/internal/storage/memory"
 	"github.com/bmaupin/go-epub/internal/storage/osfs"
 )
@@ -14,23 +17,146 @@ type FSType int
 // See the storage.Use method to change it.
 var filesystem storage.Storage = osfs.NewOSFS(os.TempDir())
 
+// filesystemErr is the error creating the default storage set by Use, if any
+var filesystemErr error
+
 const (
 	// This defines the local filesystem
 	OsFS FSType = iota
 	// This defines the memory filesystem
 	MemoryFS
+	// This defines a filesystem that keeps the small files in memory and the
+	// large ones in the local filesystem, e.g. videos (see WithSpillThreshold)
+	HybridFS
 )
 
+// defaultSpillThreshold is the size of the files over which the hybrid storage
+// spills them to the local filesystem, unless WithSpillThreshold is used
+const defaultSpillThreshold = 1 << 20
+
+// StorageOption configures a storage created by Use or WithStorage.
+type StorageOption func(*storageOptions)
+
+// storageOptions are the settings of a storage created by Use or WithStorage
+type storageOptions struct {
+	root           string
+	spillThreshold int64
+	encrypt        bool
+}
+
+// WithRoot makes the local filesystem storage build EPUBs in the directory dir
+// instead of the temporary directory of the system, e.g. a fast scratch volume
+// or the writable path of a container. The directory must exist. The hybrid
+// storage spills the large files to it. It has no effect on the memory storage.
+func WithRoot(dir string) StorageOption {
+	return func(o *storageOptions) {
+		o.root = dir
+	}
+}
+
+// WithSpillThreshold sets the size in bytes of the files over which the hybrid
+// storage spills them to the local filesystem instead of keeping them in
+// memory. It defaults to 1 MiB. It has no effect on the other storages.
+func WithSpillThreshold(size int64) StorageOption {
+	return func(o *storageOptions) {
+		o.spillThreshold = size
+	}
+}
+
+// WithEncryption makes the storage encrypt the files it stores with a random key
+// only kept in memory, so that the files of the EPUBs being built never hit the
+// disk in plaintext. The files are held in memory while they're read or
+// written.
+func WithEncryption() StorageOption {
+	return func(o *storageOptions) {
+		o.encrypt = true
+	}
+}
+
 // Use s as default storage/ This is typically used in an init function.
 // Default to local filesystem
-func Use(s FSType) {
+//
+// The default storage is used by the EPUBs created afterwards, unless another
+// storage is passed to NewEpub (see WithStorage). If the storage can't be
+// created, the EPUBs created afterwards return the error when they're written.
+func Use(s FSType, options ...StorageOption) {
+	filesystem, filesystemErr = newStorage(s, options...)
+}
+
+// WithStorage makes NewEpub create an EPUB that uses its own storage of type s
+// instead of the default one set by Use, e.g. so that EPUBs built by different
+// goroutines use different types of storage. If the storage can't be created,
+// the EPUB returns the error when it's written.
+func WithStorage(s FSType, options ...StorageOption) EpubOption {
+	storage, err := newStorage(s, options...)
+	return func(e *Epub) {
+		e.filesystem = storage
+		// The EPUB can't be written without its storage
+		if err != nil && e.initErr == nil {
+			e.initErr = err
+		}
+	}
+}
+
+// Storage is a storage used to build EPUBs when they're written. It can be
+// implemented to build EPUBs somewhere else than in the local filesystem or in
+// memory (see WithCustomStorage); the aferofs package provides one backed by
+// any afero filesystem.
+type Storage = storage.Storage
+
+// StorageFile is a file created in a Storage.
+type StorageFile = storage.File
+
+// WithCustomStorage makes NewEpub create an EPUB that uses s as its storage
+// instead of the default one set by Use.
+func WithCustomStorage(s Storage) EpubOption {
+	return func(e *Epub) {
+		e.filesystem = s
+	}
+}
+
+// NewEncryptedStorage returns a storage that encrypts the files it stores in s,
+// like the storages created with WithEncryption, e.g. to encrypt the files of a
+// custom storage.
+func NewEncryptedStorage(s Storage) (Storage, error) {
+	return encrypted.New(s)
+}
+
+// newStorage returns a new storage of type s. If the storage can't be created,
+// the error is returned along with a local filesystem storage, so that EPUBs
+// can still be built until they're written.
+func newStorage(s FSType, options ...StorageOption) (storage.Storage, error) {
+	o := storageOptions{
+		root:           os.TempDir(),
+		spillThreshold: defaultSpillThreshold,
+	}
+	for _, option := range options {
+		option(&o)
+	}
+	fs, err := newStorageType(s, o)
+	if err != nil {
+		return osfs.NewOSFS(o.root), err
+	}
+	if o.encrypt {
+		encryptedFS, err := encrypted.New(fs)
+		if err != nil {
+			return fs, fmt.Errorf("unable to create encrypted storage: %w", err)
+		}
+		return encryptedFS, nil
+	}
+	return fs, nil
+}
+
+// newStorageType returns a new storage of type s configured by o
+func newStorageType(s FSType, o storageOptions) (storage.Storage, error) {
 	switch s {
 	case OsFS:
-		filesystem = osfs.NewOSFS(os.TempDir())
+		return osfs.NewOSFS(o.root), nil
 	case MemoryFS:
-		//TODO
-		filesystem = memory.NewMemory()
+		return memory.NewMemory(), nil
+	case HybridFS:
+		return hybrid.NewHybrid(o.root, o.spillThreshold), nil
 	default:
-		panic("unexpected FSType")
+		return nil, fmt.Errorf("unexpected FSType %d", s)
 	}
 }
@@ -0,0 +1,234 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/bmaupin/go-epub/internal/storage/memory"
+	"github.com/bmaupin/go-epub/internal/storage/osfs"
+)
+
+func TestWithStorage(t *testing.T) {
+	defaultFilesystem := filesystem
+	defer func() {
+		filesystem = defaultFilesystem
+	}()
+	Use(OsFS)
+
+	memoryEpub := NewEpub(testEpubTitle, WithStorage(MemoryFS))
+	osEpub := NewEpub(testEpubTitle)
+	if _, ok := memoryEpub.filesystem.(*memory.Memory); !ok {
+		t.Errorf("Got storage %T, expected the memory storage", memoryEpub.filesystem)
+	}
+	// Changing the default storage doesn't change the storage of the EPUBs
+	// already created
+	Use(MemoryFS)
+	if _, ok := osEpub.filesystem.(*osfs.OSFS); !ok {
+		t.Errorf("Got storage %T, expected the local filesystem", osEpub.filesystem)
+	}
+
+	// EPUBs using different types of storage can be written concurrently
+	var wg sync.WaitGroup
+	for _, e := range []*Epub{memoryEpub, osEpub} {
+		if _, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename); err != nil {
+			t.Fatalf("Error adding image: %s", err)
+		}
+		if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+			t.Fatalf("Error adding section: %s", err)
+		}
+		wg.Add(1)
+		go func(e *Epub) {
+			defer wg.Done()
+			var b bytes.Buffer
+			if _, err := e.WriteTo(&b); err != nil {
+				t.Errorf("Unexpected error writing EPUB: %s", err)
+			}
+		}(e)
+	}
+	wg.Wait()
+}
+
+func TestWithRoot(t *testing.T) {
+	defaultFilesystem := filesystem
+	defer func() {
+		filesystem = defaultFilesystem
+	}()
+	Use(OsFS, WithRoot(t.TempDir()))
+	missingRoot := filepath.Join(t.TempDir(), "missing")
+
+	tests := []struct {
+		name    string
+		e       *Epub
+		wantErr bool
+	}{
+		{"default root", NewEpub(testEpubTitle), false},
+		{"EPUB root", NewEpub(testEpubTitle, WithStorage(OsFS, WithRoot(t.TempDir()))), false},
+		{"missing root", NewEpub(testEpubTitle, WithStorage(OsFS, WithRoot(missingRoot))), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+				t.Fatalf("Error adding section: %s", err)
+			}
+			var b bytes.Buffer
+			_, err := test.e.WriteTo(&b)
+			if test.wantErr {
+				var storageErr *StorageError
+				if !errors.As(err, &storageErr) {
+					t.Errorf("Got error %v, expected a storage error", err)
+				}
+			} else if err != nil {
+				t.Errorf("Unexpected error writing EPUB: %s", err)
+			}
+		})
+	}
+}
+
+func TestHybridStorage(t *testing.T) {
+	root := t.TempDir()
+	e := NewEpub(testEpubTitle, WithStorage(HybridFS, WithRoot(root), WithSpillThreshold(64<<10)))
+	if _, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	if _, err := e.AddVideo(testVideoFromFileSource, ""); err != nil {
+		t.Fatalf("Error adding video: %s", err)
+	}
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	want, err := os.ReadFile(testVideoFromFileSource)
+	if err != nil {
+		t.Fatalf("Error reading video: %s", err)
+	}
+	videoPath := path.Join(contentFolderName, VideoFolderName, filepath.Base(testVideoFromFileSource))
+	f, err := r.Open(videoPath)
+	if err != nil {
+		t.Fatalf("Unexpected error opening %s: %s", videoPath, err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Unexpected error reading %s: %s", videoPath, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Got %d bytes of video, expected the %d bytes of %s", len(got), len(want), testVideoFromFileSource)
+	}
+
+	// The spilled files are removed once the EPUB is written
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatalf("Unexpected error reading %s: %s", root, err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Got %d files left in %s, expected none", len(entries), root)
+	}
+}
+
+// recordingStorage is a storage that records all the data written to it
+type recordingStorage struct {
+	Storage
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (s *recordingStorage) record(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written.Write(p)
+}
+
+func (s *recordingStorage) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	s.record(data)
+	return s.Storage.WriteFile(name, data, perm)
+}
+
+func (s *recordingStorage) Create(name string) (StorageFile, error) {
+	f, err := s.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return recordingFile{StorageFile: f, s: s}, nil
+}
+
+type recordingFile struct {
+	StorageFile
+	s *recordingStorage
+}
+
+func (f recordingFile) Write(p []byte) (int, error) {
+	f.s.record(p)
+	return f.StorageFile.Write(p)
+}
+
+func TestWithEncryption(t *testing.T) {
+	recording := &recordingStorage{Storage: memory.NewMemory()}
+	encryptedStorage, err := NewEncryptedStorage(recording)
+	if err != nil {
+		t.Fatalf("Unexpected error creating storage: %s", err)
+	}
+
+	for _, e := range []*Epub{
+		NewEpub(testEpubTitle, WithStorage(OsFS, WithRoot(t.TempDir()), WithEncryption())),
+		NewEpub(testEpubTitle, WithCustomStorage(encryptedStorage)),
+	} {
+		if _, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename); err != nil {
+			t.Fatalf("Error adding image: %s", err)
+		}
+		if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+			t.Fatalf("Error adding section: %s", err)
+		}
+		var b bytes.Buffer
+		if _, err := e.WriteTo(&b); err != nil {
+			t.Fatalf("Unexpected error writing EPUB: %s", err)
+		}
+	}
+
+	if recording.written.Len() == 0 {
+		t.Fatal("Nothing written to the storage")
+	}
+	if bytes.Contains(recording.written.Bytes(), []byte(testSectionBody)) {
+		t.Error("Section written to the storage in plaintext")
+	}
+}
+
+// The EPUBs whose storage can't be created return the error when they're
+// written
+func TestStorageCreationError(t *testing.T) {
+	defaultFilesystem, defaultFilesystemErr := filesystem, filesystemErr
+	defer func() {
+		filesystem, filesystemErr = defaultFilesystem, defaultFilesystemErr
+	}()
+
+	e := NewEpub(testEpubTitle, WithStorage(FSType(99)))
+	if _, err := e.WriteTo(&bytes.Buffer{}); err == nil {
+		t.Error("Expected an error writing an EPUB with an unknown storage type")
+	}
+
+	Use(FSType(99))
+	e = NewEpub(testEpubTitle)
+	if _, err := e.WriteTo(&bytes.Buffer{}); err == nil {
+		t.Error("Expected an error writing an EPUB with an unknown default storage type")
+	}
+	Use(MemoryFS)
+	e = NewEpub(testEpubTitle)
+	if _, err := e.WriteTo(&bytes.Buffer{}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
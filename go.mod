@@ -1,11 +1,15 @@
 module github.com/bmaupin/go-epub
 
-go 1.20
+go 1.21
 
 require (
 	github.com/gabriel-vasile/mimetype v1.4.2
 	github.com/gofrs/uuid v4.4.0+incompatible
+	github.com/spf13/afero v1.11.0
 	github.com/vincent-petithory/dataurl v1.0.0
+	golang.org/x/image v0.18.0
+	golang.org/x/text v0.16.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/net v0.13.0 // indirect
+require golang.org/x/net v0.19.0
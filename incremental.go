@@ -0,0 +1,101 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+)
+
+// Compression level of the files compressed by incremental writes, the level
+// used by the zip package
+const incrementalCompressionLevel = 5
+
+// incrementalFile is a file of the EPUB as it was compressed by the previous
+// incremental write
+type incrementalFile struct {
+	// The hash of the uncompressed content of the file
+	hash [sha256.Size]byte
+	// The header of the file in the zip archive, with the sizes and checksum
+	// of its content
+	header zip.FileHeader
+	// The compressed content of the file
+	data []byte
+}
+
+// SetIncremental enables incremental writes, for programs that write the same
+// EPUB again and again as it changes, e.g. to add the new chapters of a serial
+// to a book of hundreds of chapters. Media retrieved from URLs is kept after the
+// first write instead of being downloaded again, and the files whose content
+// hasn't changed since the previous write are added to the EPUB as they were
+// compressed then, so that only the changed documents are compressed again.
+//
+// Incremental writes build the EPUB directly, as with SetDirectWrite. The media
+// and the compressed files are held in memory between writes; to download
+// media again if it changed, use a media cache (see SetMediaCache) instead of
+// incremental writes. Disabling incremental writes releases them.
+func (e *Epub) SetIncremental(incremental bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.incremental = incremental
+	if !incremental {
+		e.incrementalFiles = nil
+		for mediaSource := range e.incrementalMedia {
+			delete(e.fetchedMedia, mediaSource)
+		}
+		e.incrementalMedia = nil
+	}
+}
+
+// writesDirectly returns whether Write builds the zip archive without storing
+// the files first
+func (e *Epub) writesDirectly() bool {
+	return e.directWrite || e.incremental || e.signer != nil
+}
+
+// writeIncremental adds a file to the zip archive, reusing the compressed
+// content of the previous write if the content of the file hasn't changed
+func (s zipSink) writeIncremental(name string, method uint16, content []byte) error {
+	hash := sha256.Sum256(content)
+	f, ok := s.previous[name]
+	if !ok || f.hash != hash || f.header.Method != method {
+		data := content
+		if method == zip.Deflate {
+			var b bytes.Buffer
+			fw, err := flate.NewWriter(&b, incrementalCompressionLevel)
+			if err != nil {
+				return err
+			}
+			if _, err := fw.Write(content); err != nil {
+				return err
+			}
+			if err := fw.Close(); err != nil {
+				return err
+			}
+			data = b.Bytes()
+		}
+		f = incrementalFile{
+			hash: hash,
+			header: zip.FileHeader{
+				Name:               name,
+				Method:             method,
+				CRC32:              crc32.ChecksumIEEE(content),
+				CompressedSize64:   uint64(len(data)),
+				UncompressedSize64: uint64(len(content)),
+			},
+			data: data,
+		}
+	}
+	s.files[name] = f
+
+	// The header is updated by the zip writer
+	header := f.header
+	w, err := s.z.CreateRaw(&header)
+	if err != nil {
+		return fmt.Errorf("error creating zip writer: %w", err)
+	}
+	_, err = w.Write(f.data)
+	return err
+}
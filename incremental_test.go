@@ -0,0 +1,132 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestSetIncremental(t *testing.T) {
+	testImage, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading image: %s", err)
+	}
+	downloads := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			downloads++
+		}
+		w.Write(testImage)
+	}))
+	defer ts.Close()
+
+	readFiles := func(t *testing.T, e *Epub) map[string]string {
+		var b bytes.Buffer
+		if _, err := e.WriteTo(&b); err != nil {
+			t.Fatalf("Unexpected error writing EPUB: %s", err)
+		}
+		r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+		if err != nil {
+			t.Fatalf("Unexpected error reading EPUB: %s", err)
+		}
+		files := make(map[string]string)
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("Unexpected error opening %s: %s", f.Name, err)
+			}
+			// The checksum of the file is checked once it's read
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("Unexpected error reading %s: %s", f.Name, err)
+			}
+			files[f.Name] = string(content)
+		}
+		return files
+	}
+
+	e := NewEpub(testEpubTitle)
+	e.SetIdentifier(testEpubIdentifier)
+	e.SetIncremental(true)
+	imagePath, err := e.AddImage(ts.URL+"/image.png", "")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	e.SetCover(imagePath, "")
+	for i := 1; i <= 3; i++ {
+		if _, err := e.AddSection(fmt.Sprintf("<p>Chapter %d</p>", i), fmt.Sprintf("Chapter %d", i), "", ""); err != nil {
+			t.Fatalf("Error adding section: %s", err)
+		}
+	}
+	readFiles(t, e)
+
+	// A new chapter is added to the EPUB
+	if _, err := e.AddSection("<p>Chapter 4</p>", "Chapter 4", "", ""); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	files := readFiles(t, e)
+	if downloads != 1 {
+		t.Errorf("Image downloaded %d times, expected 1", downloads)
+	}
+	if len(e.incrementalFiles) != len(files) {
+		t.Errorf("Got %d files kept for the next write, expected %d", len(e.incrementalFiles), len(files))
+	}
+
+	// The EPUB is the same as one written at once
+	want := NewEpub(testEpubTitle)
+	want.SetIdentifier(testEpubIdentifier)
+	want.SetDirectWrite(true)
+	imagePath, err = want.AddImage(ts.URL+"/image.png", "")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	want.SetCover(imagePath, "")
+	for i := 1; i <= 4; i++ {
+		if _, err := want.AddSection(fmt.Sprintf("<p>Chapter %d</p>", i), fmt.Sprintf("Chapter %d", i), "", ""); err != nil {
+			t.Fatalf("Error adding section: %s", err)
+		}
+	}
+	wantFiles := readFiles(t, want)
+	if len(files) != len(wantFiles) {
+		t.Errorf("Got %d files, expected %d", len(files), len(wantFiles))
+	}
+	for name, content := range wantFiles {
+		// The package file contains the modification date
+		if name == contentFolderName+"/"+pkgFilename {
+			continue
+		}
+		if files[name] != content {
+			t.Errorf("%s doesn't match the one of an EPUB written at once\nGot: %s\nExpected: %s", name, files[name], content)
+		}
+	}
+
+	if _, ok := e.fetchedMedia[ts.URL+"/image.png"]; !ok {
+		t.Error("Image not kept for the next write")
+	}
+	e.SetIncremental(false)
+	if e.incrementalFiles != nil {
+		t.Error("Compressed files still kept after disabling incremental writes")
+	}
+	if _, ok := e.fetchedMedia[ts.URL+"/image.png"]; ok {
+		t.Error("Image still kept after disabling incremental writes")
+	}
+
+	// The media retrieved when it was added is kept until the EPUB is written
+	e = NewEpub(testEpubTitle)
+	e.SetFetchMode(FetchEager)
+	e.SetIncremental(true)
+	if _, err := e.AddImage(ts.URL+"/image.png", ""); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	readFiles(t, e)
+	e.SetIncremental(false)
+	if _, ok := e.fetchedMedia[ts.URL+"/image.png"]; !ok {
+		t.Error("Image retrieved when it was added released by disabling incremental writes")
+	}
+}
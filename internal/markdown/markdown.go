@@ -0,0 +1,313 @@
+// Package markdown converts Markdown to XHTML that can be used as the body of
+// an EPUB section.
+//
+// Only the common subset of Markdown is supported: ATX and setext headings,
+// paragraphs, emphasis, code spans, indented and fenced code blocks, links, images,
+// autolinks, block quotes, nested lists, horizontal rules and hard line breaks.
+// HTML blocks and inline tags are kept as is, so they must be valid XHTML.
+package markdown
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	atxHeadingRegex     = regexp.MustCompile(`^(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	setextUnderlineRe   = regexp.MustCompile(`^(=+|-+)[ \t]*$`)
+	horizontalRuleRegex = regexp.MustCompile(`^ {0,3}((?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fenceRegex          = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([^`\\s]*)")
+	listItemRegex       = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])([ \t]+|$)`)
+	htmlBlockRegex      = regexp.MustCompile(`^ {0,3}<(?:[A-Za-z][A-Za-z0-9-]*|/[A-Za-z][A-Za-z0-9-]*|!--)`)
+
+	codeSpanRegex   = regexp.MustCompile("(`+)(.+?)(`+)")
+	inlineTagRegex  = regexp.MustCompile(`<(?:/?[A-Za-z][A-Za-z0-9-]*(?:\s+[^<>]*)?/?|!--.*?--)>`)
+	autolinkRegex   = regexp.MustCompile(`<((?:https?|mailto|ftp):[^\s<>]+)>`)
+	imageRegex      = regexp.MustCompile(`!\[([^\]]*)\]\(\s*([^\s)]*)(?:\s+"([^"]*)")?\s*\)`)
+	linkRegex       = regexp.MustCompile(`\[([^\]]*)\]\(\s*([^\s)]*)(?:\s+"([^"]*)")?\s*\)`)
+	strongRegex     = regexp.MustCompile(`\*\*([^\s*](?:.*?[^\s*])?)\*\*|\b__([^\s_](?:.*?[^\s_])?)__\b`)
+	emphasisRegex   = regexp.MustCompile(`\*([^\s*](?:[^*]*?[^\s*])?)\*|\b_([^\s_](?:[^_]*?[^\s_])?)_\b`)
+	escapedRegex    = regexp.MustCompile("\\\\([\\\\`*_{}\\[\\]()#+\\-.!<>|~\"'])")
+	hardBreakRegex  = regexp.MustCompile(`(?: {2,}|\\)\n`)
+	placeholderMark = "\x00"
+)
+
+// ToXHTML converts the Markdown document to XHTML.
+func ToXHTML(markdown string) string {
+	markdown = strings.ReplaceAll(markdown, "\r\n", "\n")
+	markdown = strings.ReplaceAll(markdown, "\r", "\n")
+	markdown = strings.ReplaceAll(markdown, "\t", "    ")
+	var b strings.Builder
+	convertBlocks(&b, strings.Split(markdown, "\n"))
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// convertBlocks writes the XHTML of the block-level elements of the lines
+func convertBlocks(b *strings.Builder, lines []string) {
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			fmt.Fprintf(b, "<p>%s</p>\n", convertInline(strings.Join(paragraph, "\n")))
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flush()
+
+		case len(paragraph) == 0 && leadingSpaces(line) >= 4:
+			// Indented code blocks can't interrupt a paragraph, and end with
+			// the first line that is less indented, blank lines excluded
+			var code []string
+			for ; i < len(lines) && (leadingSpaces(lines[i]) >= 4 || strings.TrimSpace(lines[i]) == ""); i++ {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			i--
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			fmt.Fprintf(b, "<pre><code>%s</code></pre>\n", escapeText(strings.Join(code, "\n")))
+
+		case len(paragraph) > 0 && setextUnderlineRe.MatchString(trimmed) && !listItemRegex.MatchString(line):
+			level := 1
+			if trimmed[0] == '-' {
+				level = 2
+			}
+			fmt.Fprintf(b, "<h%d>%s</h%d>\n", level, convertInline(strings.Join(paragraph, "\n")), level)
+			paragraph = nil
+
+		case horizontalRuleRegex.MatchString(line):
+			flush()
+			b.WriteString("<hr/>\n")
+
+		case atxHeadingRegex.MatchString(trimmed) && !strings.HasPrefix(line, "    "):
+			flush()
+			m := atxHeadingRegex.FindStringSubmatch(trimmed)
+			level := len(m[1])
+			fmt.Fprintf(b, "<h%d>%s</h%d>\n", level, convertInline(m[2]), level)
+
+		case fenceRegex.MatchString(line):
+			flush()
+			m := fenceRegex.FindStringSubmatch(line)
+			fence := m[1]
+			var code []string
+			for i++; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), fence) && strings.Trim(strings.TrimSpace(lines[i]), fence[:1]) == "" {
+					break
+				}
+				code = append(code, lines[i])
+			}
+			class := ""
+			if m[2] != "" {
+				class = fmt.Sprintf(` class="language-%s"`, html.EscapeString(m[2]))
+			}
+			fmt.Fprintf(b, "<pre><code%s>%s</code></pre>\n", class, escapeText(strings.Join(code, "\n")))
+
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quotedLine := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quoted = append(quoted, strings.TrimPrefix(quotedLine, " "))
+			}
+			i--
+			b.WriteString("<blockquote>\n")
+			convertBlocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+
+		case listItemRegex.MatchString(line) && (len(paragraph) == 0 || strings.TrimSpace(listItemRegex.ReplaceAllString(line, "")) != ""):
+			flush()
+			i = convertList(b, lines, i) - 1
+
+		case len(paragraph) == 0 && htmlBlockRegex.MatchString(line):
+			// HTML blocks end with a blank line
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				b.WriteString(lines[i])
+				b.WriteByte('\n')
+			}
+
+		default:
+			paragraph = append(paragraph, strings.TrimLeft(line, " "))
+		}
+	}
+	flush()
+}
+
+// convertList writes the XHTML of the list starting at lines[start] and
+// returns the index of the first line after the list
+func convertList(b *strings.Builder, lines []string, start int) int {
+	m := listItemRegex.FindStringSubmatch(lines[start])
+	ordered := m[2][0] >= '0' && m[2][0] <= '9'
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if n, err := strconv.Atoi(m[2][:len(m[2])-1]); err == nil && n != 1 {
+			tag = fmt.Sprintf(`ol start="%d"`, n)
+		}
+	}
+
+	var items [][]string
+	loose := false
+	i := start
+	for i < len(lines) {
+		m := listItemRegex.FindStringSubmatch(lines[i])
+		if m == nil || (m[2][0] >= '0' && m[2][0] <= '9') != ordered {
+			break
+		}
+		// The content of the item is indented by the width of its marker
+		indent := len(m[0])
+		if strings.TrimSpace(lines[i][len(m[0]):]) == "" {
+			indent = len(m[1]) + len(m[2]) + 1
+		}
+		item := []string{lines[i][len(m[0]):]}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if strings.TrimSpace(line) == "" {
+				// A blank line inside the item or between items makes the list
+				// loose
+				if i+1 < len(lines) && (leadingSpaces(lines[i+1]) >= indent || listItemRegex.MatchString(lines[i+1])) && strings.TrimSpace(lines[i+1]) != "" {
+					loose = true
+					item = append(item, "")
+					continue
+				}
+				break
+			}
+			if leadingSpaces(line) >= indent {
+				item = append(item, line[indent:])
+				continue
+			}
+			if listItemRegex.MatchString(line) || horizontalRuleRegex.MatchString(line) {
+				break
+			}
+			// Lazy continuation of the paragraph of the item
+			item = append(item, strings.TrimLeft(line, " "))
+		}
+		items = append(items, item)
+		if i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+			break
+		}
+	}
+
+	endTag, _, _ := strings.Cut(tag, " ")
+	fmt.Fprintf(b, "<%s>\n", tag)
+	for _, item := range items {
+		var content strings.Builder
+		convertBlocks(&content, item)
+		itemXHTML := strings.TrimSuffix(content.String(), "\n")
+		// The paragraphs of tight lists aren't wrapped in p elements
+		if !loose {
+			itemXHTML = strings.ReplaceAll(strings.ReplaceAll(itemXHTML, "<p>", ""), "</p>", "")
+		}
+		fmt.Fprintf(b, "<li>%s</li>\n", itemXHTML)
+	}
+	fmt.Fprintf(b, "</%s>\n", endTag)
+	return i
+}
+
+// leadingSpaces returns the number of spaces the line starts with
+func leadingSpaces(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// convertInline returns the XHTML of the inline elements of the text
+func convertInline(text string) string {
+	// Code spans, escaped characters, inline tags and autolinks are replaced
+	// by placeholders so that they're left alone by the other conversions
+	var kept []string
+	keep := func(s string) string {
+		kept = append(kept, s)
+		return placeholderMark + strconv.Itoa(len(kept)-1) + placeholderMark
+	}
+	text = strings.ReplaceAll(text, placeholderMark, "")
+	text = codeSpanRegex.ReplaceAllStringFunc(text, func(s string) string {
+		m := codeSpanRegex.FindStringSubmatch(s)
+		if m[1] != m[3] {
+			return s
+		}
+		return keep("<code>" + escapeText(strings.TrimSpace(m[2])) + "</code>")
+	})
+	text = escapedRegex.ReplaceAllStringFunc(text, func(s string) string {
+		return keep(escapeText(s[1:]))
+	})
+	text = autolinkRegex.ReplaceAllStringFunc(text, func(s string) string {
+		url := s[1 : len(s)-1]
+		return keep(fmt.Sprintf(`<a href="%s">%s</a>`, escapeAttribute(url), escapeText(url)))
+	})
+	text = inlineTagRegex.ReplaceAllStringFunc(text, keep)
+	text = escapeText(text)
+
+	text = imageRegex.ReplaceAllStringFunc(text, func(s string) string {
+		m := imageRegex.FindStringSubmatch(s)
+		title := ""
+		if m[3] != "" {
+			title = fmt.Sprintf(` title="%s"`, quoteAttribute(m[3]))
+		}
+		return keep(fmt.Sprintf(`<img src="%s" alt="%s"%s/>`, quoteAttribute(m[2]), quoteAttribute(m[1]), title))
+	})
+	text = linkRegex.ReplaceAllStringFunc(text, func(s string) string {
+		m := linkRegex.FindStringSubmatch(s)
+		title := ""
+		if m[3] != "" {
+			title = fmt.Sprintf(` title="%s"`, quoteAttribute(m[3]))
+		}
+		// The link is kept so that the emphasis of the URL isn't converted
+		return keep(fmt.Sprintf(`<a href="%s"%s>`, quoteAttribute(m[2]), title)) + m[1] + keep("</a>")
+	})
+	text = strongRegex.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = emphasisRegex.ReplaceAllString(text, "<em>$1$2</em>")
+	text = hardBreakRegex.ReplaceAllString(text, "<br/>\n")
+
+	// The placeholders may be nested, e.g. code spans in image descriptions
+	for strings.Contains(text, placeholderMark) {
+		text = restorePlaceholders(text, kept)
+	}
+	return text
+}
+
+// restorePlaceholders replaces the placeholders of the text with the kept
+// strings
+func restorePlaceholders(text string, kept []string) string {
+	var b strings.Builder
+	for {
+		start := strings.Index(text, placeholderMark)
+		if start == -1 {
+			b.WriteString(text)
+			return b.String()
+		}
+		end := strings.Index(text[start+1:], placeholderMark)
+		if end == -1 {
+			b.WriteString(text)
+			return b.String()
+		}
+		end += start + 1
+		b.WriteString(text[:start])
+		if n, err := strconv.Atoi(text[start+1 : end]); err == nil && n < len(kept) {
+			b.WriteString(kept[n])
+		}
+		text = text[end+1:]
+	}
+}
+
+// escapeText escapes the characters of the text that are special in XHTML
+func escapeText(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// quoteAttribute escapes the quotes of an attribute value whose other special
+// characters are already escaped
+func quoteAttribute(value string) string {
+	return strings.ReplaceAll(value, `"`, "&quot;")
+}
+
+// escapeAttribute escapes the characters of an attribute value that are
+// special in XHTML
+func escapeAttribute(value string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(value)
+}
@@ -0,0 +1,64 @@
+package markdown
+
+import "testing"
+
+func TestToXHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		want     string
+	}{
+		{
+			name:     "headings",
+			markdown: "# Title #\n\n## Sub *title*\n\nSetext\n======\n\nSetext 2\n---",
+			want:     "<h1>Title</h1>\n<h2>Sub <em>title</em></h2>\n<h1>Setext</h1>\n<h2>Setext 2</h2>",
+		},
+		{
+			name:     "paragraphs",
+			markdown: "A **bold** and *em* & <b>tag</b> line\nwith a break  \nand `a < b` code.\n\nSecond\\*paragraph\\*.",
+			want:     "<p>A <strong>bold</strong> and <em>em</em> &amp; <b>tag</b> line\nwith a break<br/>\nand <code>a &lt; b</code> code.</p>\n<p>Second*paragraph*.</p>",
+		},
+		{
+			name:     "links and images",
+			markdown: "See [the *next* chapter](ch_2_.md#top \"Next\"), ![A \"gopher\"](images/gopher.png) and <https://example.com/a_b_c>.",
+			want:     `<p>See <a href="ch_2_.md#top" title="Next">the <em>next</em> chapter</a>, <img src="images/gopher.png" alt="A &quot;gopher&quot;"/> and <a href="https://example.com/a_b_c">https://example.com/a_b_c</a>.</p>`,
+		},
+		{
+			name:     "code block",
+			markdown: "```go\nif a < b {\n\n\treturn\n}\n```",
+			want:     "<pre><code class=\"language-go\">if a &lt; b {\n\n    return\n}</code></pre>",
+		},
+		{
+			name:     "indented code block",
+			markdown: "Text\n    continued\n\n    if a < b {\n\n        return\n    }\n\nAfter",
+			want:     "<p>Text\ncontinued</p>\n<pre><code>if a &lt; b {\n\n    return\n}</code></pre>\n<p>After</p>",
+		},
+		{
+			name:     "block quote",
+			markdown: "> Quoted\n> text\n>\n> - item",
+			want:     "<blockquote>\n<p>Quoted\ntext</p>\n<ul>\n<li>item</li>\n</ul>\n</blockquote>",
+		},
+		{
+			name:     "tight nested list",
+			markdown: "- one\n- two\n  - nested\n- three\n\nAfter",
+			want:     "<ul>\n<li>one</li>\n<li>two\n<ul>\n<li>nested</li>\n</ul></li>\n<li>three</li>\n</ul>\n<p>After</p>",
+		},
+		{
+			name:     "loose ordered list",
+			markdown: "3. one\n\n4. two",
+			want:     "<ol start=\"3\">\n<li><p>one</p></li>\n<li><p>two</p></li>\n</ol>",
+		},
+		{
+			name:     "horizontal rule and HTML block",
+			markdown: "Text\n\n* * *\n\n<div class=\"note\">\n<p>Raw</p>\n</div>",
+			want:     "<p>Text</p>\n<hr/>\n<div class=\"note\">\n<p>Raw</p>\n</div>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ToXHTML(tt.markdown); got != tt.want {
+				t.Errorf("ToXHTML(%q) =\n%s\nwant:\n%s", tt.markdown, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+// Package encrypted implements the Storage interface with a wrapper that
+// encrypts the files stored in another storage
+
+package encrypted
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+)
+
+// Encrypted is a storage that encrypts the files it stores in another storage
+// with AES-GCM, using a random key that's only kept in memory. Each file is
+// encrypted as a whole, so the files are held in memory while they're read or
+// written.
+type Encrypted struct {
+	s    storage.Storage
+	aead cipher.AEAD
+
+	mu sync.Mutex
+	// The files being written, which are only encrypted and stored once
+	// they're closed
+	writing map[string]*file
+}
+
+// New returns a storage that encrypts the files it stores in s.
+func New(s storage.Storage) (*Encrypted, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Encrypted{
+		s:       s,
+		aead:    aead,
+		writing: make(map[string]*file),
+	}, nil
+}
+
+// overhead is the number of bytes added to the files by the encryption
+func (e *Encrypted) overhead() int64 {
+	return int64(e.aead.NonceSize() + e.aead.Overhead())
+}
+
+func (e *Encrypted) seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(data)+e.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (e *Encrypted) open(name string, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		// The file was created but never closed
+		return nil, nil
+	}
+	if len(data) < e.aead.NonceSize() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	plaintext, err := e.aead.Open(nil, data[:e.aead.NonceSize()], data[e.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return plaintext, nil
+}
+
+// written returns the content written so far to the file if it's being
+// written
+func (e *Encrypted) written(name string) ([]byte, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, ok := e.writing[filepath.ToSlash(name)]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), f.buf.Bytes()...), true
+}
+
+// plaintextInfo returns the description of a file with the size of its
+// plaintext
+func (e *Encrypted) plaintextInfo(info fs.FileInfo) fs.FileInfo {
+	if info.IsDir() {
+		return info
+	}
+	size := info.Size() - e.overhead()
+	if size < 0 {
+		size = 0
+	}
+	return fileInfo{FileInfo: info, size: size}
+}
+
+func (e *Encrypted) plaintextEntries(entries []fs.DirEntry) ([]fs.DirEntry, error) {
+	for i, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = fs.FileInfoToDirEntry(e.plaintextInfo(info))
+	}
+	return entries, nil
+}
+
+func (e *Encrypted) Open(name string) (fs.File, error) {
+	if data, ok := e.written(name); ok {
+		info, err := e.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return &readFile{info: info, Reader: bytes.NewReader(data)}, nil
+	}
+	f, err := e.s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if dir, ok := f.(fs.ReadDirFile); ok && info.IsDir() {
+		return &dirFile{ReadDirFile: dir, e: e}, nil
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := e.open(name, data)
+	if err != nil {
+		return nil, err
+	}
+	return &readFile{info: fileInfo{FileInfo: info, size: int64(len(plaintext))}, Reader: bytes.NewReader(plaintext)}, nil
+}
+
+func (e *Encrypted) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	sealed, err := e.seal(data)
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	return e.s.WriteFile(name, sealed, perm)
+}
+
+func (e *Encrypted) Mkdir(name string, perm fs.FileMode) error {
+	return e.s.Mkdir(name, perm)
+}
+
+func (e *Encrypted) RemoveAll(name string) error {
+	return e.s.RemoveAll(name)
+}
+
+func (e *Encrypted) Create(name string) (storage.File, error) {
+	w, err := e.s.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	f := &file{e: e, name: filepath.ToSlash(name), w: w}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.writing[f.name] = f
+	return f, nil
+}
+
+func (e *Encrypted) Stat(name string) (fs.FileInfo, error) {
+	info, err := fs.Stat(e.s, name)
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := e.written(name); ok {
+		return fileInfo{FileInfo: info, size: int64(len(data))}, nil
+	}
+	return e.plaintextInfo(info), nil
+}
+
+// ReadDir reads the named directory
+// and returns a list of directory entries sorted by filename.
+func (e *Encrypted) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(e.s, name)
+	if err != nil {
+		return nil, err
+	}
+	return e.plaintextEntries(entries)
+}
+
+// fileInfo describes a file with the size of its plaintext
+type fileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i fileInfo) Size() int64 {
+	return i.size
+}
+
+// readFile is a decrypted file opened for reading
+type readFile struct {
+	info fs.FileInfo
+	*bytes.Reader
+}
+
+func (f *readFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *readFile) Close() error               { return nil }
+
+// dirFile is a directory opened for reading
+type dirFile struct {
+	fs.ReadDirFile
+	e *Encrypted
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.ReadDirFile.ReadDir(n)
+	if err != nil {
+		return entries, err
+	}
+	return d.e.plaintextEntries(entries)
+}
+
+// file is a file created for writing. Its content is encrypted and written
+// once it's closed, until then it's read from the buffer.
+type file struct {
+	e    *Encrypted
+	name string
+	w    storage.File
+	buf  bytes.Buffer
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	f.e.mu.Lock()
+	defer f.e.mu.Unlock()
+	return f.buf.Write(p)
+}
+
+func (f *file) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.e.Stat(f.name)
+}
+
+func (f *file) Close() error {
+	f.e.mu.Lock()
+	if f.e.writing[f.name] != f {
+		f.e.mu.Unlock()
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	delete(f.e.writing, f.name)
+	data := f.buf.Bytes()
+	f.e.mu.Unlock()
+
+	sealed, err := f.e.seal(data)
+	if err != nil {
+		f.w.Close()
+		return &fs.PathError{Op: "close", Path: f.name, Err: err}
+	}
+	if _, err := f.w.Write(sealed); err != nil {
+		f.w.Close()
+		return err
+	}
+	return f.w.Close()
+}
@@ -0,0 +1,67 @@
+package encrypted
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+	"github.com/bmaupin/go-epub/internal/storage/memory"
+)
+
+func TestEncrypted(t *testing.T) {
+	mem := memory.NewMemory()
+	fs, err := New(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(path.Join("dir", "written"), []byte("secret"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create(path.Join("dir", "created"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("secret"))
+
+	// The files being written can be read
+	assertContent(t, fs, path.Join("dir", "created"), "secret")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"written", "created"} {
+		assertContent(t, fs, path.Join("dir", name), "secret")
+		stored, err := storage.ReadFile(mem, path.Join("dir", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(stored, []byte("secret")) {
+			t.Errorf("%s stored in plaintext", name)
+		}
+	}
+	if err := fstest.TestFS(fs, "dir/written", "dir/created"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertContent(t *testing.T, fs *Encrypted, name string, expected string) {
+	t.Helper()
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatalf("open error: %v", err)
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("readall error: %v", err)
+	}
+	if string(content) != expected {
+		t.Fatalf("unexpected content: unexpected '%s', got '%s'", expected, string(content))
+	}
+}
@@ -0,0 +1,255 @@
+// Package hybrid implements the Storage interface with a filesystem that keeps
+// small files in memory and spills large files to the os' filesystem
+
+package hybrid
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+	"github.com/bmaupin/go-epub/internal/storage/memory"
+)
+
+// Hybrid is a filesystem that keeps the directories and the files up to a size
+// in memory, and the larger files in a directory of the os' filesystem.
+type Hybrid struct {
+	mem       *memory.Memory
+	rootDir   string
+	threshold int64
+
+	mu sync.Mutex
+	// The files spilled to the os' filesystem. They're kept in memory as empty
+	// files, so that the directories are complete.
+	spilled map[string]bool
+}
+
+// NewHybrid returns a filesystem that spills the files larger than threshold
+// bytes to rootDir. The files are spilled to the same path as in the
+// filesystem, so the files at the root should be directories with unique names.
+func NewHybrid(rootDir string, threshold int64) *Hybrid {
+	return &Hybrid{
+		mem:       memory.NewMemory(),
+		rootDir:   rootDir,
+		threshold: threshold,
+		spilled:   make(map[string]bool),
+	}
+}
+
+// diskPath returns the path of the file in the os' filesystem
+func (h *Hybrid) diskPath(name string) string {
+	return filepath.Join(h.rootDir, filepath.FromSlash(name))
+}
+
+func (h *Hybrid) isSpilled(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.spilled[filepath.ToSlash(name)]
+}
+
+func (h *Hybrid) setSpilled(name string, spilled bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if spilled {
+		h.spilled[filepath.ToSlash(name)] = true
+	} else {
+		delete(h.spilled, filepath.ToSlash(name))
+	}
+}
+
+// spill creates the file in the os' filesystem, and truncates it in memory
+func (h *Hybrid) spill(name string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(h.diskPath(name)), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(h.diskPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.mem.Create(name); err != nil {
+		f.Close()
+		return nil, err
+	}
+	h.setSpilled(name, true)
+	return f, nil
+}
+
+// unspill removes the file from the os' filesystem if it was spilled
+func (h *Hybrid) unspill(name string) error {
+	if !h.isSpilled(name) {
+		return nil
+	}
+	h.setSpilled(name, false)
+	if err := os.Remove(h.diskPath(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (h *Hybrid) Open(name string) (fs.File, error) {
+	if h.isSpilled(name) {
+		return os.Open(h.diskPath(name))
+	}
+	f, err := h.mem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir, ok := f.(fs.ReadDirFile); ok {
+		return &dirFile{ReadDirFile: dir, h: h, name: name}, nil
+	}
+	return f, nil
+}
+
+func (h *Hybrid) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if int64(len(data)) <= h.threshold {
+		if err := h.unspill(name); err != nil {
+			return err
+		}
+		return h.mem.WriteFile(name, data, perm)
+	}
+	f, err := h.spill(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (h *Hybrid) Mkdir(name string, perm fs.FileMode) error {
+	return h.mem.Mkdir(name, perm)
+}
+
+func (h *Hybrid) RemoveAll(name string) error {
+	if err := h.mem.RemoveAll(name); err != nil {
+		return err
+	}
+	prefix := filepath.ToSlash(name) + "/"
+	h.mu.Lock()
+	for spilled := range h.spilled {
+		if spilled == filepath.ToSlash(name) || strings.HasPrefix(spilled, prefix) {
+			delete(h.spilled, spilled)
+		}
+	}
+	h.mu.Unlock()
+	return os.RemoveAll(h.diskPath(name))
+}
+
+func (h *Hybrid) Create(name string) (storage.File, error) {
+	if err := h.unspill(name); err != nil {
+		return nil, err
+	}
+	f, err := h.mem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &file{h: h, name: name, mem: f}, nil
+}
+
+func (h *Hybrid) Stat(name string) (fs.FileInfo, error) {
+	if h.isSpilled(name) {
+		return os.Stat(h.diskPath(name))
+	}
+	return h.mem.Stat(name)
+}
+
+// ReadDir reads the named directory
+// and returns a list of directory entries sorted by filename.
+func (h *Hybrid) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := h.mem.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return h.spilledEntries(name, entries)
+}
+
+// spilledEntries replaces the entries of the directory that were spilled to the
+// os' filesystem with the entries of the spilled files
+func (h *Hybrid) spilledEntries(name string, entries []fs.DirEntry) ([]fs.DirEntry, error) {
+	for i, entry := range entries {
+		entryName := path.Join(filepath.ToSlash(name), entry.Name())
+		if h.isSpilled(entryName) {
+			info, err := os.Stat(h.diskPath(entryName))
+			if err != nil {
+				return nil, err
+			}
+			entries[i] = fs.FileInfoToDirEntry(info)
+		}
+	}
+	return entries, nil
+}
+
+// dirFile is a directory of a Hybrid filesystem returned by Open
+type dirFile struct {
+	fs.ReadDirFile
+	h    *Hybrid
+	name string
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.ReadDirFile.ReadDir(n)
+	if err != nil {
+		return entries, err
+	}
+	return d.h.spilledEntries(d.name, entries)
+}
+
+// file is a file created in a Hybrid filesystem. It's written in memory until
+// it grows larger than the threshold, then it's spilled to the os' filesystem.
+type file struct {
+	h    *Hybrid
+	name string
+	size int64
+	mem  storage.File
+	disk *os.File
+}
+
+// current returns the file where the content is written
+func (f *file) current() storage.File {
+	if f.disk != nil {
+		return f.disk
+	}
+	return f.mem
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if f.disk == nil && f.size+int64(len(p)) > f.h.threshold {
+		content, err := storage.ReadFile(f.h.mem, f.name)
+		if err != nil {
+			return 0, err
+		}
+		disk, err := f.h.spill(f.name)
+		if err != nil {
+			return 0, err
+		}
+		f.disk = disk
+		if _, err := f.disk.Write(content); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.current().Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	return f.current().Read(b)
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.current().Stat()
+}
+
+func (f *file) Close() error {
+	if f.disk != nil {
+		return f.disk.Close()
+	}
+	return f.mem.Close()
+}
@@ -0,0 +1,61 @@
+package hybrid
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestHybrid(t *testing.T) {
+	root := t.TempDir()
+	fs := NewHybrid(root, 4)
+	if err := fs.Mkdir("dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(path.Join("dir", "small"), []byte("abc"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(path.Join("dir", "large"), []byte("abcdef"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create(path.Join("dir", "created"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("abc"))
+	f.Write([]byte("def"))
+	f.Close()
+
+	for name, spilled := range map[string]bool{"small": false, "large": true, "created": true} {
+		_, err := os.Stat(filepath.Join(root, "dir", name))
+		if spilled != (err == nil) {
+			t.Errorf("%s: got spilled %t, expected %t", name, err == nil, spilled)
+		}
+	}
+	f2, err := fs.Open(path.Join("dir", "created"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(f2)
+	f2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, []byte("abcdef")) {
+		t.Errorf("unexpected content: unexpected 'abcdef', got '%s'", content)
+	}
+	if err := fstest.TestFS(fs, "dir/small", "dir/large", "dir/created"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.RemoveAll("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "dir")); !os.IsNotExist(err) {
+		t.Errorf("spilled files left after RemoveAll: %v", err)
+	}
+}
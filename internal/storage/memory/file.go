@@ -1,17 +1,57 @@
 package memory
 
 import (
+	"errors"
 	"io"
 	"io/fs"
+	"sort"
+	"sync"
 	"time"
 )
 
+// file is a file or directory of the memory filesystem. The files returned by
+// Open are copies of the files of the filesystem, so that each of them has its
+// own read state.
 type file struct {
+	mu      sync.Mutex
 	name    string
 	modTime time.Time
 	offset  int
 	content []byte
 	mode    fs.FileMode
+	// The files of a directory, by name
+	children map[string]*file
+	// The entries left to be read by ReadDir in a directory returned by Open
+	entries []fs.DirEntry
+}
+
+// open returns a copy of f to be returned by Open. The content is shared, as
+// it's only ever appended to.
+func (f *file) open() *file {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	opened := &file{
+		name:    f.name,
+		modTime: f.modTime,
+		content: f.content,
+		mode:    f.mode,
+	}
+	if f.IsDir() {
+		opened.entries = f.sortedChildren()
+	}
+	return opened
+}
+
+// sortedChildren returns the files of the directory sorted by name
+func (f *file) sortedChildren() []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(f.children))
+	for _, child := range f.children {
+		entries = append(entries, child)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
 }
 
 func (f *file) Info() (fs.FileInfo, error) {
@@ -23,9 +63,14 @@ func (f *file) Stat() (fs.FileInfo, error) {
 }
 
 func (f *file) Read(b []byte) (int, error) {
+	if f.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	length := len(f.content)
 	start := f.offset
-	if start == length {
+	if start >= length {
 		return 0, io.EOF
 	}
 	end := start + len(b)
@@ -37,12 +82,58 @@ func (f *file) Read(b []byte) (int, error) {
 	return count, nil
 }
 
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(f.offset)
+	case io.SeekEnd:
+		offset += int64(len(f.content))
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = int(offset)
+	return offset, nil
+}
+
+// ReadDir reads the files of a directory returned by Open
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
 func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.offset = 0
 	return nil
 }
 
 func (f *file) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.content = append(f.content, p...)
 	return len(p), nil
 }
@@ -52,6 +143,8 @@ func (f *file) Name() string {
 }
 
 func (f *file) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return int64(len(f.content))
 }
 
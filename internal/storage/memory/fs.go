@@ -3,28 +3,57 @@ package memory
 import (
 	"io/fs"
 	"path"
-	"strings"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/bmaupin/go-epub/internal/storage"
 )
 
+// Memory is a filesystem in memory. It's a conformant fs.FS, and safe for
+// concurrent use.
 type Memory struct {
+	mu sync.RWMutex
+	// The files and directories, by path. The root directory is "."
 	fs map[string]*file
 }
 
 func NewMemory() *Memory {
 	return &Memory{
 		fs: map[string]*file{
-			"/": {
-				name:    path.Base("/"),
-				modTime: time.Now(),
-				mode:    fs.ModeDir | (0666),
+			".": {
+				name:     ".",
+				modTime:  time.Now(),
+				mode:     fs.ModeDir | (0666),
+				children: make(map[string]*file),
 			},
 		},
 	}
 }
 
+// cleanName returns the slash-separated version of name
+func cleanName(name string) string {
+	return filepath.ToSlash(name)
+}
+
+// add adds f to the filesystem as name, replacing the existing file if there's
+// one. The parent directory of name must exist.
+func (m *Memory) add(op string, name string, f *file) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	parent, ok := m.fs[path.Dir(name)]
+	if !ok || !parent.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if existing, ok := m.fs[name]; ok && existing.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	m.fs[name] = f
+	parent.children[f.name] = f
+	return nil
+}
+
 // Open opens the named file.
 //
 // When Open returns an error, it should be of type *PathError
@@ -35,83 +64,112 @@ func NewMemory() *Memory {
 // ValidPath(name), returning a *PathError with Err set to
 // ErrInvalid or ErrNotExist.
 func (m *Memory) Open(name string) (fs.File, error) {
-	var f fs.File
-	var ok bool
-	if f, ok = m.fs[name]; !ok {
-		return nil, fs.ErrNotExist
+	name = cleanName(name)
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
 	}
-	return f, nil
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.fs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.open(), nil
 }
 
 // WriteFile writes data to the named file, creating it if necessary. If the file does not exist, WriteFile creates it with permissions perm (before umask); otherwise WriteFile truncates it before writing, without changing permissions.
 func (m *Memory) WriteFile(name string, data []byte, perm fs.FileMode) error {
-	if !fs.ValidPath(name) {
-		return fs.ErrInvalid
-	}
-	f := &file{
+	name = cleanName(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.add("write", name, &file{
 		name:    path.Base(name),
 		modTime: time.Now(),
 		mode:    (perm),
 		content: data,
-	}
-	m.fs[name] = f
-	return nil
+	})
 }
 
 // Mkdir creates a new directory with the specified name and permission bits (before umask). If there is an error, it will be of type *PathError.
 func (m *Memory) Mkdir(name string, perm fs.FileMode) error {
-	if !fs.ValidPath(path.Base(name)) {
-		return fs.ErrInvalid
+	name = cleanName(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.fs[name]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
 	}
-	f := &file{
-		name:    path.Base(name),
-		modTime: time.Now(),
-		mode:    fs.ModeDir | (perm),
-	}
-	m.fs[name] = f
-	return nil
+	return m.add("mkdir", name, &file{
+		name:     path.Base(name),
+		modTime:  time.Now(),
+		mode:     fs.ModeDir | (perm),
+		children: make(map[string]*file),
+	})
 }
 
 // RemoveAll removes path and any children it contains. It removes everything it can but returns the first error it encounters. If the path does not exist, RemoveAll returns nil (no error). If there is an error, it will be of type *PathError.
 func (m *Memory) RemoveAll(name string) error {
-	for k := range m.fs {
-		if strings.HasPrefix(k, name) {
-			delete(m.fs, k)
-		}
+	name = cleanName(name)
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "removeall", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.fs[name]
+	if !ok {
+		return nil
 	}
+	delete(m.fs[path.Dir(name)].children, f.name)
+	m.remove(name, f)
 	return nil
 }
 
+// remove removes the file f named name and its children from the filesystem
+func (m *Memory) remove(name string, f *file) {
+	for childName, child := range f.children {
+		m.remove(path.Join(name, childName), child)
+	}
+	delete(m.fs, name)
+}
+
 // Create creates or truncates the named file. If the file already exists, it is truncated. If the file does not exist, it is created with mode 0666 (before umask). If successful, methods on the returned File can be used for I/O; the associated file descriptor has mode O_RDWR. If there is an error, it will be of type *PathError.
 func (m *Memory) Create(name string) (storage.File, error) {
-	if !fs.ValidPath(path.Base(name)) {
-		return nil, fs.ErrInvalid
-	}
+	name = cleanName(name)
 	f := &file{
 		name:    path.Base(name),
 		modTime: time.Now(),
 		mode:    0666,
 	}
-	m.fs[name] = f
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.add("create", name, f); err != nil {
+		return nil, err
+	}
 	return f, nil
 }
 
 // ReadDir reads the named directory
 // and returns a list of directory entries sorted by filename.
 func (m *Memory) ReadDir(name string) ([]fs.DirEntry, error) {
-	output := make([]fs.DirEntry, 0)
-	for k, v := range m.fs {
-		if path.Dir(k) == name {
-			output = append(output, v)
-		}
+	name = cleanName(name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.fs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !f.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
 	}
-	return output, nil
+	return f.sortedChildren(), nil
 }
 
 // Stat returns a FileInfo describing the file.
 // If there is an error, it should be of type *PathError.
 // This makes Memory compatible with the StatFS interface
 func (m *Memory) Stat(name string) (fs.FileInfo, error) {
+	name = cleanName(name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	f, ok := m.fs[name]
 	if !ok {
 		return nil, &fs.PathError{
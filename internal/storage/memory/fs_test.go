@@ -1,10 +1,13 @@
 package memory
 
 import (
+	"errors"
+	iofs "io/fs"
 	"io/ioutil"
 	"path"
 	"path/filepath"
 	"testing"
+	"testing/fstest"
 )
 
 func TestMemory_Mkdir(t *testing.T) {
@@ -156,3 +159,66 @@ func assertPrefix(t *testing.T, fs *Memory, prefix string) {
 		t.Fatalf("unexpected content: unexpected '%s', got '%s'", prefix, string(b))
 	}
 }
+
+func TestMemory_TestFS(t *testing.T) {
+	fs := NewMemory()
+	if err := fs.Mkdir("dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir(path.Join("dir", "empty"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(path.Join("dir", "a.txt"), []byte("a"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("bb"))
+	if err := fstest.TestFS(fs, "dir/empty", "dir/a.txt", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemory_MissingParent(t *testing.T) {
+	fs := NewMemory()
+	if err := fs.WriteFile(path.Join("missing", "test"), []byte{}, 0666); !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("got error %v writing a file in a missing directory, expected ErrNotExist", err)
+	}
+	if _, err := fs.Create(path.Join("missing", "test")); !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("got error %v creating a file in a missing directory, expected ErrNotExist", err)
+	}
+	if err := fs.Mkdir(path.Join("missing", "test"), 0777); !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("got error %v creating a directory in a missing directory, expected ErrNotExist", err)
+	}
+}
+
+func TestMemory_OpenReadState(t *testing.T) {
+	fs := NewMemory()
+	if err := fs.WriteFile("test", []byte("content"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f1, _ := fs.Open("test")
+	f2, _ := fs.Open("test")
+	ioutil.ReadAll(f1)
+	content, err := ioutil.ReadAll(f2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Fatalf("unexpected content: unexpected 'content', got '%s'", string(content))
+	}
+}
+
+func TestMemory_RemoveAllSiblings(t *testing.T) {
+	fs := NewMemory()
+	fs.Mkdir("dir", 0777)
+	fs.Mkdir("dir2", 0777)
+	if err := fs.RemoveAll("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("dir2"); err != nil {
+		t.Errorf("dir2 removed with dir: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+)
+
+var (
+	// kindleMediaRegexp matches the audio and video elements of sections, the
+	// first group being the fallback content of audio elements and the second
+	// one the fallback content of video elements
+	kindleMediaRegexp = regexp.MustCompile(`(?is)<(?:audio|video)\b[^>]*?/>|<audio\b[^>]*>(.*?)</audio\s*>|<video\b[^>]*>(.*?)</video\s*>`)
+	// kindleMediaSourceRegexp matches the source and track elements of the
+	// fallback content of audio and video elements
+	kindleMediaSourceRegexp = regexp.MustCompile(`(?is)<(?:source|track)\b[^>]*?(?:/>|>\s*</(?:source|track)\s*>)`)
+	// kindleAnchorRegexp matches the links of sections, the first group being
+	// their target and the second one their content
+	kindleAnchorRegexp = regexp.MustCompile(`(?is)<a\b[^>]*?\shref\s*=\s*["']([^"']*)["'][^>]*>(.*?)</a\s*>`)
+)
+
+// SetKindleCompatibility sets whether the EPUB is written so that it's accepted
+// by Kindle ingestion (e.g. Send to Kindle or KDP), which rejects or breaks on
+// some features of EPUB 3:
+//   - Audio and video files, including remote ones (see AddRemoteVideo), are
+//     left out. The audio and video elements of the sections are replaced by
+//     their fallback content, and the links to the files by their content.
+//     Audio tracks (see AddAudioTrack) are replaced by their page, and media
+//     overlays (see AddMediaOverlay) are left out.
+//   - The declarations of the CSS files known to break the rendering on Kindle
+//     (see LintCSS) are removed.
+//   - A cover page that uses an SVG element (e.g. SVGCoverTemplate) is
+//     replaced by the default cover page.
+//
+// Whether the mode is set or not, the cover image is identified the way Kindle
+// expects, by the cover-image property and the EPUB 2 cover meta element. The
+// changes are reported as warnings of type WarningKindleUnsupported when the
+// EPUB is written, along with the features that can't be changed, e.g. an SVG
+// cover image or scripts (see KindleIssues). The EPUB itself isn't changed,
+// except for the cover page.
+func (e *Epub) SetKindleCompatibility(enabled bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.kindle = enabled
+}
+
+// KindleIssues returns the features of the EPUB that Kindle doesn't support,
+// as warnings of type WarningKindleUnsupported, e.g. to warn users before they
+// export the EPUB to KDP. Most of them are left out or changed in Kindle
+// compatibility mode (see SetKindleCompatibility), but nothing is changed by
+// KindleIssues. The CSS files are retrieved from their source, and an error is
+// returned if one can't be retrieved.
+func (e *Epub) KindleIssues() ([]Warning, error) {
+	e.Lock()
+	defer e.Unlock()
+	return e.kindleIssues(context.Background())
+}
+
+func (e *Epub) kindleIssues(ctx context.Context) ([]Warning, error) {
+	issues := []Warning{}
+	add := func(name string, format string, a ...interface{}) {
+		issues = append(issues, Warning{Type: WarningKindleUnsupported, Path: name, Message: fmt.Sprintf(format, a...)})
+	}
+
+	for _, mediaFolderName := range []string{AudioFolderName, VideoFolderName} {
+		for _, filename := range sortedMediaFilenames(mediaFolderName, e.mediaFolders()[mediaFolderName], nil) {
+			add(path.Join(contentFolderName, mediaFolderName, filename), "audio and video aren't supported by Kindle")
+		}
+	}
+	remoteSources := make([]string, 0, len(e.remoteMedia))
+	for source := range e.remoteMedia {
+		remoteSources = append(remoteSources, source)
+	}
+	sort.Strings(remoteSources)
+	for _, source := range remoteSources {
+		add(source, "audio and video aren't supported by Kindle")
+	}
+
+	g := e.grabber()
+	for _, cssFilename := range sortedMediaFilenames(CSSFolderName, e.css, nil) {
+		css, err := g.readMedia(ctx, e.css[cssFilename])
+		if err != nil {
+			return nil, err
+		}
+		cssIssues, _ := lintCSS(path.Join(CSSFolderName, cssFilename), string(css), nil)
+		for _, issue := range cssIssues {
+			if issue.Type == CSSUnsupportedProperty {
+				add(path.Join(contentFolderName, CSSFolderName, cssFilename), "line %d: %s", issue.Line, issue.Message)
+			}
+		}
+	}
+
+	if e.cover.imageFilename != "" && strings.EqualFold(path.Ext(e.cover.imageFilename), ".svg") {
+		add(path.Join(contentFolderName, ImageFolderName, e.cover.imageFilename), "SVG cover images are rejected by Kindle, a JPEG or PNG image is needed")
+	}
+	e.forEachSection(func(s *epubSection) {
+		name := path.Join(contentFolderName, xhtmlFolderName, s.filename)
+		body := strings.ToLower(s.xhtml.xml.Body.XML)
+		switch {
+		case s.filename == e.cover.xhtmlFilename && strings.Contains(body, "<svg"):
+			add(name, "SVG cover pages are rejected by Kindle")
+		case s.mediaOverlay != nil:
+			add(name, "media overlays aren't supported by Kindle")
+		}
+		if strings.Contains(body, "<script") {
+			add(name, "scripts aren't supported by Kindle")
+		}
+	})
+	return issues, nil
+}
+
+// prepareKindleWrite reports the Kindle issues of the EPUB as warnings and
+// replaces an SVG cover page by the default one, in Kindle compatibility mode.
+// The audio and video files are added to the orphans, which are left out.
+func (e *Epub) prepareKindleWrite(ctx context.Context, orphans map[string]bool) error {
+	if !e.kindle {
+		return nil
+	}
+	issues, err := e.kindleIssues(ctx)
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		e.addWarning(issue.Type, issue.Path, "%s", issue.Message)
+	}
+
+	for _, mediaFolderName := range []string{AudioFolderName, VideoFolderName} {
+		for filename := range e.mediaFolders()[mediaFolderName] {
+			orphans[path.Join(mediaFolderName, filename)] = true
+		}
+	}
+	if cover := e.findSection(e.cover.xhtmlFilename); cover != nil && strings.Contains(strings.ToLower(cover.xhtml.xml.Body.XML), "<svg") {
+		coverBody, err := executeCoverTemplate(nil, "../"+ImageFolderName+"/"+e.cover.imageFilename, e.title)
+		if err != nil {
+			return err
+		}
+		cover.xhtml.setBody(coverBody)
+	}
+	return nil
+}
+
+// kindleFileWriter returns an epubFileWriter that writes the sections without
+// their audio and video elements and links, for Kindle compatibility mode
+func kindleFileWriter(w epubFileWriter) epubFileWriter {
+	return func(name string, mediaType string, content []byte) error {
+		if mediaType == mediaTypeXhtml {
+			content = kindleSection(content)
+		}
+		return w(name, mediaType, content)
+	}
+}
+
+// kindleSection returns the content of the XHTML file of a section without its
+// audio and video elements, replaced by their fallback content, and without
+// its links to audio and video files, replaced by their content
+func kindleSection(content []byte) []byte {
+	content = kindleMediaRegexp.ReplaceAllFunc(content, func(element []byte) []byte {
+		m := kindleMediaRegexp.FindSubmatch(element)
+		fallback := append(append([]byte(nil), m[1]...), m[2]...)
+		return kindleMediaSourceRegexp.ReplaceAll(fallback, nil)
+	})
+	return kindleAnchorRegexp.ReplaceAllFunc(content, func(anchor []byte) []byte {
+		m := kindleAnchorRegexp.FindSubmatch(anchor)
+		linkPath := resolveLink(path.Join(xhtmlFolderName, "section.xhtml"), string(m[1]))
+		if folderName, _, _ := strings.Cut(linkPath, "/"); folderName != AudioFolderName && folderName != VideoFolderName {
+			return anchor
+		}
+		return m[2]
+	})
+}
+
+// kindleCSSFile removes the declarations known to break the rendering on
+// Kindle from the CSS file at the path of the storage
+func kindleCSSFile(filesystem storage.Storage, cssFilePath string) error {
+	css, err := storage.ReadFile(filesystem, cssFilePath)
+	if err != nil {
+		return err
+	}
+	return filesystem.WriteFile(cssFilePath, kindleCSS(css), filePermissions)
+}
+
+// kindleCSS returns the CSS without the declarations known to break the
+// rendering on Kindle
+func kindleCSS(css []byte) []byte {
+	_, unsupported := lintCSS("", string(css), nil)
+	for i := len(unsupported) - 1; i >= 0; i-- {
+		css = append(css[:unsupported[i].start:unsupported[i].start], css[unsupported[i].end:]...)
+	}
+	return css
+}
@@ -0,0 +1,210 @@
+package epub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKindleCSS = `body { margin: 0; }
+.banner { position: fixed; color: red; }
+`
+
+// newTestKindleEpub returns an EPUB using features Kindle doesn't support
+func newTestKindleEpub(t *testing.T) *Epub {
+	t.Helper()
+	e := NewEpub(testEpubTitle)
+	imagePath, err := e.AddImage(testImageFromFileSource, "cover.png")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := e.SetCoverTemplate(SVGCoverTemplate); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e.SetCover(imagePath, "")
+	cssPath, err := e.AddCSSFromString(testKindleCSS, "kindle.css")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	audioPath, err := e.AddAudio(testAudioFromFileSource, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	body := `<p>Listen</p><audio controls="controls" src="` + audioPath + `"><source src="` + audioPath + `" type="audio/wav"/>` +
+		`<p>Your reader can't play <a href="` + audioPath + `">the audio</a>.</p></audio><video src="../videos/missing.mp4"/>` +
+		`<p><a href="section0001.xhtml">Back</a></p>`
+	if _, err := e.AddSection(body, testSectionTitle, "section0002.xhtml", cssPath); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return e
+}
+
+func TestKindleIssues(t *testing.T) {
+	e := newTestKindleEpub(t)
+	if _, err := e.AddAudioTrack(testAudioFromFileSource, "Chapter 1", time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection(`<p>Script</p><script>alert(1)</script>`, "Script", "script.xhtml", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	issues, err := e.KindleIssues()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := map[string]string{
+		"EPUB/audios/sample_audio.wav": "audio and video aren't supported by Kindle",
+		"EPUB/audios/audio0002.wav":    "audio and video aren't supported by Kindle",
+		"EPUB/css/kindle.css":          "line 2: ",
+		"EPUB/xhtml/cover.xhtml":       "SVG cover pages are rejected by Kindle",
+		"EPUB/xhtml/script.xhtml":      "scripts aren't supported by Kindle",
+	}
+	if len(issues) != len(expected) {
+		t.Errorf("Got %d issues, expected %d: %+v", len(issues), len(expected), issues)
+	}
+	for _, issue := range issues {
+		if issue.Type != WarningKindleUnsupported {
+			t.Errorf("Issue %+v has type %v, expected %v", issue, issue.Type, WarningKindleUnsupported)
+		}
+		if message, ok := expected[issue.Path]; !ok || !strings.HasPrefix(issue.Message, message) {
+			t.Errorf("Unexpected issue %+v", issue)
+		}
+	}
+	// Nothing is changed
+	for _, w := range e.Warnings() {
+		if w.Type == WarningKindleUnsupported {
+			t.Errorf("Unexpected warning %+v", w)
+		}
+	}
+	if !strings.Contains(e.sections[0].xhtml.xml.Body.XML, "<svg") {
+		t.Error("Cover page was changed by KindleIssues")
+	}
+}
+
+func TestKindleIssuesSVGCover(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	imagePath, err := e.AddImage("testdata/cover.svg", "cover.svg")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e.SetCover(imagePath, "")
+	issues, err := e.KindleIssues()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(issues) != 1 || issues[0].Path != "EPUB/images/cover.svg" {
+		t.Errorf("Unexpected issues: %+v", issues)
+	}
+}
+
+func TestSetKindleCompatibility(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("./testdata/")))
+	defer server.Close()
+
+	e := newTestKindleEpub(t)
+	if _, err := e.AddRemoteVideo(server.URL+"/sample_640x360.mp4", "video/mp4"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e.SetKindleCompatibility(true)
+	r := newTestReader(t, e)
+
+	if _, err := r.ReadFile("EPUB/audios/sample_audio.wav"); err == nil {
+		t.Error("Audio file written in Kindle compatibility mode")
+	}
+
+	section, err := r.ReadFile("EPUB/xhtml/section0002.xhtml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, unexpected := range []string{"<audio", "<video", "<source", "sample_audio.wav"} {
+		if strings.Contains(string(section), unexpected) {
+			t.Errorf("Section contains %s:\n%s", unexpected, section)
+		}
+	}
+	for _, expected := range []string{
+		`<p>Your reader can't play the audio.</p>`,
+		`<a href="section0001.xhtml">Back</a>`,
+	} {
+		if !strings.Contains(string(section), expected) {
+			t.Errorf("Section doesn't contain %s:\n%s", expected, section)
+		}
+	}
+
+	css, err := r.ReadFile("EPUB/css/kindle.css")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(string(css), "position") || !strings.Contains(string(css), "color: red;") {
+		t.Errorf("Unexpected CSS:\n%s", css)
+	}
+
+	cover, err := r.ReadFile("EPUB/xhtml/cover.xhtml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(string(cover), "<svg") || !strings.Contains(string(cover), `<img src="../images/cover.png"`) {
+		t.Errorf("Unexpected cover page:\n%s", cover)
+	}
+
+	opf, err := r.ReadFile("EPUB/package.opf")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, unexpected := range []string{"remote-resources", server.URL, "audios/"} {
+		if strings.Contains(string(opf), unexpected) {
+			t.Errorf("Package file contains %s:\n%s", unexpected, opf)
+		}
+	}
+	if !strings.Contains(string(opf), `<meta name="cover" content="cover.png"></meta>`) {
+		t.Errorf("Package file doesn't contain the cover meta:\n%s", opf)
+	}
+
+	warnings := 0
+	for _, w := range e.Warnings() {
+		if w.Type == WarningKindleUnsupported {
+			warnings++
+		}
+	}
+	if warnings != 4 {
+		t.Errorf("Got %d Kindle warnings, expected 4: %+v", warnings, e.Warnings())
+	}
+}
+
+func TestSetKindleCompatibilityAudioTrack(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	trackPath, err := e.AddAudioTrack(testAudioFromFileSource, "Chapter 1", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	audioPath, err := e.AddAudio(testAudioFromFileSource, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := e.AddMediaOverlay(trackPath, []MediaOverlayClip{{TextID: "h1", Audio: audioPath, End: time.Second}}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e.SetKindleCompatibility(true)
+
+	opf, err := e.DumpOPF()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, unexpected := range []string{"media:duration", "media-overlay", ".smil", "audio/wav"} {
+		if strings.Contains(opf, unexpected) {
+			t.Errorf("Package file contains %s:\n%s", unexpected, opf)
+		}
+	}
+	if !strings.Contains(opf, `<itemref idref="`+trackPath+`"></itemref>`) {
+		t.Errorf("Track page not in the spine:\n%s", opf)
+	}
+}
+
+func TestKindleCSS(t *testing.T) {
+	css := "a { position: fixed; color: blue }\nb { position:fixed }\n"
+	expected := "a {  color: blue }\nb { }\n"
+	if got := string(kindleCSS([]byte(css))); got != expected {
+		t.Errorf("Got %q, expected %q", got, expected)
+	}
+}
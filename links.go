@@ -0,0 +1,272 @@
+package epub
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// linkAttributeRegex matches the attributes of XHTML elements that reference
+// other files, e.g. href="section0001.xhtml" or src="../images/image0001.png".
+// The first group is everything up to the value, the second group is the quote
+// and the third group is the value itself.
+var linkAttributeRegex = regexp.MustCompile(`(\s(?:href|src|poster|xlink:href)\s*=\s*)(["'])(.*?)["']`)
+
+// rewriteLinks calls fn for each link found in the XHTML body and replaces the
+// link with the value returned by fn
+func rewriteLinks(body string, fn func(link string) string) string {
+	return linkAttributeRegex.ReplaceAllStringFunc(body, func(attr string) string {
+		m := linkAttributeRegex.FindStringSubmatch(attr)
+		return m[1] + m[2] + fn(m[3]) + m[2]
+	})
+}
+
+// findLinks returns all the links found in the XHTML body
+func findLinks(body string) []string {
+	var links []string
+	for _, m := range linkAttributeRegex.FindAllStringSubmatch(body, -1) {
+		links = append(links, m[3])
+	}
+	return links
+}
+
+// splitFragment splits a link into the referenced path and the fragment
+// identifier, e.g. "section0001.xhtml#note1" becomes "section0001.xhtml" and
+// "note1"
+func splitFragment(link string) (string, string) {
+	if i := strings.Index(link, "#"); i != -1 {
+		return link[:i], link[i+1:]
+	}
+	return link, ""
+}
+
+// isRemoteLink reports whether the link points outside the EPUB
+func isRemoteLink(link string) bool {
+	return strings.Contains(link, ":")
+}
+
+// resolveLink returns the path of the file referenced by link, relative to the
+// content folder, given the path of the referencing file relative to the
+// content folder. An empty string is returned for remote links and links that
+// only contain a fragment.
+func resolveLink(fromPath string, link string) string {
+	link, _ = splitFragment(link)
+	if link == "" || isRemoteLink(link) {
+		return ""
+	}
+	if unescaped, err := url.PathUnescape(link); err == nil {
+		link = unescaped
+	}
+	resolved := path.Join(path.Dir(fromPath), link)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return ""
+	}
+	return resolved
+}
+
+// cssLinkRegex matches the references to other files in CSS, e.g.
+// url("../fonts/font0001.ttf") or @import "other.css"
+var cssLinkRegex = regexp.MustCompile(`url\(\s*["']?([^"')]*?)["']?\s*\)|@import\s+["']([^"']*)["']`)
+
+// findCSSLinks returns all the links found in the CSS content
+func findCSSLinks(css string) []string {
+	var links []string
+	for _, m := range cssLinkRegex.FindAllStringSubmatch(css, -1) {
+		if m[1] != "" {
+			links = append(links, m[1])
+		} else if m[2] != "" {
+			links = append(links, m[2])
+		}
+	}
+	return links
+}
+
+// rewriteCSSLinks calls fn for each link found in the CSS content and replaces
+// the link with the value returned by fn
+func rewriteCSSLinks(css string, fn func(link string) string) string {
+	return cssLinkRegex.ReplaceAllStringFunc(css, func(match string) string {
+		m := cssLinkRegex.FindStringSubmatch(match)
+		link := m[1] + m[2]
+		if link == "" {
+			return match
+		}
+		return strings.Replace(match, link, fn(link), 1)
+	})
+}
+
+// resolveLinks resolves each link relative to fromPath (see resolveLink) and
+// returns the sorted, deduplicated list of internal paths
+func resolveLinks(fromPath string, links []string) []string {
+	seen := make(map[string]bool)
+	resolved := []string{}
+	for _, link := range links {
+		p := resolveLink(fromPath, link)
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		resolved = append(resolved, p)
+	}
+	sort.Strings(resolved)
+	return resolved
+}
+
+// LinkGraph returns the internal links between the files of the EPUB. The keys
+// are the paths of the sections and CSS files and the values are the sorted
+// paths of the files they reference, whether they exist in the EPUB or not.
+//
+// All paths are relative to the EPUB content folder, e.g.
+// xhtml/section0001.xhtml or images/image0001.png.
+//
+// Sections reference the files linked from their body as well as their CSS
+// file, the stylesheet of the theme (see SetTheme) and the audio of their media
+// overlay (see AddMediaOverlay). CSS files
+// are retrieved from their source in order to find the files they reference
+// (e.g. fonts and background images).
+func (e *Epub) LinkGraph() (map[string][]string, error) {
+	e.Lock()
+	defer e.Unlock()
+	return e.linkGraph(context.Background())
+}
+
+func (e *Epub) linkGraph(ctx context.Context) (map[string][]string, error) {
+	graph := make(map[string][]string)
+
+	e.forEachSection(func(s *epubSection) {
+		sectionPath := path.Join(xhtmlFolderName, s.filename)
+		links := findLinks(s.xhtml.xml.Body.XML)
+		for _, link := range s.xhtml.xml.Head.Links {
+			links = append(links, link.Href)
+		}
+		// The stylesheet of the theme is linked when the EPUB is written
+		if e.themeCSSFilename != "" && s.filename != e.cover.xhtmlFilename {
+			links = append(links, path.Join("..", CSSFolderName, e.themeCSSFilename))
+		}
+		// The media overlay is next to the section
+		if s.mediaOverlay != nil {
+			links = append(links, s.mediaOverlay.audio...)
+		}
+		graph[sectionPath] = resolveLinks(sectionPath, links)
+	})
+
+	for cssFilename, cssSource := range e.css {
+		cssPath := path.Join(CSSFolderName, cssFilename)
+		css, err := e.grabber().readMedia(ctx, cssSource)
+		if err != nil {
+			return nil, err
+		}
+		graph[cssPath] = resolveLinks(cssPath, findCSSLinks(string(css)))
+	}
+
+	return graph, nil
+}
+
+// OrphanedMedia returns the sorted paths of the media files (CSS, fonts,
+// images, videos and audios) that were added to the EPUB but aren't referenced,
+// directly or through a CSS file, by any section. The paths are relative to the
+// EPUB content folder, e.g. images/image0001.png.
+//
+// See SetDropOrphanedMedia to leave these files out of the EPUB.
+func (e *Epub) OrphanedMedia() ([]string, error) {
+	e.Lock()
+	defer e.Unlock()
+	orphans, err := e.orphanedMedia(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	orphanPaths := []string{}
+	for orphanPath := range orphans {
+		orphanPaths = append(orphanPaths, orphanPath)
+	}
+	sort.Strings(orphanPaths)
+	return orphanPaths, nil
+}
+
+func (e *Epub) orphanedMedia(ctx context.Context) (map[string]bool, error) {
+	graph, err := e.linkGraph(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk the graph starting from the sections
+	referenced := make(map[string]bool)
+	var toVisit []string
+	e.forEachSection(func(s *epubSection) {
+		toVisit = append(toVisit, path.Join(xhtmlFolderName, s.filename))
+	})
+	for len(toVisit) > 0 {
+		p := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+		if referenced[p] {
+			continue
+		}
+		referenced[p] = true
+		toVisit = append(toVisit, graph[p]...)
+	}
+
+	orphans := make(map[string]bool)
+	for mediaFolderName, mediaMap := range e.mediaFolders() {
+		for mediaFilename := range mediaMap {
+			mediaPath := path.Join(mediaFolderName, mediaFilename)
+			if !referenced[mediaPath] {
+				orphans[mediaPath] = true
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// SectionAssets returns the sorted paths of the media files (CSS, fonts,
+// images, videos and audios) of the EPUB that the section needs: its CSS file,
+// the files referenced from its body and the files referenced by those CSS
+// files (e.g. fonts). Links to other sections aren't followed. The paths are
+// relative to the EPUB content folder, e.g. images/image0001.png.
+//
+// If no section with the internal filename exists, SectionDoesNotExistError will
+// be returned.
+func (e *Epub) SectionAssets(internalFilename string) ([]string, error) {
+	e.Lock()
+	defer e.Unlock()
+	if e.findSection(internalFilename) == nil {
+		return nil, &SectionDoesNotExistError{Filename: internalFilename}
+	}
+	graph, err := e.linkGraph(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return e.sectionAssets(graph, internalFilename), nil
+}
+
+// sectionAssets returns the sorted paths of the media files needed by the
+// section, given the link graph of the EPUB (see SectionAssets)
+func (e *Epub) sectionAssets(graph map[string][]string, internalFilename string) []string {
+	media := make(map[string]bool)
+	for mediaFolderName, mediaMap := range e.mediaFolders() {
+		for mediaFilename := range mediaMap {
+			media[path.Join(mediaFolderName, mediaFilename)] = true
+		}
+	}
+
+	assets := make(map[string]bool)
+	toVisit := append([]string{}, graph[path.Join(xhtmlFolderName, internalFilename)]...)
+	for len(toVisit) > 0 {
+		p := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+		if assets[p] || !media[p] {
+			continue
+		}
+		assets[p] = true
+		toVisit = append(toVisit, graph[p]...)
+	}
+
+	assetPaths := []string{}
+	for assetPath := range assets {
+		assetPaths = append(assetPaths, assetPath)
+	}
+	sort.Strings(assetPaths)
+	return assetPaths
+}
@@ -0,0 +1,103 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLinkGraph(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.AddImage(testImageFromFileSource, "")
+	e.AddFont(testFontFromFileSource, "")
+	testFontCSSPath, _ := e.AddCSS(testFontCSSSource, testFontCSSFilename)
+	e.AddCSS(testCoverCSSSource, testCoverCSSFilename)
+	testSection1Body := fmt.Sprintf(`<img src="%s" alt="" /> <a href="section0002.xhtml#top">Next</a> <a href="https://example.com">Remote</a>`, testImagePath)
+	testSection1Path, _ := e.AddSection(testSection1Body, testSectionTitle, testSectionFilename, testFontCSSPath)
+	e.AddSection(testSectionBody, testSectionTitle, "", "")
+
+	graph, err := e.LinkGraph()
+	if err != nil {
+		t.Fatalf("Error getting link graph: %s", err)
+	}
+	testGraph := map[string][]string{
+		"xhtml/" + testSection1Path:   {"css/" + testFontCSSFilename, "images/" + testImageFromFileFilename, "xhtml/section0002.xhtml"},
+		"xhtml/section0002.xhtml":     {},
+		"css/" + testFontCSSFilename:  {"fonts/redacted-script-regular.ttf"},
+		"css/" + testCoverCSSFilename: {},
+	}
+	if !reflect.DeepEqual(graph, testGraph) {
+		t.Errorf(
+			"Link graph doesn't match\n"+
+				"Got: %v\n"+
+				"Expected: %v",
+			graph,
+			testGraph)
+	}
+
+	assets, err := e.SectionAssets(testSectionFilename)
+	if err != nil {
+		t.Fatalf("Error getting section assets: %s", err)
+	}
+	testAssets := []string{"css/" + testFontCSSFilename, "fonts/redacted-script-regular.ttf", "images/" + testImageFromFileFilename}
+	if !reflect.DeepEqual(assets, testAssets) {
+		t.Errorf(
+			"Section assets don't match\n"+
+				"Got: %v\n"+
+				"Expected: %v",
+			assets,
+			testAssets)
+	}
+	assets, err = e.SectionAssets("section0002.xhtml")
+	if err != nil {
+		t.Fatalf("Error getting section assets: %s", err)
+	}
+	if len(assets) != 0 {
+		t.Errorf("Got assets %v for a section without any", assets)
+	}
+	if _, err := e.SectionAssets("missing.xhtml"); err == nil {
+		t.Errorf("Expected SectionDoesNotExistError for a missing section")
+	}
+
+	orphans, err := e.OrphanedMedia()
+	if err != nil {
+		t.Fatalf("Error getting orphaned media: %s", err)
+	}
+	testOrphans := []string{"css/" + testCoverCSSFilename, "images/gophercolor16x16.png"}
+	if !reflect.DeepEqual(orphans, testOrphans) {
+		t.Errorf(
+			"Orphaned media doesn't match\n"+
+				"Got: %v\n"+
+				"Expected: %v",
+			orphans,
+			testOrphans)
+	}
+
+	e.SetDropOrphanedMedia(true)
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	files := make(map[string]bool)
+	for _, f := range r.File {
+		files[strings.TrimPrefix(f.Name, contentFolderName+"/")] = true
+	}
+	for _, orphan := range testOrphans {
+		if files[orphan] {
+			t.Errorf("Orphaned media %s was written to the EPUB", orphan)
+		}
+	}
+	for p := range graph {
+		if !files[p] && p != testOrphans[0] {
+			t.Errorf("Referenced file %s is missing from the EPUB", p)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package epub
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// Maximum length of the media sources that are logged, longer sources (e.g.
+// data URLs) are truncated
+const maxLoggedSourceLength = 64
+
+// WithLogger returns an option of NewEpub that sets the logger of the EPUB, see
+// SetLogger.
+func WithLogger(logger *slog.Logger) EpubOption {
+	return func(e *Epub) {
+		e.logger = logger
+	}
+}
+
+// SetLogger sets the logger of the EPUB. The retrieval of the media and the
+// steps of the writes are logged at the debug level. Nothing is logged if the
+// logger is nil (default).
+func (e *Epub) SetLogger(logger *slog.Logger) {
+	e.Lock()
+	defer e.Unlock()
+	e.logger = logger
+}
+
+// debug logs a debug message if the EPUB has a logger
+func (e *Epub) debug(msg string, args ...interface{}) {
+	logDebug(e.logger, msg, args...)
+}
+
+// debug logs a debug message if the grabber has a logger
+func (g grabber) debug(msg string, args ...interface{}) {
+	logDebug(g.logger, msg, args...)
+}
+
+// logDebug logs a debug message if logger isn't nil
+func logDebug(logger *slog.Logger, msg string, args ...interface{}) {
+	if logger == nil || !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	logger.Debug(msg, args...)
+}
+
+// loggedSource returns the media source as it's logged, truncated if it's too
+// long
+func loggedSource(mediaSource string) string {
+	if len(mediaSource) <= maxLoggedSourceLength {
+		return mediaSource
+	}
+	if strings.HasPrefix(mediaSource, "data:") {
+		if i := strings.Index(mediaSource, ","); i != -1 && i < maxLoggedSourceLength {
+			return mediaSource[:i+1] + "..."
+		}
+	}
+	return mediaSource[:maxLoggedSourceLength] + "..."
+}
@@ -0,0 +1,56 @@
+package epub
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	e := NewEpub(testEpubTitle, WithLogger(logger))
+	if _, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	if _, err := e.WriteTo(io.Discard); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+
+	for _, expected := range []string{
+		`msg="writing EPUB" sections=1`,
+		`msg="retrieving media" source=` + testImageFromFileSource,
+		`msg="write stage started" stage="writing sections" files=1`,
+		`msg="file done" stage="writing sections" file=EPUB/xhtml/section0001.xhtml`,
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("Expected the logs to contain %q\nGot:\n%s", expected, logs.String())
+		}
+	}
+
+	// Nothing is logged once the logger is removed
+	e.SetLogger(nil)
+	logs.Reset()
+	if _, err := e.WriteTo(io.Discard); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("Got logs %q, expected none", logs.String())
+	}
+}
+
+func TestLoggedSource(t *testing.T) {
+	dataURL := "data:image/png;base64," + strings.Repeat("A", 100)
+	if got := loggedSource(dataURL); got != "data:image/png;base64,..." {
+		t.Errorf("Got logged source %q, expected the data URL without its data", got)
+	}
+	if got := loggedSource(testImageFromFileSource); got != testImageFromFileSource {
+		t.Errorf("Got logged source %q, expected %q", got, testImageFromFileSource)
+	}
+}
@@ -0,0 +1,338 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// mediaTypeExtensions are the extensions of the files of each media type, the
+// first one being used when a file is renamed. Files of the other media types
+// aren't checked.
+var mediaTypeExtensions = map[string][]string{
+	mediaTypeAvif:                 {".avif"},
+	"image/gif":                   {".gif"},
+	mediaTypeJpeg:                 {".jpg", ".jpeg", ".jpe"},
+	mediaTypePng:                  {".png"},
+	mediaTypeSvg:                  {".svg"},
+	mediaTypeWebp:                 {".webp"},
+	"font/otf":                    {".otf"},
+	"font/ttf":                    {".ttf"},
+	"font/woff":                   {".woff"},
+	"font/woff2":                  {".woff2"},
+	"application/vnd.ms-opentype": {".otf"},
+	"audio/mpeg":                  {".mp3"},
+	"audio/mp4":                   {".m4a", ".mp4", ".m4b"},
+	"audio/ogg":                   {".ogg", ".oga", ".opus"},
+	"video/mp4":                   {".mp4", ".m4v"},
+	"video/webm":                  {".webm"},
+	"video/ogg":                   {".ogv", ".ogg"},
+}
+
+// MediaExtensionMismatch is a media file whose extension doesn't match its
+// media type, e.g. a PNG image named image.jpg, as reported by
+// CheckMediaExtensions and FixMediaExtensions.
+type MediaExtensionMismatch struct {
+	// The relative path of the media file, as returned when it was added, e.g.
+	// ../images/image.jpg
+	Path      string
+	MediaType string // The media type of the file
+	// The relative path of the file once renamed by FixMediaExtensions, e.g.
+	// ../images/image.png, empty for CheckMediaExtensions
+	NewPath string
+}
+
+// CheckMediaExtensions returns the fonts, images, videos and audio whose
+// extension doesn't match their media type, in the order of their paths. The
+// media type is the one set by SetMediaType, or else the one detected from the
+// content as Write does, so the media is retrieved from its source. Reading
+// systems may fail to display such files, since some go by the extension.
+//
+// Mismatches found by Write are also reported by Warnings.
+func (e *Epub) CheckMediaExtensions() ([]MediaExtensionMismatch, error) {
+	e.Lock()
+	defer e.Unlock()
+	return e.mediaExtensionMismatches(context.Background())
+}
+
+// FixMediaExtensions renames the files returned by CheckMediaExtensions with
+// the extension of their media type, e.g. image.jpg becomes image.png if it's a
+// PNG image, and returns them along with their new path. Links to the files
+// from the sections and the CSS files are rewritten to use the new filename.
+// If the new filename is already used, one is generated.
+//
+// CSS files linking to renamed files are retrieved and kept in the EPUB with
+// their new content.
+func (e *Epub) FixMediaExtensions() ([]MediaExtensionMismatch, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	ctx := context.Background()
+	mismatches, err := e.mediaExtensionMismatches(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new paths of the files relative to the content folder, by old path
+	renamed := make(map[string]string)
+	folders := e.mediaFolders()
+	for i, mismatch := range mismatches {
+		oldPath := strings.TrimPrefix(mismatch.Path, "../")
+		mediaFolderName, filename := path.Split(oldPath)
+		mediaFolderName = strings.TrimSuffix(mediaFolderName, "/")
+		mediaMap := folders[mediaFolderName]
+
+		ext := mediaTypeExtensions[mismatch.MediaType][0]
+		newFilename := strings.TrimSuffix(filename, path.Ext(filename)) + ext
+		if _, ok := mediaMap[newFilename]; ok {
+			newFilename = unusedMediaFilename(mediaMap, mediaFileFormats[mediaFolderName], ext)
+		}
+		mediaMap[newFilename] = mediaMap[filename]
+		delete(mediaMap, filename)
+
+		newPath := path.Join(mediaFolderName, newFilename)
+		if mediaType, ok := e.mediaTypes[oldPath]; ok {
+			e.mediaTypes[newPath] = mediaType
+			delete(e.mediaTypes, oldPath)
+		}
+		if mediaFolderName == ImageFolderName && e.cover.imageFilename == filename {
+			e.cover.imageFilename = newFilename
+		}
+		renamed[oldPath] = newPath
+		mismatches[i].NewPath = path.Join("..", newPath)
+	}
+	if len(renamed) == 0 {
+		return mismatches, nil
+	}
+
+	e.forEachSection(func(s *epubSection) {
+		fromPath := path.Join(xhtmlFolderName, s.filename)
+		rename := func(link string) string {
+			return renamedLink(fromPath, link, renamed)
+		}
+		s.xhtml.xml.Body.XML = rewriteLinks(s.xhtml.xml.Body.XML, rename)
+		for i, link := range s.xhtml.xml.Head.Links {
+			s.xhtml.xml.Head.Links[i].Href = rename(link.Href)
+		}
+	})
+
+	g := e.grabber()
+	for _, cssFilename := range sortedMediaFilenames(CSSFolderName, e.css, nil) {
+		cssSource := e.css[cssFilename]
+		css, err := g.readCSS(ctx, cssSource)
+		if err != nil {
+			return nil, err
+		}
+		fromPath := path.Join(CSSFolderName, cssFilename)
+		content := rewriteCSSLinks(string(css), func(link string) string {
+			return renamedLink(fromPath, link, renamed)
+		})
+		if content != string(css) {
+			e.css[cssFilename] = dataurl.New([]byte(content), mediaTypeCSS, "charset", "utf-8").String()
+		}
+	}
+	return mismatches, nil
+}
+
+// mediaExtensionMismatches returns the media whose extension doesn't match
+// their media type, see CheckMediaExtensions
+func (e *Epub) mediaExtensionMismatches(ctx context.Context) ([]MediaExtensionMismatch, error) {
+	g := e.grabber()
+	mismatches := []MediaExtensionMismatch{}
+	for _, mediaFolderName := range []string{FontFolderName, ImageFolderName, VideoFolderName, AudioFolderName} {
+		mediaMap := e.mediaFolders()[mediaFolderName]
+		for _, filename := range sortedMediaFilenames(mediaFolderName, mediaMap, nil) {
+			mediaType, ok := e.mediaTypes[path.Join(mediaFolderName, filename)]
+			if !ok {
+				var err error
+				_, mediaType, err = g.fetchMediaData(ctx, mediaMap[filename], filename)
+				if err != nil {
+					return nil, err
+				}
+				if mediaFolderName == AudioFolderName || mediaFolderName == VideoFolderName {
+					mediaType = audioVideoMediaType(mediaType, mediaFolderName)
+				}
+			}
+			if !mediaExtensionMatches(filename, mediaType) {
+				baseType, _, _ := strings.Cut(mediaType, ";")
+				mismatches = append(mismatches, MediaExtensionMismatch{
+					Path:      path.Join("..", mediaFolderName, filename),
+					MediaType: strings.TrimSpace(baseType),
+				})
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// mediaExtensionMatches returns whether the extension of the filename is one of
+// the extensions of the media type, or if the media type isn't checked
+func mediaExtensionMatches(filename string, mediaType string) bool {
+	baseType, _, _ := strings.Cut(mediaType, ";")
+	extensions, ok := mediaTypeExtensions[strings.TrimSpace(baseType)]
+	if !ok {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(filename))
+	for _, extension := range extensions {
+		if extension == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// renamedLink returns the link from the file at fromPath, relative to the
+// content folder, updated if it links to a renamed file. renamed holds the new
+// paths relative to the content folder by old path.
+func renamedLink(fromPath string, link string, renamed map[string]string) string {
+	newPath, ok := renamed[resolveLink(fromPath, link)]
+	if !ok {
+		return link
+	}
+	_, fragment := splitFragment(link)
+	link = relativePath(fromPath, newPath)
+	if fragment != "" {
+		link += "#" + fragment
+	}
+	return link
+}
+
+// renameWrittenMedia renames media written in another format than the one it
+// was retrieved in, e.g. an image replaced by a PNG placeholder, with the
+// extension of its media type, and returns its new filename. If the new
+// filename is already used, one is generated. The links to the media are
+// rewritten as the sections and the CSS files are written (see
+// writtenMediaLink), the media added to the EPUB isn't changed.
+func (e *Epub) renameWrittenMedia(mediaFolderName string, mediaFilename string, mediaType string) string {
+	if mediaExtensionMatches(mediaFilename, mediaType) {
+		return mediaFilename
+	}
+	baseType, _, _ := strings.Cut(mediaType, ";")
+	ext := mediaTypeExtensions[strings.TrimSpace(baseType)][0]
+	newFilename := strings.TrimSuffix(mediaFilename, path.Ext(mediaFilename)) + ext
+	for index := len(e.mediaFolders()[mediaFolderName]) + 1; e.writtenMediaFilenameUsed(mediaFolderName, newFilename); index++ {
+		newFilename = fmt.Sprintf(mediaFileFormats[mediaFolderName], index, ext)
+	}
+
+	oldPath := path.Join(mediaFolderName, mediaFilename)
+	newPath := path.Join(mediaFolderName, newFilename)
+	e.renamedMedia[oldPath] = newPath
+	e.addWarning(WarningRenamed, path.Join(contentFolderName, newPath), "written as %s instead of %s", baseType, mediaFilename)
+	return newFilename
+}
+
+// renameStagedMedia renames media written to the temporary directory in
+// another format than the one it was retrieved in (see renameWrittenMedia)
+func (e *Epub) renameStagedMedia(mediaFolderPath string, mediaFolderName string, mediaFilename string, mediaType string) error {
+	writtenFilename := e.renameWrittenMedia(mediaFolderName, mediaFilename, mediaType)
+	if writtenFilename == mediaFilename {
+		return nil
+	}
+	mediaFilePath := filepath.Join(mediaFolderPath, mediaFilename)
+	writtenFilePath := filepath.Join(mediaFolderPath, writtenFilename)
+	if err := copyStorageFile(e.filesystem, mediaFilePath, writtenFilePath); err != nil {
+		return &StorageError{Path: writtenFilePath, Err: err}
+	}
+	if err := e.filesystem.RemoveAll(mediaFilePath); err != nil {
+		return &StorageError{Path: mediaFilePath, Err: err}
+	}
+	return nil
+}
+
+// writtenMediaFilenameUsed returns whether the filename is used by media of the
+// folder, or by media renamed by the current write
+func (e *Epub) writtenMediaFilenameUsed(mediaFolderName string, filename string) bool {
+	if _, ok := e.mediaFolders()[mediaFolderName][filename]; ok {
+		return true
+	}
+	newPath := path.Join(mediaFolderName, filename)
+	for _, renamedPath := range e.renamedMedia {
+		if renamedPath == newPath {
+			return true
+		}
+	}
+	return false
+}
+
+// writtenMediaPath returns the path of the media written by the current write,
+// relative to the content folder, given the path it was added with
+func (e *Epub) writtenMediaPath(mediaPath string) string {
+	if newPath, ok := e.renamedMedia[mediaPath]; ok && newPath != "" {
+		return newPath
+	}
+	return mediaPath
+}
+
+// writtenMediaLink returns the link from the file name, whose path relative to
+// the content folder is fromPath, updated if it links to media renamed by the
+// current write. Links to media left out of the EPUB are kept as is, with a
+// warning about the file.
+func (e *Epub) writtenMediaLink(name string, fromPath string, link string) string {
+	newPath, ok := e.renamedMedia[resolveLink(fromPath, link)]
+	if !ok {
+		return link
+	}
+	if newPath == "" {
+		e.addWarning(WarningMediaSkipped, name, "links to %s, which was left out", link)
+		return link
+	}
+	return renamedLink(fromPath, link, e.renamedMedia)
+}
+
+// writeRenamedMediaCSSFiles updates the links of the CSS files written to the
+// temporary directory to the media renamed or left out by the current write
+// (see writtenMediaLink)
+func (e *Epub) writeRenamedMediaCSSFiles(rootEpubDir string) error {
+	if len(e.renamedMedia) == 0 {
+		return nil
+	}
+	for _, item := range e.pkg.xml.ManifestItems {
+		if !strings.HasPrefix(item.Href, CSSFolderName+"/") {
+			continue
+		}
+		cssFilePath := filepath.Join(rootEpubDir, contentFolderName, filepath.FromSlash(item.Href))
+		css, err := storage.ReadFile(e.filesystem, cssFilePath)
+		if err != nil {
+			return err
+		}
+		content := e.writtenMediaLinks(path.Join(contentFolderName, item.Href), string(css), rewriteCSSLinks)
+		if content == string(css) {
+			continue
+		}
+		if err := e.filesystem.WriteFile(cssFilePath, []byte(content), filePermissions); err != nil {
+			return &StorageError{Path: cssFilePath, Err: err}
+		}
+	}
+	return nil
+}
+
+// writtenMediaFileWriter returns an epubFileWriter that updates the links of
+// the sections to the media renamed or left out by the current write (see
+// writtenMediaLink)
+func (e *Epub) writtenMediaFileWriter(w epubFileWriter) epubFileWriter {
+	return func(name string, mediaType string, content []byte) error {
+		if mediaType == mediaTypeXhtml {
+			content = []byte(e.writtenMediaLinks(name, string(content), rewriteLinks))
+		}
+		return w(name, mediaType, content)
+	}
+}
+
+// writtenMediaLinks returns the content of the file name, a section or a CSS
+// file, with its links updated by writtenMediaLink. rewrite is rewriteLinks or
+// rewriteCSSLinks.
+func (e *Epub) writtenMediaLinks(name string, content string, rewrite func(string, func(string) string) string) string {
+	if len(e.renamedMedia) == 0 {
+		return content
+	}
+	fromPath := strings.TrimPrefix(name, contentFolderName+"/")
+	return rewrite(content, func(link string) string {
+		return e.writtenMediaLink(name, fromPath, link)
+	})
+}
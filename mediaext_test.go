@@ -0,0 +1,76 @@
+package epub
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFixMediaExtensions(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	// A PNG image named as a JPEG image
+	imagePath, err := e.AddImage(testImageFromFileSource, "image.jpg")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	goodPath, err := e.AddImage("./"+testImageFromFileSource, "good.png")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	cssPath, err := e.AddCSSFromString(`body { background: url("`+imagePath+`"); }`, "style.css")
+	if err != nil {
+		t.Fatalf("Error adding CSS: %s", err)
+	}
+	body := `<p><img src="` + imagePath + `" alt=""/><img src="` + goodPath + `" alt=""/></p>`
+	section, err := e.AddSectionWithOptions(body, SectionOptions{Title: testSectionTitle, CSS: []string{cssPath}})
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+
+	expected := []MediaExtensionMismatch{{Path: "../images/image.jpg", MediaType: mediaTypePng}}
+	mismatches, err := e.CheckMediaExtensions()
+	if err != nil {
+		t.Fatalf("Unexpected error checking extensions: %s", err)
+	}
+	if !reflect.DeepEqual(mismatches, expected) {
+		t.Errorf("Got mismatches %+v, expected %+v", mismatches, expected)
+	}
+
+	// The mismatch is reported when the EPUB is written
+	writeEpubToBuffer(t, e)
+	var warned bool
+	for _, w := range e.Warnings() {
+		warned = warned || (w.Type == WarningExtensionMismatch && w.Path == "EPUB/images/image.jpg")
+	}
+	if !warned {
+		t.Errorf("Got warnings %v, expected a warning about image.jpg", e.Warnings())
+	}
+
+	expected[0].NewPath = "../images/image.png"
+	mismatches, err = e.FixMediaExtensions()
+	if err != nil {
+		t.Fatalf("Unexpected error fixing extensions: %s", err)
+	}
+	if !reflect.DeepEqual(mismatches, expected) {
+		t.Errorf("Got mismatches %+v, expected %+v", mismatches, expected)
+	}
+	if mismatches, _ := e.CheckMediaExtensions(); len(mismatches) != 0 {
+		t.Errorf("Got mismatches %+v after fixing them, expected none", mismatches)
+	}
+
+	r := newTestReader(t, e)
+	content, err := r.ReadFile("EPUB/xhtml/" + section)
+	if err != nil {
+		t.Fatalf("Unexpected error reading section: %s", err)
+	}
+	if !strings.Contains(string(content), `src="../images/image.png"`) || !strings.Contains(string(content), `src="../images/good.png"`) {
+		t.Errorf("Expected the links to the images to be updated, got:\n%s", content)
+	}
+	css, err := r.ReadFile("EPUB/css/style.css")
+	if err != nil {
+		t.Fatalf("Unexpected error reading CSS: %s", err)
+	}
+	if !strings.Contains(string(css), `url("../images/image.png")`) {
+		t.Errorf("Expected the link of the CSS to be updated, got:\n%s", css)
+	}
+}
@@ -0,0 +1,333 @@
+package epub
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Class set by reading systems on the element being read aloud, which can
+	// be styled by the CSS of the sections to highlight it
+	mediaOverlayActiveClass = "-epub-media-overlay-active"
+	mediaTypeSmil           = "application/smil+xml"
+	smilVersion             = "3.0"
+	xmlnsSmil               = "http://www.w3.org/ns/SMIL"
+)
+
+var (
+	// Full and partial clock values, e.g. 0:01:02.5 or 01:02.5
+	clockValueRegexp = regexp.MustCompile(`^(?:(\d+):)?(\d{2}):(\d{2}(?:\.\d+)?)$`)
+	// Timecount values, e.g. 1.5h, 2min, 3s, 500ms or 4 (in seconds)
+	timecountValueRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)(h|min|s|ms)?$`)
+)
+
+// InvalidMediaOverlayError is thrown by AddMediaOverlay and
+// AddMediaOverlaySMIL if the clips or the SMIL document of a media overlay
+// are invalid.
+type InvalidMediaOverlayError struct {
+	Filename string // Internal filename of the section
+	Err      error  // Underlying error
+}
+
+func (e *InvalidMediaOverlayError) Error() string {
+	return fmt.Sprintf("Invalid media overlay for section %s: %s", e.Filename, e.Err)
+}
+
+func (e *InvalidMediaOverlayError) Unwrap() error {
+	return e.Err
+}
+
+// MediaOverlayClip is a clip of audio narrating an element of a section (see
+// AddMediaOverlay).
+type MediaOverlayClip struct {
+	// ID of the element of the section that is read aloud, e.g. a paragraph or
+	// a sentence
+	TextID string
+	// Internal path to an already-added audio file (as returned by AddAudio)
+	Audio string
+	// Beginning and end of the clip in the audio file
+	Begin time.Duration
+	End   time.Duration
+}
+
+// mediaOverlay is the media overlay of a section, either clips or a SMIL
+// document provided as is. It's replaced rather than changed, so it can be
+// shared by the clones of the EPUB.
+type mediaOverlay struct {
+	clips []MediaOverlayClip
+	smil  string
+	// Links to the audio files, relative to the section
+	audio    []string
+	duration time.Duration
+}
+
+// The SMIL document of a media overlay built from clips
+// Ex: <smil xmlns="http://www.w3.org/ns/SMIL" xmlns:epub="http://www.idpf.org/2007/ops" version="3.0">
+//
+//	  <body epub:textref="section0001.xhtml">
+//	    <par id="par1">
+//	      <text src="section0001.xhtml#p1"></text>
+//	      <audio src="../audios/audio0001.mp3" clipBegin="0:00:00.000" clipEnd="0:00:04.200"></audio>
+//	    </par>
+//	  </body>
+//	</smil>
+type smilRoot struct {
+	XMLName   xml.Name `xml:"http://www.w3.org/ns/SMIL smil"`
+	XmlnsEpub string   `xml:"xmlns:epub,attr"`
+	Version   string   `xml:"version,attr"`
+	Body      smilBody `xml:"body"`
+}
+
+type smilBody struct {
+	Textref string    `xml:"epub:textref,attr"`
+	Pars    []smilPar `xml:"par"`
+}
+
+type smilPar struct {
+	ID    string    `xml:"id,attr"`
+	Text  smilText  `xml:"text"`
+	Audio smilAudio `xml:"audio"`
+}
+
+type smilText struct {
+	Src string `xml:"src,attr"`
+}
+
+type smilAudio struct {
+	Src       string `xml:"src,attr"`
+	ClipBegin string `xml:"clipBegin,attr"`
+	ClipEnd   string `xml:"clipEnd,attr"`
+}
+
+// AddMediaOverlay adds a media overlay to a section, so that reading systems
+// can read it aloud with pre-recorded narration while highlighting the element
+// being read. Each clip of audio narrates an element of the section, in order.
+// The overlay replaces the previous one of the section, if any.
+//
+// The SMIL document of the overlay and its duration, as well as the total
+// duration of the overlays, are added to the EPUB when it's written. Reading
+// systems set the -epub-media-overlay-active class on the element being read,
+// which can be styled by the CSS of the section.
+//
+// If no section with the internal filename exists, SectionDoesNotExistError
+// will be returned. If the audio of a clip wasn't added with AddAudio,
+// MediaDoesNotExistError will be returned. If there are no clips, or a clip
+// has no text ID or ends before it begins, InvalidMediaOverlayError will be
+// returned.
+func (e *Epub) AddMediaOverlay(internalFilename string, clips []MediaOverlayClip) error {
+	e.Lock()
+	defer e.Unlock()
+	section := e.findSection(internalFilename)
+	if section == nil {
+		return &SectionDoesNotExistError{Filename: internalFilename}
+	}
+	if len(clips) == 0 {
+		return &InvalidMediaOverlayError{Filename: internalFilename, Err: errors.New("no clips")}
+	}
+
+	overlay := &mediaOverlay{clips: append([]MediaOverlayClip(nil), clips...)}
+	for _, clip := range clips {
+		if clip.TextID == "" {
+			return &InvalidMediaOverlayError{Filename: internalFilename, Err: errors.New("clip without text ID")}
+		}
+		if clip.Begin < 0 || clip.End <= clip.Begin {
+			return &InvalidMediaOverlayError{Filename: internalFilename, Err: fmt.Errorf("clip of %s ends before it begins", clip.TextID)}
+		}
+		if err := e.checkOverlayAudio(internalFilename, clip.Audio); err != nil {
+			return err
+		}
+		overlay.audio = append(overlay.audio, clip.Audio)
+		overlay.duration += clip.End - clip.Begin
+	}
+	section.mediaOverlay = overlay
+	return nil
+}
+
+// AddMediaOverlaySMIL adds a media overlay to a section like AddMediaOverlay,
+// given its SMIL document, e.g. one exported by an audio alignment tool. The
+// document is stored next to the section, so its links are relative to the
+// section like the links of the section: e.g. section0001.xhtml#p1 and
+// ../audios/audio0001.mp3. Links to the section are updated if it's renamed.
+//
+// The duration of the overlay is the sum of the durations of its audio clips.
+// If the document isn't well-formed SMIL, or an audio clip has no end or an
+// invalid clock value, InvalidMediaOverlayError will be returned. The same
+// other errors as AddMediaOverlay are returned.
+func (e *Epub) AddMediaOverlaySMIL(internalFilename string, smil string) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.findSection(internalFilename) == nil {
+		return &SectionDoesNotExistError{Filename: internalFilename}
+	}
+
+	overlay := &mediaOverlay{smil: smil}
+	d := xml.NewDecoder(strings.NewReader(smil))
+	root := true
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &InvalidMediaOverlayError{Filename: internalFilename, Err: err}
+		}
+		start, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if root && (start.Name.Space != xmlnsSmil || start.Name.Local != "smil") {
+			return &InvalidMediaOverlayError{Filename: internalFilename, Err: errors.New("not a SMIL document")}
+		}
+		root = false
+		if start.Name.Local != "audio" {
+			continue
+		}
+
+		var src, clipBegin, clipEnd string
+		for _, attr := range start.Attr {
+			switch attr.Name.Local {
+			case "src":
+				src = attr.Value
+			case "clipBegin":
+				clipBegin = attr.Value
+			case "clipEnd":
+				clipEnd = attr.Value
+			}
+		}
+		if err := e.checkOverlayAudio(internalFilename, src); err != nil {
+			return err
+		}
+		if clipEnd == "" {
+			return &InvalidMediaOverlayError{Filename: internalFilename, Err: fmt.Errorf("clip of %s has no end", src)}
+		}
+		begin, err := parseClockValue(clipBegin)
+		if err != nil {
+			return &InvalidMediaOverlayError{Filename: internalFilename, Err: err}
+		}
+		end, err := parseClockValue(clipEnd)
+		if err != nil {
+			return &InvalidMediaOverlayError{Filename: internalFilename, Err: err}
+		}
+		if end <= begin {
+			return &InvalidMediaOverlayError{Filename: internalFilename, Err: fmt.Errorf("clip of %s ends before it begins", src)}
+		}
+		overlay.audio = append(overlay.audio, src)
+		overlay.duration += end - begin
+	}
+	if root {
+		return &InvalidMediaOverlayError{Filename: internalFilename, Err: errors.New("not a SMIL document")}
+	}
+	if len(overlay.audio) == 0 {
+		return &InvalidMediaOverlayError{Filename: internalFilename, Err: errors.New("no clips")}
+	}
+	e.findSection(internalFilename).mediaOverlay = overlay
+	return nil
+}
+
+// checkOverlayAudio returns MediaDoesNotExistError if the link from the
+// section with the filename doesn't point to an audio file of the EPUB
+func (e *Epub) checkOverlayAudio(internalFilename string, link string) error {
+	audioPath := resolveLink(path.Join(xhtmlFolderName, internalFilename), link)
+	audioFolderName, audioFilename := path.Split(audioPath)
+	if _, ok := e.audios[audioFilename]; !ok || audioFolderName != AudioFolderName+"/" {
+		return &MediaDoesNotExistError{Path: link}
+	}
+	return nil
+}
+
+// mediaOverlayFilename returns the filename of the SMIL document of the media
+// overlay of a section, e.g. section0001.smil, which is also its manifest ID
+func mediaOverlayFilename(s *epubSection) string {
+	return strings.TrimSuffix(s.filename, path.Ext(s.filename)) + ".smil"
+}
+
+// content returns the SMIL document of the media overlay of a section
+func (o *mediaOverlay) content(s *epubSection) ([]byte, error) {
+	if o.clips == nil {
+		return []byte(o.smil), nil
+	}
+
+	root := smilRoot{
+		XmlnsEpub: xmlnsEpub,
+		Version:   smilVersion,
+		Body:      smilBody{Textref: s.filename},
+	}
+	for i, clip := range o.clips {
+		root.Body.Pars = append(root.Body.Pars, smilPar{
+			ID:   "par" + strconv.Itoa(i+1),
+			Text: smilText{Src: s.filename + "#" + clip.TextID},
+			Audio: smilAudio{
+				Src:       clip.Audio,
+				ClipBegin: clockValue(clip.Begin),
+				ClipEnd:   clockValue(clip.End),
+			},
+		})
+	}
+	output, err := xml.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling XML for media overlay: %w", err)
+	}
+	// Add the xml header to the output
+	content := append([]byte(xml.Header), output...)
+	// It's generally nice to have files end with a newline
+	return append(content, "\n"...), nil
+}
+
+// writeMediaOverlay writes the media overlay of a section, if any, next to the
+// section and adds it to the package file, except in Kindle compatibility mode
+func (e *Epub) writeMediaOverlay(w epubFileWriter, s *epubSection) error {
+	// The audio is left out in Kindle compatibility mode
+	if s.mediaOverlay == nil || e.kindle {
+		return nil
+	}
+	filename := mediaOverlayFilename(s)
+	id := SanitizeXMLID(filename)
+	content, err := s.mediaOverlay.content(s)
+	if err != nil {
+		return err
+	}
+	if err := w(path.Join(contentFolderName, xhtmlFolderName, filename), mediaTypeSmil, content); err != nil {
+		return fmt.Errorf("error writing media overlay: %w", err)
+	}
+	e.pkg.addToManifest(id, path.Join(xhtmlFolderName, filename), mediaTypeSmil, "")
+	e.pkg.setMediaOverlay(s.filename, id)
+	e.pkg.setDuration("#"+id, clockValue(s.mediaOverlay.duration))
+	return nil
+}
+
+// parseClockValue parses a SMIL clock value, e.g. 0:01:02.5, 01:02.5 or 62.5s,
+// an empty value being zero
+func parseClockValue(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if m := clockValueRegexp.FindStringSubmatch(value); m != nil {
+		hours, _ := strconv.Atoi(m[1])
+		minutes, _ := strconv.Atoi(m[2])
+		seconds, _ := strconv.ParseFloat(m[3], 64)
+		if minutes >= 60 || seconds >= 60 {
+			return 0, fmt.Errorf("invalid clock value %q", value)
+		}
+		return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), nil
+	}
+	if m := timecountValueRegexp.FindStringSubmatch(value); m != nil {
+		count, _ := strconv.ParseFloat(m[1], 64)
+		unit := map[string]time.Duration{
+			"h":   time.Hour,
+			"min": time.Minute,
+			"s":   time.Second,
+			"":    time.Second,
+			"ms":  time.Millisecond,
+		}[m[2]]
+		return time.Duration(count * float64(unit)), nil
+	}
+	return 0, fmt.Errorf("invalid clock value %q", value)
+}
@@ -0,0 +1,207 @@
+package epub
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddMediaOverlay(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	audioPath, err := e.AddAudio(testAudioFromFileSource, "narration.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddSection(`<p id="p1">One</p><p id="p2">Two</p>`, "Read aloud", "read.xhtml", ""); err != nil {
+		t.Fatal(err)
+	}
+	err = e.AddMediaOverlay("read.xhtml", []MediaOverlayClip{
+		{TextID: "p1", Audio: audioPath, Begin: 0, End: 1200 * time.Millisecond},
+		{TextID: "p2", Audio: audioPath, Begin: 1200 * time.Millisecond, End: 3 * time.Second},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The section is renamed after the overlay is added
+	if _, err := e.RenameSection("read.xhtml", "chapter.xhtml"); err != nil {
+		t.Fatal(err)
+	}
+
+	opf, err := e.DumpOPF()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`<item id="chapter.xhtml" href="xhtml/chapter.xhtml" media-type="application/xhtml+xml" media-overlay="chapter.smil"></item>`,
+		`<item id="chapter.smil" href="xhtml/chapter.smil" media-type="application/smil+xml"></item>`,
+		`<meta refines="#chapter.smil" property="media:duration">0:00:03.000</meta>`,
+		`<meta property="media:duration">0:00:03.000</meta>`,
+		`<meta property="media:active-class">-epub-media-overlay-active</meta>`,
+	} {
+		if !strings.Contains(opf, expected) {
+			t.Errorf("Package file doesn't contain %s:\n%s", expected, opf)
+		}
+	}
+
+	r := newTestReader(t, e)
+	smil, err := r.ReadFile("EPUB/xhtml/chapter.smil")
+	if err != nil {
+		t.Fatalf("Unexpected error reading the SMIL document: %s", err)
+	}
+	for _, expected := range []string{
+		`<smil xmlns="http://www.w3.org/ns/SMIL" xmlns:epub="http://www.idpf.org/2007/ops" version="3.0">`,
+		`<text src="chapter.xhtml#p2"></text>`,
+		`<audio src="../audios/narration.wav" clipBegin="0:00:01.200" clipEnd="0:00:03.000"></audio>`,
+	} {
+		if !strings.Contains(string(smil), expected) {
+			t.Errorf("SMIL document doesn't contain %s:\n%s", expected, smil)
+		}
+	}
+
+	// The narration isn't orphaned
+	orphans, err := e.OrphanedMedia()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("Unexpected orphans %v", orphans)
+	}
+
+	findings, err := e.Validate()
+	if err != nil {
+		t.Fatalf("Unexpected error validating EPUB: %s", err)
+	}
+	for _, finding := range findings {
+		t.Errorf("Unexpected finding: %s", finding)
+	}
+}
+
+func TestAddMediaOverlaySMIL(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddAudio(testAudioFromFileSource, "narration.wav"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddSection(`<p id="p1">One</p>`, "Read aloud", "read.xhtml", ""); err != nil {
+		t.Fatal(err)
+	}
+	const smil = `<smil xmlns="http://www.w3.org/ns/SMIL" version="3.0">
+  <body>
+    <seq>
+      <par><text src="read.xhtml#p1"/><audio src="../audios/narration.wav" clipBegin="1.5s" clipEnd="00:04.5"/></par>
+    </seq>
+  </body>
+</smil>`
+	if err := e.AddMediaOverlaySMIL("read.xhtml", smil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.RenameSection("read.xhtml", "chapter.xhtml"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestReader(t, e)
+	written, err := r.ReadFile("EPUB/xhtml/chapter.smil")
+	if err != nil {
+		t.Fatalf("Unexpected error reading the SMIL document: %s", err)
+	}
+	if expected := strings.Replace(smil, "read.xhtml", "chapter.xhtml", 1); string(written) != expected {
+		t.Errorf("Got SMIL document:\n%s\nExpected:\n%s", written, expected)
+	}
+	if opf, err := e.DumpOPF(); err != nil || !strings.Contains(opf, `<meta refines="#chapter.smil" property="media:duration">0:00:03.000</meta>`) {
+		t.Errorf("Duration missing or error %v:\n%s", err, opf)
+	}
+}
+
+func TestAddMediaOverlayErrors(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	audioPath, err := e.AddAudio(testAudioFromFileSource, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddSection(`<p id="p1">One</p>`, "", "read.xhtml", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var sectionErr *SectionDoesNotExistError
+	if err := e.AddMediaOverlay("missing.xhtml", []MediaOverlayClip{{TextID: "p1", Audio: audioPath, End: time.Second}}); !errors.As(err, &sectionErr) {
+		t.Errorf("Expected SectionDoesNotExistError, got %v", err)
+	}
+	var mediaErr *MediaDoesNotExistError
+	if err := e.AddMediaOverlay("read.xhtml", []MediaOverlayClip{{TextID: "p1", Audio: "../audios/missing.wav", End: time.Second}}); !errors.As(err, &mediaErr) {
+		t.Errorf("Expected MediaDoesNotExistError, got %v", err)
+	}
+
+	testCases := map[string]error{
+		"no clips":      e.AddMediaOverlay("read.xhtml", nil),
+		"no text ID":    e.AddMediaOverlay("read.xhtml", []MediaOverlayClip{{Audio: audioPath, End: time.Second}}),
+		"reversed clip": e.AddMediaOverlay("read.xhtml", []MediaOverlayClip{{TextID: "p1", Audio: audioPath, Begin: time.Second}}),
+		"not SMIL":      e.AddMediaOverlaySMIL("read.xhtml", `<html/>`),
+		"malformed":     e.AddMediaOverlaySMIL("read.xhtml", `<smil xmlns="http://www.w3.org/ns/SMIL">`),
+		"no clip end":   e.AddMediaOverlaySMIL("read.xhtml", `<smil xmlns="http://www.w3.org/ns/SMIL"><body><par><audio src="`+audioPath+`"/></par></body></smil>`),
+		"invalid clock": e.AddMediaOverlaySMIL("read.xhtml", `<smil xmlns="http://www.w3.org/ns/SMIL"><body><par><audio src="`+audioPath+`" clipEnd="1:99"/></par></body></smil>`),
+	}
+	for name, err := range testCases {
+		var overlayErr *InvalidMediaOverlayError
+		if !errors.As(err, &overlayErr) {
+			t.Errorf("%s: expected InvalidMediaOverlayError, got %v", name, err)
+		}
+	}
+}
+
+func TestParseClockValue(t *testing.T) {
+	testCases := map[string]time.Duration{
+		"":            0,
+		"1:02:03.5":   time.Hour + 2*time.Minute + 3500*time.Millisecond,
+		"02:03":       2*time.Minute + 3*time.Second,
+		"1.5h":        90 * time.Minute,
+		"2min":        2 * time.Minute,
+		"3.25s":       3250 * time.Millisecond,
+		"500ms":       500 * time.Millisecond,
+		"4":           4 * time.Second,
+		"0:00:00.250": 250 * time.Millisecond,
+	}
+	for value, expected := range testCases {
+		got, err := parseClockValue(value)
+		if err != nil || got != expected {
+			t.Errorf("parseClockValue(%q) = %s, %v, expected %s", value, got, err, expected)
+		}
+	}
+	for _, value := range []string{"1:2:3", "00:60", "1 s", "-1s", "abc"} {
+		if _, err := parseClockValue(value); err == nil {
+			t.Errorf("Expected an error parsing %q", value)
+		}
+	}
+}
+
+func TestMergeMediaOverlay(t *testing.T) {
+	target := NewEpub(testEpubTitle)
+	if _, err := target.AddAudio(testAudioFromFileSource, "narration.wav"); err != nil {
+		t.Fatal(err)
+	}
+	source := NewEpub("Source")
+	// Same filename as the audio of the target, but another source
+	audioPath, err := source.AddAudio("./"+testAudioFromFileSource, "narration.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.AddSection(`<p id="p1">One</p>`, "Read aloud", "read.xhtml", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.AddMediaOverlay("read.xhtml", []MediaOverlayClip{{TextID: "p1", Audio: audioPath, End: time.Second}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Merge(target, source); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	merged := target.findSection("read.xhtml")
+	if merged == nil || merged.mediaOverlay == nil {
+		t.Fatal("Media overlay not merged")
+	}
+	if audio := merged.mediaOverlay.clips[0].Audio; audio == audioPath || target.checkOverlayAudio("read.xhtml", audio) != nil {
+		t.Errorf("Audio of the clip not renamed: %s", audio)
+	}
+	if source.findSection("read.xhtml").mediaOverlay.clips[0].Audio != audioPath {
+		t.Error("Audio of the clip of the source changed")
+	}
+}
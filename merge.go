@@ -0,0 +1,232 @@
+package epub
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// mediaFileFormats are the formats of the filenames generated for media, by
+// media folder
+var mediaFileFormats = map[string]string{
+	CSSFolderName:   cssFileFormat,
+	FontFolderName:  fontFileFormat,
+	ImageFolderName: imageFileFormat,
+	VideoFolderName: videoFileFormat,
+	AudioFolderName: audioFileFormat,
+}
+
+// Merge appends the sections of the sources to target, in order, along with
+// the media, raw files and META-INF files they use, e.g. to build an omnibus
+// edition or an anthology. The table of contents of target then lists the
+// sections of each source after its own. The metadata and settings of target
+// are kept, and the covers of the sources are left out.
+//
+// Sections and media whose filename is already used in target are renamed, and
+// the links of the merged sections are updated accordingly; the links inside
+// CSS files aren't. Media added to several EPUBs from the same source with the
+// same filename is only added once. If a raw file or META-INF file of a source
+// uses a path already used in target by a different file,
+// FilenameAlreadyUsedError is returned.
+//
+// The sources are left unchanged. A source can't be target itself.
+func Merge(target *Epub, sources ...*Epub) error {
+	// The sources are copied first so that two EPUBs are never locked at the
+	// same time, which could deadlock concurrent merges
+	copies := make([]*Epub, 0, len(sources))
+	for _, source := range sources {
+		if source == target {
+			return errors.New("an EPUB can't be merged into itself")
+		}
+		copies = append(copies, source.Clone())
+	}
+
+	target.Lock()
+	defer target.Unlock()
+	for _, source := range copies {
+		if err := target.merge(source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merge appends the sections of source, which isn't shared, to e
+func (e *Epub) merge(source *Epub) error {
+	// Check the files that can't be renamed first, so that e is left unchanged
+	// if they conflict
+	for rawPath, rawFile := range source.rawFiles {
+		if existing, ok := e.rawFiles[rawPath]; ok && existing != rawFile {
+			return &FilenameAlreadyUsedError{Filename: rawPath}
+		}
+	}
+	for metaInfPath, metaInfSource := range source.metaInfFiles {
+		if existing, ok := e.metaInfFiles[metaInfPath]; ok && existing != metaInfSource {
+			return &FilenameAlreadyUsedError{Filename: metaInfPath}
+		}
+	}
+	for rawPath, rawFile := range source.rawFiles {
+		e.rawFiles[rawPath] = rawFile
+	}
+	for metaInfPath, metaInfSource := range source.metaInfFiles {
+		e.metaInfFiles[metaInfPath] = metaInfSource
+	}
+	for url, mediaType := range source.remoteMedia {
+		e.remoteMedia[url] = mediaType
+	}
+	for mediaSource, data := range source.fetchedMedia {
+		if _, ok := e.fetchedMedia[mediaSource]; !ok {
+			e.fetchedMedia[mediaSource] = data
+		}
+	}
+
+	// The new paths of the media and the sections of the source relative to
+	// the content folder, by old path
+	renamed := make(map[string]string)
+
+	targetFolders := e.mediaFolders()
+	for mediaFolderName, mediaMap := range source.mediaFolders() {
+		targetMap := targetFolders[mediaFolderName]
+		for _, filename := range sortedMediaFilenames(mediaFolderName, mediaMap, nil) {
+			if mediaFolderName == CSSFolderName && filename == source.cover.cssFilename && source.cover.cssTempFile != "" {
+				continue
+			}
+			mediaSource := mediaMap[filename]
+			newFilename := filename
+			if existing, ok := targetMap[filename]; ok && existing != mediaSource {
+				newFilename = unusedMediaFilename(targetMap, mediaFileFormats[mediaFolderName], strings.ToLower(path.Ext(filename)))
+				e.addWarning(WarningRenamed, path.Join(contentFolderName, mediaFolderName, newFilename), "filename %s already used", filename)
+			}
+			targetMap[newFilename] = mediaSource
+			oldPath := path.Join(mediaFolderName, filename)
+			newPath := path.Join(mediaFolderName, newFilename)
+			renamed[oldPath] = newPath
+			if mediaType, ok := source.mediaTypes[oldPath]; ok {
+				e.mediaTypes[newPath] = mediaType
+			}
+		}
+	}
+
+	var sections []epubSection
+	for _, s := range source.sections {
+		if s.filename == source.cover.xhtmlFilename {
+			continue
+		}
+		section := e.mergedSection(s, renamed)
+		if s.children != nil {
+			children := make([]epubSection, 0, len(*s.children))
+			for _, child := range *s.children {
+				children = append(children, e.mergedSection(child, renamed))
+			}
+			section.children = &children
+		}
+		sections = append(sections, section)
+	}
+
+	// The links are updated once all the sections are renamed, since they can
+	// link to the following sections
+	for i := range sections {
+		mergeLinks(&sections[i], renamed)
+		if sections[i].children != nil {
+			children := *sections[i].children
+			for j := range children {
+				mergeLinks(&children[j], renamed)
+			}
+		}
+	}
+	e.sections = append(e.sections, sections...)
+	return nil
+}
+
+// mergedSection returns a copy of the section of a merged EPUB, renamed if its
+// filename is already used by e. The new path of the section is added to
+// renamed.
+func (e *Epub) mergedSection(s epubSection, renamed map[string]string) epubSection {
+	filename := s.filename
+	if e.sectionFilenames[filename] {
+		filename = e.unusedSectionFilename()
+		e.addWarning(WarningRenamed, path.Join(contentFolderName, xhtmlFolderName, filename), "filename %s already used", s.filename)
+	}
+	e.sectionFilenames[filename] = true
+	renamed[path.Join(xhtmlFolderName, s.filename)] = path.Join(xhtmlFolderName, filename)
+
+	// The XHTML document is copied once its links are updated
+	s.filename = filename
+	s.children = nil
+	return s
+}
+
+// mergeLinks updates the links to renamed files of a section of a merged EPUB:
+// the links of its XHTML document and of its media overlay, and its audio if
+// it's an audio track. They're copied rather than changed, since they're
+// shared with the source.
+func mergeLinks(s *epubSection, renamed map[string]string) {
+	s.xhtml = mergedXhtml(s.xhtml, renamed)
+	if newPath, ok := renamed[path.Join(AudioFolderName, s.audio)]; ok && s.audio != "" {
+		s.audio = path.Base(newPath)
+	}
+	if s.mediaOverlay != nil {
+		overlay := *s.mediaOverlay
+		overlay.smil = rewriteLinks(overlay.smil, func(link string) string {
+			return mergedLink(link, renamed)
+		})
+		if overlay.clips != nil {
+			overlay.clips = append([]MediaOverlayClip(nil), overlay.clips...)
+			for i := range overlay.clips {
+				overlay.clips[i].Audio = mergedLink(overlay.clips[i].Audio, renamed)
+			}
+		}
+		overlay.audio = append([]string(nil), overlay.audio...)
+		for i := range overlay.audio {
+			overlay.audio[i] = mergedLink(overlay.audio[i], renamed)
+		}
+		s.mediaOverlay = &overlay
+	}
+}
+
+// mergedXhtml returns a copy of the XHTML document of a section of a merged
+// EPUB, whose links to renamed files are updated. The document is still linked
+// from its old path, since the media and sections keep their folder.
+func mergedXhtml(x *xhtml, renamed map[string]string) *xhtml {
+	root := *x.xml
+	root.Head.Links = append([]xhtmlLink(nil), x.xml.Head.Links...)
+	merged := &xhtml{xml: &root}
+
+	rename := func(link string) string {
+		return mergedLink(link, renamed)
+	}
+	merged.xml.Body.XML = rewriteLinks(x.xml.Body.XML, rename)
+	for i, link := range merged.xml.Head.Links {
+		merged.xml.Head.Links[i].Href = rename(link.Href)
+	}
+	return merged
+}
+
+// mergedLink returns the link from a section of a merged EPUB, updated if it
+// points to a renamed file
+func mergedLink(link string, renamed map[string]string) string {
+	// The sections are all in the same folder, so the links can be resolved
+	// from any of them
+	fromPath := path.Join(xhtmlFolderName, "section.xhtml")
+	oldPath := resolveLink(fromPath, link)
+	newPath, ok := renamed[oldPath]
+	if oldPath == "" || !ok || newPath == oldPath {
+		return link
+	}
+	_, fragment := splitFragment(link)
+	link = relativePath(fromPath, newPath)
+	if fragment != "" {
+		link += "#" + fragment
+	}
+	return link
+}
+
+// relativePath returns the link from the file at fromPath to the file at
+// toPath, both relative to the content folder
+func relativePath(fromPath string, toPath string) string {
+	fromDir := path.Dir(fromPath)
+	if path.Dir(toPath) == fromDir {
+		return path.Base(toPath)
+	}
+	return path.Join("..", toPath)
+}
@@ -0,0 +1,112 @@
+package epub
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	target := NewEpub(testEpubTitle)
+	targetImagePath, err := target.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	if _, err := target.AddSection(`<h1>Target</h1><img src="`+targetImagePath+`" alt="" />`, "Target", "", ""); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+
+	source := NewEpub("Source")
+	// Same filename as the image of the target, but another source
+	sourceImagePath, err := source.AddImage(testImageWebpSource, testImageFromFileFilename)
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	// Same filename and source as the image of the target
+	sharedImagePath, err := source.AddImage(testImageFromFileSource, testImageFromFileFilename+".png")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	sourceSection, err := source.AddSection(`<h1>Source</h1><img src="`+sourceImagePath+`" alt="" /><a href="section0002.xhtml#part">Next</a>`, "Source", "", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	if _, err := source.AddSubSection(sourceSection, `<h1 id="part">Source part</h1><img src="`+sharedImagePath+`" alt="" />`, "Source part", "", ""); err != nil {
+		t.Fatalf("Error adding subsection: %s", err)
+	}
+
+	if err := Merge(target, source); err != nil {
+		t.Fatalf("Unexpected error merging EPUBs: %s", err)
+	}
+
+	// The source is left unchanged
+	if len(source.sections) != 1 || source.sections[0].filename != testSectionFilename {
+		t.Errorf("Source sections changed: %+v", source.sections)
+	}
+	if !strings.Contains(source.sections[0].xhtml.xml.Body.XML, `href="section0002.xhtml#part"`) {
+		t.Errorf("Source section links changed: %s", source.sections[0].xhtml.xml.Body.XML)
+	}
+
+	r := newTestReader(t, target)
+	expectedTOC := []TOCEntry{
+		{Title: "Target", Path: "EPUB/xhtml/section0001.xhtml"},
+		{Title: "Source", Path: "EPUB/xhtml/section0002.xhtml", Children: []TOCEntry{
+			{Title: "Source part", Path: "EPUB/xhtml/section0003.xhtml"},
+		}},
+	}
+	if !reflect.DeepEqual(r.TOC, expectedTOC) {
+		t.Errorf("Got TOC %+v, expected %+v", r.TOC, expectedTOC)
+	}
+
+	content, err := r.ReadFile("EPUB/xhtml/section0002.xhtml")
+	if err != nil {
+		t.Fatalf("Unexpected error reading section: %s", err)
+	}
+	for _, link := range []string{`src="../images/image0002.png"`, `href="section0003.xhtml#part"`} {
+		if !bytes.Contains(content, []byte(link)) {
+			t.Errorf("Merged section doesn't contain %s: %s", link, content)
+		}
+	}
+
+	images := make(map[string]string)
+	for _, item := range r.Manifest {
+		if strings.HasPrefix(item.Path, "EPUB/images/") {
+			images[item.Path] = item.MediaType
+		}
+	}
+	expectedImages := map[string]string{
+		"EPUB/images/" + testImageFromFileFilename:          mediaTypePng,
+		"EPUB/images/" + testImageFromFileFilename + ".png": mediaTypePng,
+		"EPUB/images/image0002.png":                         mediaTypeWebp,
+	}
+	if !reflect.DeepEqual(images, expectedImages) {
+		t.Errorf("Got images %v, expected %v", images, expectedImages)
+	}
+}
+
+func TestMergeConflicts(t *testing.T) {
+	target := NewEpub(testEpubTitle)
+	if _, err := target.AddRawFile(testImageFromFileSource, "raw/file.png", ""); err != nil {
+		t.Fatalf("Error adding raw file: %s", err)
+	}
+	source := NewEpub(testEpubTitle)
+	if _, err := source.AddRawFile(testImageWebpSource, "raw/file.png", ""); err != nil {
+		t.Fatalf("Error adding raw file: %s", err)
+	}
+	if _, err := source.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+
+	var filenameErr *FilenameAlreadyUsedError
+	if err := Merge(target, source); !errors.As(err, &filenameErr) {
+		t.Errorf("Got error %v, expected FilenameAlreadyUsedError", err)
+	}
+	if len(target.sections) != 0 {
+		t.Errorf("Got %d sections merged despite the error", len(target.sections))
+	}
+	if err := Merge(target, target); err == nil {
+		t.Error("Expected an error merging an EPUB into itself")
+	}
+}
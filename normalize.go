@@ -0,0 +1,105 @@
+package epub
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Normalize reads the EPUB from r, which is size bytes long, and creates an
+// EPUB v3 file from it like Upgrade, e.g. to repair a malformed EPUB created
+// by another tool before publishing it. The options are passed to NewEpub.
+//
+// The mistakes of the EPUB read are tolerated where possible:
+//   - backslashes in the paths of the zip file and in links are read as slashes
+//   - the package document is searched for if the container file is missing or
+//     doesn't reference it
+//   - the media type of the files of the manifest without one is detected
+//   - the files of the manifest that are missing, and the spine items that
+//     aren't in the manifest, are left out
+//   - a table of contents that can't be read is ignored, and the documents of
+//     the spine are listed by title instead if there's none
+//   - a cover image that can't be read is ignored
+//
+// Writing the EPUB returned then fixes the other problems commonly found by
+// epubcheck, since the mimetype file, the package document and the nav
+// document are written by this package, e.g. the mimetype file is stored
+// first and uncompressed, and the properties of the manifest items, such as
+// scripted or svg, are set from the content of the sections.
+func Normalize(r io.ReaderAt, size int64, options ...EpubOption) (*Epub, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	// The names are fixed before the files are opened, since the file list of
+	// the zip file is built on first use
+	for _, f := range z.File {
+		f.Name = strings.TrimLeft(path.Clean(strings.ReplaceAll(f.Name, `\`, "/")), "/")
+	}
+
+	reader := &Reader{lenient: true}
+	if err := reader.init(z); err != nil {
+		return nil, err
+	}
+	if len(reader.TOC) == 0 {
+		it := reader.Sections()
+		for it.Next() {
+			section := it.Section()
+			if section.Item.Linear && section.Title != "" {
+				reader.TOC = append(reader.TOC, TOCEntry{Title: section.Title, Path: section.Item.Item.Path})
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return Upgrade(reader, options...)
+}
+
+// lenientPackagePath returns the path of the package document of a malformed
+// EPUB, given its container file: the first one listed that exists, or else
+// the first .opf file of the EPUB
+func (r *Reader) lenientPackagePath(c readContainer) string {
+	for _, rootfile := range c.Rootfiles {
+		fullPath := strings.ReplaceAll(rootfile.FullPath, `\`, "/")
+		if _, err := fs.Stat(r.z, fullPath); err == nil {
+			return fullPath
+		}
+	}
+	for _, f := range r.z.File {
+		if strings.EqualFold(path.Ext(f.Name), ".opf") {
+			return f.Name
+		}
+	}
+	return ""
+}
+
+// lenientManifestItem returns the item of the manifest of a malformed EPUB,
+// fixing its media type if it's missing, or false if its file is missing
+func (r *Reader) lenientManifestItem(item ManifestItem, spine pkgSpine) (ManifestItem, bool) {
+	if item.Path == "" {
+		return item, false
+	}
+	if _, err := fs.Stat(r.z, item.Path); err != nil {
+		return item, false
+	}
+	if item.MediaType != "" {
+		return item, true
+	}
+	for _, itemref := range spine.Items {
+		if itemref.Idref == item.ID {
+			item.MediaType = mediaTypeXhtml
+			return item, true
+		}
+	}
+	data, err := r.ReadFile(item.Path)
+	if err != nil {
+		return item, false
+	}
+	item.MediaType, _, _ = strings.Cut(detectedMediaType(mimetype.Detect(data), "", item.Path), ";")
+	return item, true
+}
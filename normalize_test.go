@@ -0,0 +1,98 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	image, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading image: %s", err)
+	}
+	// The mimetype file isn't first, the package document isn't referenced by
+	// the container file and the paths use backslashes
+	b := zipTestFiles(t, [][2]string{
+		{`OEBPS\Text\ch1.xhtml`, `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Chapter 1</title></head><body><p><a href="ch2.xhtml">Next</a></p><script>console.log(1)</script></body></html>`},
+		{`OEBPS\Text\ch2.xhtml`, `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Chapter 2</title></head><body><p><img src="..\Images\image.png" alt=""/></p></body></html>`},
+		{`OEBPS\Images\image.png`, string(image)},
+		{"mimetype", mediaTypeEpub},
+		{"META-INF/container.xml", `<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`},
+		{`OEBPS\content.opf`, `<package xmlns="http://www.idpf.org/2007/opf" version="2.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Sloppy</dc:title></metadata>
+  <manifest>
+    <item id="ch1" href="Text\ch1.xhtml"/>
+    <item id="ch2" href="Text\ch2.xhtml" media-type="application/xhtml+xml"/>
+    <item id="image" href="Images\image.png"/>
+    <item id="missing" href="Images\missing.png" media-type="image/png"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+    <itemref idref="unknown"/>
+    <itemref idref="ch2"/>
+  </spine>
+</package>`},
+	})
+
+	if _, err := NewReader(bytes.NewReader(b.Bytes()), int64(b.Len())); err == nil {
+		t.Fatal("Expected an error reading the malformed EPUB without normalizing it")
+	}
+	e, err := Normalize(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error normalizing EPUB: %s", err)
+	}
+
+	written := writeEpubToBuffer(t, e)
+	z, err := zip.NewReader(bytes.NewReader(written.Bytes()), int64(written.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading zip file: %s", err)
+	}
+	if z.File[0].Name != mimetypeFilename || z.File[0].Method != zip.Store {
+		t.Errorf("Got first file %s, expected the uncompressed mimetype file", z.File[0].Name)
+	}
+
+	r, err := NewReader(bytes.NewReader(written.Bytes()), int64(written.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading normalized EPUB: %s", err)
+	}
+	if r.Version != "3.0" || r.Metadata.Title != "Sloppy" {
+		t.Errorf("Got version %s and title %s, expected 3.0 and Sloppy", r.Version, r.Metadata.Title)
+	}
+	var spine []string
+	for _, item := range r.Spine {
+		spine = append(spine, item.Item.Path)
+	}
+	expectedSpine := []string{"EPUB/xhtml/ch1.xhtml", "EPUB/xhtml/ch2.xhtml"}
+	if !reflect.DeepEqual(spine, expectedSpine) {
+		t.Errorf("Got spine %v, expected %v", spine, expectedSpine)
+	}
+	if !hasProperty(r.Spine[0].Item.Properties, "scripted") {
+		t.Errorf("Got properties %q, expected scripted", r.Spine[0].Item.Properties)
+	}
+	expectedTOC := []TOCEntry{
+		{Title: "Chapter 1", Path: "EPUB/xhtml/ch1.xhtml"},
+		{Title: "Chapter 2", Path: "EPUB/xhtml/ch2.xhtml"},
+	}
+	if !reflect.DeepEqual(r.TOC, expectedTOC) {
+		t.Errorf("Got TOC %+v, expected %+v", r.TOC, expectedTOC)
+	}
+
+	ch2, err := r.SectionContent(r.Spine[1])
+	if err != nil {
+		t.Fatalf("Unexpected error reading section: %s", err)
+	}
+	if !strings.Contains(string(ch2), `src="../images/image.png"`) {
+		t.Errorf("Expected the link to the image to be fixed, got:\n%s", ch2)
+	}
+	for _, item := range r.Manifest {
+		if item.Path == "EPUB/images/image.png" && item.MediaType != mediaTypePng {
+			t.Errorf("Got media type %s for the image, expected %s", item.MediaType, mediaTypePng)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package epub
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+const (
+	// <aside> element of a note, the backlinks go after its content
+	noteFormat = `<aside id="%s" epub:type="footnote">%s%s</aside>
+`
+	noteIDFormat = "note%04d"
+	// Link to a note returned by AddNote, labeled by the number of the note
+	noterefFormat   = `<a id="%s" href="%s" epub:type="noteref">%d</a>`
+	noterefIDFormat = "noteref%04d"
+	notesType       = "footnotes"
+)
+
+// AddNotesSection adds a section of notes (e.g. footnotes or endnotes) to the
+// EPUB and returns a relative path to the section, like AddSection. Notes are
+// added to it with AddNote. The body of the section is marked as a collection of
+// notes (epub:type="footnotes"), with one <aside> element per note, so that
+// reading systems can show the notes in a popup.
+//
+// The same errors as AddSection are returned.
+func (e *Epub) AddNotesSection(sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	filename, err := e.addSection("", "", sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	s := e.findSection(filename)
+	s.xhtml.setEpubType(notesType)
+	s.notes = []string{}
+	return filename, nil
+}
+
+// AddNote adds a note to the notes section with the internal filename (see
+// AddNotesSection) and returns a link to it, which can be used in the body of a
+// section (see AddSection). The content of the note must be valid XHTML. It
+// will not be validated.
+//
+// The link is a noteref (epub:type="noteref") labeled with the number of the
+// note, e.g. 1. Both the link and the note have a unique ID, so that the note
+// links back to the link once the EPUB is written.
+//
+// If no notes section with the internal filename exists,
+// SectionDoesNotExistError will be returned.
+func (e *Epub) AddNote(notesFilename string, content string) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+	s := e.findSection(notesFilename)
+	if s == nil || s.notes == nil {
+		return "", &SectionDoesNotExistError{Filename: notesFilename}
+	}
+	// The notes are replaced rather than changed, so they can be shared by the
+	// clones of the EPUB
+	s.notes = append(s.notes[:len(s.notes):len(s.notes)], content)
+	s.xhtml.setBody(e.notesBody(s))
+
+	e.noterefs++
+	noteID := fmt.Sprintf(noteIDFormat, len(s.notes))
+	noterefID := fmt.Sprintf(noterefIDFormat, e.noterefs)
+	return fmt.Sprintf(noterefFormat, noterefID, html.EscapeString(s.filename+"#"+noteID), len(s.notes)), nil
+}
+
+// prepareNotes adds the backlinks to the links to the notes to the notes
+// sections, since the sections linking to them may have been added after them
+func (e *Epub) prepareNotes() {
+	e.forEachSection(func(s *epubSection) {
+		if s.notes != nil {
+			s.xhtml.setBody(e.notesBody(s))
+		}
+	})
+}
+
+// notesBody returns the body of a notes section, with backlinks to the links
+// to its notes found in the sections
+func (e *Epub) notesBody(notes *epubSection) string {
+	backlinks := e.backlinks(notes.filename)
+	var body strings.Builder
+	for i, content := range notes.notes {
+		noteID := fmt.Sprintf(noteIDFormat, i+1)
+		var links strings.Builder
+		for _, backlink := range backlinks[noteID] {
+			fmt.Fprintf(&links, bibliographyBacklinkFormat, html.EscapeString(backlink))
+		}
+		fmt.Fprintf(&body, noteFormat, noteID, content, links.String())
+	}
+	return body.String()
+}
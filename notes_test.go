@@ -0,0 +1,76 @@
+package epub
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAddNote(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	notes, err := e.AddNotesSection("Notes", "notes.xhtml", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	first, err := e.AddNote(notes, "<p>First note</p>")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := `<a id="noteref0001" href="notes.xhtml#note0001" epub:type="noteref">1</a>`
+	if first != expected {
+		t.Errorf("Got link %s, expected %s", first, expected)
+	}
+	second, err := e.AddNote(notes, "<p>Second note</p>")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection("<p>Text"+first+" and more text"+second+".</p>", testSectionTitle, "chapter.xhtml", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The notes of a clone are its own
+	c := e.Clone()
+	if _, err := c.AddNote(notes, "<p>Third note</p>"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	r := newTestReader(t, e)
+	content, err := r.ReadFile("EPUB/xhtml/notes.xhtml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`epub:type="footnotes">`,
+		`<aside id="note0001" epub:type="footnote"><p>First note</p> <a href="chapter.xhtml#noteref0001" epub:type="backlink">&#8617;</a></aside>`,
+		`<aside id="note0002" epub:type="footnote"><p>Second note</p> <a href="chapter.xhtml#noteref0002" epub:type="backlink">&#8617;</a></aside>`,
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("Notes section doesn't contain %s:\n%s", expected, content)
+		}
+	}
+	if strings.Contains(string(content), "Third note") {
+		t.Errorf("Note of the clone added to the EPUB:\n%s", content)
+	}
+
+	findings, err := e.Validate()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("Unexpected findings: %+v", findings)
+	}
+}
+
+func TestAddNoteErrors(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	section, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var sectionErr *SectionDoesNotExistError
+	for _, filename := range []string{section, "missing.xhtml"} {
+		if _, err := e.AddNote(filename, "<p>Note</p>"); !errors.As(err, &sectionErr) {
+			t.Errorf("Expected SectionDoesNotExistError for %s, got %v", filename, err)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+// Package objectfs implements the Storage interface on top of object stores
+// (e.g. S3 or GCS buckets), so that the files of EPUBs being built are staged in
+// the object store rather than on a local disk or in memory, e.g. for
+// serverless EPUB generation:
+//
+//	e := epub.NewEpub("My title", epub.WithCustomStorage(objectfs.New(store, "builds/")))
+//
+// Object stores don't have directories, so the directories of the storage are
+// derived from the keys of the objects, like most object store browsers do. The
+// directories created empty are only known by the storage that created them.
+//
+// An ObjectStore is typically a thin wrapper around the client of the object
+// store, e.g. for S3:
+//
+//	type s3Store struct {
+//		client *s3.Client
+//		bucket string
+//	}
+//
+//	func (s *s3Store) Get(key string) ([]byte, error) {
+//		out, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{Bucket: &s.bucket, Key: &key})
+//		var noSuchKey *types.NoSuchKey
+//		if errors.As(err, &noSuchKey) {
+//			return nil, fs.ErrNotExist
+//		}
+//		if err != nil {
+//			return nil, err
+//		}
+//		defer out.Body.Close()
+//		return io.ReadAll(out.Body)
+//	}
+//
+// MemoryStore is a reference implementation of ObjectStore, which can be used
+// to test how EPUBs are built in an object store.
+package objectfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+)
+
+// ObjectStore is an object store where objects are stored by key.
+type ObjectStore interface {
+	// Get returns the content of the object with the key. If there's no such
+	// object, the error must wrap fs.ErrNotExist.
+	Get(key string) ([]byte, error)
+	// Put stores the content of the object with the key, replacing the
+	// existing object if there's one.
+	Put(key string, data []byte) error
+	// Delete deletes the object with the key. Deleting an object that doesn't
+	// exist isn't an error.
+	Delete(key string) error
+	// List returns the keys of all the objects whose key starts with the
+	// prefix, in any order.
+	List(prefix string) ([]string, error)
+}
+
+// ObjectFS is a storage that stages files in an object store.
+type ObjectFS struct {
+	store  ObjectStore
+	prefix string
+
+	mu sync.Mutex
+	// The directories created by Mkdir, which don't exist in the object store
+	// until files are stored in them
+	dirs map[string]bool
+	// The files being written, which are only stored in the object store once
+	// they're closed
+	writing map[string]*writeFile
+}
+
+// New returns a storage that stages files in the object store, as objects whose
+// key is the path of the file prefixed with prefix (e.g. "builds/").
+func New(store ObjectStore, prefix string) *ObjectFS {
+	return &ObjectFS{
+		store:   store,
+		prefix:  prefix,
+		dirs:    make(map[string]bool),
+		writing: make(map[string]*writeFile),
+	}
+}
+
+// cleanName returns the clean, slash-separated version of the name of a file
+func cleanName(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+func (o *ObjectFS) key(name string) string {
+	return o.prefix + cleanName(name)
+}
+
+func (o *ObjectFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if err := o.store.Put(o.key(name), data); err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (o *ObjectFS) Mkdir(name string, perm fs.FileMode) error {
+	name = cleanName(name)
+	if _, err := o.Stat(name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.dirs[name] = true
+	return nil
+}
+
+func (o *ObjectFS) RemoveAll(name string) error {
+	name = cleanName(name)
+	keys, err := o.store.List(o.key(name) + "/")
+	if err != nil {
+		return &fs.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	for _, key := range append(keys, o.key(name)) {
+		if err := o.store.Delete(key); err != nil {
+			return &fs.PathError{Op: "removeall", Path: name, Err: err}
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for dir := range o.dirs {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			delete(o.dirs, dir)
+		}
+	}
+	return nil
+}
+
+func (o *ObjectFS) Create(name string) (storage.File, error) {
+	// The object is created right away so that it exists until the file is
+	// written
+	if err := o.store.Put(o.key(name), nil); err != nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	f := &writeFile{o: o, name: cleanName(name)}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.writing[f.name] = f
+	return f, nil
+}
+
+// written returns the content written so far to the file if it's being
+// written
+func (o *ObjectFS) written(name string) ([]byte, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, ok := o.writing[name]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), f.buf.Bytes()...), true
+}
+
+func (o *ObjectFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(filepath.ToSlash(name)) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := o.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, err := o.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{info: info, entries: entries}, nil
+	}
+	data, ok := o.written(cleanName(name))
+	if !ok {
+		data, err = o.store.Get(o.key(name))
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	return &readFile{info: info, Reader: bytes.NewReader(data)}, nil
+}
+
+func (o *ObjectFS) Stat(name string) (fs.FileInfo, error) {
+	name = cleanName(name)
+	if name == "." {
+		return fileInfo{name: ".", dir: true}, nil
+	}
+	if data, ok := o.written(name); ok {
+		return fileInfo{name: path.Base(name), size: int64(len(data))}, nil
+	}
+	data, err := o.store.Get(o.key(name))
+	if err == nil {
+		return fileInfo{name: path.Base(name), size: int64(len(data))}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	o.mu.Lock()
+	created := o.dirs[name]
+	o.mu.Unlock()
+	if created {
+		return fileInfo{name: path.Base(name), dir: true}, nil
+	}
+	keys, err := o.store.List(o.key(name) + "/")
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(keys) > 0 {
+		return fileInfo{name: path.Base(name), dir: true}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (o *ObjectFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = cleanName(name)
+	prefix := o.prefix
+	if name != "." {
+		prefix = o.key(name) + "/"
+	}
+	keys, err := o.store.List(prefix)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	// The entries are the files directly in the directory and the directories
+	// of the files in subdirectories
+	entries := make(map[string]fs.DirEntry)
+	for _, key := range keys {
+		rest := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(rest, "/"); i != -1 {
+			entries[rest[:i]] = fs.FileInfoToDirEntry(fileInfo{name: rest[:i], dir: true})
+			continue
+		}
+		info, err := o.Stat(path.Join(name, rest))
+		if err != nil {
+			return nil, err
+		}
+		entries[rest] = fs.FileInfoToDirEntry(info)
+	}
+	o.mu.Lock()
+	for dir := range o.dirs {
+		if path.Dir(dir) == name {
+			entries[path.Base(dir)] = fs.FileInfoToDirEntry(fileInfo{name: path.Base(dir), dir: true})
+		}
+	}
+	o.mu.Unlock()
+
+	if len(entries) == 0 && name != "." {
+		if _, err := o.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	sorted := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name() < sorted[j].Name()
+	})
+	return sorted, nil
+}
+
+// fileInfo describes a file or directory of an ObjectFS
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) ModTime() time.Time { return time.Time{} }
+func (i fileInfo) IsDir() bool        { return i.dir }
+func (i fileInfo) Sys() any           { return nil }
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// readFile is a file of an ObjectFS opened for reading
+type readFile struct {
+	info fs.FileInfo
+	*bytes.Reader
+}
+
+func (f *readFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *readFile) Close() error               { return nil }
+
+// dirFile is a directory of an ObjectFS opened for reading
+type dirFile struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// writeFile is a file of an ObjectFS created for writing. Its content is stored
+// in the object store once it's closed, until then it's read from the buffer.
+type writeFile struct {
+	o    *ObjectFS
+	name string
+	buf  bytes.Buffer
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	f.o.mu.Lock()
+	defer f.o.mu.Unlock()
+	return f.buf.Write(p)
+}
+
+func (f *writeFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *writeFile) Stat() (fs.FileInfo, error) {
+	f.o.mu.Lock()
+	defer f.o.mu.Unlock()
+	return fileInfo{name: path.Base(f.name), size: int64(f.buf.Len())}, nil
+}
+
+func (f *writeFile) Close() error {
+	f.o.mu.Lock()
+	defer f.o.mu.Unlock()
+	if f.o.writing[f.name] != f {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	delete(f.o.writing, f.name)
+	if err := f.o.store.Put(f.o.key(f.name), f.buf.Bytes()); err != nil {
+		return &fs.PathError{Op: "close", Path: f.name, Err: err}
+	}
+	return nil
+}
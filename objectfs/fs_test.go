@@ -0,0 +1,80 @@
+package objectfs_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bmaupin/go-epub"
+	"github.com/bmaupin/go-epub/objectfs"
+)
+
+func TestObjectFS(t *testing.T) {
+	store := objectfs.NewMemoryStore()
+	e := epub.NewEpub("My title", epub.WithCustomStorage(objectfs.New(store, "builds/")))
+	if _, err := e.AddImage("../testdata/gophercolor16x16.png", ""); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	if _, err := e.AddSection("<h1>Section 1</h1>", "Section 1", "", ""); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	names := make(map[string]bool)
+	for _, f := range r.File {
+		names[f.Name] = true
+	}
+	for _, name := range []string{"mimetype", "META-INF/container.xml", "EPUB/package.opf", "EPUB/images/gophercolor16x16.png", "EPUB/xhtml/section0001.xhtml"} {
+		if !names[name] {
+			t.Errorf("%s not found in the EPUB", name)
+		}
+	}
+
+	// The objects of the build are removed once the EPUB is written
+	keys, err := store.List("")
+	if err != nil {
+		t.Fatalf("Unexpected error listing the objects: %s", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("Got objects %v left in the store, expected none", keys)
+	}
+}
+
+func TestObjectFSConformance(t *testing.T) {
+	s := objectfs.New(objectfs.NewMemoryStore(), "prefix/")
+	if err := s.Mkdir("empty", 0755); err != nil {
+		t.Fatalf("Unexpected error creating directory: %s", err)
+	}
+	if err := s.WriteFile("dir/sub/a.txt", []byte("a"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %s", err)
+	}
+	f, err := s.Create("dir/b.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error creating file: %s", err)
+	}
+	if _, err := f.Write([]byte("bb")); err != nil {
+		t.Fatalf("Unexpected error writing file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Unexpected error closing file: %s", err)
+	}
+
+	if err := fstest.TestFS(s, "empty", "dir/sub/a.txt", "dir/b.txt"); err != nil {
+		t.Error(err)
+	}
+
+	if err := s.RemoveAll("dir"); err != nil {
+		t.Fatalf("Unexpected error removing directory: %s", err)
+	}
+	if _, err := s.Stat("dir/b.txt"); err == nil {
+		t.Error("dir/b.txt still exists after removing its directory")
+	}
+}
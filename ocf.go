@@ -0,0 +1,152 @@
+package epub
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+)
+
+const (
+	ocfMetadataFilename = "metadata.xml"
+	rightsFilename      = "rights.xml"
+	xmlnsOCFMetadata    = "http://www.idpf.org/2013/metadata"
+)
+
+// OCFMetadata is the metadata of the publication written to the
+// META-INF/metadata.xml file of the container (see SetOCFMetadata), which
+// applies to all its renditions.
+type OCFMetadata struct {
+	// Identifier of the publication; if no identifier is provided, the
+	// identifier of the EPUB is used
+	Identifier string
+	// Other metadata, e.g. the rights holder (dcterms:rightsHolder)
+	Meta []OCFMeta
+}
+
+// OCFMeta is a meta element of the metadata of the publication (see
+// OCFMetadata).
+type OCFMeta struct {
+	Property string // The property, e.g. dcterms:rightsHolder
+	Value    string // The value of the property
+}
+
+// The META-INF/metadata.xml file
+// Ex: <metadata xmlns="http://www.idpf.org/2013/metadata" xmlns:dc="http://purl.org/dc/elements/1.1/" unique-identifier="pub-id">
+//
+//	  <dc:identifier id="pub-id">urn:uuid:fe93046f-af57-475a-a0cb-a0d4bc99ba6d</dc:identifier>
+//	  <meta property="dcterms:modified">2011-01-01T12:00:00Z</meta>
+//	</metadata>
+type ocfMetadataRoot struct {
+	XMLName          xml.Name      `xml:"http://www.idpf.org/2013/metadata metadata"`
+	XmlnsDc          string        `xml:"xmlns:dc,attr"`
+	UniqueIdentifier string        `xml:"unique-identifier,attr"`
+	Identifier       pkgIdentifier `xml:"dc:identifier"`
+	Meta             []pkgMeta     `xml:"meta"`
+}
+
+// SetOCFMetadata sets the metadata of the publication written to the
+// META-INF/metadata.xml file, or nil to leave the file out, which is the
+// default. The modification date (dcterms:modified) is added when the EPUB is
+// written.
+//
+// If a file with the same name was added with AddMetaInfFile,
+// FilenameAlreadyUsedError will be returned.
+func (e *Epub) SetOCFMetadata(metadata *OCFMetadata) error {
+	e.Lock()
+	defer e.Unlock()
+	if _, ok := e.metaInfFiles[ocfMetadataFilename]; ok && metadata != nil {
+		return &FilenameAlreadyUsedError{Filename: ocfMetadataFilename}
+	}
+	if metadata != nil {
+		metadata = &OCFMetadata{Identifier: metadata.Identifier, Meta: slices.Clone(metadata.Meta)}
+	}
+	e.ocfMetadata = metadata
+	return nil
+}
+
+// SetRights sets the rights expression written to the META-INF/rights.xml file,
+// or nil to leave the file out, which is the default. The rights are marshalled
+// with the encoding/xml package, so that vendor-specific rights expressions can
+// be defined as types. To use an existing document, use a type with a field
+// tagged ",innerxml".
+//
+// If the rights can't be marshalled, the error is returned. If a file with the
+// same name was added with AddMetaInfFile, FilenameAlreadyUsedError will be
+// returned.
+func (e *Epub) SetRights(rights interface{}) error {
+	e.Lock()
+	defer e.Unlock()
+	if rights == nil {
+		e.rights = nil
+		return nil
+	}
+	if _, ok := e.metaInfFiles[rightsFilename]; ok {
+		return &FilenameAlreadyUsedError{Filename: rightsFilename}
+	}
+	output, err := xml.MarshalIndent(rights, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling XML for rights file: %w", err)
+	}
+	if len(output) == 0 {
+		return errors.New("error marshalling XML for rights file: no element")
+	}
+	// Add the xml header to the output
+	content := append([]byte(xml.Header), output...)
+	// It's generally nice to have files end with a newline
+	e.rights = append(content, "\n"...)
+	return nil
+}
+
+// writeOCFFiles writes the META-INF/metadata.xml and rights.xml files, if they
+// were set
+func (e *Epub) writeOCFFiles(w epubFileWriter) error {
+	if e.ocfMetadata != nil {
+		content, err := e.ocfMetadataContent()
+		if err != nil {
+			return err
+		}
+		if err := w(path.Join(metaInfFolderName, ocfMetadataFilename), "", content); err != nil {
+			return fmt.Errorf("error writing metadata file: %w", err)
+		}
+	}
+	if e.rights != nil {
+		if err := w(path.Join(metaInfFolderName, rightsFilename), "", e.rights); err != nil {
+			return fmt.Errorf("error writing rights file: %w", err)
+		}
+	}
+	return nil
+}
+
+// ocfMetadataContent returns the content of the META-INF/metadata.xml file
+func (e *Epub) ocfMetadataContent() ([]byte, error) {
+	root := ocfMetadataRoot{
+		XmlnsDc:          xmlnsDc,
+		UniqueIdentifier: pkgUniqueIdentifier,
+		Identifier: pkgIdentifier{
+			ID:   pkgUniqueIdentifier,
+			Data: e.ocfMetadata.Identifier,
+		},
+		Meta: []pkgMeta{{
+			Data:     time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+			Property: pkgModifiedProperty,
+		}},
+	}
+	if root.Identifier.Data == "" {
+		root.Identifier.Data = e.identifier
+	}
+	for _, meta := range e.ocfMetadata.Meta {
+		root.Meta = append(root.Meta, pkgMeta{Data: meta.Value, Property: meta.Property})
+	}
+
+	output, err := xml.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling XML for metadata file: %w", err)
+	}
+	// Add the xml header to the output
+	content := append([]byte(xml.Header), output...)
+	// It's generally nice to have files end with a newline
+	return append(content, "\n"...), nil
+}
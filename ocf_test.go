@@ -0,0 +1,107 @@
+package epub
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testRights is a vendor-specific rights expression
+type testRights struct {
+	XMLName xml.Name `xml:"urn:example:rights rights"`
+	Holder  string   `xml:"holder"`
+	Lending bool     `xml:"lending,attr"`
+}
+
+func TestSetOCFMetadata(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	e.SetIdentifier("urn:isbn:9780000000000")
+	if err := e.SetOCFMetadata(&OCFMetadata{Meta: []OCFMeta{{Property: "dcterms:rightsHolder", Value: "Publisher & Co"}}}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := e.SetRights(testRights{Holder: "Publisher", Lending: true}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	for _, directWrite := range []bool{false, true} {
+		e.SetDirectWrite(directWrite)
+		r := newTestReader(t, e)
+		metadata, err := r.ReadFile("META-INF/metadata.xml")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, expected := range []string{
+			`<metadata xmlns="http://www.idpf.org/2013/metadata" xmlns:dc="http://purl.org/dc/elements/1.1/" unique-identifier="pub-id">`,
+			`<dc:identifier id="pub-id">urn:isbn:9780000000000</dc:identifier>`,
+			`<meta property="dcterms:modified">`,
+			`<meta property="dcterms:rightsHolder">Publisher &amp; Co</meta>`,
+		} {
+			if !strings.Contains(string(metadata), expected) {
+				t.Errorf("Metadata file doesn't contain %s:\n%s", expected, metadata)
+			}
+		}
+
+		rights, err := r.ReadFile("META-INF/rights.xml")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		expected := xml.Header + `<rights xmlns="urn:example:rights" lending="true">
+  <holder>Publisher</holder>
+</rights>
+`
+		if string(rights) != expected {
+			t.Errorf("Got rights file\n%s\nexpected\n%s", rights, expected)
+		}
+	}
+
+	// Both files are left out again
+	if err := e.SetOCFMetadata(nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := e.SetRights(nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r := newTestReader(t, e)
+	for _, name := range []string{"META-INF/metadata.xml", "META-INF/rights.xml"} {
+		if _, err := r.ReadFile(name); err == nil {
+			t.Errorf("%s written after being left out", name)
+		}
+	}
+}
+
+func TestSetOCFMetadataIdentifier(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if err := e.SetOCFMetadata(&OCFMetadata{Identifier: "urn:uuid:publication"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r := newTestReader(t, e)
+	metadata, err := r.ReadFile("META-INF/metadata.xml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(string(metadata), `<dc:identifier id="pub-id">urn:uuid:publication</dc:identifier>`) {
+		t.Errorf("Unexpected metadata file:\n%s", metadata)
+	}
+}
+
+func TestSetOCFFilesAlreadyUsed(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if err := e.AddMetaInfFile(testCoverCSSSource, "metadata.xml"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var filenameErr *FilenameAlreadyUsedError
+	if err := e.SetOCFMetadata(&OCFMetadata{}); !errors.As(err, &filenameErr) {
+		t.Errorf("Expected FilenameAlreadyUsedError, got %v", err)
+	}
+
+	if err := e.SetRights(testRights{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := e.AddMetaInfFile(testCoverCSSSource, "rights.xml"); !errors.As(err, &filenameErr) {
+		t.Errorf("Expected FilenameAlreadyUsedError, got %v", err)
+	}
+	if err := e.SetRights(make(chan int)); err == nil {
+		t.Error("Expected an error for rights that can't be marshalled")
+	}
+}
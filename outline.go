@@ -0,0 +1,210 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"path"
+	"strings"
+)
+
+// Outline describes the structure of the EPUB: its metadata, landmarks and
+// sections along with their word counts and assets. It can be printed as text
+// (see String), JSON (see JSON) or HTML (see HTML) so the structure of the book
+// can be reviewed without opening it in a reader.
+type Outline struct {
+	Title      string            `json:"title"`
+	Author     string            `json:"author,omitempty"`
+	Identifier string            `json:"identifier"`
+	Lang       string            `json:"lang"`
+	Landmarks  []OutlineLandmark `json:"landmarks"`
+	Sections   []OutlineSection  `json:"sections"`
+	Words      int               `json:"words"` // Total number of words
+}
+
+// OutlineLandmark is a landmark of the EPUB, e.g. the cover page.
+type OutlineLandmark struct {
+	Type  string `json:"type"`  // The epub:type of the landmark, e.g. cover or toc
+	Title string `json:"title"` // Title of the landmark
+	Path  string `json:"path"`  // Path of the file, relative to the EPUB content folder
+}
+
+// OutlineSection describes a section of the EPUB in an Outline.
+type OutlineSection struct {
+	Filename  string           `json:"filename"`        // Internal filename of the section
+	Title     string           `json:"title,omitempty"` // Title of the section, sections without a title aren't in the table of contents
+	Words     int              `json:"words"`           // Number of words
+	Assets    []string         `json:"assets"`          // Media needed by the section (see SectionAssets)
+	Linear    bool             `json:"linear"`          // Whether the section is part of the linear reading order
+	Auxiliary bool             `json:"auxiliary"`       // Whether the section was added with AddAuxiliaryXHTML
+	Children  []OutlineSection `json:"children,omitempty"`
+}
+
+// Outline returns the outline of the EPUB. CSS files are retrieved from their
+// source in order to find the assets of each section.
+func (e *Epub) Outline() (*Outline, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	graph, err := e.linkGraph(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Outline{
+		Title:      e.title,
+		Author:     e.author,
+		Identifier: e.identifier,
+		Lang:       e.lang,
+		Landmarks:  []OutlineLandmark{},
+		Sections:   []OutlineSection{},
+	}
+	if e.cover.xhtmlFilename != "" {
+		o.Landmarks = append(o.Landmarks, OutlineLandmark{
+			Type:  "cover",
+			Title: "Cover",
+			Path:  path.Join(xhtmlFolderName, e.cover.xhtmlFilename),
+		})
+	}
+	if e.navInSpine {
+		o.Landmarks = append(o.Landmarks, OutlineLandmark{
+			Type:  tocNavEpubType,
+			Title: tocNavTitle,
+			Path:  tocNavFilename,
+		})
+	}
+
+	newOutlineSection := func(s *epubSection) OutlineSection {
+		words := newSectionStats(s).Words
+		// The total is the one of Stats
+		if e.countsWords(s) {
+			o.Words += words
+		}
+		return OutlineSection{
+			Filename:  s.filename,
+			Title:     s.xhtml.Title(),
+			Words:     words,
+			Assets:    e.sectionAssets(graph, s.filename),
+			Linear:    !s.nonLinear,
+			Auxiliary: s.auxiliary,
+		}
+	}
+	for i := range e.sections {
+		section := newOutlineSection(&e.sections[i])
+		if e.sections[i].children != nil {
+			children := *e.sections[i].children
+			for j := range children {
+				section.Children = append(section.Children, newOutlineSection(&children[j]))
+			}
+		}
+		o.Sections = append(o.Sections, section)
+	}
+
+	return o, nil
+}
+
+// String returns the outline as indented plain text.
+func (o *Outline) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", o.Title)
+	if o.Author != "" {
+		fmt.Fprintf(&b, "Author: %s\n", o.Author)
+	}
+	fmt.Fprintf(&b, "Identifier: %s\n", o.Identifier)
+	fmt.Fprintf(&b, "Language: %s\n", o.Lang)
+	fmt.Fprintf(&b, "Words: %d\n", o.Words)
+
+	if len(o.Landmarks) > 0 {
+		fmt.Fprintf(&b, "\nLandmarks:\n")
+		for _, l := range o.Landmarks {
+			fmt.Fprintf(&b, "  %s: %s (%s)\n", l.Type, l.Title, l.Path)
+		}
+	}
+
+	fmt.Fprintf(&b, "\nSections:\n")
+	var writeSections func(sections []OutlineSection, indent string)
+	writeSections = func(sections []OutlineSection, indent string) {
+		for _, s := range sections {
+			fmt.Fprintf(&b, "%s%s", indent, s.Filename)
+			if s.Title != "" {
+				fmt.Fprintf(&b, " %q", s.Title)
+			}
+			fmt.Fprintf(&b, ", %d words", s.Words)
+			if !s.Linear {
+				fmt.Fprintf(&b, ", non-linear")
+			}
+			if s.Auxiliary {
+				fmt.Fprintf(&b, ", auxiliary")
+			}
+			fmt.Fprintf(&b, "\n")
+			if len(s.Assets) > 0 {
+				fmt.Fprintf(&b, "%s  Assets: %s\n", indent, strings.Join(s.Assets, ", "))
+			}
+			writeSections(s.Children, indent+"  ")
+		}
+	}
+	writeSections(o.Sections, "  ")
+
+	return b.String()
+}
+
+// JSON returns the outline as indented JSON.
+func (o *Outline) JSON() ([]byte, error) {
+	return json.MarshalIndent(o, "", "  ")
+}
+
+var outlineHTMLTemplate = template.Must(template.New("outline").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<dl>
+{{- if .Author}}
+<dt>Author</dt><dd>{{.Author}}</dd>
+{{- end}}
+<dt>Identifier</dt><dd>{{.Identifier}}</dd>
+<dt>Language</dt><dd>{{.Lang}}</dd>
+<dt>Words</dt><dd>{{.Words}}</dd>
+</dl>
+{{- if .Landmarks}}
+<h2>Landmarks</h2>
+<ul>
+{{- range .Landmarks}}
+<li>{{.Type}}: {{.Title}} ({{.Path}})</li>
+{{- end}}
+</ul>
+{{- end}}
+<h2>Sections</h2>
+{{template "sections" .Sections}}
+</body>
+</html>
+{{define "sections"}}<ol>
+{{- range .}}
+<li>{{.Filename}}{{if .Title}} &ldquo;{{.Title}}&rdquo;{{end}}, {{.Words}} words{{if not .Linear}}, non-linear{{end}}{{if .Auxiliary}}, auxiliary{{end}}
+{{- if .Assets}}
+<ul>
+{{- range .Assets}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+{{- if .Children}}
+{{template "sections" .Children}}
+{{- end}}
+</li>
+{{- end}}
+</ol>{{end}}`))
+
+// HTML returns the outline as an HTML document.
+func (o *Outline) HTML() (string, error) {
+	var b bytes.Buffer
+	if err := outlineHTMLTemplate.Execute(&b, o); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,83 @@
+package epub
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOutline(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	e.SetAuthor(testEpubAuthor)
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	testCSSPath, _ := e.AddCSS(testFontCSSSource, testFontCSSFilename)
+	e.AddFont(testFontFromFileSource, "")
+	e.AddSection(`<p>One two three</p>`, testSectionTitle, testSectionFilename, testCSSPath)
+	e.AddSubSection(testSectionFilename, `<p>Four five</p>`, "Subsection", "subsection.xhtml", "")
+	e.AddAuxiliaryXHTML(`<p>Note</p>`, "", "note.xhtml", "")
+
+	o, err := e.Outline()
+	if err != nil {
+		t.Fatalf("Unexpected error getting outline: %s", err)
+	}
+	testLandmarks := []OutlineLandmark{{Type: "cover", Title: "Cover", Path: "xhtml/" + defaultCoverXhtmlFilename}}
+	if !reflect.DeepEqual(o.Landmarks, testLandmarks) {
+		t.Errorf("Landmarks don't match\nGot: %v\nExpected: %v", o.Landmarks, testLandmarks)
+	}
+	testSections := []OutlineSection{
+		{
+			Filename: defaultCoverXhtmlFilename,
+			Assets:   []string{"css/" + defaultCoverCSSFilename, "images/" + testImageFromFileFilename},
+			Linear:   true,
+		},
+		{
+			Filename: testSectionFilename,
+			Title:    testSectionTitle,
+			Words:    3,
+			Assets:   []string{"css/" + testFontCSSFilename, "fonts/redacted-script-regular.ttf"},
+			Linear:   true,
+			Children: []OutlineSection{
+				{Filename: "subsection.xhtml", Title: "Subsection", Words: 2, Assets: []string{}, Linear: true},
+			},
+		},
+		{Filename: "note.xhtml", Words: 1, Assets: []string{}, Linear: true, Auxiliary: true},
+	}
+	if !reflect.DeepEqual(o.Sections, testSections) {
+		t.Errorf("Sections don't match\nGot: %+v\nExpected: %+v", o.Sections, testSections)
+	}
+	// The auxiliary file isn't part of the total, as for Stats
+	if o.Words != 5 {
+		t.Errorf("Got %d words, expected 5", o.Words)
+	}
+
+	text := o.String()
+	for _, s := range []string{testEpubTitle, "Author: " + testEpubAuthor, "cover: Cover", `section0001.xhtml "Section 1", 3 words`, "    subsection.xhtml", "note.xhtml, 1 words, auxiliary"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("Text outline doesn't contain %q:\n%s", s, text)
+		}
+	}
+
+	b, err := o.JSON()
+	if err != nil {
+		t.Fatalf("Unexpected error marshalling outline: %s", err)
+	}
+	var fromJSON Outline
+	if err := json.Unmarshal(b, &fromJSON); err != nil {
+		t.Fatalf("Unexpected error unmarshalling outline: %s", err)
+	}
+	if !reflect.DeepEqual(&fromJSON, o) {
+		t.Errorf("JSON outline doesn't match\nGot: %+v\nExpected: %+v", fromJSON, *o)
+	}
+
+	h, err := o.HTML()
+	if err != nil {
+		t.Fatalf("Unexpected error rendering outline: %s", err)
+	}
+	for _, s := range []string{"<h1>" + testEpubTitle + "</h1>", "<li>fonts/redacted-script-regular.ttf</li>", "subsection.xhtml &ldquo;Subsection&rdquo;"} {
+		if !strings.Contains(h, s) {
+			t.Errorf("HTML outline doesn't contain %q:\n%s", s, h)
+		}
+	}
+}
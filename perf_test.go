@@ -44,3 +44,13 @@ func BenchmarkAddImage_file(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkAddSection(b *testing.B) {
+	e := NewEpub("test")
+	for i := 0; i < b.N; i++ {
+		_, err := e.AddSection("<p>Section</p>", "Section", "", "")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
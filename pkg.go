@@ -3,7 +3,9 @@ package epub
 import (
 	"encoding/xml"
 	"fmt"
+	"path"
 	"path/filepath"
+	"slices"
 	"time"
 )
 
@@ -28,8 +30,10 @@ const (
   </spine>
 </package>
 `
-	pkgModifiedProperty = "dcterms:modified"
-	pkgUniqueIdentifier = "pub-id"
+	pkgActiveClassProperty = "media:active-class"
+	pkgDurationProperty    = "media:duration"
+	pkgModifiedProperty    = "dcterms:modified"
+	pkgUniqueIdentifier    = "pub-id"
 
 	xmlnsDc = "http://purl.org/dc/elements/1.1/"
 )
@@ -80,12 +84,22 @@ type pkgItem struct {
 	Href       string `xml:"href,attr"`
 	MediaType  string `xml:"media-type,attr"`
 	Properties string `xml:"properties,attr,omitempty"`
+	// ID of the item used by reading systems that don't support this one, e.g.
+	// the XHTML page of an audio track
+	Fallback string `xml:"fallback,attr,omitempty"`
+	// ID of the media overlay (SMIL document) of the item
+	MediaOverlay string `xml:"media-overlay,attr,omitempty"`
 }
 
 // <itemref> elements, which define the reading order
 // Ex: <itemref idref="section0001.xhtml" />
+//
+//	<itemref idref="section0002.xhtml" linear="no" />
+//	<itemref idref="section0003.xhtml" properties="page-spread-left" />
 type pkgItemref struct {
-	Idref string `xml:"idref,attr"`
+	Idref      string `xml:"idref,attr"`
+	Linear     string `xml:"linear,attr,omitempty"`
+	Properties string `xml:"properties,attr,omitempty"`
 }
 
 // The <meta> element, which contains modified date, role of the creator (e.g.
@@ -111,19 +125,21 @@ type pkgMetadata struct {
 	// Ex: <dc:language>en</dc:language>
 	Language    string `xml:"dc:language"`
 	Description string `xml:"dc:description,omitempty"`
-	Creator     *pkgCreator
-	Meta        []pkgMeta `xml:"meta"`
+	// Ex: <dc:type>dictionary</dc:type>
+	Type    string `xml:"dc:type,omitempty"`
+	Creator *pkgCreator
+	Meta    []pkgMeta `xml:"meta"`
 }
 
 // The <spine> element
 type pkgSpine struct {
 	Items []pkgItemref `xml:"itemref"`
-	Toc   string       `xml:"toc,attr"`
+	Toc   string       `xml:"toc,attr,omitempty"`
 	Ppd   string       `xml:"page-progression-direction,attr,omitempty"`
 }
 
 // Constructor for pkg
-func newPackage() *pkg {
+func newPackage() (*pkg, error) {
 	p := &pkg{
 		xml: &pkgRoot{
 			Metadata: pkgMetadata{
@@ -137,16 +153,10 @@ func newPackage() *pkg {
 
 	err := xml.Unmarshal([]byte(pkgFileTemplate), &p.xml)
 	if err != nil {
-		panic(fmt.Sprintf(
-			"Error unmarshalling package file XML: %s\n"+
-				"\tp.xml=%#v\n"+
-				"\tpkgFileTemplate=%s",
-			err,
-			*p.xml,
-			pkgFileTemplate))
+		return nil, fmt.Errorf("error unmarshalling package file XML: %w", err)
 	}
 
-	return p
+	return p, nil
 }
 
 func (p *pkg) addToManifest(id string, href string, mediaType string, properties string) {
@@ -160,9 +170,37 @@ func (p *pkg) addToManifest(id string, href string, mediaType string, properties
 	p.xml.ManifestItems = append(p.xml.ManifestItems, *i)
 }
 
-func (p *pkg) addToSpine(id string) {
+// Remove the items of the manifest and the spine, along with the metadata of
+// the audio tracks and the media overlays, which are added again each time the
+// EPUB is written
+func (p *pkg) resetItems() {
+	p.xml.ManifestItems = nil
+	p.xml.Spine.Items = nil
+	p.xml.Metadata.Meta = slices.DeleteFunc(p.xml.Metadata.Meta, func(m pkgMeta) bool {
+		return m.Property == pkgDurationProperty || m.Property == pkgActiveClassProperty
+	})
+}
+
+// Set the fallback of the manifest item with the ID, returns false if there's
+// no such item
+func (p *pkg) setFallback(id string, fallback string) bool {
+	for i := range p.xml.ManifestItems {
+		if p.xml.ManifestItems[i].ID == id {
+			p.xml.ManifestItems[i].Fallback = fallback
+			return true
+		}
+	}
+	return false
+}
+
+// Add an item to the spine, non-linear items are marked with linear="no"
+func (p *pkg) addToSpine(id string, linear bool, properties string) {
 	i := &pkgItemref{
-		Idref: id,
+		Idref:      id,
+		Properties: properties,
+	}
+	if !linear {
+		i.Linear = "no"
 	}
 
 	p.xml.Spine.Items = append(p.xml.Spine.Items, *i)
@@ -205,10 +243,62 @@ func (p *pkg) setDescription(desc string) {
 	p.xml.Metadata.Description = desc
 }
 
+// Set the type of the EPUB, e.g. dictionary, or an empty string if it has none
+func (p *pkg) setType(epubType string) {
+	p.xml.Metadata.Type = epubType
+}
+
+// Set the source and target languages of a dictionary, the meta elements are
+// removed if the languages are empty
+func (p *pkg) setDictionaryLanguages(source string, target string) {
+	p.xml.Metadata.Meta = slices.DeleteFunc(p.xml.Metadata.Meta, func(m pkgMeta) bool {
+		return m.Property == pkgSourceLanguageProperty || m.Property == pkgTargetLanguageProperty
+	})
+	if source != "" {
+		p.xml.Metadata.Meta = append(p.xml.Metadata.Meta, pkgMeta{Data: source, Property: pkgSourceLanguageProperty})
+	}
+	if target != "" {
+		p.xml.Metadata.Meta = append(p.xml.Metadata.Meta, pkgMeta{Data: target, Property: pkgTargetLanguageProperty})
+	}
+}
+
+// Set the ID of the EPUB 2 table of contents in the spine, or an empty string
+// if there's none
+func (p *pkg) setSpineToc(id string) {
+	p.xml.Spine.Toc = id
+}
+
 func (p *pkg) setPpd(direction string) {
 	p.xml.Spine.Ppd = direction
 }
 
+// Set the media overlay of the manifest item with the ID
+func (p *pkg) setMediaOverlay(id string, overlay string) {
+	for i := range p.xml.ManifestItems {
+		if p.xml.ManifestItems[i].ID == id {
+			p.xml.ManifestItems[i].MediaOverlay = overlay
+		}
+	}
+}
+
+// Set the class of the element being read aloud by the media overlays
+func (p *pkg) setActiveClass(class string) {
+	p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, &pkgMeta{
+		Data:     class,
+		Property: pkgActiveClassProperty,
+	})
+}
+
+// Set the duration of the item refined, e.g. #track.mp3, or of the whole EPUB if
+// refines is empty
+func (p *pkg) setDuration(refines string, duration string) {
+	p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, &pkgMeta{
+		Data:     duration,
+		Property: pkgDurationProperty,
+		Refines:  refines,
+	})
+}
+
 func (p *pkg) setModified(timestamp string) {
 	p.modifiedMeta = &pkgMeta{
 		Data:     timestamp,
@@ -222,41 +312,33 @@ func (p *pkg) setTitle(title string) {
 	p.xml.Metadata.Title = title
 }
 
-// Update the <meta> element
+// Update the <meta> element, replacing the meta element with the same name,
+// property and refines attributes if there's already one
 func updateMeta(a []pkgMeta, m *pkgMeta) []pkgMeta {
-	indexToReplace := -1
-
-	if len(a) > 0 {
-		// If we've already added the modified meta element to the meta array
-		for i, meta := range a {
-			if meta == *m {
-				indexToReplace = i
-				break
-			}
+	for i, meta := range a {
+		if meta.Name == m.Name && meta.Property == m.Property && meta.Refines == m.Refines {
+			a[i] = *m
+			return a
 		}
 	}
 
-	// If the array is empty or the meta element isn't in it
-	if indexToReplace == -1 {
-		// Add the meta element to the array of meta elements
-		a = append(a, *m)
-
-		// If the meta element is found
-	} else {
-		// Replace it
-		a[indexToReplace] = *m
-	}
-
-	return a
+	// Add the meta element to the array of meta elements
+	return append(a, *m)
 }
 
-// Write the package file to the temporary directory
-func (p *pkg) write(tempDir string) {
+// Write the package file
+func (p *pkg) write(w epubFileWriter) error {
 	now := time.Now().UTC().Format("2006-01-02T15:04:05Z")
 	p.setModified(now)
 
-	pkgFilePath := filepath.Join(tempDir, contentFolderName, pkgFilename)
+	if err := w(path.Join(contentFolderName, pkgFilename), mediaTypeOpf, p.content()); err != nil {
+		return fmt.Errorf("error writing package file: %w", err)
+	}
+	return nil
+}
 
+// content returns the content of the package file
+func (p *pkg) content() []byte {
 	output, err := xml.MarshalIndent(p.xml, "", "  ")
 	if err != nil {
 		panic(fmt.Sprintf(
@@ -269,8 +351,5 @@ func (p *pkg) write(tempDir string) {
 	pkgFileContent := append([]byte(xml.Header), output...)
 	// It's generally nice to have files end with a newline
 	pkgFileContent = append(pkgFileContent, "\n"...)
-
-	if err := filesystem.WriteFile(pkgFilePath, []byte(pkgFileContent), filePermissions); err != nil {
-		panic(fmt.Sprintf("Error writing package file: %s", err))
-	}
+	return pkgFileContent
 }
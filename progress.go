@@ -0,0 +1,201 @@
+package epub
+
+import (
+	"io/fs"
+	"log/slog"
+	"path"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+)
+
+// WriteStage is a stage of Write (see SetProgressFunc).
+type WriteStage int
+
+const (
+	// WriteStageFetchingMedia is the retrieval of the media of the EPUB
+	WriteStageFetchingMedia WriteStage = iota
+	// WriteStageWritingSections is the generation of the section files, as
+	// well as of their media overlays and of the search key map of dictionaries
+	WriteStageWritingSections
+	// WriteStageZipping is the addition of the files to the EPUB archive. With
+	// SetDirectWrite, files are added to the archive as they're generated, so
+	// only the files generated last (the TOC and package files) are reported
+	// in this stage.
+	WriteStageZipping
+)
+
+func (s WriteStage) String() string {
+	switch s {
+	case WriteStageFetchingMedia:
+		return "fetching media"
+	case WriteStageWritingSections:
+		return "writing sections"
+	case WriteStageZipping:
+		return "zipping"
+	}
+	return "unknown stage"
+}
+
+// WriteProgress is the progress of Write reported to the function set by
+// SetProgressFunc.
+type WriteProgress struct {
+	Stage WriteStage // The current stage
+	File  string     // Path of the file done in the EPUB, empty when a stage starts
+	Done  int        // Number of files of the stage done
+	Total int        // Number of files of the stage
+}
+
+// SetProgressFunc sets a function called to report the progress of Write, e.g.
+// to display a progress bar in a CLI or a web UI. The function is called when
+// each stage starts, then each time a file of the stage is done. Files that are
+// left out of the EPUB (e.g. media skipped because of the media failure policy)
+// are reported as done as well.
+//
+// The function is called synchronously by Write, while the EPUB is locked, so it
+// must not call the methods of the EPUB. A nil function, the default, disables
+// progress reporting.
+func (e *Epub) SetProgressFunc(progressFunc func(WriteProgress)) {
+	e.Lock()
+	defer e.Unlock()
+	e.progressFunc = progressFunc
+}
+
+// writeProgressTracker reports the progress of a write to the progress function
+// and to the logger of the EPUB. A nil tracker reports nothing.
+type writeProgressTracker struct {
+	progressFunc func(WriteProgress)
+	logger       *slog.Logger
+	progress     WriteProgress
+}
+
+// newWriteProgressTracker returns a tracker reporting to progressFunc and
+// logging to logger at the debug level, or nil if both are nil
+func newWriteProgressTracker(progressFunc func(WriteProgress), logger *slog.Logger) *writeProgressTracker {
+	if progressFunc == nil && logger == nil {
+		return nil
+	}
+	return &writeProgressTracker{progressFunc: progressFunc, logger: logger}
+}
+
+// report reports the current progress
+func (t *writeProgressTracker) report() {
+	if t.progress.File == "" {
+		logDebug(t.logger, "write stage started", "stage", t.progress.Stage.String(), "files", t.progress.Total)
+	} else {
+		logDebug(t.logger, "file done", "stage", t.progress.Stage.String(), "file", t.progress.File)
+	}
+	if t.progressFunc != nil {
+		t.progressFunc(t.progress)
+	}
+}
+
+// start reports the start of a stage with the given number of files
+func (t *writeProgressTracker) start(stage WriteStage, total int) {
+	if t == nil {
+		return
+	}
+	t.progress = WriteProgress{Stage: stage, Total: total}
+	t.report()
+}
+
+// fileDone reports that a file of the current stage, given its path in the EPUB,
+// is done
+func (t *writeProgressTracker) fileDone(name string) {
+	if t == nil {
+		return
+	}
+	t.progress.File = name
+	t.progress.Done++
+	t.report()
+}
+
+// writer returns an epubFileWriter that reports each file written with w
+func (t *writeProgressTracker) writer(w epubFileWriter) epubFileWriter {
+	if t == nil {
+		return w
+	}
+	return func(name string, mediaType string, content []byte) error {
+		if err := w(name, mediaType, content); err != nil {
+			return err
+		}
+		t.fileDone(name)
+		return nil
+	}
+}
+
+// fetchedMediaCount returns the number of files retrieved by Write before the
+// EPUB is zipped, including the media that's streamed if it's written directly
+func (e *Epub) fetchedMediaCount(orphans map[string]bool) int {
+	count := len(e.metaInfFiles) + len(e.rawFiles)
+	for mediaFolderName, mediaMap := range e.mediaFolders() {
+		if e.streamsMedia(mediaFolderName) && !e.writesDirectly() {
+			continue
+		}
+		count += mediaFileCount(mediaFolderName, mediaMap, orphans)
+	}
+	return count
+}
+
+// streamedMediaCount returns the number of media files streamed into the EPUB
+func (e *Epub) streamedMediaCount(orphans map[string]bool) int {
+	count := 0
+	for mediaFolderName, mediaMap := range e.mediaFolders() {
+		if e.streamsMedia(mediaFolderName) {
+			count += mediaFileCount(mediaFolderName, mediaMap, orphans)
+		}
+	}
+	return count
+}
+
+// mediaFileCount returns the number of media files of a folder, except for the
+// orphans that are left out
+func mediaFileCount(mediaFolderName string, mediaMap map[string]string, orphans map[string]bool) int {
+	count := 0
+	for mediaFilename := range mediaMap {
+		if !orphans[path.Join(mediaFolderName, mediaFilename)] {
+			count++
+		}
+	}
+	return count
+}
+
+// sectionCount returns the number of section files written by writeSections,
+// which leaves out the subsections of the sections that aren't in the TOC
+func (e *Epub) sectionCount() int {
+	return len(e.writtenSections())
+}
+
+// sectionFileCount returns the number of files written by writeSections: the
+// section files, their media overlays and the search key map of dictionaries
+func (e *Epub) sectionFileCount() int {
+	sections := e.writtenSections()
+	count := len(sections)
+	// The audio is left out in Kindle compatibility mode
+	if !e.kindle {
+		for _, s := range sections {
+			if s.mediaOverlay != nil {
+				count++
+			}
+		}
+	}
+	searchKeyMap := false
+	e.forEachSection(func(s *epubSection) {
+		searchKeyMap = searchKeyMap || len(s.dictionary) > 0
+	})
+	if searchKeyMap {
+		count++
+	}
+	return count
+}
+
+// stagedFileCount returns the number of files in the temporary directory
+func stagedFileCount(filesystem storage.Storage, rootEpubDir string) int {
+	count := 0
+	_ = fs.WalkDir(filesystem, rootEpubDir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
@@ -0,0 +1,649 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const readerNavProperty = "nav"
+
+// InvalidEpubError is thrown by Open and NewReader if the EPUB can't be read,
+// e.g. if a file required by the EPUB spec is missing or malformed.
+type InvalidEpubError struct {
+	Path string // The path of the file inside the EPUB that caused the error
+	Err  error  // The underlying error that was thrown
+}
+
+func (e *InvalidEpubError) Error() string {
+	return fmt.Sprintf("Invalid EPUB file %s: %s", e.Path, e.Err)
+}
+
+func (e *InvalidEpubError) Unwrap() error {
+	return e.Err
+}
+
+// Reader gives access to the content of an existing EPUB, e.g. one created
+// elsewhere. See Open and NewReader.
+type Reader struct {
+	Version  string         // The version of the EPUB, e.g. 3.0 or 2.0
+	Metadata Metadata       // The metadata of the package document
+	Manifest []ManifestItem // The files of the EPUB, in the order of the package document
+	Spine    []SpineItem    // The reading order of the EPUB
+	// The table of contents, from the nav document or the NCX document of EPUB
+	// v2 files
+	TOC []TOCEntry
+	// The references of the guide of EPUB v2 files, e.g. to the cover page
+	Guide []GuideReference
+
+	// The path of the package document inside the EPUB
+	PackagePath string
+
+	z *zip.Reader
+	// The path of the cover image inside the EPUB, if any
+	coverPath string
+	// Whether the mistakes of malformed EPUBs are tolerated, see Normalize
+	lenient bool
+}
+
+// ReadCloser is a Reader that must be closed once it's no longer needed.
+type ReadCloser struct {
+	Reader
+	f *zip.ReadCloser
+}
+
+// Metadata is the metadata of an existing EPUB.
+type Metadata struct {
+	Identifier  string   // The unique identifier of the EPUB
+	Title       string   // The main title
+	Language    string   // The main language
+	Description string   // The description, if any
+	Authors     []string // The creators, e.g. the authors
+	Modified    string   // The date the EPUB was last modified, if any
+	// The content of the cover image, if any
+	CoverImage []byte
+	// The media type of the cover image, if any
+	CoverMediaType string
+}
+
+// ManifestItem is a file listed in the manifest of an existing EPUB.
+type ManifestItem struct {
+	ID         string // The ID of the item
+	Href       string // The path of the file relative to the package document, as it's written in the manifest
+	Path       string // The path of the file inside the EPUB, which can be used with Reader.Open or Reader.ReadFile
+	MediaType  string // The media type of the file
+	Properties string // The properties of the item, e.g. "nav" or "cover-image"
+}
+
+// SpineItem is an item of the spine, which defines the reading order, of an
+// existing EPUB.
+type SpineItem struct {
+	Item       ManifestItem // The item of the manifest the spine item refers to
+	Linear     bool         // Whether the item is part of the default reading order
+	Properties string       // The properties of the spine item, e.g. "page-spread-left"
+}
+
+// GuideReference is a reference of the guide of an EPUB v2 file, which
+// identifies its structural components.
+type GuideReference struct {
+	Type  string // The type of the component, e.g. cover, toc or text
+	Title string // The title of the reference
+	// The path of the file inside the EPUB the reference links to, followed by
+	// the fragment if any
+	Path string
+}
+
+// TOCEntry is an entry of the table of contents of an existing EPUB.
+type TOCEntry struct {
+	Title string // The title of the entry
+	// The path of the file inside the EPUB the entry links to, followed by the
+	// fragment if any, e.g. EPUB/xhtml/section0001.xhtml#part1
+	Path     string
+	Children []TOCEntry // The subentries
+}
+
+// The container file (META-INF/container.xml), read to find the package
+// document
+type readContainer struct {
+	XMLName   xml.Name            `xml:"urn:oasis:names:tc:opendocument:xmlns:container container"`
+	Rootfiles []readContainerRoot `xml:"rootfiles>rootfile"`
+}
+
+type readContainerRoot struct {
+	FullPath  string `xml:"full-path,attr"`
+	MediaType string `xml:"media-type,attr"`
+}
+
+// The package document as it's read. Unlike pkgRoot, which is only used to
+// write it, it handles namespace prefixes other than dc and EPUB v2 files.
+type readPkg struct {
+	XMLName          xml.Name        `xml:"http://www.idpf.org/2007/opf package"`
+	UniqueIdentifier string          `xml:"unique-identifier,attr"`
+	Version          string          `xml:"version,attr"`
+	Metadata         readPkgMetadata `xml:"metadata"`
+	ManifestItems    []pkgItem       `xml:"manifest>item"`
+	Spine            pkgSpine        `xml:"spine"`
+	Guide            []readPkgGuide  `xml:"guide>reference"`
+}
+
+// A <reference> element of the guide of EPUB v2 files
+// Ex: <reference type="cover" title="Cover" href="cover.xhtml" />
+type readPkgGuide struct {
+	Type  string `xml:"type,attr"`
+	Title string `xml:"title,attr"`
+	Href  string `xml:"href,attr"`
+}
+
+type readPkgMetadata struct {
+	Identifiers  []pkgIdentifier `xml:"http://purl.org/dc/elements/1.1/ identifier"`
+	Titles       []string        `xml:"http://purl.org/dc/elements/1.1/ title"`
+	Languages    []string        `xml:"http://purl.org/dc/elements/1.1/ language"`
+	Descriptions []string        `xml:"http://purl.org/dc/elements/1.1/ description"`
+	Creators     []string        `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Meta         []pkgMeta       `xml:"meta"`
+}
+
+// A <nav> element of the nav document
+type readNav struct {
+	EpubType string      `xml:"http://www.idpf.org/2007/ops type,attr"`
+	List     readNavList `xml:"ol"`
+}
+
+type readNavList struct {
+	Items []readNavItem `xml:"li"`
+}
+
+type readNavItem struct {
+	A    readNavLink  `xml:"a"`
+	Span readNavLink  `xml:"span"`
+	List *readNavList `xml:"ol"`
+}
+
+type readNavLink struct {
+	Href  string `xml:"href,attr"`
+	Inner string `xml:",innerxml"`
+}
+
+// htmlTagRegexp matches the tags of the titles of the nav document, e.g. the
+// <span> elements they contain
+var htmlTagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// Open opens the EPUB file at path for reading.
+func Open(path string) (*ReadCloser, error) {
+	f, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReadCloser{f: f}
+	if err := r.init(&f.Reader); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close closes the EPUB file.
+func (r *ReadCloser) Close() error {
+	return r.f.Close()
+}
+
+// NewReader returns a Reader reading the EPUB from r, which is size bytes long.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	reader := &Reader{}
+	if err := reader.init(z); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Open opens the file at the path inside the EPUB, e.g. the Path of a
+// ManifestItem. This makes Reader an fs.FS.
+func (r *Reader) Open(name string) (fs.File, error) {
+	return r.z.Open(name)
+}
+
+// ReadFile returns the content of the file at the path inside the EPUB.
+func (r *Reader) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(r.z, name)
+}
+
+// SectionContent returns the content of the XHTML document of the spine item,
+// e.g. a section.
+func (r *Reader) SectionContent(item SpineItem) ([]byte, error) {
+	return r.ReadFile(item.Item.Path)
+}
+
+// ReadSection is a document of the spine of an existing EPUB, as returned by a
+// SectionIterator.
+type ReadSection struct {
+	Item SpineItem // The spine item of the document
+	// The title of the document in the table of contents, or the title of the
+	// XHTML document if it isn't part of it
+	Title string
+	Body  []byte // The content of the body of the XHTML document
+	// The files of the manifest referenced by the document, e.g. its
+	// stylesheets and images, in the order they're first referenced. The
+	// documents of the spine it links to aren't included.
+	Resources []ManifestItem
+}
+
+// SectionIterator iterates over the documents of the spine of an existing
+// EPUB, reading them one at a time. See Reader.Sections.
+type SectionIterator struct {
+	r       *Reader
+	titles  map[string]string
+	items   map[string]ManifestItem
+	spine   map[string]bool
+	next    int
+	section ReadSection
+	err     error
+}
+
+// Sections returns an iterator over the documents of the spine, in reading
+// order, e.g. to index their text:
+//
+//	it := r.Sections()
+//	for it.Next() {
+//		section := it.Section()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+func (r *Reader) Sections() *SectionIterator {
+	it := &SectionIterator{
+		r:      r,
+		titles: make(map[string]string),
+		items:  make(map[string]ManifestItem),
+		spine:  make(map[string]bool),
+	}
+	tocTitles(r.TOC, it.titles)
+	for _, item := range r.Manifest {
+		it.items[item.Path] = item
+	}
+	for _, item := range r.Spine {
+		it.spine[item.Item.Path] = true
+	}
+	return it
+}
+
+// Next reads the next document of the spine, which is then returned by
+// Section. It returns false once all the documents are read or if one can't be
+// read, in which case Err returns the error.
+func (it *SectionIterator) Next() bool {
+	if it.err != nil || it.next >= len(it.r.Spine) {
+		return false
+	}
+	item := it.r.Spine[it.next]
+	it.next++
+	content, err := it.r.SectionContent(item)
+	if err != nil {
+		it.err = &InvalidEpubError{Path: item.Item.Path, Err: err}
+		return false
+	}
+	it.section = it.readSection(item, string(content))
+	return true
+}
+
+// Section returns the document read by the last call to Next.
+func (it *SectionIterator) Section() ReadSection {
+	return it.section
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *SectionIterator) Err() error {
+	return it.err
+}
+
+// readSection returns the section of the spine item given the content of its
+// XHTML document
+func (it *SectionIterator) readSection(item SpineItem, content string) ReadSection {
+	section := ReadSection{Item: item, Title: it.titles[item.Item.Path]}
+	head, body := content, content
+	if m := xhtmlBodyRegexp.FindStringSubmatchIndex(content); m != nil {
+		head = content[:m[0]]
+		body = content[m[2]:m[3]]
+	}
+	section.Body = []byte(body)
+	if section.Title == "" {
+		if m := xhtmlTitleRegexp.FindStringSubmatch(head); m != nil {
+			section.Title = strings.TrimSpace(html.UnescapeString(htmlTagRegexp.ReplaceAllString(m[1], "")))
+		}
+	}
+
+	found := make(map[string]bool)
+	for _, link := range findLinks(content) {
+		if isRemoteLink(link) {
+			continue
+		}
+		linkPath, _ := splitFragment(resolveHref(item.Item.Path, link))
+		resource, ok := it.items[linkPath]
+		if !ok || found[linkPath] || it.spine[linkPath] {
+			continue
+		}
+		found[linkPath] = true
+		section.Resources = append(section.Resources, resource)
+	}
+	return section
+}
+
+// tocTitles adds the title of the first entry of the table of contents of each
+// file to titles, by path
+func tocTitles(toc []TOCEntry, titles map[string]string) {
+	for _, entry := range toc {
+		entryPath, _ := splitFragment(entry.Path)
+		if _, ok := titles[entryPath]; !ok && entryPath != "" {
+			titles[entryPath] = entry.Title
+		}
+		tocTitles(entry.Children, titles)
+	}
+}
+
+// ReadMetadata reads the metadata of the EPUB read from r, which is size bytes
+// long, including its cover image. Unlike NewReader, it only reads the files
+// needed to get the metadata, e.g. for catalog software listing many EPUBs.
+func ReadMetadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	reader := &Reader{z: z}
+	if _, err := reader.readPackage(); err != nil {
+		return nil, err
+	}
+	return &reader.Metadata, nil
+}
+
+// init reads the package document and the table of contents of the EPUB
+func (r *Reader) init(z *zip.Reader) error {
+	r.z = z
+	p, err := r.readPackage()
+	if err != nil {
+		return err
+	}
+
+	items := make(map[string]ManifestItem)
+	var navPath, ncxPath string
+	for _, item := range r.Manifest {
+		items[item.ID] = item
+		if hasProperty(item.Properties, readerNavProperty) {
+			navPath = item.Path
+		}
+		if item.MediaType == mediaTypeNcx && (ncxPath == "" || item.ID == p.Spine.Toc) {
+			ncxPath = item.Path
+		}
+	}
+
+	for _, itemref := range p.Spine.Items {
+		item, ok := items[itemref.Idref]
+		if !ok && r.lenient {
+			continue
+		}
+		if !ok {
+			return &InvalidEpubError{Path: r.PackagePath, Err: fmt.Errorf("spine item %q not in the manifest", itemref.Idref)}
+		}
+		r.Spine = append(r.Spine, SpineItem{
+			Item:       item,
+			Linear:     itemref.Linear != "no",
+			Properties: itemref.Properties,
+		})
+	}
+
+	for _, reference := range p.Guide {
+		r.Guide = append(r.Guide, GuideReference{
+			Type:  reference.Type,
+			Title: reference.Title,
+			Path:  resolveHref(r.PackagePath, reference.Href),
+		})
+	}
+
+	var toc []TOCEntry
+	switch {
+	case navPath != "":
+		toc, err = r.readNavTOC(navPath)
+	case ncxPath != "":
+		toc, err = r.readNcxTOC(ncxPath)
+	}
+	if err != nil && !r.lenient {
+		return err
+	}
+	r.TOC = toc
+	return nil
+}
+
+// readPackage reads the package document of the EPUB, with its metadata and
+// manifest
+func (r *Reader) readPackage() (*readPkg, error) {
+	containerPath := path.Join(metaInfFolderName, containerFilename)
+	var c readContainer
+	if err := r.readXML(containerPath, &c); err != nil && !r.lenient {
+		return nil, err
+	}
+	for i := len(c.Rootfiles) - 1; i >= 0; i-- {
+		// The first package document is the default rendition
+		if c.Rootfiles[i].MediaType == mediaTypeOpf {
+			r.PackagePath = c.Rootfiles[i].FullPath
+		}
+	}
+	if r.lenient {
+		r.PackagePath = r.lenientPackagePath(c)
+	}
+	if r.PackagePath == "" {
+		return nil, &InvalidEpubError{Path: containerPath, Err: fmt.Errorf("no package document")}
+	}
+
+	var p readPkg
+	if err := r.readXML(r.PackagePath, &p); err != nil {
+		return nil, err
+	}
+	r.Version = p.Version
+	r.Metadata = p.Metadata.metadata(p.UniqueIdentifier)
+
+	// The cover image is the item with the cover-image property, or the item
+	// referenced by the cover <meta> element of EPUB v2 files
+	var coverID string
+	for _, meta := range p.Metadata.Meta {
+		if meta.Name == "cover" {
+			coverID = meta.Content
+		}
+	}
+	var cover *ManifestItem
+	for _, pkgItem := range p.ManifestItems {
+		item := ManifestItem{
+			ID:         pkgItem.ID,
+			Href:       pkgItem.Href,
+			Path:       resolveHref(r.PackagePath, pkgItem.Href),
+			MediaType:  pkgItem.MediaType,
+			Properties: pkgItem.Properties,
+		}
+		if r.lenient {
+			var ok bool
+			if item, ok = r.lenientManifestItem(item, p.Spine); !ok {
+				continue
+			}
+		}
+		r.Manifest = append(r.Manifest, item)
+		if hasProperty(item.Properties, coverImageProperties) || (cover == nil && item.ID == coverID) {
+			cover = &item
+		}
+	}
+
+	if cover != nil {
+		coverImage, err := r.ReadFile(cover.Path)
+		switch {
+		case err == nil:
+			r.Metadata.CoverImage = coverImage
+			r.coverPath = cover.Path
+			r.Metadata.CoverMediaType = cover.MediaType
+		case !r.lenient:
+			return nil, &InvalidEpubError{Path: cover.Path, Err: err}
+		}
+	}
+	return &p, nil
+}
+
+// readXML unmarshals the XML file at the path inside the EPUB into v
+func (r *Reader) readXML(name string, v interface{}) error {
+	content, err := r.ReadFile(name)
+	if err != nil {
+		return &InvalidEpubError{Path: name, Err: err}
+	}
+	if err := xml.Unmarshal(content, v); err != nil {
+		return &InvalidEpubError{Path: name, Err: err}
+	}
+	return nil
+}
+
+// metadata returns the metadata of the package document whose unique
+// identifier has the ID uniqueIdentifier
+func (m readPkgMetadata) metadata(uniqueIdentifier string) Metadata {
+	metadata := Metadata{
+		Title:       first(m.Titles),
+		Language:    first(m.Languages),
+		Description: first(m.Descriptions),
+	}
+	for _, identifier := range m.Identifiers {
+		if identifier.ID == uniqueIdentifier || metadata.Identifier == "" {
+			metadata.Identifier = strings.TrimSpace(identifier.Data)
+		}
+	}
+	for _, creator := range m.Creators {
+		metadata.Authors = append(metadata.Authors, strings.TrimSpace(creator))
+	}
+	for _, meta := range m.Meta {
+		if meta.Property == pkgModifiedProperty {
+			metadata.Modified = strings.TrimSpace(meta.Data)
+		}
+	}
+	return metadata
+}
+
+// readNavTOC reads the table of contents from the nav document at the path
+// inside the EPUB
+func (r *Reader) readNavTOC(navPath string) ([]TOCEntry, error) {
+	content, err := r.ReadFile(navPath)
+	if err != nil {
+		return nil, &InvalidEpubError{Path: navPath, Err: err}
+	}
+	d := xml.NewDecoder(bytes.NewReader(content))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, &InvalidEpubError{Path: navPath, Err: err}
+		}
+		start, ok := t.(xml.StartElement)
+		if !ok || start.Name.Local != "nav" {
+			continue
+		}
+		var nav readNav
+		if err := d.DecodeElement(&nav, &start); err != nil {
+			return nil, &InvalidEpubError{Path: navPath, Err: err}
+		}
+		if hasProperty(nav.EpubType, tocNavEpubType) {
+			return nav.List.entries(navPath), nil
+		}
+	}
+}
+
+func (l readNavList) entries(navPath string) []TOCEntry {
+	var entries []TOCEntry
+	for _, item := range l.Items {
+		link := item.A
+		if link.Href == "" && link.Inner == "" {
+			link = item.Span
+		}
+		entry := TOCEntry{
+			Title: strings.TrimSpace(html.UnescapeString(htmlTagRegexp.ReplaceAllString(link.Inner, ""))),
+		}
+		if link.Href != "" {
+			entry.Path = resolveHref(navPath, link.Href)
+		}
+		if item.List != nil {
+			entry.Children = item.List.entries(navPath)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// readNcxTOC reads the table of contents from the NCX document at the path
+// inside the EPUB
+func (r *Reader) readNcxTOC(ncxPath string) ([]TOCEntry, error) {
+	var ncx tocNcxRoot
+	if err := r.readXML(ncxPath, &ncx); err != nil {
+		return nil, err
+	}
+	return ncxEntries(ncxPath, ncx.NavMap), nil
+}
+
+func ncxEntries(ncxPath string, navPoints []tocNcxNavPoint) []TOCEntry {
+	var entries []TOCEntry
+	for _, navPoint := range navPoints {
+		entry := TOCEntry{
+			Title: strings.TrimSpace(navPoint.Text),
+			Path:  resolveHref(ncxPath, navPoint.Content.Src),
+		}
+		if navPoint.Children != nil {
+			entry.Children = ncxEntries(ncxPath, *navPoint.Children)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// resolveHref returns the path inside the EPUB of the href of the file at the
+// path inside the EPUB, keeping the fragment if any. Backslashes are read as
+// slashes, as some tools write Windows paths.
+func resolveHref(from string, href string) string {
+	u, err := url.Parse(strings.ReplaceAll(href, `\`, "/"))
+	if err != nil || u.IsAbs() {
+		return href
+	}
+	resolved := u.Path
+	if resolved != "" {
+		resolved = path.Join(path.Dir(from), resolved)
+	} else {
+		resolved = from
+	}
+	if u.Fragment != "" {
+		resolved += "#" + u.Fragment
+	}
+	return resolved
+}
+
+// hasProperty returns whether the space-separated list of properties contains
+// the property
+func hasProperty(properties string, property string) bool {
+	for _, p := range strings.Fields(properties) {
+		if p == property {
+			return true
+		}
+	}
+	return false
+}
+
+// first returns the first of the values, or an empty string if there's none
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
@@ -0,0 +1,361 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeEpubToBuffer writes the EPUB to a buffer
+func writeEpubToBuffer(t testing.TB, e *Epub) *bytes.Buffer {
+	t.Helper()
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	return &b
+}
+
+// newTestReader returns a reader of the EPUB written to a buffer
+func newTestReader(t testing.TB, e *Epub) *Reader {
+	t.Helper()
+	b := writeEpubToBuffer(t, e)
+	r, err := NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	return r
+}
+
+// zipTestFiles returns a zip file with the files
+func zipTestFiles(t testing.TB, files [][2]string) *bytes.Buffer {
+	t.Helper()
+	var b bytes.Buffer
+	z := zip.NewWriter(&b)
+	for _, file := range files {
+		w, err := z.Create(file[0])
+		if err != nil {
+			t.Fatalf("Unexpected error creating %s: %s", file[0], err)
+		}
+		if _, err := w.Write([]byte(file[1])); err != nil {
+			t.Fatalf("Unexpected error writing %s: %s", file[0], err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatalf("Unexpected error closing zip file: %s", err)
+	}
+	return &b
+}
+
+func TestReader(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	e.SetAuthor(testEpubAuthor)
+	e.SetIdentifier(testEpubIdentifier)
+	e.SetLang("fr")
+	e.SetDescription("A description")
+	imagePath, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	section1, err := e.AddSection(testSectionBody, "Section 1", "", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	if _, err := e.AddSubSection(section1, testSectionBody, "Section 1.1", "", ""); err != nil {
+		t.Fatalf("Error adding subsection: %s", err)
+	}
+	if _, err := e.AddSection(testSectionBody, "Section 2", "", ""); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+
+	r := newTestReader(t, e)
+
+	if r.Version != "3.0" {
+		t.Errorf("Got version %q, expected 3.0", r.Version)
+	}
+	expectedMetadata := Metadata{
+		Identifier:  testEpubIdentifier,
+		Title:       testEpubTitle,
+		Language:    "fr",
+		Description: "A description",
+		Authors:     []string{testEpubAuthor},
+		Modified:    r.Metadata.Modified,
+	}
+	if !reflect.DeepEqual(r.Metadata, expectedMetadata) {
+		t.Errorf("Got metadata %+v, expected %+v", r.Metadata, expectedMetadata)
+	}
+	if r.Metadata.Modified == "" {
+		t.Error("Modification date not read")
+	}
+
+	var imageFound bool
+	for _, item := range r.Manifest {
+		if item.Path == filepath.ToSlash(filepath.Join(contentFolderName, ImageFolderName, testImageFromFileFilename)) {
+			imageFound = item.MediaType == mediaTypePng && item.Href == strings.TrimPrefix(imagePath, "../")
+		}
+	}
+	if !imageFound {
+		t.Errorf("Image not found in manifest %+v", r.Manifest)
+	}
+
+	var spine []string
+	for _, item := range r.Spine {
+		spine = append(spine, item.Item.Path)
+		if !item.Linear {
+			t.Errorf("Spine item %s not linear", item.Item.Path)
+		}
+	}
+	expectedSpine := []string{
+		"EPUB/xhtml/section0001.xhtml",
+		"EPUB/xhtml/section0002.xhtml",
+		"EPUB/xhtml/section0003.xhtml",
+	}
+	if !reflect.DeepEqual(spine, expectedSpine) {
+		t.Errorf("Got spine %v, expected %v", spine, expectedSpine)
+	}
+
+	expectedTOC := []TOCEntry{
+		{Title: "Section 1", Path: "EPUB/xhtml/section0001.xhtml", Children: []TOCEntry{
+			{Title: "Section 1.1", Path: "EPUB/xhtml/section0002.xhtml"},
+		}},
+		{Title: "Section 2", Path: "EPUB/xhtml/section0003.xhtml"},
+	}
+	if !reflect.DeepEqual(r.TOC, expectedTOC) {
+		t.Errorf("Got TOC %+v, expected %+v", r.TOC, expectedTOC)
+	}
+
+	content, err := r.SectionContent(r.Spine[0])
+	if err != nil {
+		t.Fatalf("Unexpected error reading section: %s", err)
+	}
+	if !bytes.Contains(content, []byte(testSectionBody)) {
+		t.Errorf("Section content %s doesn't contain the section body", content)
+	}
+}
+
+func TestReaderEpub2(t *testing.T) {
+	b := zipTestFiles(t, [][2]string{
+		{"mimetype", mediaTypeEpub},
+		{"META-INF/container.xml", `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`},
+		{"OEBPS/content.opf", `<?xml version="1.0"?>
+<opf:package xmlns:opf="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="id">
+  <opf:metadata xmlns:d="http://purl.org/dc/elements/1.1/">
+    <d:title>EPUB 2</d:title>
+    <d:creator>First author</d:creator>
+    <d:creator>Second author</d:creator>
+    <d:identifier id="isbn">978-0-00-000000-0</d:identifier>
+    <d:identifier id="id">urn:uuid:1234</d:identifier>
+  </opf:metadata>
+  <opf:manifest>
+    <opf:item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <opf:item id="ch1" href="text/chapter%201.html" media-type="application/xhtml+xml"/>
+  </opf:manifest>
+  <opf:spine toc="ncx">
+    <opf:itemref idref="ch1" linear="no"/>
+  </opf:spine>
+</opf:package>`},
+		{"OEBPS/toc.ncx", `<?xml version="1.0"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <navMap>
+    <navPoint id="p1"><navLabel><text>Chapter 1</text></navLabel><content src="text/chapter%201.html#start"/></navPoint>
+  </navMap>
+</ncx>`},
+		{"OEBPS/text/chapter 1.html", "<html/>"},
+	})
+	r, err := NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+
+	expectedMetadata := Metadata{
+		Identifier: "urn:uuid:1234",
+		Title:      "EPUB 2",
+		Authors:    []string{"First author", "Second author"},
+	}
+	if !reflect.DeepEqual(r.Metadata, expectedMetadata) {
+		t.Errorf("Got metadata %+v, expected %+v", r.Metadata, expectedMetadata)
+	}
+	if len(r.Spine) != 1 || r.Spine[0].Item.Path != "OEBPS/text/chapter 1.html" || r.Spine[0].Linear {
+		t.Errorf("Got spine %+v, expected the non-linear chapter 1", r.Spine)
+	}
+	expectedTOC := []TOCEntry{{Title: "Chapter 1", Path: "OEBPS/text/chapter 1.html#start"}}
+	if !reflect.DeepEqual(r.TOC, expectedTOC) {
+		t.Errorf("Got TOC %+v, expected %+v", r.TOC, expectedTOC)
+	}
+	if _, err := r.SectionContent(r.Spine[0]); err != nil {
+		t.Errorf("Unexpected error reading section: %s", err)
+	}
+}
+
+func TestReaderInvalidEpub(t *testing.T) {
+	b := zipTestFiles(t, [][2]string{{"mimetype", mediaTypeEpub}})
+	_, err := NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	var invalidErr *InvalidEpubError
+	if !errors.As(err, &invalidErr) {
+		t.Fatalf("Got error %v, expected InvalidEpubError", err)
+	}
+	if invalidErr.Path != "META-INF/container.xml" {
+		t.Errorf("Got path %s, expected META-INF/container.xml", invalidErr.Path)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	epubPath := filepath.Join(t.TempDir(), testEpubFilename)
+	if err := e.Write(epubPath); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+
+	r, err := Open(epubPath)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+	defer r.Close()
+	if r.Metadata.Title != testEpubTitle {
+		t.Errorf("Got title %q, expected %q", r.Metadata.Title, testEpubTitle)
+	}
+	if len(r.TOC) != 1 || r.TOC[0].Title != testSectionTitle {
+		t.Errorf("Got TOC %+v, expected the section", r.TOC)
+	}
+}
+
+func TestReadMetadata(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	e.SetAuthor(testEpubAuthor)
+	e.SetIdentifier(testEpubIdentifier)
+	imagePath, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	e.SetCover(imagePath, "")
+	b := writeEpubToBuffer(t, e)
+
+	metadata, err := ReadMetadata(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading metadata: %s", err)
+	}
+	if metadata.Title != testEpubTitle || metadata.Identifier != testEpubIdentifier || !reflect.DeepEqual(metadata.Authors, []string{testEpubAuthor}) {
+		t.Errorf("Got metadata %+v, expected the metadata of the EPUB", metadata)
+	}
+	coverImage, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Error reading image: %s", err)
+	}
+	if !bytes.Equal(metadata.CoverImage, coverImage) {
+		t.Errorf("Got %d bytes of cover image, expected the %d bytes of %s", len(metadata.CoverImage), len(coverImage), testImageFromFileSource)
+	}
+	if metadata.CoverMediaType != mediaTypePng {
+		t.Errorf("Got cover media type %s, expected %s", metadata.CoverMediaType, mediaTypePng)
+	}
+}
+
+func TestReadMetadataEpub2Cover(t *testing.T) {
+	b := zipTestFiles(t, [][2]string{
+		{"META-INF/container.xml", `<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`},
+		{"content.opf", `<package xmlns="http://www.idpf.org/2007/opf" version="2.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>EPUB 2</dc:title>
+    <meta name="cover" content="cover-id"/>
+  </metadata>
+  <manifest>
+    <item id="cover-id" href="images/cover.jpg" media-type="image/jpeg"/>
+  </manifest>
+</package>`},
+		{"images/cover.jpg", "cover"},
+	})
+	metadata, err := ReadMetadata(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading metadata: %s", err)
+	}
+	if string(metadata.CoverImage) != "cover" || metadata.CoverMediaType != mediaTypeJpeg {
+		t.Errorf("Got cover image %q of type %s, expected the content of images/cover.jpg", metadata.CoverImage, metadata.CoverMediaType)
+	}
+}
+
+func TestReaderSections(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	imagePath, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	cssPath, err := e.AddCSSFromString("p { color: red; }", "style.css")
+	if err != nil {
+		t.Fatalf("Error adding CSS: %s", err)
+	}
+	body := fmt.Sprintf(`<p><img src="%s" alt=""/><a href="section0002.xhtml#top">Next</a><img src="%s" alt=""/></p>`, imagePath, imagePath)
+	if _, err := e.AddSectionWithOptions(body, SectionOptions{Title: "Section 1", CSS: []string{cssPath}}); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	if _, err := e.AddSectionWithOptions(`<p id="top">Untitled</p>`, SectionOptions{}); err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	r := newTestReader(t, e)
+
+	var sections []ReadSection
+	it := r.Sections()
+	for it.Next() {
+		sections = append(sections, it.Section())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Unexpected error iterating sections: %s", err)
+	}
+	if len(sections) != 2 {
+		t.Fatalf("Got %d sections, expected 2", len(sections))
+	}
+
+	if sections[0].Title != "Section 1" {
+		t.Errorf("Got title %q, expected Section 1", sections[0].Title)
+	}
+	if !strings.Contains(string(sections[0].Body), `href="section0002.xhtml#top"`) || strings.Contains(string(sections[0].Body), "<body") {
+		t.Errorf("Got body %s, expected the content of the body", sections[0].Body)
+	}
+	var resources []string
+	for _, resource := range sections[0].Resources {
+		resources = append(resources, resource.Path)
+	}
+	expectedResources := []string{"EPUB/css/style.css", "EPUB/images/" + testImageFromFileFilename}
+	if !reflect.DeepEqual(resources, expectedResources) {
+		t.Errorf("Got resources %v, expected %v", resources, expectedResources)
+	}
+	if sections[1].Item.Item.Path != "EPUB/xhtml/section0002.xhtml" || len(sections[1].Resources) != 0 {
+		t.Errorf("Got second section %+v, expected section0002.xhtml without resources", sections[1])
+	}
+}
+
+func TestReaderSectionsMissingFile(t *testing.T) {
+	b := zipTestFiles(t, [][2]string{
+		{"META-INF/container.xml", `<container xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`},
+		{"content.opf", `<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <manifest><item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="ch1"/></spine>
+</package>`},
+	})
+	r, err := NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	it := r.Sections()
+	if it.Next() {
+		t.Error("Expected the iteration to stop")
+	}
+	var invalidErr *InvalidEpubError
+	if !errors.As(it.Err(), &invalidErr) || invalidErr.Path != "ch1.xhtml" {
+		t.Errorf("Got error %v, expected InvalidEpubError for ch1.xhtml", it.Err())
+	}
+}
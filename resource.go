@@ -0,0 +1,136 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Resource is a file added to the EPUB by AddCSS, AddCSSFromString, AddFont,
+// AddFontBytes, AddImage, AddVideo, AddAudio or AddRawFile, as returned by
+// Resource. It saves building links to the file by hand.
+type Resource struct {
+	// The path of the file relative to the EPUB content folder, e.g.
+	// images/image0001.png or data/chapters.json
+	Path string
+	// The folder of the file (CSSFolderName, FontFolderName, ImageFolderName,
+	// VideoFolderName or AudioFolderName), empty for the files added by
+	// AddRawFile
+	Folder string
+	// The media type of the file in the manifest, e.g. image/png
+	MediaType string
+	// The ID of the manifest item of the file
+	ID string
+}
+
+// String returns the relative path to the file that can be used in EPUB
+// sections, as returned when the file was added, e.g. ../images/image0001.png
+func (r Resource) String() string {
+	return path.Join("..", r.Path)
+}
+
+// Href returns the link to the file from the section with the internal
+// filename, e.g. ../images/image0001.png from section0001.xhtml.
+func (r Resource) Href(fromSection string) string {
+	return relativeHref(path.Join(xhtmlFolderName, fromSection), r.Path)
+}
+
+// HrefFrom returns the link to the file from another file of the EPUB, e.g.
+// ../fonts/font.otf from the CSS file css/style.css.
+func (r Resource) HrefFrom(from Resource) string {
+	return relativeHref(from.Path, r.Path)
+}
+
+// Resource returns the file added to the EPUB with the internal path, which is
+// the path returned when the file was added, e.g. ../images/image0001.png. If
+// no file with this path exists, MediaDoesNotExistError will be returned.
+//
+// The media type is the one set by SetMediaType or passed to AddRawFile, or
+// else the one detected from the content as Write does, so the file is retrieved
+// from its source in that case. The ID of a file added by AddRawFile depends on
+// the paths of the other files added by AddRawFile, so it may change when files
+// are added.
+func (e *Epub) Resource(internalPath string) (Resource, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	resourcePath := strings.TrimPrefix(path.Clean(internalPath), "../")
+	folderName, filename := path.Split(resourcePath)
+	folderName = strings.TrimSuffix(folderName, "/")
+	g := e.grabber()
+
+	if mediaMap, ok := e.mediaFolders()[folderName]; ok {
+		source, ok := mediaMap[filename]
+		if !ok {
+			return Resource{}, &MediaDoesNotExistError{Path: internalPath}
+		}
+		mediaType, ok := e.mediaTypes[resourcePath]
+		if !ok {
+			var err error
+			_, mediaType, err = g.fetchMediaData(context.Background(), source, filename)
+			if err != nil {
+				return Resource{}, err
+			}
+			if folderName == AudioFolderName || folderName == VideoFolderName {
+				mediaType = audioVideoMediaType(mediaType, folderName)
+			}
+		}
+		return Resource{
+			Path:      resourcePath,
+			Folder:    folderName,
+			MediaType: mediaType,
+			ID:        SanitizeXMLID(filename),
+		}, nil
+	}
+
+	rawFile, ok := e.rawFiles[resourcePath]
+	if !ok {
+		return Resource{}, &MediaDoesNotExistError{Path: internalPath}
+	}
+	mediaType := rawFile.mediaType
+	if mediaType == "" {
+		var err error
+		_, mediaType, err = g.fetchMediaData(context.Background(), rawFile.source, filename)
+		if err != nil {
+			return Resource{}, err
+		}
+	}
+	// The IDs of the raw files follow the order of their paths (see
+	// writeRawFiles)
+	rawPaths := make([]string, 0, len(e.rawFiles))
+	for rawPath := range e.rawFiles {
+		rawPaths = append(rawPaths, rawPath)
+	}
+	sort.Strings(rawPaths)
+	return Resource{
+		Path:      resourcePath,
+		MediaType: mediaType,
+		ID:        fmt.Sprintf(rawFileItemIDFormat, sort.SearchStrings(rawPaths, resourcePath)+1),
+	}, nil
+}
+
+// relativeHref returns the link to the file at toPath from the file at
+// fromPath, both relative to the EPUB content folder
+func relativeHref(fromPath string, toPath string) string {
+	fromDirs := strings.Split(path.Dir(fromPath), "/")
+	toDirs := strings.Split(path.Dir(toPath), "/")
+	if fromDirs[0] == "." {
+		fromDirs = nil
+	}
+	if toDirs[0] == "." {
+		toDirs = nil
+	}
+	common := 0
+	for common < len(fromDirs) && common < len(toDirs) && fromDirs[common] == toDirs[common] {
+		common++
+	}
+	parts := make([]string, 0, len(fromDirs)-common+len(toDirs)-common+1)
+	for range fromDirs[common:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, toDirs[common:]...)
+	parts = append(parts, path.Base(toPath))
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,82 @@
+package epub
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResource(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	imagePath, err := e.AddImage(testImageFromFileSource, "1 image.png")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	cssPath, err := e.AddCSSFromString("p {}", "style.css")
+	if err != nil {
+		t.Fatalf("Error adding CSS: %s", err)
+	}
+	fontPath, err := e.AddFont("testdata/redacted-script-regular.ttf", "")
+	if err != nil {
+		t.Fatalf("Error adding font: %s", err)
+	}
+	if err := e.SetMediaType(fontPath, "font/ttf"); err != nil {
+		t.Fatalf("Error setting media type: %s", err)
+	}
+	dataPath, err := e.AddRawFile("data:application/json,%7B%7D", "data/sub/b.json", "")
+	if err != nil {
+		t.Fatalf("Error adding raw file: %s", err)
+	}
+	if _, err := e.AddRawFile("data:application/json,%7B%7D", "data/a.json", "application/json"); err != nil {
+		t.Fatalf("Error adding raw file: %s", err)
+	}
+
+	testCases := []struct {
+		internalPath string
+		expected     Resource
+	}{
+		{imagePath, Resource{Path: "images/1 image.png", Folder: ImageFolderName, MediaType: mediaTypePng, ID: "id1image.png"}},
+		{cssPath, Resource{Path: "css/style.css", Folder: CSSFolderName, MediaType: mediaTypeCSS, ID: "style.css"}},
+		{fontPath, Resource{Path: "fonts/redacted-script-regular.ttf", Folder: FontFolderName, MediaType: "font/ttf", ID: "redacted-script-regular.ttf"}},
+		{dataPath, Resource{Path: "data/sub/b.json", MediaType: "application/json", ID: "file0002"}},
+	}
+	for _, testCase := range testCases {
+		r, err := e.Resource(testCase.internalPath)
+		if err != nil {
+			t.Fatalf("Error getting resource %s: %s", testCase.internalPath, err)
+		}
+		if r != testCase.expected {
+			t.Errorf("Got resource %+v, expected %+v", r, testCase.expected)
+		}
+		if r.String() != testCase.internalPath {
+			t.Errorf("Got resource string %s, expected %s", r, testCase.internalPath)
+		}
+	}
+
+	image, _ := e.Resource(imagePath)
+	css, _ := e.Resource(cssPath)
+	font, _ := e.Resource(fontPath)
+	data, _ := e.Resource(dataPath)
+	hrefs := []struct {
+		got      string
+		expected string
+	}{
+		{image.Href("section0001.xhtml"), "../images/1 image.png"},
+		{font.HrefFrom(css), "../fonts/redacted-script-regular.ttf"},
+		{image.HrefFrom(data), "../../images/1 image.png"},
+		{data.HrefFrom(image), "../data/sub/b.json"},
+		{css.HrefFrom(css), "style.css"},
+	}
+	for _, href := range hrefs {
+		if href.got != href.expected {
+			t.Errorf("Got href %s, expected %s", href.got, href.expected)
+		}
+	}
+
+	var mediaErr *MediaDoesNotExistError
+	if _, err := e.Resource("../images/missing.png"); !errors.As(err, &mediaErr) {
+		t.Errorf("Got error %v, expected MediaDoesNotExistError", err)
+	}
+	if _, err := e.Resource("../other/missing.json"); !errors.As(err, &mediaErr) {
+		t.Errorf("Got error %v, expected MediaDoesNotExistError", err)
+	}
+}
@@ -0,0 +1,235 @@
+package epub
+
+import (
+	"bytes"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// SanitizePolicy is the elements, attributes and URLs allowed in the bodies of
+// the sections of untrusted content (see SetSanitizePolicy). Everything else is
+// removed.
+type SanitizePolicy struct {
+	// The key is the name of an allowed element in lowercase, e.g. img, the
+	// value is the attributes allowed on it, e.g. src and alt
+	Elements map[string][]string
+	// Attributes allowed on all the allowed elements, e.g. id
+	GlobalAttributes []string
+	// Schemes allowed in URLs, e.g. https; relative URLs are always allowed
+	URLSchemes []string
+}
+
+var (
+	// Elements removed along with their content, rather than only their tags
+	sanitizeSkippedElements = []string{"iframe", "noembed", "noframes", "noscript", "object", "script", "style", "template", "title"}
+	// Attributes whose value is a URL
+	sanitizeURLAttributes = []string{"action", "background", "cite", "formaction", "href", "poster", "src", "xlink:href"}
+	// Elements that have no content, written as self-closing tags
+	sanitizeVoidElements = []string{"area", "br", "col", "hr", "img", "source", "track", "wbr"}
+)
+
+// DefaultSanitizePolicy returns a policy that allows the elements and
+// attributes commonly used for the content of books: text, headings, lists,
+// tables, figures, links, images, audio and video. Scripts, forms, frames,
+// styles and event handlers aren't allowed, nor are URLs with a scheme other
+// than http, https and mailto.
+func DefaultSanitizePolicy() *SanitizePolicy {
+	elements := map[string][]string{
+		"a":     {"href"},
+		"audio": {"controls", "src"},
+		"img":   {"alt", "height", "src", "width"},
+		"ol":    {"reversed", "start", "type"},
+		"q":     {"cite"},
+		"td":    {"colspan", "rowspan"},
+		"th":    {"colspan", "rowspan", "scope"},
+		"video": {"controls", "height", "poster", "src", "width"},
+	}
+	for _, element := range []string{
+		"abbr", "article", "aside", "b", "blockquote", "br", "caption", "cite",
+		"code", "col", "colgroup", "dd", "del", "dfn", "div", "dl", "dt", "em",
+		"figcaption", "figure", "footer", "h1", "h2", "h3", "h4", "h5", "h6",
+		"header", "hr", "i", "ins", "kbd", "li", "mark", "nav", "p", "pre",
+		"s", "samp", "section", "small", "span", "strong", "sub", "sup",
+		"table", "tbody", "tfoot", "thead", "time", "tr", "u", "ul", "var",
+	} {
+		elements[element] = nil
+	}
+	elements["blockquote"] = []string{"cite"}
+	elements["source"] = []string{"src", "type"}
+	elements["track"] = []string{"default", "kind", "label", "src", "srclang"}
+	return &SanitizePolicy{
+		Elements:         elements,
+		GlobalAttributes: []string{"class", "dir", "epub:type", "id", "lang", "title", "xml:lang"},
+		URLSchemes:       []string{"http", "https", "mailto"},
+	}
+}
+
+// SetSanitizePolicy sanitizes the bodies of the sections with the policy when
+// the EPUB is written, for EPUBs built from untrusted content, e.g. HTML
+// submitted by users or scraped from websites. Elements that aren't allowed are
+// removed but their content is kept, except for the content of scripts, styles,
+// frames and objects. Attributes that aren't allowed, including event handlers,
+// and URLs with a scheme that isn't allowed, e.g. javascript:, are removed.
+// Comments are removed as well. The bodies are written as well-formed XHTML,
+// with the elements left open by the content closed.
+//
+// Use DefaultSanitizePolicy for a policy suited to most books, or nil to write
+// the bodies as is, which is the default. The sections themselves aren't
+// changed. The cover page, whose body is generated from the cover template
+// (see SetCoverTemplate), isn't sanitized.
+func (e *Epub) SetSanitizePolicy(policy *SanitizePolicy) {
+	e.Lock()
+	defer e.Unlock()
+	if policy != nil {
+		elements := make(map[string][]string, len(policy.Elements))
+		for element, attributes := range policy.Elements {
+			elements[strings.ToLower(element)] = slices.Clone(attributes)
+		}
+		policy = &SanitizePolicy{
+			Elements:         elements,
+			GlobalAttributes: slices.Clone(policy.GlobalAttributes),
+			URLSchemes:       slices.Clone(policy.URLSchemes),
+		}
+	}
+	e.sanitizePolicy = policy
+}
+
+// Sanitize returns the HTML content sanitized with the policy, as well-formed
+// XHTML (see SetSanitizePolicy).
+func (p *SanitizePolicy) Sanitize(content string) string {
+	var sanitized strings.Builder
+	z := html.NewTokenizer(strings.NewReader(content))
+	// The allowed elements open so far, innermost last
+	var open []string
+	// The element whose content is skipped, if any, and how many elements with
+	// the same name are open inside it
+	skipped := ""
+	skippedDepth := 0
+	for {
+		tokenType := z.Next()
+		// The tokenizer only fails reading, which can't happen with a string,
+		// so the error is the end of the content
+		if tokenType == html.ErrorToken {
+			break
+		}
+		token := z.Token()
+		name := strings.ToLower(token.Data)
+
+		if skipped != "" {
+			switch {
+			case tokenType == html.StartTagToken && name == skipped:
+				skippedDepth++
+			case tokenType == html.EndTagToken && name == skipped:
+				if skippedDepth == 0 {
+					skipped = ""
+				} else {
+					skippedDepth--
+				}
+			}
+			continue
+		}
+
+		switch tokenType {
+		case html.TextToken:
+			sanitized.WriteString(html.EscapeString(token.Data))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if tokenType == html.StartTagToken && slices.Contains(sanitizeSkippedElements, name) {
+				skipped = name
+				continue
+			}
+			allowed, ok := p.Elements[name]
+			if !ok {
+				continue
+			}
+			sanitized.WriteString("<" + name)
+			for _, attr := range token.Attr {
+				key := strings.ToLower(attr.Key)
+				if attr.Namespace != "" {
+					key = strings.ToLower(attr.Namespace) + ":" + key
+				}
+				if !slices.Contains(allowed, key) && !slices.Contains(p.GlobalAttributes, key) {
+					continue
+				}
+				if slices.Contains(sanitizeURLAttributes, key) && !p.allowsURL(attr.Val) {
+					continue
+				}
+				sanitized.WriteString(" " + key + `="` + html.EscapeString(attr.Val) + `"`)
+			}
+			if tokenType == html.SelfClosingTagToken || slices.Contains(sanitizeVoidElements, name) {
+				sanitized.WriteString(" />")
+			} else {
+				sanitized.WriteString(">")
+				open = append(open, name)
+			}
+		case html.EndTagToken:
+			// The elements left open inside the element are closed with it,
+			// end tags of elements that aren't open are removed
+			i := len(open) - 1
+			for i >= 0 && open[i] != name {
+				i--
+			}
+			if i == -1 {
+				continue
+			}
+			for len(open) > i {
+				sanitized.WriteString("</" + open[len(open)-1] + ">")
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	for len(open) > 0 {
+		sanitized.WriteString("</" + open[len(open)-1] + ">")
+		open = open[:len(open)-1]
+	}
+	return sanitized.String()
+}
+
+// allowsURL returns whether the URL is relative or has an allowed scheme
+func (p *SanitizePolicy) allowsURL(rawURL string) bool {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" || slices.Contains(p.URLSchemes, strings.ToLower(u.Scheme))
+}
+
+// sanitizeFileWriter returns an epubFileWriter that sanitizes the bodies of
+// the sections with the sanitize policy. The cover page and the navigation
+// document are generated by the EPUB, so they're written as is.
+func (e *Epub) sanitizeFileWriter(w epubFileWriter) epubFileWriter {
+	policy := e.sanitizePolicy
+	cover := ""
+	if e.cover.xhtmlFilename != "" {
+		cover = path.Join(contentFolderName, xhtmlFolderName, e.cover.xhtmlFilename)
+	}
+	nav := path.Join(contentFolderName, tocNavFilename)
+	return func(name string, mediaType string, content []byte) error {
+		if mediaType == mediaTypeXhtml && name != cover && name != nav {
+			content = sanitizeSection(content, policy)
+		}
+		return w(name, mediaType, content)
+	}
+}
+
+// sanitizeSection returns the content of the XHTML file of a section with its
+// body sanitized with the policy
+func sanitizeSection(content []byte, policy *SanitizePolicy) []byte {
+	bodyStart := bytes.Index(content, []byte("<body"))
+	if bodyStart == -1 {
+		return content
+	}
+	bodyStart += bytes.IndexByte(content[bodyStart:], '>') + 1
+	bodyEnd := bytes.LastIndex(content, []byte("</body>"))
+	if bodyEnd < bodyStart {
+		return content
+	}
+	body := policy.Sanitize(string(content[bodyStart:bodyEnd]))
+	sanitized := make([]byte, 0, len(content))
+	sanitized = append(sanitized, content[:bodyStart]...)
+	sanitized = append(sanitized, body...)
+	return append(sanitized, content[bodyEnd:]...)
+}
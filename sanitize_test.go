@@ -0,0 +1,143 @@
+package epub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	policy := DefaultSanitizePolicy()
+	for _, test := range []struct {
+		content  string
+		expected string
+	}{
+		{`<p id="p1" onclick="alert(1)">Text</p>`, `<p id="p1">Text</p>`},
+		{`<p>Before<script>alert("<p>")</script>after</p>`, `<p>Beforeafter</p>`},
+		{`<iframe src="https://example.com"><p>Fallback</p></iframe><p>Text</p>`, `<p>Text</p>`},
+		{`<object><object></object><p>Fallback</p></object><p>Text</p>`, `<p>Text</p>`},
+		{`<form action="/"><p>Kept</p></form>`, `<p>Kept</p>`},
+		{`<a href="javascript:alert(1)">Link</a>`, `<a>Link</a>`},
+		{`<a href=" JavaScript:alert(1)">Link</a>`, `<a>Link</a>`},
+		{"<a href=\"java\tscript:alert(1)\">Link</a>", `<a>Link</a>`},
+		{`<a href="https://example.com/?a=1&amp;b=2">Link</a>`, `<a href="https://example.com/?a=1&amp;b=2">Link</a>`},
+		{`<a href="chapter.xhtml#note1">Link</a>`, `<a href="chapter.xhtml#note1">Link</a>`},
+		{`<img src="data:image/svg+xml;base64,AAAA" alt="Image">`, `<img alt="Image" />`},
+		{`<img src="../images/image.png" alt="Image"><br>`, `<img src="../images/image.png" alt="Image" /><br />`},
+		{`<p epub:type="footnote" style="color: red">Text</p>`, `<p epub:type="footnote">Text</p>`},
+		{`<!-- Comment --><p>Text &nbsp;&amp; more</p>`, "<p>Text \u00a0&amp; more</p>"},
+		// The content is written as well-formed XHTML
+		{`<ul><li>One<li>Two</ul>`, `<ul><li>One<li>Two</li></li></ul>`},
+		{`<p><em>Text</p></em>`, `<p><em>Text</em></p>`},
+		{`<div><p>Text`, `<div><p>Text</p></div>`},
+	} {
+		if sanitized := policy.Sanitize(test.content); sanitized != test.expected {
+			t.Errorf("Got %s sanitizing %s, expected %s", sanitized, test.content, test.expected)
+		}
+	}
+}
+
+func TestSetSanitizePolicy(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	section, err := e.AddSection(`<p onmouseover="steal()">Text<script>steal()</script></p>
+<figure id="figure"><figcaption>Figure</figcaption></figure>`, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	policy := DefaultSanitizePolicy()
+	e.SetSanitizePolicy(policy)
+	// The policy is copied
+	delete(policy.Elements, "p")
+	e.SetFigureNumbering("Figure", "")
+
+	r := newTestReader(t, e)
+	content, err := r.ReadFile("EPUB/xhtml/" + section)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		`<title dir="auto">` + testSectionTitle + `</title>`,
+		`<p>Text</p>`,
+		// The markup added when writing is kept
+		`<figcaption>Figure 1. Figure</figcaption>`,
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("Section doesn't contain %s:\n%s", expected, content)
+		}
+	}
+	if strings.Contains(string(content), "steal") {
+		t.Errorf("Section not sanitized:\n%s", content)
+	}
+
+	findings, err := e.Validate()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("Unexpected findings: %+v", findings)
+	}
+
+	e.SetSanitizePolicy(nil)
+	r = newTestReader(t, e)
+	content, err = r.ReadFile("EPUB/xhtml/" + section)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(string(content), "steal") {
+		t.Errorf("Section sanitized without a policy:\n%s", content)
+	}
+}
+
+// The manifest properties are those of the sanitized sections
+func TestSetSanitizePolicyManifestProperties(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	section, err := e.AddSection(`<p>Text</p><script>alert(1)</script><svg xmlns="http://www.w3.org/2000/svg"></svg>`, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := `href="xhtml/` + section + `" media-type="application/xhtml+xml" properties="scripted svg"`
+	r := newTestReader(t, e)
+	opf, err := r.ReadFile("EPUB/package.opf")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(string(opf), expected) {
+		t.Errorf("Package file doesn't contain %s:\n%s", expected, opf)
+	}
+
+	e.SetSanitizePolicy(DefaultSanitizePolicy())
+	r = newTestReader(t, e)
+	opf, err = r.ReadFile("EPUB/package.opf")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected = `href="xhtml/` + section + `" media-type="application/xhtml+xml"></item>`
+	if !strings.Contains(string(opf), expected) {
+		t.Errorf("Package file doesn't contain %s:\n%s", expected, opf)
+	}
+}
+
+// The cover page generated by the EPUB isn't sanitized
+func TestSetSanitizePolicyCover(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if err := e.SetCoverTemplate(SVGCoverTemplate); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := e.SetCoverFromSource(testImageFromFileSource); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e.SetSanitizePolicy(DefaultSanitizePolicy())
+
+	r := newTestReader(t, e)
+	content, err := r.ReadFile("EPUB/xhtml/cover.xhtml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{"<svg", `xlink:href="../images/cover.png"`} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("Cover doesn't contain %s:\n%s", expected, content)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package epub
+
+import (
+	"runtime"
+)
+
+// Number of section files each worker of a sectionSerializer may serialize
+// ahead of the write
+const sectionSerializerWindow = 4
+
+// sectionSerializer serializes the XHTML files of sections with a pool of
+// workers while they're written one after the other in order, so that writing
+// books with thousands of sections isn't bound by the serialization of each
+// section in turn. Only a few sections are serialized ahead of the write, so
+// that the content of all the sections isn't held in memory at once.
+type sectionSerializer struct {
+	// The content of each section, by filename
+	contents map[string]chan []byte
+	// Holds a token for each section being serialized or serialized but not
+	// written yet
+	pending chan struct{}
+	// Closed once the write is done, even if it failed
+	done chan struct{}
+}
+
+// newSectionSerializer starts serializing the sections in the order they're
+// written. stop must be called once they're written.
+func newSectionSerializer(sections []*epubSection) *sectionSerializer {
+	workers := runtime.GOMAXPROCS(0)
+	ss := &sectionSerializer{
+		contents: make(map[string]chan []byte, len(sections)),
+		pending:  make(chan struct{}, workers*sectionSerializerWindow),
+		done:     make(chan struct{}),
+	}
+	for _, s := range sections {
+		ss.contents[s.filename] = make(chan []byte, 1)
+	}
+
+	jobs := make(chan *epubSection)
+	go func() {
+		defer close(jobs)
+		for _, s := range sections {
+			select {
+			case ss.pending <- struct{}{}:
+			case <-ss.done:
+				return
+			}
+			jobs <- s
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for s := range jobs {
+				ss.contents[s.filename] <- s.xhtml.content()
+			}
+		}()
+	}
+	return ss
+}
+
+// content returns the content of the XHTML file of the section, waiting until
+// it's serialized
+func (ss *sectionSerializer) content(s *epubSection) []byte {
+	contents, ok := ss.contents[s.filename]
+	if !ok {
+		return s.xhtml.content()
+	}
+	content := <-contents
+	<-ss.pending
+	return content
+}
+
+// stop stops serializing the sections that haven't been serialized yet
+func (ss *sectionSerializer) stop() {
+	close(ss.done)
+}
+
+// writtenSections returns the sections whose files are written by
+// writeSections, in the order they're written. The subsections of the sections
+// that aren't in the TOC are left out.
+func (e *Epub) writtenSections() []*epubSection {
+	sections := make([]*epubSection, 0, len(e.sections))
+	for i := range e.sections {
+		section := &e.sections[i]
+		sections = append(sections, section)
+		if section.children != nil && !section.auxiliary && section.tocLabel() != "" && section.filename != e.cover.xhtmlFilename {
+			children := *section.children
+			for j := range children {
+				sections = append(sections, &children[j])
+			}
+		}
+	}
+	return sections
+}
@@ -0,0 +1,66 @@
+package epub
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+)
+
+func TestWriteSectionsConcurrently(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	for i := 0; i < 200; i++ {
+		parent, err := e.AddSection(fmt.Sprintf("<p>Section %d</p>", i), fmt.Sprintf("Section %d", i), "", "")
+		if err != nil {
+			t.Fatalf("Error adding section: %s", err)
+		}
+		if _, err := e.AddSubSection(parent, fmt.Sprintf("<p>Subsection %d</p>", i), fmt.Sprintf("Subsection %d", i), "", ""); err != nil {
+			t.Fatalf("Error adding subsection: %s", err)
+		}
+	}
+
+	var names []string
+	contents := map[string][]byte{}
+	err := e.writeSections(func(name string, mediaType string, content []byte) error {
+		names = append(names, name)
+		contents[name] = content
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error writing sections: %s", err)
+	}
+
+	sections := e.writtenSections()
+	if len(names) != len(sections) {
+		t.Fatalf("Got %d section files, expected %d", len(names), len(sections))
+	}
+	for i, s := range sections {
+		name := path.Join(contentFolderName, xhtmlFolderName, s.filename)
+		if names[i] != name {
+			t.Errorf("Got %s as section file %d, expected %s", names[i], i, name)
+		}
+		if string(contents[name]) != string(s.xhtml.content()) {
+			t.Errorf("Content of %s doesn't match the section", name)
+		}
+	}
+
+	// A failing write stops the serialization of the remaining sections
+	e = NewEpub(testEpubTitle)
+	for i := 0; i < 200; i++ {
+		if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+			t.Fatalf("Error adding section: %s", err)
+		}
+	}
+	errWrite := errors.New("write failed")
+	written := 0
+	err = e.writeSections(func(name string, mediaType string, content []byte) error {
+		written++
+		if written == 3 {
+			return errWrite
+		}
+		return nil
+	})
+	if !errors.Is(err, errWrite) {
+		t.Errorf("Got error %v, expected %v", err, errWrite)
+	}
+}
@@ -0,0 +1,225 @@
+package epub
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	dsigC14NAlgorithm      = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+	dsigECDSASHA256        = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	dsigRSASHA256          = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	dsigSHA256             = "http://www.w3.org/2001/04/xmlenc#sha256"
+	signatureManifestID    = "manifest"
+	signaturesFilename     = "signatures.xml"
+	signaturesFileTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<signatures xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <Signature xmlns="http://www.w3.org/2000/09/xmldsig#" Id="signature">
+    %s
+    <SignatureValue>%s</SignatureValue>%s
+    <Object>%s</Object>
+  </Signature>
+</signatures>
+`
+	xmlnsDsig = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+// ErrUnsupportedSigner is returned by SetSigner if the key of the signer is
+// neither an RSA nor an ECDSA key.
+var ErrUnsupportedSigner = errors.New("only RSA and ECDSA signers are supported")
+
+// SetSigner sets the signer used to sign the EPUB when it's written, or nil to
+// leave it unsigned. A signed EPUB has a META-INF/signatures.xml file with an
+// XML signature (XML-DSig) of the SHA-256 digests of all its other files except
+// the mimetype file, as defined by the Open Container Format. The certificate
+// of the signer is added to the signature unless it's nil, so that the
+// signature can be verified.
+//
+// Signed EPUBs are written directly (see SetDirectWrite), so that their files
+// are digested as they're written. If the key of the signer isn't an RSA or an
+// ECDSA key, ErrUnsupportedSigner will be returned.
+func (e *Epub) SetSigner(signer crypto.Signer, certificate *x509.Certificate) error {
+	e.Lock()
+	defer e.Unlock()
+	if signer != nil {
+		if _, err := signatureMethod(signer); err != nil {
+			return err
+		}
+	}
+	e.signer = signer
+	e.signerCertificate = certificate
+	return nil
+}
+
+// signatureMethod returns the algorithm of the signatures of the signer
+func signatureMethod(signer crypto.Signer) (string, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return dsigRSASHA256, nil
+	case *ecdsa.PublicKey:
+		return dsigECDSASHA256, nil
+	}
+	return "", ErrUnsupportedSigner
+}
+
+// signingSink digests the files of an EPUB written to another sink, in order to
+// sign them
+type signingSink struct {
+	epubSink
+	names   []string
+	digests map[string][]byte
+}
+
+func newSigningSink(sink epubSink) *signingSink {
+	return &signingSink{epubSink: sink, digests: make(map[string][]byte)}
+}
+
+func (s *signingSink) create(name string, mediaType string) (io.WriteCloser, error) {
+	w, err := s.epubSink.create(name, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	return &digestWriter{WriteCloser: w, hash: sha256.New(), done: func(digest []byte) {
+		s.add(name, digest)
+	}}, nil
+}
+
+func (s *signingSink) write(name string, mediaType string, content []byte) error {
+	if err := s.epubSink.write(name, mediaType, content); err != nil {
+		return err
+	}
+	digest := sha256.Sum256(content)
+	s.add(name, digest[:])
+	return nil
+}
+
+// add adds the digest of a file, the mimetype file being left out
+func (s *signingSink) add(name string, digest []byte) {
+	if name == mimetypeFilename {
+		return
+	}
+	if _, ok := s.digests[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.digests[name] = digest
+}
+
+// digestWriter digests the content written to a file of the EPUB, the digest
+// is passed to done once the file is closed
+type digestWriter struct {
+	io.WriteCloser
+	hash hash.Hash
+	done func(digest []byte)
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+func (w *digestWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w.done(w.hash.Sum(nil))
+	return nil
+}
+
+// writeSignatures signs the files written to the signing sink and writes the
+// signatures file to the sink it wraps. The signed elements (SignedInfo and
+// Manifest) are written in their canonical form, without whitespace, so that
+// their canonicalization only adds the declaration of their namespace.
+func (e *Epub) writeSignatures(s *signingSink) error {
+	var manifest strings.Builder
+	fmt.Fprintf(&manifest, `<Manifest Id="%s">`, signatureManifestID)
+	for _, name := range s.names {
+		fmt.Fprintf(&manifest, `<Reference URI="%s">%s</Reference>`, c14nAttr((&url.URL{Path: name}).EscapedPath()), digestElements(s.digests[name]))
+	}
+	manifest.WriteString(`</Manifest>`)
+
+	method, err := signatureMethod(e.signer)
+	if err != nil {
+		return err
+	}
+	manifestDigest := sha256.Sum256([]byte(canonicalDsigElement(manifest.String())))
+	signedInfo := fmt.Sprintf(
+		`<SignedInfo><CanonicalizationMethod Algorithm="%s"></CanonicalizationMethod><SignatureMethod Algorithm="%s"></SignatureMethod><Reference URI="#%s">%s</Reference></SignedInfo>`,
+		dsigC14NAlgorithm, method, signatureManifestID, digestElements(manifestDigest[:]))
+	signedInfoDigest := sha256.Sum256([]byte(canonicalDsigElement(signedInfo)))
+	signature, err := e.signer.Sign(rand.Reader, signedInfoDigest[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("error signing EPUB: %w", err)
+	}
+	// XML signatures with ECDSA keys are the concatenation of r and s rather
+	// than their ASN.1 encoding
+	if key, ok := e.signer.Public().(*ecdsa.PublicKey); ok {
+		if signature, err = ecdsaSignatureValue(signature, (key.Curve.Params().BitSize+7)/8); err != nil {
+			return fmt.Errorf("error signing EPUB: %w", err)
+		}
+	}
+
+	keyInfo := ""
+	if e.signerCertificate != nil {
+		keyInfo = "\n    <KeyInfo><X509Data><X509Certificate>" + base64.StdEncoding.EncodeToString(e.signerCertificate.Raw) + "</X509Certificate></X509Data></KeyInfo>"
+	}
+	content := fmt.Sprintf(signaturesFileTemplate, signedInfo, base64.StdEncoding.EncodeToString(signature), keyInfo, manifest.String())
+	if err := s.epubSink.write(path.Join(metaInfFolderName, signaturesFilename), "", []byte(content)); err != nil {
+		return fmt.Errorf("error writing signatures file: %w", err)
+	}
+	return nil
+}
+
+// digestElements returns the elements of a reference with its SHA-256 digest
+func digestElements(digest []byte) string {
+	return fmt.Sprintf(`<DigestMethod Algorithm="%s"></DigestMethod><DigestValue>%s</DigestValue>`, dsigSHA256, base64.StdEncoding.EncodeToString(digest))
+}
+
+// canonicalDsigElement returns the canonical form of an element of the
+// signature written without whitespace, which declares the namespace it
+// inherits
+func canonicalDsigElement(element string) string {
+	i := strings.IndexAny(element, " >")
+	return element[:i] + ` xmlns="` + xmlnsDsig + `"` + element[i:]
+}
+
+// c14nAttr escapes the value of an attribute like canonical XML does
+func c14nAttr(value string) string {
+	return strings.NewReplacer(
+		"&", "&amp;",
+		"<", "&lt;",
+		`"`, "&quot;",
+		"\t", "&#x9;",
+		"\n", "&#xA;",
+		"\r", "&#xD;",
+	).Replace(value)
+}
+
+// ecdsaSignatureValue converts an ASN.1 encoded ECDSA signature to the
+// concatenation of r and s, each one being size bytes long
+func ecdsaSignatureValue(signature []byte, size int) ([]byte, error) {
+	var rs struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(signature, &rs); err != nil {
+		return nil, err
+	}
+	value := make([]byte, 2*size)
+	rs.R.FillBytes(value[:size])
+	rs.S.FillBytes(value[size:])
+	return value, nil
+}
@@ -0,0 +1,187 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSignatureReferenceRegexp = regexp.MustCompile(`<Reference URI="([^"]*)"><DigestMethod Algorithm="[^"]*"></DigestMethod><DigestValue>([^<]*)</DigestValue></Reference>`)
+	testSignedInfoRegexp         = regexp.MustCompile(`<SignedInfo>.*</SignedInfo>`)
+	testSignatureManifestRegexp  = regexp.MustCompile(`<Manifest Id="manifest">.*</Manifest>`)
+	testSignatureValueRegexp     = regexp.MustCompile(`<SignatureValue>([^<]*)</SignatureValue>`)
+)
+
+// verifyTestSignatures verifies the signatures file of the EPUB, returns the
+// files of the EPUB
+func verifyTestSignatures(t *testing.T, b *bytes.Buffer, public crypto.PublicKey) map[string][]byte {
+	t.Helper()
+	z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		files[f.Name] = content
+	}
+	signatures := string(files["META-INF/signatures.xml"])
+	if signatures == "" {
+		t.Fatal("No signatures file")
+	}
+
+	references := make(map[string]string)
+	for _, m := range testSignatureReferenceRegexp.FindAllStringSubmatch(signatures, -1) {
+		name, err := url.PathUnescape(m[1])
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		references[name] = m[2]
+	}
+	for name, content := range files {
+		if name == "mimetype" || name == "META-INF/signatures.xml" {
+			continue
+		}
+		digest := sha256.Sum256(content)
+		if references[name] != base64.StdEncoding.EncodeToString(digest[:]) {
+			t.Errorf("Wrong or missing digest of %s", name)
+		}
+	}
+
+	manifest := strings.Replace(testSignatureManifestRegexp.FindString(signatures), "<Manifest", `<Manifest xmlns="http://www.w3.org/2000/09/xmldsig#"`, 1)
+	manifestDigest := sha256.Sum256([]byte(manifest))
+	if references["#manifest"] != base64.StdEncoding.EncodeToString(manifestDigest[:]) {
+		t.Error("Wrong digest of the manifest of the signature")
+	}
+	signedInfo := strings.Replace(testSignedInfoRegexp.FindString(signatures), "<SignedInfo", `<SignedInfo xmlns="http://www.w3.org/2000/09/xmldsig#"`, 1)
+	signedInfoDigest := sha256.Sum256([]byte(signedInfo))
+	signature, err := base64.StdEncoding.DecodeString(testSignatureValueRegexp.FindStringSubmatch(signatures)[1])
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, signedInfoDigest[:], signature); err != nil {
+			t.Errorf("Invalid signature: %s", err)
+		}
+	case *ecdsa.PublicKey:
+		r := new(big.Int).SetBytes(signature[:len(signature)/2])
+		s := new(big.Int).SetBytes(signature[len(signature)/2:])
+		if !ecdsa.Verify(public, signedInfoDigest[:], r, s) {
+			t.Error("Invalid signature")
+		}
+	}
+	return files
+}
+
+func TestSetSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Publisher"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddImage(testImageFromFileSource, "image name.png"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := e.SetSigner(key, certificate); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	b := writeEpubToBuffer(t, e)
+	files := verifyTestSignatures(t, b, key.Public())
+	signatures := string(files["META-INF/signatures.xml"])
+	for _, expected := range []string{
+		`<SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"></SignatureMethod>`,
+		`<Reference URI="EPUB/images/image%20name.png">`,
+		`<X509Certificate>` + base64.StdEncoding.EncodeToString(der) + `</X509Certificate>`,
+	} {
+		if !strings.Contains(signatures, expected) {
+			t.Errorf("Signatures file doesn't contain %s:\n%s", expected, signatures)
+		}
+	}
+
+	// The EPUB can be read
+	if _, err := NewReader(bytes.NewReader(b.Bytes()), int64(b.Len())); err != nil {
+		t.Errorf("Unexpected error reading EPUB: %s", err)
+	}
+
+	if err := e.SetSigner(nil, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r := newTestReader(t, e)
+	if _, err := r.ReadFile("META-INF/signatures.xml"); err == nil {
+		t.Error("Unsigned EPUB has a signatures file")
+	}
+}
+
+func TestSetSignerECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := e.SetSigner(key, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	files := verifyTestSignatures(t, writeEpubToBuffer(t, e), key.Public())
+	if strings.Contains(string(files["META-INF/signatures.xml"]), "<KeyInfo>") {
+		t.Error("Signatures file has a key info without a certificate")
+	}
+}
+
+func TestSetSignerUnsupported(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e := NewEpub(testEpubTitle)
+	if err := e.SetSigner(key, nil); !errors.Is(err, ErrUnsupportedSigner) {
+		t.Errorf("Expected ErrUnsupportedSigner, got %v", err)
+	}
+}
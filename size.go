@@ -0,0 +1,97 @@
+package epub
+
+import (
+	"path"
+)
+
+// Estimated sizes of the entries added to the package and TOC files for each
+// file of the EPUB when it's written, in bytes, not counting the ids, paths,
+// media types and titles of the entries
+const (
+	estimatedManifestItemSize = 60
+	estimatedSpineItemSize    = 40
+	estimatedNavEntrySize     = 40
+	estimatedNcxEntrySize     = 160
+)
+
+// EstimatedSize returns an estimate of the size of the EPUB before compression,
+// in bytes, e.g. to pre-allocate storage or to reject a book that's too large
+// before spending time writing it. Since most of the files of the EPUB are
+// compressed when it's written, the size of the EPUB file is usually smaller.
+//
+// The estimate is the sum of the sizes of the media, as they're stored before
+// any conversion, and of the generated files (sections, table of contents and
+// package file). The size of media from URLs is only known if it was
+// retrieved when it was added (see SetFetchMode) or if it's in the media cache
+// (see SetMediaCache); media whose size isn't known, like media that can't be
+// retrieved, isn't counted. Nothing is downloaded to compute the estimate.
+func (e *Epub) EstimatedSize() int64 {
+	e.Lock()
+	defer e.Unlock()
+
+	var size int64
+	countSize := func(name string, mediaType string, content []byte) error {
+		size += int64(len(content))
+		return nil
+	}
+	// The size of a file's entry in the manifest of the package file
+	manifestItemSize := func(id string, href string, mediaType string) int64 {
+		return int64(estimatedManifestItemSize + len(id) + len(href) + len(mediaType))
+	}
+
+	// Files generated at the root of the EPUB
+	_ = writeMimetype(countSize)
+	_ = writeContainerFile(countSize)
+
+	// Media
+	g := e.grabber()
+	for mediaFolderName, mediaMap := range e.mediaFolders() {
+		for mediaFilename, mediaSource := range mediaMap {
+			if mediaSize, ok := g.mediaSize(mediaSource); ok {
+				size += mediaSize
+			}
+			size += manifestItemSize(mediaFilename, path.Join(mediaFolderName, mediaFilename), "")
+		}
+	}
+	for rawPath, rawFile := range e.rawFiles {
+		if mediaSize, ok := g.mediaSize(rawFile.source); ok {
+			size += mediaSize
+		}
+		size += manifestItemSize(rawPath, path.Join("..", rawPath), rawFile.mediaType)
+	}
+	for _, source := range e.metaInfFiles {
+		if mediaSize, ok := g.mediaSize(source); ok {
+			size += mediaSize
+		}
+	}
+
+	// Sections and their entries in the package and TOC files
+	e.forEachSection(func(s *epubSection) {
+		_ = writeSection(countSize, s, s.xhtml.content())
+		href := path.Join(xhtmlFolderName, s.filename)
+		size += manifestItemSize(s.filename, href, mediaTypeXhtml)
+		if !s.auxiliary {
+			size += int64(estimatedSpineItemSize + len(s.filename))
+		}
+		if label := s.tocLabel(); label != "" && !s.auxiliary && s.filename != e.cover.xhtmlFilename {
+			size += int64(estimatedNavEntrySize + len(href) + len(label))
+			if !e.noNcx {
+				size += int64(estimatedNcxEntrySize + len(href) + len(label))
+			}
+		}
+	})
+
+	// The table of contents and package files as they are before their
+	// entries are added
+	if navDocContent, err := e.toc.navDocContent(); err == nil {
+		size += int64(len(navDocContent))
+	}
+	size += manifestItemSize(tocNavItemID, tocNavFilename, mediaTypeXhtml)
+	if !e.noNcx {
+		size += int64(len(e.toc.ncxDocContent()))
+		size += manifestItemSize(tocNcxItemID, tocNcxFilename, mediaTypeNcx)
+	}
+	size += int64(len(e.pkg.content()))
+
+	return size
+}
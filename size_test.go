@@ -0,0 +1,55 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEstimatedSize(t *testing.T) {
+	newTestEpub := func(t *testing.T) *Epub {
+		e := NewEpub(testEpubTitle)
+		e.SetAuthor(testEpubAuthor)
+		imagePath, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+		if err != nil {
+			t.Fatalf("Error adding image: %s", err)
+		}
+		e.SetCover(imagePath, "")
+		if _, err := e.AddFont(testFontFromFileSource, ""); err != nil {
+			t.Fatalf("Error adding font: %s", err)
+		}
+		if _, err := e.AddRawFile("data:application/json,%7B%7D", "data/book.json", "application/json"); err != nil {
+			t.Fatalf("Error adding raw file: %s", err)
+		}
+		for i := 0; i < 20; i++ {
+			if _, err := e.AddSection(strings.Repeat(testSectionBody, 10), testSectionTitle, "", ""); err != nil {
+				t.Fatalf("Error adding section: %s", err)
+			}
+		}
+		return e
+	}
+
+	e := newTestEpub(t)
+	estimatedSize := e.EstimatedSize()
+	if e.EstimatedSize() != estimatedSize {
+		t.Errorf("EstimatedSize changed between calls")
+	}
+
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	var size int64
+	for _, f := range r.File {
+		size += int64(f.UncompressedSize64)
+	}
+	// The estimate should be within 5% of the actual size
+	if diff := estimatedSize - size; diff*20 > size || -diff*20 > size {
+		t.Errorf("Got an estimated size of %d bytes, expected about %d", estimatedSize, size)
+	}
+}
@@ -0,0 +1,46 @@
+package epub
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WithSourceFS returns an option of NewEpub that sets the file system the local
+// media sources are read from, see SetSourceFS.
+func WithSourceFS(fsys fs.FS) EpubOption {
+	return func(e *Epub) {
+		e.sourceFS = fsys
+	}
+}
+
+// SetSourceFS sets the file system the local media sources are read from, e.g.
+// files embedded with go:embed, so that they can be added without being written
+// to temporary files:
+//
+//	//go:embed assets
+//	var assets embed.FS
+//
+//	e.SetSourceFS(assets)
+//	imgPath, err := e.AddImage("assets/cover.png", "")
+//
+// The sources of AddCSS, AddFont, AddImage, AddVideo, AddAudio, AddRawFile,
+// AddMetaInfFile and SetCoverFromSource that are neither URLs nor data URLs are
+// then paths of the file system, which use slashes (see fs.ValidPath); a leading
+// ./ or / is ignored. The local sources are read from the OS file system if fsys
+// is nil (default).
+//
+// Since the media may be read when the EPUB is written, the file system should
+// be set before adding media and not changed afterwards.
+func (e *Epub) SetSourceFS(fsys fs.FS) {
+	e.Lock()
+	defer e.Unlock()
+	e.sourceFS = fsys
+}
+
+// sourceFSPath returns the path in the source file system of a local media
+// source, e.g. images/cover.png for ./images/cover.png
+func sourceFSPath(mediaSource string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(mediaSource)), "/")
+}
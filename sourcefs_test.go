@@ -0,0 +1,80 @@
+package epub
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSetSourceFS(t *testing.T) {
+	image, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Error reading image: %s", err)
+	}
+	fsys := fstest.MapFS{
+		"assets/image.png": {Data: image},
+		"assets/style.css": {Data: []byte("p { margin: 0; }")},
+		"assets/data.json": {Data: []byte("{}")},
+	}
+
+	for _, fetchMode := range []FetchMode{FetchEager, FetchLazy} {
+		e := NewEpub(testEpubTitle, WithSourceFS(fsys))
+		e.SetFetchMode(fetchMode)
+		imagePath, err := e.AddImage("./assets/image.png", "")
+		if err != nil {
+			t.Fatalf("Unexpected error adding image: %s", err)
+		}
+		if _, err := e.AddCSS("/assets/style.css", ""); err != nil {
+			t.Fatalf("Unexpected error adding CSS: %s", err)
+		}
+		if _, err := e.AddRawFile("assets/data.json", "data/data.json", ""); err != nil {
+			t.Fatalf("Unexpected error adding raw file: %s", err)
+		}
+		if _, err := e.AddSection(`<img src="`+imagePath+`" alt="Image"/>`, testSectionTitle, "", ""); err != nil {
+			t.Fatalf("Unexpected error adding section: %s", err)
+		}
+
+		r := newTestReader(t, e)
+		for name, expected := range map[string][]byte{
+			"EPUB/images/image.png": image,
+			"EPUB/css/style.css":    []byte("p { margin: 0; }"),
+			"EPUB/data/data.json":   []byte("{}"),
+		} {
+			data, err := r.ReadFile(name)
+			if err != nil {
+				t.Errorf("Unexpected error reading %s: %s", name, err)
+				continue
+			}
+			if !bytes.Equal(data, expected) {
+				t.Errorf("Unexpected content of %s", name)
+			}
+		}
+	}
+
+	// The OS file system isn't used once a source file system is set
+	e := NewEpub(testEpubTitle)
+	e.SetSourceFS(fsys)
+	_, err = e.AddImage(testImageFromFileSource, "")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected an error wrapping fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestSourceFSPath(t *testing.T) {
+	testCases := map[string]string{
+		"image.png":           "image.png",
+		"./assets/image.png":  "assets/image.png",
+		"/assets/image.png":   "assets/image.png",
+		"assets/../image.png": "image.png",
+		"../assets/image.png": "assets/image.png",
+		"assets//a/./b.png":   "assets/a/b.png",
+	}
+	for source, expected := range testCases {
+		if got := sourceFSPath(source); got != expected {
+			t.Errorf("sourceFSPath(%q) = %q, expected %q", source, got, expected)
+		}
+	}
+}
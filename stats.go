@@ -0,0 +1,131 @@
+package epub
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Average reading speed used to estimate reading times, in words per minute
+const wordsPerMinute = 250
+
+var (
+	// Matches elements whose content isn't text shown to the reader
+	nonTextElementRegex = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)\s*>`)
+	// Matches any tag, comment or CDATA section, the first group being the name
+	// of the element of a tag
+	tagRegex = regexp.MustCompile(`(?s)<!--.*?-->|<!\[CDATA\[.*?\]\]>|</?([a-zA-Z][^\s/>]*)[^>]*>|<[^>]*>`)
+	// Elements that can be part of a word, e.g. in<i>cred</i>ible
+	inlineElements = map[string]bool{
+		"a": true, "abbr": true, "b": true, "bdi": true, "bdo": true,
+		"cite": true, "code": true, "data": true, "del": true, "dfn": true,
+		"em": true, "i": true, "ins": true, "kbd": true, "mark": true,
+		"q": true, "s": true, "samp": true, "small": true, "span": true,
+		"strong": true, "sub": true, "sup": true, "time": true, "u": true,
+		"var": true,
+	}
+)
+
+// SectionStats contains statistics about the text of a section.
+type SectionStats struct {
+	Filename    string        // Internal filename of the section
+	Title       string        // Title of the section
+	Words       int           // Number of words
+	Characters  int           // Number of visible characters, excluding whitespace
+	ReadingTime time.Duration // Estimated reading time
+}
+
+// Stats contains statistics about the text of the EPUB.
+type Stats struct {
+	Sections    []SectionStats // Statistics of each section, in reading order
+	Words       int            // Total number of words
+	Characters  int            // Total number of visible characters, excluding whitespace
+	ReadingTime time.Duration  // Total estimated reading time
+}
+
+// Stats returns word and character counts as well as estimated reading times
+// (based on an average of 250 words per minute) for each section and for the
+// whole EPUB. Statistics are computed from the text of the section bodies,
+// ignoring markup. Each Chinese or Japanese character counts as a word, since
+// these languages don't separate words with spaces. The cover and the
+// auxiliary files (see AddAuxiliaryXHTML) aren't part of the statistics.
+func (e *Epub) Stats() Stats {
+	e.Lock()
+	defer e.Unlock()
+
+	stats := Stats{}
+	e.forEachSection(func(s *epubSection) {
+		if !e.countsWords(s) {
+			return
+		}
+		sectionStats := newSectionStats(s)
+		stats.Sections = append(stats.Sections, sectionStats)
+		stats.Words += sectionStats.Words
+		stats.Characters += sectionStats.Characters
+		stats.ReadingTime += sectionStats.ReadingTime
+	})
+	return stats
+}
+
+func newSectionStats(s *epubSection) SectionStats {
+	text := bodyText(s.xhtml.xml.Body.XML)
+	characters := 0
+	for _, r := range text {
+		// Invisible characters such as soft hyphens aren't counted
+		if unicode.IsGraphic(r) && !unicode.IsSpace(r) {
+			characters++
+		}
+	}
+	words := countWords(text)
+
+	return SectionStats{
+		Filename:    s.filename,
+		Title:       s.xhtml.Title(),
+		Words:       words,
+		Characters:  characters,
+		ReadingTime: time.Duration(words) * time.Minute / wordsPerMinute,
+	}
+}
+
+// countsWords returns whether the words of the section are part of the
+// statistics of the EPUB, i.e. it's neither the cover nor an auxiliary file
+func (e *Epub) countsWords(s *epubSection) bool {
+	return !s.auxiliary && s.filename != e.cover.xhtmlFilename
+}
+
+// bodyText returns the text of an XHTML body, without markup
+func bodyText(body string) string {
+	text := nonTextElementRegex.ReplaceAllString(body, " ")
+	// Tags other than those of inline elements are replaced with spaces so
+	// that words in different elements (e.g. table cells) don't get merged
+	text = tagRegex.ReplaceAllStringFunc(text, func(tag string) string {
+		if m := tagRegex.FindStringSubmatch(tag); inlineElements[strings.ToLower(m[1])] {
+			return ""
+		}
+		return " "
+	})
+	return html.UnescapeString(text)
+}
+
+// countWords returns the number of words of the text, separated by whitespace,
+// except for Chinese and Japanese characters which count as one word each
+func countWords(text string) int {
+	words := 0
+	inWord := false
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana):
+			words++
+			inWord = false
+		// Ideographic spaces and punctuation, e.g. 。, separate words as well
+		case unicode.IsSpace(r) || (r >= 0x3000 && unicode.IsPunct(r)):
+			inWord = false
+		case !inWord:
+			words++
+			inWord = true
+		}
+	}
+	return words
+}
@@ -0,0 +1,76 @@
+package epub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	testSubSectionBody := `<h2>Sub&#173;section</h2>
+<style>p { color: red; }</style>
+<!-- A comment -->
+<table><tr><td>one</td><td>two</td></tr></table>
+<p>Caf&eacute; &amp; cr&egrave;me</p>`
+	e.AddSubSection(testSectionFilename, testSubSectionBody, "Subsection", "", "")
+
+	stats := e.Stats()
+	testStats := []SectionStats{
+		{Filename: testSectionFilename, Title: testSectionTitle, Words: 6, Characters: 25},
+		{Filename: "section0002.xhtml", Title: "Subsection", Words: 6, Characters: 26},
+	}
+	if len(stats.Sections) != len(testStats) {
+		t.Fatalf("Got stats for %d sections, expected %d", len(stats.Sections), len(testStats))
+	}
+	for i, want := range testStats {
+		got := stats.Sections[i]
+		want.ReadingTime = time.Duration(want.Words) * time.Minute / wordsPerMinute
+		if got != want {
+			t.Errorf(
+				"Section stats don't match\n"+
+					"Got: %+v\n"+
+					"Expected: %+v",
+				got,
+				want)
+		}
+	}
+	if stats.Words != 12 || stats.Characters != 51 {
+		t.Errorf("Got %d words and %d characters, expected 12 words and 51 characters", stats.Words, stats.Characters)
+	}
+	if stats.ReadingTime != stats.Sections[0].ReadingTime+stats.Sections[1].ReadingTime {
+		t.Errorf("Total reading time %s doesn't match the sum of the sections", stats.ReadingTime)
+	}
+}
+
+func TestStatsWords(t *testing.T) {
+	for _, test := range []struct {
+		body  string
+		words int
+	}{
+		{`<p>in<i>cred</i>ible <a href="#">link</a>s</p>`, 2},
+		{`<p>One</p><p>two<br/>three</p>`, 3},
+		{`<p>中文的句子。</p>`, 5},
+		{`<p>日本語のテキスト、<ruby>漢<rt>かん</rt></ruby> and English</p>`, 13},
+	} {
+		if words := countWords(bodyText(test.body)); words != test.words {
+			t.Errorf("Got %d words in %s, expected %d", words, test.body, test.words)
+		}
+	}
+
+	// The cover and the auxiliary files aren't counted
+	e := NewEpub(testEpubTitle)
+	if err := e.SetCoverFromSource(testImageFromFileSource); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection(`<p>One two</p>`, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddAuxiliaryXHTML(`<p>Note</p>`, "", "note.xhtml", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	stats := e.Stats()
+	if len(stats.Sections) != 1 || stats.Words != 2 {
+		t.Errorf("Got %d words in %d sections, expected 2 words in 1 section", stats.Words, len(stats.Sections))
+	}
+}
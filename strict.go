@@ -0,0 +1,126 @@
+package epub
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// langTagRegex matches the well-formed language tags, e.g. en or pt-BR
+var langTagRegex = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// StrictModeError is thrown by Write in strict mode (see SetStrict) if the EPUB
+// would be invalid. Nothing is written.
+type StrictModeError struct {
+	Findings []ValidationFinding // The problems that make the EPUB invalid
+}
+
+func (e *StrictModeError) Error() string {
+	if len(e.Findings) == 1 {
+		return fmt.Sprintf("Invalid EPUB in strict mode: %s", e.Findings[0])
+	}
+	return fmt.Sprintf("Invalid EPUB in strict mode: %s (and %d more problems)", e.Findings[0], len(e.Findings)-1)
+}
+
+// SetStrict sets whether Write fails with StrictModeError, before anything is
+// written, if the EPUB would be reported as invalid by epubcheck because of:
+//   - the language of the EPUB or of a section not being a well-formed
+//     language tag, e.g. "english" instead of "en"
+//   - links of the sections that aren't valid URLs (e.g. containing spaces or
+//     backslashes) or that link to files that aren't part of the EPUB
+//   - fragments of the links of the sections that don't match an ID of the
+//     linked section, e.g. section0002.xhtml#missing
+//   - IDs used more than once in a section
+//
+// By default, the EPUB is written as is, on a best-effort basis.
+func (e *Epub) SetStrict(strict bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.strict = strict
+}
+
+// strictFindings returns the problems that make Write fail in strict mode
+func (e *Epub) strictFindings() []ValidationFinding {
+	v := &validator{}
+	pkgPath := path.Join(contentFolderName, pkgFilename)
+	if !langTagRegex.MatchString(e.lang) {
+		v.add(SeverityError, CheckLang, pkgPath, 0, "invalid language tag %q", e.lang)
+	}
+
+	files := map[string]bool{
+		tocNavFilename: true,
+		tocNcxFilename: !e.noNcx,
+	}
+	for mediaFolderName, mediaMap := range e.mediaFolders() {
+		for filename := range mediaMap {
+			files[path.Join(mediaFolderName, filename)] = true
+		}
+	}
+	for rawPath := range e.rawFiles {
+		files[rawPath] = true
+	}
+	// The IDs of the sections, by path
+	sectionIDs := make(map[string]map[string]bool)
+	idRegex := attributeRegex("id")
+	e.forEachSection(func(s *epubSection) {
+		sectionPath := path.Join(xhtmlFolderName, s.filename)
+		files[sectionPath] = true
+		sectionIDs[sectionPath] = make(map[string]bool)
+		for _, m := range idRegex.FindAllStringSubmatch(s.xhtml.xml.Body.XML, -1) {
+			sectionIDs[sectionPath][html.UnescapeString(m[1]+m[2])] = true
+		}
+	})
+
+	e.forEachSection(func(s *epubSection) {
+		sectionPath := path.Join(xhtmlFolderName, s.filename)
+		name := path.Join(contentFolderName, sectionPath)
+		if s.xhtml.xml.Lang != "" && !langTagRegex.MatchString(s.xhtml.xml.Lang) {
+			v.add(SeverityError, CheckLang, name, 0, "invalid language tag %q", s.xhtml.xml.Lang)
+		}
+
+		links := findLinks(s.xhtml.xml.Body.XML)
+		for _, link := range s.xhtml.xml.Head.Links {
+			links = append(links, link.Href)
+		}
+		for _, link := range links {
+			link = html.UnescapeString(link)
+			if _, err := url.Parse(link); err != nil || strings.ContainsAny(link, ` \`) {
+				v.add(SeverityError, CheckHref, name, 0, "invalid link %q", link)
+				continue
+			}
+			linkPath, fragment := splitFragment(link)
+			if isRemoteLink(linkPath) {
+				continue
+			}
+			resolved := sectionPath
+			if linkPath != "" {
+				resolved = resolveLink(sectionPath, link)
+				if !files[resolved] {
+					v.add(SeverityError, CheckHref, name, 0, "link %q to a file that isn't part of the EPUB", link)
+					continue
+				}
+			}
+			if ids, ok := sectionIDs[resolved]; ok && fragment != "" && !strings.HasPrefix(fragment, "epubcfi(") {
+				if unescaped, err := url.PathUnescape(fragment); err == nil {
+					fragment = unescaped
+				}
+				if !ids[fragment] {
+					v.add(SeverityError, CheckFragment, name, 0, "fragment %q of link %q not found in %s", fragment, link, path.Join(contentFolderName, resolved))
+				}
+			}
+		}
+
+		ids := make(map[string]bool)
+		for _, m := range idRegex.FindAllStringSubmatch(s.xhtml.xml.Body.XML, -1) {
+			id := m[1] + m[2]
+			if ids[id] {
+				v.add(SeverityError, CheckDuplicateID, name, 0, "ID %q used more than once", id)
+			}
+			ids[id] = true
+		}
+	})
+	return v.findings
+}
@@ -0,0 +1,103 @@
+package epub
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSetStrict(t *testing.T) {
+	testCases := []struct {
+		name            string
+		lang            string
+		sectionLang     string
+		body            string
+		expectedCheck   ValidationCheck
+		expectedMessage string
+	}{
+		{
+			name: "valid",
+			lang: "pt-BR",
+			body: `<p id="a"><a href="section0001.xhtml#a">Link</a> <a href="https://example.com/a%20b">Remote</a></p>`,
+		},
+		{
+			name:            "invalid language",
+			lang:            "english (US)",
+			body:            testSectionBody,
+			expectedCheck:   CheckLang,
+			expectedMessage: `invalid language tag "english (US)"`,
+		},
+		{
+			name:            "invalid section language",
+			lang:            "en",
+			sectionLang:     "fr_FR",
+			body:            testSectionBody,
+			expectedCheck:   CheckLang,
+			expectedMessage: `invalid language tag "fr_FR"`,
+		},
+		{
+			name:            "link with a space",
+			lang:            "en",
+			body:            `<p><a href="other section.xhtml">Link</a></p>`,
+			expectedCheck:   CheckHref,
+			expectedMessage: `invalid link "other section.xhtml"`,
+		},
+		{
+			name:            "link to a missing file",
+			lang:            "en",
+			body:            `<p><img src="../images/missing.png" alt=""/></p>`,
+			expectedCheck:   CheckHref,
+			expectedMessage: `link "../images/missing.png" to a file that isn't part of the EPUB`,
+		},
+		{
+			name:            "duplicate ID",
+			lang:            "en",
+			body:            `<p id="a">1</p><p id="a">2</p>`,
+			expectedCheck:   CheckDuplicateID,
+			expectedMessage: `ID "a" used more than once`,
+		},
+		{
+			name:            "dead fragment",
+			lang:            "en",
+			body:            `<p id="a"><a href="#a">Found</a> <a href="section0001.xhtml#b">Dead</a></p>`,
+			expectedCheck:   CheckFragment,
+			expectedMessage: `fragment "b" of link "section0001.xhtml#b" not found in EPUB/xhtml/section0001.xhtml`,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			e := NewEpub(testEpubTitle)
+			e.SetLang(testCase.lang)
+			if _, err := e.AddSectionWithOptions(testCase.body, SectionOptions{Title: testSectionTitle, Lang: testCase.sectionLang}); err != nil {
+				t.Fatalf("Error adding section: %s", err)
+			}
+
+			// The EPUB is written as is in permissive mode
+			if _, err := e.WriteTo(&bytes.Buffer{}); err != nil {
+				t.Fatalf("Unexpected error writing EPUB in permissive mode: %s", err)
+			}
+
+			e.SetStrict(true)
+			var b bytes.Buffer
+			_, err := e.WriteTo(&b)
+			if testCase.expectedCheck == "" {
+				if err != nil {
+					t.Errorf("Unexpected error writing EPUB in strict mode: %s", err)
+				}
+				return
+			}
+			var strictErr *StrictModeError
+			if !errors.As(err, &strictErr) {
+				t.Fatalf("Got error %v, expected StrictModeError", err)
+			}
+			if b.Len() != 0 {
+				t.Error("Expected nothing to be written")
+			}
+			finding := strictErr.Findings[0]
+			if finding.Check != testCase.expectedCheck || !strings.Contains(finding.Message, testCase.expectedMessage) {
+				t.Errorf("Got finding %s, expected a %s finding containing %q", finding, testCase.expectedCheck, testCase.expectedMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package epub
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrNoCover is returned by CoverStub if no cover was set.
+var ErrNoCover = errors.New("no cover was set")
+
+// CoverStub returns a new EPUB with the same metadata (title, author,
+// identifier, language, description and page progression direction) and the
+// same cover as the EPUB, but without any content sections. Such stub EPUBs are
+// used by some catalog and preview systems. The cover template (see
+// SetCoverTemplate), the default cover CSS (see SetDefaultCoverCSS) and the
+// Kindle compatibility mode (see SetKindleCompatibility) are reused as well.
+//
+// The settings used to retrieve media (HTTP client, request headers and
+// cookies, fetch and write timeouts, media cache, fetch mode, media size limits
+// and media failure policy) are carried over as well, along with the storage
+// (see WithStorage).
+// If no cover was set, ErrNoCover will be returned.
+func (e *Epub) CoverStub() (*Epub, error) {
+	e.Lock()
+	defer e.Unlock()
+	if e.cover.xhtmlFilename == "" {
+		return nil, ErrNoCover
+	}
+
+	stub := NewEpub(e.title)
+	stub.Client = e.Client
+	stub.userAgent = e.userAgent
+	stub.from = e.from
+	stub.header = e.header.Clone()
+	stub.cookies = append([]*http.Cookie{}, e.cookies...)
+	stub.fetchTimeout = e.fetchTimeout
+	stub.mediaCache = e.mediaCache
+	stub.fetchMode = e.fetchMode
+	stub.maxMediaSize = e.maxMediaSize
+	stub.maxTotalMediaSize = e.maxTotalMediaSize
+	stub.writeTimeout = e.writeTimeout
+	stub.filesystem = e.filesystem
+	stub.mediaFailurePolicy = e.mediaFailurePolicy
+	stub.noNcx = e.noNcx
+	stub.kindle = e.kindle
+	stub.coverTemplate = e.coverTemplate
+	stub.coverCSS = e.coverCSS
+	stub.mediaCharsets = e.mediaCharsets
+	// Media retrieved when it was added isn't retrieved again
+	for source, data := range e.fetchedMedia {
+		stub.fetchedMedia[source] = data
+	}
+	stub.SetIdentifier(e.identifier)
+	stub.SetLang(e.lang)
+	if e.author != "" {
+		stub.SetAuthor(e.author)
+	}
+	if e.desc != "" {
+		stub.SetDescription(e.desc)
+	}
+	if e.ppd != "" {
+		stub.SetPpd(e.ppd)
+	}
+
+	imagePath, err := addMedia(stub.grabber(), e.images[e.cover.imageFilename], e.cover.imageFilename, imageFileFormat, ImageFolderName, stub.images)
+	if err != nil {
+		return nil, err
+	}
+	// The default cover CSS is generated again by setCover
+	cssPath := ""
+	if e.cover.cssTempFile == "" && e.cover.cssFilename != "" {
+		cssPath, err = stub.addCSS(e.css[e.cover.cssFilename], e.cover.cssFilename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := stub.setCover(imagePath, cssPath); err != nil {
+		return nil, err
+	}
+
+	return stub, nil
+}
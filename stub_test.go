@@ -0,0 +1,51 @@
+package epub
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+)
+
+func TestCoverStub(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if _, err := e.CoverStub(); !errors.Is(err, ErrNoCover) {
+		t.Errorf("Expected ErrNoCover, got %v", err)
+	}
+
+	e.SetAuthor(testEpubAuthor)
+	e.SetIdentifier(testEpubIdentifier)
+	e.SetLang(testEpubLang)
+	e.SetDescription(testEpubDescription)
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	stub, err := e.CoverStub()
+	if err != nil {
+		t.Fatalf("Unexpected error creating cover stub: %s", err)
+	}
+	if stub.Title() != testEpubTitle || stub.Author() != testEpubAuthor || stub.Identifier() != testEpubIdentifier ||
+		stub.Lang() != testEpubLang || stub.Description() != testEpubDescription {
+		t.Errorf("Cover stub metadata doesn't match the EPUB")
+	}
+
+	tempDir := writeAndExtractEpub(t, stub, testEpubFilename)
+	defer cleanup(testEpubFilename, tempDir)
+
+	if _, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, ImageFolderName, testImageFromFileFilename)); err != nil {
+		t.Errorf("Cover image is missing from the cover stub: %s", err)
+	}
+	if _, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionFilename)); err == nil {
+		t.Errorf("Section was written to the cover stub")
+	}
+	navContents, err := storage.ReadFile(filesystem, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Fatalf("Unexpected error reading nav file: %s", err)
+	}
+	if !strings.Contains(string(navContents), defaultCoverXhtmlFilename) {
+		t.Errorf("Cover page isn't in the table of contents of the cover stub: %s", navContents)
+	}
+}
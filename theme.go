@@ -0,0 +1,204 @@
+package epub
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"path"
+	"path/filepath"
+)
+
+// Theme is a built-in stylesheet applied to the sections (see SetTheme).
+type Theme int
+
+const (
+	// ThemeNone applies no stylesheet, which is the default
+	ThemeNone Theme = iota
+	// ThemeSerifNovel is a stylesheet for fiction: serif font, justified
+	// paragraphs with indented first lines and centered headings
+	ThemeSerifNovel
+	// ThemeTechnical is a stylesheet for technical documentation: sans-serif
+	// font, spaced paragraphs, monospace code blocks that wrap, bordered
+	// tables and captioned figures kept on one page
+	ThemeTechnical
+	// ThemeManga is a stylesheet for comics and manga, whose sections are
+	// full-page images: no margins and images scaled to fit the page. Use
+	// SetPpd to read right-to-left.
+	ThemeManga
+)
+
+const (
+	themeCSSFilename = "theme.css"
+	// Link to the stylesheet of the theme, in the format of the links of the
+	// sections
+	themeLinkFormat = `<link rel="` + xhtmlLinkRel + `" type="` + mediaTypeCSS + `" href="%s"></link>`
+)
+
+// themeCSS is the content of the stylesheet of each theme. The declarations
+// known to break the rendering on e-readers (see LintCSS) are left out, so
+// that the themes render the same on Kindle, Kobo and Apple Books.
+var themeCSS = map[Theme]string{
+	ThemeSerifNovel: `body {
+  font-family: Georgia, "Times New Roman", serif;
+  line-height: 1.4;
+  margin: 0 5%;
+}
+h1, h2, h3 {
+  font-weight: normal;
+  margin: 2em 0 1em;
+  page-break-after: avoid;
+  text-align: center;
+}
+p {
+  margin: 0;
+  text-align: justify;
+  text-indent: 1.5em;
+}
+h1 + p, h2 + p, h3 + p, hr + p {
+  text-indent: 0;
+}
+hr {
+  border: none;
+  margin: 1.5em 0;
+}
+blockquote {
+  font-style: italic;
+  margin: 1em 2em;
+}
+img {
+  max-width: 100%;
+}
+`,
+	ThemeTechnical: `body {
+  font-family: "Helvetica Neue", Helvetica, Arial, sans-serif;
+  line-height: 1.5;
+  margin: 0 3%;
+}
+h1, h2, h3, h4 {
+  margin: 1.5em 0 0.5em;
+  page-break-after: avoid;
+}
+p {
+  margin: 0 0 0.8em;
+}
+code, kbd, pre, samp {
+  font-family: "Courier New", Courier, monospace;
+  font-size: 0.9em;
+}
+pre {
+  background-color: #F5F5F5;
+  border: 1px solid #CCCCCC;
+  padding: 0.5em;
+  page-break-inside: avoid;
+  white-space: pre-wrap;
+}
+table {
+  border-collapse: collapse;
+  margin: 1em 0;
+  width: 100%;
+}
+th, td {
+  border: 1px solid #999999;
+  padding: 0.25em 0.5em;
+  text-align: left;
+}
+figure {
+  margin: 1em 0;
+  page-break-inside: avoid;
+  text-align: center;
+}
+figcaption, caption {
+  font-size: 0.9em;
+  font-style: italic;
+}
+img {
+  max-width: 100%;
+}
+`,
+	ThemeManga: `body {
+  margin: 0;
+  padding: 0;
+  text-align: center;
+}
+p {
+  margin: 0;
+}
+img, svg {
+  height: auto;
+  max-height: 100%;
+  max-width: 100%;
+}
+`,
+}
+
+// SetTheme applies a built-in stylesheet to the sections, for readable output
+// without writing CSS. The stylesheet is added to the EPUB as theme.css (or a
+// generated filename if it's already used) and linked from each section except
+// the cover when the EPUB is written, before the CSS of the section, so that
+// the CSS of the section overrides it. ThemeNone removes the stylesheet.
+//
+// If the theme doesn't exist, an error is returned.
+func (e *Epub) SetTheme(theme Theme) error {
+	e.Lock()
+	defer e.Unlock()
+	css, ok := themeCSS[theme]
+	if !ok && theme != ThemeNone {
+		return fmt.Errorf("unknown theme %d", theme)
+	}
+
+	// Remove the stylesheet of the previous theme
+	if e.themeCSSFilename != "" {
+		delete(e.css, e.themeCSSFilename)
+		delete(e.mediaTypes, path.Join(CSSFolderName, e.themeCSSFilename))
+		e.themeCSSFilename = ""
+	}
+	if theme == ThemeNone {
+		return nil
+	}
+
+	// First try to use the default theme filename
+	internalCSSPath, err := e.addCSSFromString(css, themeCSSFilename)
+	// If that doesn't work, generate a filename
+	if _, ok := err.(*FilenameAlreadyUsedError); ok {
+		internalCSSPath, err = e.addCSSFromString(css, "")
+	}
+	if err != nil {
+		return fmt.Errorf("error adding theme CSS file: %w", err)
+	}
+	e.themeCSSFilename = filepath.Base(internalCSSPath)
+	return nil
+}
+
+// themeFileWriter returns an epubFileWriter that links the sections other
+// than the cover to the stylesheet of the theme
+func (e *Epub) themeFileWriter(w epubFileWriter) epubFileWriter {
+	link := fmt.Sprintf(themeLinkFormat, html.EscapeString(path.Join("..", CSSFolderName, e.themeCSSFilename)))
+	cover := path.Join(contentFolderName, xhtmlFolderName, e.cover.xhtmlFilename)
+	return func(name string, mediaType string, content []byte) error {
+		if mediaType == mediaTypeXhtml && name != cover {
+			content = themeSection(content, link)
+		}
+		return w(name, mediaType, content)
+	}
+}
+
+// themeSection returns the content of the XHTML file of a section with the
+// link added before the other links of its head
+func themeSection(content []byte, link string) []byte {
+	headEnd := bytes.Index(content, []byte("</head>"))
+	if headEnd == -1 {
+		return content
+	}
+	i := bytes.Index(content[:headEnd], []byte("<link "))
+	if i == -1 {
+		// Indent the link like the other elements of the head
+		i = headEnd
+		link = "  " + link + "\n  "
+	} else {
+		link += "\n    "
+	}
+	themed := make([]byte, 0, len(content)+len(link))
+	themed = append(themed, content[:i]...)
+	themed = append(themed, link...)
+	return append(themed, content[i:]...)
+}
@@ -0,0 +1,153 @@
+package epub
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSetTheme(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if err := e.SetCoverFromSource(testImageFromFileSource); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cssPath, err := e.AddCSS(testCoverCSSSource, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	styled, err := e.AddSection(testSectionBody, testSectionTitle, "", cssPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	unstyled, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := e.SetTheme(ThemeSerifNovel); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	r := newTestReader(t, e)
+	css, err := r.ReadFile("EPUB/css/theme.css")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(css) != themeCSS[ThemeSerifNovel] {
+		t.Errorf("Got theme CSS\n%s\nexpected\n%s", css, themeCSS[ThemeSerifNovel])
+	}
+	themeLink := `<link rel="stylesheet" type="text/css" href="../css/theme.css"></link>`
+	content, err := r.ReadFile("EPUB/xhtml/" + styled)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The CSS of the section overrides the theme
+	expected := themeLink + `
+    <link rel="stylesheet" type="text/css" href="` + cssPath + `"></link>`
+	if !strings.Contains(string(content), expected) {
+		t.Errorf("Section doesn't contain %s:\n%s", expected, content)
+	}
+	content, err = r.ReadFile("EPUB/xhtml/" + unstyled)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected = "  " + themeLink + "\n  </head>"
+	if !strings.Contains(string(content), expected) {
+		t.Errorf("Section doesn't contain %s:\n%s", expected, content)
+	}
+	content, err = r.ReadFile("EPUB/xhtml/cover.xhtml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(string(content), themeLink) {
+		t.Errorf("Cover linked to the theme:\n%s", content)
+	}
+
+	findings, err := e.Validate()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("Unexpected findings: %+v", findings)
+	}
+
+	// The stylesheet is replaced, then removed
+	if err := e.SetTheme(ThemeManga); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r = newTestReader(t, e)
+	if css, err := r.ReadFile("EPUB/css/theme.css"); err != nil || string(css) != themeCSS[ThemeManga] {
+		t.Errorf("Got theme CSS\n%s\nexpected\n%s (error: %v)", css, themeCSS[ThemeManga], err)
+	}
+	if err := e.SetTheme(ThemeNone); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r = newTestReader(t, e)
+	if _, err := r.ReadFile("EPUB/css/theme.css"); err == nil {
+		t.Error("Theme CSS written after the theme was removed")
+	}
+	content, err = r.ReadFile("EPUB/xhtml/" + unstyled)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(string(content), "<link") {
+		t.Errorf("Section linked to a stylesheet without a theme:\n%s", content)
+	}
+}
+
+func TestSetThemeFilenameUsed(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddCSS(testCoverCSSSource, themeCSSFilename); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := e.SetTheme(ThemeTechnical); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if e.themeCSSFilename == themeCSSFilename || e.css[themeCSSFilename] == "" {
+		t.Errorf("Theme CSS replaced the CSS file %s", themeCSSFilename)
+	}
+	if err := e.SetTheme(Theme(-1)); err == nil {
+		t.Error("Expected an error for an unknown theme")
+	}
+}
+
+// The themes don't use declarations that break the rendering on e-readers
+func TestThemeCSSLint(t *testing.T) {
+	for theme, css := range themeCSS {
+		if issues, _ := lintCSS(themeCSSFilename, css, nil); len(issues) != 0 {
+			t.Errorf("Unexpected issues of theme %d: %v", theme, issues)
+		}
+	}
+}
+
+// The stylesheet of the theme is referenced by the sections
+func TestSetThemeDropOrphanedMedia(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	section, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := e.SetTheme(ThemeSerifNovel); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	e.SetDropOrphanedMedia(true)
+
+	orphans, err := e.OrphanedMedia()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("Unexpected orphaned media: %v", orphans)
+	}
+	assets, err := e.SectionAssets(section)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if expected := []string{"css/theme.css"}; !slices.Equal(assets, expected) {
+		t.Errorf("Got section assets %v, expected %v", assets, expected)
+	}
+
+	r := newTestReader(t, e)
+	if _, err := r.ReadFile("EPUB/css/theme.css"); err != nil {
+		t.Errorf("Theme CSS dropped: %s", err)
+	}
+}
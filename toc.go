@@ -3,6 +3,7 @@ package epub
 import (
 	"encoding/xml"
 	"fmt"
+	"path"
 	"path/filepath"
 	"strconv"
 )
@@ -16,17 +17,24 @@ const (
     </nav>
 `
 	tocNavFilename       = "nav.xhtml"
+	tocNavLandmarksTitle = "Landmarks"
+	tocNavLandmarksType  = "landmarks"
+	tocNavTitle          = "Table of Contents"
 	tocNavItemID         = "nav"
 	tocNavItemProperties = "nav"
 	tocNavEpubType       = "toc"
 
-	tocNcxFilename = "toc.ncx"
-	tocNcxItemID   = "ncx"
-	tocNcxTemplate = `
+	tocNcxFilename  = "toc.ncx"
+	tocNcxItemID    = "ncx"
+	tocNcxMetaDepth = "dtb:depth"
+	tocNcxMetaUID   = "dtb:uid"
+	tocNcxTemplate  = `
 <ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
   <head>
     <meta name="dtb:uid" content="" />
-    <meta name="dtb:depth" content="" />
+    <meta name="dtb:depth" content="1" />
+    <meta name="dtb:totalPageCount" content="0" />
+    <meta name="dtb:maxPageNumber" content="0" />
   </head>
   <docTitle>
     <text></text>
@@ -59,6 +67,13 @@ type toc struct {
 
 	title  string // EPUB title
 	author string // EPUB author
+
+	// Whether the nav document contains a landmark pointing to the table of
+	// contents, which is needed when the nav document is part of the spine
+	tocLandmark bool
+
+	// Maximum depth of the EPUB v2 TOC file, 0 means no limit
+	ncxMaxDepth int
 }
 
 type tocNavBody struct {
@@ -79,10 +94,27 @@ type tocNavLink struct {
 	Data    string   `xml:",chardata"`
 }
 
+// The landmarks <nav> element of the nav document
+// Ex: <nav epub:type="landmarks" hidden="hidden">
+type tocLandmarksBody struct {
+	XMLName  xml.Name          `xml:"nav"`
+	EpubType string            `xml:"epub:type,attr"`
+	Hidden   string            `xml:"hidden,attr,omitempty"`
+	H1       string            `xml:"h1"`
+	Links    []tocLandmarkLink `xml:"ol>li>a"`
+}
+
+// Ex: <a epub:type="toc" href="nav.xhtml">Table of Contents</a>
+type tocLandmarkLink struct {
+	EpubType string `xml:"epub:type,attr"`
+	Href     string `xml:"href,attr"`
+	Data     string `xml:",chardata"`
+}
+
 type tocNcxRoot struct {
 	XMLName xml.Name         `xml:"http://www.daisy.org/z3986/2005/ncx/ ncx"`
 	Version string           `xml:"version,attr"`
-	Meta    tocNcxMeta       `xml:"head>meta"`
+	Meta    []tocNcxMeta     `xml:"head>meta"`
 	Title   string           `xml:"docTitle>text"`
 	Author  string           `xml:"docAuthor>text"`
 	NavMap  []tocNcxNavPoint `xml:"navMap>navPoint"`
@@ -106,51 +138,46 @@ type tocNcxNavPoint struct {
 }
 
 // Constructor for toc
-func newToc() *toc {
+func newToc() (*toc, error) {
 	t := &toc{}
 
-	t.navXML = newTocNavXML()
+	var err error
+	t.navXML, err = newTocNavXML()
+	if err != nil {
+		return nil, err
+	}
 
-	t.ncxXML = newTocNcxXML()
+	t.ncxXML, err = newTocNcxXML()
+	if err != nil {
+		return nil, err
+	}
 
-	return t
+	return t, nil
 }
 
 // Constructor for tocNavBody
-func newTocNavXML() *tocNavBody {
+func newTocNavXML() (*tocNavBody, error) {
 	b := &tocNavBody{
 		EpubType: tocNavEpubType,
 	}
 	err := xml.Unmarshal([]byte(tocNavBodyTemplate), &b)
 	if err != nil {
-		panic(fmt.Sprintf(
-			"Error unmarshalling tocNavBody: %s\n"+
-				"\ttocNavBody=%#v\n"+
-				"\ttocNavBodyTemplate=%s",
-			err,
-			*b,
-			tocNavBodyTemplate))
+		return nil, fmt.Errorf("error unmarshalling tocNavBody: %w", err)
 	}
 
-	return b
+	return b, nil
 }
 
 // Constructor for tocNcxRoot
-func newTocNcxXML() *tocNcxRoot {
+func newTocNcxXML() (*tocNcxRoot, error) {
 	n := &tocNcxRoot{}
 
 	err := xml.Unmarshal([]byte(tocNcxTemplate), &n)
 	if err != nil {
-		panic(fmt.Sprintf(
-			"Error unmarshalling tocNcxRoot: %s\n"+
-				"\ttocNcxRoot=%#v\n"+
-				"\ttocNcxTemplate=%s",
-			err,
-			*n,
-			tocNcxTemplate))
+		return nil, fmt.Errorf("error unmarshalling tocNcxRoot: %w", err)
 	}
 
-	return n
+	return n, nil
 }
 
 // Add a section to the TOC (navXML as well as ncxXML)
@@ -221,7 +248,7 @@ func (t *toc) addSubSection(parent string, index int, title string, relativePath
 		},
 		Children: nil,
 	}
-	if parentNcxIndex > len(t.ncxXML.NavMap) {
+	if parentNcxIndex < len(t.ncxXML.NavMap) {
 		if t.ncxXML.NavMap[parentNcxIndex].Children == nil {
 			n := make([]tocNcxNavPoint, 0)
 			t.ncxXML.NavMap[parentNcxIndex].Children = &n
@@ -233,8 +260,31 @@ func (t *toc) addSubSection(parent string, index int, title string, relativePath
 	}
 }
 
+// Remove the entries of the TOC, which are added again each time the EPUB is
+// written
+func (t *toc) resetEntries() {
+	t.navXML.Links = nil
+	t.ncxXML.NavMap = nil
+}
+
 func (t *toc) setIdentifier(identifier string) {
-	t.ncxXML.Meta.Content = identifier
+	t.setNcxMeta(tocNcxMetaUID, identifier)
+}
+
+// Set the content of the NCX <meta> element with the given name
+func (t *toc) setNcxMeta(name string, content string) {
+	for i := range t.ncxXML.Meta {
+		if t.ncxXML.Meta[i].Name == name {
+			t.ncxXML.Meta[i].Content = content
+			return
+		}
+	}
+	t.ncxXML.Meta = append(t.ncxXML.Meta, tocNcxMeta{Name: name, Content: content})
+}
+
+// Set the maximum depth of the EPUB v2 TOC file, 0 means no limit
+func (t *toc) setNcxMaxDepth(depth int) {
+	t.ncxMaxDepth = depth
 }
 
 func (t *toc) setTitle(title string) {
@@ -245,43 +295,84 @@ func (t *toc) setAuthor(author string) {
 	t.author = author
 }
 
-// Write the TOC files
-func (t *toc) write(tempDir string) {
-	t.writeNavDoc(tempDir)
-	t.writeNcxDoc(tempDir)
+func (t *toc) setTocLandmark(tocLandmark bool) {
+	t.tocLandmark = tocLandmark
+}
+
+// Write the TOC files. The EPUB v2 TOC file is only written if ncx is true.
+func (t *toc) write(w epubFileWriter, ncx bool) error {
+	navDocContent, err := t.navDocContent()
+	if err != nil {
+		return err
+	}
+	if err := w(path.Join(contentFolderName, tocNavFilename), mediaTypeXhtml, navDocContent); err != nil {
+		return fmt.Errorf("error writing EPUB v3 TOC file: %w", err)
+	}
+	if ncx {
+		if err := w(path.Join(contentFolderName, tocNcxFilename), mediaTypeNcx, t.ncxDocContent()); err != nil {
+			return fmt.Errorf("error writing EPUB v2 TOC file: %w", err)
+		}
+	}
+	return nil
 }
 
-// Write the the EPUB v3 TOC file (nav.xhtml) to the temporary directory
-func (t *toc) writeNavDoc(tempDir string) {
+// navDocContent returns the content of the EPUB v3 TOC file (nav.xhtml)
+func (t *toc) navDocContent() ([]byte, error) {
 	navBodyContent, err := xml.MarshalIndent(t.navXML, "    ", "  ")
 	if err != nil {
-		panic(fmt.Sprintf(
-			"Error marshalling XML for EPUB v3 TOC file: %s\n"+
-				"\tXML=%#v",
-			err,
-			t.navXML))
+		return nil, fmt.Errorf("error marshalling XML for EPUB v3 TOC file: %w", err)
+	}
+
+	if t.tocLandmark {
+		landmarks := &tocLandmarksBody{
+			EpubType: tocNavLandmarksType,
+			Hidden:   "hidden",
+			H1:       tocNavLandmarksTitle,
+			Links: []tocLandmarkLink{
+				{
+					EpubType: tocNavEpubType,
+					Href:     tocNavFilename,
+					Data:     tocNavTitle,
+				},
+			},
+		}
+		landmarksContent, err := xml.MarshalIndent(landmarks, "    ", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling XML for EPUB v3 TOC landmarks: %w", err)
+		}
+		navBodyContent = append(navBodyContent, "\n"...)
+		navBodyContent = append(navBodyContent, landmarksContent...)
 	}
 
-	n := newXhtml(string(navBodyContent))
+	n, err := newXhtml(string(navBodyContent))
+	if err != nil {
+		return nil, err
+	}
 	n.setXmlnsEpub(xmlnsEpub)
 	n.setTitle(t.title)
 
-	navFilePath := filepath.Join(tempDir, contentFolderName, tocNavFilename)
-	n.write(navFilePath)
+	return n.content(), nil
 }
 
-// Write the EPUB v2 TOC file (toc.ncx) to the temporary directory
-func (t *toc) writeNcxDoc(tempDir string) {
+// ncxDocContent returns the content of the EPUB v2 TOC file (toc.ncx)
+func (t *toc) ncxDocContent() []byte {
 	t.ncxXML.Title = t.title
 	t.ncxXML.Author = t.author
 
-	ncxFileContent, err := xml.MarshalIndent(t.ncxXML, "", "  ")
+	// Entries deeper than the maximum depth are left out of the NCX only, the
+	// nav document keeps all of them
+	ncxXML := *t.ncxXML
+	ncxXML.NavMap = limitNavPointsDepth(t.ncxXML.NavMap, t.ncxMaxDepth)
+	t.setNcxMeta(tocNcxMetaDepth, strconv.Itoa(navPointsDepth(ncxXML.NavMap)))
+	ncxXML.Meta = t.ncxXML.Meta
+
+	ncxFileContent, err := xml.MarshalIndent(ncxXML, "", "  ")
 	if err != nil {
 		panic(fmt.Sprintf(
 			"Error marshalling XML for EPUB v2 TOC file: %s\n"+
 				"\tXML=%#v",
 			err,
-			t.ncxXML))
+			ncxXML))
 	}
 
 	// Add the xml header to the output
@@ -289,8 +380,41 @@ func (t *toc) writeNcxDoc(tempDir string) {
 	// It's generally nice to have files end with a newline
 	ncxFileContent = append(ncxFileContent, "\n"...)
 
-	ncxFilePath := filepath.Join(tempDir, contentFolderName, tocNcxFilename)
-	if err := filesystem.WriteFile(ncxFilePath, []byte(ncxFileContent), filePermissions); err != nil {
-		panic(fmt.Sprintf("Error writing EPUB v2 TOC file: %s", err))
+	return ncxFileContent
+}
+
+// navPointsDepth returns the depth of the navPoint tree, at least 1 as required
+// by dtb:depth
+func navPointsDepth(navPoints []tocNcxNavPoint) int {
+	depth := 1
+	for _, np := range navPoints {
+		if np.Children != nil && len(*np.Children) > 0 {
+			if d := navPointsDepth(*np.Children) + 1; d > depth {
+				depth = d
+			}
+		}
+	}
+	return depth
+}
+
+// limitNavPointsDepth returns a copy of the navPoint tree without the navPoints
+// deeper than maxDepth. A maxDepth of 0 or less means no limit.
+func limitNavPointsDepth(navPoints []tocNcxNavPoint, maxDepth int) []tocNcxNavPoint {
+	if maxDepth <= 0 {
+		return navPoints
+	}
+	limited := make([]tocNcxNavPoint, len(navPoints))
+	for i, np := range navPoints {
+		limited[i] = np
+		if np.Children == nil {
+			continue
+		}
+		if maxDepth == 1 {
+			limited[i].Children = nil
+		} else {
+			children := limitNavPointsDepth(*np.Children, maxDepth-1)
+			limited[i].Children = &children
+		}
 	}
+	return limited
 }
@@ -0,0 +1,438 @@
+package epub
+
+import (
+	"fmt"
+	"html"
+	"io/fs"
+	"mime"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/vincent-petithory/dataurl"
+)
+
+const (
+	// Folder of the files of an upgraded EPUB that would otherwise be in a
+	// folder used by the other files of the EPUB
+	upgradedRawFolderName = "files"
+	mediaTypeOctetStream  = "application/octet-stream"
+)
+
+var (
+	// xhtmlBodyRegexp matches the body of an XHTML document, the first group
+	// being its content
+	xhtmlBodyRegexp = regexp.MustCompile(`(?is)<body\b[^>]*>(.*)</body\s*>`)
+	// xhtmlTitleRegexp matches the title of an XHTML document, the first group
+	// being its content
+	xhtmlTitleRegexp = regexp.MustCompile(`(?is)<title\b[^>]*>(.*?)</title\s*>`)
+	// xhtmlHeadLinkRegexp matches the <link> elements of an XHTML document
+	xhtmlHeadLinkRegexp = regexp.MustCompile(`(?is)<link\b[^>]*>`)
+	// xhtmlHeadStyleRegexp matches the <style> elements of an XHTML document,
+	// the first group being their content
+	xhtmlHeadStyleRegexp = regexp.MustCompile(`(?is)<style\b[^>]*>(.*?)</style\s*>`)
+)
+
+// guideEpubTypes are the epub:type of the sections of an upgraded EPUB, by type
+// of their reference in the guide of the EPUB v2 file
+var guideEpubTypes = map[string]string{
+	"acknowledgements": "acknowledgments",
+	"bibliography":     "bibliography",
+	"colophon":         "colophon",
+	"copyright-page":   "copyright-page",
+	"cover":            "cover",
+	"dedication":       "dedication",
+	"epigraph":         "epigraph",
+	"foreword":         "foreword",
+	"glossary":         "glossary",
+	"index":            "index",
+	"notes":            "endnotes",
+	"preface":          "preface",
+	"text":             "bodymatter",
+	"title-page":       "titlepage",
+	"toc":              "toc",
+}
+
+// upgradedSection is a document of the spine of an EPUB being upgraded
+type upgradedSection struct {
+	item     SpineItem
+	filename string
+}
+
+// Upgrade creates an EPUB v3 file from the EPUB read by r, typically an EPUB v2
+// file, which can then be written like any other EPUB, e.g. to add the nav
+// document required by EPUB v3 to EPUB v2 files that only have an NCX document.
+// The options are passed to NewEpub.
+//
+// The documents of the spine become sections, titled in the table of contents
+// as in the table of contents of r; the documents that aren't part of it are
+// left out of the table of contents. The stylesheets, fonts, images, videos
+// and audio are added as such, the other files of the manifest as raw files,
+// and the links between them are updated to their new paths. The cover image
+// replaces the cover page referenced by the guide, or else the first document
+// of the spine if it only shows the cover image, and the other references of
+// the guide become the epub:type of the sections.
+func Upgrade(r *Reader, options ...EpubOption) (*Epub, error) {
+	e := NewEpub(r.Metadata.Title, options...)
+	if r.Metadata.Identifier != "" {
+		e.SetIdentifier(r.Metadata.Identifier)
+	}
+	if r.Metadata.Language != "" {
+		e.SetLang(r.Metadata.Language)
+	}
+	e.SetDescription(r.Metadata.Description)
+	e.SetAuthor(strings.Join(r.Metadata.Authors, ", "))
+
+	spine := make(map[string]bool)
+	for _, item := range r.Spine {
+		spine[item.Item.Path] = true
+	}
+
+	// The new paths of the files relative to the content folder, by path
+	// inside the EPUB read
+	renamed := make(map[string]string)
+	// The filenames used in each media folder and by the sections
+	used := map[string]map[string]string{}
+	for mediaFolderName := range mediaFileFormats {
+		used[mediaFolderName] = make(map[string]string)
+	}
+	var mediaItems, cssItems, rawItems []ManifestItem
+	for _, item := range r.Manifest {
+		switch mediaFolderName := upgradedMediaFolder(item.MediaType); {
+		case spine[item.Path] || item.MediaType == mediaTypeNcx:
+		case mediaFolderName != "":
+			filename := SafeInternalFilename(item.Path)
+			if _, ok := used[mediaFolderName][filename]; filename == "" || ok {
+				filename = unusedMediaFilename(used[mediaFolderName], mediaFileFormats[mediaFolderName], strings.ToLower(path.Ext(item.Path)))
+			}
+			used[mediaFolderName][filename] = item.Path
+			renamed[item.Path] = path.Join(mediaFolderName, filename)
+			if mediaFolderName == CSSFolderName {
+				cssItems = append(cssItems, item)
+			} else {
+				mediaItems = append(mediaItems, item)
+			}
+		default:
+			rawPath := strings.TrimPrefix(item.Path, path.Dir(r.PackagePath)+"/")
+			folderName, _, _ := strings.Cut(rawPath, "/")
+			if _, ok := mediaFileFormats[folderName]; ok || folderName == xhtmlFolderName || rawPath == pkgFilename || rawPath == tocNavFilename || rawPath == tocNcxFilename {
+				rawPath = path.Join(upgradedRawFolderName, rawPath)
+			}
+			renamed[item.Path] = rawPath
+			rawItems = append(rawItems, item)
+		}
+	}
+
+	for _, item := range mediaItems {
+		if err := upgradeMedia(r, e, item, renamed); err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range rawItems {
+		data, err := r.ReadFile(item.Path)
+		if err != nil {
+			return nil, &InvalidEpubError{Path: item.Path, Err: err}
+		}
+		if _, err := e.AddRawFile(upgradedDataURL(data, item.MediaType), renamed[item.Path], item.MediaType); err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range cssItems {
+		data, err := r.ReadFile(item.Path)
+		if err != nil {
+			return nil, &InvalidEpubError{Path: item.Path, Err: err}
+		}
+		css := upgradedCSS(string(data), item.Path, renamed)
+		if _, err := e.AddCSSFromString(css, path.Base(renamed[item.Path])); err != nil {
+			return nil, err
+		}
+	}
+
+	// The cover page is added first, so that it's at the beginning of the spine
+	coverPage := ""
+	sectionFilenames := make(map[string]bool)
+	if r.coverPath != "" {
+		if err := e.setCover(path.Join("..", renamed[r.coverPath]), ""); err != nil {
+			return nil, err
+		}
+		sectionFilenames[e.cover.xhtmlFilename] = true
+		var err error
+		coverPage, err = upgradedCoverPage(r)
+		if err != nil {
+			return nil, err
+		}
+		if coverPage != "" {
+			renamed[coverPage] = path.Join(xhtmlFolderName, e.cover.xhtmlFilename)
+		}
+	}
+
+	var sections []upgradedSection
+	for i, item := range r.Spine {
+		if item.Item.Path == coverPage {
+			continue
+		}
+		filename := path.Base(item.Item.Path)
+		if !fs.ValidPath(filename) || sectionFilenames[filename] {
+			filename = ""
+			for index := i + 1; filename == "" || sectionFilenames[filename]; index++ {
+				filename = fmt.Sprintf(sectionFileFormat, index)
+			}
+		}
+		sectionFilenames[filename] = true
+		renamed[item.Item.Path] = path.Join(xhtmlFolderName, filename)
+		sections = append(sections, upgradedSection{item: item, filename: filename})
+	}
+
+	epubTypes := make(map[string]string)
+	for _, reference := range r.Guide {
+		referencePath, _ := splitFragment(reference.Path)
+		if _, ok := epubTypes[referencePath]; !ok {
+			epubTypes[referencePath] = guideEpubTypes[reference.Type]
+		}
+	}
+	tocEntries := make(map[string]upgradedTOCEntry)
+	upgradedTOCEntries(r.TOC, "", tocEntries)
+
+	// The last section added at the top level, which can be the parent of the
+	// following ones
+	var parent upgradedSection
+	for _, section := range sections {
+		content, err := r.SectionContent(section.item)
+		if err != nil {
+			return nil, &InvalidEpubError{Path: section.item.Item.Path, Err: err}
+		}
+		opts, body, err := upgradedSectionOptions(e, section, string(content), renamed)
+		if err != nil {
+			return nil, err
+		}
+		opts.EpubType = epubTypes[section.item.Item.Path]
+		if entry, ok := tocEntries[section.item.Item.Path]; ok {
+			opts.TocTitle = entry.title
+			if opts.Title == "" {
+				opts.Title = entry.title
+			}
+			if entry.parent != "" && entry.parent == parent.item.Item.Path {
+				opts.Parent = parent.filename
+			}
+		} else {
+			// Left out of the table of contents
+			opts.Title = ""
+		}
+		if _, err := e.AddSectionWithOptions(body, opts); err != nil {
+			return nil, err
+		}
+		if opts.Parent == "" {
+			parent = section
+		}
+	}
+	return e, nil
+}
+
+// upgradedCoverPage returns the path of the cover page of the EPUB read by r,
+// which is replaced by the cover of the upgraded EPUB: the document referenced
+// as the cover by the guide, or else the first document of the spine if it only
+// shows the cover image, as is usual for EPUB files without a guide. It returns
+// an empty string if there's no such document.
+func upgradedCoverPage(r *Reader) (string, error) {
+	for _, reference := range r.Guide {
+		if reference.Type == "cover" {
+			coverPage, _ := splitFragment(reference.Path)
+			return coverPage, nil
+		}
+	}
+	if len(r.Spine) == 0 {
+		return "", nil
+	}
+	first := r.Spine[0]
+	content, err := r.SectionContent(first)
+	if err != nil {
+		return "", &InvalidEpubError{Path: first.Item.Path, Err: err}
+	}
+	body := string(content)
+	if m := xhtmlBodyRegexp.FindStringSubmatch(body); m != nil {
+		body = m[1]
+	}
+	if strings.TrimSpace(html.UnescapeString(htmlTagRegexp.ReplaceAllString(body, ""))) != "" {
+		return "", nil
+	}
+	for _, link := range findLinks(body) {
+		if linkPath, _ := splitFragment(resolveHref(first.Item.Path, link)); linkPath == r.coverPath {
+			return first.Item.Path, nil
+		}
+	}
+	return "", nil
+}
+
+// upgradedMediaFolder returns the media folder of the files of the media type
+// in an upgraded EPUB, or an empty string if they're raw files
+func upgradedMediaFolder(mediaType string) string {
+	switch {
+	case mediaType == mediaTypeCSS:
+		return CSSFolderName
+	case strings.HasPrefix(mediaType, "font/"),
+		strings.HasPrefix(mediaType, "application/") && strings.Contains(mediaType, "font"),
+		mediaType == "application/vnd.ms-opentype":
+		return FontFolderName
+	case strings.HasPrefix(mediaType, "image/"):
+		return ImageFolderName
+	case strings.HasPrefix(mediaType, "video/"):
+		return VideoFolderName
+	case strings.HasPrefix(mediaType, "audio/"):
+		return AudioFolderName
+	}
+	return ""
+}
+
+// upgradedDataURL returns the data URL used as the source of a file of an
+// upgraded EPUB
+func upgradedDataURL(data []byte, mediaType string) string {
+	if mediaType == "" {
+		mediaType = mediaTypeOctetStream
+	}
+	// The parameters of the media type, e.g. text/plain; charset=utf-8, must
+	// be passed separately to be encoded, and dataurl panics on invalid media
+	// types
+	baseType, params, err := mime.ParseMediaType(mediaType)
+	if err != nil || !strings.Contains(baseType, "/") {
+		return dataurl.New(data, mediaTypeOctetStream).String()
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	paramPairs := make([]string, 0, 2*len(params))
+	for _, name := range names {
+		paramPairs = append(paramPairs, name, params[name])
+	}
+	return dataurl.New(data, baseType, paramPairs...).String()
+}
+
+// upgradeMedia adds a media file of the EPUB read by r to e
+func upgradeMedia(r *Reader, e *Epub, item ManifestItem, renamed map[string]string) error {
+	data, err := r.ReadFile(item.Path)
+	if err != nil {
+		return &InvalidEpubError{Path: item.Path, Err: err}
+	}
+	source := upgradedDataURL(data, item.MediaType)
+	mediaFolderName, filename := path.Split(renamed[item.Path])
+	add := map[string]func(string, string) (string, error){
+		FontFolderName:  e.AddFont,
+		ImageFolderName: e.AddImage,
+		VideoFolderName: e.AddVideo,
+		AudioFolderName: e.AddAudio,
+	}[strings.TrimSuffix(mediaFolderName, "/")]
+	internalPath, err := add(source, filename)
+	if err != nil {
+		return err
+	}
+	// The media type of the manifest is kept, since some can't be detected
+	// from the content, e.g. fonts
+	return e.SetMediaType(internalPath, item.MediaType)
+}
+
+// upgradedLink returns the link of an upgraded EPUB from the file whose path
+// relative to the content folder is fromPath, given the link from the file at
+// originalPath inside the EPUB read
+func upgradedLink(link string, originalPath string, fromPath string, renamed map[string]string) string {
+	if link == "" || strings.HasPrefix(link, "#") || isRemoteLink(link) {
+		return link
+	}
+	linkPath, fragment := splitFragment(resolveHref(originalPath, link))
+	newPath, ok := renamed[linkPath]
+	if !ok {
+		return link
+	}
+	link = relativePath(fromPath, newPath)
+	if fragment != "" {
+		link += "#" + fragment
+	}
+	return link
+}
+
+// upgradedCSS returns the CSS of an upgraded EPUB, whose links are updated
+func upgradedCSS(css string, originalPath string, renamed map[string]string) string {
+	fromPath := renamed[originalPath]
+	return cssLinkRegex.ReplaceAllStringFunc(css, func(match string) string {
+		m := cssLinkRegex.FindStringSubmatch(match)
+		link := m[1] + m[2]
+		if link == "" {
+			return match
+		}
+		return strings.Replace(match, link, upgradedLink(link, originalPath, fromPath, renamed), 1)
+	})
+}
+
+// upgradedSectionOptions returns the options and the body of a section of an
+// upgraded EPUB, given the content of its XHTML document. The stylesheets of
+// the <style> elements of the document are added to e.
+func upgradedSectionOptions(e *Epub, section upgradedSection, content string, renamed map[string]string) (SectionOptions, string, error) {
+	originalPath := section.item.Item.Path
+	fromPath := renamed[originalPath]
+	opts := SectionOptions{
+		Filename:        section.filename,
+		NonLinear:       !section.item.Linear,
+		SpineProperties: section.item.Properties,
+	}
+
+	head, body := content, content
+	if m := xhtmlBodyRegexp.FindStringSubmatchIndex(content); m != nil {
+		head = content[:m[0]]
+		body = content[m[2]:m[3]]
+	}
+	if m := xhtmlTitleRegexp.FindStringSubmatch(head); m != nil {
+		opts.Title = strings.TrimSpace(html.UnescapeString(htmlTagRegexp.ReplaceAllString(m[1], "")))
+	}
+	for _, link := range xhtmlHeadLinkRegexp.FindAllString(head, -1) {
+		if !hasProperty(strings.ToLower(getAttribute(link, "rel")), "stylesheet") {
+			continue
+		}
+		href := getAttribute(link, "href")
+		hrefPath, _ := splitFragment(resolveHref(originalPath, href))
+		if _, ok := renamed[hrefPath]; !ok && !isRemoteLink(href) {
+			// The stylesheet isn't part of the EPUB
+			continue
+		}
+		opts.CSS = append(opts.CSS, upgradedLink(href, originalPath, fromPath, renamed))
+	}
+	for i, m := range xhtmlHeadStyleRegexp.FindAllStringSubmatch(head, -1) {
+		css := upgradedCSS(m[1], originalPath, renamed)
+		filename := fmt.Sprintf("%s-%d.css", strings.TrimSuffix(section.filename, path.Ext(section.filename)), i+1)
+		cssPath, err := e.AddCSSFromString(css, filename)
+		if err != nil {
+			return opts, "", err
+		}
+		opts.CSS = append(opts.CSS, cssPath)
+	}
+
+	body = rewriteLinks(body, func(link string) string {
+		return upgradedLink(link, originalPath, fromPath, renamed)
+	})
+	return opts, strings.TrimSpace(body), nil
+}
+
+// upgradedTOCEntry is the entry of the table of contents of the EPUB read for a
+// document of an upgraded EPUB
+type upgradedTOCEntry struct {
+	title string
+	// The path of the document of the top level entry the entry belongs to, if
+	// it's a subentry
+	parent string
+}
+
+// upgradedTOCEntries adds the first entry of each document of the table of
+// contents to entries, by path
+func upgradedTOCEntries(toc []TOCEntry, parent string, entries map[string]upgradedTOCEntry) {
+	for _, entry := range toc {
+		entryPath, _ := splitFragment(entry.Path)
+		if _, ok := entries[entryPath]; !ok && entryPath != "" {
+			entries[entryPath] = upgradedTOCEntry{title: entry.Title, parent: parent}
+		}
+		childParent := parent
+		if childParent == "" {
+			childParent = entryPath
+		}
+		upgradedTOCEntries(entry.Children, childParent, entries)
+	}
+}
@@ -0,0 +1,245 @@
+package epub
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vincent-petithory/dataurl"
+)
+
+func TestUpgrade(t *testing.T) {
+	image, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading image: %s", err)
+	}
+	b := zipTestFiles(t, [][2]string{
+		{"mimetype", mediaTypeEpub},
+		{"META-INF/container.xml", `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`},
+		{"OEBPS/content.opf", `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:title>EPUB 2</dc:title>
+    <dc:creator>First author</dc:creator>
+    <dc:creator>Second author</dc:creator>
+    <dc:identifier id="id">urn:uuid:1234</dc:identifier>
+    <dc:language>fr</dc:language>
+    <meta name="cover" content="cover-image"/>
+  </metadata>
+  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="cover" href="Text/cover.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="Text/ch2.xhtml" media-type="application/xhtml+xml"/>
+    <item id="notes" href="Text/notes.xhtml" media-type="application/xhtml+xml"/>
+    <item id="style" href="Styles/style.css" media-type="text/css"/>
+    <item id="cover-image" href="Images/cover.png" media-type="image/png"/>
+    <item id="data" href="Misc/data.json" media-type="application/json"/>
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="cover"/>
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+    <itemref idref="notes" linear="no"/>
+  </spine>
+  <guide>
+    <reference type="cover" title="Cover" href="Text/cover.xhtml"/>
+    <reference type="text" title="Start" href="Text/ch1.xhtml"/>
+  </guide>
+</package>`},
+		{"OEBPS/toc.ncx", `<?xml version="1.0"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <navMap>
+    <navPoint id="p1"><navLabel><text>Part 1</text></navLabel><content src="Text/ch1.xhtml"/>
+      <navPoint id="p2"><navLabel><text>Chapter 2</text></navLabel><content src="Text/ch2.xhtml#start"/></navPoint>
+    </navPoint>
+  </navMap>
+</ncx>`},
+		{"OEBPS/Text/cover.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Cover</title></head><body><img src="../Images/cover.png" alt=""/></body></html>`},
+		{"OEBPS/Text/ch1.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml">
+<head>
+  <title>Part 1</title>
+  <link rel="stylesheet" type="text/css" href="../Styles/style.css"/>
+  <style>p { background: url("../Images/cover.png"); }</style>
+</head>
+<body><p><a href="ch2.xhtml#start">Next</a> <img src="../Images/cover.png" alt=""/></p></body>
+</html>`},
+		{"OEBPS/Text/ch2.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Chapter 2</title></head><body><p id="start"><a href="../Text/ch1.xhtml">Back</a></p></body></html>`},
+		{"OEBPS/Text/notes.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Notes</title></head><body><p>Notes</p></body></html>`},
+		{"OEBPS/Styles/style.css", `body { background: url(../Images/cover.png); }`},
+		{"OEBPS/Images/cover.png", string(image)},
+		{"OEBPS/Misc/data.json", `{}`},
+	})
+	source, err := NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+
+	e, err := Upgrade(source)
+	if err != nil {
+		t.Fatalf("Unexpected error upgrading EPUB: %s", err)
+	}
+	r := newTestReader(t, e)
+
+	if r.Version != "3.0" {
+		t.Errorf("Got version %s, expected 3.0", r.Version)
+	}
+	if r.Metadata.Title != "EPUB 2" || r.Metadata.Identifier != "urn:uuid:1234" || r.Metadata.Language != "fr" {
+		t.Errorf("Got metadata %+v, expected the metadata of the EPUB v2 file", r.Metadata)
+	}
+	if !reflect.DeepEqual(r.Metadata.Authors, []string{"First author, Second author"}) {
+		t.Errorf("Got authors %v, expected the authors of the EPUB v2 file", r.Metadata.Authors)
+	}
+	if !bytes.Equal(r.Metadata.CoverImage, image) {
+		t.Error("Expected the cover image of the EPUB v2 file")
+	}
+
+	var spine []string
+	for _, item := range r.Spine {
+		spine = append(spine, item.Item.Path)
+	}
+	expectedSpine := []string{"EPUB/xhtml/cover.xhtml", "EPUB/xhtml/ch1.xhtml", "EPUB/xhtml/ch2.xhtml", "EPUB/xhtml/notes.xhtml"}
+	if !reflect.DeepEqual(spine, expectedSpine) {
+		t.Errorf("Got spine %v, expected %v", spine, expectedSpine)
+	}
+	if r.Spine[3].Linear {
+		t.Error("Expected the notes to stay non-linear")
+	}
+
+	expectedTOC := []TOCEntry{{
+		Title:    "Part 1",
+		Path:     "EPUB/xhtml/ch1.xhtml",
+		Children: []TOCEntry{{Title: "Chapter 2", Path: "EPUB/xhtml/ch2.xhtml"}},
+	}}
+	if !reflect.DeepEqual(r.TOC, expectedTOC) {
+		t.Errorf("Got TOC %+v, expected %+v", r.TOC, expectedTOC)
+	}
+
+	ch1, err := r.SectionContent(r.Spine[1])
+	if err != nil {
+		t.Fatalf("Unexpected error reading section: %s", err)
+	}
+	for _, expected := range []string{
+		`href="ch2.xhtml#start"`,
+		`src="../images/cover.png"`,
+		`href="../css/style.css"`,
+		`href="../css/ch1-1.css"`,
+		`epub:type="bodymatter"`,
+	} {
+		if !strings.Contains(string(ch1), expected) {
+			t.Errorf("Expected %s in the section, got:\n%s", expected, ch1)
+		}
+	}
+	ch2, err := r.SectionContent(r.Spine[2])
+	if err != nil {
+		t.Fatalf("Unexpected error reading section: %s", err)
+	}
+	if !strings.Contains(string(ch2), `href="ch1.xhtml"`) {
+		t.Errorf("Expected the link to chapter 1 to be updated, got:\n%s", ch2)
+	}
+
+	for name, expected := range map[string]string{
+		"EPUB/css/style.css":  `url(../images/cover.png)`,
+		"EPUB/css/ch1-1.css":  `url("../images/cover.png")`,
+		"EPUB/Misc/data.json": `{}`,
+	} {
+		data, err := r.ReadFile(name)
+		if err != nil {
+			t.Errorf("Unexpected error reading %s: %s", name, err)
+			continue
+		}
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected %s in %s, got:\n%s", expected, name, data)
+		}
+	}
+	if _, err := r.ReadFile(tocNavFilename); err == nil {
+		t.Errorf("Expected the nav document in the content folder only")
+	}
+	if _, err := r.ReadFile(contentFolderName + "/" + tocNavFilename); err != nil {
+		t.Errorf("Expected a nav document: %s", err)
+	}
+}
+
+// The cover page of EPUB files without a guide is replaced by the cover
+func TestUpgradeCoverWithoutGuide(t *testing.T) {
+	image, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading image: %s", err)
+	}
+	b := zipTestFiles(t, [][2]string{
+		{"mimetype", mediaTypeEpub},
+		{"META-INF/container.xml", `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`},
+		{"content.opf", `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>EPUB 2</dc:title>
+    <dc:identifier id="id">urn:uuid:1234</dc:identifier>
+    <meta name="cover" content="cover-image"/>
+  </metadata>
+  <manifest>
+    <item id="titlepage" href="titlepage.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="cover-image" href="cover.png" media-type="image/png"/>
+  </manifest>
+  <spine>
+    <itemref idref="titlepage"/>
+    <itemref idref="ch1"/>
+  </spine>
+</package>`},
+		{"titlepage.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Cover</title></head><body>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><image xlink:href="cover.png"/></svg>
+</body></html>`},
+		{"ch1.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Chapter 1</title></head><body><p><img src="cover.png" alt=""/> Text</p></body></html>`},
+		{"cover.png", string(image)},
+	})
+	source, err := NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+
+	e, err := Upgrade(source)
+	if err != nil {
+		t.Fatalf("Unexpected error upgrading EPUB: %s", err)
+	}
+	r := newTestReader(t, e)
+	var spine []string
+	for _, item := range r.Spine {
+		spine = append(spine, item.Item.Path)
+	}
+	expectedSpine := []string{"EPUB/xhtml/cover.xhtml", "EPUB/xhtml/ch1.xhtml"}
+	if !reflect.DeepEqual(spine, expectedSpine) {
+		t.Errorf("Got spine %v, expected %v", spine, expectedSpine)
+	}
+}
+
+func TestUpgradedDataURL(t *testing.T) {
+	testCases := []struct {
+		mediaType string
+		expected  string
+	}{
+		{"", "data:application/octet-stream;base64,"},
+		{"text/plain; charset=utf-8", "data:text/plain;charset=utf-8;base64,"},
+		{"invalid;", "data:application/octet-stream;base64,"},
+	}
+	for _, tc := range testCases {
+		dataURL := upgradedDataURL([]byte("Notes"), tc.mediaType)
+		if !strings.HasPrefix(dataURL, tc.expected) {
+			t.Errorf("Got %s for media type %q, expected prefix %s", dataURL, tc.mediaType, tc.expected)
+		}
+		if _, err := dataurl.DecodeString(dataURL); err != nil {
+			t.Errorf("Unexpected error decoding %s: %s", dataURL, err)
+		}
+	}
+}
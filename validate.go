@@ -0,0 +1,475 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ValidationSeverity is the severity of a ValidationFinding.
+type ValidationSeverity int
+
+const (
+	// SeverityError is the severity of the problems that make the EPUB invalid,
+	// which reading systems may fail to open
+	SeverityError ValidationSeverity = iota
+	// SeverityWarning is the severity of the problems that don't make the EPUB
+	// invalid but may still be unintended, e.g. files missing from the manifest
+	SeverityWarning
+)
+
+// String returns the name of the severity, e.g. ERROR
+func (s ValidationSeverity) String() string {
+	if s == SeverityWarning {
+		return "WARNING"
+	}
+	return "ERROR"
+}
+
+// ValidationCheck is the check of Validate that found a ValidationFinding.
+type ValidationCheck string
+
+const (
+	// CheckMimetype checks that the mimetype file is the first file of the
+	// EPUB, stored uncompressed, and contains the EPUB media type
+	CheckMimetype ValidationCheck = "mimetype"
+	// CheckContainer checks that the container file references a package
+	// document of the EPUB
+	CheckContainer ValidationCheck = "container"
+	// CheckPackage checks that the package document has the required metadata
+	CheckPackage ValidationCheck = "package"
+	// CheckManifest checks that the files of the manifest are in the EPUB and
+	// that the files of the EPUB are in the manifest
+	CheckManifest ValidationCheck = "manifest"
+	// CheckSpine checks that the spine only references items of the manifest
+	// that are content documents or fall back to one
+	CheckSpine ValidationCheck = "spine"
+	// CheckDuplicateID checks that the IDs of each XML file are unique
+	CheckDuplicateID ValidationCheck = "duplicate-id"
+	// CheckXHTML checks that the XHTML documents and the other XML files of
+	// the package are well-formed
+	CheckXHTML ValidationCheck = "xhtml"
+	// CheckLang checks that the languages are well-formed language tags
+	CheckLang ValidationCheck = "lang"
+	// CheckHref checks that the links of the sections are valid URLs and link
+	// to files of the EPUB. It's only done in strict mode (see SetStrict).
+	CheckHref ValidationCheck = "href"
+	// CheckFragment checks that the fragments of the links of the XHTML
+	// documents and of the tables of contents match an ID of the linked
+	// document. The fragments of the links of the sections are also checked in
+	// strict mode (see SetStrict).
+	CheckFragment ValidationCheck = "fragment"
+)
+
+// ValidationFinding is a problem found by Validate.
+type ValidationFinding struct {
+	Severity ValidationSeverity
+	Check    ValidationCheck
+	Path     string // The path of the file inside the EPUB, if the problem concerns a file
+	Line     int    // The line of the problem in the file, starting at 1, if known
+	Message  string
+}
+
+// String returns the finding as a single line, e.g.
+// ERROR(spine) EPUB/package.opf: spine item "ch1" not in the manifest
+func (f ValidationFinding) String() string {
+	location := f.Path
+	if location != "" && f.Line > 0 {
+		location = fmt.Sprintf("%s:%d", location, f.Line)
+	}
+	if location != "" {
+		location = " " + location + ":"
+	}
+	return fmt.Sprintf("%s(%s)%s %s", f.Severity, f.Check, location, f.Message)
+}
+
+// Validate checks the EPUB read from r, which is size bytes long, and returns
+// the problems found, in the order they're found. It implements a subset of
+// the checks of epubcheck in pure Go, so that EPUBs can be checked without
+// Java, e.g. in tests:
+//   - the mimetype file is first, uncompressed and has the right content
+//   - the container file references a package document of the EPUB
+//   - the package document has a title, a well-formed language tag and a
+//     unique identifier
+//   - the files of the manifest exist, and the files of the EPUB are in the
+//     manifest
+//   - the spine and the table of contents reference items of the manifest,
+//     and the items of the spine are content documents or fall back to one
+//   - the IDs of the package document and of the XHTML documents are unique
+//   - the package document and the XHTML documents are well-formed XML
+//   - the fragments of the links of the XHTML documents and of the tables of
+//     contents match an ID of the linked document
+//
+// An error is only returned if r can't be read as a zip file. No findings
+// doesn't mean the EPUB is valid, since epubcheck checks a lot more.
+func Validate(r io.ReaderAt, size int64) ([]ValidationFinding, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return validateZip(z), nil
+}
+
+// ValidateFile checks the EPUB file at the path, see Validate.
+func ValidateFile(path string) ([]ValidationFinding, error) {
+	f, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return validateZip(&f.Reader), nil
+}
+
+// Validate writes the EPUB and checks it, see the Validate function.
+func (e *Epub) Validate() ([]ValidationFinding, error) {
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		return nil, err
+	}
+	return Validate(bytes.NewReader(b.Bytes()), int64(b.Len()))
+}
+
+// validator checks an EPUB, adding the problems found to its findings
+type validator struct {
+	z        *zip.Reader
+	files    map[string]*zip.File // The files of the EPUB, by name
+	findings []ValidationFinding
+	// The IDs of the XML files that were checked, by name
+	ids map[string]map[string]bool
+	// The links of the XML files that were checked, in the order they're found
+	links []validatorLink
+}
+
+// validatorLink is a link of an XML file checked by the validator
+type validatorLink struct {
+	name string // The path of the file of the link inside the EPUB
+	line int
+	href string
+}
+
+// validateZip runs all the checks on the EPUB read from z
+func validateZip(z *zip.Reader) []ValidationFinding {
+	v := &validator{z: z, files: make(map[string]*zip.File), ids: make(map[string]map[string]bool)}
+	for _, f := range z.File {
+		v.files[f.Name] = f
+	}
+	v.validate()
+	return v.findings
+}
+
+// add adds a finding about the file at the path inside the EPUB
+func (v *validator) add(severity ValidationSeverity, check ValidationCheck, name string, line int, format string, a ...interface{}) {
+	v.findings = append(v.findings, ValidationFinding{
+		Severity: severity,
+		Check:    check,
+		Path:     name,
+		Line:     line,
+		Message:  fmt.Sprintf(format, a...),
+	})
+}
+
+// validate runs all the checks
+func (v *validator) validate() {
+	v.validateMimetype()
+	pkgPath := v.validateContainer()
+	if pkgPath == "" {
+		return
+	}
+	content, ok := v.validateXML(pkgPath)
+	if !ok {
+		return
+	}
+	var p readPkg
+	if err := xml.Unmarshal(content, &p); err != nil {
+		v.add(SeverityError, CheckPackage, pkgPath, 0, "invalid package document: %s", err)
+		return
+	}
+	v.validateMetadata(pkgPath, &p)
+	items := v.validateManifest(pkgPath, &p)
+	v.validateSpine(pkgPath, &p, items)
+	v.validateFragments()
+}
+
+// validateMimetype checks the mimetype file
+func (v *validator) validateMimetype() {
+	f, ok := v.files[mimetypeFilename]
+	if !ok {
+		v.add(SeverityError, CheckMimetype, "", 0, "mimetype file missing")
+		return
+	}
+	if v.z.File[0] != f {
+		v.add(SeverityError, CheckMimetype, mimetypeFilename, 0, "mimetype file not the first file of the EPUB")
+	}
+	if f.Method != zip.Store {
+		v.add(SeverityError, CheckMimetype, mimetypeFilename, 0, "mimetype file compressed")
+	}
+	if len(f.Extra) > 0 {
+		v.add(SeverityError, CheckMimetype, mimetypeFilename, 0, "mimetype file has an extra field")
+	}
+	content, err := v.readFile(mimetypeFilename)
+	if err == nil && string(content) != mediaTypeEpub {
+		v.add(SeverityError, CheckMimetype, mimetypeFilename, 0, "mimetype file contains %q instead of %q", content, mediaTypeEpub)
+	}
+}
+
+// validateContainer checks the container file and returns the path of the
+// package document, or an empty string if there's none
+func (v *validator) validateContainer() string {
+	containerPath := path.Join(metaInfFolderName, containerFilename)
+	if _, ok := v.files[containerPath]; !ok {
+		v.add(SeverityError, CheckContainer, "", 0, "%s missing", containerPath)
+		return ""
+	}
+	content, ok := v.validateXML(containerPath)
+	if !ok {
+		return ""
+	}
+	var c readContainer
+	if err := xml.Unmarshal(content, &c); err != nil {
+		v.add(SeverityError, CheckContainer, containerPath, 0, "invalid container file: %s", err)
+		return ""
+	}
+	pkgPath := ""
+	referenced := false
+	for _, rootfile := range c.Rootfiles {
+		if rootfile.MediaType != mediaTypeOpf {
+			continue
+		}
+		referenced = true
+		if _, ok := v.files[rootfile.FullPath]; !ok {
+			v.add(SeverityError, CheckContainer, containerPath, 0, "package document %q not found", rootfile.FullPath)
+			continue
+		}
+		if pkgPath == "" {
+			pkgPath = rootfile.FullPath
+		}
+	}
+	if !referenced {
+		v.add(SeverityError, CheckContainer, containerPath, 0, "no package document referenced")
+	}
+	return pkgPath
+}
+
+// validateMetadata checks the metadata of the package document
+func (v *validator) validateMetadata(pkgPath string, p *readPkg) {
+	if first(p.Metadata.Titles) == "" {
+		v.add(SeverityError, CheckPackage, pkgPath, 0, "title missing")
+	}
+	if lang := first(p.Metadata.Languages); lang == "" {
+		v.add(SeverityError, CheckPackage, pkgPath, 0, "language missing")
+	} else if !langTagRegex.MatchString(lang) {
+		v.add(SeverityError, CheckLang, pkgPath, 0, "invalid language tag %q", lang)
+	}
+	uniqueIdentifier := false
+	for _, identifier := range p.Metadata.Identifiers {
+		if identifier.ID == p.UniqueIdentifier && strings.TrimSpace(identifier.Data) != "" {
+			uniqueIdentifier = true
+		}
+	}
+	if !uniqueIdentifier {
+		v.add(SeverityError, CheckPackage, pkgPath, 0, "unique identifier %q missing", p.UniqueIdentifier)
+	}
+	if strings.HasPrefix(p.Version, "3.") && p.Metadata.metadata(p.UniqueIdentifier).Modified == "" {
+		v.add(SeverityError, CheckPackage, pkgPath, 0, "%s missing", pkgModifiedProperty)
+	}
+}
+
+// validateManifest checks the manifest and returns its items, by ID
+func (v *validator) validateManifest(pkgPath string, p *readPkg) map[string]pkgItem {
+	items := make(map[string]pkgItem)
+	hrefs := make(map[string]bool)
+	manifested := map[string]bool{pkgPath: true}
+	navFound := false
+	for _, item := range p.ManifestItems {
+		switch {
+		case item.ID == "":
+			v.add(SeverityError, CheckManifest, pkgPath, 0, "item %q without an ID", item.Href)
+		case hasItem(items, item.ID):
+			v.add(SeverityError, CheckDuplicateID, pkgPath, 0, "item ID %q used more than once", item.ID)
+		default:
+			items[item.ID] = item
+		}
+		if item.MediaType == "" {
+			v.add(SeverityError, CheckManifest, pkgPath, 0, "item %q without a media type", item.Href)
+		}
+		if hasProperty(item.Properties, readerNavProperty) {
+			navFound = true
+		}
+		if item.Href == "" || isRemoteLink(item.Href) {
+			continue
+		}
+		if strings.Contains(item.Href, `\`) {
+			v.add(SeverityError, CheckManifest, pkgPath, 0, "item %q uses backslashes in its path", item.Href)
+		}
+		itemPath, _ := splitFragment(resolveHref(pkgPath, item.Href))
+		if hrefs[itemPath] {
+			v.add(SeverityError, CheckManifest, pkgPath, 0, "file %q listed more than once", itemPath)
+		}
+		hrefs[itemPath] = true
+		manifested[itemPath] = true
+		if _, ok := v.files[itemPath]; !ok {
+			v.add(SeverityError, CheckManifest, pkgPath, 0, "file %q listed in the manifest not found", itemPath)
+			continue
+		}
+		if item.MediaType == mediaTypeXhtml || item.MediaType == mediaTypeNcx {
+			v.validateXML(itemPath)
+		}
+	}
+	if strings.HasPrefix(p.Version, "3.") && !navFound {
+		v.add(SeverityError, CheckManifest, pkgPath, 0, "nav document missing")
+	}
+
+	var unlisted []string
+	for name := range v.files {
+		if name == mimetypeFilename || strings.HasPrefix(name, metaInfFolderName+"/") || strings.HasSuffix(name, "/") || manifested[name] {
+			continue
+		}
+		unlisted = append(unlisted, name)
+	}
+	sort.Strings(unlisted)
+	for _, name := range unlisted {
+		v.add(SeverityWarning, CheckManifest, name, 0, "file not listed in the manifest")
+	}
+	return items
+}
+
+// validateSpine checks the spine, given the items of the manifest by ID
+func (v *validator) validateSpine(pkgPath string, p *readPkg, items map[string]pkgItem) {
+	if len(p.Spine.Items) == 0 {
+		v.add(SeverityError, CheckSpine, pkgPath, 0, "spine empty")
+	}
+	referenced := make(map[string]bool)
+	for _, itemref := range p.Spine.Items {
+		if _, ok := items[itemref.Idref]; !ok {
+			v.add(SeverityError, CheckSpine, pkgPath, 0, "spine item %q not in the manifest", itemref.Idref)
+			continue
+		}
+		if referenced[itemref.Idref] {
+			v.add(SeverityError, CheckSpine, pkgPath, 0, "spine item %q listed more than once", itemref.Idref)
+		}
+		if !fallsBackToContentDocument(itemref.Idref, items) {
+			v.add(SeverityError, CheckSpine, pkgPath, 0, "spine item %q isn't a content document and has no fallback to one", itemref.Idref)
+		}
+		referenced[itemref.Idref] = true
+	}
+	switch ncx, ok := items[p.Spine.Toc]; {
+	case p.Spine.Toc != "" && !ok:
+		v.add(SeverityError, CheckSpine, pkgPath, 0, "NCX document %q not in the manifest", p.Spine.Toc)
+	case p.Spine.Toc != "" && ncx.MediaType != mediaTypeNcx:
+		v.add(SeverityError, CheckSpine, pkgPath, 0, "item %q referenced as the NCX document isn't one", p.Spine.Toc)
+	case p.Spine.Toc == "" && strings.HasPrefix(p.Version, "2."):
+		v.add(SeverityError, CheckSpine, pkgPath, 0, "NCX document missing")
+	}
+}
+
+// fallsBackToContentDocument returns whether the item with the ID is an XHTML
+// or SVG content document, or falls back to one
+func fallsBackToContentDocument(id string, items map[string]pkgItem) bool {
+	visited := make(map[string]bool)
+	for item, ok := items[id]; ok && !visited[id]; item, ok = items[id] {
+		if item.MediaType == mediaTypeXhtml || item.MediaType == mediaTypeSvg {
+			return true
+		}
+		visited[id] = true
+		id = item.Fallback
+	}
+	return false
+}
+
+// validateXML checks that the XML file at the path inside the EPUB is
+// well-formed and that its IDs are unique, and returns its content. It returns
+// false if the file can't be read or isn't well-formed. The IDs and the links
+// of the file are kept for validateFragments.
+func (v *validator) validateXML(name string) ([]byte, bool) {
+	content, err := v.readFile(name)
+	if err != nil {
+		v.add(SeverityError, CheckXHTML, name, 0, "unable to read file: %s", err)
+		return nil, false
+	}
+	ids := make(map[string]bool)
+	v.ids[name] = ids
+	d := xml.NewDecoder(bytes.NewReader(content))
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return content, true
+		}
+		if err != nil {
+			line := 0
+			var syntaxErr *xml.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				line = syntaxErr.Line
+			}
+			v.add(SeverityError, CheckXHTML, name, line, "not well-formed: %s", err)
+			return content, false
+		}
+		start, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, attr := range start.Attr {
+			// The links of the XHTML documents, including the nav document,
+			// and of the NCX document (<content src="...">)
+			if attr.Name.Local == "href" || (attr.Name.Local == "src" && start.Name.Local == "content") {
+				line, _ := d.InputPos()
+				v.links = append(v.links, validatorLink{name: name, line: line, href: attr.Value})
+			}
+			if attr.Name.Local != "id" || (attr.Name.Space != "" && attr.Name.Space != "xml") {
+				continue
+			}
+			if ids[attr.Value] {
+				line, _ := d.InputPos()
+				v.add(SeverityError, CheckDuplicateID, name, line, "ID %q used more than once", attr.Value)
+			}
+			ids[attr.Value] = true
+		}
+	}
+}
+
+// validateFragments checks that the fragments of the links of the XML files
+// that were checked match an ID of the linked file. Links to files that weren't
+// checked (e.g. images) are ignored.
+func (v *validator) validateFragments() {
+	for _, link := range v.links {
+		if isRemoteLink(link.href) {
+			continue
+		}
+		linkPath, fragment := splitFragment(resolveHref(link.name, link.href))
+		if fragment == "" || strings.HasPrefix(fragment, "epubcfi(") {
+			continue
+		}
+		ids, ok := v.ids[linkPath]
+		if !ok {
+			continue
+		}
+		if !ids[fragment] {
+			v.add(SeverityError, CheckFragment, link.name, link.line, "fragment %q of link %q not found in %s", fragment, link.href, linkPath)
+		}
+	}
+}
+
+// hasItem returns whether the manifest items contain the ID
+func hasItem(items map[string]pkgItem, id string) bool {
+	_, ok := items[id]
+	return ok
+}
+
+// readFile returns the content of the file at the path inside the EPUB
+func (v *validator) readFile(name string) ([]byte, error) {
+	f, ok := v.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
@@ -0,0 +1,232 @@
+package epub
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	section, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	if _, err := e.AddSubSection(section, testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Error adding subsection: %s", err)
+	}
+	findings, err := e.Validate()
+	if err != nil {
+		t.Fatalf("Unexpected error validating EPUB: %s", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("Got findings %v, expected none", findings)
+	}
+
+	tempDir := t.TempDir()
+	epubPath := filepath.Join(tempDir, testEpubFilename)
+	if err := e.Write(epubPath); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	findings, err = ValidateFile(epubPath)
+	if err != nil {
+		t.Fatalf("Unexpected error validating EPUB file: %s", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("Got findings %v, expected none", findings)
+	}
+}
+
+func TestValidateFindings(t *testing.T) {
+	const container = `<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`
+	const metadata = `<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:uuid:1234</dc:identifier>
+    <dc:title>Title</dc:title>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">2020-01-01T00:00:00Z</meta>
+  </metadata>`
+	pkg := func(manifest string, spine string) string {
+		return `<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">` + metadata + `
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>` + manifest + `
+  </manifest>
+  <spine>` + spine + `</spine>
+</package>`
+	}
+	const nav = `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Nav</title></head><body/></html>`
+
+	testCases := []struct {
+		name            string
+		files           [][2]string
+		expectedCheck   ValidationCheck
+		expectedMessage string
+	}{
+		{
+			name:            "mimetype missing",
+			files:           [][2]string{{"META-INF/container.xml", container}},
+			expectedCheck:   CheckMimetype,
+			expectedMessage: "mimetype file missing",
+		},
+		{
+			name:            "mimetype not first",
+			files:           [][2]string{{"META-INF/container.xml", container}, {"mimetype", mediaTypeEpub}},
+			expectedCheck:   CheckMimetype,
+			expectedMessage: "not the first file",
+		},
+		{
+			name:            "mimetype compressed",
+			files:           [][2]string{{"mimetype", mediaTypeEpub}},
+			expectedCheck:   CheckMimetype,
+			expectedMessage: "compressed",
+		},
+		{
+			name:            "container missing",
+			files:           [][2]string{{"mimetype", mediaTypeEpub}},
+			expectedCheck:   CheckContainer,
+			expectedMessage: "META-INF/container.xml missing",
+		},
+		{
+			name:            "package document not found",
+			files:           [][2]string{{"mimetype", mediaTypeEpub}, {"META-INF/container.xml", container}},
+			expectedCheck:   CheckContainer,
+			expectedMessage: `package document "content.opf" not found`,
+		},
+		{
+			name: "metadata missing",
+			files: [][2]string{
+				{"META-INF/container.xml", container},
+				{"content.opf", `<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id"><metadata/></package>`},
+			},
+			expectedCheck:   CheckPackage,
+			expectedMessage: "title missing",
+		},
+		{
+			name: "manifest file missing",
+			files: [][2]string{
+				{"META-INF/container.xml", container},
+				{"content.opf", pkg(`<item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>`, `<itemref idref="ch1"/>`)},
+				{"nav.xhtml", nav},
+			},
+			expectedCheck:   CheckManifest,
+			expectedMessage: `file "ch1.xhtml" listed in the manifest not found`,
+		},
+		{
+			name: "file not in manifest",
+			files: [][2]string{
+				{"META-INF/container.xml", container},
+				{"content.opf", pkg("", `<itemref idref="nav"/>`)},
+				{"nav.xhtml", nav},
+				{"extra.css", "p {}"},
+			},
+			expectedCheck:   CheckManifest,
+			expectedMessage: "file not listed in the manifest",
+		},
+		{
+			name: "nav missing",
+			files: [][2]string{
+				{"META-INF/container.xml", container},
+				{"content.opf", strings.Replace(pkg("", `<itemref idref="nav"/>`), ` properties="nav"`, "", 1)},
+				{"nav.xhtml", nav},
+			},
+			expectedCheck:   CheckManifest,
+			expectedMessage: "nav document missing",
+		},
+		{
+			name: "spine item not in the manifest",
+			files: [][2]string{
+				{"META-INF/container.xml", container},
+				{"content.opf", pkg("", `<itemref idref="ch1"/>`)},
+				{"nav.xhtml", nav},
+			},
+			expectedCheck:   CheckSpine,
+			expectedMessage: `spine item "ch1" not in the manifest`,
+		},
+		{
+			name: "spine item without fallback",
+			files: [][2]string{
+				{"META-INF/container.xml", container},
+				{"content.opf", pkg(`<item id="track" href="track.mp3" media-type="audio/mpeg"/>`, `<itemref idref="track"/>`)},
+				{"nav.xhtml", nav},
+				{"track.mp3", "ID3"},
+			},
+			expectedCheck:   CheckSpine,
+			expectedMessage: `spine item "track" isn't a content document and has no fallback to one`,
+		},
+		{
+			name: "duplicate item ID",
+			files: [][2]string{
+				{"META-INF/container.xml", container},
+				{"content.opf", pkg(`<item id="nav" href="other.xhtml" media-type="application/xhtml+xml"/>`, `<itemref idref="nav"/>`)},
+				{"nav.xhtml", nav},
+				{"other.xhtml", nav},
+			},
+			expectedCheck:   CheckDuplicateID,
+			expectedMessage: `item ID "nav" used more than once`,
+		},
+		{
+			name: "duplicate XHTML ID",
+			files: [][2]string{
+				{"META-INF/container.xml", container},
+				{"content.opf", pkg(`<item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>`, `<itemref idref="ch1"/>`)},
+				{"nav.xhtml", nav},
+				{"ch1.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>1</title></head><body><p id="a"/><p id="a"/></body></html>`},
+			},
+			expectedCheck:   CheckDuplicateID,
+			expectedMessage: `ID "a" used more than once`,
+		},
+		{
+			name: "XHTML not well-formed",
+			files: [][2]string{
+				{"META-INF/container.xml", container},
+				{"content.opf", pkg(`<item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>`, `<itemref idref="ch1"/>`)},
+				{"nav.xhtml", nav},
+				{"ch1.xhtml", "<html xmlns=\"http://www.w3.org/1999/xhtml\">\n<body><p>Unclosed</body></html>"},
+			},
+			expectedCheck:   CheckXHTML,
+			expectedMessage: "not well-formed",
+		},
+		{
+			name: "dead fragment",
+			files: [][2]string{
+				{"META-INF/container.xml", container},
+				{"content.opf", pkg(`<item id="ch1" href="text/ch1.xhtml" media-type="application/xhtml+xml"/>`, `<itemref idref="ch1"/>`)},
+				{"nav.xhtml", nav},
+				{"text/ch1.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>1</title></head><body><p id="a"><a href="#a">Found</a> <a href="ch1.xhtml#b">Dead</a></p></body></html>`},
+			},
+			expectedCheck:   CheckFragment,
+			expectedMessage: `fragment "b" of link "ch1.xhtml#b" not found in text/ch1.xhtml`,
+		},
+		{
+			name: "dead fragment in the table of contents",
+			files: [][2]string{
+				{"META-INF/container.xml", container},
+				{"content.opf", pkg(`<item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>`, `<itemref idref="ch1"/>`)},
+				{"nav.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Nav</title></head><body><nav><ol><li><a href="ch1.xhtml#part%201">1</a></li></ol></nav></body></html>`},
+				{"ch1.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>1</title></head><body><p id="part1"/></body></html>`},
+			},
+			expectedCheck:   CheckFragment,
+			expectedMessage: `fragment "part 1" of link "ch1.xhtml#part%201" not found in ch1.xhtml`,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			b := zipTestFiles(t, testCase.files)
+			findings, err := Validate(bytes.NewReader(b.Bytes()), int64(b.Len()))
+			if err != nil {
+				t.Fatalf("Unexpected error validating EPUB: %s", err)
+			}
+			for _, finding := range findings {
+				if finding.Check == testCase.expectedCheck && strings.Contains(finding.Message, testCase.expectedMessage) {
+					return
+				}
+			}
+			t.Errorf("Got findings %v, expected a %s finding containing %q", findings, testCase.expectedCheck, testCase.expectedMessage)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package epub
+
+import "fmt"
+
+// WarningType is the kind of problem a Warning is about.
+type WarningType int
+
+const (
+	// WarningRenamed is the type of the warnings about files given another
+	// filename than the one expected because it was already used, e.g. an image
+	// added without a filename whose source has the filename of another image
+	WarningRenamed WarningType = iota
+	// WarningMediaSkipped is the type of the warnings about media that couldn't
+	// be retrieved during Write and was left out or replaced by a placeholder
+	// (see SetMediaFailurePolicy)
+	WarningMediaSkipped
+	// WarningIDSanitized is the type of the warnings about IDs of the package
+	// document that differ from the filename they're derived from, in order to
+	// be valid XML IDs (see SanitizeXMLID)
+	WarningIDSanitized
+	// WarningExtensionMismatch is the type of the warnings about media whose
+	// extension doesn't match their media type (see CheckMediaExtensions)
+	WarningExtensionMismatch
+	// WarningKindleUnsupported is the type of the warnings about features
+	// that Kindle doesn't support, which are left out or changed in Kindle
+	// compatibility mode (see SetKindleCompatibility)
+	WarningKindleUnsupported
+	// WarningUnresolvedReference is the type of the warnings about
+	// cross-references that don't match a numbered figure or table (see
+	// SetFigureNumbering)
+	WarningUnresolvedReference
+)
+
+// Warning is a non-fatal problem found while building or writing the EPUB,
+// about something that was done differently than requested. See Warnings.
+type Warning struct {
+	Type    WarningType
+	Path    string // The path of the file inside the EPUB, e.g. EPUB/images/image0001.png
+	Message string
+}
+
+// String returns the warning as a single line, e.g.
+// EPUB/images/image0002.png: filename image.png already used
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Path, w.Message)
+}
+
+// Warnings returns the warnings of the EPUB so far, in the order they
+// happened, so that they can be logged or shown to users. Warnings aren't
+// repeated, e.g. when the EPUB is written more than once.
+func (e *Epub) Warnings() []Warning {
+	e.Lock()
+	defer e.Unlock()
+	return append([]Warning(nil), e.warnings...)
+}
+
+// addWarning adds a warning about the file at the path inside the EPUB, unless
+// the same warning was already added
+func (e *Epub) addWarning(warningType WarningType, name string, format string, a ...interface{}) {
+	w := Warning{Type: warningType, Path: name, Message: fmt.Sprintf(format, a...)}
+	for _, existing := range e.warnings {
+		if existing == w {
+			return
+		}
+	}
+	e.warnings = append(e.warnings, w)
+}
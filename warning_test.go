@@ -0,0 +1,69 @@
+package epub
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWarnings(t *testing.T) {
+	image, err := os.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading image: %s", err)
+	}
+	tempDir := t.TempDir()
+	missingImagePath := filepath.Join(tempDir, "missing.png")
+	if err := os.WriteFile(missingImagePath, image, 0644); err != nil {
+		t.Fatalf("Unexpected error writing image: %s", err)
+	}
+
+	e := NewEpub(testEpubTitle)
+	e.SetMediaFailurePolicy(MediaFailureSkip)
+	if _, err := e.AddImage(testImageFromFileSource, ""); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	// Another source with the same filename
+	if _, err := e.AddImage("testdata/../"+testImageFromFileSource, ""); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	if _, err := e.AddImage("./"+testImageFromFileSource, "1.png"); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	if _, err := e.AddImage(missingImagePath, ""); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	if err := os.Remove(missingImagePath); err != nil {
+		t.Fatalf("Unexpected error removing image: %s", err)
+	}
+	if len(e.Warnings()) != 1 {
+		t.Errorf("Got warnings %v, expected only the renamed image before writing", e.Warnings())
+	}
+
+	// The warnings of the write aren't repeated
+	for i := 0; i < 2; i++ {
+		if _, err := e.WriteTo(&bytes.Buffer{}); err != nil {
+			t.Fatalf("Unexpected error writing EPUB: %s", err)
+		}
+	}
+
+	var got []WarningType
+	for _, w := range e.Warnings() {
+		got = append(got, w.Type)
+	}
+	expected := []WarningType{WarningRenamed, WarningIDSanitized, WarningMediaSkipped}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Got warnings %v, expected types %v", e.Warnings(), expected)
+	}
+	warnings := e.Warnings()
+	if warnings[0].Path != "EPUB/images/image0002.png" || warnings[0].String() != "EPUB/images/image0002.png: filename gophercolor16x16.png already used" {
+		t.Errorf("Got warning %q for the renamed image", warnings[0])
+	}
+	if warnings[1].Path != "EPUB/images/1.png" {
+		t.Errorf("Got path %s for the sanitized ID, expected EPUB/images/1.png", warnings[1].Path)
+	}
+	if warnings[2].Path != "EPUB/images/missing.png" {
+		t.Errorf("Got path %s for the skipped image, expected EPUB/images/missing.png", warnings[2].Path)
+	}
+}
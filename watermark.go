@@ -0,0 +1,99 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	colophonType = "colophon"
+	// Element with the identifier of a watermark hidden in each section
+	watermarkIDFormat = `<span hidden="hidden" data-watermark="%s"></span>
+`
+	// Paragraph with the text of a watermark added to the colophon
+	watermarkTextFormat = `<p class="watermark">%s</p>
+`
+)
+
+// Watermark personalizes a copy of the EPUB for a buyer (see
+// WriteWatermarked), which is known as social DRM: it deters sharing the copy
+// rather than prevents it.
+type Watermark struct {
+	// Line of plain text added to the colophon, e.g. "This copy was sold to
+	// Jane Doe", or an empty string to only hide the identifier
+	Text string
+	// Identifier of the buyer or the transaction, hidden in each section
+	ID string
+}
+
+// WriteWatermarked writes the EPUB to dst like WriteContext, with the watermark
+// added to the sections, so that a store can write a personalized copy for each
+// buyer without changing the EPUB. The text of the watermark is added to the
+// end of the colophon (the section with the colophon epub:type, see
+// SectionOptions), or to the end of the last section if there's none. The
+// identifier is hidden in each section.
+func (e *Epub) WriteWatermarked(ctx context.Context, dst io.Writer, watermark Watermark) (int64, error) {
+	e.Lock()
+	defer e.Unlock()
+	e.watermark = &watermark
+	defer func() { e.watermark = nil }()
+	return e.writeContext(ctx, dst)
+}
+
+// watermarkFileWriter returns an epubFileWriter that adds the watermark to the
+// sections
+func (e *Epub) watermarkFileWriter(w epubFileWriter) epubFileWriter {
+	colophon := e.watermarkColophon()
+	hiddenID := fmt.Sprintf(watermarkIDFormat, html.EscapeString(e.watermark.ID))
+	text := ""
+	if e.watermark.Text != "" {
+		text = fmt.Sprintf(watermarkTextFormat, html.EscapeString(e.watermark.Text))
+	}
+	return func(name string, mediaType string, content []byte) error {
+		if mediaType == mediaTypeXhtml {
+			mark := hiddenID
+			if name == path.Join(contentFolderName, xhtmlFolderName, colophon) {
+				mark = text + hiddenID
+			}
+			content = watermarkSection(content, mark)
+		}
+		return w(name, mediaType, content)
+	}
+}
+
+// watermarkColophon returns the filename of the section the text of the
+// watermark is added to: the colophon, or the last section of the reading order
+func (e *Epub) watermarkColophon() string {
+	last := ""
+	colophon := ""
+	e.forEachSection(func(s *epubSection) {
+		if colophon == "" && strings.Contains(" "+s.xhtml.xml.Body.EpubType+" ", " "+colophonType+" ") {
+			colophon = s.filename
+		}
+		if !s.auxiliary && !s.nonLinear {
+			last = s.filename
+		}
+	})
+	if colophon != "" {
+		return colophon
+	}
+	return last
+}
+
+// watermarkSection returns the content of the XHTML file of a section with the
+// mark added to the end of its body
+func watermarkSection(content []byte, mark string) []byte {
+	i := bytes.LastIndex(content, []byte("</body>"))
+	if i == -1 {
+		return content
+	}
+	marked := make([]byte, 0, len(content)+len(mark))
+	marked = append(marked, content[:i]...)
+	marked = append(marked, mark...)
+	return append(marked, content[i:]...)
+}
@@ -0,0 +1,85 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// readWatermarked returns the sections of the EPUB written with the watermark
+func readWatermarked(t *testing.T, e *Epub, watermark Watermark, filenames ...string) map[string]string {
+	t.Helper()
+	var b bytes.Buffer
+	if _, err := e.WriteWatermarked(context.Background(), &b, watermark); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	r, err := NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	sections := make(map[string]string)
+	for _, filename := range filenames {
+		content, err := r.ReadFile("EPUB/xhtml/" + filename)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		sections[filename] = string(content)
+	}
+	return sections
+}
+
+func TestWriteWatermarked(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "chapter.xhtml", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSectionWithOptions("<p>Colophon</p>", SectionOptions{Filename: "colophon.xhtml", EpubType: "backmatter colophon"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "last.xhtml", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	text := `<p class="watermark">Sold to Jane &lt;jane@example.com&gt;</p>`
+	hiddenID := `<span hidden="hidden" data-watermark="order-42&amp;1"></span>`
+	sections := readWatermarked(t, e, Watermark{Text: "Sold to Jane <jane@example.com>", ID: "order-42&1"}, "chapter.xhtml", "colophon.xhtml", "last.xhtml")
+	for filename, content := range sections {
+		if !strings.Contains(content, hiddenID+"\n</body>") {
+			t.Errorf("%s doesn't contain the identifier:\n%s", filename, content)
+		}
+		if strings.Contains(content, text) != (filename == "colophon.xhtml") {
+			t.Errorf("Unexpected text of the watermark in %s:\n%s", filename, content)
+		}
+	}
+
+	// The EPUB isn't changed
+	r := newTestReader(t, e)
+	content, err := r.ReadFile("EPUB/xhtml/colophon.xhtml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(string(content), "watermark") {
+		t.Errorf("Watermark written by WriteTo:\n%s", content)
+	}
+}
+
+func TestWriteWatermarkedNoColophon(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "chapter.xhtml", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSection(testSectionBody, testSectionTitle, "last.xhtml", ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := e.AddSectionWithOptions(testSectionBody, SectionOptions{Filename: "notes.xhtml", NonLinear: true}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	sections := readWatermarked(t, e, Watermark{Text: "Sold to Jane", ID: "order-42"}, "chapter.xhtml", "last.xhtml", "notes.xhtml")
+	for filename, content := range sections {
+		if strings.Contains(content, "Sold to Jane") != (filename == "last.xhtml") {
+			t.Errorf("Unexpected text of the watermark in %s:\n%s", filename, content)
+		}
+	}
+}
@@ -2,15 +2,29 @@ package epub
 
 import (
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
-	"unicode"
-	"unicode/utf8"
+	"sort"
+	"strings"
+	"sync/atomic"
 
+	"github.com/bmaupin/go-epub/internal/storage"
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/gofrs/uuid"
+	// Registers the WebP format with the image package for convertImage
+	_ "golang.org/x/image/webp"
 )
 
 // UnableToCreateEpubError is thrown by Write if it cannot create the destination EPUB file
@@ -23,6 +37,39 @@ func (e *UnableToCreateEpubError) Error() string {
 	return fmt.Sprintf("Error creating EPUB at %q: %+v", e.Path, e.Err)
 }
 
+// StorageError is returned by Write if the files of the EPUB can't be stored in
+// the temporary storage used to build it (see Use).
+type StorageError struct {
+	Path string // The path in the storage that caused the error
+	Err  error  // The underlying error that was thrown
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("Error accessing %q in the temporary storage: %+v", e.Path, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// MediaFailurePolicy defines how Write handles media that can't be retrieved,
+// e.g. because the source disappeared or the write timeout has been reached.
+type MediaFailurePolicy int
+
+const (
+	// MediaFailureError makes Write return a FileRetrievalError (default)
+	MediaFailureError MediaFailurePolicy = iota
+	// MediaFailureSkip leaves the media out of the EPUB. The links to the media
+	// are kept, and each section or CSS file linking to it gets a warning (see
+	// Warnings).
+	MediaFailureSkip
+	// MediaFailurePlaceholder replaces images with a blank placeholder PNG
+	// image, renamed with the .png extension if needed, e.g. image.jpg becomes
+	// image.png, and the links to the images are updated. Other media is left
+	// out of the EPUB as with MediaFailureSkip.
+	MediaFailurePlaceholder
+)
+
 const (
 	containerFilename     = "container.xml"
 	containerFileTemplate = `<?xml version="1.0" encoding="UTF-8"?>
@@ -34,101 +81,293 @@ const (
 `
 	// This seems to be the standard based on the latest EPUB spec:
 	// http://www.idpf.org/epub/31/spec/epub-ocf.html
-	contentFolderName    = "EPUB"
+	contentFolderName = "EPUB"
+	// Quality of the JPEG images converted from other formats
+	convertedJpegQuality = 90
 	coverImageProperties = "cover-image"
 	// Permissions for any new directories we create
 	dirPermissions = 0755
 	// Permissions for any new files we create
 	filePermissions   = 0644
+	mediaTypeAvif     = "image/avif"
 	mediaTypeCSS      = "text/css"
 	mediaTypeEpub     = "application/epub+zip"
 	mediaTypeJpeg     = "image/jpeg"
 	mediaTypeNcx      = "application/x-dtbncx+xml"
+	mediaTypeOpf      = "application/oebps-package+xml"
+	mediaTypePng      = "image/png"
+	mediaTypeSvg      = "image/svg+xml"
+	mediaTypeWebp     = "image/webp"
 	mediaTypeXhtml    = "application/xhtml+xml"
 	metaInfFolderName = "META-INF"
 	mimetypeFilename  = "mimetype"
 	pkgFilename       = "package.opf"
-	tempDirPrefix     = "go-epub"
-	xhtmlFolderName   = "xhtml"
+	// Number of bytes from the beginning of streamed media used to detect its
+	// media type, which is the default read limit of the mimetype package
+	mediaTypeDetectionLimit = 3072
+	// Format of the IDs of the manifest items of the files added by AddRawFile
+	rawFileItemIDFormat = "file%04d"
+	// Format of the IDs of the manifest items of remote media
+	remoteMediaItemIDFormat   = "remote%04d"
+	remoteResourcesProperties = "remote-resources"
+	tempDirPrefix             = "go-epub"
+	xhtmlFolderName           = "xhtml"
 )
 
 // WriteTo the dest io.Writer. The return value is the number of bytes written. Any error encountered during the write is also returned.
+//
+// The EPUB can be written several times, e.g. to write a new version each time
+// sections are added. Apart from the modification date in the package file,
+// writing an EPUB that hasn't changed produces the same files.
 func (e *Epub) WriteTo(dst io.Writer) (int64, error) {
+	return e.WriteContext(context.Background(), dst)
+}
+
+// WriteContext writes the EPUB to dst like WriteTo, but stops as soon as ctx is
+// done, e.g. when the client of an HTTP handler generating the EPUB on demand
+// disconnects. Media still being retrieved is abandoned and an error wrapping
+// ctx.Err() is returned, whatever the media failure policy.
+func (e *Epub) WriteContext(ctx context.Context, dst io.Writer) (int64, error) {
 	e.Lock()
 	defer e.Unlock()
-	tempDir := uuid.Must(uuid.NewV4()).String()
+	return e.writeContext(ctx, dst)
+}
 
-	err := filesystem.Mkdir(tempDir, dirPermissions)
+func (e *Epub) writeContext(ctx context.Context, dst io.Writer) (n int64, err error) {
+	fetchCtx, g, orphans, done, err := e.prepareWrite(ctx)
 	if err != nil {
-		panic(fmt.Sprintf("Error creating temp directory: %s", err))
+		return 0, err
+	}
+	defer done()
+
+	if e.writesDirectly() {
+		return e.writeDirect(ctx, fetchCtx, g, dst, orphans)
+	}
+
+	tempDir := uuid.Must(uuid.NewV4()).String()
+
+	if err := e.filesystem.Mkdir(tempDir, dirPermissions); err != nil {
+		return 0, &StorageError{Path: tempDir, Err: err}
 	}
 	defer func() {
-		if err := filesystem.RemoveAll(tempDir); err != nil {
-			panic(fmt.Sprintf("Error removing temp directory: %s", err))
+		// The EPUB has been written even if the temp directory can't be
+		// removed, but the error is still reported
+		if removeErr := e.filesystem.RemoveAll(tempDir); removeErr != nil && err == nil {
+			err = &StorageError{Path: tempDir, Err: removeErr}
 		}
 	}()
-	writeMimetype(tempDir)
-	createEpubFolders(tempDir)
+
+	// Media added several times from the same URL is only downloaded once
+	g.fetches = &fetchGroup{}
+
+	w := stagingFileWriter(e.filesystem, tempDir)
+
+	if err := createEpubFolders(e.filesystem, tempDir); err != nil {
+		return 0, err
+	}
+	if err := writeMimetype(w); err != nil {
+		return 0, err
+	}
+
+	// Must be called after:
+	// createEpubFolders()
+	if err := writeContainerFile(w); err != nil {
+		return 0, err
+	}
+	if err := e.writeOCFFiles(w); err != nil {
+		return 0, err
+	}
+
+	e.progress.start(WriteStageFetchingMedia, e.fetchedMediaCount(orphans))
 
 	// Must be called after:
 	// createEpubFolders()
-	writeContainerFile(tempDir)
+	err = e.writeMetaInfFiles(fetchCtx, g, tempDir)
+	if err != nil {
+		return 0, err
+	}
 
 	// Must be called after:
 	// createEpubFolders()
-	err = e.writeCSSFiles(tempDir)
+	err = e.writeCSSFiles(fetchCtx, g, tempDir, orphans)
 	if err != nil {
 		return 0, err
 	}
 
 	// Must be called after:
 	// createEpubFolders()
-	err = e.writeFonts(tempDir)
+	err = e.writeFonts(fetchCtx, g, tempDir, orphans)
 	if err != nil {
 		return 0, err
 	}
 
 	// Must be called after:
 	// createEpubFolders()
-	err = e.writeImages(tempDir)
+	err = e.writeImages(fetchCtx, g, tempDir, orphans)
 	if err != nil {
 		return 0, err
 	}
 
 	// Must be called after:
 	// createEpubFolders()
-	err = e.writeVideos(tempDir)
+	err = e.writeVideos(fetchCtx, g, tempDir, orphans)
 	if err != nil {
 		return 0, err
 	}
 
 	// Must be called after:
 	// createEpubFolders()
-	err = e.writeAudios(tempDir)
+	err = e.writeAudios(fetchCtx, g, tempDir, orphans)
+	if err != nil {
+		return 0, err
+	}
+
+	// Must be called after:
+	// writeCSSFiles()
+	// writeImages()
+	err = e.writeRenamedMediaCSSFiles(tempDir)
 	if err != nil {
 		return 0, err
 	}
 
 	// Must be called after:
 	// createEpubFolders()
-	e.writeSections(tempDir)
+	err = e.writeRawFiles(fetchCtx, g, tempDir)
+	if err != nil {
+		return 0, err
+	}
+
+	// Media that couldn't be retrieved because the write was canceled may
+	// have been skipped
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	e.writeRemoteMedia()
 
 	// Must be called after:
 	// createEpubFolders()
-	// writeSections()
-	e.writeToc(tempDir)
+	err = e.writeSections(w)
+	if err != nil {
+		return 0, err
+	}
 
 	// Must be called after:
 	// createEpubFolders()
-	// writeCSSFiles()
-	// writeImages()
-	// writeVideos()
-	// writeAudios()
 	// writeSections()
-	// writeToc()
-	e.writePackageFile(tempDir)
-	// Must be called last
-	return e.writeEpub(tempDir, dst)
+	err = e.writeToc(w)
+	if err != nil {
+		return 0, err
+	}
+
+	// Must be called last, writes the package file once the streamed media
+	// has been added to the manifest
+	return e.writeEpub(ctx, fetchCtx, g, tempDir, dst, orphans)
+}
+
+// WriteUnpacked writes the files of the EPUB to a directory of the local
+// filesystem without zipping them, e.g. to debug, diff or serve an unpacked
+// EPUB. The directory, which is created if needed, ends up with the mimetype
+// file and the META-INF and EPUB folders. Existing files with the same paths are
+// overwritten.
+func (e *Epub) WriteUnpacked(destDir string) error {
+	e.Lock()
+	defer e.Unlock()
+
+	ctx := context.Background()
+	fetchCtx, g, orphans, done, err := e.prepareWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if err := os.MkdirAll(destDir, dirPermissions); err != nil {
+		return &UnableToCreateEpubError{
+			Path: destDir,
+			Err:  err,
+		}
+	}
+	return e.writeDirectFiles(ctx, fetchCtx, g, dirSink{dir: destDir}, orphans)
+}
+
+// prepareWrite prepares a write of the EPUB. It returns the context bounding the
+// retrieval of the media, the grabber retrieving them and the orphaned media
+// left out of the EPUB, along with a function to call once the write is done.
+func (e *Epub) prepareWrite(ctx context.Context) (context.Context, grabber, map[string]bool, func(), error) {
+	if e.initErr != nil {
+		return nil, grabber{}, nil, nil, e.initErr
+	}
+	if e.strict {
+		if findings := e.strictFindings(); len(findings) > 0 {
+			return nil, grabber{}, nil, nil, &StrictModeError{Findings: findings}
+		}
+	}
+
+	// Remote media still being retrieved once the write timeout is reached
+	// are handled according to the media failure policy
+	fetchCtx, cancel := ctx, context.CancelFunc(func() {})
+	if e.writeTimeout > 0 {
+		fetchCtx, cancel = context.WithTimeout(ctx, e.writeTimeout)
+	}
+
+	// Media that isn't referenced by any section is left out if requested
+	orphans := map[string]bool{}
+	if e.dropOrphanedMedia {
+		var err error
+		orphans, err = e.orphanedMedia(fetchCtx)
+		if err != nil {
+			cancel()
+			return nil, grabber{}, nil, nil, err
+		}
+	}
+
+	// Kindle compatibility mode leaves out the audio and video
+	if err := e.prepareKindleWrite(fetchCtx, orphans); err != nil {
+		cancel()
+		return nil, grabber{}, nil, nil, err
+	}
+
+	// The backlinks of the bibliographies and the notes depend on the other
+	// sections
+	e.prepareBibliographies()
+	e.prepareNotes()
+
+	e.progress = newWriteProgressTracker(e.progressFunc, e.logger)
+	e.renamedMedia = make(map[string]string)
+	e.debug("writing EPUB", "sections", e.sectionCount(), "orphanedMedia", len(orphans))
+
+	// The manifest, the spine and the TOC are built again by each write, so
+	// that writing the EPUB several times produces the same files
+	e.pkg.resetItems()
+	e.toc.resetEntries()
+
+	g := e.grabber()
+	// The total size of the media is limited for each write
+	g.maxTotalSize = e.maxTotalMediaSize
+	g.totalSize = &atomic.Int64{}
+
+	done := func() {
+		cancel()
+		e.progress = nil
+		e.renamedMedia = nil
+	}
+	return fetchCtx, g, orphans, done, nil
+}
+
+// epubFileWriter writes a generated file of the EPUB, given its path relative
+// to the root of the EPUB (e.g. EPUB/package.opf) and its media type
+type epubFileWriter func(name string, mediaType string, content []byte) error
+
+// stagingFileWriter returns an epubFileWriter that writes the files to the
+// temporary directory
+func stagingFileWriter(filesystem storage.Storage, rootEpubDir string) epubFileWriter {
+	return func(name string, mediaType string, content []byte) error {
+		filePath := filepath.Join(rootEpubDir, filepath.FromSlash(name))
+		if err := filesystem.WriteFile(filePath, content, filePermissions); err != nil {
+			return &StorageError{Path: filePath, Err: err}
+		}
+		return nil
+	}
 }
 
 // Write writes the EPUB file. The destination path must be the full path to
@@ -149,35 +388,17 @@ func (e *Epub) Write(destFilePath string) error {
 }
 
 // Create the EPUB folder structure in a temp directory
-func createEpubFolders(rootEpubDir string) {
-	if err := filesystem.Mkdir(
-		filepath.Join(
-			rootEpubDir,
-			contentFolderName,
-		),
-		dirPermissions); err != nil {
-		// No reason this should happen if tempDir creation was successful
-		panic(fmt.Sprintf("Error creating EPUB subdirectory: %s", err))
-	}
-
-	if err := filesystem.Mkdir(
-		filepath.Join(
-			rootEpubDir,
-			contentFolderName,
-			xhtmlFolderName,
-		),
-		dirPermissions); err != nil {
-		panic(fmt.Sprintf("Error creating xhtml subdirectory: %s", err))
-	}
-
-	if err := filesystem.Mkdir(
-		filepath.Join(
-			rootEpubDir,
-			metaInfFolderName,
-		),
-		dirPermissions); err != nil {
-		panic(fmt.Sprintf("Error creating META-INF subdirectory: %s", err))
+func createEpubFolders(filesystem storage.Storage, rootEpubDir string) error {
+	for _, folderPath := range []string{
+		filepath.Join(rootEpubDir, contentFolderName),
+		filepath.Join(rootEpubDir, contentFolderName, xhtmlFolderName),
+		filepath.Join(rootEpubDir, metaInfFolderName),
+	} {
+		if err := filesystem.Mkdir(folderPath, dirPermissions); err != nil {
+			return &StorageError{Path: folderPath, Err: err}
+		}
 	}
+	return nil
 }
 
 // Write the contatiner file (container.xml), which mostly just points to the
@@ -185,10 +406,10 @@ func createEpubFolders(rootEpubDir string) {
 //
 // Sample: https://github.com/bmaupin/epub-samples/blob/master/minimal-v3plus2/META-INF/container.xml
 // Spec: http://www.idpf.org/epub/301/spec/epub-ocf.html#sec-container-metainf-container.xml
-func writeContainerFile(rootEpubDir string) {
-	containerFilePath := filepath.Join(rootEpubDir, metaInfFolderName, containerFilename)
-	if err := filesystem.WriteFile(
-		containerFilePath,
+func writeContainerFile(w epubFileWriter) error {
+	if err := w(
+		path.Join(metaInfFolderName, containerFilename),
+		"",
 		[]byte(
 			fmt.Sprintf(
 				containerFileTemplate,
@@ -196,26 +417,37 @@ func writeContainerFile(rootEpubDir string) {
 				pkgFilename,
 			),
 		),
-		filePermissions,
 	); err != nil {
-		panic(fmt.Sprintf("Error writing container file: %s", err))
+		return fmt.Errorf("error writing container file: %w", err)
 	}
+	return nil
 }
 
-// Write the CSS files to the temporary directory and add them to the package
-// file
-func (e *Epub) writeCSSFiles(rootEpubDir string) error {
-	err := e.writeMedia(rootEpubDir, e.css, CSSFolderName)
-	if err != nil {
-		return err
+// Get the files added by AddMetaInfFile from their source and save them in the
+// META-INF folder of the temporary directory
+func (e *Epub) writeMetaInfFiles(ctx context.Context, g grabber, rootEpubDir string) error {
+	for metaInfPath, source := range e.metaInfFiles {
+		metaInfFilePath := filepath.Join(rootEpubDir, metaInfFolderName, filepath.FromSlash(metaInfPath))
+		if err := storage.MkdirAll(e.filesystem, metaInfFilePath, dirPermissions); err != nil {
+			return fmt.Errorf("unable to create directory: %s", err)
+		}
+		_, err := g.fetchMedia(ctx, source, filepath.Dir(metaInfFilePath), filepath.Base(metaInfFilePath))
+		e.progress.fileDone(path.Join(metaInfFolderName, metaInfPath))
+		if err != nil {
+			if _, err := e.handleMediaFailure(path.Join(metaInfFolderName, metaInfPath), filepath.Dir(metaInfFilePath), filepath.Base(metaInfFilePath), "", err); err != nil {
+				return err
+			}
+		}
 	}
-
-	// Clean up the cover temp file if one was created
-	os.Remove(e.cover.cssTempFile)
-
 	return nil
 }
 
+// Write the CSS files to the temporary directory and add them to the package
+// file
+func (e *Epub) writeCSSFiles(ctx context.Context, g grabber, rootEpubDir string, orphans map[string]bool) error {
+	return e.writeMedia(ctx, g, rootEpubDir, e.css, CSSFolderName, orphans)
+}
+
 // writeCounter counts the number of bytes written to it.
 type writeCounter struct {
 	Total int64 // Total # of bytes written
@@ -229,9 +461,11 @@ func (wc *writeCounter) Write(p []byte) (int, error) {
 	return n, nil
 }
 
-// Write the EPUB file itself by zipping up everything from a temp directory
+// Write the EPUB file itself by zipping up everything from a temp directory,
+// along with the media streamed from its source (see SetStreamMedia)
+// The write stops once ctx is done, fetchCtx bounds the retrieval of the media.
 // The return value is the number of bytes written. Any error encountered during the write is also returned.
-func (e *Epub) writeEpub(rootEpubDir string, dst io.Writer) (int64, error) {
+func (e *Epub) writeEpub(ctx context.Context, fetchCtx context.Context, g grabber, rootEpubDir string, dst io.Writer, orphans map[string]bool) (int64, error) {
 	counter := &writeCounter{}
 	teeWriter := io.MultiWriter(counter, dst)
 
@@ -239,11 +473,20 @@ func (e *Epub) writeEpub(rootEpubDir string, dst io.Writer) (int64, error) {
 
 	skipMimetypeFile := false
 
+	// The media types of the files are used to choose their compression method
+	manifestMediaTypes := make(map[string]string)
+	for _, item := range e.pkg.xml.ManifestItems {
+		manifestMediaTypes[path.Join(contentFolderName, item.Href)] = item.MediaType
+	}
+
 	// addFileToZip adds the file present at path to the zip archive. The path is relative to the rootEpubDir
 	addFileToZip := func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		// Get the path of the file relative to the folder we're zipping
 		relativePath, err := filepath.Rel(rootEpubDir, path)
@@ -274,53 +517,78 @@ func (e *Epub) writeEpub(rootEpubDir string, dst io.Writer) (int64, error) {
 				Method: zip.Store,
 			})
 		} else {
-			w, err = z.Create(relativePath)
+			w, err = z.CreateHeader(&zip.FileHeader{
+				Name:   relativePath,
+				Method: e.compressionMethod(relativePath, manifestMediaTypes[relativePath]),
+			})
 		}
 		if err != nil {
 			return fmt.Errorf("error creating zip writer: %w", err)
 		}
 
-		r, err := filesystem.Open(path)
+		r, err := e.filesystem.Open(path)
 		if err != nil {
 			return fmt.Errorf("error opening file %v being added to EPUB: %w", path, err)
 		}
-		defer func() {
-			if err := r.Close(); err != nil {
-				panic(err)
-			}
-		}()
+		defer r.Close()
 
-		_, err = io.Copy(w, r)
+		_, err = io.Copy(w, contextReadCloser{ctx: ctx, ReadCloser: r})
 		if err != nil {
 			return fmt.Errorf("error copying contents of file being added EPUB: %w", err)
 		}
+		e.progress.fileDone(relativePath)
 		return nil
 	}
 
+	// The package file is only written once the streamed media has been added
+	e.progress.start(WriteStageZipping, stagedFileCount(e.filesystem, rootEpubDir)+1+e.streamedMediaCount(orphans))
+
 	// Add the mimetype file first
 	mimetypeFilePath := filepath.Join(rootEpubDir, mimetypeFilename)
-	mimetypeInfo, err := fs.Stat(filesystem, mimetypeFilePath)
+	mimetypeInfo, err := fs.Stat(e.filesystem, mimetypeFilePath)
 	if err != nil {
-		if err := z.Close(); err != nil {
-			panic(err)
-		}
+		// The write already failed, so closing the archive is only done to
+		// release its resources
+		_ = z.Close()
 		return counter.Total, fmt.Errorf("unable to get FileInfo for mimetype file: %w", err)
 	}
 	err = addFileToZip(mimetypeFilePath, fileInfoToDirEntry(mimetypeInfo), nil)
 	if err != nil {
-		if err := z.Close(); err != nil {
-			panic(err)
-		}
+		_ = z.Close()
 		return counter.Total, fmt.Errorf("unable to add mimetype file to EPUB: %w", err)
 	}
 
 	skipMimetypeFile = true
 
-	err = fs.WalkDir(filesystem, rootEpubDir, addFileToZip)
+	err = e.writeStreamedMedia(fetchCtx, g, zipSink{e: e, z: z}, orphans)
+	if err == nil {
+		// Media that couldn't be retrieved because the write was canceled
+		// may have been skipped
+		err = ctx.Err()
+	}
 	if err != nil {
-		if err := z.Close(); err != nil {
-			panic(err)
-		}
+		_ = z.Close()
+		return counter.Total, err
+	}
+
+	// Must be called after:
+	// createEpubFolders()
+	// writeCSSFiles()
+	// writeImages()
+	// writeVideos()
+	// writeAudios()
+	// writeSections()
+	// writeToc()
+	// writeStreamedMedia()
+	err = e.writePackageFile(stagingFileWriter(e.filesystem, rootEpubDir))
+	if err != nil {
+		_ = z.Close()
+		return counter.Total, err
+	}
+
+	err = fs.WalkDir(e.filesystem, rootEpubDir, addFileToZip)
+	if err != nil {
+		_ = z.Close()
 		return counter.Total, fmt.Errorf("unable to add file to EPUB: %w", err)
 	}
 
@@ -328,154 +596,627 @@ func (e *Epub) writeEpub(rootEpubDir string, dst io.Writer) (int64, error) {
 	return counter.Total, err
 }
 
+// streamsMedia returns whether the media of the folder is streamed from its
+// source into the EPUB instead of being stored in the temporary directory
+func (e *Epub) streamsMedia(mediaFolderName string) bool {
+	return e.streamMedia && (mediaFolderName == AudioFolderName || mediaFolderName == VideoFolderName)
+}
+
+// writeStreamedMedia streams the audio and video files from their source into
+// the zip archive and adds them to the package file, except for the orphans
+// that should be left out
+func (e *Epub) writeStreamedMedia(ctx context.Context, g grabber, sink epubSink, orphans map[string]bool) error {
+	for _, mediaFolderName := range []string{VideoFolderName, AudioFolderName} {
+		if !e.streamsMedia(mediaFolderName) {
+			continue
+		}
+		mediaMap := e.mediaFolders()[mediaFolderName]
+		for _, mediaFilename := range sortedMediaFilenames(mediaFolderName, mediaMap, orphans) {
+			err := e.streamMediaFile(ctx, g, sink, mediaMap[mediaFilename], mediaFolderName, mediaFilename)
+			e.progress.fileDone(path.Join(contentFolderName, mediaFolderName, mediaFilename))
+			// Nothing has been added to the EPUB for the media, so there's
+			// nothing to remove if it's skipped. Audio and video are
+			// never replaced by a placeholder.
+			if err != nil {
+				if _, _, err := e.mediaFailureReplacement(path.Join(contentFolderName, mediaFolderName, mediaFilename), mediaFolderName, err); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// streamMediaFile streams a media file from its source into the sink and adds
+// it to the package file. The errors that happen before the file is added to
+// the sink are returned as is, while the ones that happen after are wrapped so
+// that they're never handled by the media failure policy.
+func (e *Epub) streamMediaFile(ctx context.Context, g grabber, sink epubSink, mediaSource string, mediaFolderName string, mediaFilename string) error {
+	ctx, cancel := g.withTimeout(ctx)
+	defer cancel()
+
+	source, err := g.openMedia(ctx, mediaSource)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	// The media type is detected from the beginning of the media, which is
+	// buffered until it's added to the sink
+	r := bufio.NewReaderSize(source, mediaTypeDetectionLimit)
+	head, err := r.Peek(mediaTypeDetectionLimit)
+	if err != nil && err != io.EOF {
+		return &FileRetrievalError{Source: mediaSource, Err: err}
+	}
+	mediaType, err := e.manifestMediaType(mediaSource, detectedMediaType(mimetype.Detect(head), mediaSource, mediaFilename), mediaFolderName, mediaFilename)
+	if err != nil {
+		return err
+	}
+
+	w, err := sink.create(path.Join(contentFolderName, mediaFolderName, mediaFilename), mediaType)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error streaming %s into EPUB: %w", mediaSource, err)
+	}
+
+	e.addMediaToManifest(mediaFolderName, mediaFilename, mediaType)
+	return nil
+}
+
+// compressionMethod returns the zip compression method of the file at the path,
+// relative to the root of the EPUB, given its media type if it's known (see
+// SetCompressionMethod)
+func (e *Epub) compressionMethod(filePath string, mediaType string) uint16 {
+	baseType, _, _ := strings.Cut(mediaType, ";")
+	if method, ok := e.compressionMethods[strings.TrimSpace(baseType)]; ok && baseType != "" {
+		return method
+	}
+	if method, ok := e.compressionMethods[strings.ToLower(path.Ext(filePath))]; ok {
+		return method
+	}
+	return zip.Deflate
+}
+
 // Get fonts from their source and save them in the temporary directory
-func (e *Epub) writeFonts(rootEpubDir string) error {
-	return e.writeMedia(rootEpubDir, e.fonts, FontFolderName)
+func (e *Epub) writeFonts(ctx context.Context, g grabber, rootEpubDir string, orphans map[string]bool) error {
+	return e.writeMedia(ctx, g, rootEpubDir, e.fonts, FontFolderName, orphans)
 }
 
 // Get images from their source and save them in the temporary directory
-func (e *Epub) writeImages(rootEpubDir string) error {
-	return e.writeMedia(rootEpubDir, e.images, ImageFolderName)
+func (e *Epub) writeImages(ctx context.Context, g grabber, rootEpubDir string, orphans map[string]bool) error {
+	return e.writeMedia(ctx, g, rootEpubDir, e.images, ImageFolderName, orphans)
 }
 
 // Get videos from their source and save them in the temporary directory
-func (e *Epub) writeVideos(rootEpubDir string) error {
-	return e.writeMedia(rootEpubDir, e.videos, VideoFolderName)
+func (e *Epub) writeVideos(ctx context.Context, g grabber, rootEpubDir string, orphans map[string]bool) error {
+	return e.writeMedia(ctx, g, rootEpubDir, e.videos, VideoFolderName, orphans)
 }
 
 // Get audios from their source and save them in the temporary directory
-func (e *Epub) writeAudios(rootEpubDir string) error {
-	return e.writeMedia(rootEpubDir, e.audios, AudioFolderName)
+func (e *Epub) writeAudios(ctx context.Context, g grabber, rootEpubDir string, orphans map[string]bool) error {
+	return e.writeMedia(ctx, g, rootEpubDir, e.audios, AudioFolderName, orphans)
 }
 
-// Get media from their source and save them in the temporary directory
-func (e *Epub) writeMedia(rootEpubDir string, mediaMap map[string]string, mediaFolderName string) error {
-	if len(mediaMap) > 0 {
+// Get media from their source and save them in the temporary directory, except
+// for the orphans that should be left out
+func (e *Epub) writeMedia(ctx context.Context, g grabber, rootEpubDir string, mediaMap map[string]string, mediaFolderName string, orphans map[string]bool) error {
+	// Streamed media is added to the EPUB by writeEpub
+	if len(mediaMap) > 0 && !e.streamsMedia(mediaFolderName) {
 		mediaFolderPath := filepath.Join(rootEpubDir, contentFolderName, mediaFolderName)
-		if err := filesystem.Mkdir(mediaFolderPath, dirPermissions); err != nil {
+		if err := e.filesystem.Mkdir(mediaFolderPath, dirPermissions); err != nil {
 			return fmt.Errorf("unable to create directory: %s", err)
 		}
 
-		for mediaFilename, mediaSource := range mediaMap {
-			mediaType, err := grabber{(e.Client)}.fetchMedia(mediaSource, mediaFolderPath, mediaFilename)
-			if err != nil {
-				return err
+		// Fonts are subset to the characters used by the sections
+		var runes map[rune]bool
+		if e.subsetFonts && mediaFolderName == FontFolderName {
+			runes = e.usedRunes()
+		}
+
+		// The media is added to the manifest in a stable order
+		for _, mediaFilename := range sortedMediaFilenames(mediaFolderName, mediaMap, orphans) {
+			mediaSource := mediaMap[mediaFilename]
+			mediaType, err := g.fetchMedia(ctx, mediaSource, mediaFolderPath, mediaFilename)
+			if err == nil {
+				mediaType, err = e.manifestMediaType(mediaSource, mediaType, mediaFolderName, mediaFilename)
 			}
-			// The cover image has a special value for the properties attribute
-			mediaProperties := ""
-			if mediaFilename == e.cover.imageFilename {
-				mediaProperties = coverImageProperties
+			// Images in formats that older readers can't display are converted
+			// when possible, otherwise they're kept as is
+			if err == nil && e.convertsImage(mediaFolderName, mediaFilename, mediaType) {
+				if convertedType, convertErr := convertImage(e.filesystem, filepath.Join(mediaFolderPath, mediaFilename)); convertErr == nil {
+					mediaType = convertedType
+					// The converted image is written with the extension of
+					// its format
+					err = e.renameStagedMedia(mediaFolderPath, mediaFolderName, mediaFilename, mediaType)
+				}
 			}
-
-			// Add the file to the OPF manifest
-			e.pkg.addToManifest(fixXMLId(mediaFilename), filepath.Join(mediaFolderName, mediaFilename), mediaType, mediaProperties)
+			// Fonts that can't be subset (e.g. fonts with CFF outlines) are kept
+			// as is
+			if err == nil && runes != nil {
+				_ = subsetFontFile(e.filesystem, filepath.Join(mediaFolderPath, mediaFilename), runes)
+			}
+			// CSS retrieved in another encoding is transcoded, since readers
+			// only support UTF-8 and UTF-16
+			if err == nil && mediaFolderName == CSSFolderName {
+				err = utf8CSSFile(e.filesystem, filepath.Join(mediaFolderPath, mediaFilename), g.mediaCharset(mediaSource))
+			}
+			if err == nil && e.kindle && mediaFolderName == CSSFolderName {
+				err = kindleCSSFile(e.filesystem, filepath.Join(mediaFolderPath, mediaFilename))
+			}
+			e.progress.fileDone(path.Join(contentFolderName, mediaFolderName, mediaFilename))
+			if err != nil {
+				mediaType, err = e.handleMediaFailure(path.Join(contentFolderName, mediaFolderName, mediaFilename), mediaFolderPath, mediaFilename, mediaFolderName, err)
+				if err != nil {
+					return err
+				}
+				// The media has been skipped
+				if mediaType == "" {
+					continue
+				}
+			}
+			e.addMediaToManifest(mediaFolderName, mediaFilename, mediaType)
 		}
 	}
 	return nil
 }
 
-// fixXMLId takes a string and returns an XML id compatible string.
-// https://www.w3.org/TR/REC-xml-names/#NT-NCName
-// This means it must not contain a colon (:) or whitespace and it must not
-// start with a digit, punctuation or diacritics
-func fixXMLId(id string) string {
-	if len(id) == 0 {
-		panic("No id given")
-	}
-	fixedId := []rune{}
-	for i := 0; len(id) > 0; i++ {
-		r, size := utf8.DecodeRuneInString(id)
-		if i == 0 {
-			// The new id should be prefixed with 'id' if an invalid
-			// starting character is found
-			// this is not 100% accurate, but a better check than no check
-			if unicode.IsNumber(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
-				fixedId = append(fixedId, []rune("id")...)
-			}
+// sortedMediaFilenames returns the filenames of the media of a folder in
+// lexical order, except for the orphans that are left out
+func sortedMediaFilenames(mediaFolderName string, mediaMap map[string]string, orphans map[string]bool) []string {
+	mediaFilenames := make([]string, 0, len(mediaMap))
+	for mediaFilename := range mediaMap {
+		if !orphans[path.Join(mediaFolderName, mediaFilename)] {
+			mediaFilenames = append(mediaFilenames, mediaFilename)
+		}
+	}
+	sort.Strings(mediaFilenames)
+	return mediaFilenames
+}
+
+// manifestMediaType returns the media type of retrieved media for the manifest,
+// making sure that it matches the type of media it was added as. The media type
+// set by SetMediaType is used as is.
+func (e *Epub) manifestMediaType(mediaSource string, mediaType string, mediaFolderName string, mediaFilename string) (string, error) {
+	if overrideType, ok := e.mediaTypes[path.Join(mediaFolderName, mediaFilename)]; ok {
+		return overrideType, nil
+	}
+	if err := checkMediaType(mediaSource, mediaType, mediaFolderName); err != nil {
+		return "", err
+	}
+	return audioVideoMediaType(mediaType, mediaFolderName), nil
+}
+
+// convertsImage returns whether the media is an image that's converted to a
+// format that older readers can display (see SetConvertImages)
+func (e *Epub) convertsImage(mediaFolderName string, mediaFilename string, mediaType string) bool {
+	if _, ok := e.mediaTypes[path.Join(mediaFolderName, mediaFilename)]; ok {
+		return false
+	}
+	return e.convertImages && mediaFolderName == ImageFolderName && (mediaType == mediaTypeWebp || mediaType == mediaTypeAvif)
+}
+
+// addMediaToManifest adds a media file to the package file
+func (e *Epub) addMediaToManifest(mediaFolderName string, mediaFilename string, mediaType string) {
+	// The cover image has a special value for the properties attribute
+	mediaProperties := ""
+	if mediaFilename == e.cover.imageFilename {
+		mediaProperties = coverImageProperties
+	}
+
+	// Add the file to the OPF manifest. Media renamed by the write keeps the ID
+	// of its original filename, which other items may refer to.
+	href := e.writtenMediaPath(path.Join(mediaFolderName, mediaFilename))
+	name := path.Join(contentFolderName, href)
+	id := SanitizeXMLID(mediaFilename)
+	if id != mediaFilename {
+		e.addWarning(WarningIDSanitized, name, "manifest ID %q used instead of %q", id, mediaFilename)
+	}
+	if !mediaExtensionMatches(href, mediaType) {
+		e.addWarning(WarningExtensionMismatch, name, "extension doesn't match media type %s", mediaType)
+	}
+	e.pkg.addToManifest(id, href, mediaType, mediaProperties)
+}
+
+// audioVideoMediaType returns the media type of an audio or video file for the
+// manifest. Containers that can hold audio as well as video are detected as
+// video (e.g. video/mp4) or generically (e.g. application/ogg), so the media
+// type is adjusted to the kind of media the file was added as.
+func audioVideoMediaType(mediaType string, mediaFolderName string) string {
+	baseType, params, _ := strings.Cut(mediaType, ";")
+	baseType = strings.TrimSpace(baseType)
+
+	var kind string
+	switch mediaFolderName {
+	case AudioFolderName:
+		kind = "audio/"
+	case VideoFolderName:
+		kind = "video/"
+	default:
+		return mediaType
+	}
+
+	var subtype string
+	switch baseType {
+	case "application/ogg", "audio/ogg", "video/ogg":
+		subtype = "ogg"
+	case "audio/mp4", "video/mp4":
+		subtype = "mp4"
+	case "audio/webm", "video/webm":
+		subtype = "webm"
+	default:
+		return mediaType
+	}
+
+	if params != "" {
+		return kind + subtype + ";" + params
+	}
+	return kind + subtype
+}
+
+// checkMediaType makes sure that the media type of retrieved content matches the
+// type of media it was added as, e.g. that an image isn't an HTML error page
+func checkMediaType(mediaSource string, mediaType string, mediaFolderName string) error {
+	baseType, _, _ := strings.Cut(mediaType, ";")
+	baseType = strings.TrimSpace(baseType)
+
+	var expected string
+	switch mediaFolderName {
+	case ImageFolderName:
+		if strings.HasPrefix(baseType, "image/") {
+			return nil
+		}
+		expected = "an image"
+	case AudioFolderName, VideoFolderName:
+		if strings.HasPrefix(baseType, "audio/") || strings.HasPrefix(baseType, "video/") || baseType == "application/ogg" {
+			return nil
+		}
+		expected = "audio or video"
+	default:
+		// CSS files and fonts are commonly detected as generic types, but they
+		// should never be HTML
+		if baseType != "text/html" && baseType != mediaTypeXhtml {
+			return nil
+		}
+		expected = "a CSS file"
+		if mediaFolderName == FontFolderName {
+			expected = "a font"
+		}
+	}
+
+	return &FileRetrievalError{
+		Source: mediaSource,
+		Err: &UnexpectedMediaTypeError{
+			MediaType: baseType,
+			Expected:  expected,
+		},
+	}
+}
+
+// handleMediaFailure applies the media failure policy to media that couldn't
+// be retrieved, whose path inside the EPUB is name. It returns the media type
+// of the file that replaces the media, or an empty media type if the media
+// should be left out of the EPUB.
+func (e *Epub) handleMediaFailure(name string, mediaFolderPath string, mediaFilename string, mediaFolderName string, err error) (string, error) {
+	replacement, mediaType, err := e.mediaFailureReplacement(name, mediaFolderName, err)
+	if err != nil {
+		return "", err
+	}
+
+	mediaFilePath := filepath.Join(mediaFolderPath, mediaFilename)
+	if replacement != nil {
+		if err := e.filesystem.WriteFile(mediaFilePath, replacement, filePermissions); err != nil {
+			return "", fmt.Errorf("unable to write placeholder image: %w", err)
 		}
-		if !unicode.IsSpace(r) && r != ':' {
-			fixedId = append(fixedId, r)
+		// The placeholder is written with the extension of its format
+		if err := e.renameStagedMedia(mediaFolderPath, mediaFolderName, mediaFilename, mediaType); err != nil {
+			return "", err
 		}
-		id = id[size:]
+		return mediaType, nil
 	}
-	return string(fixedId)
+
+	// Remove anything that may have been written before the retrieval failed
+	if err := e.filesystem.RemoveAll(mediaFilePath); err != nil {
+		return "", fmt.Errorf("unable to remove %s: %w", mediaFilePath, err)
+	}
+	return "", nil
+}
+
+// mediaFailureReplacement applies the media failure policy to media that
+// couldn't be retrieved, whose path inside the EPUB is name. It returns the
+// content and the media type of the file that replaces the media, or no content
+// if the media should be left out of the EPUB.
+func (e *Epub) mediaFailureReplacement(name string, mediaFolderName string, err error) ([]byte, string, error) {
+	var retrievalErr *FileRetrievalError
+	if e.mediaFailurePolicy == MediaFailureError || !errors.As(err, &retrievalErr) {
+		return nil, "", err
+	}
+	if e.mediaFailurePolicy == MediaFailurePlaceholder && mediaFolderName == ImageFolderName {
+		e.addWarning(WarningMediaSkipped, name, "media replaced by a placeholder: %s", retrievalErr.Err)
+		return placeholderImage(), mediaTypePng, nil
+	}
+	e.addWarning(WarningMediaSkipped, name, "media left out: %s", retrievalErr.Err)
+	// The links to the media are reported as the sections and the CSS files
+	// are written
+	if mediaFolderName != "" {
+		e.renamedMedia[path.Join(mediaFolderName, path.Base(name))] = ""
+	}
+	return nil, "", nil
+}
+
+// convertImage converts the image at mediaFilePath to PNG if it has
+// transparency or JPEG otherwise, and returns the new media type. The image
+// format must be registered with the image package.
+func convertImage(filesystem storage.Storage, mediaFilePath string) (string, error) {
+	data, err := storage.ReadFile(filesystem, mediaFilePath)
+	if err != nil {
+		return "", err
+	}
+	converted, mediaType, err := convertImageData(data)
+	if err != nil {
+		return "", err
+	}
+	if err := filesystem.WriteFile(mediaFilePath, converted, filePermissions); err != nil {
+		return "", err
+	}
+	return mediaType, nil
+}
+
+// convertImageData converts an image to PNG if it has transparency or JPEG
+// otherwise, and returns the converted image and its media type
+func convertImageData(data []byte) ([]byte, string, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var b bytes.Buffer
+	mediaType := mediaTypeJpeg
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		mediaType = mediaTypePng
+		err = png.Encode(&b, img)
+	} else {
+		err = jpeg.Encode(&b, img, &jpeg.Options{Quality: convertedJpegQuality})
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return b.Bytes(), mediaType, nil
+}
+
+// placeholderImage returns a transparent 1x1 PNG image used in place of images
+// that couldn't be retrieved
+func placeholderImage() []byte {
+	var b bytes.Buffer
+	// Encoding an in-memory image to an in-memory buffer can't fail
+	_ = png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	return b.Bytes()
 }
 
 // Write the mimetype file
 //
 // Sample: https://github.com/bmaupin/epub-samples/blob/master/minimal-v3plus2/mimetype
 // Spec: http://www.idpf.org/epub/301/spec/epub-ocf.html#sec-zip-container-mime
-func writeMimetype(rootEpubDir string) {
-	mimetypeFilePath := filepath.Join(rootEpubDir, mimetypeFilename)
-
-	if err := filesystem.WriteFile(mimetypeFilePath, []byte(mediaTypeEpub), filePermissions); err != nil {
-		panic(fmt.Sprintf("Error writing mimetype file: %s", err))
+func writeMimetype(w epubFileWriter) error {
+	if err := w(mimetypeFilename, "", []byte(mediaTypeEpub)); err != nil {
+		return fmt.Errorf("error writing mimetype file: %w", err)
 	}
+	return nil
 }
 
-func (e *Epub) writePackageFile(rootEpubDir string) {
-	e.pkg.write(rootEpubDir)
+func (e *Epub) writePackageFile(w epubFileWriter) error {
+	return e.pkg.write(w)
 }
 
-// Write the section files to the temporary directory and add the sections to
-// the TOC and package files
-func (e *Epub) writeSections(rootEpubDir string) {
+// Write the section files and add the sections to the TOC and package files
+func (e *Epub) writeSections(w epubFileWriter) error {
+	e.progress.start(WriteStageWritingSections, e.sectionFileCount())
+	w = e.progress.writer(w)
+	w = e.writtenMediaFileWriter(w)
+	if e.kindle {
+		w = kindleFileWriter(w)
+	}
+	if e.watermark != nil {
+		w = e.watermarkFileWriter(w)
+	}
+	if e.figureLabel != "" || e.tableLabel != "" {
+		w = e.figureNumberingFileWriter(w)
+	}
+	if e.themeCSSFilename != "" {
+		w = e.themeFileWriter(w)
+	}
+	// The bodies are sanitized first, so that the markup added to them is kept
+	if e.sanitizePolicy != nil {
+		w = e.sanitizeFileWriter(w)
+	}
+
 	var index int
+	tocEmpty := true
 
 	if len(e.sections) > 0 {
 		// If a cover was set, add it to the package spine first so it shows up
 		// first in the reading order
-		if e.cover.xhtmlFilename != "" {
-			e.pkg.addToSpine(e.cover.xhtmlFilename)
+		if cover := e.findSection(e.cover.xhtmlFilename); cover != nil {
+			// Set the title of the cover page XHTML to the title of the EPUB
+			cover.xhtml.setTitle(e.title)
+			e.pkg.addToSpine(cover.filename, !cover.nonLinear, cover.spineProperties)
+		}
+		// The table of contents comes next if it's part of the spine
+		if e.navInSpine {
+			e.pkg.addToSpine(tocNavItemID, true, "")
 		}
 
+		// The sections are serialized concurrently but written in order
+		ss := newSectionSerializer(e.writtenSections())
+		defer ss.stop()
+
 		for _, section := range e.sections {
-			// Set the title of the cover page XHTML to the title of the EPUB
-			if section.filename == e.cover.xhtmlFilename {
-				section.xhtml.setTitle(e.Title())
+			if err := writeSection(w, &section, ss.content(&section)); err != nil {
+				return err
 			}
-
-			sectionFilePath := filepath.Join(rootEpubDir, contentFolderName, xhtmlFolderName, section.filename)
-			section.xhtml.write(sectionFilePath)
 			relativePath := filepath.Join(xhtmlFolderName, section.filename)
 
+			// Auxiliary files are only part of the manifest
+			if section.auxiliary {
+				e.pkg.addToManifest(section.filename, relativePath, mediaTypeXhtml, e.sectionManifestProperties(&section))
+				if err := e.writeMediaOverlay(w, &section); err != nil {
+					return err
+				}
+				continue
+			}
+
 			// The cover page should have already been added to the spine first
 			if section.filename != e.cover.xhtmlFilename {
-				e.pkg.addToSpine(section.filename)
+				e.addSectionToSpine(&section)
+			}
+			e.pkg.addToManifest(section.filename, relativePath, mediaTypeXhtml, e.sectionManifestProperties(&section))
+			if err := e.writeMediaOverlay(w, &section); err != nil {
+				return err
 			}
-			e.pkg.addToManifest(section.filename, relativePath, mediaTypeXhtml, "")
 
 			// Don't add pages without titles or the cover to the TOC
-			if section.xhtml.Title() != "" && section.filename != e.cover.xhtmlFilename {
-				e.toc.addSection(index, section.xhtml.Title(), relativePath)
+			if section.tocLabel() != "" && section.filename != e.cover.xhtmlFilename {
+				e.toc.addSection(index, section.tocLabel(), relativePath)
+				tocEmpty = false
 
 				// Add subsections
 				if section.children != nil {
 					for _, child := range *section.children {
 						index += 1
 						relativeSubPath := filepath.Join(xhtmlFolderName, child.filename)
-						e.toc.addSubSection(relativePath, index, child.xhtml.Title(), relativeSubPath)
+						e.toc.addSubSection(relativePath, index, child.tocLabel(), relativeSubPath)
 
-						subSectionFilePath := filepath.Join(rootEpubDir, contentFolderName, xhtmlFolderName, child.filename)
-						child.xhtml.write(subSectionFilePath)
+						if err := writeSection(w, &child, ss.content(&child)); err != nil {
+							return err
+						}
 
 						// Add subsection to spine
-						e.pkg.addToSpine(child.filename)
-						e.pkg.addToManifest(child.filename, relativeSubPath, mediaTypeXhtml, "")
+						e.addSectionToSpine(&child)
+						e.pkg.addToManifest(child.filename, relativeSubPath, mediaTypeXhtml, e.sectionManifestProperties(&child))
+						if err := e.writeMediaOverlay(w, &child); err != nil {
+							return err
+						}
 					}
 				}
 			}
 
 			index += 1
 		}
+
+		// The table of contents needs at least one entry, so the cover is
+		// added to it when there's nothing else (e.g. a cover stub)
+		if tocEmpty && e.cover.xhtmlFilename != "" {
+			e.toc.addSection(index, e.title, filepath.Join(xhtmlFolderName, e.cover.xhtmlFilename))
+		}
+		e.setTotalDuration()
 	}
+	return e.writeSearchKeyMap(w)
 }
 
-// Write the TOC file to the temporary directory and add the TOC entries to the
-// package file
-func (e *Epub) writeToc(rootEpubDir string) {
+// writeSection writes the XHTML file of a section given its content
+func writeSection(w epubFileWriter, s *epubSection, content []byte) error {
+	if err := w(path.Join(contentFolderName, xhtmlFolderName, s.filename), mediaTypeXhtml, content); err != nil {
+		return fmt.Errorf("error writing XHTML file: %w", err)
+	}
+	return nil
+}
+
+// sectionManifestProperties returns the properties of the manifest item of a
+// section, e.g. svg if the section contains embedded SVG, scripted if it
+// contains scripts or remote-resources if it references remote media (see
+// AddRemoteVideo)
+func (e *Epub) sectionManifestProperties(s *epubSection) string {
+	// The properties are those of the body as written, without the content
+	// removed by the sanitize policy
+	body := s.xhtml.xml.Body.XML
+	if e.sanitizePolicy != nil {
+		body = e.sanitizePolicy.Sanitize(body)
+	}
+	var properties []string
+	if strings.Contains(body, "<math") {
+		properties = append(properties, "mathml")
+	}
+	if strings.Contains(body, "<script") {
+		properties = append(properties, "scripted")
+	}
+	if strings.Contains(body, "<svg") {
+		properties = append(properties, "svg")
+	}
+	// Remote media is left out in Kindle compatibility mode
+	for _, link := range findLinks(body) {
+		if _, ok := e.remoteMedia[html.UnescapeString(link)]; ok && !e.kindle {
+			properties = append(properties, remoteResourcesProperties)
+			break
+		}
+	}
+	return strings.Join(properties, " ")
+}
+
+// Get the files added by AddRawFile from their source, save them in the
+// temporary directory and add them to the package file
+func (e *Epub) writeRawFiles(ctx context.Context, g grabber, rootEpubDir string) error {
+	rawPaths := make([]string, 0, len(e.rawFiles))
+	for rawPath := range e.rawFiles {
+		rawPaths = append(rawPaths, rawPath)
+	}
+	sort.Strings(rawPaths)
+
+	for i, rawPath := range rawPaths {
+		rawFile := e.rawFiles[rawPath]
+		rawFilePath := filepath.Join(rootEpubDir, contentFolderName, filepath.FromSlash(rawPath))
+		if err := storage.MkdirAll(e.filesystem, rawFilePath, dirPermissions); err != nil {
+			return fmt.Errorf("unable to create directory: %s", err)
+		}
+		mediaType, err := g.fetchMedia(ctx, rawFile.source, filepath.Dir(rawFilePath), filepath.Base(rawFilePath))
+		e.progress.fileDone(path.Join(contentFolderName, rawPath))
+		if err != nil {
+			mediaType, err = e.handleMediaFailure(path.Join(contentFolderName, rawPath), filepath.Dir(rawFilePath), filepath.Base(rawFilePath), "", err)
+			if err != nil {
+				return err
+			}
+			// The file has been skipped
+			if mediaType == "" {
+				continue
+			}
+		}
+		if rawFile.mediaType != "" {
+			mediaType = rawFile.mediaType
+		}
+		e.pkg.addToManifest(fmt.Sprintf(rawFileItemIDFormat, i+1), rawPath, mediaType, "")
+	}
+	return nil
+}
+
+// Add the remote media to the package file, unless it's left out in Kindle
+// compatibility mode
+func (e *Epub) writeRemoteMedia() {
+	if e.kindle {
+		return
+	}
+	sources := make([]string, 0, len(e.remoteMedia))
+	for source := range e.remoteMedia {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for i, source := range sources {
+		e.pkg.addToManifest(fmt.Sprintf(remoteMediaItemIDFormat, i+1), source, e.remoteMedia[source], "")
+	}
+}
+
+// Write the TOC file and add the TOC entries to the package file
+func (e *Epub) writeToc(w epubFileWriter) error {
 	e.pkg.addToManifest(tocNavItemID, tocNavFilename, mediaTypeXhtml, tocNavItemProperties)
-	e.pkg.addToManifest(tocNcxItemID, tocNcxFilename, mediaTypeNcx, "")
+	if e.noNcx {
+		e.pkg.setSpineToc("")
+	} else {
+		e.pkg.addToManifest(tocNcxItemID, tocNcxFilename, mediaTypeNcx, "")
+		e.pkg.setSpineToc(tocNcxItemID)
+	}
 
-	e.toc.write(rootEpubDir)
+	return e.toc.write(w, !e.noNcx)
 }
@@ -1,12 +1,27 @@
 package epub
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/bmaupin/go-epub/internal/storage"
+	"github.com/bmaupin/go-epub/internal/storage/memory"
 )
 
 func TestEpubWriteTo(t *testing.T) {
@@ -71,3 +86,886 @@ func testWriteToErrors(t *testing.T, e *Epub, adder func(string, string) (string
 		t.Fatal("Expected error")
 	}
 }
+
+// failingStorage is a storage whose operations fail for the paths containing
+// failingPath
+type failingStorage struct {
+	storage.Storage
+	failingPath string
+	op          string
+}
+
+func (s failingStorage) fail(op string, name string) error {
+	if op == s.op && strings.Contains(filepath.ToSlash(name), s.failingPath) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (s failingStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(s.Storage, name)
+}
+
+func (s failingStorage) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(s.Storage, name)
+}
+
+func (s failingStorage) Mkdir(name string, perm fs.FileMode) error {
+	if err := s.fail("mkdir", name); err != nil {
+		return err
+	}
+	return s.Storage.Mkdir(name, perm)
+}
+
+func (s failingStorage) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if err := s.fail("write", name); err != nil {
+		return err
+	}
+	return s.Storage.WriteFile(name, data, perm)
+}
+
+func (s failingStorage) RemoveAll(name string) error {
+	if err := s.fail("remove", name); err != nil {
+		return err
+	}
+	return s.Storage.RemoveAll(name)
+}
+
+func TestWriteStorageErrors(t *testing.T) {
+	defaultFilesystem := filesystem
+	defer func() {
+		filesystem = defaultFilesystem
+	}()
+
+	tests := []struct {
+		name        string
+		op          string
+		failingPath string
+	}{
+		{"TempDir", "mkdir", ""},
+		{"XhtmlFolder", "mkdir", xhtmlFolderName},
+		{"MetaInfFolder", "mkdir", metaInfFolderName},
+		{"Mimetype", "write", mimetypeFilename},
+		{"Section", "write", testSectionFilename},
+		{"PackageFile", "write", pkgFilename},
+		{"RemoveTempDir", "remove", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filesystem = failingStorage{
+				Storage:     memory.NewMemory(),
+				failingPath: test.failingPath,
+				op:          test.op,
+			}
+			e := NewEpub(testEpubTitle)
+			if _, err := e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, ""); err != nil {
+				t.Fatalf("Error adding section: %s", err)
+			}
+			var b bytes.Buffer
+			_, err := e.WriteTo(&b)
+			var storageErr *StorageError
+			if !errors.As(err, &storageErr) {
+				t.Fatalf("Got error %v, expected a StorageError", err)
+			}
+			if !errors.Is(err, fs.ErrPermission) {
+				t.Errorf("Got error %v, expected it to wrap the storage error", err)
+			}
+		})
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		// Only the download is slow, not the check done when adding the image
+		if r.Method == http.MethodGet {
+			time.Sleep(2 * time.Second)
+		}
+		http.ServeFile(w, r, testImageFromFileSource)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		policy     MediaFailurePolicy
+		wantErr    bool
+		wantImages int
+	}{
+		{"Error", MediaFailureError, true, 0},
+		{"Skip", MediaFailureSkip, false, 0},
+		{"Placeholder", MediaFailurePlaceholder, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEpub(testEpubTitle)
+			if _, err := e.AddImage(server.URL+"/slow.png", ""); err != nil {
+				t.Fatalf("Error adding image: %s", err)
+			}
+			e.SetWriteTimeout(100 * time.Millisecond)
+			e.SetMediaFailurePolicy(tt.policy)
+
+			var b bytes.Buffer
+			start := time.Now()
+			_, err := e.WriteTo(&b)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Write took %s, expected it to stop after the timeout", elapsed)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WriteTo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if _, ok := err.(*FileRetrievalError); !ok {
+					t.Errorf("Expected error FileRetrievalError not returned. Returned instead: %+v", err)
+				}
+				return
+			}
+
+			r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+			if err != nil {
+				t.Fatalf("Unexpected error reading EPUB: %s", err)
+			}
+			images := 0
+			for _, f := range r.File {
+				if strings.HasPrefix(f.Name, contentFolderName+"/"+ImageFolderName+"/") {
+					images++
+				}
+			}
+			if images != tt.wantImages {
+				t.Errorf("Got %d images in the EPUB, expected %d", images, tt.wantImages)
+			}
+		})
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Second)
+		http.ServeFile(w, r, testImageFromFileSource)
+	})
+	mux.HandleFunc("/slow-download.png", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			time.Sleep(2 * time.Second)
+		}
+		http.ServeFile(w, r, testImageFromFileSource)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	e := NewEpub(testEpubTitle)
+	e.SetFetchTimeout(100 * time.Millisecond)
+
+	// The check done when adding the image is bounded as well
+	start := time.Now()
+	_, err := e.AddImage(server.URL+"/slow.png", "")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("AddImage took %s, expected it to stop after the timeout", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error context.DeadlineExceeded not returned. Returned instead: %+v", err)
+	}
+
+	if _, err := e.AddImage(server.URL+"/slow-download.png", ""); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	start = time.Now()
+	_, err = e.WriteTo(io.Discard)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Write took %s, expected it to stop after the timeout", elapsed)
+	}
+	if _, ok := err.(*FileRetrievalError); !ok || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error FileRetrievalError wrapping context.DeadlineExceeded not returned. Returned instead: %+v", err)
+	}
+}
+
+func TestUnexpectedMediaType(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<!DOCTYPE html><html><body><h1>Please log in</h1></body></html>")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	e := NewEpub(testEpubTitle)
+	if _, err := e.AddImage(server.URL+"/image.png", ""); err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+
+	_, err := e.WriteTo(io.Discard)
+	var mediaTypeErr *UnexpectedMediaTypeError
+	if _, ok := err.(*FileRetrievalError); !ok || !errors.As(err, &mediaTypeErr) {
+		t.Fatalf("Expected error UnexpectedMediaTypeError not returned. Returned instead: %+v", err)
+	}
+	if mediaTypeErr.MediaType != "text/html" {
+		t.Errorf("Got media type %s, expected text/html", mediaTypeErr.MediaType)
+	}
+
+	// The placeholder policy applies to images with unexpected content as well
+	e.SetMediaFailurePolicy(MediaFailurePlaceholder)
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	f, err := r.Open(contentFolderName + "/" + ImageFolderName + "/image.png")
+	if err != nil {
+		t.Fatalf("Placeholder image not found in the EPUB: %s", err)
+	}
+	defer f.Close()
+	if _, err := png.Decode(f); err != nil {
+		t.Errorf("Placeholder image isn't a PNG image: %s", err)
+	}
+}
+
+// Placeholders are written with the extension of their format, and the links
+// to the media left out are reported
+func TestMediaFailureLinks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<!DOCTYPE html><html><body><h1>Please log in</h1></body></html>")
+	}))
+	defer server.Close()
+
+	e := NewEpub(testEpubTitle)
+	imagePath, err := e.AddImage(server.URL+"/photo.jpg", "")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	cssPath, err := e.AddCSS("data:text/css,body%20%7B%20background%3A%20url%28"+imagePath+"%29%20%7D", "")
+	if err != nil {
+		t.Fatalf("Error adding CSS: %s", err)
+	}
+	section, err := e.AddSection(`<img src="`+imagePath+`" alt="" />`, testSectionTitle, "", cssPath)
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+
+	e.SetMediaFailurePolicy(MediaFailurePlaceholder)
+	for _, directWrite := range []bool{false, true} {
+		e.SetDirectWrite(directWrite)
+		r := newTestReader(t, e)
+		f, err := r.Open("EPUB/images/photo.png")
+		if err != nil {
+			t.Fatalf("Placeholder image not found in the EPUB writing directly: %t: %s", directWrite, err)
+		}
+		if _, err := png.Decode(f); err != nil {
+			t.Errorf("Placeholder image isn't a PNG image: %s", err)
+		}
+		f.Close()
+		if _, err := r.ReadFile("EPUB/images/photo.jpg"); err == nil {
+			t.Error("Placeholder image written with the original filename")
+		}
+		for name, expected := range map[string]string{
+			"EPUB/xhtml/" + section:                      `src="../images/photo.png"`,
+			"EPUB/" + strings.TrimPrefix(cssPath, "../"): `url(../images/photo.png)`,
+			"EPUB/package.opf":                           `id="photo.jpg" href="images/photo.png" media-type="image/png"`,
+		} {
+			content, err := r.ReadFile(name)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !strings.Contains(string(content), expected) {
+				t.Errorf("%s doesn't contain %s writing directly: %t:\n%s", name, expected, directWrite, content)
+			}
+		}
+	}
+	for _, w := range e.Warnings() {
+		if w.Type == WarningExtensionMismatch {
+			t.Errorf("Unexpected warning: %s", w)
+		}
+	}
+
+	e.SetMediaFailurePolicy(MediaFailureSkip)
+	for _, directWrite := range []bool{false, true} {
+		e.SetDirectWrite(directWrite)
+		newTestReader(t, e)
+	}
+	for _, name := range []string{"EPUB/xhtml/" + section, "EPUB/" + strings.TrimPrefix(cssPath, "../")} {
+		expected := Warning{Type: WarningMediaSkipped, Path: name, Message: "links to " + imagePath + ", which was left out"}
+		found := false
+		for _, w := range e.Warnings() {
+			found = found || w == expected
+		}
+		if !found {
+			t.Errorf("Warning %s not found in %v", expected, e.Warnings())
+		}
+	}
+}
+
+func TestAudioVideoMediaType(t *testing.T) {
+	tests := []struct {
+		mediaType       string
+		mediaFolderName string
+		want            string
+	}{
+		{"video/mp4", AudioFolderName, "audio/mp4"},
+		{"video/mp4", VideoFolderName, "video/mp4"},
+		{"application/ogg", AudioFolderName, "audio/ogg"},
+		{"application/ogg", VideoFolderName, "video/ogg"},
+		{"video/webm; codecs=opus", AudioFolderName, "audio/webm; codecs=opus"},
+		{"audio/mpeg", AudioFolderName, "audio/mpeg"},
+		{"audio/wav", AudioFolderName, "audio/wav"},
+		{"application/ogg", ImageFolderName, "application/ogg"},
+	}
+	for _, tt := range tests {
+		if got := audioVideoMediaType(tt.mediaType, tt.mediaFolderName); got != tt.want {
+			t.Errorf("audioVideoMediaType(%q, %q) = %q, want %q", tt.mediaType, tt.mediaFolderName, got, tt.want)
+		}
+	}
+}
+
+func TestSetCompressionMethod(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	testImagePath, err := e.AddImage(testImageFromFileSource, "")
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	testVideoPath, err := e.AddVideo(testVideoFromFileSource, "video")
+	if err != nil {
+		t.Fatalf("Error adding video: %s", err)
+	}
+	if err := e.SetCompressionMethod(".PNG", zip.Store); err != nil {
+		t.Errorf("Unexpected error setting compression method: %s", err)
+	}
+	// The video has no extension, so it's matched by its media type
+	if err := e.SetCompressionMethod("video/mp4", zip.Store); err != nil {
+		t.Errorf("Unexpected error setting compression method: %s", err)
+	}
+	if err := e.SetCompressionMethod(".txt", 99); err == nil {
+		t.Error("Expected error InvalidCompressionMethodError not returned")
+	} else if _, ok := err.(*InvalidCompressionMethodError); !ok {
+		t.Errorf("Expected error InvalidCompressionMethodError not returned. Returned instead: %+v", err)
+	}
+
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	wantMethods := map[string]uint16{
+		mimetypeFilename: zip.Store,
+		contentFolderName + "/" + strings.TrimPrefix(testImagePath, "../"): zip.Store,
+		contentFolderName + "/" + strings.TrimPrefix(testVideoPath, "../"): zip.Store,
+		contentFolderName + "/" + pkgFilename:                              zip.Deflate,
+	}
+	for _, f := range r.File {
+		if want, ok := wantMethods[f.Name]; ok {
+			if f.Method != want {
+				t.Errorf("%s compressed with method %d, expected %d", f.Name, f.Method, want)
+			}
+			delete(wantMethods, f.Name)
+		}
+	}
+	for name := range wantMethods {
+		t.Errorf("%s not found in the EPUB", name)
+	}
+}
+
+func TestSetStreamMedia(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video.mp4", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, testVideoFromFileSource)
+	})
+	mux.HandleFunc("/missing.mp4", func(w http.ResponseWriter, r *http.Request) {
+		// Only the download fails, not the check done when adding the video
+		if r.Method == http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, testVideoFromFileSource)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	testVideo, err := os.ReadFile(testVideoFromFileSource)
+	if err != nil {
+		t.Fatalf("Error reading video: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		policy  MediaFailurePolicy
+		wantErr bool
+	}{
+		{"Error", MediaFailureError, true},
+		{"Skip", MediaFailureSkip, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEpub(testEpubTitle)
+			testVideoPath, err := e.AddVideo(server.URL+"/video.mp4", "")
+			if err != nil {
+				t.Fatalf("Error adding video: %s", err)
+			}
+			testMissingPath, err := e.AddVideo(server.URL+"/missing.mp4", "")
+			if err != nil {
+				t.Fatalf("Error adding video: %s", err)
+			}
+			e.SetStreamMedia(true)
+			e.SetMediaFailurePolicy(tt.policy)
+
+			var b bytes.Buffer
+			_, err = e.WriteTo(&b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WriteTo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if _, ok := err.(*FileRetrievalError); !ok {
+					t.Errorf("Expected error FileRetrievalError not returned. Returned instead: %+v", err)
+				}
+				return
+			}
+
+			r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+			if err != nil {
+				t.Fatalf("Unexpected error reading EPUB: %s", err)
+			}
+			files := make(map[string][]byte)
+			for _, f := range r.File {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatalf("Unexpected error opening %s: %s", f.Name, err)
+				}
+				files[f.Name], err = io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatalf("Unexpected error reading %s: %s", f.Name, err)
+				}
+			}
+			if r.File[0].Name != mimetypeFilename {
+				t.Errorf("Got %s as the first file of the EPUB, expected %s", r.File[0].Name, mimetypeFilename)
+			}
+			videoName := contentFolderName + "/" + strings.TrimPrefix(testVideoPath, "../")
+			if !bytes.Equal(files[videoName], testVideo) {
+				t.Errorf("Streamed video %s doesn't match its source", videoName)
+			}
+			missingName := contentFolderName + "/" + strings.TrimPrefix(testMissingPath, "../")
+			if _, ok := files[missingName]; ok {
+				t.Errorf("Video %s that can't be retrieved found in the EPUB", missingName)
+			}
+			pkgFile := string(files[contentFolderName+"/"+pkgFilename])
+			if !strings.Contains(pkgFile, `href="`+strings.TrimPrefix(testVideoPath, "../")+`" media-type="video/mp4"`) {
+				t.Errorf("Streamed video not found in the manifest:\n%s", pkgFile)
+			}
+			if strings.Contains(pkgFile, strings.TrimPrefix(testMissingPath, "../")) {
+				t.Errorf("Video that can't be retrieved found in the manifest:\n%s", pkgFile)
+			}
+		})
+	}
+}
+
+func TestSetDirectWrite(t *testing.T) {
+	newTestEpub := func(t *testing.T) *Epub {
+		e := NewEpub(testEpubTitle)
+		// The identifier is part of the TOC
+		e.SetIdentifier(testEpubIdentifier)
+		imagePath, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+		if err != nil {
+			t.Fatalf("Error adding image: %s", err)
+		}
+		e.SetCover(imagePath, "")
+		if _, err := e.AddFont(testFontFromFileSource, ""); err != nil {
+			t.Fatalf("Error adding font: %s", err)
+		}
+		if _, err := e.AddVideo(testVideoFromFileSource, ""); err != nil {
+			t.Fatalf("Error adding video: %s", err)
+		}
+		if _, err := e.AddRawFile("data:application/json,%7B%7D", "data/book.json", "application/json"); err != nil {
+			t.Fatalf("Error adding raw file: %s", err)
+		}
+		if err := e.AddMetaInfFile("data:application/xml,%3Crights%2F%3E", "rights.xml"); err != nil {
+			t.Fatalf("Error adding META-INF file: %s", err)
+		}
+		if _, err := e.AddSection(fmt.Sprintf(`<img src="%s" alt="" />`, imagePath), testSectionTitle, "", ""); err != nil {
+			t.Fatalf("Error adding section: %s", err)
+		}
+		return e
+	}
+	readZip := func(t *testing.T, e *Epub) (*zip.Reader, map[string]string) {
+		var b bytes.Buffer
+		n, err := e.WriteTo(&b)
+		if err != nil {
+			t.Fatalf("Unexpected error writing EPUB: %s", err)
+		}
+		if n != int64(b.Len()) {
+			t.Errorf("WriteTo returned %d bytes written, expected %d", n, b.Len())
+		}
+		r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+		if err != nil {
+			t.Fatalf("Unexpected error reading EPUB: %s", err)
+		}
+		files := make(map[string]string)
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("Unexpected error opening %s: %s", f.Name, err)
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("Unexpected error reading %s: %s", f.Name, err)
+			}
+			files[f.Name] = string(content)
+		}
+		return r, files
+	}
+
+	_, stagedFiles := readZip(t, newTestEpub(t))
+	e := newTestEpub(t)
+	e.SetDirectWrite(true)
+	r, directFiles := readZip(t, e)
+
+	if r.File[0].Name != mimetypeFilename || r.File[0].Method != zip.Store {
+		t.Errorf("Got %s with method %d as the first file of the EPUB, expected the uncompressed mimetype file", r.File[0].Name, r.File[0].Method)
+	}
+	for name, content := range stagedFiles {
+		directContent, ok := directFiles[name]
+		if !ok {
+			t.Errorf("%s not found in the EPUB written directly", name)
+			continue
+		}
+		// The order of the manifest items isn't the same
+		if name == contentFolderName+"/"+pkgFilename {
+			continue
+		}
+		if directContent != content {
+			t.Errorf("%s written directly doesn't match the one written from the storage", name)
+		}
+	}
+	if len(directFiles) != len(stagedFiles) {
+		t.Errorf("Got %d files in the EPUB written directly, expected %d", len(directFiles), len(stagedFiles))
+	}
+	pkgFile := directFiles[contentFolderName+"/"+pkgFilename]
+	for name := range directFiles {
+		href := strings.TrimPrefix(name, contentFolderName+"/")
+		if href == name || href == pkgFilename {
+			continue
+		}
+		if !strings.Contains(pkgFile, `href="`+href+`"`) {
+			t.Errorf("%s not found in the manifest:\n%s", href, pkgFile)
+		}
+	}
+}
+
+func TestWriteUnpacked(t *testing.T) {
+	newTestEpub := func(t *testing.T) *Epub {
+		e := NewEpub(testEpubTitle)
+		// The identifier is part of the TOC
+		e.SetIdentifier(testEpubIdentifier)
+		imagePath, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+		if err != nil {
+			t.Fatalf("Error adding image: %s", err)
+		}
+		if _, err := e.AddVideo(testVideoFromFileSource, ""); err != nil {
+			t.Fatalf("Error adding video: %s", err)
+		}
+		if err := e.AddMetaInfFile("data:application/xml,%3Crights%2F%3E", "rights.xml"); err != nil {
+			t.Fatalf("Error adding META-INF file: %s", err)
+		}
+		if _, err := e.AddSection(fmt.Sprintf(`<img src="%s" alt="" />`, imagePath), testSectionTitle, "", ""); err != nil {
+			t.Fatalf("Error adding section: %s", err)
+		}
+		return e
+	}
+
+	// The unpacked EPUB is written the same way as an EPUB written directly
+	e := newTestEpub(t)
+	e.SetDirectWrite(true)
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+
+	destDir := filepath.Join(t.TempDir(), "book")
+	e = newTestEpub(t)
+	e.SetStreamMedia(true)
+	if err := e.WriteUnpacked(destDir); err != nil {
+		t.Fatalf("Unexpected error writing unpacked EPUB: %s", err)
+	}
+
+	fileCount := 0
+	err = filepath.WalkDir(destDir, func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			fileCount++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error walking %s: %s", destDir, err)
+	}
+	if fileCount != len(r.File) {
+		t.Errorf("Got %d files in the unpacked EPUB, expected %d", fileCount, len(r.File))
+	}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Unexpected error opening %s: %s", f.Name, err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s: %s", f.Name, err)
+		}
+		unpackedContent, err := os.ReadFile(filepath.Join(destDir, filepath.FromSlash(f.Name)))
+		if err != nil {
+			t.Errorf("Unexpected error reading unpacked %s: %s", f.Name, err)
+			continue
+		}
+		if !bytes.Equal(unpackedContent, content) {
+			t.Errorf("Unpacked %s doesn't match the one of the EPUB", f.Name)
+		}
+	}
+}
+
+func TestManifestOrder(t *testing.T) {
+	manifest := func(t *testing.T) string {
+		e := NewEpub(testEpubTitle)
+		for i := 0; i < 20; i++ {
+			if _, err := e.AddImage(testImageFromFileSource, ""); err != nil {
+				t.Fatalf("Error adding image: %s", err)
+			}
+			if _, err := e.AddCSS("data:text/css,p%7Bmargin:0%7D", ""); err != nil {
+				t.Fatalf("Error adding CSS: %s", err)
+			}
+		}
+		var b bytes.Buffer
+		if _, err := e.WriteTo(&b); err != nil {
+			t.Fatalf("Unexpected error writing EPUB: %s", err)
+		}
+		r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+		if err != nil {
+			t.Fatalf("Unexpected error reading EPUB: %s", err)
+		}
+		f, err := r.Open(contentFolderName + "/" + pkgFilename)
+		if err != nil {
+			t.Fatalf("Unexpected error opening package file: %s", err)
+		}
+		defer f.Close()
+		pkgFile, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("Unexpected error reading package file: %s", err)
+		}
+		start := strings.Index(string(pkgFile), "<manifest>")
+		end := strings.Index(string(pkgFile), "</manifest>")
+		if start == -1 || end == -1 {
+			t.Fatalf("Manifest not found in the package file:\n%s", pkgFile)
+		}
+		return string(pkgFile[start:end])
+	}
+
+	want := manifest(t)
+	var hrefs []string
+	for _, line := range strings.Split(want, "\n") {
+		if i := strings.Index(line, `href="`); i != -1 {
+			hrefs = append(hrefs, strings.SplitN(line[i+len(`href="`):], `"`, 2)[0])
+		}
+	}
+	cssHrefs := hrefs[:20]
+	imageHrefs := hrefs[20:40]
+	if !sort.StringsAreSorted(cssHrefs) || !strings.HasPrefix(cssHrefs[0], CSSFolderName+"/") {
+		t.Errorf("Got CSS files in the order %v, expected them first in lexical order", cssHrefs)
+	}
+	if !sort.StringsAreSorted(imageHrefs) || !strings.HasPrefix(imageHrefs[0], ImageFolderName+"/") {
+		t.Errorf("Got images in the order %v, expected them after the CSS files in lexical order", imageHrefs)
+	}
+	for i := 0; i < 5; i++ {
+		if got := manifest(t); got != want {
+			t.Fatalf("Manifest changed between writes\nGot: %s\nExpected: %s", got, want)
+		}
+	}
+}
+
+func TestWriteRepeated(t *testing.T) {
+	e := NewEpub(testEpubTitle)
+	imagePath, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	if err != nil {
+		t.Fatalf("Error adding image: %s", err)
+	}
+	e.SetCover(imagePath, "")
+	parentPath, err := e.AddSection(fmt.Sprintf(`<img src="%s" alt="" />`, imagePath), testSectionTitle, "", "")
+	if err != nil {
+		t.Fatalf("Error adding section: %s", err)
+	}
+	if _, err := e.AddSubSection(parentPath, testSectionBody, testSectionTitle, "", ""); err != nil {
+		t.Fatalf("Error adding subsection: %s", err)
+	}
+	if _, err := e.AddRawFile("data:application/json,%7B%7D", "data/book.json", "application/json"); err != nil {
+		t.Fatalf("Error adding raw file: %s", err)
+	}
+
+	// The modification date is the only thing that changes between writes
+	modifiedRegex := regexp.MustCompile(`<meta property="dcterms:modified">[^<]*</meta>`)
+	readFiles := func(t *testing.T) map[string]string {
+		var b bytes.Buffer
+		if _, err := e.WriteTo(&b); err != nil {
+			t.Fatalf("Unexpected error writing EPUB: %s", err)
+		}
+		r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+		if err != nil {
+			t.Fatalf("Unexpected error reading EPUB: %s", err)
+		}
+		files := make(map[string]string)
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("Unexpected error opening %s: %s", f.Name, err)
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("Unexpected error reading %s: %s", f.Name, err)
+			}
+			files[f.Name] = modifiedRegex.ReplaceAllString(string(content), "")
+		}
+		return files
+	}
+
+	want := readFiles(t)
+	for i := 0; i < 2; i++ {
+		got := readFiles(t)
+		if len(got) != len(want) {
+			t.Errorf("Got %d files when writing the EPUB again, expected %d", len(got), len(want))
+		}
+		for name, content := range want {
+			if got[name] != content {
+				t.Errorf("%s changed when writing the EPUB again\nGot: %s\nExpected: %s", name, got[name], content)
+			}
+		}
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		// Only the download is slow, not the check done when adding the image
+		if r.Method == http.MethodGet {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(2 * time.Second):
+			}
+		}
+		http.ServeFile(w, r, testImageFromFileSource)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, direct := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Direct=%v", direct), func(t *testing.T) {
+			e := NewEpub(testEpubTitle)
+			if _, err := e.AddImage(server.URL+"/slow.png", ""); err != nil {
+				t.Fatalf("Error adding image: %s", err)
+			}
+			if _, err := e.AddSection(testSectionBody, testSectionTitle, "", ""); err != nil {
+				t.Fatalf("Error adding section: %s", err)
+			}
+			// Canceling the write isn't a media failure
+			e.SetMediaFailurePolicy(MediaFailureSkip)
+			e.SetDirectWrite(direct)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			start := time.Now()
+			_, err := e.WriteContext(ctx, io.Discard)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Write took %s, expected it to stop once canceled", elapsed)
+			}
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Got error %v, expected context.Canceled", err)
+			}
+
+			// A canceled context stops the write right away
+			_, err = e.WriteContext(ctx, io.Discard)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Got error %v, expected context.Canceled", err)
+			}
+		})
+	}
+}
+
+func TestSetProgressFunc(t *testing.T) {
+	for _, direct := range []bool{false, true} {
+		for _, stream := range []bool{false, true} {
+			t.Run(fmt.Sprintf("Direct=%v,Stream=%v", direct, stream), func(t *testing.T) {
+				e := NewEpub(testEpubTitle)
+				if _, err := e.AddImage(testImageFromFileSource, ""); err != nil {
+					t.Fatalf("Error adding image: %s", err)
+				}
+				if _, err := e.AddVideo(testVideoFromFileSource, ""); err != nil {
+					t.Fatalf("Error adding video: %s", err)
+				}
+				sectionPath, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+				if err != nil {
+					t.Fatalf("Error adding section: %s", err)
+				}
+				if _, err := e.AddSubSection(sectionPath, testSectionBody, testSectionTitle, "", ""); err != nil {
+					t.Fatalf("Error adding subsection: %s", err)
+				}
+				// The media overlays and the search key map are written with the
+				// sections
+				audioPath, err := e.AddAudio(testAudioFromFileSource, "")
+				if err != nil {
+					t.Fatalf("Error adding audio: %s", err)
+				}
+				readPath, err := e.AddSection(`<p id="p1">One</p>`, "Read aloud", "", "")
+				if err != nil {
+					t.Fatalf("Error adding section: %s", err)
+				}
+				if err := e.AddMediaOverlay(readPath, []MediaOverlayClip{{TextID: "p1", Audio: audioPath, End: time.Second}}); err != nil {
+					t.Fatalf("Error adding media overlay: %s", err)
+				}
+				if _, err := e.AddDictionarySection([]DictionaryEntry{{Headword: "cat", Definition: "<p>chat</p>"}}, "A-Z", "", ""); err != nil {
+					t.Fatalf("Error adding dictionary section: %s", err)
+				}
+				e.SetDirectWrite(direct)
+				e.SetStreamMedia(stream)
+
+				var events []WriteProgress
+				e.SetProgressFunc(func(p WriteProgress) {
+					events = append(events, p)
+				})
+				if _, err := e.WriteTo(io.Discard); err != nil {
+					t.Fatalf("Unexpected error writing EPUB: %s", err)
+				}
+
+				var stages []WriteStage
+				for i, p := range events {
+					if p.File == "" {
+						if p.Done != 0 {
+							t.Errorf("Stage %s started with %d files done", p.Stage, p.Done)
+						}
+						stages = append(stages, p.Stage)
+					}
+					if p.Done > p.Total {
+						t.Errorf("Got %d files done out of %d in stage %s", p.Done, p.Total, p.Stage)
+					}
+					// Each stage is complete when the next one starts
+					if i+1 == len(events) || events[i+1].File == "" {
+						if p.Done != p.Total {
+							t.Errorf("Stage %s ended with %d files done out of %d", p.Stage, p.Done, p.Total)
+						}
+					}
+				}
+				wantStages := []WriteStage{WriteStageFetchingMedia, WriteStageWritingSections, WriteStageZipping}
+				if fmt.Sprint(stages) != fmt.Sprint(wantStages) {
+					t.Errorf("Got stages %v, expected %v", stages, wantStages)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package epub
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// writeDirect writes the EPUB straight into a zip archive written to dst,
+// without storing its files first (see SetDirectWrite). The write stops once
+// ctx is done, fetchCtx bounds the retrieval of the media. The return value is
+// the number of bytes written.
+func (e *Epub) writeDirect(ctx context.Context, fetchCtx context.Context, g grabber, dst io.Writer, orphans map[string]bool) (int64, error) {
+	counter := &writeCounter{}
+	z := zip.NewWriter(io.MultiWriter(counter, dst))
+
+	sink := zipSink{e: e, z: z}
+	if e.incremental {
+		sink.previous = e.incrementalFiles
+		sink.files = make(map[string]incrementalFile)
+	}
+	if err := e.writeDirectFiles(ctx, fetchCtx, g, sink, orphans); err != nil {
+		// The error that stopped the write matters more than the one closing
+		// the archive
+		_ = z.Close()
+		return counter.Total, err
+	}
+	err := z.Close()
+	if err == nil && e.incremental {
+		// The files that are no longer part of the EPUB are dropped
+		e.incrementalFiles = sink.files
+	}
+	return counter.Total, err
+}
+
+// epubSink receives the files of an EPUB written directly, i.e. without storing
+// them first
+type epubSink interface {
+	// create creates a file of the EPUB given its path relative to the root of
+	// the EPUB and its media type
+	create(name string, mediaType string) (io.WriteCloser, error)
+	// write writes a file of the EPUB whose whole content is known
+	write(name string, mediaType string, content []byte) error
+}
+
+// writeSinkFile writes a file of the EPUB to the sink by creating it
+func writeSinkFile(sink epubSink, name string, mediaType string, content []byte) error {
+	w, err := sink.create(name, mediaType)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// zipSink adds the files of an EPUB to a zip archive
+type zipSink struct {
+	e *Epub
+	z *zip.Writer
+	// The files compressed by the previous incremental write, and the ones
+	// compressed by this one, if the write is incremental
+	previous map[string]incrementalFile
+	files    map[string]incrementalFile
+}
+
+// method returns the compression method of a file of the EPUB
+func (s zipSink) method(name string, mediaType string) uint16 {
+	// The mimetype file must be uncompressed according to the EPUB spec
+	if name == mimetypeFilename {
+		return zip.Store
+	}
+	return s.e.compressionMethod(name, mediaType)
+}
+
+func (s zipSink) create(name string, mediaType string) (io.WriteCloser, error) {
+	w, err := s.z.CreateHeader(&zip.FileHeader{
+		Name:   name,
+		Method: s.method(name, mediaType),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating zip writer: %w", err)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// nopWriteCloser is an io.WriteCloser whose Close method does nothing
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (s zipSink) write(name string, mediaType string, content []byte) error {
+	if s.files != nil {
+		return s.writeIncremental(name, s.method(name, mediaType), content)
+	}
+	return writeSinkFile(s, name, mediaType, content)
+}
+
+// dirSink writes the files of an EPUB to a directory of the local filesystem
+// (see WriteUnpacked)
+type dirSink struct {
+	dir string
+}
+
+func (s dirSink) create(name string, mediaType string) (io.WriteCloser, error) {
+	filePath := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filePath), dirPermissions); err != nil {
+		return nil, err
+	}
+	return os.Create(filePath)
+}
+
+func (s dirSink) write(name string, mediaType string, content []byte) error {
+	return writeSinkFile(s, name, mediaType, content)
+}
+
+// sinkFileWriter returns an epubFileWriter that writes the files to the sink
+// until ctx is done. Media that couldn't be retrieved because ctx is done may
+// have been skipped, so nothing is written once it is.
+func sinkFileWriter(ctx context.Context, sink epubSink) epubFileWriter {
+	return func(name string, mediaType string, content []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return sink.write(name, mediaType, content)
+	}
+}
+
+// writeDirectFiles writes the files of the EPUB to the sink and builds the
+// package file along the way, which is why it's written last
+func (e *Epub) writeDirectFiles(ctx context.Context, fetchCtx context.Context, g grabber, sink epubSink, orphans map[string]bool) error {
+	// The files of signed EPUBs are digested as they're written
+	var signing *signingSink
+	if e.signer != nil {
+		signing = newSigningSink(sink)
+		sink = signing
+	}
+	w := sinkFileWriter(ctx, sink)
+
+	// The mimetype file must be the first file of the archive
+	if err := writeMimetype(w); err != nil {
+		return err
+	}
+	if err := writeContainerFile(w); err != nil {
+		return err
+	}
+	if err := e.writeOCFFiles(w); err != nil {
+		return err
+	}
+
+	// Media added several times from the same URL is only downloaded once,
+	// the content is kept for the next uses
+	uses := make(map[string]int)
+	for _, mediaMap := range e.mediaFolders() {
+		for _, mediaSource := range mediaMap {
+			uses[mediaSource]++
+		}
+	}
+	fetched := make(map[string][]byte, len(g.fetched))
+	for source, data := range g.fetched {
+		fetched[source] = data
+	}
+	g.fetched = fetched
+	fetch := func(mediaSource string, mediaFilename string) ([]byte, string, error) {
+		data, mediaType, err := g.fetchMediaData(fetchCtx, mediaSource, mediaFilename)
+		if err == nil && uses[mediaSource] > 1 && detectMediaType(mediaSource) == "URL" {
+			g.fetched[mediaSource] = data
+		}
+		// Incremental writes keep the media for the next writes, until they're
+		// disabled
+		if err == nil && e.incremental && detectMediaType(mediaSource) == "URL" {
+			if _, ok := e.fetchedMedia[mediaSource]; !ok {
+				if e.incrementalMedia == nil {
+					e.incrementalMedia = make(map[string]bool)
+				}
+				e.incrementalMedia[mediaSource] = true
+			}
+			e.fetchedMedia[mediaSource] = data
+		}
+		return data, mediaType, err
+	}
+
+	e.progress.start(WriteStageFetchingMedia, e.fetchedMediaCount(orphans))
+
+	metaInfPaths := make([]string, 0, len(e.metaInfFiles))
+	for metaInfPath := range e.metaInfFiles {
+		metaInfPaths = append(metaInfPaths, metaInfPath)
+	}
+	sort.Strings(metaInfPaths)
+	for _, metaInfPath := range metaInfPaths {
+		data, _, err := fetch(e.metaInfFiles[metaInfPath], path.Base(metaInfPath))
+		e.progress.fileDone(path.Join(metaInfFolderName, metaInfPath))
+		if err != nil {
+			if _, _, err := e.mediaFailureReplacement(path.Join(metaInfFolderName, metaInfPath), "", err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w(path.Join(metaInfFolderName, metaInfPath), "", data); err != nil {
+			return err
+		}
+	}
+
+	// The CSS files are written once the images have been, since their links
+	// to the images renamed by the write are updated
+	type cssFile struct {
+		name      string
+		mediaType string
+		content   []byte
+	}
+	var cssFiles []cssFile
+	cssWriter := func(name string, mediaType string, content []byte) error {
+		cssFiles = append(cssFiles, cssFile{name: name, mediaType: mediaType, content: content})
+		return nil
+	}
+	for _, mediaFolderName := range []string{CSSFolderName, FontFolderName, ImageFolderName, VideoFolderName, AudioFolderName} {
+		// Streamed media is added by writeStreamedMedia
+		if e.streamsMedia(mediaFolderName) {
+			continue
+		}
+		mediaWriter := w
+		if mediaFolderName == CSSFolderName {
+			mediaWriter = cssWriter
+		}
+		if err := e.writeDirectMedia(mediaWriter, g, fetch, mediaFolderName, orphans); err != nil {
+			return err
+		}
+	}
+	for _, f := range cssFiles {
+		content := e.writtenMediaLinks(f.name, string(f.content), rewriteCSSLinks)
+		if err := w(f.name, f.mediaType, []byte(content)); err != nil {
+			return err
+		}
+	}
+	if err := e.writeStreamedMedia(fetchCtx, g, sink, orphans); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	rawPaths := make([]string, 0, len(e.rawFiles))
+	for rawPath := range e.rawFiles {
+		rawPaths = append(rawPaths, rawPath)
+	}
+	sort.Strings(rawPaths)
+	for i, rawPath := range rawPaths {
+		rawFile := e.rawFiles[rawPath]
+		data, mediaType, err := fetch(rawFile.source, path.Base(rawPath))
+		e.progress.fileDone(path.Join(contentFolderName, rawPath))
+		if err != nil {
+			data, mediaType, err = e.mediaFailureReplacement(path.Join(contentFolderName, rawPath), "", err)
+			if err != nil {
+				return err
+			}
+			// The file has been skipped
+			if data == nil {
+				continue
+			}
+		}
+		if rawFile.mediaType != "" {
+			mediaType = rawFile.mediaType
+		}
+		if err := w(path.Join(contentFolderName, rawPath), mediaType, data); err != nil {
+			return err
+		}
+		e.pkg.addToManifest(fmt.Sprintf(rawFileItemIDFormat, i+1), rawPath, mediaType, "")
+	}
+
+	e.writeRemoteMedia()
+
+	if err := e.writeSections(w); err != nil {
+		return err
+	}
+
+	// The TOC files and the package file are the only files left
+	tocFileCount := 1
+	if !e.noNcx {
+		tocFileCount++
+	}
+	e.progress.start(WriteStageZipping, tocFileCount+1)
+	w = e.progress.writer(w)
+	if err := e.writeToc(w); err != nil {
+		return err
+	}
+	if err := e.writePackageFile(w); err != nil {
+		return err
+	}
+	if signing != nil {
+		return e.writeSignatures(signing)
+	}
+	return nil
+}
+
+// writeDirectMedia retrieves the media of a folder, adds it to the zip archive
+// and to the package file, except for the orphans that should be left out
+func (e *Epub) writeDirectMedia(w epubFileWriter, g grabber, fetch func(string, string) ([]byte, string, error), mediaFolderName string, orphans map[string]bool) error {
+	mediaMap := e.mediaFolders()[mediaFolderName]
+	mediaFilenames := sortedMediaFilenames(mediaFolderName, mediaMap, orphans)
+
+	// Fonts are subset to the characters used by the sections
+	var runes map[rune]bool
+	if e.subsetFonts && mediaFolderName == FontFolderName && len(mediaFilenames) > 0 {
+		runes = e.usedRunes()
+	}
+
+	for _, mediaFilename := range mediaFilenames {
+		mediaSource := mediaMap[mediaFilename]
+		data, mediaType, err := fetch(mediaSource, mediaFilename)
+		if err == nil {
+			mediaType, err = e.manifestMediaType(mediaSource, mediaType, mediaFolderName, mediaFilename)
+		}
+		// Images in formats that older readers can't display are converted
+		// when possible, otherwise they're kept as is
+		if err == nil && e.convertsImage(mediaFolderName, mediaFilename, mediaType) {
+			if converted, convertedType, convertErr := convertImageData(data); convertErr == nil {
+				data, mediaType = converted, convertedType
+				// The converted image is written with the extension of its
+				// format
+				e.renameWrittenMedia(mediaFolderName, mediaFilename, mediaType)
+			}
+		}
+		// Fonts that can't be subset (e.g. fonts with CFF outlines) are kept
+		// as is
+		if err == nil && runes != nil {
+			if subset, subsetErr := subsetFont(data, runes); subsetErr == nil {
+				data = subset
+			}
+		}
+		// CSS retrieved in another encoding is transcoded, since readers only
+		// support UTF-8 and UTF-16
+		if err == nil && mediaFolderName == CSSFolderName {
+			data = utf8CSS(data, g.mediaCharset(mediaSource))
+		}
+		if err == nil && e.kindle && mediaFolderName == CSSFolderName {
+			data = kindleCSS(data)
+		}
+		e.progress.fileDone(path.Join(contentFolderName, mediaFolderName, mediaFilename))
+		if err != nil {
+			data, mediaType, err = e.mediaFailureReplacement(path.Join(contentFolderName, mediaFolderName, mediaFilename), mediaFolderName, err)
+			if err != nil {
+				return err
+			}
+			// The media has been skipped
+			if data == nil {
+				continue
+			}
+			// The placeholder is written with the extension of its format
+			e.renameWrittenMedia(mediaFolderName, mediaFilename, mediaType)
+		}
+		if err := w(path.Join(contentFolderName, e.writtenMediaPath(path.Join(mediaFolderName, mediaFilename))), mediaType, data); err != nil {
+			return err
+		}
+		e.addMediaToManifest(mediaFolderName, mediaFilename, mediaType)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package epub
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 )
@@ -29,13 +30,15 @@ type xhtml struct {
 type xhtmlRoot struct {
 	XMLName   xml.Name      `xml:"http://www.w3.org/1999/xhtml html"`
 	XmlnsEpub string        `xml:"xmlns:epub,attr,omitempty"`
+	Lang      string        `xml:"lang,attr,omitempty"`
+	XMLLang   string        `xml:"xml:lang,attr,omitempty"`
 	Head      xhtmlHead     `xml:"head"`
 	Body      xhtmlInnerxml `xml:"body"`
 }
 
 type xhtmlHead struct {
-	Title xhtmlTitle `xml:"title"`
-	Link  *xhtmlLink
+	Title xhtmlTitle  `xml:"title"`
+	Links []xhtmlLink `xml:"link"`
 }
 
 type xhtmlTitle struct {
@@ -57,37 +60,36 @@ type xhtmlLink struct {
 // implemented as a string because we don't know what it will contain and we
 // leave it up to the user of the package to validate the content
 type xhtmlInnerxml struct {
-	XML string `xml:",innerxml"`
-	Dir string `xml:"dir,attr,omitempty"`
+	XML      string `xml:",innerxml"`
+	Dir      string `xml:"dir,attr,omitempty"`
+	EpubType string `xml:"epub:type,attr,omitempty"`
 }
 
 // Constructor for xhtml
-func newXhtml(body string) *xhtml {
+func newXhtml(body string) (*xhtml, error) {
+	root, err := newXhtmlRoot()
+	if err != nil {
+		return nil, err
+	}
 	x := &xhtml{
-		xml: newXhtmlRoot(),
+		xml: root,
 	}
 	x.setBody(body)
 
-	return x
+	return x, nil
 }
 
 // Constructor for xhtmlRoot
-func newXhtmlRoot() *xhtmlRoot {
+func newXhtmlRoot() (*xhtmlRoot, error) {
 	r := &xhtmlRoot{
 		Body: xhtmlInnerxml{Dir: "auto"},
 	}
 	err := xml.Unmarshal([]byte(xhtmlTemplate), &r)
 	if err != nil {
-		panic(fmt.Sprintf(
-			"Error unmarshalling xhtmlRoot: %s\n"+
-				"\txhtmlRoot=%#v\n"+
-				"\txhtmlTemplate=%s",
-			err,
-			*r,
-			xhtmlTemplate))
+		return nil, fmt.Errorf("error unmarshalling xhtmlRoot: %w", err)
 	}
 
-	return r
+	return r, nil
 }
 
 func (x *xhtml) setBody(body string) {
@@ -95,14 +97,29 @@ func (x *xhtml) setBody(body string) {
 	x.xml.Body.Dir = "auto"
 }
 
-func (x *xhtml) setCSS(path string) {
-	x.xml.Head.Link = &xhtmlLink{
-		Rel:  xhtmlLinkRel,
-		Type: mediaTypeCSS,
-		Href: path,
+// Link the XHTML document to the stylesheets, in order
+func (x *xhtml) setCSS(paths ...string) {
+	x.xml.Head.Links = nil
+	for _, path := range paths {
+		x.xml.Head.Links = append(x.xml.Head.Links, xhtmlLink{
+			Rel:  xhtmlLinkRel,
+			Type: mediaTypeCSS,
+			Href: path,
+		})
 	}
 }
 
+// Set the language of the XHTML document, both as lang and xml:lang
+func (x *xhtml) setLang(lang string) {
+	x.xml.Lang = lang
+	x.xml.XMLLang = lang
+}
+
+// Set the epub:type of the body, e.g. chapter
+func (x *xhtml) setEpubType(epubType string) {
+	x.xml.Body.EpubType = epubType
+}
+
 func (x *xhtml) setTitle(title string) {
 	x.xml.Head.Title = xhtmlTitle{
 		Dir:   "auto",
@@ -118,8 +135,17 @@ func (x *xhtml) Title() string {
 	return x.xml.Head.Title.Value
 }
 
-// Write the XHTML file to the specified path
-func (x *xhtml) write(xhtmlFilePath string) {
+// bodyLine returns the line of the XHTML file where the body content starts,
+// starting at 1
+func (x *xhtml) bodyLine() int {
+	content := x.content()
+	bodyStart := bytes.Index(content, []byte("<body"))
+	bodyStart += bytes.IndexByte(content[bodyStart:], '>') + 1
+	return bytes.Count(content[:bodyStart], []byte("\n")) + 1
+}
+
+// content returns the content of the XHTML file
+func (x *xhtml) content() []byte {
 	xhtmlFileContent, err := xml.MarshalIndent(x.xml, "", "  ")
 	if err != nil {
 		panic(fmt.Sprintf(
@@ -136,7 +162,5 @@ func (x *xhtml) write(xhtmlFilePath string) {
 	// It's generally nice to have files end with a newline
 	xhtmlFileContent = append(xhtmlFileContent, "\n"...)
 
-	if err := filesystem.WriteFile(xhtmlFilePath, []byte(xhtmlFileContent), filePermissions); err != nil {
-		panic(fmt.Sprintf("Error writing XHTML file: %s", err))
-	}
+	return xhtmlFileContent
 }